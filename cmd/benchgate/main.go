@@ -0,0 +1,142 @@
+// Command benchgate compares two `go test -bench` outputs and exits non-zero when a
+// benchmark of the new run regressed past the threshold. Runs repeated with -count are
+// reduced to their median. Allocations are compared exactly because they do not depend
+// on the machine; time is compared with the threshold.
+//
+// Usage: benchgate [-threshold 20] baseline.txt current.txt
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// procsSuffix is the -GOMAXPROCS suffix go test adds to benchmark names
+var procsSuffix = regexp.MustCompile(`-\d+$`)
+
+type samples struct {
+	nsPerOp     []float64
+	allocsPerOp []float64
+}
+
+func main() {
+	threshold := flag.Float64("threshold", 20, "allowed slowdown in percent")
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: benchgate [-threshold percent] baseline.txt current.txt")
+		os.Exit(2)
+	}
+
+	baseline, err := parseFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	current, err := parseFile(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	regressions := compare(baseline, current, *threshold)
+	for _, regression := range regressions {
+		fmt.Println(regression)
+	}
+	if len(regressions) > 0 {
+		fmt.Printf("%d benchmark(s) regressed\n", len(regressions))
+		os.Exit(1)
+	}
+	fmt.Println("No benchmark regressed")
+}
+
+func parseFile(path string) (map[string]*samples, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	results := make(map[string]*samples)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+
+		name := procsSuffix.ReplaceAllString(fields[0], "")
+		sample := results[name]
+		if sample == nil {
+			sample = &samples{}
+			results[name] = sample
+		}
+
+		// after the name and iteration count come value/unit pairs
+		for i := 2; i+1 < len(fields); i += 2 {
+			value, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				continue
+			}
+			switch fields[i+1] {
+			case "ns/op":
+				sample.nsPerOp = append(sample.nsPerOp, value)
+			case "allocs/op":
+				sample.allocsPerOp = append(sample.allocsPerOp, value)
+			}
+		}
+	}
+
+	return results, scanner.Err()
+}
+
+// compare lists the benchmarks of current slower than the threshold or allocating more
+// than in baseline. Benchmarks missing from either side are ignored.
+func compare(baseline, current map[string]*samples, threshold float64) []string {
+	names := make([]string, 0, len(current))
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var regressions []string
+	for _, name := range names {
+		old, exists := baseline[name]
+		if !exists {
+			continue
+		}
+		now := current[name]
+
+		if oldTime, newTime := median(old.nsPerOp), median(now.nsPerOp); oldTime > 0 && newTime > 0 {
+			if change := (newTime - oldTime) / oldTime * 100; change > threshold {
+				regressions = append(regressions, fmt.Sprintf("%s: %.1f ns/op -> %.1f ns/op (+%.1f%%)", name, oldTime, newTime, change))
+			}
+		}
+		if len(old.allocsPerOp) > 0 && len(now.allocsPerOp) > 0 {
+			if oldAllocs, newAllocs := median(old.allocsPerOp), median(now.allocsPerOp); newAllocs > oldAllocs {
+				regressions = append(regressions, fmt.Sprintf("%s: %.0f allocs/op -> %.0f allocs/op", name, oldAllocs, newAllocs))
+			}
+		}
+	}
+	return regressions
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
@@ -1,32 +1,395 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	ratelimiter "rate-limiter"
+	"rate-limiter/decision"
 	"rate-limiter/middleware"
 	"rate-limiter/rest"
+	"rate-limiter/rls"
 	"rate-limiter/storage"
+
+	"google.golang.org/grpc"
 )
 
 func main() {
-	appConfig, err := storage.LoadConfig()
+	configPath := flag.String("config", "", "YAML or JSON config file; environment variables override its values")
+	migrateEnvToStore := flag.Bool("migrate-env-to-store", false, "import TOKEN_* env configuration into the storage-backed token store and exit")
+	migrateOverwrite := flag.Bool("migrate-overwrite", false, "overwrite tokens already in the store when migrating")
+	flag.Parse()
+
+	env := storage.SnapshotEnv()
+
+	secrets, err := storage.LoadSecrets(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load secrets: %v", err)
+	}
+
+	// an empty environment loads the defaults, so an error is a value set wrong, and
+	// starting anyway would throw away the rest of the configuration with it
+	appConfig, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	snapshotRecorder, err := newSnapshotRecorder(appConfig)
+	if err != nil {
+		log.Fatalf("Failed to open the snapshot sink: %v", err)
+	}
+
+	if secrets != nil && secrets.Has("REDIS_PASSWORD") {
+		appConfig.Storage.PasswordProvider = func() string {
+			return secrets.Get("REDIS_PASSWORD")
+		}
+	}
+
+	rateLimitStorage, err := storage.NewStorage(appConfig.Storage)
+	if err != nil {
+		log.Fatalf("Failed to connect to the storage: %v", err)
+	}
+	backendStorage := rateLimitStorage
+
+	if appConfig.Storage.CoalesceEnabled {
+		rateLimitStorage = storage.NewCoalescingStorage(rateLimitStorage)
+	}
+
+	if appConfig.Storage.RetryAttempts > 0 {
+		backoff := time.Duration(appConfig.Storage.RetryBackoff) * time.Millisecond
+		rateLimitStorage = storage.NewRetryStorage(rateLimitStorage, appConfig.Storage.RetryAttempts, backoff)
+	}
+
+	if appConfig.Storage.FallbackEnabled {
+		timeout := time.Duration(appConfig.Storage.FallbackTimeout) * time.Millisecond
+		probeInterval := time.Duration(appConfig.Storage.FallbackProbeInterval) * time.Second
+		rateLimitStorage = storage.NewFallbackStorage(rateLimitStorage, timeout, probeInterval)
+	}
+
+	if appConfig.Storage.WriteBehindEnabled {
+		flushInterval := time.Duration(appConfig.Storage.WriteBehindFlushInterval) * time.Millisecond
+		rateLimitStorage = storage.NewWriteBehindStorage(rateLimitStorage, flushInterval, appConfig.Storage.WriteBehindMaxPending)
+	}
+
+	if appConfig.Storage.LocalCacheEnabled {
+		counterTTL := time.Duration(appConfig.Storage.LocalCacheCounterTTL) * time.Millisecond
+		blockTTL := time.Duration(appConfig.Storage.LocalCacheBlockTTL) * time.Millisecond
+		localCache := storage.NewLocalCacheStorage(rateLimitStorage, counterTTL, blockTTL, appConfig.Storage.LocalCacheSize)
+		if appConfig.Storage.LocalCacheShareBlocks {
+			shareBlocks(localCache, backendStorage)
+		}
+		rateLimitStorage = localCache
+	}
+
+	readOnly := storage.NewReadOnlyStorage(rateLimitStorage, appConfig.Storage.ReadOnly)
+	if readOnly.IsReadOnly() {
+		slog.Info("Starting in read-only mode, counters will not be written")
+	}
+	rateLimitStorage = readOnly
+
+	// the default scope shares the backend with the apps without seeing their data
+	rateLimiterService := middleware.NewService(appConfig.RateLimit, storage.NewDefaultScopeStorage(rateLimitStorage))
+
+	var apps []*middleware.App
+	for _, app := range appConfig.Apps {
+		apps = append(apps, &middleware.App{
+			Name:       app.Name,
+			Hosts:      app.Hosts,
+			PathPrefix: app.PathPrefix,
+			Service:    middleware.NewService(app.RateLimit, storage.NewNamespacedStorage(rateLimitStorage, app.Name)),
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	services := []*middleware.Service{rateLimiterService}
+	for _, app := range apps {
+		services = append(services, app.Service)
+	}
+	for _, service := range services {
+		service.SetReadOnlySwitch(readOnly)
+	}
+
+	if *migrateEnvToStore {
+		migrateTokens(ctx, rateLimiterService, apps, *migrateOverwrite)
+		return
+	}
+
+	reloader := &configReloader{
+		env:        env,
+		configPath: *configPath,
+		secrets:    secrets,
+		service:    rateLimiterService,
+		apps:       apps,
+	}
+	rateLimiterService.SetReloader(reloader.Reload)
+	go reloader.watchSIGHUP(ctx)
+
+	if secrets != nil && storage.SecretsRefreshInterval() > 0 {
+		go secrets.Watch(ctx, storage.SecretsRefreshInterval(), func(changed []string) {
+			applyRotatedSecrets(ctx, reloader, changed)
+		})
+	}
+
+	for _, service := range services {
+		service.SetSnapshotRecorder(snapshotRecorder)
+		if err := service.SeedDenylist(ctx); err != nil {
+			slog.Warn("Failed to seed denylist", "error", err)
+		}
+		if !service.IsReadOnly() {
+			if err := service.SeedTokens(ctx); err != nil {
+				slog.Warn("Failed to seed the token registry", "error", err)
+			}
+		}
+		if err := service.SyncTokenConfigs(ctx); err != nil {
+			slog.Warn("Failed to load token configs", "error", err)
+		}
+		go service.RunSync(ctx, time.Duration(service.Config().SyncInterval)*time.Second)
+		go service.RunUsageFlush(ctx, time.Second)
+		go service.RunRejectionFlush(ctx, time.Second)
+		go service.RunQuotaAlerts(ctx)
+	}
+
+	go rateLimiterService.RunCanary(ctx)
+
+	if emitter := middleware.NewBlockEventEmitter(appConfig.RateLimit.BlockEventsSocket); emitter != nil {
+		for _, service := range services {
+			go emitter.Run(ctx, service)
+		}
+		slog.Info("Emitting block events", "socket", appConfig.RateLimit.BlockEventsSocket)
+	}
+
+	elector := middleware.NewElector(rateLimitStorage, "background-jobs", time.Duration(appConfig.RateLimit.LeaderLeaseTTL)*time.Second)
+	rateLimiterService.SetElector(elector)
+	go elector.Run(ctx)
+
+	if appConfig.RateLimit.MaxBlockTime > 0 && appConfig.RateLimit.BlockSweepInterval > 0 {
+		go rateLimiterService.RunBlockSweep(ctx, time.Duration(appConfig.RateLimit.BlockSweepInterval)*time.Second)
+	}
+
+	if appConfig.RateLimit.UsageEnabled {
+		go rateLimiterService.RunUsageRollup(ctx, time.Duration(appConfig.RateLimit.UsageRollupInterval)*time.Second)
+
+		archive, err := storage.NewObjectStore(appConfig.RateLimit)
+		if err != nil {
+			log.Fatalf("Failed to open usage archive: %v", err)
+		}
+		if archive != nil {
+			rateLimiterService.SetUsageArchive(archive)
+			go rateLimiterService.RunUsageArchive(ctx, time.Duration(appConfig.RateLimit.ArchiveInterval)*time.Second, time.Duration(appConfig.RateLimit.ArchiveAfterHours)*time.Hour)
+		}
+	}
+
+	var r http.Handler
+	if upstream := appConfig.RateLimit.UpstreamURL; upstream != "" {
+		proxyOpts := []rest.ProxyOption{rest.WithResponseFormat(rateLimiterService.ResponseFormat())}
+		if appConfig.RateLimit.ProxyStripAPIKey {
+			proxyOpts = append(proxyOpts, rest.WithStrippedAPIKey(appConfig.RateLimit))
+		}
+		proxy, err := rest.NewProxy(upstream, proxyOpts...)
+		if err != nil {
+			log.Fatalf("Failed to set up proxy: %v", err)
+		}
+		r = rest.SetupProxyRouter(rateLimiterService, proxy, apps...)
+		slog.Info("Proxying allowed requests", "upstream", upstream)
+	} else {
+		r = rest.SetupRouter(rateLimiterService, apps...)
+	}
+	server, err := rest.NewServer(appConfig.RateLimit, r)
 	if err != nil {
-		log.Printf("Warning: Failed to load configuration, using defaults: %v", err)
-		appConfig = storage.GetDefaultConfig()
+		log.Fatalf("Failed to set up TLS: %v", err)
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("Server starting", "addr", server.Addr, "tls", server.TLSConfig != nil)
+		serverErr <- rest.ListenAndServe(server)
+	}()
+
+	grpcServers := startGRPCServers(rateLimiterService, appConfig.RateLimit, serverErr)
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server failed: %v", err)
+		}
+	case <-ctx.Done():
+		slog.Info("Shutting down, draining in-flight requests")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RateLimit.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Server shutdown did not complete", "error", err)
+	}
+
+	for _, grpcServer := range grpcServers {
+		grpcServer.GracefulStop()
+	}
+
+	if err := elector.Resign(shutdownCtx); err != nil {
+		slog.Warn("Failed to release leadership", "error", err)
+	}
+
+	for _, service := range services {
+		if err := service.FlushUsage(shutdownCtx); err != nil {
+			slog.Warn("Failed to flush usage", "error", err)
+		}
+		if err := service.FlushRejections(shutdownCtx); err != nil {
+			slog.Warn("Failed to flush rejection counters", "error", err)
+		}
 	}
 
-	redisStorage, err := storage.NewRedisStorage(appConfig.Storage)
+	if snapshotRecorder != nil {
+		if err := snapshotRecorder.Close(); err != nil {
+			slog.Warn("Failed to close snapshot sink", "error", err)
+		}
+	}
+
+	if err := rateLimitStorage.Close(); err != nil {
+		slog.Warn("Failed to close storage", "error", err)
+	}
+
+	slog.Info("Server stopped")
+}
+
+// startGRPCServers serves the Envoy RateLimitService on RLS_PORT and the
+// ratelimiter.v1.RateLimitService on GRPC_PORT, with one server when the ports are the
+// same; an unset port disables its service
+func startGRPCServers(service *middleware.Service, config storage.Config, serverErr chan<- error) []*grpc.Server {
+	servers := make(map[string]*grpc.Server)
+	serve := func(port string, register func(*grpc.Server)) {
+		if port == "" {
+			return
+		}
+		if servers[port] == nil {
+			servers[port] = grpc.NewServer()
+		}
+		register(servers[port])
+	}
+	serve(config.RLSPort, rls.NewServer(service).Register)
+	serve(config.GRPCPort, decision.NewServer(service).Register)
+
+	started := make([]*grpc.Server, 0, len(servers))
+	for port, server := range servers {
+		listener, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			log.Fatalf("Failed to listen for gRPC on port %s: %v", port, err)
+		}
+
+		go func(port string, server *grpc.Server) {
+			slog.Info("gRPC server starting", "port", port)
+			if err := server.Serve(listener); err != nil {
+				serverErr <- err
+			}
+		}(port, server)
+		started = append(started, server)
+	}
+
+	return started
+}
+
+func loadConfig(path string) (storage.AppConfig, error) {
+	load := storage.LoadConfig
+	if path != "" {
+		load = func() (storage.AppConfig, error) {
+			return storage.LoadConfigFromFile(path)
+		}
+	}
+
+	appConfig, err := load()
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		return appConfig, err
+	}
+
+	slog.SetDefault(storage.NewLogger(os.Stderr, appConfig.Log))
+	for _, warning := range appConfig.Warnings() {
+		slog.Warn(warning)
+	}
+	return appConfig, nil
+}
+
+func migrateTokens(ctx context.Context, service *middleware.Service, apps []*middleware.App, overwrite bool) {
+	printMigrationReport(ctx, "default", service, overwrite)
+	for _, app := range apps {
+		printMigrationReport(ctx, "app "+app.Name, app.Service, overwrite)
+	}
+}
+
+func printMigrationReport(ctx context.Context, scope string, service *middleware.Service, overwrite bool) {
+	report, err := service.MigrateEnvTokens(ctx, overwrite)
+	if err != nil {
+		log.Fatalf("Failed to migrate env tokens (%s): %v", scope, err)
+	}
+
+	fmt.Printf("Token migration (%s):\n", scope)
+	fmt.Printf("  imported:  %d [%s]\n", len(report.Imported), strings.Join(report.Imported, ", "))
+	fmt.Printf("  skipped:   %d [%s] (already in store)\n", len(report.Skipped), strings.Join(report.Skipped, ", "))
+	fmt.Printf("  defaulted: %d [%s] (missing limit or block time, IP defaults applied)\n", len(report.Defaulted), strings.Join(report.Defaulted, ", "))
+}
+
+// applyRotatedSecrets reloads the configuration when a rotated secret feeds it; the Redis
+// password applies on the next connection without a reload
+func applyRotatedSecrets(ctx context.Context, reloader *configReloader, changed []string) {
+	needsReload := false
+	for _, name := range changed {
+		slog.Info("Secret rotated", "secret", name)
+		if name != "REDIS_PASSWORD" {
+			needsReload = true
+		}
 	}
 
-	rateLimiterService := middleware.NewService(appConfig.RateLimit, redisStorage)
+	if needsReload {
+		if err := reloader.Reload(ctx); err != nil {
+			slog.Error("Failed to reload configuration after secret rotation", "error", err)
+		}
+	}
+}
 
-	r := rest.SetupRouter(rateLimiterService)
-	port := rest.GetServerPort(appConfig.RateLimit)
+// newSnapshotRecorder returns nil when snapshot sampling is disabled
+func newSnapshotRecorder(appConfig storage.AppConfig) (*middleware.SnapshotRecorder, error) {
+	config := appConfig.RateLimit
+	if config.SnapshotSampleRate <= 0 {
+		return nil, nil
+	}
 
-	fmt.Printf("Server starting on port %s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	var sink middleware.SnapshotSink
+	var err error
+	switch config.SnapshotSink {
+	case "file":
+		sink, err = storage.NewFileSink(config.SnapshotFile, config.SnapshotFileMaxBytes)
+	default:
+		sink, err = storage.NewRedisStreamSink(appConfig.Storage, config.SnapshotStream, config.SnapshotMaxEntries)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return middleware.NewSnapshotRecorder(sink, config.SnapshotSampleRate, config.SnapshotMaxPerSecond, config.SnapshotMaxBodyBytes, config.SnapshotRedactHeaders), nil
+}
+
+// shareBlocks relays the blocks of the local cache between the instances for as long as
+// the process runs, when the storage backend can broadcast them
+func shareBlocks(localCache *storage.LocalCacheStorage, backend ratelimiter.Storage) {
+	broadcaster, ok := backend.(ratelimiter.BlockBroadcaster)
+	if !ok {
+		slog.Warn("The storage backend can't broadcast blocks, blocks stay local to each instance")
+		return
+	}
+	if err := localCache.ShareBlocks(context.Background(), broadcaster); err != nil {
+		slog.Warn("Failed to subscribe to the blocks of the other instances, blocks stay local", "error", err)
+	}
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain runs the service itself when a test starts the test binary through
+// runMain, so the tests can watch a startup that ends the process
+func TestMain(m *testing.M) {
+	if os.Getenv("RATE_LIMITER_RUN_MAIN") == "true" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runMain starts the service with the extra environment variables and returns its
+// output once it exits, killing it if it is still running after 30 seconds
+func runMain(t *testing.T, env ...string) (string, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0])
+	cmd.Env = append(os.Environ(), append([]string{"RATE_LIMITER_RUN_MAIN=true"}, env...)...)
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+func TestInvalidConfigurationStopsStartup(t *testing.T) {
+	for name, value := range map[string]string{
+		"IP_BLOCK_TIME":          "-1",
+		"TOKEN_ALPHA_BLOCK_TIME": "-1",
+		"ROUTE_COSTS":            "/search",
+		"QUOTA_ALERT_THRESHOLDS": "150",
+		"ROUTE_POLICIES":         "/api/*",
+		"API_SUNSET":             "/v1=someday",
+		"MTLS_IDENTITY_LIMITS":   "svc",
+		"NETWORK_LIMITS":         "/24",
+		"REFUND_STATUSES":        "6xx",
+		"FAILURE_STATUSES":       "6xx",
+		"POLICY_RULES":           "/api/*=missing",
+		"GEOIP_DATABASES":        "/missing/GeoLite2-Country.mmdb",
+		"TRUSTED_PROXIES":        "10.0.0.0/33",
+		"API_KEY_PATTERN":        "[a-z",
+		"JWT_PUBLIC_KEY_FILE":    "/missing/jwt.pem",
+		"MESSAGES_FILE":          "/missing/messages.json",
+	} {
+		t.Run(name, func(t *testing.T) {
+			output, err := runMain(t, name+"="+value)
+			var exitErr *exec.ExitError
+			require.ErrorAs(t, err, &exitErr, "the service started: %s", output)
+			assert.Contains(t, output, "Failed to load configuration: ")
+			assert.Contains(t, output, name, "the error names the variable")
+			assert.NotContains(t, output, "Failed to connect to the storage", "the service stopped before it")
+		})
+	}
+}
+
+func TestUnreadableDenylistFileStopsStartup(t *testing.T) {
+	output, err := runMain(t, "DENYLIST_FILE="+t.TempDir()+"/missing.txt")
+	var exitErr *exec.ExitError
+	require.ErrorAs(t, err, &exitErr, "the service started: %s", output)
+	assert.Contains(t, output, "Failed to load configuration: failed to load DENYLIST_FILE")
+	assert.NotContains(t, output, "Failed to connect to the storage", "the service stopped before it, with no denylist")
+}
+
+func TestUnopenableSnapshotSinkStopsStartup(t *testing.T) {
+	output, err := runMain(t, "SNAPSHOT_SAMPLE_RATE=1", "SNAPSHOT_SINK=file", "SNAPSHOT_FILE="+t.TempDir()+"/missing/snapshots.jsonl")
+	var exitErr *exec.ExitError
+	require.ErrorAs(t, err, &exitErr, "the service started: %s", output)
+	assert.Contains(t, output, "Failed to open the snapshot sink")
+	assert.NotContains(t, output, "Failed to connect to the storage", "the service stopped before it")
+}
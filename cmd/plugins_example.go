@@ -0,0 +1,7 @@
+//go:build example_plugins
+
+package main
+
+// Extensions are linked in by files like this one, each behind a build tag of its own,
+// so the default binary carries none of them
+import _ "rate-limiter/plugins/example"
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+)
+
+// diff compares two storages and prints what drifted, reporting whether anything did
+func diff(args []string) (bool, error) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	source := fs.String("source", "", "source storage URL (redis://, rediss://, etcd://, etcds:// or disk://)")
+	target := fs.String("target", "", "target storage URL")
+	countTolerance := fs.Int("count-tolerance", 0, "also report counters whose counts differ by more than this (0 compares block state only)")
+	configOnly := fs.Bool("config-only", false, "compare the denylist and token registry, not the counters")
+	asJSON := fs.Bool("json", false, "print the drift as JSON")
+	timeout := fs.Duration("timeout", time.Minute, "timeout of the whole comparison")
+	fs.Parse(args)
+
+	if *source == "" || *target == "" {
+		return false, fmt.Errorf("both --source and --target are required")
+	}
+
+	sourceStorage, err := openStorage(*source)
+	if err != nil {
+		return false, fmt.Errorf("source: %w", err)
+	}
+	defer sourceStorage.Close()
+	targetStorage, err := openStorage(*target)
+	if err != nil {
+		return false, fmt.Errorf("target: %w", err)
+	}
+	defer targetStorage.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	drifts, err := storage.Diff(ctx, sourceStorage, targetStorage, storage.DiffOptions{
+		CountTolerance: *countTolerance,
+		SkipKeys:       *configOnly,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if *asJSON {
+		if drifts == nil {
+			drifts = []storage.Drift{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return len(drifts) > 0, encoder.Encode(drifts)
+	}
+
+	for _, drift := range drifts {
+		fmt.Printf("%-12s %s\n", drift.Kind, drift.Name)
+		fmt.Printf("  - source: %s\n", describeSide(drift.Source))
+		fmt.Printf("  + target: %s\n", describeSide(drift.Target))
+	}
+	fmt.Printf("%d difference(s)\n", len(drifts))
+	return len(drifts) > 0, nil
+}
+
+func openStorage(raw string) (ratelimiter.Storage, error) {
+	config, err := storage.ParseURL(raw)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewStorage(config)
+}
+
+func describeSide(description string) string {
+	if description == "" {
+		return "(missing)"
+	}
+	return description
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"rate-limiter/middleware"
+)
+
+type filterFlags []string
+
+func (f *filterFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *filterFlags) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("filter must be in the form name=value")
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "tail":
+		if err := tail(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "diff":
+		drifted, err := diff(os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		if drifted {
+			os.Exit(1)
+		}
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: ratelimitctl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  tail    stream live rate limit decisions")
+	fmt.Fprintln(os.Stderr, "  diff    compare the configuration and state of two storages")
+}
+
+func tail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	server := fs.String("url", getEnvOrDefault("RATELIMIT_URL", "http://localhost:8080"), "rate limiter base URL")
+	token := fs.String("token", os.Getenv("RATELIMIT_ADMIN_TOKEN"), "admin token")
+	app := fs.String("app", "", "app namespace to tail")
+	asJSON := fs.Bool("json", false, "print raw JSON decisions")
+	var filters filterFlags
+	fs.Var(&filters, "filter", "filter as name=value (key, client_ip, host, reason, allowed); repeatable")
+	fs.Parse(args)
+
+	endpoint := strings.TrimSuffix(*server, "/") + "/admin/v2"
+	if *app != "" {
+		endpoint += "/apps/" + *app
+	}
+
+	query := url.Values{}
+	for _, filter := range filters {
+		name, value, _ := strings.Cut(filter, "=")
+		query.Set(name, value)
+	}
+	endpoint += "/decisions?" + query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Authorization", "Bearer "+*token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+
+		if *asJSON {
+			fmt.Println(data)
+			continue
+		}
+
+		var decision middleware.Decision
+		if err := json.Unmarshal([]byte(data), &decision); err != nil {
+			continue
+		}
+		printDecision(decision)
+	}
+
+	return scanner.Err()
+}
+
+func printDecision(decision middleware.Decision) {
+	verdict := "ALLOW"
+	if !decision.Allowed {
+		verdict = "BLOCK"
+	}
+
+	fmt.Printf("%s %s %-24s %-15s %s %s (%s)\n",
+		decision.Time.Format(time.TimeOnly), verdict, decision.Key, decision.ClientIP,
+		decision.Method, decision.Path, decision.Reason)
+}
+
+func getEnvOrDefault(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
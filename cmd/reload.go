@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"rate-limiter/middleware"
+	"rate-limiter/storage"
+)
+
+// configReloader re-reads .env, the config file and secrets over the environment the
+// process started with, and applies the result to every running service
+type configReloader struct {
+	mu         sync.Mutex
+	env        storage.EnvSnapshot
+	configPath string
+	secrets    *storage.Secrets
+	service    *middleware.Service
+	apps       []*middleware.App
+}
+
+func (c *configReloader) Reload(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.env.Restore()
+	if c.secrets != nil {
+		if _, err := c.secrets.Refresh(ctx); err != nil {
+			return err
+		}
+	}
+
+	appConfig, err := loadConfig(c.configPath)
+	if err != nil {
+		return err
+	}
+
+	if err := c.service.Reload(ctx, appConfig.RateLimit); err != nil {
+		return err
+	}
+
+	configured := make(map[string]storage.AppNamespace, len(appConfig.Apps))
+	for _, app := range appConfig.Apps {
+		configured[app.Name] = app
+	}
+
+	for _, app := range c.apps {
+		namespace, exists := configured[app.Name]
+		if !exists {
+			slog.Warn("App is no longer configured, restart to remove it", "app", app.Name)
+			continue
+		}
+		if err := app.Service.Reload(ctx, namespace.RateLimit); err != nil {
+			return err
+		}
+		delete(configured, app.Name)
+	}
+	for name := range configured {
+		slog.Warn("App was added, restart to serve it", "app", name)
+	}
+
+	slog.Info("Configuration reloaded")
+	return nil
+}
+
+// watchSIGHUP reloads the configuration on every SIGHUP until the context is done
+func (c *configReloader) watchSIGHUP(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			if err := c.Reload(ctx); err != nil {
+				slog.Error("Failed to reload configuration", "error", err)
+			}
+		}
+	}
+}
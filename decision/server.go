@@ -0,0 +1,57 @@
+// Package decision serves the rate limiter over gRPC, so services outside of HTTP, such
+// as queue consumers and workers, can consult it remotely. The API is defined in
+// decisionpb/decision.proto.
+package decision
+
+import (
+	"context"
+
+	"rate-limiter/decision/decisionpb"
+	"rate-limiter/middleware"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Server answers Check with the limits, denylist and storage of the service
+type Server struct {
+	decisionpb.UnimplementedRateLimitServiceServer
+	service *middleware.Service
+}
+
+func NewServer(service *middleware.Service) *Server {
+	return &Server{service: service}
+}
+
+// Register adds the RateLimitService to a gRPC server
+func (s *Server) Register(server *grpc.Server) {
+	decisionpb.RegisterRateLimitServiceServer(server, s)
+}
+
+// Check consumes cost units of the quota of the key; a cost of 0 means 1
+func (s *Server) Check(ctx context.Context, req *decisionpb.CheckRequest) (*decisionpb.CheckResponse, error) {
+	if req.GetKey() == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is required")
+	}
+	if req.GetCost() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "cost must not be negative")
+	}
+	cost := int(req.GetCost())
+	if cost == 0 {
+		cost = 1
+	}
+
+	verdict := s.service.EvaluateKeyContext(ctx, req.GetKey(), "GRPC", decisionpb.RateLimitService_Check_FullMethodName, cost)
+	response := &decisionpb.CheckResponse{
+		Allowed:   verdict.Allowed,
+		Limit:     int32(verdict.Result.Limit),
+		Remaining: int32(max(verdict.Result.Remaining, 0)),
+		Reason:    verdict.Reason,
+	}
+	if !verdict.Allowed && verdict.Result.RetryAfter > 0 {
+		response.RetryAfter = durationpb.New(verdict.Result.RetryAfter)
+	}
+	return response, nil
+}
@@ -0,0 +1,54 @@
+package decision
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"rate-limiter/decision/decisionpb"
+	"rate-limiter/middleware"
+	"rate-limiter/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestServer(config storage.Config) *Server {
+	return NewServer(middleware.NewService(config, storage.NewMemoryStorage()))
+}
+
+func TestCheck(t *testing.T) {
+	server := newTestServer(storage.Config{IPRateLimit: 3, IPBlockTime: 30, TokenLimits: map[string]int{"worker": 10}})
+	req := &decisionpb.CheckRequest{Key: "queue:emails", Cost: 2}
+
+	resp, err := server.Check(context.Background(), req)
+	require.NoError(t, err)
+	assert.True(t, resp.Allowed)
+	assert.Equal(t, int32(3), resp.Limit)
+	assert.Equal(t, int32(1), resp.Remaining)
+	assert.Nil(t, resp.RetryAfter)
+
+	resp, err = server.Check(context.Background(), req)
+	require.NoError(t, err)
+	assert.False(t, resp.Allowed, "the cost does not fit in the remaining unit")
+	assert.Equal(t, "rate_limit", resp.Reason)
+	assert.Equal(t, 30*time.Second, resp.RetryAfter.AsDuration())
+
+	resp, err = server.Check(context.Background(), &decisionpb.CheckRequest{Key: "token:worker"})
+	require.NoError(t, err)
+	assert.True(t, resp.Allowed)
+	assert.Equal(t, int32(10), resp.Limit)
+	assert.Equal(t, int32(9), resp.Remaining, "a cost of 0 counts as 1")
+}
+
+func TestCheckInvalidArgument(t *testing.T) {
+	server := newTestServer(storage.Config{IPRateLimit: 3})
+
+	_, err := server.Check(context.Background(), &decisionpb.CheckRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = server.Check(context.Background(), &decisionpb.CheckRequest{Key: "queue:emails", Cost: -1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
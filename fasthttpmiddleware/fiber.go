@@ -0,0 +1,19 @@
+package fasthttpmiddleware
+
+import (
+	"rate-limiter/middleware"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Fiber returns a Fiber handler limiting requests like RateLimiter; requests over the
+// limit are answered without calling the next handler
+func Fiber(service *middleware.Service, opts ...Option) fiber.Handler {
+	o := newOptions(service, opts)
+	return func(c *fiber.Ctx) error {
+		if !o.limit(service, c.Context()) {
+			return nil
+		}
+		return c.Next()
+	}
+}
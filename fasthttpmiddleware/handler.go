@@ -0,0 +1,181 @@
+// Package fasthttpmiddleware rate limits fasthttp servers, and Fiber apps built on them,
+// with the same Service, limits and storage as the HTTP middleware. fasthttp requests
+// are not *http.Request, so the API key is read and the refusal written here; the
+// extractors registered through API_KEY_EXTRACTORS are not tried.
+//
+// The service does not import this package, so fasthttp and Fiber are only linked into
+// the programs that do.
+package fasthttpmiddleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"rate-limiter/middleware"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Option customizes the handler
+type Option func(*options)
+
+type options struct {
+	headers    []string
+	bearer     bool
+	jwt        bool
+	queryParam string
+	cookie     string
+	costFunc   func(ctx *fasthttp.RequestCtx) int
+	onExceeded func(ctx *fasthttp.RequestCtx, verdict middleware.Verdict)
+}
+
+// WithHeaders overrides the headers the API key is read from. By default they are the
+// API_KEY_HEADERS of the service.
+func WithHeaders(headers ...string) Option {
+	return func(o *options) {
+		o.headers = headers
+	}
+}
+
+// WithCost sets how many units of quota a request consumes; it is 1 by default
+func WithCost(cost func(ctx *fasthttp.RequestCtx) int) Option {
+	return func(o *options) {
+		o.costFunc = cost
+	}
+}
+
+// WithOnLimitExceeded calls fn for every request refused with 429, before the response
+// is written
+func WithOnLimitExceeded(fn func(ctx *fasthttp.RequestCtx, verdict middleware.Verdict)) Option {
+	return func(o *options) {
+		o.onExceeded = fn
+	}
+}
+
+func newOptions(service *middleware.Service, opts []Option) *options {
+	config := service.Config()
+
+	o := &options{
+		headers:    config.APIKeyHeaders,
+		bearer:     config.APIKeyBearer,
+		jwt:        service.VerifiesJWT(),
+		queryParam: config.APIKeyQueryParam,
+		cookie:     config.APIKeyCookie,
+	}
+	if len(o.headers) == 0 {
+		o.headers = []string{"API_KEY"}
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// RateLimiter wraps a fasthttp handler, answering requests over the limit itself
+func RateLimiter(service *middleware.Service, opts ...Option) func(fasthttp.RequestHandler) fasthttp.RequestHandler {
+	o := newOptions(service, opts)
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			if o.limit(service, ctx) {
+				next(ctx)
+			}
+		}
+	}
+}
+
+// limit evaluates the request and answers it when it is refused, reporting whether it
+// may go on to the next handler
+func (o *options) limit(service *middleware.Service, ctx *fasthttp.RequestCtx) bool {
+	cost := 1
+	if o.costFunc != nil {
+		cost = o.costFunc(ctx)
+	}
+
+	verdict := service.EvaluateContext(ctx, clientIP(service, ctx), o.apiKey(ctx), string(ctx.Method()), string(ctx.Path()), cost)
+	if verdict.Allowed {
+		return true
+	}
+
+	acceptLanguage := string(ctx.Request.Header.Peek("Accept-Language"))
+	messages := service.Messages()
+
+	switch verdict.Reason {
+	case "invalid_api_key", "invalid_jwt", "token_disabled", "unknown_token":
+		writeError(service, ctx, http.StatusUnauthorized, messages.FormatLanguage(acceptLanguage, middleware.MessageInvalidAPIKey, 0), 0)
+		return false
+	case "missing_token":
+		writeError(service, ctx, http.StatusUnauthorized, messages.FormatLanguage(acceptLanguage, middleware.MessageTokenRequired, 0), 0)
+		return false
+	case "denylist", "geo_blocked":
+		if service.Config().DenylistStatusCode == http.StatusForbidden {
+			writeError(service, ctx, http.StatusForbidden, messages.FormatLanguage(acceptLanguage, middleware.MessageDenied, 0), 0)
+			return false
+		}
+	}
+
+	if o.onExceeded != nil {
+		o.onExceeded(ctx, verdict)
+	}
+	retryAfter := verdict.Result.RetryAfter
+	writeError(service, ctx, http.StatusTooManyRequests, messages.FormatLanguage(acceptLanguage, middleware.MessageRateLimited, retryAfter), retryAfter)
+	return false
+}
+
+// apiKey returns the API key of the request; a JWT bearer token comes first when the
+// service verifies JWTs, as in the HTTP middleware
+func (o *options) apiKey(ctx *fasthttp.RequestCtx) string {
+	scheme, bearer, hasBearer := strings.Cut(string(ctx.Request.Header.Peek("Authorization")), " ")
+	bearer = strings.TrimSpace(bearer)
+	hasBearer = hasBearer && strings.EqualFold(scheme, "Bearer") && bearer != ""
+	if hasBearer && o.jwt && middleware.LooksLikeJWT(bearer) {
+		return bearer
+	}
+
+	for _, header := range o.headers {
+		if value := strings.TrimSpace(string(ctx.Request.Header.Peek(header))); value != "" {
+			return value
+		}
+	}
+
+	if hasBearer && o.bearer {
+		return bearer
+	}
+	if o.queryParam != "" {
+		if value := string(ctx.QueryArgs().Peek(o.queryParam)); value != "" {
+			return value
+		}
+	}
+	if o.cookie != "" {
+		return string(ctx.Request.Header.Cookie(o.cookie))
+	}
+	return ""
+}
+
+// clientIP resolves the client IP with the trusted proxies of the service, from the
+// peer address and the client IP headers of the request
+func clientIP(service *middleware.Service, ctx *fasthttp.RequestCtx) string {
+	r := &http.Request{RemoteAddr: ctx.RemoteAddr().String(), Header: make(http.Header)}
+	for _, name := range service.ClientIPHeaders() {
+		if value := ctx.Request.Header.Peek(name); len(value) > 0 {
+			r.Header.Set(name, string(value))
+		}
+	}
+	return service.ClientIP(r)
+}
+
+// writeError answers in the error envelope of the service, with a Retry-After rounded
+// up to the second when the client should wait
+func writeError(service *middleware.Service, ctx *fasthttp.RequestCtx, statusCode int, message string, retryAfter time.Duration) {
+	seconds := 0
+	if retryAfter > 0 {
+		seconds = int((retryAfter + time.Second - 1) / time.Second)
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(seconds))
+	}
+
+	contentType, body := service.ResponseFormat().ErrorBody(statusCode, message, seconds)
+	ctx.SetStatusCode(statusCode)
+	ctx.SetContentType(contentType)
+	ctx.SetBody(body)
+}
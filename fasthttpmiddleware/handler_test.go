@@ -0,0 +1,91 @@
+package fasthttpmiddleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"rate-limiter/middleware"
+	"rate-limiter/storage"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func newRequestCtx(ip string, headers ...string) *fasthttp.RequestCtx {
+	var req fasthttp.Request
+	req.SetRequestURI("/api/test")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}, nil)
+	return ctx
+}
+
+func TestRateLimiter(t *testing.T) {
+	service := middleware.NewService(storage.Config{
+		IPRateLimit:   1,
+		IPBlockTime:   30,
+		TokenLimits:   map[string]int{"gold": 2},
+		APIKeyHeaders: []string{"API_KEY"},
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(http.StatusOK)
+	})
+
+	ctx := newRequestCtx("10.0.0.1")
+	handler(ctx)
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+
+	ctx = newRequestCtx("10.0.0.1")
+	handler(ctx)
+	assert.Equal(t, http.StatusTooManyRequests, ctx.Response.StatusCode())
+	assert.Equal(t, "30", string(ctx.Response.Header.Peek("Retry-After")))
+	assert.Equal(t, "application/json", string(ctx.Response.Header.ContentType()))
+	assert.JSONEq(t, `{"error": "you have reached the maximum number of requests or actions allowed within a certain time frame"}`, string(ctx.Response.Body()))
+
+	for i := 0; i < 2; i++ {
+		ctx = newRequestCtx("10.0.0.1", "API_KEY", "gold")
+		handler(ctx)
+		assert.Equal(t, http.StatusOK, ctx.Response.StatusCode(), "the token has a bucket of its own")
+	}
+}
+
+func TestFiber(t *testing.T) {
+	service := middleware.NewService(storage.Config{IPRateLimit: 1, IPBlockTime: 30}, storage.NewMemoryStorage())
+	app := fiber.New()
+	app.Use(Fiber(service))
+	app.Get("/api/test", func(c *fiber.Ctx) error {
+		return c.SendString("ok")
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/test", nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/api/test", nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "the next handler is not called")
+	assert.Equal(t, "30", resp.Header.Get("Retry-After"))
+}
+
+func TestClientIPIgnoresUntrustedForwardedHeaders(t *testing.T) {
+	service := middleware.NewService(storage.Config{IPRateLimit: 10, TrustedProxies: []string{"10.0.0.0/8"}}, storage.NewMemoryStorage())
+
+	assert.Equal(t, "192.168.1.1", clientIP(service, newRequestCtx("192.168.1.1", "X-Forwarded-For", "203.0.113.7")))
+	assert.Equal(t, "203.0.113.7", clientIP(service, newRequestCtx("10.0.0.1", "X-Forwarded-For", "203.0.113.7")))
+}
+
+func TestClientIPHeadersOfTheService(t *testing.T) {
+	service := middleware.NewService(storage.Config{IPRateLimit: 10, TrustedProxies: []string{"10.0.0.0/8"}}, storage.NewMemoryStorage())
+	assert.Equal(t, "203.0.113.7", clientIP(service, newRequestCtx("10.0.0.1", "Forwarded", "for=203.0.113.7")))
+
+	service = middleware.NewService(storage.Config{IPRateLimit: 10, TrustedProxies: []string{"10.0.0.0/8"}, ClientIPHeaders: []string{"True-Client-IP"}}, storage.NewMemoryStorage())
+	assert.Equal(t, "203.0.113.7", clientIP(service, newRequestCtx("10.0.0.1", "True-Client-IP", "203.0.113.7")))
+	assert.Equal(t, "10.0.0.1", clientIP(service, newRequestCtx("10.0.0.1", "X-Forwarded-For", "203.0.113.8")))
+}
@@ -0,0 +1,150 @@
+// Package grpcmiddleware rate limits gRPC servers with the same Service, limits and
+// storage as the HTTP middleware.
+package grpcmiddleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"rate-limiter/middleware"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Option customizes the interceptors
+type Option func(*options)
+
+type options struct {
+	metadataKeys []string
+	bearer       bool
+	jwt          bool
+}
+
+// WithMetadataKeys overrides the metadata keys the API key is read from. By default
+// they are the API_KEY_HEADERS of the service, lowercased.
+func WithMetadataKeys(keys ...string) Option {
+	return func(o *options) {
+		o.metadataKeys = keys
+	}
+}
+
+func newOptions(service *middleware.Service, opts []Option) *options {
+	config := service.Config()
+
+	o := &options{bearer: config.APIKeyBearer, jwt: service.VerifiesJWT()}
+	for _, header := range config.APIKeyHeaders {
+		o.metadataKeys = append(o.metadataKeys, strings.ToLower(header))
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// UnaryServerInterceptor rejects unary calls over the limit with codes.ResourceExhausted
+func UnaryServerInterceptor(service *middleware.Service, opts ...Option) grpc.UnaryServerInterceptor {
+	o := newOptions(service, opts)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := o.check(ctx, service, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor counts each stream once, when it is opened
+func StreamServerInterceptor(service *middleware.Service, opts ...Option) grpc.StreamServerInterceptor {
+	o := newOptions(service, opts)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := o.check(ss.Context(), service, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func (o *options) check(ctx context.Context, service *middleware.Service, fullMethod string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	verdict := service.EvaluateContext(ctx, peerIP(ctx), o.apiKey(md), "GRPC", fullMethod, 1)
+	if verdict.Allowed {
+		return nil
+	}
+
+	acceptLanguage := firstValue(md, "accept-language")
+	messages := service.Messages()
+
+	switch verdict.Reason {
+	case "invalid_api_key", "invalid_jwt", "token_disabled", "unknown_token":
+		return status.Error(codes.Unauthenticated, messages.FormatLanguage(acceptLanguage, middleware.MessageInvalidAPIKey, 0))
+	case "missing_token":
+		return status.Error(codes.Unauthenticated, messages.FormatLanguage(acceptLanguage, middleware.MessageTokenRequired, 0))
+	case "denylist", "geo_blocked":
+		if service.Config().DenylistStatusCode == http.StatusForbidden {
+			return status.Error(codes.PermissionDenied, messages.FormatLanguage(acceptLanguage, middleware.MessageDenied, 0))
+		}
+	}
+
+	retryAfter := verdict.Result.RetryAfter
+	if retryAfter > 0 {
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second))))
+	}
+
+	st := status.New(codes.ResourceExhausted, messages.FormatLanguage(acceptLanguage, middleware.MessageRateLimited, retryAfter))
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// apiKey returns the API key of the call; a JWT bearer token comes first when the
+// service verifies JWTs, as in the HTTP middleware
+func (o *options) apiKey(md metadata.MD) string {
+	bearer, hasBearer := strings.CutPrefix(firstValue(md, "authorization"), "Bearer ")
+	bearer = strings.TrimSpace(bearer)
+	if hasBearer && o.jwt && middleware.LooksLikeJWT(bearer) {
+		return bearer
+	}
+
+	for _, key := range o.metadataKeys {
+		if value := firstValue(md, key); value != "" {
+			return value
+		}
+	}
+
+	if hasBearer && o.bearer {
+		return bearer
+	}
+	return ""
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return strings.TrimSpace(values[0])
+	}
+	return ""
+}
+
+// peerIP returns the IP of the connected peer; forwarded metadata is not trusted
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
@@ -0,0 +1,130 @@
+package grpcmiddleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"rate-limiter/middleware"
+	"rate-limiter/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func newTestService(config storage.Config) *middleware.Service {
+	if config.APIKeyHeaders == nil {
+		config.APIKeyHeaders = []string{"API_KEY"}
+	}
+	return middleware.NewService(config, storage.NewMemoryStorage())
+}
+
+func peerContext(ip string, pairs ...string) context.Context {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 50051},
+	})
+	return metadata.NewIncomingContext(ctx, metadata.Pairs(pairs...))
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	service := newTestService(storage.Config{
+		IPRateLimit:  1,
+		IPBlockTime:  30,
+		TokenLimits:  map[string]int{"gold": 2},
+		APIKeyBearer: true,
+	})
+	interceptor := UnaryServerInterceptor(service)
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Service/Call"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+
+	resp, err := interceptor(peerContext("10.0.0.1"), nil, info, handler)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp)
+
+	_, err = interceptor(peerContext("10.0.0.1"), nil, info, handler)
+	st := status.Convert(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	require.Len(t, st.Details(), 1)
+	retryInfo, ok := st.Details()[0].(*errdetails.RetryInfo)
+	require.True(t, ok)
+	assert.Equal(t, int64(30), retryInfo.RetryDelay.Seconds)
+
+	for i := 0; i < 2; i++ {
+		_, err = interceptor(peerContext("10.0.0.1", "api_key", "gold"), nil, info, handler)
+		assert.NoError(t, err, "tokens are keyed separately from the peer IP")
+	}
+
+	_, err = interceptor(peerContext("10.0.0.2", "authorization", "Bearer gold"), nil, info, handler)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestUnaryServerInterceptorDenylist(t *testing.T) {
+	service := newTestService(storage.Config{
+		IPRateLimit:        10,
+		IPBlockTime:        30,
+		Denylist:           []string{"10.0.0.9"},
+		DenylistStatusCode: http.StatusForbidden,
+	})
+	interceptor := UnaryServerInterceptor(service)
+
+	_, err := interceptor(peerContext("10.0.0.9"), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestUnaryServerInterceptorJWT(t *testing.T) {
+	service := newTestService(storage.Config{
+		IPRateLimit: 10,
+		IPBlockTime: 30,
+		JWTSecret:   "s3cret",
+	})
+	interceptor := UnaryServerInterceptor(service)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+
+	_, err := interceptor(peerContext("10.0.0.1", "api_key", "gold", "authorization", "Bearer e30.e30.bad"), nil, &grpc.UnaryServerInfo{}, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "a JWT bearer token is verified ahead of the API key")
+
+	_, err = interceptor(peerContext("10.0.0.1", "authorization", "Bearer opaque"), nil, &grpc.UnaryServerInfo{}, handler)
+	assert.NoError(t, err, "an opaque bearer token is not a JWT")
+}
+
+type testServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	service := newTestService(storage.Config{IPRateLimit: 1, IPBlockTime: 30})
+	interceptor := StreamServerInterceptor(service, WithMetadataKeys("x-api-key"))
+	info := &grpc.StreamServerInfo{FullMethod: "/test.Service/Stream"}
+
+	opened := 0
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		opened++
+		return nil
+	}
+
+	stream := &testServerStream{ctx: peerContext("10.0.0.1")}
+	assert.NoError(t, interceptor(nil, stream, info, handler))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(interceptor(nil, stream, info, handler)))
+	assert.Equal(t, 1, opened)
+
+	keyed := &testServerStream{ctx: peerContext("10.0.0.1", "x-api-key", "silver")}
+	assert.NoError(t, interceptor(nil, keyed, info, handler))
+}
@@ -0,0 +1,599 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Algorithms supported by Limiter
+const (
+	// AlgorithmFixedWindow counts requests per window and blocks a key that goes
+	// over the limit for the block time. It is what the HTTP server uses.
+	AlgorithmFixedWindow = "fixed_window"
+	// AlgorithmTokenBucket allows bursts up to the limit and refills limit tokens
+	// per window. The block time is not used.
+	AlgorithmTokenBucket = "token_bucket"
+	// AlgorithmLeakyBucket drains limit requests per window at a steady pace into a
+	// bucket of BucketSize requests, so a key can never burst more than the bucket
+	// holds. The block time is not used.
+	AlgorithmLeakyBucket = "leaky_bucket"
+)
+
+// ErrNoStorage is returned by NewLimiter when no storage was given
+var ErrNoStorage = errors.New("ratelimiter: a storage is required")
+
+// Limits are the limit and block time applied to a key. A Limit of 0 blocks every
+// request and a negative Limit allows every request, with any algorithm and without
+// touching the storage. BucketSize is only used by AlgorithmLeakyBucket; below 1 the
+// bucket holds a single request. A positive Window replaces the window of the limiter.
+type Limits struct {
+	Limit      int
+	BlockTime  time.Duration
+	BucketSize int
+	Window     time.Duration
+	Escalation Escalation
+}
+
+// Escalation lengthens the fixed window blocks of repeat offenders: the nth block of a
+// key lasts BlockTime * Factor^(n-1), capped at MaxBlockTime but never shorter than
+// BlockTime. A violation is forgotten every Decay without a new one. A Factor of 1 or
+// less disables it.
+type Escalation struct {
+	Factor       float64
+	MaxBlockTime time.Duration
+	Decay        time.Duration
+}
+
+// Enabled reports whether blocks escalate
+func (e Escalation) Enabled() bool {
+	return e.Factor > 1
+}
+
+// violations returns the violations of the counter still remembered at now
+func (e Escalation) violations(state *RateLimit, now time.Time) int {
+	violations := state.Violations
+	if e.Decay > 0 && violations > 0 {
+		violations -= int(now.Sub(state.ViolatedAt) / e.Decay)
+	}
+	return max(violations, 0)
+}
+
+// BlockFor returns how long the block of a key with that many violations lasts
+func (l Limits) BlockFor(violations int) time.Duration {
+	if !l.Escalation.Enabled() || violations <= 1 {
+		return l.BlockTime
+	}
+
+	block := float64(l.BlockTime) * math.Pow(l.Escalation.Factor, float64(violations-1))
+	if maxBlock := l.Escalation.MaxBlockTime; maxBlock > 0 && block > float64(maxBlock) {
+		return max(maxBlock, l.BlockTime)
+	}
+	if block >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(block)
+}
+
+// BlockedUntil returns when the block of the counter ends, or the zero time when the
+// counter is not blocked at now
+func (l Limits) BlockedUntil(state *RateLimit, now time.Time) time.Time {
+	if state.BlockedAt.IsZero() {
+		return time.Time{}
+	}
+	if until := state.BlockedAt.Add(l.BlockFor(state.Violations)); now.Before(until) {
+		return until
+	}
+	return time.Time{}
+}
+
+// Expiration returns how long after now the fixed window counter of the check has to be
+// kept: until its window ends, its block ends and, with escalation, its violations are
+// forgotten, whichever comes last. A counter that is not blocked expires with its window.
+func (c WindowCheck) Expiration(state *RateLimit, now time.Time) time.Duration {
+	until := state.LastReset.Add(c.Window)
+	if blocked := c.Limits.BlockedUntil(state, now); blocked.After(until) {
+		until = blocked
+	}
+	if state.Violations > 0 && c.Limits.Escalation.Enabled() {
+		if forgotten := state.ViolatedAt.Add(c.Limits.Escalation.Decay * time.Duration(state.Violations)); forgotten.After(until) {
+			until = forgotten
+		}
+	}
+	// a zero expiration keeps the counter forever
+	return max(until.Sub(now), time.Millisecond)
+}
+
+// Result is the outcome of a single Allow call
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	ResetAt    time.Time
+	RetryAfter time.Duration
+}
+
+// Option configures a Limiter
+type Option func(*Limiter)
+
+// WithAlgorithm selects AlgorithmFixedWindow (the default), AlgorithmTokenBucket,
+// AlgorithmLeakyBucket or a strategy registered with RegisterStrategy
+func WithAlgorithm(algorithm string) Option {
+	return func(l *Limiter) {
+		l.algorithm = algorithm
+	}
+}
+
+// WithLimit sets the number of requests allowed per window; the default is 10 per second
+func WithLimit(limit int, window time.Duration) Option {
+	return func(l *Limiter) {
+		l.limits.Limit = limit
+		l.window = window
+	}
+}
+
+// WithBlockTime sets how long a key stays blocked after going over its limit
+func WithBlockTime(blockTime time.Duration) Option {
+	return func(l *Limiter) {
+		l.limits.BlockTime = blockTime
+	}
+}
+
+// WithBucketSize sets how many requests the leaky bucket holds before refusing
+func WithBucketSize(size int) Option {
+	return func(l *Limiter) {
+		l.limits.BucketSize = size
+	}
+}
+
+// WithEscalation lengthens the blocks of keys going over their limit again and again
+func WithEscalation(escalation Escalation) Option {
+	return func(l *Limiter) {
+		l.limits.Escalation = escalation
+	}
+}
+
+// WithLimitFunc picks the limits per key, overriding WithLimit and WithBlockTime
+func WithLimitFunc(limitFunc func(key string) Limits) Option {
+	return func(l *Limiter) {
+		l.limitFunc = limitFunc
+	}
+}
+
+// WithStorage sets where the counters are kept
+func WithStorage(storage Storage) Option {
+	return func(l *Limiter) {
+		l.storage = storage
+	}
+}
+
+// WithClock sets where the limiter reads the current time, time.Now by default. A clock
+// driven by hand makes the decisions deterministic in tests and simulations.
+func WithClock(now func() time.Time) Option {
+	return func(l *Limiter) {
+		l.now = now
+	}
+}
+
+// Limiter rate limits arbitrary keys without any HTTP dependency, so other Go services
+// can embed it directly
+type Limiter struct {
+	storage   Storage
+	algorithm string
+	window    time.Duration
+	limits    Limits
+	limitFunc func(key string) Limits
+	now       func() time.Time
+}
+
+func NewLimiter(opts ...Option) (*Limiter, error) {
+	l := &Limiter{
+		algorithm: AlgorithmFixedWindow,
+		window:    time.Second,
+		limits:    Limits{Limit: 10, BlockTime: 300 * time.Second},
+		now:       time.Now,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	if l.storage == nil {
+		return nil, ErrNoStorage
+	}
+	if !IsAlgorithm(l.algorithm) {
+		return nil, fmt.Errorf("ratelimiter: unknown algorithm %q", l.algorithm)
+	}
+	if l.window <= 0 {
+		return nil, fmt.Errorf("ratelimiter: window must be positive")
+	}
+
+	return l, nil
+}
+
+// Allow consumes one request for the key
+func (l *Limiter) Allow(ctx context.Context, key string) (Result, error) {
+	return l.AllowN(ctx, key, 1)
+}
+
+// AllowN consumes cost units of quota for the key at once
+func (l *Limiter) AllowN(ctx context.Context, key string, cost int) (Result, error) {
+	limits := l.limits
+	if l.limitFunc != nil {
+		limits = l.limitFunc(key)
+	}
+	return l.AllowLimitsN(ctx, key, limits, cost)
+}
+
+// AllowLimits consumes one request for the key under limits chosen by the caller
+func (l *Limiter) AllowLimits(ctx context.Context, key string, limits Limits) (Result, error) {
+	return l.AllowLimitsN(ctx, key, limits, 1)
+}
+
+// AllowLimitsN consumes cost units of quota for the key under limits chosen by the
+// caller. A request is allowed only when the whole cost fits; a cost below 1 counts as 1.
+func (l *Limiter) AllowLimitsN(ctx context.Context, key string, limits Limits, cost int) (Result, error) {
+	if cost < 1 {
+		cost = 1
+	}
+
+	switch {
+	case limits.Limit < 0:
+		return Result{Allowed: true, Limit: limits.Limit, Remaining: -1}, nil
+	case limits.Limit == 0:
+		return Result{}, nil
+	}
+
+	now := l.now()
+	if strategy, registered := lookupStrategy(l.algorithm); registered {
+		return strategy.Allow(ctx, l.storage, key, limits, l.windowOf(limits), cost, now)
+	}
+	if atomic, ok := l.storage.(AtomicStorage); ok && l.algorithm == AlgorithmFixedWindow {
+		result, err := atomic.AllowWindows(ctx, []WindowCheck{{Key: key, Limits: limits, Window: l.windowOf(limits)}}, cost, now)
+		if !errors.Is(err, ErrNotAtomic) {
+			return result, err
+		}
+	}
+
+	rateLimit, err := l.storage.Get(ctx, key)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if rateLimit == nil {
+		rateLimit = &RateLimit{LastReset: now}
+	}
+
+	switch l.algorithm {
+	case AlgorithmTokenBucket:
+		return l.allowTokenBucket(ctx, key, rateLimit, limits, cost, now)
+	case AlgorithmLeakyBucket:
+		return l.allowLeakyBucket(ctx, key, rateLimit, limits, cost, now)
+	}
+	return l.allowFixedWindow(ctx, key, rateLimit, limits, cost, now)
+}
+
+// Window is a fixed window stacked on the one of Limits: Limit requests per Length
+type Window struct {
+	Limit  int
+	Length time.Duration
+}
+
+// windowKeyMarker separates a key from the length in seconds of a stacked window
+const windowKeyMarker = ":w"
+
+// WindowKey is the key the counter of a stacked window of key is stored under
+func WindowKey(key string, length time.Duration) string {
+	return key + windowKeyMarker + strconv.FormatInt(int64(length/time.Second), 10)
+}
+
+// CutWindowKey splits a key built by WindowKey into the key and the window length
+func CutWindowKey(windowKey string) (string, time.Duration, bool) {
+	i := strings.LastIndex(windowKey, windowKeyMarker)
+	if i <= 0 {
+		return windowKey, 0, false
+	}
+	seconds, err := strconv.ParseInt(windowKey[i+len(windowKeyMarker):], 10, 64)
+	if err != nil || seconds <= 0 {
+		return windowKey, 0, false
+	}
+	return windowKey[:i], time.Duration(seconds) * time.Second, true
+}
+
+// AllowWindowsN consumes cost units for the key in the window of limits and in every
+// stacked window at once, allowing the request only when it fits in all of them; the
+// result describes the window with the least remaining. Stacked windows are counted
+// under WindowKey and share the block time and escalation of limits. Only the fixed
+// window algorithm stacks windows, the others check limits alone.
+//
+// An AtomicStorage checks every window in one step. Otherwise, such as for windows on
+// different Redis cluster slots, the counters are read with one GetMulti and written
+// back with one SetMulti.
+func (l *Limiter) AllowWindowsN(ctx context.Context, key string, limits Limits, windows []Window, cost int) (Result, error) {
+	if len(windows) == 0 || limits.Limit <= 0 || l.algorithm != AlgorithmFixedWindow {
+		return l.AllowLimitsN(ctx, key, limits, cost)
+	}
+	if cost < 1 {
+		cost = 1
+	}
+
+	checks := l.windowChecks(key, limits, windows)
+
+	now := l.now()
+	if atomic, ok := l.storage.(AtomicStorage); ok {
+		result, err := atomic.AllowWindows(ctx, checks, cost, now)
+		if !errors.Is(err, ErrNotAtomic) {
+			return result, err
+		}
+	}
+
+	keys := make([]string, len(checks))
+	for i, check := range checks {
+		keys[i] = check.Key
+	}
+	states, err := l.storage.GetMulti(ctx, keys)
+	if err != nil {
+		return Result{}, err
+	}
+	for i := range states {
+		if states[i] == nil {
+			states[i] = &RateLimit{LastReset: now}
+		}
+	}
+
+	result := ApplyWindows(states, checks, cost, now)
+	var entries []RateLimitEntry
+	for i, check := range checks {
+		if WindowChanged(result, states[i], now) {
+			entries = append(entries, RateLimitEntry{Key: check.Key, RateLimit: states[i], Expiration: check.Expiration(states[i], now)})
+		}
+	}
+	if len(entries) > 0 {
+		if err := l.storage.SetMulti(ctx, entries); err != nil {
+			return Result{}, err
+		}
+	}
+	return result, nil
+}
+
+// RefundWindowsN gives back cost units AllowWindowsN consumed at for the key, in the
+// window of limits and in every stacked window still running since. Only the fixed
+// window algorithm refunds, the others keep what they counted.
+//
+// An AtomicStorage refunds each counter in place. Otherwise they are read with one
+// GetMulti and written back with one SetMulti, so a concurrent check may be overwritten.
+func (l *Limiter) RefundWindowsN(ctx context.Context, key string, limits Limits, windows []Window, cost int, at time.Time) error {
+	if limits.Limit <= 0 || l.algorithm != AlgorithmFixedWindow {
+		return nil
+	}
+	if cost < 1 {
+		cost = 1
+	}
+
+	checks := l.windowChecks(key, limits, windows)
+
+	if atomic, ok := l.storage.(AtomicStorage); ok {
+		var err error
+		for _, check := range checks {
+			if err = atomic.Refund(ctx, check.Key, cost, at); err != nil {
+				break
+			}
+		}
+		if !errors.Is(err, ErrNotAtomic) {
+			return err
+		}
+	}
+
+	keys := make([]string, len(checks))
+	for i, check := range checks {
+		keys[i] = check.Key
+	}
+	states, err := l.storage.GetMulti(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	now := l.now()
+	var entries []RateLimitEntry
+	for i, check := range checks {
+		if states[i] == nil || states[i].LastReset.After(at) || now.Sub(states[i].LastReset) >= check.Window {
+			continue
+		}
+		states[i].Count = max(states[i].Count-cost, 0)
+		entries = append(entries, RateLimitEntry{Key: check.Key, RateLimit: states[i], Expiration: check.Expiration(states[i], now)})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return l.storage.SetMulti(ctx, entries)
+}
+
+// windowChecks returns the check of the window of limits followed by those of the
+// stacked windows
+func (l *Limiter) windowChecks(key string, limits Limits, windows []Window) []WindowCheck {
+	checks := make([]WindowCheck, 0, 1+len(windows))
+	checks = append(checks, WindowCheck{Key: key, Limits: limits, Window: l.windowOf(limits)})
+	for _, window := range windows {
+		stacked := limits
+		stacked.Limit, stacked.Window = window.Limit, window.Length
+		checks = append(checks, WindowCheck{Key: WindowKey(key, window.Length), Limits: stacked, Window: window.Length})
+	}
+	return checks
+}
+
+// windowOf returns the window of the limits, the one of the limiter unless they set one
+func (l *Limiter) windowOf(limits Limits) time.Duration {
+	if limits.Window > 0 {
+		return limits.Window
+	}
+	return l.window
+}
+
+func (l *Limiter) allowFixedWindow(ctx context.Context, key string, rateLimit *RateLimit, limits Limits, cost int, now time.Time) (Result, error) {
+	check := WindowCheck{Key: key, Limits: limits, Window: l.windowOf(limits)}
+	result := ApplyWindows([]*RateLimit{rateLimit}, []WindowCheck{check}, cost, now)
+	if WindowChanged(result, rateLimit, now) {
+		if err := l.storage.Set(ctx, key, rateLimit, check.Expiration(rateLimit, now)); err != nil {
+			return Result{}, err
+		}
+	}
+	return result, nil
+}
+
+// ApplyWindows runs a fixed window check over the counters of the checks, one per
+// check. Storages implementing AtomicStorage in process call it under their lock and
+// write back the counters WindowChanged reports, with WindowCheck.Expiration as expiration;
+// the Redis scripts implement the same steps:
+//
+//   - a counter whose window is over starts a new window, keeping a block still running
+//   - while any window is blocked the request is refused and nothing changes
+//   - when the cost overflows any window, those windows are blocked, for longer with
+//     every violation when blocks escalate, and the others are left untouched
+//   - otherwise the cost is consumed in every window, and the result describes the
+//     window with the least remaining
+func ApplyWindows(states []*RateLimit, checks []WindowCheck, cost int, now time.Time) Result {
+	for i, state := range states {
+		if now.Sub(state.LastReset) >= checks[i].Window {
+			state.Count = 0
+			state.LastReset = now
+			if checks[i].Limits.BlockedUntil(state, now).IsZero() {
+				state.BlockedAt = time.Time{}
+			}
+		}
+	}
+
+	var result Result
+	refused := false
+	for i, state := range states {
+		until := checks[i].Limits.BlockedUntil(state, now)
+		if until.IsZero() {
+			continue
+		}
+		if !refused {
+			result = Result{Limit: checks[i].Limits.Limit, ResetAt: state.LastReset.Add(checks[i].Window)}
+			refused = true
+		}
+		result.RetryAfter = max(result.RetryAfter, until.Sub(now))
+	}
+	if refused {
+		return result
+	}
+
+	for i, state := range states {
+		if state.Count+cost <= checks[i].Limits.Limit {
+			continue
+		}
+		state.BlockedAt = now
+		if escalation := checks[i].Limits.Escalation; escalation.Enabled() {
+			state.Violations = escalation.violations(state, now) + 1
+			state.ViolatedAt = now
+		}
+		if !refused {
+			result = Result{Limit: checks[i].Limits.Limit, ResetAt: state.LastReset.Add(checks[i].Window)}
+			refused = true
+		}
+		result.RetryAfter = max(result.RetryAfter, checks[i].Limits.BlockFor(state.Violations))
+	}
+	if refused {
+		return result
+	}
+
+	result.Allowed = true
+	for i, state := range states {
+		state.Count += cost
+		if remaining := checks[i].Limits.Limit - state.Count; i == 0 || remaining < result.Remaining {
+			result.Limit = checks[i].Limits.Limit
+			result.Remaining = remaining
+			result.ResetAt = state.LastReset.Add(checks[i].Window)
+		}
+	}
+	return result
+}
+
+// WindowChanged reports whether ApplyWindows changed the counter: every counter of an
+// allowed request, and the counters it blocked at now otherwise
+func WindowChanged(result Result, state *RateLimit, now time.Time) bool {
+	return result.Allowed || state.BlockedAt.Equal(now)
+}
+
+// allowTokenBucket stores the tokens taken from a full bucket in Count and the time of
+// the last refill in LastReset, refilling whole tokens only
+func (l *Limiter) allowTokenBucket(ctx context.Context, key string, rateLimit *RateLimit, limits Limits, cost int, now time.Time) (Result, error) {
+	result := Result{Limit: limits.Limit}
+
+	window := l.windowOf(limits)
+	interval := window / time.Duration(limits.Limit)
+	if interval <= 0 {
+		interval = time.Nanosecond
+	}
+
+	if refilled := int(now.Sub(rateLimit.LastReset) / interval); refilled > 0 {
+		rateLimit.Count -= refilled
+		rateLimit.LastReset = rateLimit.LastReset.Add(time.Duration(refilled) * interval)
+		if rateLimit.Count <= 0 {
+			rateLimit.Count = 0
+			rateLimit.LastReset = now
+		}
+	}
+
+	if missing := rateLimit.Count + cost - limits.Limit; missing > 0 {
+		// the first missing token arrives one interval after the last refill
+		enough := rateLimit.LastReset.Add(time.Duration(missing) * interval)
+		result.RetryAfter = enough.Sub(now)
+		result.ResetAt = enough
+		return result, nil
+	}
+
+	rateLimit.Count += cost
+	if err := l.storage.Set(ctx, key, rateLimit, window); err != nil {
+		return Result{}, err
+	}
+
+	result.Allowed = true
+	result.Remaining = limits.Limit - rateLimit.Count
+	result.ResetAt = rateLimit.LastReset.Add(time.Duration(rateLimit.Count) * interval)
+	return result, nil
+}
+
+// allowLeakyBucket stores the time the bucket will be empty in LastReset and its level,
+// rounded up, in Count. Each request adds one drain interval to the empty time, and fits
+// while the bucket then holds no more than BucketSize requests. A request costing more
+// than the bucket holds fits only in an empty bucket.
+func (l *Limiter) allowLeakyBucket(ctx context.Context, key string, rateLimit *RateLimit, limits Limits, cost int, now time.Time) (Result, error) {
+	size := max(limits.BucketSize, 1)
+	result := Result{Limit: size}
+
+	window := l.windowOf(limits)
+	interval := window / time.Duration(limits.Limit)
+	if interval <= 0 {
+		interval = time.Nanosecond
+	}
+
+	emptyAt := rateLimit.LastReset
+	if emptyAt.Before(now) {
+		emptyAt = now
+	}
+	full := emptyAt.Add(time.Duration(cost) * interval)
+
+	if capacity := time.Duration(max(size, cost)) * interval; full.Sub(now) > capacity {
+		result.RetryAfter = full.Sub(now) - capacity
+		result.ResetAt = emptyAt
+		return result, nil
+	}
+
+	level := int((full.Sub(now) + interval - 1) / interval)
+	rateLimit.Count = level
+	rateLimit.LastReset = full
+	rateLimit.BlockedAt = time.Time{}
+	if err := l.storage.Set(ctx, key, rateLimit, full.Sub(now)+window); err != nil {
+		return Result{}, err
+	}
+
+	result.Allowed = true
+	result.Remaining = max(size-level, 0)
+	result.ResetAt = full
+	return result, nil
+}
@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LimitState describes the current rate limiting state of a key
+type LimitState struct {
+	Key          string    `json:"key"`
+	Count        int       `json:"count"`
+	Limit        int       `json:"limit"`
+	LastReset    time.Time `json:"last_reset"`
+	Blocked      bool      `json:"blocked"`
+	BlockedAt    time.Time `json:"blocked_at,omitempty"`
+	BlockedUntil time.Time `json:"blocked_until,omitempty"`
+	Violations   int       `json:"violations,omitempty"`
+}
+
+// GetLimitState returns the state of a key, or nil when the key is not tracked
+func (s *Service) GetLimitState(ctx context.Context, key string) (*LimitState, error) {
+	rateLimit, err := s.adminStorage().Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if rateLimit == nil {
+		return nil, nil
+	}
+
+	isToken := strings.HasPrefix(key, "token:")
+	limitKey, limit := key, 0
+	if base, window, found := s.cutWindowKey(key, isToken); found {
+		limitKey, limit = base, window.Limit
+	}
+	limits := ratelimiter.Limits{
+		BlockTime:  time.Duration(s.getBlockTime(limitKey, isToken)) * time.Second,
+		Escalation: s.escalation(),
+	}
+	blockedUntil := limits.BlockedUntil(rateLimit, s.now())
+	if limitKey == key {
+		limit = s.getLimit(key, isToken)
+	}
+
+	state := &LimitState{
+		Key:        key,
+		Count:      rateLimit.Count,
+		Limit:      limit,
+		LastReset:  rateLimit.LastReset,
+		Blocked:    !blockedUntil.IsZero(),
+		Violations: rateLimit.Violations,
+	}
+	if state.Blocked {
+		state.BlockedAt = rateLimit.BlockedAt
+		state.BlockedUntil = blockedUntil
+	}
+
+	return state, nil
+}
+
+// ResetLimit removes the stored counter of a key and those of its stacked windows,
+// unblocking it
+func (s *Service) ResetLimit(ctx context.Context, key string) error {
+	for _, window := range s.getWindows(key, strings.HasPrefix(key, "token:")) {
+		if err := s.adminStorage().Delete(ctx, ratelimiter.WindowKey(key, window.Length)); err != nil {
+			return err
+		}
+	}
+	return s.adminStorage().Delete(ctx, key)
+}
+
+// cutWindowKey splits the counter key of a stacked window into the key and the window,
+// provided the policy of the key stacks a window of that length
+func (s *Service) cutWindowKey(windowKey string, isToken bool) (string, ratelimiter.Window, bool) {
+	key, length, found := ratelimiter.CutWindowKey(windowKey)
+	if !found {
+		return windowKey, ratelimiter.Window{}, false
+	}
+	for _, window := range s.getWindows(key, isToken) {
+		if window.Length == length {
+			return key, window, true
+		}
+	}
+	return windowKey, ratelimiter.Window{}, false
+}
+
+// ListLimits returns the state of every key starting with prefix
+func (s *Service) ListLimits(ctx context.Context, prefix string) ([]*LimitState, error) {
+	keys, err := s.adminStorage().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	states := make([]*LimitState, 0)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		state, err := s.GetLimitState(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		// a key may expire between List and Get
+		if state != nil {
+			states = append(states, state)
+		}
+	}
+
+	return states, nil
+}
+
+// ResetLimits resets every key starting with prefix and returns how many it reset
+func (s *Service) ResetLimits(ctx context.Context, prefix string) (int, error) {
+	keys, err := s.adminStorage().List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	reset := 0
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := s.adminStorage().Delete(ctx, key); err != nil {
+			return reset, err
+		}
+		reset++
+	}
+
+	return reset, nil
+}
+
+// ListBlocked returns the state of every currently blocked key
+func (s *Service) ListBlocked(ctx context.Context) ([]*LimitState, error) {
+	keys, err := s.adminStorage().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	blocked := make([]*LimitState, 0)
+	for _, key := range keys {
+		state, err := s.GetLimitState(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if state != nil && state.Blocked {
+			blocked = append(blocked, state)
+		}
+	}
+
+	return blocked, nil
+}
@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"context"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceAdminOperations(t *testing.T) {
+	testStorage := createTestStorage(t)
+	defer testStorage.Close()
+
+	ctx := context.Background()
+	service := NewService(storage.Config{
+		IPRateLimit:     1,
+		IPBlockTime:     60,
+		TokenLimits:     map[string]int{},
+		TokenBlockTimes: map[string]int{},
+	}, testStorage)
+
+	key := "192.168.50.1"
+	defer service.ResetLimit(ctx, key)
+
+	t.Run("untracked_key", func(t *testing.T) {
+		state, err := service.GetLimitState(ctx, "192.168.50.99")
+		require.NoError(t, err)
+		assert.Nil(t, state)
+	})
+
+	t.Run("blocked_key", func(t *testing.T) {
+		allowed, err := service.CheckRateLimit(key, false, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+
+		allowed, err = service.CheckRateLimit(key, false, 1)
+		require.NoError(t, err)
+		assert.False(t, allowed)
+
+		state, err := service.GetLimitState(ctx, key)
+		require.NoError(t, err)
+		require.NotNil(t, state)
+		assert.True(t, state.Blocked)
+		assert.Equal(t, 1, state.Limit)
+
+		blocked, err := service.ListBlocked(ctx)
+		require.NoError(t, err)
+		keys := make([]string, 0, len(blocked))
+		for _, state := range blocked {
+			keys = append(keys, state.Key)
+		}
+		assert.Contains(t, keys, key)
+	})
+
+	t.Run("reset_unblocks", func(t *testing.T) {
+		require.NoError(t, service.ResetLimit(ctx, key))
+
+		allowed, err := service.CheckRateLimit(key, false, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+	})
+}
+
+func TestServiceLimitsByPrefix(t *testing.T) {
+	ctx := context.Background()
+	service := NewService(storage.Config{
+		IPRateLimit: 10,
+		IPBlockTime: 60,
+		TokenLimits: map[string]int{"gold": 10, "silver": 10},
+	}, storage.NewMemoryStorage())
+
+	for _, key := range []string{"192.168.1.1", "token:gold", "token:silver"} {
+		_, err := service.CheckRateLimit(key, key != "192.168.1.1", 1)
+		require.NoError(t, err)
+	}
+
+	states, err := service.ListLimits(ctx, "token:")
+	require.NoError(t, err)
+	require.Len(t, states, 2)
+	assert.Equal(t, "token:gold", states[0].Key)
+	assert.Equal(t, "token:silver", states[1].Key)
+
+	states, err = service.ListLimits(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, states, 3)
+
+	reset, err := service.ResetLimits(ctx, "token:")
+	require.NoError(t, err)
+	assert.Equal(t, 2, reset)
+	states, err = service.ListLimits(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, states, 1)
+	assert.Equal(t, "192.168.1.1", states[0].Key)
+}
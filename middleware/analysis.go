@@ -0,0 +1,356 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxAnalysisKeys caps the clients counted within one second, so a flood of distinct
+// clients can't grow the analysis without bound; the excess is not counted
+const maxAnalysisKeys = 100000
+
+// defaultAnalysisHeadroom is how far above the observed p99 rate the suggestions go
+const defaultAnalysisHeadroom = 1.5
+
+// ErrAnalysisRunning is returned when an analysis is started while one is running
+var ErrAnalysisRunning = errors.New("an analysis is already running")
+
+// analysisGroup is what a suggestion is made for: the IPs as a whole, a token, an mTLS
+// identity or a route
+type analysisGroup struct {
+	kind string
+	name string
+}
+
+const (
+	analysisIP       = "ip"
+	analysisToken    = "token"
+	analysisIdentity = "identity"
+	analysisRoute    = "route"
+)
+
+// analysisCounter counts the requests of one member of a group in the current second,
+// such as one client of a route
+type analysisCounter struct {
+	group  analysisGroup
+	member string
+}
+
+// TrafficAnalyzer observes the traffic of a service for a while and suggests limits
+// from it: for the IPs, each token and identity and each top-level route, the requests
+// per second of every client in the seconds it was active, with the p99 of that times a
+// headroom as the suggested limit. Denied requests count too, since they are demand the
+// current limits refused. It keeps per-second histograms only, in memory.
+type TrafficAnalyzer struct {
+	active atomic.Bool
+
+	mu         sync.Mutex
+	startedAt  time.Time
+	endsAt     time.Time
+	headroom   float64
+	requests   uint64
+	second     int64
+	current    map[analysisCounter]int
+	histograms map[analysisGroup]map[int]int
+}
+
+func NewTrafficAnalyzer() *TrafficAnalyzer {
+	return &TrafficAnalyzer{}
+}
+
+// Start begins a new analysis of the given duration, discarding the previous report
+func (a *TrafficAnalyzer) Start(duration time.Duration, headroom float64) error {
+	if duration <= 0 {
+		return fmt.Errorf("the duration must be positive")
+	}
+	if headroom <= 0 {
+		headroom = defaultAnalysisHeadroom
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.active.Load() {
+		return ErrAnalysisRunning
+	}
+	now := time.Now()
+	a.startedAt = now
+	a.endsAt = now.Add(duration)
+	a.headroom = headroom
+	a.requests = 0
+	a.second = now.Unix()
+	a.current = make(map[analysisCounter]int)
+	a.histograms = make(map[analysisGroup]map[int]int)
+	a.active.Store(true)
+	return nil
+}
+
+// Stop ends the running analysis early, keeping its report
+func (a *TrafficAnalyzer) Stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.active.Load() {
+		a.finish(time.Now())
+	}
+}
+
+// Observe counts a request of the client key on the path while an analysis runs
+func (a *TrafficAnalyzer) Observe(key, path string, now time.Time) {
+	if a == nil || !a.active.Load() {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.active.Load() {
+		return
+	}
+	if !now.Before(a.endsAt) {
+		a.finish(a.endsAt)
+		return
+	}
+	if second := now.Unix(); second != a.second {
+		a.flush()
+		a.second = second
+	}
+
+	a.requests++
+	client := clientKey(key)
+	a.count(analysisCounter{group: clientGroup(client), member: client})
+	a.count(analysisCounter{group: analysisGroup{kind: analysisRoute, name: topLevelRoute(path)}, member: client})
+}
+
+func (a *TrafficAnalyzer) count(counter analysisCounter) {
+	if _, exists := a.current[counter]; !exists && len(a.current) >= maxAnalysisKeys {
+		return
+	}
+	a.current[counter]++
+}
+
+// flush adds the counts of the second that ended to the histograms
+func (a *TrafficAnalyzer) flush() {
+	for counter, count := range a.current {
+		histogram := a.histograms[counter.group]
+		if histogram == nil {
+			histogram = make(map[int]int)
+			a.histograms[counter.group] = histogram
+		}
+		histogram[count]++
+	}
+	clear(a.current)
+}
+
+func (a *TrafficAnalyzer) finish(endedAt time.Time) {
+	a.flush()
+	a.endsAt = endedAt
+	a.active.Store(false)
+}
+
+// clientGroup is the group a client key is suggested a limit in
+func clientGroup(client string) analysisGroup {
+	if name, found := tokenOf(client); found {
+		return analysisGroup{kind: analysisToken, name: name}
+	}
+	if identity, found := strings.CutPrefix(client, identityKeyPrefix); found {
+		return analysisGroup{kind: analysisIdentity, name: identity}
+	}
+	return analysisGroup{kind: analysisIP}
+}
+
+// topLevelRoute returns the first segment of the path, "/api" for "/api/users/1"
+func topLevelRoute(path string) string {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return "/" + segment
+}
+
+// RateSuggestion is the observed requests per second of the clients of a group, over
+// the seconds they were active, and the limit suggested from it
+type RateSuggestion struct {
+	Seconds   int `json:"seconds"`
+	P50       int `json:"p50"`
+	P99       int `json:"p99"`
+	Max       int `json:"max"`
+	Suggested int `json:"suggested_limit"`
+}
+
+// TrafficReport is the outcome of an analysis so far. Config is the suggestions as
+// environment variables ready to paste into .env.
+type TrafficReport struct {
+	Running    bool                      `json:"running"`
+	StartedAt  time.Time                 `json:"started_at"`
+	EndsAt     time.Time                 `json:"ends_at"`
+	Requests   uint64                    `json:"requests"`
+	Headroom   float64                   `json:"headroom"`
+	IP         *RateSuggestion           `json:"ip,omitempty"`
+	Tokens     map[string]RateSuggestion `json:"tokens,omitempty"`
+	Identities map[string]RateSuggestion `json:"identities,omitempty"`
+	Routes     map[string]RateSuggestion `json:"routes,omitempty"`
+	Config     string                    `json:"config"`
+}
+
+// Report returns the suggestions of the running or last analysis, nil before the first
+func (a *TrafficAnalyzer) Report() *TrafficReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.startedAt.IsZero() {
+		return nil
+	}
+	if a.active.Load() {
+		if now := time.Now(); !now.Before(a.endsAt) {
+			a.finish(a.endsAt)
+		} else if now.Unix() != a.second {
+			a.flush()
+			a.second = now.Unix()
+		}
+	}
+
+	report := &TrafficReport{
+		Running:   a.active.Load(),
+		StartedAt: a.startedAt,
+		EndsAt:    a.endsAt,
+		Requests:  a.requests,
+		Headroom:  a.headroom,
+	}
+	for group, histogram := range a.histograms {
+		suggestion := suggestRate(histogram, a.headroom)
+		switch group.kind {
+		case analysisIP:
+			report.IP = &suggestion
+		case analysisToken:
+			report.Tokens = setSuggestion(report.Tokens, group.name, suggestion)
+		case analysisIdentity:
+			report.Identities = setSuggestion(report.Identities, group.name, suggestion)
+		case analysisRoute:
+			report.Routes = setSuggestion(report.Routes, group.name, suggestion)
+		}
+	}
+	report.Config = report.envConfig()
+	return report
+}
+
+func setSuggestion(suggestions map[string]RateSuggestion, name string, suggestion RateSuggestion) map[string]RateSuggestion {
+	if suggestions == nil {
+		suggestions = make(map[string]RateSuggestion)
+	}
+	suggestions[name] = suggestion
+	return suggestions
+}
+
+// suggestRate reads the percentiles off a histogram of requests per second
+func suggestRate(histogram map[int]int, headroom float64) RateSuggestion {
+	rates := make([]int, 0, len(histogram))
+	var seconds int
+	for rate, count := range histogram {
+		rates = append(rates, rate)
+		seconds += count
+	}
+	sort.Ints(rates)
+
+	percentile := func(p float64) int {
+		rank := int(math.Ceil(p * float64(seconds)))
+		var seen int
+		for _, rate := range rates {
+			seen += histogram[rate]
+			if seen >= rank {
+				return rate
+			}
+		}
+		return rates[len(rates)-1]
+	}
+
+	suggestion := RateSuggestion{Seconds: seconds, P50: percentile(0.5), P99: percentile(0.99), Max: rates[len(rates)-1]}
+	suggestion.Suggested = max(int(math.Ceil(float64(suggestion.P99)*headroom)), 1)
+	return suggestion
+}
+
+// envName matches the names that fit in an environment variable
+var envName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// envConfig writes the suggestions as environment variables. Routes become policies of
+// ROUTE_POLICIES, which also gives each route a counter of its own per client, and
+// tokens whose name can't be a variable are left as comments for the token registry.
+func (r *TrafficReport) envConfig() string {
+	var b strings.Builder
+	if r.IP != nil {
+		fmt.Fprintf(&b, "IP_RATE_LIMIT=%d\n", r.IP.Suggested)
+	}
+
+	for _, name := range sortedKeys(r.Tokens) {
+		if envName.MatchString(name) {
+			fmt.Fprintf(&b, "TOKEN_%s_LIMIT=%d\n", name, r.Tokens[name].Suggested)
+		} else {
+			fmt.Fprintf(&b, "# token %q: limit %d (set it through the token registry)\n", name, r.Tokens[name].Suggested)
+		}
+	}
+
+	if len(r.Identities) > 0 {
+		entries := make([]string, 0, len(r.Identities))
+		for _, identity := range sortedKeys(r.Identities) {
+			entries = append(entries, fmt.Sprintf("%s=%d", identity, r.Identities[identity].Suggested))
+		}
+		fmt.Fprintf(&b, "MTLS_IDENTITY_LIMITS=%s\n", strings.Join(entries, ","))
+	}
+
+	var policies, routes []string
+	var settings strings.Builder
+	for _, route := range sortedKeys(r.Routes) {
+		segment := strings.TrimPrefix(route, "/")
+		if !envName.MatchString(segment) {
+			continue
+		}
+		name := "route_" + strings.ToLower(segment)
+		policies = append(policies, name)
+		routes = append(routes, route+"="+name)
+		fmt.Fprintf(&settings, "POLICY_%s_LIMIT=%d\n", strings.ToUpper(name), r.Routes[route].Suggested)
+	}
+	if len(policies) > 0 {
+		fmt.Fprintf(&b, "POLICIES=%s\n%sROUTE_POLICIES=%s\n", strings.Join(policies, ","), settings.String(), strings.Join(routes, ","))
+	}
+	return b.String()
+}
+
+func sortedKeys(suggestions map[string]RateSuggestion) []string {
+	keys := make([]string, 0, len(suggestions))
+	for key := range suggestions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// StartAnalysis observes the traffic of the service for the duration, see TrafficAnalyzer
+func (s *Service) StartAnalysis(duration time.Duration, headroom float64) error {
+	return s.analyzer.Start(duration, headroom)
+}
+
+// StopAnalysis ends the running analysis early
+func (s *Service) StopAnalysis() {
+	s.analyzer.Stop()
+}
+
+// AnalysisReport returns the suggestions of the running or last analysis, nil before
+// the first one
+func (s *Service) AnalysisReport() *TrafficReport {
+	return s.analyzer.Report()
+}
+
+// observe feeds a decision to the running analysis. Requests refused before the limits,
+// such as denylisted clients or invalid keys, and health checks are not demand to size
+// limits for.
+func (s *Service) observe(key, path, reason string) {
+	switch reason {
+	case "health_check", "denylist", "invalid_api_key", "invalid_jwt", "missing_token", "token_disabled", "unknown_token":
+		return
+	}
+	s.analyzer.Observe(key, path, s.now())
+}
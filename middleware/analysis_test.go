@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrafficAnalyzer(t *testing.T) {
+	analyzer := NewTrafficAnalyzer()
+	assert.Nil(t, analyzer.Report(), "no report before the first analysis")
+	require.NoError(t, analyzer.Start(time.Hour, 2))
+	assert.ErrorIs(t, analyzer.Start(time.Hour, 2), ErrAnalysisRunning)
+
+	base := time.Now()
+	// the IP sends 2 requests a second for 99 seconds and 10 in one; the token 5 a second
+	for second := 0; second < 100; second++ {
+		now := base.Add(time.Duration(second) * time.Second)
+		requests := 2
+		if second == 50 {
+			requests = 10
+		}
+		for i := 0; i < requests; i++ {
+			analyzer.Observe("10.0.0.1", "/api/users/1", now)
+		}
+		for i := 0; i < 5; i++ {
+			analyzer.Observe("policy:premium:token:gold", "/search", now)
+		}
+	}
+	analyzer.Stop()
+
+	report := analyzer.Report()
+	require.NotNil(t, report)
+	assert.False(t, report.Running)
+	assert.Equal(t, uint64(708), report.Requests)
+
+	require.NotNil(t, report.IP)
+	assert.Equal(t, RateSuggestion{Seconds: 100, P50: 2, P99: 2, Max: 10, Suggested: 4}, *report.IP, "a single burst stays above the p99")
+	assert.Equal(t, RateSuggestion{Seconds: 100, P50: 5, P99: 5, Max: 5, Suggested: 10}, report.Tokens["gold"])
+	assert.Equal(t, 4, report.Routes["/api"].Suggested)
+	assert.Equal(t, 10, report.Routes["/search"].Suggested)
+
+	assert.Equal(t, "IP_RATE_LIMIT=4\n"+
+		"TOKEN_gold_LIMIT=10\n"+
+		"POLICIES=route_api,route_search\n"+
+		"POLICY_ROUTE_API_LIMIT=4\n"+
+		"POLICY_ROUTE_SEARCH_LIMIT=10\n"+
+		"ROUTE_POLICIES=/api=route_api,/search=route_search\n", report.Config)
+}
+
+func TestServiceAnalysis(t *testing.T) {
+	service := NewService(storage.Config{IPRateLimit: 1, IPBlockTime: 60}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func() {
+		req := httptest.NewRequest("GET", "/api/orders", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	send()
+	assert.Nil(t, service.AnalysisReport(), "traffic is only observed while an analysis runs")
+
+	require.NoError(t, service.StartAnalysis(time.Minute, 0))
+	for i := 0; i < 3; i++ {
+		send()
+	}
+	service.StopAnalysis()
+
+	report := service.AnalysisReport()
+	require.NotNil(t, report)
+	assert.Equal(t, uint64(3), report.Requests, "denied requests are demand too")
+	assert.Equal(t, 1.5, report.Headroom)
+	require.NotNil(t, report.IP)
+	assert.GreaterOrEqual(t, report.IP.Max, 2)
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"fmt"
+	"rate-limiter/storage"
+	"regexp"
+	"strings"
+)
+
+const defaultAPIKeyPattern = `^[A-Za-z0-9._\-]+$`
+
+// APIKeyValidator checks API keys before they are used as rate limit keys, so
+// arbitrary header values can't pollute the storage key space
+type APIKeyValidator struct {
+	minLength int
+	maxLength int
+	prefix    string
+	pattern   *regexp.Regexp
+}
+
+func NewAPIKeyValidator(config storage.Config) (*APIKeyValidator, error) {
+	pattern := config.APIKeyPattern
+	if pattern == "" {
+		pattern = defaultAPIKeyPattern
+	}
+
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid API key pattern: %w", err)
+	}
+
+	return &APIKeyValidator{
+		minLength: config.APIKeyMinLength,
+		maxLength: config.APIKeyMaxLength,
+		prefix:    config.APIKeyPrefix,
+		pattern:   compiled,
+	}, nil
+}
+
+func (v *APIKeyValidator) Validate(apiKey string) error {
+	if len(apiKey) < v.minLength {
+		return fmt.Errorf("API key shorter than %d characters", v.minLength)
+	}
+	if v.maxLength > 0 && len(apiKey) > v.maxLength {
+		return fmt.Errorf("API key longer than %d characters", v.maxLength)
+	}
+	if !strings.HasPrefix(apiKey, v.prefix) {
+		return fmt.Errorf("API key must start with %q", v.prefix)
+	}
+	if !v.pattern.MatchString(apiKey) {
+		return fmt.Errorf("API key contains invalid characters")
+	}
+	return nil
+}
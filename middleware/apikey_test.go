@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeyValidator(t *testing.T) {
+	validator, err := NewAPIKeyValidator(storage.Config{
+		APIKeyMinLength: 6,
+		APIKeyMaxLength: 32,
+		APIKeyPrefix:    "sk-",
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		apiKey  string
+		wantErr bool
+	}{
+		{"valid", "sk-abc123", false},
+		{"valid_special", "sk-abc_1.2-3", false},
+		{"too_short", "sk-a", true},
+		{"too_long", "sk-" + strings.Repeat("a", 40), true},
+		{"missing_prefix", "pk-abc123", true},
+		{"invalid_chars", "sk-abc 123", true},
+		{"injection", "sk-abc\r\nX: y", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validator.Validate(tt.apiKey)
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func TestNewAPIKeyValidatorInvalidPattern(t *testing.T) {
+	_, err := NewAPIKeyValidator(storage.Config{APIKeyPattern: "["})
+	assert.Error(t, err)
+}
+
+func TestRateLimiterStrictAPIKey(t *testing.T) {
+	service := NewService(storage.Config{
+		APIKeyHeaders:   []string{"API_KEY"},
+		APIKeyStrict:    true,
+		APIKeyMinLength: 1,
+		APIKeyMaxLength: 8,
+	}, nil)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.1:12345"
+	req.Header.Set("API_KEY", "way-too-long-api-key")
+	w := httptest.NewRecorder()
+
+	RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid API key")
+}
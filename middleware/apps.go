@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type appContextKey struct{}
+
+// App binds a namespaced Service to the requests matching its hosts or path prefix
+type App struct {
+	Name       string
+	Hosts      []string
+	PathPrefix string
+	Service    *Service
+}
+
+// AppRouter resolves the App serving a request, falling back to a default Service
+type AppRouter struct {
+	apps     []*App
+	fallback *Service
+}
+
+func NewAppRouter(fallback *Service, apps ...*App) *AppRouter {
+	return &AppRouter{
+		apps:     apps,
+		fallback: fallback,
+	}
+}
+
+func (a *AppRouter) Apps() []*App {
+	return a.apps
+}
+
+// Resolve matches the Host header first, then the longest path prefix
+func (a *AppRouter) Resolve(r *http.Request) *App {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, app := range a.apps {
+		for _, appHost := range app.Hosts {
+			if strings.EqualFold(appHost, host) {
+				return app
+			}
+		}
+	}
+
+	var matched *App
+	for _, app := range a.apps {
+		if app.PathPrefix == "" || !strings.HasPrefix(r.URL.Path, app.PathPrefix) {
+			continue
+		}
+		if matched == nil || len(app.PathPrefix) > len(matched.PathPrefix) {
+			matched = app
+		}
+	}
+
+	return matched
+}
+
+// AppRateLimiter rate limits each request with the Service of the app it belongs to
+// and records the app name in the request context
+func AppRateLimiter(router *AppRouter, opts ...Option) func(http.Handler) http.Handler {
+	o := newOptions(opts)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			app := router.Resolve(r)
+			if app == nil {
+				serveRateLimited(router.fallback, o, next, w, r)
+				return
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), appContextKey{}, app.Name))
+			serveRateLimited(app.Service, o, next, w, r)
+		})
+	}
+}
+
+// AppFromContext returns the name of the app that served the request, if any
+func AppFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(appContextKey{}).(string)
+	return name, ok
+}
@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppRouterResolve(t *testing.T) {
+	billing := &App{Name: "billing", Hosts: []string{"billing.example.com"}}
+	search := &App{Name: "search", PathPrefix: "/search"}
+	searchAdmin := &App{Name: "search-admin", PathPrefix: "/search/admin"}
+	router := NewAppRouter(nil, billing, search, searchAdmin)
+
+	tests := []struct {
+		name     string
+		host     string
+		path     string
+		expected *App
+	}{
+		{"host", "billing.example.com", "/", billing},
+		{"host_with_port", "BILLING.example.com:8080", "/search", billing},
+		{"path_prefix", "example.com", "/search/items", search},
+		{"longest_prefix", "example.com", "/search/admin/users", searchAdmin},
+		{"no_match", "example.com", "/other", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Host = tt.host
+			assert.Equal(t, tt.expected, router.Resolve(req))
+		})
+	}
+}
+
+func TestAppRateLimiterUsesAppService(t *testing.T) {
+	fallback := NewService(storage.Config{}, nil)
+	app := &App{
+		Name:       "billing",
+		PathPrefix: "/billing",
+		Service:    NewService(storage.Config{Denylist: []string{"192.168.1.1"}, DenylistStatusCode: http.StatusForbidden}, nil),
+	}
+
+	var appName string
+	handler := AppRateLimiter(NewAppRouter(fallback, app))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		appName, _ = AppFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/billing/invoices", nil)
+	req.RemoteAddr = "192.168.1.1:12345"
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, appName)
+}
+
+func TestLoadConfigApps(t *testing.T) {
+	envs := map[string]string{
+		"APPS":                             "billing",
+		"IP_RATE_LIMIT":                    "10",
+		"APP_BILLING_HOSTS":                "billing.example.com, pay.example.com",
+		"APP_BILLING_PATH_PREFIX":          "/billing",
+		"APP_BILLING_IP_RATE_LIMIT":        "42",
+		"APP_BILLING_TOKEN_ABC_LIMIT":      "500",
+		"APP_BILLING_ADMIN_TOKEN":          "secret",
+		"APP_BILLING_TOKEN_ABC_BLOCK_TIME": "30",
+	}
+	for key, value := range envs {
+		original, exists := os.LookupEnv(key)
+		os.Setenv(key, value)
+		defer func(key, original string, exists bool) {
+			if exists {
+				os.Setenv(key, original)
+			} else {
+				os.Unsetenv(key)
+			}
+		}(key, original, exists)
+	}
+
+	config, err := storage.LoadConfig()
+	require.NoError(t, err)
+	require.Len(t, config.Apps, 1)
+
+	app := config.Apps[0]
+	assert.Equal(t, "billing", app.Name)
+	assert.Equal(t, []string{"billing.example.com", "pay.example.com"}, app.Hosts)
+	assert.Equal(t, "/billing", app.PathPrefix)
+	assert.Equal(t, 42, app.RateLimit.IPRateLimit)
+	assert.Equal(t, config.RateLimit.IPBlockTime, app.RateLimit.IPBlockTime)
+	assert.Equal(t, 500, app.RateLimit.TokenLimits["ABC"])
+	assert.Equal(t, 30, app.RateLimit.TokenBlockTimes["ABC"])
+	assert.Equal(t, "secret", app.RateLimit.AdminToken)
+	assert.NotContains(t, config.RateLimit.TokenLimits, "ABC")
+}
+
+func TestLoadConfigHostTemplates(t *testing.T) {
+	t.Setenv("IP_RATE_LIMIT", "10")
+	t.Setenv("HOST_TEMPLATES", "api.example.com=strict, www.example.com=relaxed, docs.example.com=relaxed, broken")
+	t.Setenv("TEMPLATE_STRICT_IP_RATE_LIMIT", "5")
+	t.Setenv("TEMPLATE_STRICT_TOKEN_ABC_LIMIT", "50")
+	t.Setenv("TEMPLATE_STRICT_IP_DAILY_QUOTA", "1000")
+	t.Setenv("TEMPLATE_RELAXED_IP_RATE_LIMIT", "100")
+
+	config, err := storage.LoadConfig()
+	require.NoError(t, err)
+	require.Len(t, config.Apps, 3, "the entry without a template is skipped")
+
+	api := config.Apps[0]
+	assert.Equal(t, "api.example.com", api.Name)
+	assert.Equal(t, []string{"api.example.com"}, api.Hosts)
+	assert.Equal(t, "strict", api.Template)
+	assert.Equal(t, 5, api.RateLimit.IPRateLimit)
+	assert.Equal(t, 50, api.RateLimit.TokenLimits["ABC"])
+	assert.Equal(t, 1000, api.RateLimit.IPDailyQuota)
+
+	for _, app := range config.Apps[1:] {
+		assert.Equal(t, "relaxed", app.Template)
+		assert.Equal(t, 100, app.RateLimit.IPRateLimit, app.Name)
+		assert.Zero(t, app.RateLimit.IPDailyQuota, app.Name)
+	}
+	assert.Equal(t, 10, config.RateLimit.IPRateLimit)
+}
+
+func TestHostScopedStats(t *testing.T) {
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	fallback := NewService(storage.Config{IPRateLimit: 10, IPBlockTime: 60}, storage.NewMemoryStorage())
+	api := &App{Name: "api.example.com", Hosts: []string{"api.example.com"}, Service: NewService(storage.Config{IPRateLimit: 1, IPBlockTime: 60}, storage.NewMemoryStorage())}
+	handler := AppRateLimiter(NewAppRouter(fallback, api))(testHandler)
+
+	decisions, cancel := api.Service.Decisions().Subscribe(10)
+	defer cancel()
+
+	for _, host := range []string{"api.example.com:443", "api.example.com", "www.example.com"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		req.RemoteAddr = "192.168.1.1:12345"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, Stats{Allowed: 1, Denied: 1}, api.Service.Stats())
+	assert.Equal(t, Stats{Allowed: 1}, fallback.Stats())
+	assert.Equal(t, "api.example.com", (<-decisions).Host, "the port is dropped")
+}
+
+func TestDefaultScopeHidesApps(t *testing.T) {
+	backend := storage.NewMemoryStorage()
+	ctx := context.Background()
+	config := func(denied string) storage.Config {
+		return storage.Config{IPRateLimit: 1, IPBlockTime: 60, Denylist: []string{denied}}
+	}
+	fallback := NewService(config("10.0.0.1"), storage.NewDefaultScopeStorage(backend))
+	billing := &App{Name: "billing", PathPrefix: "/billing", Service: NewService(config("10.0.0.2"), storage.NewNamespacedStorage(backend, "billing"))}
+	search := &App{Name: "search", PathPrefix: "/search", Service: NewService(config("10.0.0.3"), storage.NewNamespacedStorage(backend, "search"))}
+	for _, service := range []*Service{fallback, billing.Service, search.Service} {
+		require.NoError(t, service.SeedDenylist(ctx))
+	}
+
+	handler := AppRateLimiter(NewAppRouter(fallback, billing, search))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, path := range []string{"/", "/", "/billing", "/billing", "/search", "/search"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	blocked, err := fallback.ListBlocked(ctx)
+	require.NoError(t, err)
+	require.Len(t, blocked, 1, "the blocks of the apps are not listed")
+	assert.Equal(t, "192.168.1.1", blocked[0].Key)
+	blocked, err = billing.Service.ListBlocked(ctx)
+	require.NoError(t, err)
+	assert.Len(t, blocked, 1)
+
+	bans, err := fallback.ListBans(ctx)
+	require.NoError(t, err)
+	require.Len(t, bans, 1, "the bans of the apps are not listed")
+	assert.Equal(t, "10.0.0.1", bans[0].Value)
+
+	require.NoError(t, fallback.Reload(ctx, config("10.0.0.4")))
+	for app, denied := range map[*App]string{billing: "10.0.0.2", search: "10.0.0.3"} {
+		bans, err := app.Service.ListBans(ctx)
+		require.NoError(t, err)
+		require.Len(t, bans, 1, "a reload of the default scope keeps the bans of %s", app.Name)
+		assert.Equal(t, denied, bans[0].Value)
+	}
+	bans, err = fallback.ListBans(ctx)
+	require.NoError(t, err)
+	require.Len(t, bans, 1)
+	assert.Equal(t, "10.0.0.4", bans[0].Value)
+}
@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"sort"
+	"time"
+)
+
+// SetUsageArchive moves hourly and daily usage older than ARCHIVE_AFTER_HOURS out of the
+// storage into the object store, keeping only recent history in Redis
+func (s *Service) SetUsageArchive(archive storage.ObjectStore) {
+	s.archive = archive
+}
+
+// ArchiveUsage takes the complete hourly and daily usage records that started before
+// the cutoff and writes them as gzipped JSON lines, one object per period and UTC day:
+// usage/<period>/<YYYY-MM-DD>/<archived at>.jsonl.gz. A day can get several objects
+// when late usage is rolled up after it was archived; readers sum them. Records go
+// back to the storage when an upload fails. It returns how many records were archived.
+func (s *Service) ArchiveUsage(ctx context.Context, cutoff time.Time) (int, error) {
+	if s.archive == nil {
+		return 0, nil
+	}
+
+	config := s.Config()
+	periods := []struct {
+		period    string
+		length    time.Duration
+		retention time.Duration
+	}{
+		{ratelimiter.UsagePeriodHour, time.Hour, time.Duration(config.UsageHourlyRetention) * 24 * time.Hour},
+		{ratelimiter.UsagePeriodDay, 24 * time.Hour, time.Duration(config.UsageDailyRetention) * 24 * time.Hour},
+	}
+
+	archived := 0
+	for _, p := range periods {
+		records, err := s.storage.TakeUsage(ctx, p.period, cutoff.Add(-p.length))
+		if err != nil {
+			return archived, err
+		}
+		if len(records) == 0 {
+			continue
+		}
+
+		pending, err := s.uploadUsage(ctx, p.period, records)
+		archived += len(records) - len(pending)
+		if err != nil {
+			s.restoreUsageRecords(ctx, p.period, pending, p.retention)
+			return archived, err
+		}
+	}
+
+	return archived, nil
+}
+
+// uploadUsage writes the records one UTC day at a time and returns the records of the
+// days that could not be uploaded
+func (s *Service) uploadUsage(ctx context.Context, period string, records []*ratelimiter.UsageRecord) ([]*ratelimiter.UsageRecord, error) {
+	days := make(map[string][]*ratelimiter.UsageRecord)
+	for _, record := range records {
+		day := record.Start.UTC().Format("2006-01-02")
+		days[day] = append(days[day], record)
+	}
+
+	dayNames := make([]string, 0, len(days))
+	for day := range days {
+		dayNames = append(dayNames, day)
+	}
+	sort.Strings(dayNames)
+
+	archivedAt := time.Now().UnixNano()
+	for i, day := range dayNames {
+		dayRecords := days[day]
+		sort.Slice(dayRecords, func(i, j int) bool {
+			if !dayRecords[i].Start.Equal(dayRecords[j].Start) {
+				return dayRecords[i].Start.Before(dayRecords[j].Start)
+			}
+			return dayRecords[i].Key < dayRecords[j].Key
+		})
+
+		body, err := encodeUsageLines(dayRecords)
+		if err == nil {
+			err = s.archive.PutObject(ctx, fmt.Sprintf("usage/%s/%s/%d.jsonl.gz", period, day, archivedAt), body)
+		}
+		if err != nil {
+			var pending []*ratelimiter.UsageRecord
+			for _, remaining := range dayNames[i:] {
+				pending = append(pending, days[remaining]...)
+			}
+			return pending, err
+		}
+	}
+
+	return nil, nil
+}
+
+func encodeUsageLines(records []*ratelimiter.UsageRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(writer)
+
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// restoreUsageRecords puts records that could not be archived back into the storage
+func (s *Service) restoreUsageRecords(ctx context.Context, period string, records []*ratelimiter.UsageRecord, retention time.Duration) {
+	buckets := make(map[time.Time]map[string]int64)
+	for _, record := range records {
+		addUsageCount(buckets, record.Start, record.Key, record.Count)
+	}
+	for start, counts := range buckets {
+		if err := s.storage.AddUsage(ctx, period, start, counts, retention); err != nil {
+			slog.Error("Failed to restore usage", "period", period, "start", start.Format(time.RFC3339), "error", err)
+		}
+	}
+}
+
+// RunUsageArchive archives usage older than after every interval. Like the rollup it
+// runs on one service and only on the leader.
+func (s *Service) RunUsageArchive(ctx context.Context, interval, after time.Duration) {
+	if s.archive == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !s.elector.IsLeader() {
+				continue
+			}
+			archived, err := s.ArchiveUsage(ctx, now.Add(-after))
+			if err != nil {
+				slog.Error("Failed to archive usage", "error", err)
+			} else if archived > 0 {
+				slog.Info("Archived usage records", "records", archived)
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readArchivedUsage(t *testing.T, dir string) map[string][]ratelimiter.UsageRecord {
+	archived := make(map[string][]ratelimiter.UsageRecord)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		file, err := os.Open(path)
+		require.NoError(t, err)
+		defer file.Close()
+		reader, err := gzip.NewReader(file)
+		require.NoError(t, err)
+
+		rel, _ := filepath.Rel(dir, filepath.Dir(path))
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			var record ratelimiter.UsageRecord
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+			archived[filepath.ToSlash(rel)] = append(archived[filepath.ToSlash(rel)], record)
+		}
+		return scanner.Err()
+	})
+	require.NoError(t, err)
+	return archived
+}
+
+func TestArchiveUsage(t *testing.T) {
+	ctx := context.Background()
+	memory := storage.NewMemoryStorage()
+	service := newUsageService(t, memory)
+
+	dir := t.TempDir()
+	archive, err := storage.NewObjectStore(storage.Config{ArchiveURL: "file://" + dir})
+	require.NoError(t, err)
+	service.SetUsageArchive(archive)
+
+	now := time.Date(2026, 3, 10, 12, 30, 0, 0, time.UTC)
+	require.NoError(t, memory.AddUsage(ctx, ratelimiter.UsagePeriodHour, time.Date(2026, 3, 7, 23, 0, 0, 0, time.UTC), map[string]int64{"10.0.0.1": 5}, time.Hour))
+	require.NoError(t, memory.AddUsage(ctx, ratelimiter.UsagePeriodHour, time.Date(2026, 3, 8, 1, 0, 0, 0, time.UTC), map[string]int64{"10.0.0.1": 2, "token:gold": 7}, time.Hour))
+	require.NoError(t, memory.AddUsage(ctx, ratelimiter.UsagePeriodHour, time.Date(2026, 3, 10, 11, 0, 0, 0, time.UTC), map[string]int64{"10.0.0.1": 1}, time.Hour))
+	require.NoError(t, memory.AddUsage(ctx, ratelimiter.UsagePeriodDay, time.Date(2026, 3, 7, 0, 0, 0, 0, time.UTC), map[string]int64{"10.0.0.1": 5}, time.Hour))
+	require.NoError(t, memory.AddUsage(ctx, ratelimiter.UsagePeriodDay, time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC), map[string]int64{"10.0.0.1": 2}, time.Hour))
+
+	archived, err := service.ArchiveUsage(ctx, now.Add(-48*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 4, archived, "three old hourly records and the complete day")
+
+	files := readArchivedUsage(t, dir)
+	assert.Equal(t, []ratelimiter.UsageRecord{
+		{Key: "10.0.0.1", Period: ratelimiter.UsagePeriodHour, Start: time.Date(2026, 3, 7, 23, 0, 0, 0, time.UTC), Count: 5},
+	}, files["usage/hour/2026-03-07"])
+	assert.Len(t, files["usage/hour/2026-03-08"], 2)
+	assert.Len(t, files["usage/day/2026-03-07"], 1)
+	assert.NotContains(t, files, "usage/day/2026-03-08", "the day still running at the cutoff stays hot")
+
+	hours, err := service.ListUsage(ctx, ratelimiter.UsagePeriodHour, now.Add(-7*24*time.Hour), now, "")
+	require.NoError(t, err)
+	require.Len(t, hours, 1)
+	assert.Equal(t, time.Date(2026, 3, 10, 11, 0, 0, 0, time.UTC), hours[0].Start.UTC())
+
+	days, err := service.ListUsage(ctx, ratelimiter.UsagePeriodDay, now.Add(-7*24*time.Hour), now, "")
+	require.NoError(t, err)
+	assert.Len(t, days, 1)
+}
+
+type failingObjectStore struct{}
+
+func (failingObjectStore) PutObject(ctx context.Context, key string, body []byte) error {
+	return errors.New("bucket unavailable")
+}
+
+func TestArchiveUsageRestoresOnFailure(t *testing.T) {
+	ctx := context.Background()
+	memory := storage.NewMemoryStorage()
+	service := newUsageService(t, memory)
+	service.SetUsageArchive(failingObjectStore{})
+
+	start := time.Now().UTC().Add(-72 * time.Hour).Truncate(time.Hour)
+	require.NoError(t, memory.AddUsage(ctx, ratelimiter.UsagePeriodHour, start, map[string]int64{"10.0.0.1": 3}, time.Hour))
+
+	archived, err := service.ArchiveUsage(ctx, time.Now().Add(-48*time.Hour))
+	assert.Error(t, err)
+	assert.Zero(t, archived)
+
+	hours, err := service.ListUsage(ctx, ratelimiter.UsagePeriodHour, start.Add(-time.Hour), start.Add(time.Hour), "")
+	require.NoError(t, err)
+	require.Len(t, hours, 1)
+	assert.Equal(t, int64(3), hours[0].Count)
+}
+
+func TestS3ObjectStore(t *testing.T) {
+	var path, authorization, contentHash string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		authorization = r.Header.Get("Authorization")
+		contentHash = r.Header.Get("X-Amz-Content-Sha256")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	archive, err := storage.NewObjectStore(storage.Config{
+		ArchiveURL:             "s3://usage-bucket/rate-limiter",
+		ArchiveEndpoint:        server.URL,
+		ArchiveRegion:          "eu-west-1",
+		ArchiveAccessKeyID:     "AKID",
+		ArchiveSecretAccessKey: "secret",
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, archive.PutObject(context.Background(), "usage/hour/2026-03-07/1.jsonl.gz", []byte("data")))
+	assert.Equal(t, "/usage-bucket/rate-limiter/usage/hour/2026-03-07/1.jsonl.gz", path)
+	assert.Equal(t, "data", string(body))
+	assert.True(t, strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKID/"), authorization)
+	assert.Contains(t, authorization, "/eu-west-1/s3/aws4_request")
+	assert.Len(t, contentHash, 64)
+}
+
+func TestNewObjectStoreErrors(t *testing.T) {
+	archive, err := storage.NewObjectStore(storage.Config{})
+	assert.NoError(t, err)
+	assert.Nil(t, archive)
+
+	for _, archiveURL := range []string{"ftp://bucket", "s3:///prefix", "file://"} {
+		_, err := storage.NewObjectStore(storage.Config{ArchiveURL: archiveURL})
+		assert.Error(t, err, archiveURL)
+	}
+}
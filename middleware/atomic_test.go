@@ -0,0 +1,216 @@
+package middleware
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// plainStorage hides the atomic methods of a storage, forcing the Get and Set path
+type plainStorage struct {
+	ratelimiter.Storage
+}
+
+func TestApplyWindows(t *testing.T) {
+	now := time.Now()
+	checks := []ratelimiter.WindowCheck{
+		{Key: "second", Limits: ratelimiter.Limits{Limit: 3, BlockTime: time.Second}, Window: time.Second},
+		{Key: "minute", Limits: ratelimiter.Limits{Limit: 4, BlockTime: time.Minute}, Window: time.Minute},
+	}
+	states := []*ratelimiter.RateLimit{{LastReset: now}, {LastReset: now}}
+
+	changed := func(result ratelimiter.Result, at time.Time) []bool {
+		return []bool{ratelimiter.WindowChanged(result, states[0], at), ratelimiter.WindowChanged(result, states[1], at)}
+	}
+
+	result := ratelimiter.ApplyWindows(states, checks, 2, now)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, []bool{true, true}, changed(result, now))
+	assert.Equal(t, 1, result.Remaining, "the window with the least remaining is reported")
+	assert.Equal(t, 3, result.Limit)
+
+	later := now.Add(1500 * time.Millisecond)
+	result = ratelimiter.ApplyWindows(states, checks, 3, later)
+	assert.False(t, result.Allowed, "the second window has room again but the minute does not")
+	assert.Equal(t, []bool{false, true}, changed(result, later))
+	assert.Equal(t, time.Minute, result.RetryAfter)
+	assert.Equal(t, 0, states[0].Count, "the window with room consumed nothing")
+
+	result = ratelimiter.ApplyWindows(states, checks, 1, later.Add(time.Second))
+	assert.False(t, result.Allowed, "a blocked window refuses every request")
+	assert.Equal(t, []bool{false, false}, changed(result, later.Add(time.Second)))
+	assert.Equal(t, 4, result.Limit)
+}
+
+func TestApplyWindowsEscalation(t *testing.T) {
+	check := ratelimiter.WindowCheck{
+		Key: "offender",
+		Limits: ratelimiter.Limits{
+			Limit:      1,
+			BlockTime:  time.Minute,
+			Escalation: ratelimiter.Escalation{Factor: 5, MaxBlockTime: 30 * time.Minute, Decay: time.Hour},
+		},
+		Window: time.Second,
+	}
+	checks := []ratelimiter.WindowCheck{check}
+
+	now := time.Now()
+	state := &ratelimiter.RateLimit{LastReset: now}
+	var blocks []time.Duration
+	for i := 0; i < 4; i++ {
+		require.True(t, ratelimiter.ApplyWindows([]*ratelimiter.RateLimit{state}, checks, 1, now).Allowed)
+		block := ratelimiter.ApplyWindows([]*ratelimiter.RateLimit{state}, checks, 1, now).RetryAfter
+		blocks = append(blocks, block)
+
+		result := ratelimiter.ApplyWindows([]*ratelimiter.RateLimit{state}, checks, 1, now.Add(block-time.Second))
+		assert.False(t, result.Allowed, "the block outlives the window")
+		assert.Equal(t, time.Second, result.RetryAfter)
+		now = now.Add(block)
+	}
+	assert.Equal(t, []time.Duration{time.Minute, 5 * time.Minute, 25 * time.Minute, 30 * time.Minute}, blocks)
+	// the last violation was at the start of the 30 minute block that just ended
+	assert.Equal(t, 4*time.Hour-30*time.Minute, check.Expiration(state, now), "the counter is kept until its violations decay")
+
+	now = now.Add(3 * time.Hour)
+	require.True(t, ratelimiter.ApplyWindows([]*ratelimiter.RateLimit{state}, checks, 1, now).Allowed)
+	result := ratelimiter.ApplyWindows([]*ratelimiter.RateLimit{state}, checks, 1, now)
+	assert.Equal(t, 5*time.Minute, result.RetryAfter, "three hours forgot three of the four violations")
+	assert.Equal(t, 2, state.Violations)
+}
+
+func TestWindowCheckExpiration(t *testing.T) {
+	check := ratelimiter.WindowCheck{
+		Key:    "client",
+		Limits: ratelimiter.Limits{Limit: 2, BlockTime: time.Minute},
+		Window: 10 * time.Second,
+	}
+	checks := []ratelimiter.WindowCheck{check}
+
+	now := time.Now()
+	state := &ratelimiter.RateLimit{LastReset: now}
+	require.True(t, ratelimiter.ApplyWindows([]*ratelimiter.RateLimit{state}, checks, 1, now).Allowed)
+	assert.Equal(t, 10*time.Second, check.Expiration(state, now), "a counter under its limit expires with its window")
+	assert.Equal(t, 6*time.Second, check.Expiration(state, now.Add(4*time.Second)))
+
+	now = now.Add(4 * time.Second)
+	require.True(t, ratelimiter.ApplyWindows([]*ratelimiter.RateLimit{state}, checks, 1, now).Allowed)
+	result := ratelimiter.ApplyWindows([]*ratelimiter.RateLimit{state}, checks, 1, now)
+	require.False(t, result.Allowed)
+	assert.Equal(t, time.Minute, result.RetryAfter)
+	assert.Equal(t, time.Minute, check.Expiration(state, now), "a blocked counter is kept until its block ends")
+}
+
+func TestAtomicStorageMatchesGetSet(t *testing.T) {
+	ctx := context.Background()
+	for name, backend := range map[string]ratelimiter.Storage{
+		"atomic":     storage.NewMemoryStorage(),
+		"get_set":    plainStorage{storage.NewMemoryStorage()},
+		"namespaced": storage.NewNamespacedStorage(storage.NewMemoryStorage(), "app"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			limiter, err := ratelimiter.NewLimiter(
+				ratelimiter.WithStorage(backend),
+				ratelimiter.WithLimit(3, time.Minute),
+				ratelimiter.WithBlockTime(10*time.Second),
+			)
+			require.NoError(t, err)
+
+			var allowed []bool
+			for _, cost := range []int{1, 2, 1, 1} {
+				result, err := limiter.AllowN(ctx, "user:1", cost)
+				require.NoError(t, err)
+				allowed = append(allowed, result.Allowed)
+			}
+			assert.Equal(t, []bool{true, true, false, false}, allowed)
+
+			state, err := backend.Get(ctx, "user:1")
+			require.NoError(t, err)
+			require.NotNil(t, state)
+			assert.Equal(t, 3, state.Count)
+			assert.False(t, state.BlockedAt.IsZero())
+		})
+	}
+}
+
+func TestMemoryStorageConsume(t *testing.T) {
+	ctx := context.Background()
+	memory := storage.NewMemoryStorage()
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	count, err := memory.Consume(ctx, "quota:day:2026-10-01:10.0.0.1", 2, start, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = memory.Consume(ctx, "quota:day:2026-10-01:10.0.0.1", 3, start, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 5, count)
+
+	state, err := memory.Get(ctx, "quota:day:2026-10-01:10.0.0.1")
+	require.NoError(t, err)
+	assert.True(t, state.LastReset.Equal(start))
+}
+
+// TestRedisScripts runs the Lua bundle against counters written by Go, so both sides
+// agree on the stored format
+func TestRedisScripts(t *testing.T) {
+	ctx := context.Background()
+	backend := createTestStorage(t)
+	defer backend.Close()
+	atomic := backend.(ratelimiter.AtomicStorage)
+
+	key := "test:scripts:" + time.Now().Format(time.RFC3339Nano)
+	defer backend.Delete(ctx, key)
+
+	now := time.Now()
+	local := time.FixedZone("UTC-3", -3*60*60)
+	require.NoError(t, backend.Set(ctx, key, &ratelimiter.RateLimit{Count: 2, LastReset: now.In(local)}, time.Minute))
+
+	check := ratelimiter.WindowCheck{Key: key, Limits: ratelimiter.Limits{Limit: 3, BlockTime: time.Minute}, Window: time.Minute}
+	result, err := atomic.AllowWindows(ctx, []ratelimiter.WindowCheck{check}, 1, now)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	assert.WithinDuration(t, now.Add(time.Minute), result.ResetAt, time.Millisecond)
+
+	result, err = atomic.AllowWindows(ctx, []ratelimiter.WindowCheck{check}, 1, now)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, time.Minute, result.RetryAfter)
+
+	state, err := backend.Get(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, 3, state.Count)
+	assert.WithinDuration(t, now, state.BlockedAt, time.Millisecond)
+	assert.WithinDuration(t, now, state.LastReset, time.Millisecond)
+
+	escalating := check
+	escalating.Key = key + ":escalating"
+	escalating.Limits.Escalation = ratelimiter.Escalation{Factor: 2, MaxBlockTime: time.Hour, Decay: time.Hour}
+	defer backend.Delete(ctx, escalating.Key)
+	at := now
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		state := &ratelimiter.RateLimit{Count: 3, LastReset: at}
+		if stored, err := backend.Get(ctx, escalating.Key); err == nil && stored != nil {
+			state.Violations, state.ViolatedAt = stored.Violations, stored.ViolatedAt
+		}
+		require.NoError(t, backend.Set(ctx, escalating.Key, state, time.Hour))
+
+		result, err := atomic.AllowWindows(ctx, []ratelimiter.WindowCheck{escalating}, 1, at)
+		require.NoError(t, err)
+		assert.Equal(t, want, result.RetryAfter, "the script escalates like ApplyWindows")
+		at = at.Add(want)
+	}
+
+	quotaKey := key + ":quota"
+	defer backend.Delete(ctx, quotaKey)
+	for _, want := range []int{2, 4} {
+		count, err := atomic.Consume(ctx, quotaKey, 2, now, time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, want, count)
+	}
+}
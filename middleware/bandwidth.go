@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"net/http"
+	"rate-limiter/storage"
+	"sync"
+	"time"
+)
+
+// BandwidthLimiter paces the responses of a key to the bandwidth of its policy, in
+// bytes per second. The concurrent responses of a key share one bucket holding up to a
+// second of bytes; like the concurrency limit, it is kept in process, so each instance
+// enforces the cap on its own.
+type BandwidthLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bandwidthBucket
+	lastSweep time.Time
+}
+
+type bandwidthBucket struct {
+	rate    float64
+	tokens  float64
+	updated time.Time
+	writers int
+}
+
+// NewBandwidthLimiter returns nil when no policy caps the bandwidth
+func NewBandwidthLimiter(config storage.Config) *BandwidthLimiter {
+	if !config.HasBandwidthPolicy() {
+		return nil
+	}
+	return &BandwidthLimiter{buckets: make(map[string]*bandwidthBucket)}
+}
+
+// Wrap paces the writes of the response to rate bytes per second for the key. The
+// release function must be called once the response is written.
+func (b *BandwidthLimiter) Wrap(w http.ResponseWriter, r *http.Request, key string, rate int) (http.ResponseWriter, func()) {
+	now := time.Now()
+
+	b.mu.Lock()
+	b.sweep(now)
+	bucket, exists := b.buckets[key]
+	if !exists {
+		bucket = &bandwidthBucket{tokens: float64(rate), updated: now}
+		b.buckets[key] = bucket
+	}
+	bucket.rate = float64(rate)
+	bucket.writers++
+	b.mu.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			bucket.writers--
+			b.mu.Unlock()
+		})
+	}
+	return &pacedWriter{ResponseWriter: w, request: r, limiter: b, bucket: bucket, chunkSize: max(rate, 1)}, release
+}
+
+// reserve takes n bytes from the bucket, returning how long to wait before writing them
+func (b *BandwidthLimiter) reserve(bucket *bandwidthBucket, n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bucket.refill(now)
+	bucket.tokens -= float64(n)
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// sweep drops the buckets no response is using that have refilled, at most once a second
+func (b *BandwidthLimiter) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < time.Second {
+		return
+	}
+	b.lastSweep = now
+
+	for key, bucket := range b.buckets {
+		if bucket.writers > 0 {
+			continue
+		}
+		if bucket.refill(now); bucket.tokens >= bucket.rate {
+			delete(b.buckets, key)
+		}
+	}
+}
+
+func (b *bandwidthBucket) refill(now time.Time) {
+	b.tokens = min(b.tokens+now.Sub(b.updated).Seconds()*b.rate, b.rate)
+	b.updated = now
+}
+
+// pacedWriter writes the body in chunks of at most a second of bytes, waiting for the
+// bucket before each one. A write stops early when the client goes away.
+type pacedWriter struct {
+	http.ResponseWriter
+	request *http.Request
+	limiter *BandwidthLimiter
+	bucket  *bandwidthBucket
+
+	chunkSize int
+}
+
+func (p *pacedWriter) Write(data []byte) (int, error) {
+	written := 0
+	for written < len(data) {
+		chunk := data[written:]
+		if len(chunk) > p.chunkSize {
+			chunk = chunk[:p.chunkSize]
+		}
+
+		if wait := p.limiter.reserve(p.bucket, len(chunk), time.Now()); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-p.request.Context().Done():
+				timer.Stop()
+				return written, p.request.Context().Err()
+			case <-timer.C:
+			}
+		}
+
+		n, err := p.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (p *pacedWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
@@ -0,0 +1,213 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+)
+
+// The benchmarks in this file run without Redis so `make bench` gives comparable numbers
+// on any machine; BenchmarkStorage/redis skips itself when Redis is not reachable.
+
+func benchmarkService(rateLimitStorage ratelimiter.Storage) *Service {
+	return NewService(storage.Config{
+		IPRateLimit: 1 << 30,
+		IPBlockTime: 300,
+		TokenLimits: map[string]int{"bench": 1 << 30},
+	}, rateLimitStorage)
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+func BenchmarkDecision(b *testing.B) {
+	b.Run("ip", func(b *testing.B) {
+		service := benchmarkService(storage.NewMemoryStorage())
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			service.Evaluate("192.168.1.1", "", "GET", "/", 1)
+		}
+	})
+
+	b.Run("token", func(b *testing.B) {
+		service := benchmarkService(storage.NewMemoryStorage())
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			service.Evaluate("192.168.1.1", "bench", "GET", "/", 1)
+		}
+	})
+
+	b.Run("quota", func(b *testing.B) {
+		service := benchmarkService(storage.NewMemoryStorage())
+		service.config.IPDailyQuota = 1 << 30
+		service.config.IPMonthlyQuota = 1 << 30
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			service.Evaluate("192.168.1.1", "", "GET", "/", 1)
+		}
+	})
+
+	b.Run("denylist", func(b *testing.B) {
+		service := benchmarkService(storage.NewMemoryStorage())
+		service.denylist.Replace([]string{"10.0.0.0/8", "token:blocked"})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			service.Evaluate("10.1.2.3", "", "GET", "/", 1)
+		}
+	})
+
+	b.Run("parallel", func(b *testing.B) {
+		service := benchmarkService(storage.NewMemoryStorage())
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				service.Evaluate("192.168.1.1", "", "GET", "/", 1)
+			}
+		})
+	})
+}
+
+func BenchmarkLimiter(b *testing.B) {
+	for _, algorithm := range []string{ratelimiter.AlgorithmFixedWindow, ratelimiter.AlgorithmTokenBucket} {
+		b.Run(algorithm, func(b *testing.B) {
+			limiter, err := ratelimiter.NewLimiter(
+				ratelimiter.WithStorage(storage.NewMemoryStorage()),
+				ratelimiter.WithAlgorithm(algorithm),
+				ratelimiter.WithLimit(1<<30, time.Second),
+			)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx := context.Background()
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				limiter.Allow(ctx, "bench")
+			}
+		})
+	}
+}
+
+func BenchmarkStorage(b *testing.B) {
+	backends := []struct {
+		name string
+		open func(b *testing.B) ratelimiter.Storage
+	}{
+		{"memory", func(b *testing.B) ratelimiter.Storage {
+			return storage.NewMemoryStorage()
+		}},
+		{"namespaced", func(b *testing.B) ratelimiter.Storage {
+			return storage.NewNamespacedStorage(storage.NewMemoryStorage(), "bench")
+		}},
+		{"write_behind", func(b *testing.B) ratelimiter.Storage {
+			return storage.NewWriteBehindStorage(storage.NewMemoryStorage(), 100*time.Millisecond, 1000)
+		}},
+		{"fallback", func(b *testing.B) ratelimiter.Storage {
+			return storage.NewFallbackStorage(storage.NewMemoryStorage(), 100*time.Millisecond, 5*time.Second)
+		}},
+		{"redis", func(b *testing.B) ratelimiter.Storage {
+			redisStorage, err := storage.NewRedisStorage(ratelimiter.StorageConfig{Host: "localhost", Port: "6379", DB: 1})
+			if err != nil {
+				b.Skip("Redis not available for benchmarking")
+			}
+			return redisStorage
+		}},
+	}
+
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			rateLimitStorage := backend.open(b)
+			defer rateLimitStorage.Close()
+
+			ctx := context.Background()
+			rateLimit := &ratelimiter.RateLimit{Count: 1, LastReset: time.Now()}
+
+			b.Run("get", func(b *testing.B) {
+				rateLimitStorage.Set(ctx, "bench", rateLimit, time.Minute)
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					rateLimitStorage.Get(ctx, "bench")
+				}
+			})
+
+			b.Run("set", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					rateLimitStorage.Set(ctx, "bench", rateLimit, time.Minute)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMiddlewareOverhead(b *testing.B) {
+	request := func() *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		return req
+	}
+
+	b.Run("bare", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			okHandler.ServeHTTP(httptest.NewRecorder(), request())
+		}
+	})
+
+	b.Run("rate_limited", func(b *testing.B) {
+		handler := RateLimiter(benchmarkService(storage.NewMemoryStorage()))(okHandler)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			handler.ServeHTTP(httptest.NewRecorder(), request())
+		}
+	})
+
+	b.Run("blocked", func(b *testing.B) {
+		service := benchmarkService(storage.NewMemoryStorage())
+		service.config.IPRateLimit = 0
+		handler := RateLimiter(service)(okHandler)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			handler.ServeHTTP(httptest.NewRecorder(), request())
+		}
+	})
+
+	b.Run("forwarded", func(b *testing.B) {
+		handler := RateLimiter(benchmarkService(storage.NewMemoryStorage()))(okHandler)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			req := request()
+			req.Header.Set("X-Forwarded-For", "203.0.113."+strconv.Itoa(i%250)+", 10.0.0.1")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	})
+}
+
+func BenchmarkHeaderEmission(b *testing.B) {
+	quotas := []QuotaStatus{
+		{Period: QuotaPeriodDay, Limit: 10000, Remaining: 9000, ResetAt: time.Now().Add(time.Hour)},
+		{Period: QuotaPeriodMonth, Limit: 200000, Remaining: 150000, ResetAt: time.Now().Add(24 * time.Hour)},
+	}
+
+	b.Run("quota_headers", func(b *testing.B) {
+		w := httptest.NewRecorder()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			setQuotaHeaders(w, quotas)
+		}
+	})
+
+	b.Run("error_body", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sendError(httptest.NewRecorder(), nil, http.StatusTooManyRequests, defaultMessages[MessageRateLimited])
+		}
+	})
+}
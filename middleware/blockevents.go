@@ -0,0 +1,212 @@
+package middleware
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// BlockEventVersion is the first byte of every datagram written by BlockEventEmitter
+const BlockEventVersion = 1
+
+// Reason codes of a block event
+const (
+	BlockReasonOther     = 0
+	BlockReasonRateLimit = 1
+	BlockReasonDenylist  = 2
+)
+
+var blockReasonCodes = map[string]byte{
+	"rate_limit": BlockReasonRateLimit,
+	"denylist":   BlockReasonDenylist,
+}
+
+// blockEventHeaderSize is the fixed part of a datagram, before the address
+const blockEventHeaderSize = 16
+
+// BlockEvent tells a kernel-level blocker (an eBPF/XDP program, an nftables updater) to
+// drop the packets of an IP. A Duration of 0 means until further notice, as for the
+// denylist.
+type BlockEvent struct {
+	IP       net.IP
+	Reason   byte
+	Duration time.Duration
+	Time     time.Time
+}
+
+// MarshalBinary encodes the event as one datagram, all integers big endian:
+//
+//	0  1 version (BlockEventVersion)
+//	1  1 reason code
+//	2  1 address length, 4 or 16
+//	3  1 reserved, 0
+//	4  4 block duration in seconds
+//	8  8 event time in Unix seconds
+//	16 4 or 16 IP address
+func (e BlockEvent) MarshalBinary() ([]byte, error) {
+	ip := e.IP.To4()
+	if ip == nil {
+		ip = e.IP.To16()
+	}
+	if ip == nil {
+		return nil, errors.New("block event without a valid IP")
+	}
+
+	data := make([]byte, blockEventHeaderSize+len(ip))
+	data[0] = BlockEventVersion
+	data[1] = e.Reason
+	data[2] = byte(len(ip))
+	binary.BigEndian.PutUint32(data[4:8], uint32(e.Duration/time.Second))
+	binary.BigEndian.PutUint64(data[8:16], uint64(e.Time.Unix()))
+	copy(data[blockEventHeaderSize:], ip)
+
+	return data, nil
+}
+
+// UnmarshalBinary decodes a datagram written by MarshalBinary
+func (e *BlockEvent) UnmarshalBinary(data []byte) error {
+	if len(data) < blockEventHeaderSize || data[0] != BlockEventVersion {
+		return errors.New("not a block event")
+	}
+	length := int(data[2])
+	if (length != net.IPv4len && length != net.IPv6len) || len(data) != blockEventHeaderSize+length {
+		return errors.New("block event with an invalid address length")
+	}
+
+	e.Reason = data[1]
+	e.Duration = time.Duration(binary.BigEndian.Uint32(data[4:8])) * time.Second
+	e.Time = time.Unix(int64(binary.BigEndian.Uint64(data[8:16])), 0)
+	e.IP = net.IP(append([]byte(nil), data[blockEventHeaderSize:]...))
+	return nil
+}
+
+// BlockEventEmitter writes a datagram to a local Unix socket for every client IP blocked
+// by the rate limit or the denylist. Only decisions keyed by the bare client IP qualify:
+// a token, a fingerprinted NAT address or the health check pool must not get a shared
+// IP dropped. An IP is sent once per block so the socket is not flooded.
+type BlockEventEmitter struct {
+	path string
+
+	mu   sync.Mutex
+	conn net.Conn
+	sent map[string]time.Time
+}
+
+// NewBlockEventEmitter returns nil when BLOCK_EVENTS_SOCKET is not set
+func NewBlockEventEmitter(path string) *BlockEventEmitter {
+	if path == "" {
+		return nil
+	}
+	return &BlockEventEmitter{path: path, sent: make(map[string]time.Time)}
+}
+
+// Run emits the blocks decided by the service until the context is done
+func (e *BlockEventEmitter) Run(ctx context.Context, service *Service) {
+	if e == nil {
+		return
+	}
+
+	decisions, unsubscribe := service.Decisions().Subscribe(1024)
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			e.close()
+			return
+		case decision := <-decisions:
+			event, ok := blockEvent(service, decision)
+			if !ok {
+				continue
+			}
+			if err := e.Emit(event); err != nil {
+				slog.Error("Failed to emit block event", "client_ip", decision.ClientIP, "error", err)
+			}
+		}
+	}
+}
+
+func blockEvent(service *Service, decision Decision) (BlockEvent, bool) {
+	reason, blocking := blockReasonCodes[decision.Reason]
+	if decision.Allowed || !blocking || decision.ClientIP == "" || decision.Key != decision.ClientIP {
+		return BlockEvent{}, false
+	}
+	ip := net.ParseIP(decision.ClientIP)
+	if ip == nil {
+		return BlockEvent{}, false
+	}
+
+	event := BlockEvent{IP: ip, Reason: reason, Time: decision.Time}
+	if reason == BlockReasonRateLimit {
+		event.Duration = time.Duration(service.getBlockTime(decision.Key, false)) * time.Second
+	}
+	return event, true
+}
+
+// blockEventResend is how often an IP blocked until further notice is sent again, so a
+// blocker restarted in the meantime learns about it
+const blockEventResend = time.Minute
+
+// Emit writes the event unless the same IP was sent for a block that is still running
+func (e *BlockEventEmitter) Emit(event BlockEvent) error {
+	data, err := event.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ip := event.IP.String()
+	if until, exists := e.sent[ip]; exists && event.Time.Before(until) {
+		return nil
+	}
+
+	if e.conn == nil {
+		conn, err := net.Dial("unixgram", e.path)
+		if err != nil {
+			return err
+		}
+		e.conn = conn
+	}
+	if _, err := e.conn.Write(data); err != nil {
+		e.conn.Close()
+		e.conn = nil
+		return err
+	}
+
+	until := event.Duration
+	if until <= 0 {
+		until = blockEventResend
+	}
+	e.sent[ip] = event.Time.Add(until)
+	e.prune(event.Time)
+
+	return nil
+}
+
+// prune forgets IPs whose block is over once the map grows large
+func (e *BlockEventEmitter) prune(now time.Time) {
+	if len(e.sent) < 10000 {
+		return
+	}
+	for ip, until := range e.sent {
+		if !now.Before(until) {
+			delete(e.sent, ip)
+		}
+	}
+}
+
+func (e *BlockEventEmitter) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.conn != nil {
+		e.conn.Close()
+		e.conn = nil
+	}
+}
@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockEventEncoding(t *testing.T) {
+	at := time.Unix(1767225600, 0)
+	for _, ip := range []string{"203.0.113.7", "2001:db8::1"} {
+		data, err := BlockEvent{IP: net.ParseIP(ip), Reason: BlockReasonRateLimit, Duration: 5 * time.Minute, Time: at}.MarshalBinary()
+		require.NoError(t, err)
+
+		var event BlockEvent
+		require.NoError(t, event.UnmarshalBinary(data))
+		assert.Equal(t, ip, event.IP.String())
+		assert.Equal(t, byte(BlockReasonRateLimit), event.Reason)
+		assert.Equal(t, 5*time.Minute, event.Duration)
+		assert.True(t, at.Equal(event.Time))
+	}
+
+	data, _ := BlockEvent{IP: net.ParseIP("203.0.113.7"), Time: at}.MarshalBinary()
+	assert.Len(t, data, 20, "IPv4 addresses take 4 bytes")
+
+	var event BlockEvent
+	assert.Error(t, event.UnmarshalBinary(data[:10]))
+}
+
+func TestBlockEventEmitter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks.sock")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer listener.Close()
+
+	service := NewService(storage.Config{
+		IPRateLimit: 1,
+		IPBlockTime: 120,
+		TokenLimits: map[string]int{"gold": 1},
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	emitter := NewBlockEventEmitter(path)
+	subscribed := make(chan struct{})
+	go func() {
+		for !service.Decisions().hasSubscribers() {
+			time.Sleep(time.Millisecond)
+		}
+		close(subscribed)
+	}()
+	go emitter.Run(ctx, service)
+	<-subscribed
+
+	send := func(ip, apiKey string) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":12345"
+		if apiKey != "" {
+			req.Header.Set("API_KEY", apiKey)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for i := 0; i < 3; i++ {
+		send("198.51.100.9", "gold")
+	}
+	for i := 0; i < 3; i++ {
+		send("203.0.113.7", "")
+	}
+
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	n, err := listener.Read(buf)
+	require.NoError(t, err)
+
+	var event BlockEvent
+	require.NoError(t, event.UnmarshalBinary(buf[:n]))
+	assert.Equal(t, "203.0.113.7", event.IP.String(), "token denials are not sent")
+	assert.Equal(t, 120*time.Second, event.Duration)
+
+	listener.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = listener.Read(buf)
+	assert.Error(t, err, "the IP is sent once per block")
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"rate-limiter/storage"
+	"time"
+)
+
+// ClearStaleBlocks deletes the counters of keys blocked for longer than maxAge. New
+// blocks are capped by MAX_BLOCK_TIME already; this is the safety valve for blocks
+// written by instances running an older config, so no customer stays locked out.
+// It returns how many keys were unblocked.
+func (s *Service) ClearStaleBlocks(ctx context.Context, maxAge time.Duration) (int, error) {
+	keys, err := s.adminStorage().List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	now := s.now()
+	cleared := 0
+	for _, key := range keys {
+		rateLimit, err := s.adminStorage().Get(ctx, key)
+		if err != nil {
+			return cleared, err
+		}
+		if rateLimit == nil || rateLimit.BlockedAt.IsZero() || now.Sub(rateLimit.BlockedAt) < maxAge {
+			continue
+		}
+
+		if err := s.adminStorage().Delete(ctx, key); err != nil {
+			return cleared, err
+		}
+		slog.Info("Cleared block", "key", storage.RedactKey(key), "blocked_at", rateLimit.BlockedAt.Format(time.RFC3339))
+		cleared++
+	}
+
+	s.clearedBlocks.Add(uint64(cleared))
+	return cleared, nil
+}
+
+// ClearedBlocks returns how many blocks the safety valve lifted
+func (s *Service) ClearedBlocks() uint64 {
+	return s.clearedBlocks.Load()
+}
+
+// RunBlockSweep clears blocks older than MAX_BLOCK_TIME every interval. The sweep
+// lists the whole storage, app namespaces included, so it runs on one service and
+// only on the leader.
+func (s *Service) RunBlockSweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			maxBlockTime := s.Config().MaxBlockTime
+			if maxBlockTime <= 0 || !s.elector.IsLeader() {
+				continue
+			}
+			if _, err := s.ClearStaleBlocks(ctx, time.Duration(maxBlockTime)*time.Second); err != nil {
+				slog.Error("Failed to clear stale blocks", "error", err)
+			}
+		}
+	}
+}
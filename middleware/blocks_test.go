@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxBlockTimeCapsBlocks(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:     1,
+		IPBlockTime:     30 * 24 * 3600,
+		TokenBlockTimes: map[string]int{"gold": 60},
+		MaxBlockTime:    3600,
+	}, storage.NewMemoryStorage())
+
+	assert.Equal(t, 3600, service.getBlockTime("10.0.0.1", false))
+	assert.Equal(t, 60, service.getBlockTime("token:gold", true), "shorter block times are kept")
+
+	_, err := service.checkRateLimit(context.Background(), "10.0.0.1", false, 1)
+	require.NoError(t, err)
+	check, err := service.checkRateLimit(context.Background(), "10.0.0.1", false, 1)
+	require.NoError(t, err)
+	assert.False(t, check.Allowed)
+	assert.Equal(t, time.Hour, check.RetryAfter)
+
+	service.config.MaxBlockTime = 0
+	assert.Equal(t, 30*24*3600, service.getBlockTime("10.0.0.1", false), "0 disables the cap")
+}
+
+func TestClearStaleBlocks(t *testing.T) {
+	ctx := context.Background()
+	memory := storage.NewMemoryStorage()
+	service := NewService(storage.Config{IPRateLimit: 10, IPBlockTime: 300}, memory)
+
+	now := time.Now()
+	require.NoError(t, memory.Set(ctx, "10.0.0.1", &ratelimiter.RateLimit{Count: 11, LastReset: now, BlockedAt: now.Add(-48 * time.Hour)}, 365*24*time.Hour))
+	require.NoError(t, memory.Set(ctx, "10.0.0.2", &ratelimiter.RateLimit{Count: 11, LastReset: now, BlockedAt: now.Add(-time.Minute)}, time.Hour))
+	require.NoError(t, memory.Set(ctx, "10.0.0.3", &ratelimiter.RateLimit{Count: 3, LastReset: now}, time.Hour))
+
+	cleared, err := service.ClearStaleBlocks(ctx, 24*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, cleared)
+	assert.Equal(t, uint64(1), service.ClearedBlocks())
+
+	keys, err := memory.List(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.3"}, keys)
+}
+
+func TestMaxBlockTimeWarnings(t *testing.T) {
+	warnings := storage.Config{
+		IPRateLimit:     10,
+		IPBlockTime:     7200,
+		TokenBlockTimes: map[string]int{"gold": 60, "silver": 99999},
+		MaxBlockTime:    3600,
+	}.Warnings()
+
+	assert.Equal(t, []string{
+		"IP_BLOCK_TIME 7200s is capped at MAX_BLOCK_TIME 3600s",
+		"TOKEN_silver_BLOCK_TIME 99999s is capped at MAX_BLOCK_TIME 3600s",
+	}, warnings)
+}
@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"rate-limiter/storage"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCache is a short-lived cache of GET responses per rate limit key. A client
+// repeating the same request within the TTL gets the cached response without consuming
+// quota or reaching the backend, which absorbs refresh storms.
+type ResponseCache struct {
+	paths        []string
+	ttl          time.Duration
+	maxBodyBytes int64
+	maxEntries   int
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+type cachedResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	expiresAt  time.Time
+}
+
+// NewResponseCache returns nil when no path is configured for caching
+func NewResponseCache(config storage.Config) *ResponseCache {
+	if len(config.ResponseCachePaths) == 0 || config.ResponseCacheTTL <= 0 {
+		return nil
+	}
+
+	return &ResponseCache{
+		paths:        config.ResponseCachePaths,
+		ttl:          time.Duration(config.ResponseCacheTTL) * time.Millisecond,
+		maxBodyBytes: config.ResponseCacheMaxBodyBytes,
+		maxEntries:   config.ResponseCacheMaxEntries,
+		entries:      make(map[string]*cachedResponse),
+	}
+}
+
+// Cacheable reports whether the request may be served from or stored in the cache
+func (c *ResponseCache) Cacheable(r *http.Request) bool {
+	if c == nil || r.Method != http.MethodGet || isWebSocketUpgrade(r) {
+		return false
+	}
+
+	for _, path := range c.paths {
+		if strings.HasPrefix(r.URL.Path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func responseCacheKey(key string, r *http.Request) string {
+	return key + "|" + r.URL.RequestURI() + "|" + r.Header.Get("Accept") + "|" + r.Header.Get("Accept-Encoding")
+}
+
+// Serve writes the cached response for the key, returning false on a miss
+func (c *ResponseCache) Serve(w http.ResponseWriter, cacheKey string) bool {
+	c.mu.Lock()
+	entry, exists := c.entries[cacheKey]
+	if exists && time.Now().After(entry.expiresAt) {
+		delete(c.entries, cacheKey)
+		exists = false
+	}
+	c.mu.Unlock()
+
+	if !exists {
+		return false
+	}
+
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(entry.statusCode)
+	w.Write(entry.body)
+
+	return true
+}
+
+// Store keeps a successful response captured by the recorder
+func (c *ResponseCache) Store(cacheKey string, recorder *cacheRecorder) {
+	if recorder.overflow || recorder.statusCode != http.StatusOK || recorder.Header().Get("Set-Cookie") != "" {
+		return
+	}
+	if strings.Contains(recorder.Header().Get("Cache-Control"), "no-store") {
+		return
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= c.maxEntries {
+		for key, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			return
+		}
+	}
+
+	c.entries[cacheKey] = &cachedResponse{
+		statusCode: recorder.statusCode,
+		header:     recorder.Header().Clone(),
+		body:       recorder.body.Bytes(),
+		expiresAt:  now.Add(c.ttl),
+	}
+}
+
+// cacheRecorder passes the response through while keeping a copy for the cache
+type cacheRecorder struct {
+	http.ResponseWriter
+	statusCode   int
+	body         bytes.Buffer
+	maxBodyBytes int64
+	overflow     bool
+}
+
+func (c *ResponseCache) recorder(w http.ResponseWriter) *cacheRecorder {
+	return &cacheRecorder{ResponseWriter: w, statusCode: http.StatusOK, maxBodyBytes: c.maxBodyBytes}
+}
+
+func (r *cacheRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *cacheRecorder) Write(data []byte) (int, error) {
+	if !r.overflow {
+		if int64(r.body.Len()+len(data)) > r.maxBodyBytes {
+			r.overflow = true
+			r.body.Reset()
+		} else {
+			r.body.Write(data)
+		}
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *cacheRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCachingService(ttl int) *Service {
+	config := storage.Config{
+		IPRateLimit:               1,
+		IPBlockTime:               60,
+		ResponseCachePaths:        []string{"/feed"},
+		ResponseCacheTTL:          ttl,
+		ResponseCacheMaxBodyBytes: 1024,
+		ResponseCacheMaxEntries:   10,
+	}
+	return &Service{
+		config:        config,
+		storage:       storage.NewMemoryStorage(),
+		responseCache: NewResponseCache(config),
+	}
+}
+
+func TestNewResponseCacheDisabled(t *testing.T) {
+	assert.Nil(t, NewResponseCache(storage.Config{ResponseCacheTTL: 1000}))
+	assert.False(t, (*ResponseCache)(nil).Cacheable(httptest.NewRequest("GET", "/feed", nil)))
+}
+
+func TestRateLimiterResponseCache(t *testing.T) {
+	calls := 0
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "call %d", calls)
+	})
+
+	service := newCachingService(1000)
+	handler := RateLimiter(service)(testHandler)
+
+	send := func(method, path, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	first := send("GET", "/feed", "192.168.1.1:1234")
+	require.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "call 1", first.Body.String())
+
+	for i := 0; i < 3; i++ {
+		cached := send("GET", "/feed", "192.168.1.1:1234")
+		assert.Equal(t, http.StatusOK, cached.Code, "cached responses don't consume quota")
+		assert.Equal(t, "call 1", cached.Body.String())
+		assert.Equal(t, "HIT", cached.Header().Get("X-Cache"))
+	}
+	assert.Equal(t, 1, calls)
+
+	assert.Equal(t, http.StatusTooManyRequests, send("GET", "/feed?page=2", "192.168.1.1:1234").Code)
+	assert.Equal(t, http.StatusTooManyRequests, send("GET", "/other", "192.168.1.1:1234").Code)
+
+	other := send("GET", "/feed", "192.168.1.2:1234")
+	assert.Equal(t, "call 2", other.Body.String(), "responses are cached per key")
+}
+
+func TestResponseCacheExpiresAndSkipsUncacheable(t *testing.T) {
+	status := http.StatusInternalServerError
+	calls := 0
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+	})
+
+	service := newCachingService(20)
+	service.config.IPRateLimit = 100
+	handler := RateLimiter(service)(testHandler)
+
+	send := func() {
+		req := httptest.NewRequest("GET", "/feed", nil)
+		req.RemoteAddr = "192.168.1.1:1234"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	send()
+	send()
+	assert.Equal(t, 2, calls, "errors are not cached")
+
+	status = http.StatusOK
+	send()
+	send()
+	assert.Equal(t, 3, calls)
+
+	time.Sleep(30 * time.Millisecond)
+	send()
+	assert.Equal(t, 4, calls, "entries expire after the TTL")
+}
@@ -0,0 +1,285 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"sync"
+	"time"
+)
+
+// canaryKeyPrefix is reserved for the counters of the canary, one set per instance
+const canaryKeyPrefix = "canary:"
+
+// canaryLimit is how many checks of a cycle fit in the window; the next one must be refused
+const canaryLimit = 3
+
+// CanaryStatus is the outcome of the latest canary cycle and the totals so far
+type CanaryStatus struct {
+	Ready               bool      `json:"ready"`
+	CheckedAt           time.Time `json:"checked_at"`
+	LatencyMs           float64   `json:"latency_ms"`
+	Error               string    `json:"error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Runs                uint64    `json:"runs"`
+	Failures            uint64    `json:"failures"`
+}
+
+// Canary runs end-to-end check cycles against the storage under a reserved key of the
+// instance, so a storage that answers but misbehaves shows up before the limits do.
+// A cycle fails when the counter math is off, when a sentinel written by the previous
+// cycle is gone before its TTL (eviction of limiter keys) or when it takes longer
+// than CANARY_MAX_LATENCY_MS. After CANARY_FAILURE_THRESHOLD failed cycles in a row
+// the instance reports not ready, and CANARY_ALERT_WEBHOOK is notified when that
+// happens and when it recovers.
+type Canary struct {
+	storage    ratelimiter.Storage
+	limiter    *ratelimiter.Limiter
+	key        string
+	interval   time.Duration
+	maxLatency time.Duration
+	threshold  int
+	webhook    string
+	client     *http.Client
+
+	mu       sync.Mutex
+	status   CanaryStatus
+	sequence int
+}
+
+// NewCanary returns nil when CANARY_INTERVAL is not set
+func NewCanary(config storage.Config, rateLimitStorage ratelimiter.Storage) *Canary {
+	if config.CanaryInterval <= 0 {
+		return nil
+	}
+
+	limiter, _ := ratelimiter.NewLimiter(
+		ratelimiter.WithStorage(rateLimitStorage),
+		ratelimiter.WithLimit(canaryLimit, time.Minute),
+		ratelimiter.WithBlockTime(time.Second),
+	)
+	hostname, _ := os.Hostname()
+
+	return &Canary{
+		storage:    rateLimitStorage,
+		limiter:    limiter,
+		key:        fmt.Sprintf("%s%s-%d-%d", canaryKeyPrefix, hostname, os.Getpid(), time.Now().UnixNano()),
+		interval:   time.Duration(config.CanaryInterval) * time.Second,
+		maxLatency: time.Duration(config.CanaryMaxLatency) * time.Millisecond,
+		threshold:  max(config.CanaryFailureThreshold, 1),
+		webhook:    config.CanaryAlertWebhook,
+		client:     &http.Client{Timeout: 5 * time.Second},
+		status:     CanaryStatus{Ready: true},
+	}
+}
+
+// Run checks the storage every interval until the context is done. Cycles are skipped
+// while paused reports true, such as in read-only mode where the canary can't write.
+func (c *Canary) Run(ctx context.Context, paused func() bool) {
+	if c == nil {
+		return
+	}
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		if !paused() {
+			c.Check(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check runs one cycle and records its outcome
+func (c *Canary) Check(ctx context.Context) CanaryStatus {
+	start := time.Now()
+	err := c.cycle(ctx)
+	latency := time.Since(start)
+	if err == nil && c.maxLatency > 0 && latency > c.maxLatency {
+		err = fmt.Errorf("cycle took %v, over the %v limit", latency.Round(time.Millisecond), c.maxLatency)
+	}
+
+	c.mu.Lock()
+	wasReady := c.status.Ready
+	c.status.CheckedAt = start
+	c.status.LatencyMs = float64(latency.Microseconds()) / 1000
+	c.status.Runs++
+	if err != nil {
+		c.status.Error = err.Error()
+		c.status.ConsecutiveFailures++
+		c.status.Failures++
+	} else {
+		c.status.Error = ""
+		c.status.ConsecutiveFailures = 0
+	}
+	c.status.Ready = c.status.ConsecutiveFailures < c.threshold
+	status := c.status
+	c.mu.Unlock()
+
+	if err != nil {
+		slog.Warn("Storage canary failed", "error", err)
+	}
+	if status.Ready != wasReady {
+		c.alert(ctx, status)
+	}
+	return status
+}
+
+// cycle resets the counter of the instance, checks that the limiter counts it down to
+// a refusal, reads it back and verifies the sentinel of the previous cycle
+func (c *Canary) cycle(ctx context.Context) error {
+	if err := c.storage.Delete(ctx, c.key); err != nil {
+		return fmt.Errorf("reset counter: %w", err)
+	}
+	defer c.storage.Delete(context.Background(), c.key)
+
+	for i := 1; i <= canaryLimit+1; i++ {
+		result, err := c.limiter.Allow(ctx, c.key)
+		if err != nil {
+			return fmt.Errorf("check %d: %w", i, err)
+		}
+		if want := i <= canaryLimit; result.Allowed != want {
+			return fmt.Errorf("check %d: allowed is %t, want %t", i, result.Allowed, want)
+		}
+		if want := canaryLimit - i; i <= canaryLimit && result.Remaining != want {
+			return fmt.Errorf("check %d: %d remaining, want %d", i, result.Remaining, want)
+		}
+	}
+
+	state, err := c.storage.Get(ctx, c.key)
+	if err != nil {
+		return fmt.Errorf("read counter: %w", err)
+	}
+	if state == nil || state.Count != canaryLimit {
+		return fmt.Errorf("counter read back as %v, want a count of %d", state, canaryLimit)
+	}
+
+	return c.checkSentinel(ctx)
+}
+
+// checkSentinel expects the sentinel written by the previous cycle, which lives for
+// three intervals, and writes the next one even when it was missing
+func (c *Canary) checkSentinel(ctx context.Context) error {
+	sentinelKey := c.key + ":sentinel"
+
+	c.mu.Lock()
+	sequence := c.sequence
+	c.mu.Unlock()
+
+	var err error
+	if sequence > 0 {
+		var sentinel *ratelimiter.RateLimit
+		sentinel, err = c.storage.Get(ctx, sentinelKey)
+		switch {
+		case err != nil:
+			err = fmt.Errorf("read sentinel: %w", err)
+		case sentinel == nil:
+			err = fmt.Errorf("sentinel %d was evicted before its TTL", sequence)
+		case sentinel.Count != sequence:
+			err = fmt.Errorf("sentinel read back as %d, want %d", sentinel.Count, sequence)
+		}
+	}
+
+	next := &ratelimiter.RateLimit{Count: sequence + 1, LastReset: time.Now()}
+	if writeErr := c.storage.Set(ctx, sentinelKey, next, 3*c.interval); writeErr != nil {
+		c.setSequence(0)
+		if err == nil {
+			err = fmt.Errorf("write sentinel: %w", writeErr)
+		}
+		return err
+	}
+	c.setSequence(next.Count)
+	return err
+}
+
+func (c *Canary) setSequence(sequence int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sequence = sequence
+}
+
+// Status returns the outcome of the latest cycle
+func (c *Canary) Status() CanaryStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.status
+}
+
+// Ready reports whether fewer cycles than the threshold failed in a row. A nil canary
+// is always ready.
+func (c *Canary) Ready() bool {
+	return c == nil || c.Status().Ready
+}
+
+// canaryAlert is the body POSTed to CANARY_ALERT_WEBHOOK
+type canaryAlert struct {
+	Status string `json:"status"`
+	CanaryStatus
+}
+
+// alert logs the change of readiness and posts it to the webhook, best effort
+func (c *Canary) alert(ctx context.Context, status CanaryStatus) {
+	state := "recovered"
+	if !status.Ready {
+		state = "failing"
+	}
+	slog.Warn("Storage canary changed state", "state", state, "runs", status.Runs)
+
+	if c.webhook == "" {
+		return
+	}
+	body, err := json.Marshal(canaryAlert{Status: state, CanaryStatus: status})
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.webhook, bytes.NewReader(body))
+	if err != nil {
+		slog.Error("Failed to deliver canary alert", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		slog.Error("Failed to deliver canary alert", "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		slog.Error("Failed to deliver canary alert", "status", resp.Status)
+	}
+}
+
+// RunCanary runs the storage canary of the service until the context is done, pausing
+// it in read-only mode
+func (s *Service) RunCanary(ctx context.Context) {
+	s.canary.Run(ctx, s.IsReadOnly)
+}
+
+// Ready reports whether the storage canary considers the storage healthy
+func (s *Service) Ready() bool {
+	return s.canary.Ready()
+}
+
+// CanaryStatus returns the outcome of the latest canary cycle, nil when the canary is off
+func (s *Service) CanaryStatus() *CanaryStatus {
+	if s.canary == nil {
+		return nil
+	}
+	status := s.canary.Status()
+	return &status
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// forgetfulStorage drops every write, like a Redis evicting keys as soon as they land
+type forgetfulStorage struct {
+	plainStorage
+}
+
+func (f forgetfulStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
+	return nil
+}
+
+func TestCanary(t *testing.T) {
+	assert.Nil(t, NewCanary(storage.Config{}, storage.NewMemoryStorage()))
+	var disabled *Canary
+	assert.True(t, disabled.Ready())
+
+	alerts := make(chan canaryAlert, 2)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert canaryAlert
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&alert))
+		alerts <- alert
+	}))
+	defer webhook.Close()
+
+	ctx := context.Background()
+	memory := storage.NewMemoryStorage()
+	canary := NewCanary(storage.Config{
+		CanaryInterval:         10,
+		CanaryMaxLatency:       1000,
+		CanaryFailureThreshold: 2,
+		CanaryAlertWebhook:     webhook.URL,
+	}, memory)
+	require.NotNil(t, canary)
+
+	status := canary.Check(ctx)
+	assert.True(t, status.Ready)
+	assert.Empty(t, status.Error)
+	assert.Equal(t, uint64(1), status.Runs)
+	state, err := memory.Get(ctx, canary.key)
+	require.NoError(t, err)
+	assert.Nil(t, state, "the counter is removed after the cycle")
+
+	assert.True(t, canary.Check(ctx).Ready, "the sentinel of the first cycle is found")
+
+	require.NoError(t, memory.Delete(ctx, canary.key+":sentinel"))
+	status = canary.Check(ctx)
+	assert.Contains(t, status.Error, "evicted")
+	assert.True(t, status.Ready, "a single failure stays under the threshold")
+
+	require.NoError(t, memory.Delete(ctx, canary.key+":sentinel"))
+	status = canary.Check(ctx)
+	assert.False(t, status.Ready)
+	assert.Equal(t, 2, status.ConsecutiveFailures)
+	assert.Equal(t, uint64(2), status.Failures)
+	assert.Equal(t, "failing", (<-alerts).Status)
+
+	assert.True(t, canary.Check(ctx).Ready)
+	assert.Equal(t, "recovered", (<-alerts).Status)
+}
+
+func TestCanaryCounterMath(t *testing.T) {
+	canary := NewCanary(storage.Config{CanaryInterval: 10}, forgetfulStorage{plainStorage{storage.NewMemoryStorage()}})
+
+	status := canary.Check(context.Background())
+	assert.Contains(t, status.Error, "check 2: 2 remaining, want 1")
+}
+
+func TestServiceCanaryStats(t *testing.T) {
+	service := NewService(storage.Config{IPRateLimit: 10}, storage.NewMemoryStorage())
+	assert.True(t, service.Ready())
+	assert.Nil(t, service.Stats().Canary)
+
+	service = NewService(storage.Config{IPRateLimit: 10, CanaryInterval: 10}, storage.NewMemoryStorage())
+	service.canary.Check(context.Background())
+	require.NotNil(t, service.Stats().Canary)
+	assert.Equal(t, uint64(1), service.Stats().Canary.Runs)
+}
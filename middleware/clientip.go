@@ -0,0 +1,195 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// defaultClientIPHeaders carry the client IP, by precedence, when CLIENT_IP_HEADERS is
+// not set
+var defaultClientIPHeaders = []string{"X-Forwarded-For", "Forwarded", "X-Real-IP", "CF-Connecting-IP"}
+
+// ClientIPResolver determines the client IP, honoring forwarded headers only when
+// the request comes from a trusted proxy. Without trusted proxies any client could set
+// them, so the peer of the request is the client.
+type ClientIPResolver struct {
+	trusted []*net.IPNet
+	headers []string
+
+	// warned is set once a forwarded header was ignored for want of trusted proxies
+	warned atomic.Bool
+}
+
+// NewClientIPResolver parses the trusted proxies, given as CIDRs or plain IPs. The client
+// IP is looked for in the headers in order, defaultClientIPHeaders when there are none.
+func NewClientIPResolver(trustedProxies, headers []string) (*ClientIPResolver, error) {
+	resolver := &ClientIPResolver{headers: headers}
+	if len(resolver.headers) == 0 {
+		resolver.headers = defaultClientIPHeaders
+	}
+
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", proxy)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			proxy = fmt.Sprintf("%s/%d", ip.String(), bits)
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", proxy)
+		}
+		resolver.trusted = append(resolver.trusted, network)
+	}
+
+	return resolver, nil
+}
+
+func (c *ClientIPResolver) isTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, network := range c.trusted {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromTrustedProxy reports whether the peer of the request is one of the trusted proxies
+func (c *ClientIPResolver) fromTrustedProxy(r *http.Request) bool {
+	return c != nil && c.isTrusted(getRemoteIP(r))
+}
+
+// Headers returns the headers the client IP is looked for in, by precedence
+func (c *ClientIPResolver) Headers() []string {
+	if c == nil {
+		return nil
+	}
+	return c.headers
+}
+
+// ClientIP returns the client IP of the request in its canonical form
+func (c *ClientIPResolver) ClientIP(r *http.Request) string {
+	return normalizeIP(c.resolve(r))
+}
+
+func (c *ClientIPResolver) resolve(r *http.Request) string {
+	remoteIP := getRemoteIP(r)
+	if c == nil {
+		return remoteIP
+	}
+	if len(c.trusted) == 0 {
+		c.warnUntrusted(r)
+		return remoteIP
+	}
+	if !c.isTrusted(remoteIP) {
+		return remoteIP
+	}
+
+	for _, header := range c.headers {
+		if hop, found := c.untrustedHop(headerHops(r, header)); found {
+			return hop
+		}
+	}
+	return remoteIP
+}
+
+// warnUntrusted logs, once, that the requests carry client IP headers that are ignored
+// because no proxy is trusted: behind a load balancer every client then shares its IP
+func (c *ClientIPResolver) warnUntrusted(r *http.Request) {
+	if c.warned.Load() {
+		return
+	}
+	for _, header := range c.headers {
+		if r.Header.Get(header) != "" {
+			if c.warned.CompareAndSwap(false, true) {
+				slog.Warn("Ignoring the client IP headers of requests, set TRUSTED_PROXIES to the proxies in front of the limiter to honor them", "header", header)
+			}
+			return
+		}
+	}
+}
+
+// headerHops lists the addresses of a client IP header, every proxy appending its own
+// to X-Forwarded-For and Forwarded while headers like X-Real-IP hold a single one
+func headerHops(r *http.Request, header string) []string {
+	if strings.EqualFold(header, "Forwarded") {
+		return forwardedFor(r)
+	}
+	values := r.Header.Values(header)
+	if len(values) == 0 {
+		return nil
+	}
+	return strings.Split(strings.Join(values, ","), ",")
+}
+
+// untrustedHop walks the hops of a forwarding chain right-to-left: the rightmost
+// untrusted hop is the first address that was not appended by one of our own proxies.
+// An invalid hop ends the walk without a client IP.
+func (c *ClientIPResolver) untrustedHop(hops []string) (string, bool) {
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if !isValidIP(hop) {
+			break
+		}
+		if !c.isTrusted(hop) || i == 0 {
+			return hop, true
+		}
+	}
+	return "", false
+}
+
+// forwardedFor returns the for= node of every element of the Forwarded headers (RFC 7239)
+// in order, as an IP, or empty when it is missing, obfuscated or "unknown"
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	for _, header := range r.Header.Values("Forwarded") {
+		for _, element := range strings.Split(header, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(name, "for") {
+					hop = forwardedNode(value)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// forwardedNode strips the quotes, the brackets of IPv6 and the port off a node of the
+// Forwarded header, such as "[2001:db8::17]:4711"
+func forwardedNode(node string) string {
+	node = strings.Trim(node, `"`)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	if !isValidIP(node) {
+		return ""
+	}
+	return node
+}
+
+func getRemoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
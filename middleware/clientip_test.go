@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8", "172.16.0.1"}, nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		remoteAddr string
+		expectedIP string
+	}{
+		{
+			name:       "untrusted_remote_ignores_xff",
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4"},
+			remoteAddr: "203.0.113.9:12345",
+			expectedIP: "203.0.113.9",
+		},
+		{
+			name:       "trusted_remote_uses_xff",
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4"},
+			remoteAddr: "10.0.0.1:12345",
+			expectedIP: "1.2.3.4",
+		},
+		{
+			name:       "spoofed_leftmost_hop",
+			headers:    map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 172.16.0.1"},
+			remoteAddr: "10.0.0.1:12345",
+			expectedIP: "1.2.3.4",
+		},
+		{
+			name:       "all_hops_trusted",
+			headers:    map[string]string{"X-Forwarded-For": "10.1.1.1, 10.2.2.2"},
+			remoteAddr: "10.0.0.1:12345",
+			expectedIP: "10.1.1.1",
+		},
+		{
+			name:       "trusted_remote_real_ip",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.1"},
+			remoteAddr: "172.16.0.1:12345",
+			expectedIP: "198.51.100.1",
+		},
+		{
+			name:       "untrusted_remote_ignores_real_ip",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.1"},
+			remoteAddr: "172.16.0.2:12345",
+			expectedIP: "172.16.0.2",
+		},
+		{
+			name:       "trusted_remote_uses_forwarded",
+			headers:    map[string]string{"Forwarded": `for=6.6.6.6, for="[2001:db8:cafe::17]:4711";proto=https, for=172.16.0.1;by=10.0.0.1`},
+			remoteAddr: "10.0.0.1:12345",
+			expectedIP: "2001:db8:cafe::17",
+		},
+		{
+			name:       "forwarded_obfuscated_hop",
+			headers:    map[string]string{"Forwarded": "for=1.2.3.4, for=_hidden", "X-Real-IP": "198.51.100.1"},
+			remoteAddr: "10.0.0.1:12345",
+			expectedIP: "198.51.100.1",
+		},
+		{
+			name:       "untrusted_remote_ignores_forwarded",
+			headers:    map[string]string{"Forwarded": "for=1.2.3.4"},
+			remoteAddr: "203.0.113.9:12345",
+			expectedIP: "203.0.113.9",
+		},
+		{
+			name:       "trusted_remote_no_headers",
+			headers:    map[string]string{},
+			remoteAddr: "10.0.0.1:12345",
+			expectedIP: "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+
+			assert.Equal(t, tt.expectedIP, resolver.ClientIP(req))
+		})
+	}
+}
+
+func TestClientIPResolverWithoutTrustedProxies(t *testing.T) {
+	resolver, err := NewClientIPResolver(nil, nil)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.9:12345"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+	assert.Equal(t, "203.0.113.9", resolver.ClientIP(req), "any client could set the header")
+
+	req.Header.Del("X-Forwarded-For")
+	req.Header.Set("Forwarded", `For="192.0.2.43:47011", for=10.0.0.1`)
+	assert.Equal(t, "203.0.113.9", resolver.ClientIP(req))
+}
+
+func TestClientIPResolverHeaders(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8"}, []string{"True-Client-IP", "X-Forwarded-For"})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("X-Real-IP", "198.51.100.1")
+	assert.Equal(t, "1.2.3.4", resolver.ClientIP(req), "headers left out are ignored")
+
+	req.Header.Set("True-Client-IP", "203.0.113.7")
+	assert.Equal(t, "203.0.113.7", resolver.ClientIP(req), "the first header listed wins")
+
+	req.RemoteAddr = "192.0.2.1:12345"
+	assert.Equal(t, "192.0.2.1", resolver.ClientIP(req), "only trusted proxies set them")
+
+	resolver, err = NewClientIPResolver([]string{"192.0.2.1"}, []string{"Fastly-Client-IP"})
+	require.NoError(t, err)
+	req.Header.Set("Fastly-Client-IP", "2001:db8::1")
+	assert.Equal(t, "2001:db8::1", resolver.ClientIP(req))
+}
+
+func TestNewClientIPResolverInvalid(t *testing.T) {
+	_, err := NewClientIPResolver([]string{"not-a-cidr"}, nil)
+	assert.Error(t, err)
+
+	_, err = NewClientIPResolver([]string{"10.0.0.0/40"}, nil)
+	assert.Error(t, err)
+}
+
+func TestLoadTrustedProxies(t *testing.T) {
+	unsetEnv(t, "APPS", "HOST_TEMPLATES")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8,192.168.1.1")
+	appConfig, err := storage.LoadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.1"}, appConfig.RateLimit.TrustedProxies)
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8,10.0.0.0/40")
+	_, err = storage.LoadConfig()
+	assert.ErrorContains(t, err, "TRUSTED_PROXIES", "a typo stops startup instead of trusting no proxy")
+}
+
+func TestRateLimiterIgnoresSpoofedForwarded(t *testing.T) {
+	handler := func(trustedProxies []string) http.Handler {
+		service := NewService(storage.Config{IPRateLimit: 1, IPBlockTime: 60, TrustedProxies: trustedProxies}, storage.NewMemoryStorage())
+		return RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	}
+	send := func(handler http.Handler, forwardedFor string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		req.Header.Set("Forwarded", "for="+forwardedFor)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	untrusted := handler(nil)
+	assert.Equal(t, http.StatusOK, send(untrusted, "192.0.2.1"))
+	assert.Equal(t, http.StatusTooManyRequests, send(untrusted, "192.0.2.2"), "a new for= does not get the client a new bucket")
+
+	trusted := handler([]string{"10.0.0.1"})
+	assert.Equal(t, http.StatusOK, send(trusted, "192.0.2.1"))
+	assert.Equal(t, http.StatusOK, send(trusted, "192.0.2.2"), "behind a trusted proxy each client has its own")
+}
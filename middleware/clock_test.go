@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceWithManualClock(t *testing.T) {
+	ctx := context.Background()
+	clock := ratelimiter.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	memoryStorage := storage.NewMemoryStorage()
+	memoryStorage.SetClock(clock)
+	service := NewService(storage.Config{IPRateLimit: 1, IPBlockTime: 60}, memoryStorage)
+	service.SetClock(clock)
+
+	check, err := service.checkRateLimit(context.Background(), "10.0.0.1", false, 1)
+	require.NoError(t, err)
+	assert.True(t, check.Allowed)
+	check, err = service.checkRateLimit(context.Background(), "10.0.0.1", false, 1)
+	require.NoError(t, err)
+	assert.False(t, check.Allowed)
+	assert.Equal(t, time.Minute, check.RetryAfter)
+
+	clock.Advance(59 * time.Second)
+	check, err = service.checkRateLimit(context.Background(), "10.0.0.1", false, 1)
+	require.NoError(t, err)
+	assert.False(t, check.Allowed)
+	assert.Equal(t, time.Second, check.RetryAfter)
+
+	clock.Advance(2 * time.Second)
+	keys, err := memoryStorage.List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, keys, "the counter expires with the block on the storage clock")
+
+	check, err = service.checkRateLimit(context.Background(), "10.0.0.1", false, 1)
+	require.NoError(t, err)
+	assert.True(t, check.Allowed)
+}
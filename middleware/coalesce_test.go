@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"rate-limiter/ratelimitertest"
+	"rate-limiter/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalescingStorage(t *testing.T) {
+	fake := ratelimitertest.NewFakeStorage()
+	fake.SetLatency(20 * time.Millisecond)
+	service := NewService(storage.Config{IPRateLimit: 30, IPBlockTime: 60}, storage.NewCoalescingStorage(fake))
+
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if verdict := service.Evaluate("10.0.0.1", "", "GET", "/", 1); verdict.Allowed {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(30), allowed.Load(), "coalesced checks allow exactly the limit")
+	roundTrips := fake.Calls("AllowWindows") + fake.Calls("AllowWindowsBatch")
+	assert.Less(t, roundTrips, 10, "checks waiting behind an in-flight one share a round trip")
+
+	assert.False(t, service.Evaluate("10.0.0.1", "", "GET", "/", 1).Allowed, "the key is blocked")
+	assert.True(t, service.Evaluate("10.0.0.2", "", "GET", "/", 1).Allowed)
+}
+
+func TestRedisAllowWindowsBatch(t *testing.T) {
+	ctx := context.Background()
+	backend := createTestStorage(t)
+	defer backend.Close()
+
+	key := "test:batch:" + time.Now().Format(time.RFC3339Nano)
+	defer backend.Delete(ctx, key)
+
+	now := time.Now()
+	checks := []ratelimiter.WindowCheck{{Key: key, Limits: ratelimiter.Limits{Limit: 3, BlockTime: time.Minute}, Window: time.Minute}}
+	calls := make([]*ratelimiter.WindowCall, 5)
+	for i := range calls {
+		calls[i] = &ratelimiter.WindowCall{Checks: checks, Cost: 1, Now: now}
+	}
+	backend.(ratelimiter.BatchStorage).AllowWindowsBatch(ctx, calls)
+
+	for i, call := range calls {
+		require.NoError(t, call.Err)
+		assert.Equal(t, i < 3, call.Result.Allowed, "call %d runs after the ones before it", i)
+	}
+	assert.Equal(t, 0, calls[2].Result.Remaining)
+	assert.Equal(t, time.Minute, calls[3].Result.RetryAfter)
+}
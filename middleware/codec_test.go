@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitBinaryEncoding(t *testing.T) {
+	now := time.Date(2026, 3, 8, 1, 2, 3, 456789000, time.UTC)
+	rateLimit := &ratelimiter.RateLimit{Count: 7, LastReset: now, BlockedAt: now.Add(time.Second), Violations: 2, ViolatedAt: now}
+
+	data, err := ratelimiter.EncodeRateLimit(rateLimit, ratelimiter.CounterEncodingBinary)
+	require.NoError(t, err)
+	assert.Len(t, data, 41)
+	decoded, err := ratelimiter.DecodeRateLimit(data)
+	require.NoError(t, err)
+	assert.Equal(t, rateLimit, decoded, "microseconds survive")
+
+	data, err = ratelimiter.EncodeRateLimit(&ratelimiter.RateLimit{Count: 1, LastReset: now}, ratelimiter.CounterEncodingBinary)
+	require.NoError(t, err)
+	decoded, err = ratelimiter.DecodeRateLimit(data)
+	require.NoError(t, err)
+	assert.True(t, decoded.BlockedAt.IsZero(), "zero times stay zero")
+	assert.True(t, decoded.ViolatedAt.IsZero())
+
+	legacy, err := json.Marshal(rateLimit)
+	require.NoError(t, err)
+	decoded, err = ratelimiter.DecodeRateLimit(legacy)
+	require.NoError(t, err)
+	assert.Equal(t, 7, decoded.Count, "JSON counters are still read")
+	assert.True(t, decoded.LastReset.Equal(now))
+
+	_, err = ratelimiter.DecodeRateLimit([]byte{2, 0, 0})
+	assert.ErrorContains(t, err, "version")
+	_, err = ratelimiter.DecodeRateLimit(data[:20])
+	assert.Error(t, err)
+}
+
+func TestEtcdStorageBinaryCounters(t *testing.T) {
+	server := newFakeEtcd()
+	t.Cleanup(server.Close)
+	ctx := context.Background()
+
+	open := func(encoding string) ratelimiter.Storage {
+		etcdStorage, err := storage.NewStorage(ratelimiter.StorageConfig{
+			Backend:         storage.BackendEtcd,
+			EtcdEndpoints:   []string{server.URL},
+			EtcdPrefix:      "ratelimiter/",
+			CounterEncoding: encoding,
+		})
+		require.NoError(t, err)
+		return etcdStorage
+	}
+	jsonStorage, binaryStorage := open(ratelimiter.CounterEncodingJSON), open(ratelimiter.CounterEncodingBinary)
+
+	require.NoError(t, jsonStorage.Set(ctx, "192.168.1.1", &ratelimiter.RateLimit{Count: 1, LastReset: time.Now()}, time.Minute))
+	service := NewService(storage.Config{IPRateLimit: 2, IPBlockTime: 60}, binaryStorage)
+	allowed, err := service.CheckRateLimit("192.168.1.1", false, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed, "the JSON counter is read and rewritten in binary")
+	allowed, err = service.CheckRateLimit("192.168.1.1", false, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	counter, err := jsonStorage.Get(ctx, "192.168.1.1")
+	require.NoError(t, err)
+	require.NotNil(t, counter)
+	assert.Equal(t, 2, counter.Count, "instances still writing JSON read binary counters")
+	assert.False(t, counter.BlockedAt.IsZero())
+}
+
+func TestCounterEncodingValidation(t *testing.T) {
+	config := storage.GetDefaultConfig()
+	require.NoError(t, config.Validate())
+	config.Storage.CounterEncoding = "msgpack"
+	assert.ErrorContains(t, config.Validate(), "COUNTER_ENCODING")
+}
+
+func BenchmarkRateLimitEncoding(b *testing.B) {
+	now := time.Now()
+	rateLimit := &ratelimiter.RateLimit{Count: 7, LastReset: now, BlockedAt: now}
+	for _, encoding := range []string{ratelimiter.CounterEncodingJSON, ratelimiter.CounterEncodingBinary} {
+		b.Run(encoding, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				data, _ := ratelimiter.EncodeRateLimit(rateLimit, encoding)
+				ratelimiter.DecodeRateLimit(data)
+			}
+		})
+	}
+}
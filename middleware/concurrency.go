@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"net/http"
+	"rate-limiter/storage"
+	"strings"
+	"sync"
+)
+
+// ConcurrencyLimiter caps how many requests of a key are in flight at once, on top of
+// the request rate. Slots are held until the response completes and are counted in
+// process, so each instance enforces CONCURRENCY_LIMIT and the concurrency of the
+// policies on its own.
+type ConcurrencyLimiter struct {
+	limit int
+	paths []string
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+// NewConcurrencyLimiter returns nil when neither CONCURRENCY_LIMIT nor any policy caps
+// the requests in flight
+func NewConcurrencyLimiter(config storage.Config) *ConcurrencyLimiter {
+	if config.ConcurrencyLimit <= 0 && !config.HasConcurrencyPolicy() {
+		return nil
+	}
+	return &ConcurrencyLimiter{
+		limit:    config.ConcurrencyLimit,
+		paths:    config.ConcurrencyPaths,
+		inFlight: make(map[string]int),
+	}
+}
+
+// Applies reports whether the request is subject to the limit: every request, or only
+// those under CONCURRENCY_PATHS when set
+func (c *ConcurrencyLimiter) Applies(r *http.Request) bool {
+	if c == nil || c.limit <= 0 {
+		return false
+	}
+	if len(c.paths) == 0 {
+		return true
+	}
+	for _, prefix := range c.paths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Acquire takes a slot for the key, returning false when all of them are in use. The
+// release function must be called exactly once when the request is done.
+func (c *ConcurrencyLimiter) Acquire(key string) (func(), bool) {
+	return c.AcquireLimit(key, c.limit)
+}
+
+// AcquireLimit is Acquire with the limit of the key's policy instead of CONCURRENCY_LIMIT
+func (c *ConcurrencyLimiter) AcquireLimit(key string, limit int) (func(), bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inFlight[key] >= limit {
+		return nil, false
+	}
+	c.inFlight[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { c.release(key) })
+	}, true
+}
+
+func (c *ConcurrencyLimiter) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inFlight[key] <= 1 {
+		delete(c.inFlight, key)
+		return
+	}
+	c.inFlight[key]--
+}
+
+// InFlight returns how many requests of the key hold a slot
+func (c *ConcurrencyLimiter) InFlight(key string) int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.inFlight[key]
+}
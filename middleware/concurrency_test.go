@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	var disabled *ConcurrencyLimiter
+	assert.False(t, disabled.Applies(httptest.NewRequest("GET", "/", nil)))
+	assert.Nil(t, NewConcurrencyLimiter(storage.Config{}))
+
+	limiter := NewConcurrencyLimiter(storage.Config{ConcurrencyLimit: 2, ConcurrencyPaths: []string{"/reports"}})
+	assert.True(t, limiter.Applies(httptest.NewRequest("GET", "/reports/42", nil)))
+	assert.False(t, limiter.Applies(httptest.NewRequest("GET", "/users", nil)))
+
+	first, ok := limiter.Acquire("10.0.0.1")
+	assert.True(t, ok)
+	_, ok = limiter.Acquire("10.0.0.1")
+	assert.True(t, ok)
+	_, ok = limiter.Acquire("10.0.0.1")
+	assert.False(t, ok, "both slots are taken")
+	_, ok = limiter.Acquire("10.0.0.2")
+	assert.True(t, ok, "keys have their own slots")
+
+	first()
+	first()
+	assert.Equal(t, 1, limiter.InFlight("10.0.0.1"), "releasing twice frees one slot")
+	_, ok = limiter.Acquire("10.0.0.1")
+	assert.True(t, ok)
+}
+
+func TestRateLimiterConcurrencyLimit(t *testing.T) {
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	slowHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-finish
+		w.WriteHeader(http.StatusOK)
+	})
+
+	service := NewService(storage.Config{
+		IPRateLimit:      100,
+		IPBlockTime:      60,
+		ConcurrencyLimit: 1,
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(slowHandler)
+
+	send := func() int {
+		req := httptest.NewRequest("GET", "/reports", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, http.StatusOK, send())
+	}()
+	<-started
+
+	assert.Equal(t, http.StatusTooManyRequests, send(), "the first request still holds the slot")
+
+	close(finish)
+	wg.Wait()
+	assert.Equal(t, 0, service.concurrency.InFlight("192.168.1.1"))
+
+	go func() { <-started }()
+	assert.Equal(t, http.StatusOK, send(), "the slot is released once the response completes")
+}
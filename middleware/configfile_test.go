@@ -0,0 +1,179 @@
+package middleware
+
+import (
+	"os"
+	"path/filepath"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unsetEnv clears variables for the test and restores them afterwards
+func unsetEnv(t *testing.T, keys ...string) {
+	for _, key := range keys {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfigFromFile(t *testing.T) {
+	unsetEnv(t, "IP_RATE_LIMIT", "IP_BLOCK_TIME", "TOKEN_gold_LIMIT", "TOKEN_gold_BLOCK_TIME",
+		"APPS", "APP_LOGIN_PATH_PREFIX", "APP_LOGIN_HOSTS", "APP_LOGIN_IP_RATE_LIMIT", "APP_LOGIN_IP_BLOCK_TIME",
+		"REDIS_HOST", "REDIS_DB", "SYNC_INTERVAL")
+
+	path := writeConfigFile(t, "config.yaml", `
+ip:
+  limit: 20
+  block_time: 60
+tokens:
+  gold:
+    limit: 500
+    block_time: 30
+routes:
+  - name: login
+    path_prefix: /login
+    ip:
+      limit: 3
+storage:
+  host: redis.internal
+  db: 2
+env:
+  SYNC_INTERVAL: "5"
+`)
+
+	t.Setenv("IP_BLOCK_TIME", "120")
+
+	appConfig, err := storage.LoadConfigFromFile(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, 20, appConfig.RateLimit.IPRateLimit)
+	assert.Equal(t, 120, appConfig.RateLimit.IPBlockTime, "env overrides the file")
+	assert.Equal(t, 500, appConfig.RateLimit.TokenLimits["gold"])
+	assert.Equal(t, 30, appConfig.RateLimit.TokenBlockTimes["gold"])
+	assert.Equal(t, 5, appConfig.RateLimit.SyncInterval)
+	assert.Equal(t, "redis.internal", appConfig.Storage.Host)
+	assert.Equal(t, 2, appConfig.Storage.DB)
+
+	require.Len(t, appConfig.Apps, 1)
+	assert.Equal(t, "login", appConfig.Apps[0].Name)
+	assert.Equal(t, "/login", appConfig.Apps[0].PathPrefix)
+	assert.Equal(t, 3, appConfig.Apps[0].RateLimit.IPRateLimit)
+	assert.Equal(t, 120, appConfig.Apps[0].RateLimit.IPBlockTime)
+}
+
+func TestLoadConfigFromFileJSON(t *testing.T) {
+	unsetEnv(t, "IP_RATE_LIMIT", "TOKEN_silver_LIMIT")
+
+	path := writeConfigFile(t, "config.json", `{"ip": {"limit": 7}, "tokens": {"silver": {"limit": 40}}}`)
+
+	appConfig, err := storage.LoadConfigFromFile(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, 7, appConfig.RateLimit.IPRateLimit)
+	assert.Equal(t, 40, appConfig.RateLimit.TokenLimits["silver"])
+}
+
+func TestLoadConfigFromFileTokenWindow(t *testing.T) {
+	unsetEnv(t, "TOKEN_batch_LIMIT", "TOKEN_batch_WINDOW", "TOKEN_batch_ALGORITHM", "TOKEN_batch_BUCKET_SIZE", "APPS")
+
+	path := writeConfigFile(t, "config.yaml", `
+tokens:
+  batch:
+    limit: 6000
+    window: 3600
+    algorithm: leaky_bucket
+    burst: 100
+`)
+
+	appConfig, err := storage.LoadConfigFromFile(path)
+	require.NoError(t, err)
+
+	policy := appConfig.RateLimit.TokenPolicy("batch")
+	assert.Equal(t, 6000, policy.Limit)
+	assert.Equal(t, 3600, policy.Window)
+	assert.Equal(t, "leaky_bucket", policy.Algorithm)
+	assert.Equal(t, 100, policy.Burst)
+}
+
+func TestLoadConfigFromFileGeoIP(t *testing.T) {
+	unsetEnv(t, "POLICIES", "POLICY_STRICT_LIMIT", "GEOIP_DATABASES", "COUNTRY_POLICIES", "ASN_POLICIES",
+		"BLOCKED_COUNTRIES", "BLOCKED_ASNS", "APPS")
+
+	database := testGeoIPDatabase(t)
+	path := writeConfigFile(t, "config.yaml", `
+policies:
+  strict:
+    limit: 2
+geoip:
+  databases: [`+database+`]
+  countries:
+    cn: strict
+  asns:
+    AS14061: strict
+  blocked_countries: [KP]
+`)
+
+	appConfig, err := storage.LoadConfigFromFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{database}, appConfig.RateLimit.GeoIPDatabases)
+	assert.Equal(t, map[string]string{"CN": "strict"}, appConfig.RateLimit.CountryPolicies)
+	assert.Equal(t, map[string]string{"14061": "strict"}, appConfig.RateLimit.ASNPolicies)
+	assert.Equal(t, []string{"KP"}, appConfig.RateLimit.BlockedCountries)
+}
+
+func TestLoadConfigFromFilePolicies(t *testing.T) {
+	unsetEnv(t, "POLICIES", "POLICY_PREMIUM_LIMIT", "POLICY_PREMIUM_CONCURRENCY", "IP_POLICY",
+		"TOKEN_gold_POLICY", "ROUTE_POLICIES", "POLICY_RULES", "APPS")
+
+	path := writeConfigFile(t, "config.yaml", `
+ip:
+  policy: premium
+tokens:
+  gold:
+    policy: premium
+policies:
+  premium:
+    limit: 1000
+    concurrency: 8
+route_policies:
+  POST /login: premium
+policy_rules:
+  - path: /api/*/upload
+    methods: [POST, PUT]
+    key_type: token
+    policy: premium
+`)
+
+	appConfig, err := storage.LoadConfigFromFile(path)
+	require.NoError(t, err)
+
+	config := appConfig.RateLimit
+	assert.Equal(t, 1000, config.Policies["premium"].Limit)
+	assert.Equal(t, 8, config.Policies["premium"].Concurrency)
+	assert.Equal(t, "premium", config.IPPolicy)
+	assert.Equal(t, "premium", config.TokenPolicies["gold"])
+	assert.Equal(t, map[string]string{"POST /login": "premium"}, config.RoutePolicies)
+	assert.Equal(t, []storage.PolicyRule{{Path: "/api/*/upload", Methods: []string{"POST", "PUT"}, KeyType: "token", Policy: "premium"}}, config.PolicyRules)
+}
+
+func TestLoadConfigFromFileErrors(t *testing.T) {
+	_, err := storage.LoadConfigFromFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+
+	_, err = storage.LoadConfigFromFile(writeConfigFile(t, "config.toml", "ip = 1"))
+	assert.Error(t, err)
+
+	_, err = storage.LoadConfigFromFile(writeConfigFile(t, "config.yaml", "ip: [not, a, map]"))
+	assert.Error(t, err)
+
+	_, err = storage.LoadConfigFromFile(writeConfigFile(t, "config.yaml", "routes:\n  - name: orphan\n"))
+	assert.Error(t, err)
+}
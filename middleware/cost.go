@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"rate-limiter/storage"
+	"strconv"
+)
+
+// CostResolver decides how many units of quota a request consumes: the cost header
+// of a trusted internal caller, else the longest matching ROUTE_COSTS prefix, else 1
+type CostResolver struct {
+	routes  routeTable[int]
+	header  string
+	callers *ClientIPResolver
+}
+
+// NewCostResolver returns nil when no route has a cost and no caller is trusted with
+// the cost header
+func NewCostResolver(config storage.Config) *CostResolver {
+	if len(config.RouteCosts) == 0 && len(config.CostTrustedCallers) == 0 {
+		return nil
+	}
+
+	c := &CostResolver{header: config.CostHeader, routes: newRouteTable(config.RouteCosts)}
+
+	if c.header != "" && len(config.CostTrustedCallers) > 0 {
+		callers, err := NewClientIPResolver(config.CostTrustedCallers, nil)
+		if err != nil {
+			slog.Warn("The cost header will be ignored", "error", err)
+		} else {
+			c.callers = callers
+		}
+	}
+
+	return c
+}
+
+// Cost returns the units of quota the request consumes
+func (c *CostResolver) Cost(r *http.Request) int {
+	if c == nil {
+		return 1
+	}
+
+	if c.callers != nil && c.callers.isTrusted(getRemoteIP(r)) {
+		if cost, err := strconv.Atoi(r.Header.Get(c.header)); err == nil && cost > 0 {
+			return cost
+		}
+	}
+
+	if cost, found := c.routes.match(r.Method, r.URL.Path); found {
+		return cost
+	}
+	return 1
+}
@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCostResolver(t *testing.T) {
+	var disabled *CostResolver
+	assert.Equal(t, 1, disabled.Cost(httptest.NewRequest("GET", "/", nil)))
+	assert.Nil(t, NewCostResolver(storage.Config{}))
+
+	resolver := NewCostResolver(storage.Config{
+		RouteCosts: map[string]int{
+			"/api":             2,
+			"/api/export":      10,
+			"POST /api/export": 25,
+		},
+		CostHeader:         "X-RateLimit-Cost",
+		CostTrustedCallers: []string{"10.0.0.0/8"},
+	})
+
+	cost := func(method, path, remoteAddr, header string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = remoteAddr
+		if header != "" {
+			req.Header.Set("X-RateLimit-Cost", header)
+		}
+		return resolver.Cost(req)
+	}
+
+	assert.Equal(t, 1, cost("GET", "/", "203.0.113.7:1234", ""))
+	assert.Equal(t, 2, cost("GET", "/api/users", "203.0.113.7:1234", ""))
+	assert.Equal(t, 10, cost("GET", "/api/export/csv", "203.0.113.7:1234", ""), "the longest prefix wins")
+	assert.Equal(t, 25, cost("POST", "/api/export", "203.0.113.7:1234", ""), "a method-specific route wins over the same prefix")
+
+	assert.Equal(t, 50, cost("GET", "/", "10.1.2.3:1234", "50"), "trusted callers set the cost")
+	assert.Equal(t, 2, cost("GET", "/api", "10.1.2.3:1234", "-3"), "invalid costs fall back to the route")
+	assert.Equal(t, 1, cost("GET", "/", "203.0.113.7:1234", "50"), "untrusted callers can't set the cost")
+}
+
+func TestRateLimiterRouteCost(t *testing.T) {
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	service := NewService(storage.Config{
+		IPRateLimit: 10,
+		IPBlockTime: 60,
+		RouteCosts:  map[string]int{"/export": 6},
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(testHandler)
+
+	send := func(path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("/export"))
+	assert.Equal(t, http.StatusOK, send("/"))
+	assert.Equal(t, http.StatusTooManyRequests, send("/export"), "7 of 10 units used, 6 more don't fit")
+}
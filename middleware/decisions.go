@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Decision describes the outcome of a single rate limit check
+type Decision struct {
+	Time     time.Time `json:"time"`
+	Key      string    `json:"key"`
+	ClientIP string    `json:"client_ip"`
+	Host     string    `json:"host,omitempty"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Allowed  bool      `json:"allowed"`
+	Reason   string    `json:"reason"`
+}
+
+// DecisionBroadcaster fans decisions out to live subscribers. Slow subscribers
+// miss decisions instead of slowing down the request path.
+type DecisionBroadcaster struct {
+	mu          sync.RWMutex
+	subscribers map[chan Decision]struct{}
+}
+
+func NewDecisionBroadcaster() *DecisionBroadcaster {
+	return &DecisionBroadcaster{
+		subscribers: make(map[chan Decision]struct{}),
+	}
+}
+
+// Subscribe returns a channel of decisions and a function that cancels the subscription
+func (b *DecisionBroadcaster) Subscribe(buffer int) (<-chan Decision, func()) {
+	ch := make(chan Decision, buffer)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (b *DecisionBroadcaster) Publish(decision Decision) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- decision:
+		default:
+		}
+	}
+}
+
+func (b *DecisionBroadcaster) hasSubscribers() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return len(b.subscribers) > 0
+}
+
+func (s *Service) Decisions() *DecisionBroadcaster {
+	return s.decisions
+}
+
+func (s *Service) publishDecision(r *http.Request, clientIP, key string, allowed bool, reason string) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	s.publish(r.Method, host, r.URL.Path, clientIP, key, allowed, reason)
+}
+
+func (s *Service) publish(method, host, path, clientIP, key string, allowed bool, reason string) {
+	if allowed {
+		s.allowedRequests.Add(1)
+	} else {
+		s.deniedRequests.Add(1)
+		if s.rejections != nil {
+			s.rejections.Record(s.storageKey(key))
+		}
+	}
+	s.observe(key, path, reason)
+
+	subscribed := s.decisions != nil && s.decisions.hasSubscribers()
+	if !subscribed && len(s.hooks) == 0 {
+		return
+	}
+
+	decision := Decision{
+		Time:     s.now(),
+		Key:      key,
+		ClientIP: clientIP,
+		Host:     host,
+		Method:   method,
+		Path:     path,
+		Allowed:  allowed,
+		Reason:   reason,
+	}
+	if subscribed {
+		s.decisions.Publish(decision)
+	}
+	for _, hook := range s.hooks {
+		hook.OnDecision(decision)
+	}
+}
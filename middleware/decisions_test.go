@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecisionBroadcaster(t *testing.T) {
+	broadcaster := NewDecisionBroadcaster()
+	assert.False(t, broadcaster.hasSubscribers())
+
+	decisions, unsubscribe := broadcaster.Subscribe(1)
+	assert.True(t, broadcaster.hasSubscribers())
+
+	broadcaster.Publish(Decision{Key: "first"})
+	broadcaster.Publish(Decision{Key: "dropped"})
+
+	decision := <-decisions
+	assert.Equal(t, "first", decision.Key)
+
+	unsubscribe()
+	unsubscribe()
+	assert.False(t, broadcaster.hasSubscribers())
+
+	_, open := <-decisions
+	assert.False(t, open)
+}
+
+func TestRateLimiterPublishesDecisions(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:   1,
+		IPBlockTime:   60,
+		APIKeyHeaders: []string{"API_KEY"},
+	}, storage.NewMemoryStorage())
+
+	decisions, unsubscribe := service.Decisions().Subscribe(10)
+	defer unsubscribe()
+
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/api/test", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	require.Len(t, decisions, 2)
+
+	first := <-decisions
+	assert.True(t, first.Allowed)
+	assert.Equal(t, "within_limit", first.Reason)
+	assert.Equal(t, "192.168.1.1", first.Key)
+	assert.Equal(t, "/api/test", first.Path)
+
+	second := <-decisions
+	assert.False(t, second.Allowed)
+	assert.Equal(t, "rate_limit", second.Reason)
+}
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+var ErrInvalidDenylistEntry = errors.New("invalid denylist entry")
+
+// Denylist is an in-memory matcher for banned IPs, CIDRs and token keys
+type Denylist struct {
+	mu       sync.RWMutex
+	ips      map[string]struct{}
+	networks []*net.IPNet
+	tokens   map[string]struct{}
+}
+
+func NewDenylist(entries []string) *Denylist {
+	d := &Denylist{}
+	d.Replace(entries)
+	return d
+}
+
+// Replace swaps the whole set of entries, ignoring invalid ones
+func (d *Denylist) Replace(entries []string) {
+	ips := make(map[string]struct{})
+	tokens := make(map[string]struct{})
+	var networks []*net.IPNet
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+
+		if strings.HasPrefix(entry, "token:") {
+			tokens[entry] = struct{}{}
+			continue
+		}
+
+		if strings.Contains(entry, "/") {
+			if _, network, err := net.ParseCIDR(entry); err == nil {
+				networks = append(networks, network)
+			}
+			continue
+		}
+
+		if ip := net.ParseIP(entry); ip != nil {
+			ips[ip.String()] = struct{}{}
+		}
+	}
+
+	d.mu.Lock()
+	d.ips = ips
+	d.networks = networks
+	d.tokens = tokens
+	d.mu.Unlock()
+}
+
+// IsDenied reports whether the client IP or the rate limit key is banned
+func (d *Denylist) IsDenied(clientIP, key string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if _, exists := d.tokens[key]; exists {
+		return true
+	}
+
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+
+	if _, exists := d.ips[ip.String()]; exists {
+		return true
+	}
+
+	for _, network := range d.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateDenylistEntry checks that an entry is an IP, a CIDR or a token key
+func ValidateDenylistEntry(entry string) error {
+	if strings.HasPrefix(entry, "token:") {
+		if len(entry) == len("token:") {
+			return fmt.Errorf("%w: empty token", ErrInvalidDenylistEntry)
+		}
+		return nil
+	}
+
+	if strings.Contains(entry, "/") {
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			return fmt.Errorf("%w: invalid CIDR %s", ErrInvalidDenylistEntry, entry)
+		}
+		return nil
+	}
+
+	if !isValidIP(entry) {
+		return fmt.Errorf("%w: %s", ErrInvalidDenylistEntry, entry)
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDenylistIsDenied(t *testing.T) {
+	denylist := NewDenylist([]string{"192.168.1.1", "10.0.0.0/8", "token:BANNED", "2001:db8::/32", "invalid"})
+
+	tests := []struct {
+		name     string
+		clientIP string
+		key      string
+		expected bool
+	}{
+		{"exact_ip", "192.168.1.1", "192.168.1.1", true},
+		{"other_ip", "192.168.1.2", "192.168.1.2", false},
+		{"cidr_ipv4", "10.20.30.40", "10.20.30.40", true},
+		{"cidr_ipv6", "2001:db8::1", "2001:db8::1", true},
+		{"banned_token", "8.8.8.8", "token:BANNED", true},
+		{"other_token", "8.8.8.8", "token:ABC123", false},
+		{"banned_ip_with_token", "192.168.1.1", "token:ABC123", true},
+		{"invalid_ip", "not-an-ip", "not-an-ip", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, denylist.IsDenied(tt.clientIP, tt.key))
+		})
+	}
+}
+
+func TestDenylistReplace(t *testing.T) {
+	denylist := NewDenylist([]string{"192.168.1.1"})
+	assert.True(t, denylist.IsDenied("192.168.1.1", "192.168.1.1"))
+
+	denylist.Replace([]string{"token:ABC123"})
+	assert.False(t, denylist.IsDenied("192.168.1.1", "192.168.1.1"))
+	assert.True(t, denylist.IsDenied("192.168.1.1", "token:ABC123"))
+}
+
+func TestValidateDenylistEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   string
+		wantErr bool
+	}{
+		{"ipv4", "192.168.1.1", false},
+		{"ipv6", "::1", false},
+		{"cidr", "10.0.0.0/8", false},
+		{"token", "token:ABC123", false},
+		{"empty_token", "token:", true},
+		{"invalid_cidr", "10.0.0.0/33", true},
+		{"invalid_ip", "not-an-ip", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateDenylistEntry(tt.entry)
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func TestRateLimiterMiddlewareDenylist(t *testing.T) {
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	t.Run("forbidden", func(t *testing.T) {
+		service := NewService(storage.Config{
+			Denylist:           []string{"192.168.1.0/24"},
+			DenylistStatusCode: http.StatusForbidden,
+		}, nil)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		w := httptest.NewRecorder()
+
+		RateLimiter(service)(testHandler).ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		var response ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, "access denied", response.Error)
+	})
+
+	t.Run("too_many_requests", func(t *testing.T) {
+		service := NewService(storage.Config{
+			Denylist:           []string{"token:BANNED"},
+			DenylistStatusCode: http.StatusTooManyRequests,
+		}, nil)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		req.Header.Set("API_KEY", "BANNED")
+		w := httptest.NewRecorder()
+
+		RateLimiter(service)(testHandler).ServeHTTP(w, req)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	})
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffStorages(t *testing.T) {
+	ctx := context.Background()
+	source, target := storage.NewMemoryStorage(), storage.NewMemoryStorage()
+
+	require.NoError(t, source.AddBan(ctx, &ratelimiter.Ban{Value: "10.0.0.1", Reason: "abuse"}))
+	require.NoError(t, target.AddBan(ctx, &ratelimiter.Ban{Value: "10.0.0.1", Reason: "abuse"}))
+	require.NoError(t, source.AddBan(ctx, &ratelimiter.Ban{Value: "10.0.0.2", Reason: "scraping"}))
+	require.NoError(t, source.SetTokenConfig(ctx, &ratelimiter.TokenConfig{Name: "gold", Limit: 100}))
+	require.NoError(t, target.SetTokenConfig(ctx, &ratelimiter.TokenConfig{Name: "gold", Limit: 50}))
+	require.NoError(t, source.Set(ctx, "192.168.1.1", &ratelimiter.RateLimit{Count: 3}, time.Minute))
+	require.NoError(t, target.Set(ctx, "192.168.1.1", &ratelimiter.RateLimit{Count: 5}, time.Minute))
+	require.NoError(t, target.Set(ctx, "192.168.1.2", &ratelimiter.RateLimit{Count: 1, BlockedAt: time.Now()}, time.Minute))
+
+	drifts, err := storage.Diff(ctx, source, target, storage.DiffOptions{})
+	require.NoError(t, err)
+	require.Len(t, drifts, 3, "counts are not compared by default")
+	assert.Equal(t, storage.Drift{Kind: storage.DriftBan, Name: "10.0.0.2", Source: "reason=scraping"}, drifts[0])
+	assert.Equal(t, storage.DriftKey, drifts[1].Kind)
+	assert.Equal(t, "192.168.1.2", drifts[1].Name)
+	assert.Empty(t, drifts[1].Source)
+	assert.Contains(t, drifts[1].Target, "blocked_at=")
+	assert.Equal(t, storage.DriftTokenConfig, drifts[2].Kind)
+	assert.Equal(t, "gold", drifts[2].Name)
+
+	drifts, err = storage.Diff(ctx, source, target, storage.DiffOptions{CountTolerance: 1})
+	require.NoError(t, err)
+	assert.Len(t, drifts, 4, "the counts of 192.168.1.1 are 2 apart")
+
+	drifts, err = storage.Diff(ctx, source, target, storage.DiffOptions{SkipKeys: true})
+	require.NoError(t, err)
+	assert.Len(t, drifts, 2)
+
+	drifts, err = storage.Diff(ctx, source, source, storage.DiffOptions{CountTolerance: 1})
+	require.NoError(t, err)
+	assert.Empty(t, drifts)
+}
+
+func TestParseStorageURL(t *testing.T) {
+	config, err := storage.ParseURL("rediss://:secret@redis-a:6380/2")
+	require.NoError(t, err)
+	assert.Equal(t, storage.BackendRedis, config.Backend)
+	assert.Equal(t, "redis-a", config.Host)
+	assert.Equal(t, "6380", config.Port)
+	assert.Equal(t, "secret", config.Password)
+	assert.Equal(t, 2, config.DB)
+	assert.True(t, config.TLSEnabled)
+
+	config, err = storage.ParseURL("redis://redis-b")
+	require.NoError(t, err)
+	assert.Equal(t, "6379", config.Port)
+
+	config, err = storage.ParseURL("etcd://etcd-1,etcd-2:2380/limits")
+	require.NoError(t, err)
+	assert.Equal(t, storage.BackendEtcd, config.Backend)
+	assert.Equal(t, []string{"http://etcd-1:2379", "http://etcd-2:2380"}, config.EtcdEndpoints)
+	assert.Equal(t, "limits/", config.EtcdPrefix)
+
+	config, err = storage.ParseURL("etcds://etcd-1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://etcd-1:2379"}, config.EtcdEndpoints)
+	assert.Equal(t, "ratelimiter/", config.EtcdPrefix)
+
+	config, err = storage.ParseURL("disk:///var/lib/rate-limiter/state.json")
+	require.NoError(t, err)
+	assert.Equal(t, storage.BackendDisk, config.Backend)
+	assert.Equal(t, "/var/lib/rate-limiter/state.json", config.DiskPath)
+
+	_, err = storage.ParseURL("redis://redis-a/cache")
+	assert.Error(t, err)
+	_, err = storage.ParseURL("consul://consul-1")
+	assert.ErrorContains(t, err, "unknown scheme")
+	_, err = storage.ParseURL("redis-a:6379")
+	assert.ErrorContains(t, err, "missing scheme")
+}
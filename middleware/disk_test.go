@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskStorageSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "ratelimiter.json")
+	config := storage.Config{IPRateLimit: 2, IPBlockTime: 60}
+
+	diskStorage, err := storage.NewDiskStorage(path, time.Hour)
+	require.NoError(t, err)
+	service := NewService(config, diskStorage)
+	for i := 0; i < 3; i++ {
+		_, err := service.CheckRateLimit("192.168.1.1", false, 1)
+		require.NoError(t, err)
+	}
+	require.NoError(t, diskStorage.Set(ctx, "expiring", &ratelimiter.RateLimit{Count: 1}, time.Millisecond))
+	require.NoError(t, diskStorage.AddBan(ctx, &ratelimiter.Ban{Value: "10.0.0.1", Reason: "abuse"}))
+
+	_, err = os.Stat(path)
+	require.NoError(t, err, "a ban is saved right away")
+	require.NoError(t, diskStorage.Close())
+	time.Sleep(2 * time.Millisecond)
+
+	diskStorage, err = storage.NewDiskStorage(path, time.Hour)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+	service = NewService(config, diskStorage)
+
+	allowed, err := service.CheckRateLimit("192.168.1.1", false, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed, "the block outlives the restart")
+	bans, err := diskStorage.ListBans(ctx)
+	require.NoError(t, err)
+	assert.Len(t, bans, 1)
+	expired, err := diskStorage.Get(ctx, "expiring")
+	require.NoError(t, err)
+	assert.Nil(t, expired, "what expired while down is dropped")
+}
+
+func TestDiskStorageCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimiter.json")
+	require.NoError(t, os.WriteFile(path, []byte("{not json"), 0o600))
+
+	_, err := storage.NewDiskStorage(path, time.Hour)
+	assert.ErrorContains(t, err, "failed to parse storage file")
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	ratelimiter "rate-limiter"
+	"strings"
+	"time"
+)
+
+// originKeyPrefix separates the origin protection windows from the regular ones
+const originKeyPrefix = "origin:"
+
+// edgeCacheHit reports whether the CDN in front served the request from its cache, as
+// told by CDN_CACHE_HEADER. The header is honored only from TRUSTED_PROXIES, since
+// anyone else could claim a hit to get around the origin limit. Any comma-separated
+// value of the header counts, so "MISS, HIT" from a shielded CDN is a hit at the edge.
+func (s *Service) edgeCacheHit(r *http.Request) bool {
+	config := s.Config()
+	if config.CDNCacheHeader == "" || !s.clientIP.fromTrustedProxy(r) {
+		return false
+	}
+
+	for _, value := range strings.Split(r.Header.Get(config.CDNCacheHeader), ",") {
+		value = strings.TrimSpace(value)
+		for _, hit := range config.CDNCacheHitValues {
+			if strings.EqualFold(value, hit) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkOrigin counts a request the CDN did not serve from its cache toward the origin
+// protection window of the key, ORIGIN_RATE_LIMIT, once the regular limits allowed it.
+// A request over it is refused with the result of that window.
+func (s *Service) checkOrigin(r *http.Request, key string, cost int, check *rateLimitCheck) error {
+	config := s.Config()
+	if config.OriginRateLimit <= 0 || s.edgeCacheHit(r) {
+		return nil
+	}
+
+	limits := ratelimiter.Limits{Limit: config.OriginRateLimit, BlockTime: time.Duration(config.OriginBlockTime) * time.Second}
+	result, err := s.rateLimiter(ratelimiter.AlgorithmFixedWindow).AllowLimitsN(context.Background(), originKeyPrefix+key, limits, max(cost, 1))
+	if err != nil {
+		return err
+	}
+	if !result.Allowed {
+		check.Result = result
+		check.OriginLimited = true
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEdgeCacheOriginLimit(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:       4,
+		IPBlockTime:       60,
+		TrustedProxies:    []string{"10.0.0.0/8"},
+		CDNCacheHeader:    "X-Cache",
+		CDNCacheHitValues: []string{"HIT", "STALE"},
+		OriginRateLimit:   1,
+		OriginBlockTime:   60,
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(remoteAddr, cache string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.Header.Set("X-Cache", cache)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("10.0.0.1:1234", "MISS"))
+	assert.Equal(t, http.StatusTooManyRequests, send("10.0.0.1:1234", "MISS"), "misses count toward the origin limit")
+	assert.Equal(t, http.StatusOK, send("10.0.0.1:1234", "HIT"), "hits don't")
+	assert.Equal(t, http.StatusOK, send("10.0.0.1:1234", "MISS, HIT"))
+	assert.Equal(t, http.StatusTooManyRequests, send("10.0.0.1:1234", "HIT"), "every request counts toward the regular limit")
+
+	assert.Equal(t, http.StatusOK, send("192.0.2.1:1234", "MISS"))
+	assert.Equal(t, http.StatusTooManyRequests, send("192.0.2.1:1234", "HIT"), "the cache status of untrusted peers is ignored")
+}
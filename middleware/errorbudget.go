@@ -0,0 +1,208 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errorBudgetKeyPrefix keeps the error budget counters and blocks apart from the
+// request windows in the storage
+const errorBudgetKeyPrefix = "errors:"
+
+// ErrorBudget tracks the share of client errors, 4xx responses other than the 429s of
+// the limiter itself, in the responses of each client over fixed windows of
+// ERROR_BUDGET_WINDOW. A client whose ratio goes over ERROR_BUDGET_RATIO, once it made
+// ERROR_BUDGET_MIN_REQUESTS requests in the window, is likely misconfigured or probing
+// and is blocked for ERROR_BUDGET_BLOCK_TIME however slowly it sends them. The counters
+// live in the storage, so the instances share them.
+type ErrorBudget struct {
+	storage     ratelimiter.Storage
+	window      time.Duration
+	ratio       float64
+	minRequests int
+	blockTime   time.Duration
+}
+
+// NewErrorBudget returns nil when ERROR_BUDGET_WINDOW is not set
+func NewErrorBudget(config storage.Config, rateLimitStorage ratelimiter.Storage) *ErrorBudget {
+	if config.ErrorBudgetWindow <= 0 {
+		return nil
+	}
+	return &ErrorBudget{
+		storage:     rateLimitStorage,
+		window:      time.Duration(config.ErrorBudgetWindow) * time.Second,
+		ratio:       config.ErrorBudgetRatio,
+		minRequests: max(config.ErrorBudgetMinRequests, 1),
+		blockTime:   time.Duration(config.ErrorBudgetBlockTime) * time.Second,
+	}
+}
+
+// isClientError reports whether the status counts against the error budget
+func isClientError(statusCode int) bool {
+	return statusCode >= 400 && statusCode < 500 && statusCode != http.StatusTooManyRequests
+}
+
+// Blocked returns how long the key stays blocked for exceeding its error budget, 0 when
+// it is not
+func (b *ErrorBudget) Blocked(ctx context.Context, key string, now time.Time) (time.Duration, error) {
+	if b == nil || b.ratio <= 0 {
+		return 0, nil
+	}
+	block, err := b.storage.Get(ctx, errorBudgetKeyPrefix+"block:"+key)
+	if err != nil || block == nil {
+		return 0, err
+	}
+	if until := block.BlockedAt.Add(b.blockTime); now.Before(until) {
+		return until.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// Record counts a response of the key, reporting whether it blocked the key for going
+// over the error budget of the window
+func (b *ErrorBudget) Record(ctx context.Context, key string, statusCode int, now time.Time) (bool, error) {
+	if b == nil {
+		return false, nil
+	}
+	start := now.Truncate(b.window)
+	expiration := start.Add(b.window).Sub(now)
+	suffix := strconv.FormatInt(start.Unix(), 10) + ":" + key
+
+	requests, err := b.count(ctx, errorBudgetKeyPrefix+"requests:"+suffix, start, expiration)
+	if err != nil || !isClientError(statusCode) {
+		return false, err
+	}
+	clientErrors, err := b.count(ctx, errorBudgetKeyPrefix+"4xx:"+suffix, start, expiration)
+	if err != nil {
+		return false, err
+	}
+
+	if b.ratio <= 0 || b.blockTime <= 0 || requests < b.minRequests || float64(clientErrors) <= b.ratio*float64(requests) {
+		return false, nil
+	}
+	block := &ratelimiter.RateLimit{Count: clientErrors, LastReset: start, BlockedAt: now}
+	return true, b.storage.Set(ctx, errorBudgetKeyPrefix+"block:"+key, block, b.blockTime)
+}
+
+// count adds one to the counter in place on an atomic storage, else with a Get and a Set
+func (b *ErrorBudget) count(ctx context.Context, key string, start time.Time, expiration time.Duration) (int, error) {
+	if atomic, isAtomic := b.storage.(ratelimiter.AtomicStorage); isAtomic {
+		count, err := atomic.Consume(ctx, key, 1, start, expiration)
+		if !errors.Is(err, ratelimiter.ErrNotAtomic) {
+			return count, err
+		}
+	}
+
+	counter, err := b.storage.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if counter == nil {
+		counter = &ratelimiter.RateLimit{LastReset: start}
+	}
+	counter.Count++
+	return counter.Count, b.storage.Set(ctx, key, counter, expiration)
+}
+
+// statusWriter remembers the status of the response for the error budget, refunds and
+// failure limits: 200 unless the handler writes another before its body
+type statusWriter struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+}
+
+func newStatusWriter(w http.ResponseWriter) *statusWriter {
+	return &statusWriter{ResponseWriter: w, statusCode: http.StatusOK}
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	// informational statuses precede the one of the response
+	if !w.wroteHeader && statusCode >= http.StatusOK {
+		w.statusCode = statusCode
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush and Hijack keep streaming and WebSocket handlers working behind the recorder
+func (w *statusWriter) Flush() {
+	w.wroteHeader = true
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// errorBudgetKey is the key the error budget of a request is counted under: its client,
+// whatever route policy or WebSocket bucket the request went to. The health check pool
+// has none.
+func errorBudgetKey(key string) string {
+	if strings.HasPrefix(key, healthCheckKeyPrefix) {
+		return ""
+	}
+	return clientKey(key)
+}
+
+// checkErrorBudget reports how long the client of the key stays blocked for exceeding
+// its error budget. A storage error leaves the request to the regular limits.
+func (s *Service) checkErrorBudget(key string) time.Duration {
+	budgetKey := errorBudgetKey(key)
+	if budgetKey == "" {
+		return 0
+	}
+	retryAfter, err := s.errorBudget.Blocked(context.Background(), budgetKey, s.now())
+	if err != nil {
+		slog.Error("Error budget check failed", "key", storage.RedactKey(budgetKey), "error", err)
+	}
+	return retryAfter
+}
+
+// recordErrorBudget counts the response toward the error budget of the client of the key
+func (s *Service) recordErrorBudget(key string, statusCode int) {
+	budgetKey := errorBudgetKey(key)
+	if budgetKey == "" {
+		return
+	}
+	if isClientError(statusCode) {
+		s.clientErrors.Add(1)
+	}
+	blocked, err := s.errorBudget.Record(context.Background(), budgetKey, statusCode, s.now())
+	if err != nil {
+		slog.Error("Error budget update failed", "key", storage.RedactKey(budgetKey), "error", err)
+		return
+	}
+	if blocked {
+		s.errorBudgetBlocks.Add(1)
+		slog.Info("Error budget exceeded", "key", storage.RedactKey(budgetKey), "block_time", s.errorBudget.blockTime)
+	}
+}
+
+// ClientErrors returns how many responses were client errors, counted toward the error budget
+func (s *Service) ClientErrors() uint64 {
+	return s.clientErrors.Load()
+}
+
+// ErrorBudgetBlocks returns how many clients were blocked for exceeding their error budget
+func (s *Service) ErrorBudgetBlocks() uint64 {
+	return s.errorBudgetBlocks.Load()
+}
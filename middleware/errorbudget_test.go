@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorBudget(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:            100,
+		IPBlockTime:            60,
+		ErrorBudgetWindow:      60,
+		ErrorBudgetRatio:       0.5,
+		ErrorBudgetMinRequests: 4,
+		ErrorBudgetBlockTime:   60,
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/busy":
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	send := func(remoteAddr, path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusNotFound, send("192.168.1.1:1234", "/missing"), "under the minimum of requests errors don't block")
+	}
+	assert.Equal(t, http.StatusOK, send("192.168.1.1:1234", "/"))
+	assert.Equal(t, http.StatusNotFound, send("192.168.1.1:1234", "/missing"), "4 errors of 5 go over the ratio")
+	assert.Equal(t, http.StatusTooManyRequests, send("192.168.1.1:1234", "/"), "the client is blocked however slow it is")
+
+	for i := 0; i < 4; i++ {
+		send("192.168.1.2:1234", "/busy")
+	}
+	assert.Equal(t, http.StatusOK, send("192.168.1.2:1234", "/"), "429s of the upstream are not client errors")
+
+	stats := service.Stats()
+	assert.Equal(t, uint64(4), stats.ClientErrors)
+	assert.Equal(t, uint64(1), stats.ErrorBudgetBlocks)
+}
+
+func TestErrorBudgetTrackOnly(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:            100,
+		IPBlockTime:            60,
+		ErrorBudgetWindow:      60,
+		ErrorBudgetMinRequests: 1,
+		ErrorBudgetBlockTime:   60,
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code, "without a ratio errors are only counted")
+	}
+	assert.Equal(t, uint64(5), service.Stats().ClientErrors)
+	assert.Zero(t, service.Stats().ErrorBudgetBlocks)
+}
+
+func TestStatusWriter(t *testing.T) {
+	recorder := newStatusWriter(httptest.NewRecorder())
+	assert.Equal(t, http.StatusOK, recorder.statusCode, "a handler writing nothing answers 200")
+
+	recorder.WriteHeader(http.StatusEarlyHints)
+	recorder.WriteHeader(http.StatusNotFound)
+	recorder.WriteHeader(http.StatusInternalServerError)
+	assert.Equal(t, http.StatusNotFound, recorder.statusCode, "the first status after the informational ones is kept")
+
+	recorder = newStatusWriter(httptest.NewRecorder())
+	recorder.Write([]byte("ok"))
+	recorder.WriteHeader(http.StatusInternalServerError)
+	assert.Equal(t, http.StatusOK, recorder.statusCode, "a body sends the 200 first")
+}
+
+func TestRateLimiterStatusRecorder(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:            1,
+		IPBlockTime:            60,
+		ErrorBudgetWindow:      60,
+		ErrorBudgetRatio:       0.5,
+		ErrorBudgetMinRequests: 4,
+		ErrorBudgetBlockTime:   60,
+		RefundStatuses:         []string{"2xx"},
+		FailurePaths:           []string{"/*"},
+		FailureStatuses:        []string{"401"},
+		FailureRateLimit:       5,
+		FailureWindow:          60,
+		FailureBlockTime:       60,
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stream":
+			flusher, ok := w.(http.Flusher)
+			require.True(t, ok, "the recorder keeps the writer a Flusher")
+			w.Write([]byte("event"))
+			flusher.Flush()
+		case "/upgrade":
+			conn, buffered, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err, "the recorder keeps the writer a Hijacker")
+			defer conn.Close()
+			buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+			buffered.Flush()
+		}
+	}))
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, "the implicit 200 is refunded like a written one")
+	}
+
+	req := httptest.NewRequest("GET", "/stream", nil)
+	req.RemoteAddr = "192.168.1.2:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.True(t, w.Flushed)
+	assert.Equal(t, "event", w.Body.String())
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/upgrade")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+}
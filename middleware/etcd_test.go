@@ -0,0 +1,276 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEtcd serves the subset of the etcd v3 JSON gateway the etcd storage uses, keeping
+// the keys in memory with their revisions and leases
+type fakeEtcd struct {
+	mu       sync.Mutex
+	revision int64
+	kvs      map[string]fakeEtcdValue
+	leases   map[int64]time.Time
+	txns     int
+}
+
+type fakeEtcdValue struct {
+	value    []byte
+	revision int64
+	lease    int64
+}
+
+type fakeEtcdKeyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value,omitempty"`
+	ModRevision string `json:"mod_revision"`
+}
+
+type fakeEtcdRequest struct {
+	Key         []byte `json:"key"`
+	RangeEnd    []byte `json:"range_end"`
+	Value       []byte `json:"value"`
+	Lease       string `json:"lease"`
+	KeysOnly    bool   `json:"keys_only"`
+	PrevKv      bool   `json:"prev_kv"`
+	Target      string `json:"target"`
+	ModRevision string `json:"mod_revision"`
+}
+
+type fakeEtcdOp struct {
+	RequestRange       *fakeEtcdRequest `json:"request_range"`
+	RequestPut         *fakeEtcdRequest `json:"request_put"`
+	RequestDeleteRange *fakeEtcdRequest `json:"request_delete_range"`
+}
+
+func newFakeEtcd() *httptest.Server {
+	etcd := &fakeEtcd{kvs: make(map[string]fakeEtcdValue), leases: make(map[int64]time.Time)}
+	return httptest.NewServer(etcd)
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expire(time.Now())
+
+	var response any
+	switch r.URL.Path {
+	case "/v3/maintenance/status":
+		response = map[string]string{"version": "3.5.0"}
+	case "/v3/lease/grant":
+		var grant struct {
+			TTL string `json:"TTL"`
+		}
+		json.NewDecoder(r.Body).Decode(&grant)
+		ttl, _ := strconv.Atoi(grant.TTL)
+		id := int64(len(f.leases) + 1)
+		f.leases[id] = time.Now().Add(time.Duration(ttl) * time.Second)
+		response = map[string]string{"ID": strconv.FormatInt(id, 10), "TTL": grant.TTL}
+	case "/v3/kv/txn":
+		var txn struct {
+			Compare []fakeEtcdRequest `json:"compare"`
+			Success []fakeEtcdOp      `json:"success"`
+		}
+		json.NewDecoder(r.Body).Decode(&txn)
+		f.txns++
+		succeeded := true
+		for _, compare := range txn.Compare {
+			current := f.kvs[string(compare.Key)]
+			switch compare.Target {
+			case "MOD":
+				succeeded = succeeded && strconv.FormatInt(current.revision, 10) == compare.ModRevision
+			case "VALUE":
+				succeeded = succeeded && current.revision != 0 && bytes.Equal(current.value, compare.Value)
+			}
+		}
+		var responses []map[string]any
+		if succeeded {
+			f.revision++
+			for _, op := range txn.Success {
+				switch {
+				case op.RequestRange != nil:
+					responses = append(responses, map[string]any{"response_range": f.rangeKeys(op.RequestRange)})
+				case op.RequestPut != nil:
+					f.put(op.RequestPut)
+					responses = append(responses, map[string]any{"response_put": map[string]any{}})
+				case op.RequestDeleteRange != nil:
+					f.deleteRange(op.RequestDeleteRange)
+					responses = append(responses, map[string]any{"response_delete_range": map[string]any{}})
+				}
+			}
+		}
+		response = map[string]any{"succeeded": succeeded, "responses": responses}
+	default:
+		var request fakeEtcdRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			response = f.rangeKeys(&request)
+		case "/v3/kv/put":
+			f.revision++
+			f.put(&request)
+			response = map[string]any{}
+		case "/v3/kv/deleterange":
+			f.revision++
+			response = map[string]any{"prev_kvs": f.deleteRange(&request)}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// expire drops the keys of the leases that ran out
+func (f *fakeEtcd) expire(now time.Time) {
+	for key, value := range f.kvs {
+		if expiresAt, exists := f.leases[value.lease]; value.lease != 0 && (!exists || now.After(expiresAt)) {
+			delete(f.kvs, key)
+		}
+	}
+}
+
+func (f *fakeEtcd) matching(request *fakeEtcdRequest) []string {
+	var keys []string
+	for key := range f.kvs {
+		if len(request.RangeEnd) == 0 && key == string(request.Key) ||
+			len(request.RangeEnd) > 0 && key >= string(request.Key) && key < string(request.RangeEnd) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeEtcd) rangeKeys(request *fakeEtcdRequest) map[string]any {
+	kvs := []fakeEtcdKeyValue{}
+	for _, key := range f.matching(request) {
+		kv := fakeEtcdKeyValue{Key: []byte(key), ModRevision: strconv.FormatInt(f.kvs[key].revision, 10)}
+		if !request.KeysOnly {
+			kv.Value = f.kvs[key].value
+		}
+		kvs = append(kvs, kv)
+	}
+	return map[string]any{"kvs": kvs, "count": strconv.Itoa(len(kvs))}
+}
+
+func (f *fakeEtcd) put(request *fakeEtcdRequest) {
+	lease, _ := strconv.ParseInt(request.Lease, 10, 64)
+	f.kvs[string(request.Key)] = fakeEtcdValue{value: request.Value, revision: f.revision, lease: lease}
+}
+
+func (f *fakeEtcd) deleteRange(request *fakeEtcdRequest) []fakeEtcdKeyValue {
+	var deleted []fakeEtcdKeyValue
+	for _, key := range f.matching(request) {
+		deleted = append(deleted, fakeEtcdKeyValue{Key: []byte(key), Value: f.kvs[key].value, ModRevision: strconv.FormatInt(f.kvs[key].revision, 10)})
+		delete(f.kvs, key)
+	}
+	return deleted
+}
+
+func createEtcdStorage(t *testing.T) ratelimiter.Storage {
+	server := newFakeEtcd()
+	t.Cleanup(server.Close)
+
+	etcdStorage, err := storage.NewStorage(ratelimiter.StorageConfig{
+		Backend:       storage.BackendEtcd,
+		EtcdEndpoints: []string{"http://127.0.0.1:1", server.URL},
+		EtcdPrefix:    "ratelimiter/",
+	})
+	require.NoError(t, err, "an unreachable endpoint is skipped")
+	return etcdStorage
+}
+
+func TestEtcdStorageRateLimit(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:  2,
+		IPBlockTime:  60,
+		IPDailyQuota: 3,
+	}, createEtcdStorage(t))
+
+	for i := 0; i < 2; i++ {
+		allowed, err := service.CheckRateLimit("192.168.1.1", false, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+	}
+	allowed, err := service.CheckRateLimit("192.168.1.1", false, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed, "the window is shared through etcd")
+
+	counter, err := service.storage.Get(context.Background(), "192.168.1.1")
+	require.NoError(t, err)
+	require.NotNil(t, counter)
+	assert.False(t, counter.BlockedAt.IsZero())
+
+	keys, err := service.storage.List(context.Background())
+	require.NoError(t, err)
+	assert.Contains(t, keys, "192.168.1.1")
+}
+
+func TestEtcdStorageRegistryAndLeases(t *testing.T) {
+	ctx := context.Background()
+	etcdStorage := createEtcdStorage(t)
+
+	require.NoError(t, etcdStorage.AddBan(ctx, &ratelimiter.Ban{Value: "10.0.0.1", Reason: "abuse"}))
+	require.NoError(t, etcdStorage.SetTokenConfig(ctx, &ratelimiter.TokenConfig{Name: "gold", Limit: 100}))
+	bans, err := etcdStorage.ListBans(ctx)
+	require.NoError(t, err)
+	require.Len(t, bans, 1)
+	assert.Equal(t, "abuse", bans[0].Reason)
+	tokens, err := etcdStorage.ListTokenConfigs(ctx)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	assert.Equal(t, 100, tokens[0].Limit)
+	require.NoError(t, etcdStorage.RemoveBan(ctx, "10.0.0.1"))
+	bans, err = etcdStorage.ListBans(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, bans)
+
+	acquired, err := etcdStorage.AcquireLease(ctx, "jobs", "a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	acquired, err = etcdStorage.AcquireLease(ctx, "jobs", "b", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, acquired, "the lease is held by a")
+	acquired, err = etcdStorage.AcquireLease(ctx, "jobs", "a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired, "its holder renews it")
+	require.NoError(t, etcdStorage.ReleaseLease(ctx, "jobs", "a"))
+	acquired, err = etcdStorage.AcquireLease(ctx, "jobs", "b", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	hour := time.Date(2026, 3, 8, 1, 0, 0, 0, time.UTC)
+	require.NoError(t, etcdStorage.AddUsage(ctx, ratelimiter.UsagePeriodHour, hour, map[string]int64{"10.0.0.1": 2}, time.Hour))
+	require.NoError(t, etcdStorage.AddUsage(ctx, ratelimiter.UsagePeriodHour, hour, map[string]int64{"10.0.0.1": 3}, time.Hour))
+	records, err := etcdStorage.ListUsage(ctx, ratelimiter.UsagePeriodHour, hour, hour)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, int64(5), records[0].Count, "the entries of the instances add up")
+
+	records, err = etcdStorage.TakeUsage(ctx, ratelimiter.UsagePeriodHour, hour.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	records, err = etcdStorage.TakeUsage(ctx, ratelimiter.UsagePeriodHour, hour.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, records, "a bucket is taken once")
+}
+
+func TestNewStorageUnknownBackend(t *testing.T) {
+	_, err := storage.NewStorage(ratelimiter.StorageConfig{Backend: "consul"})
+	assert.ErrorContains(t, err, "unknown storage backend")
+}
@@ -0,0 +1,163 @@
+package middleware
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"strings"
+)
+
+// Verdict is the outcome of Evaluate
+type Verdict struct {
+	Key     string
+	Allowed bool
+	Reason  string
+	Result  ratelimiter.Result
+	Quotas  []QuotaStatus
+}
+
+// Evaluate applies API key validation, the denylist, the rate limit and the storage
+// error policy to a call identified outside of HTTP, such as gRPC, consuming cost units
+// of quota. The method and path pick the route policy and label the published decision.
+// With a JWT key configured, an apiKey shaped like a JWT is verified and keyed by its
+// claims, as the HTTP middleware does with a JWT bearer token.
+func (s *Service) Evaluate(clientIP, apiKey, method, path string, cost int) Verdict {
+	return s.EvaluateContext(context.Background(), clientIP, apiKey, method, path, cost)
+}
+
+// EvaluateContext is Evaluate with the storage calls bound to ctx, such as the context
+// of the incoming call, so they stop when it is canceled
+func (s *Service) EvaluateContext(ctx context.Context, clientIP, apiKey, method, path string, cost int) Verdict {
+	clientIP = normalizeIP(clientIP)
+	if s.IsExempt(path) {
+		return Verdict{Key: clientIP, Allowed: true, Reason: "exempt"}
+	}
+	credentials, signed, err := s.jwt.AuthenticateToken(apiKey)
+	if err != nil {
+		s.publish(method, "", path, clientIP, clientIP, false, "invalid_jwt")
+		return Verdict{Key: clientIP, Reason: "invalid_jwt"}
+	}
+	if signed {
+		apiKey = credentials.subject
+	} else if apiKey != "" && s.validator != nil {
+		if err := s.validator.Validate(apiKey); err != nil {
+			s.publish(method, "", path, clientIP, clientIP, false, "invalid_api_key")
+			return Verdict{Key: clientIP, Reason: "invalid_api_key"}
+		}
+	}
+
+	key, isToken := determineRateLimitKey(s.ipKey(clientIP), apiKey)
+	verdict := Verdict{Key: key}
+
+	if s.tokenDisabled(key, isToken) {
+		verdict.Reason = "token_disabled"
+		s.publish(method, "", path, clientIP, key, false, verdict.Reason)
+		return verdict
+	}
+	// a JWT naming a configured tier vouches for its subject
+	var rejected bool
+	tier := s.jwtTier(credentials)
+	if tier == "" {
+		key, isToken, rejected = s.unknownToken(key, isToken, clientIP)
+	}
+	if rejected {
+		verdict.Reason = "unknown_token"
+		s.publish(method, "", path, clientIP, key, false, verdict.Reason)
+		return verdict
+	}
+
+	if s.IsDenied(clientIP, key) {
+		verdict.Reason = "denylist"
+		s.publish(method, "", path, clientIP, key, false, verdict.Reason)
+		return verdict
+	}
+	location := s.geoIP.Locate(clientIP)
+	if s.geoIP.Blocked(location) {
+		verdict.Reason = "geo_blocked"
+		s.publish(method, "", path, clientIP, key, false, verdict.Reason)
+		return verdict
+	}
+	if config := s.Config(); !isToken && config.IPRateLimitDisabled {
+		if config.TokenlessPolicy == TokenlessAllow {
+			return Verdict{Key: key, Allowed: true, Reason: "tokenless"}
+		}
+		verdict.Reason = "missing_token"
+		s.publish(method, "", path, clientIP, key, false, verdict.Reason)
+		return verdict
+	}
+
+	if tier == "" && !isToken {
+		tier = s.geoIP.Policy(location)
+	}
+	verdict.Key = s.policyKey(tierKey(s.tokenIPKey(key, isToken, clientIP), tier), method, path, keyTypeOf(isToken, false))
+	return s.evaluate(ctx, verdict, clientIP, isToken, method, path, cost)
+}
+
+// EvaluateKey applies the denylist, the rate limit and the storage error policy to a
+// key built by the caller, such as an Envoy descriptor. Keys other than token:<name>
+// get the IP limits; with a JWT key configured, token:<JWT> is verified and keyed by
+// its claims.
+func (s *Service) EvaluateKey(key, method, path string, cost int) Verdict {
+	return s.EvaluateKeyContext(context.Background(), key, method, path, cost)
+}
+
+// EvaluateKeyContext is EvaluateKey with the storage calls bound to ctx
+func (s *Service) EvaluateKeyContext(ctx context.Context, key, method, path string, cost int) Verdict {
+	raw, isToken := strings.CutPrefix(key, "token:")
+	var tier string
+	if isToken {
+		credentials, signed, err := s.jwt.AuthenticateToken(raw)
+		if err != nil {
+			s.publish(method, "", path, "", "", false, "invalid_jwt")
+			return Verdict{Reason: "invalid_jwt"}
+		}
+		if signed {
+			key, tier = "token:"+credentials.subject, s.jwtTier(credentials)
+		}
+	}
+	verdict := Verdict{Key: key}
+
+	if s.IsDenied("", key) {
+		verdict.Reason = "denylist"
+		s.publish(method, "", path, "", key, false, verdict.Reason)
+		return verdict
+	}
+	if s.tokenDisabled(key, isToken) {
+		verdict.Reason = "token_disabled"
+		s.publish(method, "", path, "", key, false, verdict.Reason)
+		return verdict
+	}
+	// a JWT naming a configured tier vouches for its subject
+	var rejected bool
+	if tier == "" {
+		key, isToken, rejected = s.unknownToken(key, isToken, "")
+	}
+	if rejected {
+		verdict.Reason = "unknown_token"
+		s.publish(method, "", path, "", key, false, verdict.Reason)
+		return verdict
+	}
+
+	verdict.Key = tierKey(key, tier)
+	return s.evaluate(ctx, verdict, "", isToken, method, path, cost)
+}
+
+func (s *Service) evaluate(ctx context.Context, verdict Verdict, clientIP string, isToken bool, method, path string, cost int) Verdict {
+	key := verdict.Key
+
+	check, err := s.checkRateLimit(ctx, key, isToken, cost)
+	if err == nil && check.Allowed {
+		err = s.checkNetwork(ctx, clientIP, cost, &check)
+	}
+	if err != nil {
+		verdict.Allowed = s.handleStorageError(key, err)
+		verdict.Reason = "storage_error"
+	} else {
+		verdict.Allowed = check.Allowed
+		verdict.Reason = check.reason()
+	}
+	verdict.Result = check.Result
+	verdict.Quotas = check.Quotas
+
+	s.publish(method, "", path, clientIP, key, verdict.Allowed, verdict.Reason)
+	return verdict
+}
@@ -0,0 +1,15 @@
+package middleware
+
+import "path"
+
+// IsExempt reports whether the path matches one of the EXEMPT_PATHS patterns, whose
+// requests are let through without being counted, so a liveness probe can't get the
+// instance it checks blocked
+func (s *Service) IsExempt(requestPath string) bool {
+	for _, pattern := range s.Config().ExemptPaths {
+		if matched, _ := path.Match(pattern, requestPath); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadExemptPaths(t *testing.T) {
+	unsetEnv(t, "EXEMPT_PATHS", "APPS", "HOST_TEMPLATES")
+
+	appConfig, err := storage.LoadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/health", "/healthz", "/metrics"}, appConfig.RateLimit.ExemptPaths)
+
+	t.Setenv("EXEMPT_PATHS", "")
+	appConfig, err = storage.LoadConfig()
+	require.NoError(t, err)
+	assert.Empty(t, appConfig.RateLimit.ExemptPaths, "an empty list exempts nothing")
+
+	t.Setenv("EXEMPT_PATHS", "/status/[a-")
+	_, err = storage.LoadConfig()
+	assert.ErrorContains(t, err, "EXEMPT_PATHS")
+}
+
+func TestRateLimiterExemptPaths(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit: 1,
+		IPBlockTime: 60,
+		ExemptPaths: []string{"/health", "/internal/*/metrics"},
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, send("/health"))
+		assert.Equal(t, http.StatusOK, send("/internal/pod-1/metrics"))
+	}
+	assert.Equal(t, http.StatusOK, send("/api"), "exempt requests consumed no quota")
+	assert.Equal(t, http.StatusTooManyRequests, send("/api"))
+	assert.Equal(t, http.StatusOK, send("/health"), "a blocked client can still be probed")
+	assert.Equal(t, http.StatusTooManyRequests, send("/health/deep"), "patterns match the whole path")
+
+	verdict := service.Evaluate("192.168.1.1", "", "GET", "/health", 1)
+	assert.True(t, verdict.Allowed)
+	assert.Equal(t, "exempt", verdict.Reason)
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"rate-limiter/storage"
+	"strings"
+)
+
+// KeyExtractor returns the API key of a request, if it carries one
+type KeyExtractor func(r *http.Request) (string, bool)
+
+// HeaderExtractor reads the API key from the first non-empty header among names
+func HeaderExtractor(names ...string) KeyExtractor {
+	return func(r *http.Request) (string, bool) {
+		for _, name := range names {
+			if value := r.Header.Get(name); value != "" {
+				return value, true
+			}
+		}
+		return "", false
+	}
+}
+
+// BearerExtractor reads the API key from an "Authorization: Bearer <token>" header
+func BearerExtractor() KeyExtractor {
+	return func(r *http.Request) (string, bool) {
+		scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			return "", false
+		}
+		token = strings.TrimSpace(token)
+		return token, token != ""
+	}
+}
+
+// QueryExtractor reads the API key from a query string parameter
+func QueryExtractor(param string) KeyExtractor {
+	return func(r *http.Request) (string, bool) {
+		value := r.URL.Query().Get(param)
+		return value, value != ""
+	}
+}
+
+// CookieExtractor reads the API key from a cookie
+func CookieExtractor(name string) KeyExtractor {
+	return func(r *http.Request) (string, bool) {
+		cookie, err := r.Cookie(name)
+		if err != nil || cookie.Value == "" {
+			return "", false
+		}
+		return cookie.Value, true
+	}
+}
+
+// ChainExtractors returns the key of the first extractor that finds one
+func ChainExtractors(extractors ...KeyExtractor) KeyExtractor {
+	return func(r *http.Request) (string, bool) {
+		for _, extractor := range extractors {
+			if key, ok := extractor(r); ok {
+				return key, true
+			}
+		}
+		return "", false
+	}
+}
+
+// NewKeyExtractor builds the extractor described by the config: headers first,
+// then the bearer token, the query parameter, the cookie and the registered
+// extractors of API_KEY_EXTRACTORS
+func NewKeyExtractor(config storage.Config) KeyExtractor {
+	headers := config.APIKeyHeaders
+	if len(headers) == 0 {
+		headers = []string{"API_KEY"}
+	}
+
+	extractors := []KeyExtractor{HeaderExtractor(headers...)}
+	if config.APIKeyBearer {
+		extractors = append(extractors, BearerExtractor())
+	}
+	if config.APIKeyQueryParam != "" {
+		extractors = append(extractors, QueryExtractor(config.APIKeyQueryParam))
+	}
+	if config.APIKeyCookie != "" {
+		extractors = append(extractors, CookieExtractor(config.APIKeyCookie))
+	}
+	for _, name := range config.APIKeyExtractors {
+		factory, exists := lookupKeyExtractor(name)
+		if !exists {
+			slog.Warn("API_KEY_EXTRACTORS names an extractor that is not registered", "extractor", name)
+			continue
+		}
+		extractors = append(extractors, factory(config))
+	}
+
+	return ChainExtractors(extractors...)
+}
@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewKeyExtractor(t *testing.T) {
+	extractor := NewKeyExtractor(storage.Config{
+		APIKeyHeaders:    []string{"API_KEY", "X-API-Key"},
+		APIKeyBearer:     true,
+		APIKeyQueryParam: "api_key",
+		APIKeyCookie:     "api_key",
+	})
+
+	tests := []struct {
+		name     string
+		prepare  func(r *http.Request)
+		expected string
+		found    bool
+	}{
+		{"api_key_header", func(r *http.Request) { r.Header.Set("API_KEY", "ABC123") }, "ABC123", true},
+		{"custom_header", func(r *http.Request) { r.Header.Set("X-API-Key", "XYZ789") }, "XYZ789", true},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer ABC123") }, "ABC123", true},
+		{"bearer_lowercase", func(r *http.Request) { r.Header.Set("Authorization", "bearer ABC123") }, "ABC123", true},
+		{"basic_auth_ignored", func(r *http.Request) { r.Header.Set("Authorization", "Basic dXNlcjpwYXNz") }, "", false},
+		{"empty_bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer ") }, "", false},
+		{"query_param", func(r *http.Request) { r.URL.RawQuery = "api_key=QUERY1" }, "QUERY1", true},
+		{"cookie", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "api_key", Value: "COOKIE1"}) }, "COOKIE1", true},
+		{"header_priority", func(r *http.Request) {
+			r.Header.Set("API_KEY", "HEADER1")
+			r.Header.Set("Authorization", "Bearer BEARER1")
+		}, "HEADER1", true},
+		{"none", func(r *http.Request) {}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			tt.prepare(req)
+
+			key, found := extractor(req)
+			assert.Equal(t, tt.expected, key)
+			assert.Equal(t, tt.found, found)
+		})
+	}
+}
+
+func TestNewKeyExtractorBearerDisabled(t *testing.T) {
+	extractor := NewKeyExtractor(storage.Config{})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer ABC123")
+
+	_, found := extractor(req)
+	assert.False(t, found)
+}
+
+func TestRateLimiterWithKeyExtractor(t *testing.T) {
+	service := NewService(storage.Config{
+		Denylist:           []string{"token:CUSTOM"},
+		DenylistStatusCode: http.StatusForbidden,
+	}, nil)
+
+	extractor := func(r *http.Request) (string, bool) {
+		return "CUSTOM", true
+	}
+	handler := RateLimiter(service, WithKeyExtractor(extractor))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.1:12345"
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"path"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"strings"
+	"time"
+)
+
+// failureKeyPrefix counts the failed attempts of a client apart from its requests:
+// failures:<client key>
+const failureKeyPrefix = "failures:"
+
+// FailureLimiter guards the FAILURE_PATHS, such as a login, against brute force: their
+// requests count only when the response has one of the FAILURE_STATUSES, 401 and 403 by
+// default, and a client with more than FAILURE_RATE_LIMIT failures in FAILURE_WINDOW is
+// refused on those paths for FAILURE_BLOCK_TIME. Successful attempts are never counted,
+// so clients that log in are not throttled.
+type FailureLimiter struct {
+	paths    []string
+	statuses []string
+	limits   ratelimiter.Limits
+}
+
+// NewFailureLimiter returns nil when no path is guarded
+func NewFailureLimiter(config storage.Config) *FailureLimiter {
+	if config.FailureRateLimit <= 0 || len(config.FailurePaths) == 0 {
+		return nil
+	}
+	return &FailureLimiter{
+		paths:    config.FailurePaths,
+		statuses: config.FailureStatuses,
+		limits: ratelimiter.Limits{
+			Limit:     config.FailureRateLimit,
+			BlockTime: time.Duration(config.FailureBlockTime) * time.Second,
+			Window:    time.Duration(config.FailureWindow) * time.Second,
+		},
+	}
+}
+
+// Applies reports whether the path is guarded
+func (f *FailureLimiter) Applies(requestPath string) bool {
+	if f == nil {
+		return false
+	}
+	for _, pattern := range f.paths {
+		if matched, _ := path.Match(pattern, requestPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// failureKey is the key the failures of a request are counted under: its client,
+// whatever route policy or WebSocket bucket the request went to. The health check pool
+// has none.
+func failureKey(key string) string {
+	if strings.HasPrefix(key, healthCheckKeyPrefix) {
+		return ""
+	}
+	return failureKeyPrefix + clientKey(key)
+}
+
+// checkFailures reports how long the client of the key stays blocked on the guarded
+// paths. A storage error leaves the request to the regular limits.
+func (s *Service) checkFailures(ctx context.Context, key string) time.Duration {
+	failures := failureKey(key)
+	if failures == "" {
+		return 0
+	}
+	ctx, cancel := s.storageContext(ctx)
+	defer cancel()
+
+	state, err := s.storage.Get(ctx, failures)
+	if err != nil {
+		slog.Error("Failure limit check failed", "key", storage.RedactKey(failures), "error", err)
+		return 0
+	}
+	if state == nil {
+		return 0
+	}
+	now := s.now()
+	if until := s.failures.limits.BlockedUntil(state, now); !until.IsZero() {
+		return until.Sub(now)
+	}
+	return 0
+}
+
+// recordFailure counts a response of the key with one of the FAILURE_STATUSES,
+// blocking its client once it goes over FAILURE_RATE_LIMIT
+func (s *Service) recordFailure(key string, statusCode int) {
+	failures := failureKey(key)
+	if failures == "" || !statusMatches(s.failures.statuses, statusCode) {
+		return
+	}
+	ctx, cancel := s.storageContext(context.Background())
+	defer cancel()
+
+	result, err := s.rateLimiter(ratelimiter.AlgorithmFixedWindow).AllowLimitsN(ctx, failures, s.failures.limits, 1)
+	if err != nil {
+		slog.Error("Failure limit update failed", "key", storage.RedactKey(failures), "error", err)
+		return
+	}
+	if !result.Allowed {
+		s.failureBlocks.Add(1)
+		slog.Info("Failure limit exceeded", "key", storage.RedactKey(failures), "block_time", s.failures.limits.BlockTime)
+	}
+}
+
+// FailureBlocks returns how many clients were blocked for too many failed attempts
+func (s *Service) FailureBlocks() uint64 {
+	return s.failureBlocks.Load()
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFailureLimit(t *testing.T) {
+	unsetEnv(t, "FAILURE_STATUSES", "APPS", "HOST_TEMPLATES")
+	t.Setenv("FAILURE_PATHS", "/login,/api/*/token")
+	t.Setenv("FAILURE_RATE_LIMIT", "5")
+
+	appConfig, err := storage.LoadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"401", "403"}, appConfig.RateLimit.FailureStatuses)
+	assert.Equal(t, 60, appConfig.RateLimit.FailureWindow)
+
+	t.Setenv("FAILURE_STATUSES", "4xx,9")
+	_, err = storage.LoadConfig()
+	assert.ErrorContains(t, err, "FAILURE_STATUSES")
+
+	t.Setenv("FAILURE_STATUSES", "401")
+	t.Setenv("FAILURE_PATHS", "/login[")
+	_, err = storage.LoadConfig()
+	assert.ErrorContains(t, err, "FAILURE_PATHS")
+}
+
+func TestRateLimiterFailureLimit(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:      100,
+		IPBlockTime:      60,
+		FailurePaths:     []string{"/login"},
+		FailureStatuses:  []string{"401", "403"},
+		FailureRateLimit: 2,
+		FailureWindow:    60,
+		FailureBlockTime: 60,
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" && r.Header.Get("X-Password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	send := func(remoteAddr, path, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Password", password)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusOK, send("192.168.1.1:1234", "/login", "secret").Code, "successful attempts are not counted")
+	}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, send("192.168.1.1:1234", "/login", "guess").Code)
+	}
+	w := send("192.168.1.1:1234", "/login", "secret")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "the third failure blocked the client")
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, send("192.168.1.1:1234", "/data", "").Code, "other paths are not guarded")
+	assert.Equal(t, http.StatusOK, send("192.168.1.2:1234", "/login", "secret").Code, "other clients keep trying")
+	assert.Equal(t, uint64(1), service.Stats().FailureBlocks)
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ratelimiter "rate-limiter"
+	"rate-limiter/ratelimitertest"
+	"rate-limiter/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeStorage(t *testing.T) {
+	fake := ratelimitertest.NewFakeStorage()
+	service := NewService(storage.Config{IPRateLimit: 5, IPBlockTime: 60, OnStorageError: storage.OnStorageErrorDeny}, fake)
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(ip string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	fake.Seed("10.0.0.1", ratelimiter.RateLimit{Count: 5, LastReset: time.Now()})
+	assert.Equal(t, http.StatusTooManyRequests, serve("10.0.0.1"), "the seeded counter is at the limit")
+	assert.Equal(t, http.StatusOK, serve("10.0.0.2"))
+	counter, found := fake.Counter("10.0.0.2")
+	require.True(t, found)
+	assert.Equal(t, 1, counter.Count)
+	assert.Positive(t, fake.Calls("AllowWindows"))
+
+	fake.FailKey("10.0.0.3", errors.New("connection reset"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("10.0.0.3"), "ON_STORAGE_ERROR=deny refuses the failing key")
+	assert.Equal(t, http.StatusOK, serve("10.0.0.2"))
+	fake.FailKey("10.0.0.3", nil)
+	assert.Equal(t, http.StatusOK, serve("10.0.0.3"))
+
+	fake.FailOn("AllowWindows", errors.New("timeout"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("10.0.0.2"))
+	assert.Equal(t, uint64(2), service.StorageErrors())
+	fake.FailOn("AllowWindows", nil)
+
+	fake.SetLatency(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := fake.Get(ctx, "10.0.0.2")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,162 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyStorage wraps a memory storage and fails counter operations while down is set
+type flakyStorage struct {
+	*storage.MemoryStorage
+
+	mu   sync.Mutex
+	down bool
+}
+
+func (f *flakyStorage) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *flakyStorage) isDown() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.down
+}
+
+func (f *flakyStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLimit, error) {
+	if f.isDown() {
+		return nil, errors.New("connection refused")
+	}
+	return f.MemoryStorage.Get(ctx, key)
+}
+
+func (f *flakyStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
+	if f.isDown() {
+		return errors.New("connection refused")
+	}
+	return f.MemoryStorage.Set(ctx, key, rateLimit, expiration)
+}
+
+func (f *flakyStorage) AllowWindows(ctx context.Context, checks []ratelimiter.WindowCheck, cost int, now time.Time) (ratelimiter.Result, error) {
+	if f.isDown() {
+		return ratelimiter.Result{}, errors.New("connection refused")
+	}
+	return f.MemoryStorage.AllowWindows(ctx, checks, cost, now)
+}
+
+func (f *flakyStorage) Consume(ctx context.Context, key string, cost int, start time.Time, expiration time.Duration) (int, error) {
+	if f.isDown() {
+		return 0, errors.New("connection refused")
+	}
+	return f.MemoryStorage.Consume(ctx, key, cost, start, expiration)
+}
+
+func (f *flakyStorage) Refund(ctx context.Context, key string, cost int, at time.Time) error {
+	if f.isDown() {
+		return errors.New("connection refused")
+	}
+	return f.MemoryStorage.Refund(ctx, key, cost, at)
+}
+
+func TestFallbackStorage(t *testing.T) {
+	primary := &flakyStorage{MemoryStorage: storage.NewMemoryStorage()}
+	fallback := storage.NewFallbackStorage(primary, 50*time.Millisecond, 50*time.Millisecond)
+
+	service := &Service{
+		config:  storage.Config{IPRateLimit: 2, IPBlockTime: 60},
+		storage: fallback,
+	}
+
+	allowed, err := service.CheckRateLimit("192.168.1.1", false, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.False(t, fallback.IsFallbackActive())
+
+	primary.setDown(true)
+
+	allowed, err = service.CheckRateLimit("192.168.1.2", false, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.True(t, fallback.IsFallbackActive())
+
+	allowed, err = service.CheckRateLimit("192.168.1.2", false, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = service.CheckRateLimit("192.168.1.2", false, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed, "fallback keeps limiting while the primary is down")
+
+	primary.setDown(false)
+	time.Sleep(60 * time.Millisecond)
+
+	_, err = service.CheckRateLimit("192.168.1.3", false, 1)
+	require.NoError(t, err)
+	assert.False(t, fallback.IsFallbackActive())
+}
+
+// contextStorage fails the calls of a cancelled context like a network client does
+type contextStorage struct {
+	*storage.MemoryStorage
+}
+
+func (c contextStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLimit, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.MemoryStorage.Get(ctx, key)
+}
+
+func (c contextStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.MemoryStorage.Set(ctx, key, rateLimit, expiration)
+}
+
+func TestFallbackStorageIgnoresCancelledRequests(t *testing.T) {
+	fallback := storage.NewFallbackStorage(contextStorage{storage.NewMemoryStorage()}, time.Second, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	fallback.Get(ctx, "192.168.1.1")
+	fallback.Set(ctx, "192.168.1.1", &ratelimiter.RateLimit{Count: 1, LastReset: time.Now()}, time.Minute)
+	assert.False(t, fallback.IsFallbackActive(), "a client going away does not open the breaker")
+
+	require.NoError(t, fallback.Set(context.Background(), "192.168.1.1", &ratelimiter.RateLimit{Count: 1, LastReset: time.Now()}, time.Minute))
+	rateLimit, err := fallback.Get(context.Background(), "192.168.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, rateLimit.Count, "the counters stay in the primary")
+}
+
+func TestMemoryStorageExpiration(t *testing.T) {
+	memory := storage.NewMemoryStorage()
+	ctx := context.Background()
+
+	require.NoError(t, memory.Set(ctx, "192.168.1.1", &ratelimiter.RateLimit{Count: 1}, 20*time.Millisecond))
+
+	rateLimit, err := memory.Get(ctx, "192.168.1.1")
+	require.NoError(t, err)
+	require.NotNil(t, rateLimit)
+	assert.Equal(t, 1, rateLimit.Count)
+
+	time.Sleep(30 * time.Millisecond)
+
+	rateLimit, err = memory.Get(ctx, "192.168.1.1")
+	require.NoError(t, err)
+	assert.Nil(t, rateLimit)
+
+	keys, err := memory.List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
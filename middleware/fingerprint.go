@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"rate-limiter/storage"
+)
+
+// fingerprintSeparator splits the client IP from the fingerprint in a rate limit key
+const fingerprintSeparator = "#"
+
+// defaultFingerprintHeaders feed the fingerprint when FINGERPRINT_HEADERS is not set
+var defaultFingerprintHeaders = []string{"User-Agent", "Accept-Language"}
+
+// Fingerprinter splits the bucket of a shared IP (carrier-grade NAT, offices) by a
+// lightweight client fingerprint: the FINGERPRINT_HEADERS, User-Agent and
+// Accept-Language by default, and, when a TLS terminating proxy forwards it, the JA3
+// hash. Only a keyed hash of these headers is kept in the rate limit key.
+type Fingerprinter struct {
+	secret   []byte
+	networks []*net.IPNet
+	headers  []string
+}
+
+// NewFingerprinter returns nil when fingerprinting is disabled
+func NewFingerprinter(config storage.Config) *Fingerprinter {
+	if !config.FingerprintEnabled {
+		return nil
+	}
+
+	f := &Fingerprinter{
+		secret:  []byte(config.FingerprintSecret),
+		headers: append([]string(nil), config.FingerprintHeaders...),
+	}
+	if len(f.headers) == 0 {
+		f.headers = append(f.headers, defaultFingerprintHeaders...)
+	}
+	if config.FingerprintJA3Header != "" {
+		f.headers = append(f.headers, config.FingerprintJA3Header)
+	}
+
+	if len(f.secret) == 0 {
+		slog.Warn("FINGERPRINT_SECRET is not set, fingerprints will differ between instances and restarts")
+		f.secret = make([]byte, 32)
+		rand.Read(f.secret)
+	}
+
+	for _, cidr := range config.FingerprintCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			slog.Warn("Skipping invalid fingerprint CIDR", "cidr", cidr, "error", err)
+			continue
+		}
+		f.networks = append(f.networks, network)
+	}
+
+	return f
+}
+
+// Key returns the IP key augmented with the fingerprint of the request, or the plain
+// IP when fingerprinting does not apply to it
+func (f *Fingerprinter) Key(r *http.Request, clientIP string) string {
+	if f == nil || !f.applies(clientIP) {
+		return clientIP
+	}
+
+	mac := hmac.New(sha256.New, f.secret)
+	for i, header := range f.headers {
+		if i > 0 {
+			mac.Write([]byte{0})
+		}
+		mac.Write([]byte(r.Header.Get(header)))
+	}
+
+	return clientIP + fingerprintSeparator + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// applies reports whether the IP is in FINGERPRINT_CIDRS, or any IP when none are set
+func (f *Fingerprinter) applies(clientIP string) bool {
+	if len(f.networks) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, network := range f.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fingerprintRequest(userAgent, language string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "100.64.0.1:12345"
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept-Language", language)
+	return req
+}
+
+func TestFingerprinterKey(t *testing.T) {
+	assert.Nil(t, NewFingerprinter(storage.Config{}))
+
+	var disabled *Fingerprinter
+	assert.Equal(t, "100.64.0.1", disabled.Key(fingerprintRequest("curl", "en"), "100.64.0.1"))
+
+	f := NewFingerprinter(storage.Config{FingerprintEnabled: true, FingerprintSecret: "s3cret", FingerprintJA3Header: "X-JA3"})
+	key := f.Key(fingerprintRequest("Mozilla/5.0", "pt-BR"), "100.64.0.1")
+	assert.True(t, strings.HasPrefix(key, "100.64.0.1#"), key)
+	assert.Len(t, strings.TrimPrefix(key, "100.64.0.1#"), 16)
+	assert.NotContains(t, key, "Mozilla", "only a hash of the headers is kept")
+
+	assert.Equal(t, key, f.Key(fingerprintRequest("Mozilla/5.0", "pt-BR"), "100.64.0.1"))
+	assert.NotEqual(t, key, f.Key(fingerprintRequest("Mozilla/5.0", "en-US"), "100.64.0.1"))
+
+	withJA3 := fingerprintRequest("Mozilla/5.0", "pt-BR")
+	withJA3.Header.Set("X-JA3", "771,4865-4866")
+	assert.NotEqual(t, key, f.Key(withJA3, "100.64.0.1"))
+
+	other := NewFingerprinter(storage.Config{FingerprintEnabled: true, FingerprintSecret: "other", FingerprintJA3Header: "X-JA3"})
+	assert.NotEqual(t, key, other.Key(fingerprintRequest("Mozilla/5.0", "pt-BR"), "100.64.0.1"), "the secret keys the hash")
+}
+
+func TestFingerprinterHeaders(t *testing.T) {
+	f := NewFingerprinter(storage.Config{FingerprintEnabled: true, FingerprintSecret: "s3cret", FingerprintHeaders: []string{"User-Agent", "X-Client-Version"}})
+
+	req := fingerprintRequest("Mozilla/5.0", "pt-BR")
+	key := f.Key(req, "100.64.0.1")
+	assert.Equal(t, key, f.Key(fingerprintRequest("Mozilla/5.0", "en-US"), "100.64.0.1"), "headers left out don't split the IP")
+
+	req.Header.Set("X-Client-Version", "2.1")
+	assert.NotEqual(t, key, f.Key(req, "100.64.0.1"))
+
+	defaults := NewFingerprinter(storage.Config{FingerprintEnabled: true, FingerprintSecret: "s3cret"})
+	explicit := NewFingerprinter(storage.Config{FingerprintEnabled: true, FingerprintSecret: "s3cret", FingerprintHeaders: []string{"User-Agent", "Accept-Language"}})
+	assert.Equal(t, defaults.Key(req, "100.64.0.1"), explicit.Key(req, "100.64.0.1"))
+}
+
+func TestFingerprinterCIDRs(t *testing.T) {
+	f := NewFingerprinter(storage.Config{FingerprintEnabled: true, FingerprintSecret: "s3cret", FingerprintCIDRs: []string{"100.64.0.0/10"}})
+
+	assert.NotEqual(t, "100.64.0.1", f.Key(fingerprintRequest("curl", "en"), "100.64.0.1"))
+	assert.Equal(t, "203.0.113.7", f.Key(fingerprintRequest("curl", "en"), "203.0.113.7"))
+}
+
+func TestRateLimiterFingerprint(t *testing.T) {
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	service := NewService(storage.Config{
+		IPRateLimit:        1,
+		IPBlockTime:        60,
+		FingerprintEnabled: true,
+		FingerprintSecret:  "s3cret",
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(testHandler)
+
+	send := func(userAgent string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, fingerprintRequest(userAgent, "en"))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("Firefox"))
+	assert.Equal(t, http.StatusTooManyRequests, send("Firefox"))
+	assert.Equal(t, http.StatusOK, send("Safari"), "another client behind the same NAT keeps its own bucket")
+}
@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"rate-limiter/storage"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Field cases of RESPONSE_FIELD_CASE. Without one, fields keep their documented names.
+const (
+	FieldCaseSnake = "snake"
+	FieldCaseCamel = "camel"
+)
+
+// Error envelopes of RESPONSE_ERROR_ENVELOPE
+const (
+	// ErrorEnvelopeFlat answers {"error": "message"}, the default
+	ErrorEnvelopeFlat = "flat"
+	// ErrorEnvelopeNested answers {"error": {"message": "message", "status": 429}}
+	ErrorEnvelopeNested = "nested"
+	// ErrorEnvelopeProblem answers an RFC 7807 application/problem+json document
+	ErrorEnvelopeProblem = "problem"
+)
+
+// ProblemDetails is the RFC 7807 body of an error with ErrorEnvelopeProblem. RetryAfter
+// is an extension member repeating the Retry-After header of a refused request.
+type ProblemDetails struct {
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+// ResponseFormat is the serialization profile of the JSON responses of the middleware,
+// the admin API and the decision stream, so they can match the conventions of the API
+// they sit in front of. A nil ResponseFormat writes the default format.
+type ResponseFormat struct {
+	fieldCase     string
+	envelope      string
+	errorEnvelope string
+}
+
+// NewResponseFormat returns nil when the config keeps the default format
+func NewResponseFormat(config storage.Config) *ResponseFormat {
+	format := &ResponseFormat{
+		fieldCase:     config.ResponseFieldCase,
+		envelope:      config.ResponseEnvelope,
+		errorEnvelope: config.ResponseErrorEnvelope,
+	}
+	if format.errorEnvelope == ErrorEnvelopeFlat {
+		format.errorEnvelope = ""
+	}
+	if *format == (ResponseFormat{}) {
+		return nil
+	}
+	return format
+}
+
+// Marshal encodes v with the field case of the profile, wrapped in its envelope
+func (f *ResponseFormat) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || f == nil || (f.fieldCase == "" && f.envelope == "") {
+		return data, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	value = f.renameFields(value)
+	if f.envelope != "" {
+		value = map[string]interface{}{f.envelope: value}
+	}
+	return json.Marshal(value)
+}
+
+// WriteJSON answers with v encoded by Marshal
+func (f *ResponseFormat) WriteJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	data, err := f.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(append(data, '\n'))
+}
+
+// WriteError answers with the message in the error envelope of the profile. Errors are
+// never wrapped in the RESPONSE_ENVELOPE of successful responses. A problem document
+// takes its retry_after from the Retry-After header already set on w.
+func (f *ResponseFormat) WriteError(w http.ResponseWriter, statusCode int, message string) {
+	retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After"))
+	contentType, body := f.ErrorBody(statusCode, message, retryAfter)
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+// ErrorBody renders an error as WriteError does, for servers that do not answer through
+// an http.ResponseWriter
+func (f *ResponseFormat) ErrorBody(statusCode int, message string, retryAfter int) (string, []byte) {
+	var response interface{} = ErrorResponse{Error: message}
+	contentType := "application/json"
+	if f != nil {
+		switch f.errorEnvelope {
+		case ErrorEnvelopeNested:
+			response = map[string]interface{}{
+				"error": map[string]interface{}{"message": message, "status": statusCode},
+			}
+		case ErrorEnvelopeProblem:
+			response = ProblemDetails{
+				Type:       "about:blank",
+				Title:      http.StatusText(statusCode),
+				Status:     statusCode,
+				Detail:     message,
+				RetryAfter: retryAfter,
+			}
+			contentType = "application/problem+json"
+		}
+	}
+
+	body, _ := json.Marshal(response)
+	return contentType, append(body, '\n')
+}
+
+func (f *ResponseFormat) renameFields(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		renamed := make(map[string]interface{}, len(value))
+		for name, field := range value {
+			renamed[convertFieldName(name, f.fieldCase)] = f.renameFields(field)
+		}
+		return renamed
+	case []interface{}:
+		for i, item := range value {
+			value[i] = f.renameFields(item)
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+// convertFieldName rewrites a snake_case or CamelCase name in the given case
+func convertFieldName(name, fieldCase string) string {
+	words := splitFieldName(name)
+	if len(words) == 0 {
+		return name
+	}
+
+	switch fieldCase {
+	case FieldCaseSnake:
+		for i, word := range words {
+			words[i] = strings.ToLower(word)
+		}
+		return strings.Join(words, "_")
+	case FieldCaseCamel:
+		var b strings.Builder
+		b.WriteString(strings.ToLower(words[0]))
+		for _, word := range words[1:] {
+			b.WriteString(strings.ToUpper(word[:1]) + strings.ToLower(word[1:]))
+		}
+		return b.String()
+	default:
+		return name
+	}
+}
+
+// splitFieldName splits a name on underscores, dashes and case changes, keeping
+// acronyms together: "ClientIP" and "client_ip" both give "Client" and "IP"/"ip"
+func splitFieldName(name string) []string {
+	runes := []rune(name)
+
+	var words []string
+	start := 0
+	flush := func(end int) {
+		if end > start {
+			words = append(words, string(runes[start:end]))
+		}
+	}
+
+	for i, r := range runes {
+		switch {
+		case r == '_' || r == '-':
+			flush(i)
+			start = i + 1
+		case i > start && unicode.IsUpper(r):
+			previous := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if !unicode.IsUpper(previous) || nextIsLower {
+				flush(i)
+				start = i
+			}
+		}
+	}
+	flush(len(runes))
+
+	return words
+}
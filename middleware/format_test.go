@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertFieldName(t *testing.T) {
+	tests := []struct {
+		name  string
+		snake string
+		camel string
+	}{
+		{"client_ip", "client_ip", "clientIp"},
+		{"ClientIP", "client_ip", "clientIp"},
+		{"CreatedAt", "created_at", "createdAt"},
+		{"IPAddress", "ip_address", "ipAddress"},
+		{"retryAfter", "retry_after", "retryAfter"},
+		{"error", "error", "error"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.snake, convertFieldName(tt.name, FieldCaseSnake), tt.name)
+		assert.Equal(t, tt.camel, convertFieldName(tt.name, FieldCaseCamel), tt.name)
+		assert.Equal(t, tt.name, convertFieldName(tt.name, ""), tt.name)
+	}
+}
+
+func TestResponseFormat(t *testing.T) {
+	assert.Nil(t, NewResponseFormat(storage.Config{ResponseErrorEnvelope: ErrorEnvelopeFlat}))
+
+	decision := Decision{Time: time.Unix(0, 0).UTC(), Key: "10.0.0.1", ClientIP: "10.0.0.1", Allowed: true, Reason: "allowed"}
+
+	var format *ResponseFormat
+	data, err := format.Marshal(decision)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"client_ip":"10.0.0.1"`)
+
+	format = NewResponseFormat(storage.Config{ResponseFieldCase: FieldCaseCamel, ResponseEnvelope: "data"})
+	data, err = format.Marshal([]Decision{decision})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"data": [{"time": "1970-01-01T00:00:00Z", "key": "10.0.0.1", "clientIp": "10.0.0.1",
+		"method": "", "path": "", "allowed": true, "reason": "allowed"}]}`, string(data))
+
+	stats, err := format.Marshal(Stats{StorageErrors: 12345678901234})
+	require.NoError(t, err)
+	assert.Contains(t, string(stats), `"storageErrors":12345678901234`, "large numbers keep their precision")
+}
+
+func TestRateLimiterNestedErrorEnvelope(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:           1,
+		IPBlockTime:           60,
+		ResponseEnvelope:      "data",
+		ResponseErrorEnvelope: ErrorEnvelopeNested,
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, code := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, code, w.Code, "request %d", i+1)
+
+		if code == http.StatusTooManyRequests {
+			assert.JSONEq(t, `{"error": {"message": "`+defaultMessages[MessageRateLimited]+`", "status": 429}}`, w.Body.String(),
+				"errors are not wrapped in the success envelope")
+		}
+	}
+}
+
+func TestRateLimiterProblemDetails(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:           1,
+		IPBlockTime:           60,
+		ResponseErrorEnvelope: ErrorEnvelopeProblem,
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, code := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, code, w.Code, "request %d", i+1)
+
+		if code == http.StatusTooManyRequests {
+			assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+			assert.JSONEq(t, `{
+				"type": "about:blank",
+				"title": "Too Many Requests",
+				"status": 429,
+				"detail": "`+defaultMessages[MessageRateLimited]+`",
+				"retry_after": 60
+			}`, w.Body.String())
+		}
+	}
+
+	// errors without a wait leave retry_after out
+	w := httptest.NewRecorder()
+	service.format.WriteError(w, http.StatusUnauthorized, "invalid API key")
+	assert.JSONEq(t, `{"type": "about:blank", "title": "Unauthorized", "status": 401, "detail": "invalid API key"}`, w.Body.String())
+}
@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"net"
+	"rate-limiter/storage"
+	"strconv"
+)
+
+// GeoLocation is what the GeoIP databases know about a client IP; ASN is 0 and Country
+// empty when they don't
+type GeoLocation struct {
+	Country string
+	ASN     uint
+}
+
+// GeoIP attaches the country and ASN of the GEOIP_DATABASES to client IPs, picking their
+// COUNTRY_POLICIES or ASN_POLICIES policy and refusing BLOCKED_COUNTRIES and BLOCKED_ASNS
+type GeoIP struct {
+	databases        []*storage.MMDBReader
+	countryPolicies  map[string]string
+	asnPolicies      map[string]string
+	blockedCountries map[string]bool
+	blockedASNs      map[string]bool
+}
+
+// NewGeoIP opens the databases, returning nil when none is configured
+func NewGeoIP(config storage.Config) (*GeoIP, error) {
+	if len(config.GeoIPDatabases) == 0 {
+		return nil, nil
+	}
+
+	geoIP := &GeoIP{
+		countryPolicies:  config.CountryPolicies,
+		asnPolicies:      config.ASNPolicies,
+		blockedCountries: make(map[string]bool, len(config.BlockedCountries)),
+		blockedASNs:      make(map[string]bool, len(config.BlockedASNs)),
+	}
+	for _, path := range config.GeoIPDatabases {
+		database, err := storage.OpenMMDB(path)
+		if err != nil {
+			return nil, err
+		}
+		geoIP.databases = append(geoIP.databases, database)
+	}
+	for _, country := range config.BlockedCountries {
+		geoIP.blockedCountries[country] = true
+	}
+	for _, asn := range config.BlockedASNs {
+		geoIP.blockedASNs[asn] = true
+	}
+	return geoIP, nil
+}
+
+// Locate merges what every database knows about the IP, the first one to know a field
+// winning. Lookup errors leave the fields they would have set empty.
+func (g *GeoIP) Locate(clientIP string) GeoLocation {
+	var location GeoLocation
+	ip := net.ParseIP(clientIP)
+	if g == nil || ip == nil {
+		return location
+	}
+
+	for _, database := range g.databases {
+		record, err := database.Lookup(ip)
+		fields, ok := record.(map[string]any)
+		if err != nil || !ok {
+			continue
+		}
+		if location.Country == "" {
+			location.Country = isoCode(fields["country"])
+		}
+		if location.Country == "" {
+			location.Country = isoCode(fields["registered_country"])
+		}
+		if asn, ok := fields["autonomous_system_number"].(uint64); ok && location.ASN == 0 {
+			location.ASN = uint(asn)
+		}
+	}
+	return location
+}
+
+func isoCode(country any) string {
+	fields, _ := country.(map[string]any)
+	code, _ := fields["iso_code"].(string)
+	return code
+}
+
+// Blocked reports whether the country or ASN of the location is blocked
+func (g *GeoIP) Blocked(location GeoLocation) bool {
+	if g == nil {
+		return false
+	}
+	return g.blockedCountries[location.Country] || (location.ASN != 0 && g.blockedASNs[strconv.FormatUint(uint64(location.ASN), 10)])
+}
+
+// Policy returns the policy of the ASN of the location, or else of its country
+func (g *GeoIP) Policy(location GeoLocation) string {
+	if g == nil {
+		return ""
+	}
+	if name, exists := g.asnPolicies[strconv.FormatUint(uint64(location.ASN), 10)]; exists && location.ASN != 0 {
+		return name
+	}
+	return g.countryPolicies[location.Country]
+}
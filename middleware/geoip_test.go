@@ -0,0 +1,217 @@
+package middleware
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rate-limiter/storage"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// MaxMind DB data types and the marker of the metadata section written by writeMMDB
+const (
+	mmdbString = 2
+	mmdbUint16 = 5
+	mmdbUint32 = 6
+	mmdbMap    = 7
+)
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbTestNode is a node of the search tree writeMMDB builds; leaves hold the offset of
+// their record in the data section, plus one
+type mmdbTestNode struct {
+	children [2]*mmdbTestNode
+	data     int
+}
+
+// writeMMDB writes an IPv6 MaxMind DB with 24-bit records mapping each CIDR to its record
+func writeMMDB(t *testing.T, records map[string]map[string]any) string {
+	root := &mmdbTestNode{}
+	var data []byte
+	for cidr, record := range records {
+		_, network, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		ones, bits := network.Mask.Size()
+		address := network.IP.To16()
+		if bits == 32 {
+			ones += 96
+			address = append(make(net.IP, 12), network.IP.To4()...)
+		}
+
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := address[i/8] >> (7 - i%8) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &mmdbTestNode{}
+			}
+			node = node.children[bit]
+		}
+		node.data = len(data) + 1
+		data = append(data, mmdbEncode(record)...)
+	}
+
+	var nodes []*mmdbTestNode
+	numbers := map[*mmdbTestNode]int{}
+	for queue := []*mmdbTestNode{root}; len(queue) > 0; queue = queue[1:] {
+		numbers[queue[0]] = len(nodes)
+		nodes = append(nodes, queue[0])
+		for _, child := range queue[0].children {
+			if child != nil && child.data == 0 {
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	var file []byte
+	for _, node := range nodes {
+		for _, child := range node.children {
+			record := len(nodes)
+			if child != nil && child.data > 0 {
+				record = len(nodes) + 16 + child.data - 1
+			} else if child != nil {
+				record = numbers[child]
+			}
+			file = append(file, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+	file = append(file, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataMarker...)
+	file = append(file, mmdbEncode(map[string]any{
+		"node_count":    uint32(len(nodes)),
+		"record_size":   uint16(24),
+		"ip_version":    uint16(6),
+		"database_type": "Test",
+	})...)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	require.NoError(t, os.WriteFile(path, file, 0o600))
+	return path
+}
+
+func mmdbEncode(value any) []byte {
+	switch v := value.(type) {
+	case string:
+		return append([]byte{mmdbString<<5 | byte(len(v))}, v...)
+	case uint16:
+		return binary.BigEndian.AppendUint16([]byte{mmdbUint16<<5 | 2}, v)
+	case uint32:
+		return binary.BigEndian.AppendUint32([]byte{mmdbUint32<<5 | 4}, v)
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		encoded := []byte{mmdbMap<<5 | byte(len(v))}
+		for _, key := range keys {
+			encoded = append(encoded, mmdbEncode(key)...)
+			encoded = append(encoded, mmdbEncode(v[key])...)
+		}
+		return encoded
+	}
+	panic("unsupported value")
+}
+
+func testGeoIPDatabase(t *testing.T) string {
+	return writeMMDB(t, map[string]map[string]any{
+		"1.2.3.0/24":      {"country": map[string]any{"iso_code": "BR"}, "autonomous_system_number": uint32(64500)},
+		"1.2.4.0/24":      {"registered_country": map[string]any{"iso_code": "BR"}},
+		"5.6.7.0/24":      {"country": map[string]any{"iso_code": "US"}, "autonomous_system_number": uint32(13335)},
+		"2001:db8::/32":   {"country": map[string]any{"iso_code": "KP"}},
+		"2001:db9::/32":   {"autonomous_system_number": uint32(64501)},
+		"198.51.100.0/24": {"country": map[string]any{"iso_code": "AR"}},
+	})
+}
+
+func TestGeoIPLocate(t *testing.T) {
+	geoIP, err := NewGeoIP(storage.Config{GeoIPDatabases: []string{testGeoIPDatabase(t)}})
+	require.NoError(t, err)
+
+	assert.Equal(t, GeoLocation{Country: "BR", ASN: 64500}, geoIP.Locate("1.2.3.4"))
+	assert.Equal(t, GeoLocation{Country: "BR"}, geoIP.Locate("1.2.4.4"), "the registered country stands in for the country")
+	assert.Equal(t, GeoLocation{Country: "KP"}, geoIP.Locate("2001:db8::1"))
+	assert.Equal(t, GeoLocation{}, geoIP.Locate("10.0.0.1"))
+	assert.Equal(t, GeoLocation{}, geoIP.Locate("not-an-ip"))
+
+	_, err = NewGeoIP(storage.Config{GeoIPDatabases: []string{filepath.Join(t.TempDir(), "missing.mmdb")}})
+	assert.Error(t, err)
+}
+
+func TestLoadGeoIP(t *testing.T) {
+	unsetEnv(t, "GEOIP_DATABASES", "BLOCKED_COUNTRIES", "ASN_POLICIES", "APPS", "HOST_TEMPLATES")
+	t.Setenv("POLICIES", "strict")
+	t.Setenv("POLICY_STRICT_LIMIT", "1")
+	t.Setenv("COUNTRY_POLICIES", "br=strict")
+	t.Setenv("BLOCKED_ASNS", "AS13335")
+
+	_, err := storage.LoadConfig()
+	assert.ErrorContains(t, err, "GEOIP_DATABASES")
+
+	t.Setenv("GEOIP_DATABASES", filepath.Join(t.TempDir(), "missing.mmdb"))
+	_, err = storage.LoadConfig()
+	assert.ErrorContains(t, err, "failed to open GEOIP_DATABASES", "blocked countries are not left unenforced")
+
+	t.Setenv("GEOIP_DATABASES", testGeoIPDatabase(t)+","+testGeoIPDatabase(t))
+	appConfig, err := storage.LoadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"BR": "strict"}, appConfig.RateLimit.CountryPolicies)
+	assert.Equal(t, []string{"13335"}, appConfig.RateLimit.BlockedASNs)
+
+	t.Setenv("ASN_POLICIES", "13335=relaxed")
+	_, err = storage.LoadConfig()
+	assert.ErrorContains(t, err, "ASN_POLICIES")
+}
+
+func TestRateLimiterGeoIP(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:        10,
+		IPBlockTime:        60,
+		DenylistStatusCode: http.StatusForbidden,
+		Policies: map[string]storage.Policy{
+			"strict":  {Name: "strict", Limit: 1, BlockTime: 60},
+			"relaxed": {Name: "relaxed", Limit: 3, BlockTime: 60},
+		},
+		GeoIPDatabases:   []string{testGeoIPDatabase(t)},
+		CountryPolicies:  map[string]string{"BR": "strict"},
+		ASNPolicies:      map[string]string{"64500": "relaxed"},
+		BlockedCountries: []string{"KP"},
+		BlockedASNs:      []string{"64501"},
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(remoteAddr string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("1.2.4.4:1234"))
+	assert.Equal(t, http.StatusTooManyRequests, send("1.2.4.4:1234"), "the country policy applies")
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, send("1.2.3.4:1234"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, send("1.2.3.4:1234"), "the ASN policy wins over the country one")
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, send("5.6.7.8:1234"), "other clients keep the IP limit")
+	}
+	assert.Equal(t, http.StatusForbidden, send("[2001:db8::1]:1234"))
+	assert.Equal(t, http.StatusForbidden, send("[2001:db9::1]:1234"))
+
+	verdict := service.Evaluate("2001:db8::1", "", "GET", "/", 1)
+	assert.False(t, verdict.Allowed)
+	assert.Equal(t, "geo_blocked", verdict.Reason)
+	verdict = service.Evaluate("1.2.4.5", "", "GET", "/", 1)
+	assert.Equal(t, "tier:strict:1.2.4.5", verdict.Key)
+}
@@ -0,0 +1,172 @@
+package middleware
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"strings"
+	"testing"
+
+	"rate-limiter/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceHashesStorageKeys(t *testing.T) {
+	ctx := context.Background()
+	memory := storage.NewMemoryStorage()
+	service := NewService(storage.Config{
+		IPRateLimit:       10,
+		IPBlockTime:       60,
+		TokenLimits:       map[string]int{"abc123": 100},
+		KeyHashingEnabled: true,
+		KeyHashSecret:     "secret",
+	}, memory)
+
+	for _, key := range []string{"192.168.1.1", "token:abc123"} {
+		_, err := service.CheckRateLimit(key, strings.HasPrefix(key, "token:"), 1)
+		require.NoError(t, err)
+	}
+
+	keys, err := memory.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	for _, key := range keys {
+		assert.NotContains(t, key, "192.168.1.1")
+		assert.NotContains(t, key, "abc123")
+	}
+
+	state, err := service.GetLimitState(ctx, "192.168.1.1")
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, 1, state.Count)
+
+	tokens, err := service.ListLimits(ctx, "token:")
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	assert.True(t, strings.HasPrefix(tokens[0].Key, "token:#"))
+
+	// a listed key is already hashed and is looked up as is
+	state, err = service.GetLimitState(ctx, tokens[0].Key)
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, 1, state.Count)
+
+	require.NoError(t, service.ResetLimit(ctx, "token:abc123"))
+	state, err = service.GetLimitState(ctx, tokens[0].Key)
+	require.NoError(t, err)
+	assert.Nil(t, state)
+}
+
+func TestHashKeyDependsOnSecret(t *testing.T) {
+	memory := storage.NewMemoryStorage()
+	first := storage.NewHashedStorage(memory, "first")
+	second := storage.NewHashedStorage(memory, "second")
+
+	assert.Equal(t, first.HashKey("10.0.0.1"), first.HashKey("10.0.0.1"))
+	assert.NotEqual(t, first.HashKey("10.0.0.1"), second.HashKey("10.0.0.1"))
+	assert.Equal(t, first.HashKey("10.0.0.1"), first.StoredKey(first.HashKey("10.0.0.1")))
+	// clients choose their API keys, so one that looks hashed is hashed all the same
+	assert.NotEqual(t, first.HashKey("token:abc123"), first.HashKey(first.HashKey("token:abc123")))
+}
+
+func TestHashedKeyOfClientIsHashed(t *testing.T) {
+	ctx := context.Background()
+	memory := storage.NewMemoryStorage()
+	service := NewService(storage.Config{
+		IPRateLimit:       10,
+		IPBlockTime:       60,
+		KeyHashingEnabled: true,
+		KeyHashSecret:     "secret",
+	}, memory)
+
+	key := service.storageKey("token:abc123")
+	_, err := service.CheckRateLimit(key, true, 1)
+	require.NoError(t, err)
+
+	keys, err := memory.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.NotEqual(t, key, keys[0])
+}
+
+func TestServiceHashesTokenNamesAndBans(t *testing.T) {
+	ctx := context.Background()
+	memory := storage.NewMemoryStorage()
+	service := NewService(storage.Config{
+		IPRateLimit:       10,
+		IPBlockTime:       60,
+		TokenLimits:       map[string]int{"seeded": 100},
+		Denylist:          []string{"token:banned"},
+		KeyHashingEnabled: true,
+		KeyHashSecret:     "secret",
+	}, memory)
+	require.NoError(t, service.SeedDenylist(ctx))
+	require.NoError(t, service.SeedTokens(ctx))
+	require.NoError(t, service.CreateToken(ctx, &ratelimiter.TokenConfig{Name: "abc123", Limit: 1, BlockTime: 60}))
+	_, err := service.AddBan(ctx, "token:secret-key", "abuse")
+	require.NoError(t, err)
+
+	tokens, err := memory.ListTokenConfigs(ctx)
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	for _, token := range tokens {
+		assert.NotContains(t, token.Name, "seeded")
+		assert.NotContains(t, token.Name, "abc123")
+	}
+	bans, err := memory.ListBans(ctx)
+	require.NoError(t, err)
+	require.Len(t, bans, 2)
+	for _, ban := range bans {
+		assert.True(t, strings.HasPrefix(ban.Value, "token:#"))
+	}
+
+	assert.True(t, service.IsDenied("", "token:banned"))
+	assert.True(t, service.IsDenied("", "token:secret-key"))
+	assert.False(t, service.IsDenied("", "token:abc123"))
+
+	allowed, err := service.CheckRateLimit("token:abc123", true, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, err = service.CheckRateLimit("token:abc123", true, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed, "the registry limit applies to the hashed token")
+
+	token, err := service.GetToken(ctx, "abc123")
+	require.NoError(t, err)
+	assert.Equal(t, 1, token.Limit)
+
+	// configured bans are reconciled by their hash, not seeded twice
+	require.NoError(t, service.Reload(ctx, service.Config()))
+	bans, err = memory.ListBans(ctx)
+	require.NoError(t, err)
+	assert.Len(t, bans, 2)
+
+	require.NoError(t, service.RemoveBan(ctx, "token:secret-key"))
+	assert.False(t, service.IsDenied("", "token:secret-key"))
+}
+
+func TestKeyStatsWithHashedKeys(t *testing.T) {
+	ctx := context.Background()
+	service := NewService(storage.Config{
+		IPRateLimit:       10,
+		KeyStatsRetention: 30,
+		KeyHashingEnabled: true,
+		KeyHashSecret:     "secret",
+	}, storage.NewMemoryStorage())
+
+	service.publish("GET", "", "/", "192.168.1.1", "192.168.1.1", false, "rate_limit")
+	service.publish("GET", "", "/", "192.168.1.1", "192.168.1.1", false, "rate_limit")
+	require.NoError(t, service.FlushRejections(ctx))
+
+	stats, err := service.GetKeyStats(ctx, "192.168.1.1")
+	require.NoError(t, err)
+	require.NotNil(t, stats)
+	assert.Equal(t, 2, stats.Rejections)
+
+	top, err := service.TopRejected(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, top, 1)
+	assert.True(t, strings.HasPrefix(top[0].Key, "#"), "listed keys stay hashed")
+	assert.Equal(t, 2, top[0].Rejections)
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"rate-limiter/storage"
+	"time"
+)
+
+// Health states, from best to worst. A degraded instance still limits requests, with
+// a weaker guarantee: counters in memory only, no counter writes, or a failing canary.
+const (
+	HealthHealthy   = "healthy"
+	HealthDegraded  = "degraded"
+	HealthUnhealthy = "unhealthy"
+)
+
+// Check states of HealthCheck
+const (
+	CheckUp       = "up"
+	CheckDegraded = "degraded"
+	CheckDown     = "down"
+)
+
+// HealthCheck is the outcome of one check of Health
+type HealthCheck struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Health is the state of the instance and of the checks it is made of
+type Health struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// Health pings the storage and reads the canary and read-only mode. The instance is
+// unhealthy when the storage is unreachable, and degraded when it is reached through
+// the in-memory fallback, is read-only or fails its canary.
+func (s *Service) Health(ctx context.Context) Health {
+	health := Health{Status: HealthHealthy, Checks: make(map[string]HealthCheck)}
+	degrade := func(status string) {
+		if status == HealthUnhealthy || health.Status == HealthHealthy {
+			health.Status = status
+		}
+	}
+
+	start := time.Now()
+	err := s.storage.Ping(ctx)
+	check := HealthCheck{Status: CheckUp, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+	switch {
+	case errors.Is(err, storage.ErrFallbackActive):
+		check.Status, check.Error = CheckDegraded, err.Error()
+		degrade(HealthDegraded)
+	case err != nil:
+		check.Status, check.Error = CheckDown, err.Error()
+		degrade(HealthUnhealthy)
+	}
+	health.Checks["storage"] = check
+
+	if canary := s.CanaryStatus(); canary != nil {
+		check := HealthCheck{Status: CheckUp, LatencyMs: canary.LatencyMs, Error: canary.Error}
+		if !canary.Ready {
+			check.Status = CheckDown
+			degrade(HealthDegraded)
+		}
+		health.Checks["canary"] = check
+	}
+
+	if s.IsReadOnly() {
+		health.Checks["read_only"] = HealthCheck{Status: CheckDegraded}
+		degrade(HealthDegraded)
+	}
+
+	return health
+}
@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"net/http"
+	"rate-limiter/storage"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	healthCheckKeyPrefix = "healthcheck:"
+
+	HealthCheckModeOff    = "off"
+	HealthCheckModeExempt = "exempt"
+	HealthCheckModePool   = "pool"
+
+	maxHealthCheckSignatures = 1024
+)
+
+// HealthCheckDetector recognizes orchestrator health checks so post-deploy probe
+// storms don't trip per-IP limits. A request is a health check when its User-Agent
+// matches a known checker, or when the same User-Agent hits the same probe path from
+// at least minSources distinct IPs within the detection window.
+type HealthCheckDetector struct {
+	mode       string
+	userAgents []string
+	paths      map[string]struct{}
+	minSources int
+	window     time.Duration
+
+	mu         sync.Mutex
+	signatures map[string]map[string]time.Time
+}
+
+func NewHealthCheckDetector(config storage.Config) *HealthCheckDetector {
+	paths := make(map[string]struct{}, len(config.HealthCheckPaths))
+	for _, path := range config.HealthCheckPaths {
+		paths[path] = struct{}{}
+	}
+
+	userAgents := make([]string, 0, len(config.HealthCheckUserAgents))
+	for _, userAgent := range config.HealthCheckUserAgents {
+		userAgents = append(userAgents, strings.ToLower(userAgent))
+	}
+
+	return &HealthCheckDetector{
+		mode:       config.HealthCheckMode,
+		userAgents: userAgents,
+		paths:      paths,
+		minSources: config.HealthCheckMinSources,
+		window:     time.Duration(config.HealthCheckWindow) * time.Second,
+		signatures: make(map[string]map[string]time.Time),
+	}
+}
+
+// Classify reports whether the request is a health check that should be exempted
+// from limiting or pooled into the shared health check bucket
+func (h *HealthCheckDetector) Classify(r *http.Request, clientIP string) (exempt, pooled bool) {
+	if h == nil || h.mode == HealthCheckModeOff || h.mode == "" {
+		return false, false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false, false
+	}
+
+	if !h.isKnownChecker(r.UserAgent()) && !h.isStorm(r, clientIP) {
+		return false, false
+	}
+
+	if h.mode == HealthCheckModeExempt {
+		return true, false
+	}
+	return false, true
+}
+
+func (h *HealthCheckDetector) isKnownChecker(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, known := range h.userAgents {
+		if known != "" && strings.Contains(userAgent, known) {
+			return true
+		}
+	}
+	return false
+}
+
+// isStorm records the source of a probe path request and reports whether its
+// signature has been seen from enough distinct IPs within the window
+func (h *HealthCheckDetector) isStorm(r *http.Request, clientIP string) bool {
+	if h.minSources <= 0 {
+		return false
+	}
+	if _, probe := h.paths[r.URL.Path]; !probe {
+		return false
+	}
+
+	signature := r.UserAgent() + "|" + r.URL.Path
+	now := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sources, exists := h.signatures[signature]
+	if !exists {
+		if len(h.signatures) >= maxHealthCheckSignatures {
+			h.pruneSignatures(now)
+			if len(h.signatures) >= maxHealthCheckSignatures {
+				return false
+			}
+		}
+		sources = make(map[string]time.Time)
+		h.signatures[signature] = sources
+	}
+
+	for ip, seen := range sources {
+		if now.Sub(seen) > h.window {
+			delete(sources, ip)
+		}
+	}
+	if len(sources) < maxHealthCheckSignatures {
+		sources[clientIP] = now
+	}
+
+	return len(sources) >= h.minSources
+}
+
+func (h *HealthCheckDetector) pruneSignatures(now time.Time) {
+	for signature, sources := range h.signatures {
+		stale := true
+		for _, seen := range sources {
+			if now.Sub(seen) <= h.window {
+				stale = false
+				break
+			}
+		}
+		if stale {
+			delete(h.signatures, signature)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newHealthCheckConfig(mode string) storage.Config {
+	return storage.Config{
+		IPRateLimit:              1,
+		IPBlockTime:              60,
+		HealthCheckMode:          mode,
+		HealthCheckUserAgents:    []string{"kube-probe"},
+		HealthCheckPaths:         []string{"/health"},
+		HealthCheckMinSources:    3,
+		HealthCheckWindow:        10,
+		HealthCheckPoolLimit:     100,
+		HealthCheckPoolBlockTime: 1,
+	}
+}
+
+func TestHealthCheckDetectorClassify(t *testing.T) {
+	newRequest := func(method, path, userAgent string) *http.Request {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("User-Agent", userAgent)
+		return req
+	}
+
+	t.Run("known_checker", func(t *testing.T) {
+		detector := NewHealthCheckDetector(newHealthCheckConfig(HealthCheckModePool))
+		exempt, pooled := detector.Classify(newRequest("GET", "/health", "kube-probe/1.29"), "10.0.0.1")
+		assert.False(t, exempt)
+		assert.True(t, pooled)
+	})
+
+	t.Run("exempt_mode", func(t *testing.T) {
+		detector := NewHealthCheckDetector(newHealthCheckConfig(HealthCheckModeExempt))
+		exempt, pooled := detector.Classify(newRequest("GET", "/health", "kube-probe/1.29"), "10.0.0.1")
+		assert.True(t, exempt)
+		assert.False(t, pooled)
+	})
+
+	t.Run("off_mode", func(t *testing.T) {
+		detector := NewHealthCheckDetector(newHealthCheckConfig(HealthCheckModeOff))
+		exempt, pooled := detector.Classify(newRequest("GET", "/health", "kube-probe/1.29"), "10.0.0.1")
+		assert.False(t, exempt)
+		assert.False(t, pooled)
+	})
+
+	t.Run("post_ignored", func(t *testing.T) {
+		detector := NewHealthCheckDetector(newHealthCheckConfig(HealthCheckModePool))
+		_, pooled := detector.Classify(newRequest("POST", "/health", "kube-probe/1.29"), "10.0.0.1")
+		assert.False(t, pooled)
+	})
+
+	t.Run("storm_detection", func(t *testing.T) {
+		detector := NewHealthCheckDetector(newHealthCheckConfig(HealthCheckModePool))
+
+		_, pooled := detector.Classify(newRequest("GET", "/health", "custom-checker"), "10.0.0.1")
+		assert.False(t, pooled)
+		_, pooled = detector.Classify(newRequest("GET", "/health", "custom-checker"), "10.0.0.2")
+		assert.False(t, pooled)
+		_, pooled = detector.Classify(newRequest("GET", "/health", "custom-checker"), "10.0.0.3")
+		assert.True(t, pooled)
+
+		_, pooled = detector.Classify(newRequest("GET", "/api/test", "custom-checker"), "10.0.0.4")
+		assert.False(t, pooled, "only probe paths are subject to storm detection")
+	})
+}
+
+func TestRateLimiterPoolsHealthChecks(t *testing.T) {
+	service := NewService(newHealthCheckConfig(HealthCheckModePool), storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("GET", "/health", nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		req.Header.Set("User-Agent", "kube-probe/1.29")
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "the probe traffic did not consume the IP bucket")
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// identityKeyPrefix keys the clients authenticated by an mTLS certificate
+const identityKeyPrefix = "mtls:"
+
+// clientIdentity returns the identity of the verified client certificate of the request:
+// its first URI SAN (such as a SPIFFE ID), else its first DNS SAN, else its subject
+// common name. It is empty for plain HTTP and for clients without a verified
+// certificate, which are keyed by their API key or IP as usual.
+func clientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	if len(cert.DNSNames) > 0 {
+		return strings.ToLower(cert.DNSNames[0])
+	}
+	return cert.Subject.CommonName
+}
+
+// identityKey returns the rate limit key of the mTLS identity of the request, which
+// takes precedence over the API key and IP since the handshake proved it
+func identityKey(r *http.Request) (string, bool) {
+	if identity := clientIdentity(r); identity != "" {
+		return identityKeyPrefix + identity, true
+	}
+	return "", false
+}
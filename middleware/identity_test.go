@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withClientCert gives the request a verified client certificate
+func withClientCert(r *http.Request, cert *x509.Certificate) *http.Request {
+	r.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+	return r
+}
+
+func TestClientIdentity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.org/ns/prod/sa/billing")
+	req := httptest.NewRequest("GET", "/", nil)
+	assert.Empty(t, clientIdentity(req), "plain HTTP has no identity")
+
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "billing"},
+		DNSNames: []string{"Billing.Internal"},
+		URIs:     []*url.URL{spiffe},
+	}
+	assert.Equal(t, "spiffe://example.org/ns/prod/sa/billing", clientIdentity(withClientCert(req, cert)))
+	cert.URIs = nil
+	assert.Equal(t, "billing.internal", clientIdentity(withClientCert(req, cert)))
+	cert.DNSNames = nil
+	assert.Equal(t, "billing", clientIdentity(withClientCert(req, cert)))
+
+	req.TLS.VerifiedChains = nil
+	assert.Empty(t, clientIdentity(req), "unverified certificates are not trusted")
+}
+
+func TestRateLimiterClientIdentity(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:      100,
+		IPBlockTime:      60,
+		TokenLimits:      map[string]int{"ABC": 100},
+		Policies:         map[string]storage.Policy{"internal": {Name: "internal", Limit: 3, BlockTime: 60}},
+		IdentityLimits:   map[string]int{"billing.internal": 1},
+		IdentityPolicies: map[string]string{"orders.internal": "internal"},
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(identity string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("API_KEY", "ABC")
+		if identity != "" {
+			req = withClientCert(req, &x509.Certificate{DNSNames: []string{identity}})
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("billing.internal"))
+	assert.Equal(t, http.StatusTooManyRequests, send("billing.internal"), "the identity wins over the API key")
+	assert.Equal(t, http.StatusOK, send(""), "the token keeps its own counter")
+	assert.Equal(t, 3, service.getLimit("mtls:orders.internal", false))
+	assert.Equal(t, 100, service.getLimit("mtls:unknown.internal", false), "unlisted identities get the default policy")
+}
+
+func TestLoadIdentityLimits(t *testing.T) {
+	unsetEnv(t, "IP_RATE_LIMIT", "IP_BLOCK_TIME", "APPS", "HOST_TEMPLATES", "POLICIES")
+	t.Setenv("MTLS_IDENTITY_LIMITS", "billing.internal=50,spiffe://example.org/sa/orders=500")
+	t.Setenv("TLS_CERT", "server.crt")
+	t.Setenv("TLS_KEY", "server.key")
+	t.Setenv("TLS_CLIENT_CA", "ca.crt")
+
+	appConfig, err := storage.LoadConfig()
+	require.NoError(t, err)
+	config := appConfig.RateLimit
+	assert.Equal(t, map[string]int{"billing.internal": 50, "spiffe://example.org/sa/orders": 500}, config.IdentityLimits)
+	assert.Equal(t, "require", config.TLSClientAuth)
+	assert.Equal(t, 50, config.IdentityPolicy("billing.internal").Limit)
+
+	t.Setenv("MTLS_IDENTITY_POLICIES", "billing.internal=missing")
+	_, err = storage.LoadConfig()
+	assert.ErrorContains(t, err, "MTLS_IDENTITY_POLICIES")
+
+	t.Setenv("MTLS_IDENTITY_POLICIES", "")
+	t.Setenv("TLS_KEY", "")
+	_, err = storage.LoadConfig()
+	assert.ErrorContains(t, err, "TLS_CERT and TLS_KEY")
+}
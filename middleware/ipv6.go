@@ -0,0 +1,28 @@
+package middleware
+
+import "net"
+
+// normalizeIP returns the canonical form of an IP, so that the spellings of an IPv6
+// address, or an IPv4 address mapped into IPv6, share a key. Anything else is kept as is.
+func normalizeIP(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return clientIP
+	}
+	return ip.String()
+}
+
+// ipKey returns the key of a client IP: the first address of its IPV6_PREFIX network
+// for IPv6 clients, such as 2001:db8:1:2:: for /64, and the IP itself otherwise
+func (s *Service) ipKey(clientIP string) string {
+	prefix := s.Config().IPv6Prefix
+	if prefix <= 0 || prefix >= 128 {
+		return clientIP
+	}
+
+	ip := net.ParseIP(clientIP)
+	if ip == nil || ip.To4() != nil {
+		return clientIP
+	}
+	return ip.Mask(net.CIDRMask(prefix, 128)).String()
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeIP(t *testing.T) {
+	assert.Equal(t, "2001:db8::1", normalizeIP("2001:DB8:0:0::0001"))
+	assert.Equal(t, "192.168.1.1", normalizeIP("::ffff:192.168.1.1"), "mapped IPv4 addresses are keyed as IPv4")
+	assert.Equal(t, "not-an-ip", normalizeIP("not-an-ip"))
+}
+
+func TestLoadIPv6Prefix(t *testing.T) {
+	unsetEnv(t, "IPV6_PREFIX", "APPS", "HOST_TEMPLATES")
+
+	appConfig, err := storage.LoadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 64, appConfig.RateLimit.IPv6Prefix)
+
+	t.Setenv("IPV6_PREFIX", "129")
+	_, err = storage.LoadConfig()
+	assert.ErrorContains(t, err, "IPV6_PREFIX")
+}
+
+func TestRateLimiterIPv6Prefix(t *testing.T) {
+	service := NewService(storage.Config{IPRateLimit: 2, IPBlockTime: 60, IPv6Prefix: 64}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(remoteAddr string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("[2001:db8:1:2::1]:1234"))
+	assert.Equal(t, http.StatusOK, send("[2001:db8:1:2:aaaa::2]:1234"))
+	assert.Equal(t, http.StatusTooManyRequests, send("[2001:db8:1:2:ffff::3]:1234"), "the addresses of a /64 share a key")
+	assert.Equal(t, http.StatusOK, send("[2001:db8:1:3::1]:1234"), "another /64 has its own")
+
+	verdict := service.Evaluate("2001:DB8:1:2::9", "", "GET", "/", 1)
+	assert.Equal(t, "2001:db8:1:2::", verdict.Key)
+	assert.False(t, verdict.Allowed)
+
+	service = NewService(storage.Config{IPRateLimit: 1, IPBlockTime: 60, IPv6Prefix: 128}, storage.NewMemoryStorage())
+	assert.True(t, service.Evaluate("2001:db8::1", "", "GET", "/", 1).Allowed)
+	assert.True(t, service.Evaluate("2001:db8::2", "", "GET", "/", 1).Allowed, "128 keys every address apart")
+	assert.False(t, service.Evaluate("2001:DB8:0::1", "", "GET", "/", 1).Allowed, "but spellings of an address still share a key")
+}
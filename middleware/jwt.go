@@ -0,0 +1,342 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"rate-limiter/storage"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tierKeyPrefix scopes the key of a client to the tier its JWT names: tier:<name>:<key>.
+// The tier is part of the client, so its window and quotas follow it.
+const tierKeyPrefix = "tier:"
+
+// jwksRefreshInterval bounds how often the JWKS is fetched again for a key id not seen yet
+const jwksRefreshInterval = time.Minute
+
+var errInvalidJWT = errors.New("invalid JWT")
+
+// JWTVerifier verifies the JWT bearer tokens of requests, so clients are keyed by a claim
+// the issuer signed rather than an opaque header value. HMAC tokens are checked against
+// JWT_SECRET, RSA ones against JWT_PUBLIC_KEY_FILE or the keys served at JWT_JWKS_URL,
+// fetched again when a token names a key id not seen yet. Each algorithm family is only
+// accepted when its key is configured, and "none" never is.
+type JWTVerifier struct {
+	secret    []byte
+	publicKey *rsa.PublicKey
+	jwksURL   string
+	keyClaims []string
+	tierClaim string
+	issuer    string
+	audience  string
+	client    *http.Client
+
+	mu        sync.Mutex
+	jwks      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// NewJWTVerifier returns nil when no JWT key is configured
+func NewJWTVerifier(config storage.Config) (*JWTVerifier, error) {
+	if config.JWTSecret == "" && config.JWTPublicKeyFile == "" && config.JWTJWKSURL == "" {
+		return nil, nil
+	}
+
+	verifier := &JWTVerifier{
+		jwksURL:   config.JWTJWKSURL,
+		keyClaims: config.JWTKeyClaims,
+		tierClaim: config.JWTTierClaim,
+		issuer:    config.JWTIssuer,
+		audience:  config.JWTAudience,
+		client:    &http.Client{Timeout: 5 * time.Second},
+	}
+	if config.JWTSecret != "" {
+		verifier.secret = []byte(config.JWTSecret)
+	}
+	if len(verifier.keyClaims) == 0 {
+		verifier.keyClaims = []string{"sub", "client_id"}
+	}
+	if config.JWTPublicKeyFile != "" {
+		publicKey, err := storage.LoadRSAPublicKey(config.JWTPublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT_PUBLIC_KEY_FILE: %w", err)
+		}
+		verifier.publicKey = publicKey
+	}
+	return verifier, nil
+}
+
+// jwtCredentials is what a verified JWT says about its client: the first set of the key
+// claims and the tier claim
+type jwtCredentials struct {
+	subject string
+	tier    string
+}
+
+// Authenticate verifies the JWT bearer token of the request. It reports false when the
+// request carries no JWT, to be keyed as usual; a JWT failing verification is an error.
+func (v *JWTVerifier) Authenticate(r *http.Request) (jwtCredentials, bool, error) {
+	raw, _ := BearerExtractor()(r)
+	return v.AuthenticateToken(raw)
+}
+
+// AuthenticateToken is Authenticate for a credential read outside of HTTP, such as gRPC
+// metadata or an Envoy descriptor
+func (v *JWTVerifier) AuthenticateToken(raw string) (jwtCredentials, bool, error) {
+	if v == nil || !LooksLikeJWT(raw) {
+		return jwtCredentials{}, false, nil
+	}
+
+	claims, err := v.Verify(raw, time.Now())
+	if err != nil {
+		return jwtCredentials{}, true, err
+	}
+
+	var credentials jwtCredentials
+	for _, name := range v.keyClaims {
+		if value, ok := claims[name].(string); ok && value != "" {
+			credentials.subject = value
+			break
+		}
+	}
+	if credentials.subject == "" {
+		return jwtCredentials{}, true, fmt.Errorf("%w: none of the claims %s is set", errInvalidJWT, strings.Join(v.keyClaims, ", "))
+	}
+	if v.tierClaim != "" {
+		tier, _ := claims[v.tierClaim].(string)
+		credentials.tier = strings.ToLower(tier)
+	}
+	return credentials, true, nil
+}
+
+// Verify checks the signature and the time, issuer and audience claims of the JWT,
+// returning its claims
+func (v *JWTVerifier) Verify(raw string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", errInvalidJWT)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", errInvalidJWT)
+	}
+	if err := v.verifySignature(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return claims, v.validateClaims(claims, now)
+}
+
+func decodeJWTSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: malformed segment", errInvalidJWT)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: malformed segment", errInvalidJWT)
+	}
+	return nil
+}
+
+// jwtHash returns the hash of the HS and RS algorithms
+func jwtHash(alg string) (crypto.Hash, bool) {
+	if len(alg) != 5 {
+		return 0, false
+	}
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, true
+	case "384":
+		return crypto.SHA384, true
+	case "512":
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+func (v *JWTVerifier) verifySignature(alg, kid string, signed, signature []byte) error {
+	hash, ok := jwtHash(alg)
+	if !ok {
+		return fmt.Errorf("%w: unsupported algorithm %q", errInvalidJWT, alg)
+	}
+
+	switch {
+	case strings.HasPrefix(alg, "HS") && v.secret != nil:
+		mac := hmac.New(hash.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("%w: bad signature", errInvalidJWT)
+		}
+		return nil
+	case strings.HasPrefix(alg, "RS"):
+		key := v.rsaKey(kid)
+		if key == nil {
+			return fmt.Errorf("%w: no key for key id %q", errInvalidJWT, kid)
+		}
+		digest := hash.New()
+		digest.Write(signed)
+		if err := rsa.VerifyPKCS1v15(key, hash, digest.Sum(nil), signature); err != nil {
+			return fmt.Errorf("%w: bad signature", errInvalidJWT)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: no key configured for %s", errInvalidJWT, alg)
+}
+
+// rsaKey returns the JWKS key of the key id, fetching the JWKS when it is not known yet,
+// else the key of JWT_PUBLIC_KEY_FILE
+func (v *JWTVerifier) rsaKey(kid string) *rsa.PublicKey {
+	if v.jwksURL == "" {
+		return v.publicKey
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key, exists := v.jwks[kid]
+	if !exists && time.Since(v.fetchedAt) >= jwksRefreshInterval {
+		v.fetchedAt = time.Now()
+		if keys, err := v.fetchJWKS(); err != nil {
+			slog.Error("Failed to fetch the JWKS", "error", err)
+		} else {
+			v.jwks = keys
+		}
+		key, exists = v.jwks[kid]
+	}
+	if !exists {
+		return v.publicKey
+	}
+	return key
+}
+
+// fetchJWKS loads the RSA keys of JWT_JWKS_URL by key id
+func (v *JWTVerifier) fetchJWKS() (map[string]*rsa.PublicKey, error) {
+	resp, err := v.client.Get(v.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+func (v *JWTVerifier) validateClaims(claims map[string]any, now time.Time) error {
+	if exp, ok := claims["exp"].(float64); ok && !now.Before(time.Unix(int64(exp), 0)) {
+		return fmt.Errorf("%w: expired", errInvalidJWT)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: not valid yet", errInvalidJWT)
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return fmt.Errorf("%w: unexpected issuer", errInvalidJWT)
+	}
+	if v.audience != "" && !jwtAudienceContains(claims["aud"], v.audience) {
+		return fmt.Errorf("%w: unexpected audience", errInvalidJWT)
+	}
+	return nil
+}
+
+// jwtAudienceContains matches the aud claim, a string or a list of them
+func jwtAudienceContains(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, value := range aud {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LooksLikeJWT reports whether the credential has the three segments of a JWT, to be
+// verified rather than taken as an opaque API key
+func LooksLikeJWT(raw string) bool {
+	return strings.Count(raw, ".") == 2
+}
+
+// VerifiesJWT reports whether a JWT key is configured, so JWT bearer tokens are verified
+func (s *Service) VerifiesJWT() bool {
+	return s.jwt != nil
+}
+
+// jwtTier returns the tier a JWT claims when it names a configured policy or tier
+func (s *Service) jwtTier(credentials jwtCredentials) string {
+	if credentials.tier == "" {
+		return ""
+	}
+	if _, exists := s.Config().Policies[credentials.tier]; !exists {
+		return ""
+	}
+	return credentials.tier
+}
+
+// tierKey scopes the key to the tier of its JWT, if any
+func tierKey(key, tier string) string {
+	if tier == "" {
+		return key
+	}
+	return tierKeyPrefix + tier + ":" + key
+}
+
+// cutTierKey splits a tier key into the tier and the key of the client
+func cutTierKey(key string) (tier, rest string, found bool) {
+	scoped, found := strings.CutPrefix(key, tierKeyPrefix)
+	if !found {
+		return "", key, false
+	}
+	return strings.Cut(scoped, ":")
+}
@@ -0,0 +1,161 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signJWT builds a JWT signed with the HMAC secret, or the RSA key when secret is nil
+func signJWT(t *testing.T, header, claims map[string]any, secret []byte, key *rsa.PrivateKey) string {
+	t.Helper()
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+
+	var signature []byte
+	if secret != nil {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	} else {
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestRateLimiterJWT(t *testing.T) {
+	secret := []byte("s3cret")
+	service := NewService(storage.Config{
+		IPRateLimit:        5,
+		IPBlockTime:        60,
+		TokenLimits:        map[string]int{"alice": 1},
+		TokenBlockTimes:    map[string]int{"alice": 60},
+		Policies:           map[string]storage.Policy{"gold": {Name: "gold", Limit: 3, BlockTime: 60}},
+		UnknownTokenPolicy: UnknownTokenReject,
+		JWTSecret:          string(secret),
+		JWTTierClaim:       "tier",
+		JWTIssuer:          "https://auth.example.com",
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(token string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	hs256 := map[string]any{"alg": "HS256", "typ": "JWT"}
+	claims := func(sub, tier string) map[string]any {
+		return map[string]any{"sub": sub, "tier": tier, "iss": "https://auth.example.com", "exp": time.Now().Add(time.Hour).Unix()}
+	}
+
+	alice := signJWT(t, hs256, claims("alice", ""), secret, nil)
+	assert.Equal(t, http.StatusOK, send(alice))
+	assert.Equal(t, http.StatusTooManyRequests, send(alice), "the subject gets the limits of its token")
+
+	bob := signJWT(t, hs256, claims("bob", "Gold"), secret, nil)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, send(bob), "the tier claim selects the policy")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, send(bob))
+	assert.Equal(t, http.StatusUnauthorized, send(signJWT(t, hs256, claims("carol", "platinum"), secret, nil)), "an unconfigured tier vouches for nothing")
+
+	assert.Equal(t, http.StatusUnauthorized, send(signJWT(t, hs256, claims("alice", ""), []byte("wrong"), nil)))
+	expired := claims("alice", "")
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	assert.Equal(t, http.StatusUnauthorized, send(signJWT(t, hs256, expired, secret, nil)))
+	foreign := claims("alice", "")
+	foreign["iss"] = "https://evil.example.com"
+	assert.Equal(t, http.StatusUnauthorized, send(signJWT(t, hs256, foreign, secret, nil)))
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice"}`)) + "."
+	assert.Equal(t, http.StatusUnauthorized, send(none))
+}
+
+func TestEvaluateJWT(t *testing.T) {
+	secret := []byte("s3cret")
+	service := NewService(storage.Config{
+		IPRateLimit:        5,
+		IPBlockTime:        60,
+		TokenLimits:        map[string]int{"alice": 1},
+		TokenBlockTimes:    map[string]int{"alice": 60},
+		Policies:           map[string]storage.Policy{"gold": {Name: "gold", Limit: 3, BlockTime: 60}},
+		UnknownTokenPolicy: UnknownTokenReject,
+		JWTSecret:          string(secret),
+		JWTTierClaim:       "tier",
+	}, storage.NewMemoryStorage())
+	hs256 := map[string]any{"alg": "HS256", "typ": "JWT"}
+	claims := func(sub, tier string) map[string]any {
+		return map[string]any{"sub": sub, "tier": tier, "exp": time.Now().Add(time.Hour).Unix()}
+	}
+
+	alice := signJWT(t, hs256, claims("alice", ""), secret, nil)
+	verdict := service.Evaluate("192.168.1.1", alice, "GRPC", "/svc/Method", 1)
+	assert.True(t, verdict.Allowed)
+	assert.Equal(t, "token:alice", verdict.Key, "the subject keys the call")
+	assert.False(t, service.Evaluate("192.168.1.1", alice, "GRPC", "/svc/Method", 1).Allowed)
+
+	bob := signJWT(t, hs256, claims("bob", "gold"), secret, nil)
+	verdict = service.EvaluateKey("token:"+bob, "GRPC", "/svc/Method", 1)
+	assert.True(t, verdict.Allowed, "the tier claim vouches for an unknown subject")
+	assert.Equal(t, "tier:gold:token:bob", verdict.Key)
+	assert.Equal(t, 3, verdict.Result.Limit)
+
+	forged := signJWT(t, hs256, claims("alice", ""), []byte("wrong"), nil)
+	assert.Equal(t, "invalid_jwt", service.Evaluate("192.168.1.1", forged, "GRPC", "/svc/Method", 1).Reason)
+	assert.Equal(t, "invalid_jwt", service.EvaluateKey("token:"+forged, "GRPC", "/svc/Method", 1).Reason)
+}
+
+func TestJWTVerifierJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	fetches := 0
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer jwks.Close()
+
+	verifier, err := NewJWTVerifier(storage.Config{JWTJWKSURL: jwks.URL, JWTAudience: "api"})
+	require.NoError(t, err)
+
+	token := signJWT(t, map[string]any{"alg": "RS256", "kid": "k1"}, map[string]any{"client_id": "svc-a", "aud": []string{"api", "web"}}, nil, key)
+	claims, err := verifier.Verify(token, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, "svc-a", claims["client_id"])
+
+	_, err = verifier.Verify(signJWT(t, map[string]any{"alg": "RS256", "kid": "k2"}, map[string]any{"sub": "x", "aud": "api"}, nil, key), time.Now())
+	assert.ErrorIs(t, err, errInvalidJWT)
+	assert.Equal(t, 1, fetches, "an unknown key id refetches the JWKS at most once a minute")
+
+	_, err = verifier.Verify(signJWT(t, map[string]any{"alg": "HS256"}, map[string]any{"sub": "x", "aud": "api"}, []byte("guess"), nil), time.Now())
+	assert.ErrorIs(t, err, errInvalidJWT, "HMAC is refused without JWT_SECRET")
+}
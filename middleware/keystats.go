@@ -0,0 +1,211 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	ratelimiter "rate-limiter"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rejectionsKeyPrefix = "rejections:"
+
+// KeyStats describes a key: the state of its current window and how many of its
+// requests were refused since it was first refused, within the retention
+type KeyStats struct {
+	Key          string    `json:"key"`
+	Count        int       `json:"count"`
+	Limit        int       `json:"limit"`
+	WindowStart  time.Time `json:"window_start,omitempty"`
+	BlockedUntil time.Time `json:"blocked_until,omitempty"`
+	Rejections   int       `json:"rejections"`
+}
+
+// RejectionCounter buffers refused requests per key, so storage sees one write per key
+// and flush instead of one per refusal. The counters live in storage under
+// "rejections:<key>" and expire after retention without a refusal.
+type RejectionCounter struct {
+	storage   ratelimiter.Storage
+	retention time.Duration
+
+	mu      sync.Mutex
+	pending map[string]int
+}
+
+// NewRejectionCounter returns nil when the retention is not positive
+func NewRejectionCounter(storage ratelimiter.Storage, retention time.Duration) *RejectionCounter {
+	if retention <= 0 {
+		return nil
+	}
+	return &RejectionCounter{
+		storage:   storage,
+		retention: retention,
+		pending:   make(map[string]int),
+	}
+}
+
+func (c *RejectionCounter) Record(key string) {
+	if c == nil || key == "" {
+		return
+	}
+	c.mu.Lock()
+	c.pending[key]++
+	c.mu.Unlock()
+}
+
+// Flush adds the buffered refusals to the stored counters; keys that fail stay buffered
+func (c *RejectionCounter) Flush(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[string]int)
+	c.mu.Unlock()
+
+	var firstErr error
+	now := time.Now()
+	for key, count := range pending {
+		err := c.add(ctx, rejectionsKeyPrefix+key, count, now)
+		if err == nil {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		c.mu.Lock()
+		c.pending[key] += count
+		c.mu.Unlock()
+	}
+
+	return firstErr
+}
+
+// add adds count to the counter in place on an atomic storage, else with a Get and a Set
+func (c *RejectionCounter) add(ctx context.Context, key string, count int, now time.Time) error {
+	if atomic, isAtomic := c.storage.(ratelimiter.AtomicStorage); isAtomic {
+		_, err := atomic.Consume(ctx, key, count, now, c.retention)
+		if !errors.Is(err, ratelimiter.ErrNotAtomic) {
+			return err
+		}
+	}
+
+	counter, err := c.storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if counter == nil {
+		counter = &ratelimiter.RateLimit{LastReset: now}
+	}
+	counter.Count += count
+	return c.storage.Set(ctx, key, counter, c.retention)
+}
+
+// RunRejectionFlush flushes the buffered refusals every interval
+func (s *Service) RunRejectionFlush(ctx context.Context, interval time.Duration) {
+	if s.rejections == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.rejections.Flush(ctx); err != nil {
+				slog.Error("Failed to flush rejection counters", "error", err)
+			}
+		}
+	}
+}
+
+// FlushRejections writes the buffered refusals, used on shutdown
+func (s *Service) FlushRejections(ctx context.Context) error {
+	return s.rejections.Flush(ctx)
+}
+
+// GetKeyStats returns the stats of a key, or nil when the key has neither a counter
+// nor refusals
+func (s *Service) GetKeyStats(ctx context.Context, key string) (*KeyStats, error) {
+	state, err := s.GetLimitState(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	rejections, err := s.adminStorage().Get(ctx, rejectionsKeyPrefix+s.adminKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if state == nil && rejections == nil {
+		return nil, nil
+	}
+
+	isToken := strings.HasPrefix(key, "token:")
+	stats := &KeyStats{Key: key, Limit: s.getLimit(key, isToken)}
+	if state != nil {
+		stats.Count = state.Count
+		stats.Limit = state.Limit
+		stats.WindowStart = state.LastReset
+		stats.BlockedUntil = state.BlockedUntil
+	}
+	if rejections != nil {
+		stats.Rejections = rejections.Count
+	}
+	return stats, nil
+}
+
+// TopRejected returns the stats of the n keys with the most refusals, most refused first
+func (s *Service) TopRejected(ctx context.Context, n int) ([]*KeyStats, error) {
+	keys, err := s.adminStorage().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type rejected struct {
+		key   string
+		count int
+	}
+	var counts []rejected
+	for _, key := range keys {
+		client, found := strings.CutPrefix(key, rejectionsKeyPrefix)
+		if !found {
+			continue
+		}
+		counter, err := s.adminStorage().Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		// a counter may expire between List and Get
+		if counter != nil {
+			counts = append(counts, rejected{key: client, count: counter.Count})
+		}
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].count != counts[j].count {
+			return counts[i].count > counts[j].count
+		}
+		return counts[i].key < counts[j].key
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+
+	top := make([]*KeyStats, 0, len(counts))
+	for _, c := range counts {
+		stats, err := s.GetKeyStats(ctx, c.key)
+		if err != nil {
+			return nil, err
+		}
+		if stats != nil {
+			top = append(top, stats)
+		}
+	}
+	return top, nil
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	ratelimiter "rate-limiter"
+	"sync/atomic"
+	"time"
+)
+
+// Elector holds a lease in storage so singleton background jobs (rollups, janitors)
+// run on exactly one instance. Every instance runs the same binary and competes for
+// the lease; a standby takes over once the leader stops renewing it.
+type Elector struct {
+	storage ratelimiter.Storage
+	name    string
+	holder  string
+	ttl     time.Duration
+
+	leader atomic.Bool
+}
+
+func NewElector(storage ratelimiter.Storage, name string, ttl time.Duration) *Elector {
+	hostname, _ := os.Hostname()
+
+	return &Elector{
+		storage: storage,
+		name:    name,
+		holder:  fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		ttl:     ttl,
+	}
+}
+
+// IsLeader reports whether this instance currently holds the lease. A nil elector
+// always leads, for single instance setups.
+func (e *Elector) IsLeader() bool {
+	return e == nil || e.leader.Load()
+}
+
+// Campaign tries to take or renew the lease once
+func (e *Elector) Campaign(ctx context.Context) {
+	acquired, err := e.storage.AcquireLease(ctx, e.name, e.holder, e.ttl)
+	if err != nil {
+		slog.Error("Failed to renew lease", "lease", e.name, "error", err)
+		acquired = false
+	}
+
+	if was := e.leader.Swap(acquired); was != acquired {
+		if acquired {
+			slog.Info("Became leader", "lease", e.name)
+		} else {
+			slog.Info("Lost leadership", "lease", e.name)
+		}
+	}
+}
+
+// Run renews the lease three times per TTL until the context is done
+func (e *Elector) Run(ctx context.Context) {
+	e.Campaign(ctx)
+
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.Campaign(ctx)
+		}
+	}
+}
+
+// Resign releases the lease on shutdown so a standby can take over without waiting
+// for it to expire
+func (e *Elector) Resign(ctx context.Context) error {
+	if !e.leader.Swap(false) {
+		return nil
+	}
+	return e.storage.ReleaseLease(ctx, e.name, e.holder)
+}
+
+// SetElector makes the singleton jobs of the service run only while it leads
+func (s *Service) SetElector(elector *Elector) {
+	s.elector = elector
+}
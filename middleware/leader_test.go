@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"context"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestElector(t *testing.T) {
+	ctx := context.Background()
+	memory := storage.NewMemoryStorage()
+
+	first := NewElector(memory, "jobs", 50*time.Millisecond)
+	second := NewElector(memory, "jobs", 50*time.Millisecond)
+
+	first.Campaign(ctx)
+	second.Campaign(ctx)
+	assert.True(t, first.IsLeader())
+	assert.False(t, second.IsLeader(), "only one instance leads")
+
+	first.Campaign(ctx)
+	assert.True(t, first.IsLeader(), "the leader renews its lease")
+
+	time.Sleep(60 * time.Millisecond)
+	second.Campaign(ctx)
+	assert.True(t, second.IsLeader(), "a standby takes over an expired lease")
+	first.Campaign(ctx)
+	assert.False(t, first.IsLeader())
+
+	require.NoError(t, second.Resign(ctx))
+	assert.False(t, second.IsLeader())
+	first.Campaign(ctx)
+	assert.True(t, first.IsLeader(), "a resigned lease is free immediately")
+
+	var single *Elector
+	assert.True(t, single.IsLeader())
+}
+
+func TestRunUsageRollupOnlyOnLeader(t *testing.T) {
+	memory := storage.NewMemoryStorage()
+	leader := NewElector(memory, "jobs", time.Minute)
+	standby := NewElector(memory, "jobs", time.Minute)
+	leader.Campaign(context.Background())
+	standby.Campaign(context.Background())
+
+	rolledUp := func(elector *Elector) bool {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		service := newUsageService(t, memory)
+		service.SetElector(elector)
+		service.usage.Record("10.0.0.1", time.Now().Add(-time.Minute))
+		require.NoError(t, service.FlushUsage(ctx))
+
+		go service.RunUsageRollup(ctx, 5*time.Millisecond)
+		time.Sleep(30 * time.Millisecond)
+
+		seconds, err := memory.ListUsage(ctx, "second", time.Now().Add(-time.Hour), time.Now())
+		require.NoError(t, err)
+		return len(seconds) == 0
+	}
+
+	assert.False(t, rolledUp(standby), "the standby leaves the raw usage alone")
+	assert.True(t, rolledUp(leader))
+}
@@ -0,0 +1,254 @@
+package middleware
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLimiter(t *testing.T) {
+	_, err := ratelimiter.NewLimiter()
+	assert.ErrorIs(t, err, ratelimiter.ErrNoStorage)
+
+	_, err = ratelimiter.NewLimiter(ratelimiter.WithStorage(storage.NewMemoryStorage()), ratelimiter.WithAlgorithm("leaky"))
+	assert.Error(t, err)
+
+	_, err = ratelimiter.NewLimiter(ratelimiter.WithStorage(storage.NewMemoryStorage()), ratelimiter.WithLimit(5, 0))
+	assert.Error(t, err)
+}
+
+func TestLimiterFixedWindow(t *testing.T) {
+	ctx := context.Background()
+	limiter, err := ratelimiter.NewLimiter(
+		ratelimiter.WithStorage(storage.NewMemoryStorage()),
+		ratelimiter.WithLimit(3, time.Minute),
+		ratelimiter.WithBlockTime(10*time.Second),
+	)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		result, err := limiter.Allow(ctx, "user:1")
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 2-i, result.Remaining)
+	}
+
+	result, err := limiter.Allow(ctx, "user:1")
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 10*time.Second, result.RetryAfter)
+
+	result, err = limiter.Allow(ctx, "user:1")
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.InDelta(t, 10*time.Second, result.RetryAfter, float64(time.Second))
+
+	result, err = limiter.Allow(ctx, "user:2")
+	require.NoError(t, err)
+	assert.True(t, result.Allowed, "keys are limited independently")
+}
+
+func TestLimiterTokenBucket(t *testing.T) {
+	ctx := context.Background()
+	limiter, err := ratelimiter.NewLimiter(
+		ratelimiter.WithStorage(storage.NewMemoryStorage()),
+		ratelimiter.WithAlgorithm(ratelimiter.AlgorithmTokenBucket),
+		ratelimiter.WithLimit(5, 100*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		result, err := limiter.Allow(ctx, "burst")
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+	}
+
+	result, err := limiter.Allow(ctx, "burst")
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Positive(t, result.RetryAfter)
+
+	time.Sleep(25 * time.Millisecond)
+
+	result, err = limiter.Allow(ctx, "burst")
+	require.NoError(t, err)
+	assert.True(t, result.Allowed, "tokens refill over the window")
+}
+
+func TestLimiterLeakyBucket(t *testing.T) {
+	ctx := context.Background()
+	limiter, err := ratelimiter.NewLimiter(
+		ratelimiter.WithStorage(storage.NewMemoryStorage()),
+		ratelimiter.WithAlgorithm(ratelimiter.AlgorithmLeakyBucket),
+		ratelimiter.WithLimit(10, time.Second),
+		ratelimiter.WithBucketSize(2),
+	)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		result, err := limiter.Allow(ctx, "smooth")
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 1-i, result.Remaining)
+	}
+
+	result, err := limiter.Allow(ctx, "smooth")
+	require.NoError(t, err)
+	assert.False(t, result.Allowed, "a burst cannot go past the bucket size, whatever the limit")
+	assert.Equal(t, 2, result.Limit)
+	assert.InDelta(t, 100*time.Millisecond, result.RetryAfter, float64(10*time.Millisecond))
+
+	time.Sleep(result.RetryAfter)
+
+	result, err = limiter.Allow(ctx, "smooth")
+	require.NoError(t, err)
+	assert.True(t, result.Allowed, "the bucket drains one request per interval")
+	result, err = limiter.Allow(ctx, "smooth")
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	result, err = limiter.AllowN(ctx, "heavy", 5)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed, "a request larger than the bucket fits an empty bucket")
+	result, err = limiter.Allow(ctx, "heavy")
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.InDelta(t, 400*time.Millisecond, result.RetryAfter, float64(10*time.Millisecond))
+}
+
+func TestServiceTokenAlgorithm(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:      10,
+		IPBlockTime:      60,
+		TokenLimits:      map[string]int{"smooth": 10, "bursty": 10},
+		TokenBlockTimes:  map[string]int{"smooth": 60, "bursty": 60},
+		TokenAlgorithms:  map[string]string{"smooth": ratelimiter.AlgorithmLeakyBucket},
+		TokenBucketSizes: map[string]int{"smooth": 3},
+	}, storage.NewMemoryStorage())
+
+	allowed := func(key string, isToken bool) int {
+		count := 0
+		for i := 0; i < 10; i++ {
+			check, err := service.checkRateLimit(context.Background(), key, isToken, 1)
+			require.NoError(t, err)
+			if check.Allowed {
+				count++
+			}
+		}
+		return count
+	}
+
+	assert.Equal(t, 3, allowed("token:smooth", true), "the leaky bucket tier bursts up to its bucket size")
+	assert.Equal(t, 10, allowed("token:bursty", true), "other tiers keep the fixed window")
+	assert.Equal(t, 10, allowed("10.0.0.1", false))
+
+	service.tokenConfigs = map[string]*ratelimiter.TokenConfig{
+		"bursty": {Name: "bursty", Limit: 10, BlockTime: 60, Algorithm: ratelimiter.AlgorithmLeakyBucket},
+	}
+	algorithm, bucketSize := service.getAlgorithm("token:bursty", true)
+	assert.Equal(t, ratelimiter.AlgorithmLeakyBucket, algorithm, "the runtime token config wins")
+	assert.Equal(t, 0, bucketSize)
+}
+
+func TestLimiterLimitFunc(t *testing.T) {
+	ctx := context.Background()
+	limiter, err := ratelimiter.NewLimiter(
+		ratelimiter.WithStorage(storage.NewMemoryStorage()),
+		ratelimiter.WithLimitFunc(func(key string) ratelimiter.Limits {
+			if key == "premium" {
+				return ratelimiter.Limits{Limit: 2, BlockTime: time.Second}
+			}
+			return ratelimiter.Limits{Limit: 1, BlockTime: time.Second}
+		}),
+	)
+	require.NoError(t, err)
+
+	allowed := func(key string) bool {
+		result, err := limiter.Allow(ctx, key)
+		require.NoError(t, err)
+		return result.Allowed
+	}
+
+	assert.True(t, allowed("premium"))
+	assert.True(t, allowed("premium"))
+	assert.False(t, allowed("premium"))
+
+	assert.True(t, allowed("free"))
+	assert.False(t, allowed("free"))
+}
+
+func TestLimiterZeroAndNegativeLimits(t *testing.T) {
+	ctx := context.Background()
+
+	for _, algorithm := range []string{ratelimiter.AlgorithmFixedWindow, ratelimiter.AlgorithmTokenBucket} {
+		t.Run(algorithm, func(t *testing.T) {
+			memory := storage.NewMemoryStorage()
+			limiter, err := ratelimiter.NewLimiter(ratelimiter.WithStorage(memory), ratelimiter.WithAlgorithm(algorithm))
+			require.NoError(t, err)
+
+			for i := 0; i < 3; i++ {
+				result, err := limiter.AllowLimits(ctx, "blocked", ratelimiter.Limits{Limit: 0, BlockTime: time.Minute})
+				require.NoError(t, err)
+				assert.False(t, result.Allowed)
+				assert.Zero(t, result.RetryAfter)
+
+				result, err = limiter.AllowLimits(ctx, "open", ratelimiter.Limits{Limit: -1})
+				require.NoError(t, err)
+				assert.True(t, result.Allowed)
+				assert.Equal(t, -1, result.Limit)
+			}
+
+			for _, key := range []string{"blocked", "open"} {
+				stored, err := memory.Get(ctx, key)
+				require.NoError(t, err)
+				assert.Nil(t, stored, "explicit limits never touch the storage")
+			}
+		})
+	}
+}
+
+func TestLimiterCost(t *testing.T) {
+	ctx := context.Background()
+
+	fixed, err := ratelimiter.NewLimiter(
+		ratelimiter.WithStorage(storage.NewMemoryStorage()),
+		ratelimiter.WithLimit(10, time.Minute),
+		ratelimiter.WithBlockTime(10*time.Second),
+	)
+	require.NoError(t, err)
+
+	result, err := fixed.AllowN(ctx, "export", 6)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 4, result.Remaining)
+
+	result, err = fixed.AllowN(ctx, "export", 5)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed, "a cost that does not fit is rejected whole")
+
+	bucket, err := ratelimiter.NewLimiter(
+		ratelimiter.WithStorage(storage.NewMemoryStorage()),
+		ratelimiter.WithAlgorithm(ratelimiter.AlgorithmTokenBucket),
+		ratelimiter.WithLimit(10, 10*time.Second),
+	)
+	require.NoError(t, err)
+
+	result, err = bucket.AllowN(ctx, "export", 8)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 2, result.Remaining)
+
+	result, err = bucket.AllowN(ctx, "export", 4)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.InDelta(t, 2*time.Second, result.RetryAfter, float64(100*time.Millisecond), "two more tokens are needed")
+
+	result, err = bucket.AllowN(ctx, "export", 2)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed, "a smaller cost still fits")
+}
@@ -0,0 +1,236 @@
+package middleware
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"rate-limiter/ratelimitertest"
+	"rate-limiter/storage"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTripStorage counts the checks and reads reaching a memory storage
+type roundTripStorage struct {
+	*storage.MemoryStorage
+
+	checks atomic.Int32
+	reads  atomic.Int32
+}
+
+func (r *roundTripStorage) AllowWindows(ctx context.Context, checks []ratelimiter.WindowCheck, cost int, now time.Time) (ratelimiter.Result, error) {
+	r.checks.Add(1)
+	return r.MemoryStorage.AllowWindows(ctx, checks, cost, now)
+}
+
+func (r *roundTripStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLimit, error) {
+	r.reads.Add(1)
+	return r.MemoryStorage.Get(ctx, key)
+}
+
+func TestLocalCacheStorageBlockedKeys(t *testing.T) {
+	inner := &roundTripStorage{MemoryStorage: storage.NewMemoryStorage()}
+	cache := storage.NewLocalCacheStorage(inner, 100*time.Millisecond, 5*time.Second, 100)
+	service := NewService(storage.Config{IPRateLimit: 2, IPBlockTime: 60}, cache)
+
+	for i := 0; i < 2; i++ {
+		allowed, err := service.CheckRateLimit("192.168.1.1", false, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+	}
+	allowed, err := service.CheckRateLimit("192.168.1.1", false, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, int32(3), inner.checks.Load())
+
+	for i := 0; i < 10; i++ {
+		check, err := service.checkRateLimit(context.Background(), "192.168.1.1", false, 1)
+		require.NoError(t, err)
+		assert.False(t, check.Allowed)
+		assert.Greater(t, check.RetryAfter, 59*time.Second)
+	}
+	assert.Equal(t, int32(3), inner.checks.Load(), "the block is answered locally")
+	assert.Equal(t, uint64(10), cache.Hits())
+
+	allowed, err = service.CheckRateLimit("192.168.1.2", false, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed, "other keys still reach the storage")
+
+	require.NoError(t, cache.Delete(context.Background(), "192.168.1.1"))
+	allowed, err = service.CheckRateLimit("192.168.1.1", false, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed, "a block lifted through the cache is forgotten")
+}
+
+func TestLocalCacheStorageBlockTTL(t *testing.T) {
+	inner := &roundTripStorage{MemoryStorage: storage.NewMemoryStorage()}
+	cache := storage.NewLocalCacheStorage(inner, 0, 20*time.Millisecond, 100)
+	limiter, err := ratelimiter.NewLimiter(ratelimiter.WithStorage(cache), ratelimiter.WithLimit(1, time.Second), ratelimiter.WithBlockTime(time.Minute))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	limiter.Allow(ctx, "user:42")
+	result, err := limiter.Allow(ctx, "user:42")
+	require.NoError(t, err)
+	require.False(t, result.Allowed)
+
+	// another instance lifts the block in the shared storage
+	require.NoError(t, inner.Delete(ctx, "user:42"))
+	result, err = limiter.Allow(ctx, "user:42")
+	require.NoError(t, err)
+	assert.False(t, result.Allowed, "the cached refusal holds until the block TTL")
+
+	time.Sleep(30 * time.Millisecond)
+	result, err = limiter.Allow(ctx, "user:42")
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+}
+
+func TestLocalCacheStorageCounters(t *testing.T) {
+	inner := &roundTripStorage{MemoryStorage: storage.NewMemoryStorage()}
+	cache := storage.NewLocalCacheStorage(inner, time.Minute, time.Minute, 2)
+	ctx := context.Background()
+
+	require.NoError(t, cache.Set(ctx, "a", &ratelimiter.RateLimit{Count: 1}, time.Minute))
+	for i := 0; i < 3; i++ {
+		counter, err := cache.Get(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, 1, counter.Count)
+	}
+	assert.Equal(t, int32(0), inner.reads.Load(), "the counter written through is read locally")
+
+	require.NoError(t, cache.Set(ctx, "b", &ratelimiter.RateLimit{Count: 2}, time.Minute))
+	require.NoError(t, cache.Set(ctx, "c", &ratelimiter.RateLimit{Count: 3}, time.Minute))
+	counter, err := cache.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, 1, counter.Count)
+	assert.Equal(t, int32(1), inner.reads.Load(), "the least recently used counter was evicted")
+
+	counter, err = cache.Get(ctx, "missing")
+	require.NoError(t, err)
+	assert.Nil(t, counter)
+}
+
+// receivedBroadcaster signals every event its subscriber handled
+type receivedBroadcaster struct {
+	ratelimiter.BlockBroadcaster
+
+	received chan ratelimiter.BlockEvent
+}
+
+func (b *receivedBroadcaster) SubscribeBlocks(ctx context.Context, handler func(ratelimiter.BlockEvent)) error {
+	return b.BlockBroadcaster.SubscribeBlocks(ctx, func(event ratelimiter.BlockEvent) {
+		handler(event)
+		b.received <- event
+	})
+}
+
+// waitForBlockEvent waits until the subscriber handled a block, or a lift
+func waitForBlockEvent(t *testing.T, received <-chan ratelimiter.BlockEvent, lift bool) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-received:
+			if event.BlockedUntil.IsZero() == lift {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no block event received, lift %v", lift)
+		}
+	}
+}
+
+func TestLocalCacheStorageShareBlocks(t *testing.T) {
+	backends := map[string]func(t *testing.T) []ratelimiter.Storage{
+		"memory": func(t *testing.T) []ratelimiter.Storage {
+			shared := storage.NewMemoryStorage()
+			return []ratelimiter.Storage{shared, shared}
+		},
+		"redis": func(t *testing.T) []ratelimiter.Storage { return ratelimitertest.RedisStorages(t, 2) },
+	}
+
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ip := "192.168.1.1-" + time.Now().Format(time.RFC3339Nano)
+			var services []*Service
+			var caches []*storage.LocalCacheStorage
+			var broadcasters []*receivedBroadcaster
+			for _, shared := range backend(t) {
+				cache := storage.NewLocalCacheStorage(shared, 0, time.Minute, 100)
+				broadcaster := &receivedBroadcaster{
+					BlockBroadcaster: shared.(ratelimiter.BlockBroadcaster),
+					received:         make(chan ratelimiter.BlockEvent, 16),
+				}
+				require.NoError(t, cache.ShareBlocks(ctx, broadcaster))
+				caches = append(caches, cache)
+				broadcasters = append(broadcasters, broadcaster)
+				services = append(services, NewService(storage.Config{IPRateLimit: 2, IPBlockTime: 60}, cache))
+			}
+
+			for i := 0; i < 3; i++ {
+				services[0].CheckRateLimit(ip, false, 1)
+			}
+			waitForBlockEvent(t, broadcasters[1].received, false)
+			for i := 0; i < 5; i++ {
+				check, err := services[1].checkRateLimit(context.Background(), ip, false, 1)
+				require.NoError(t, err)
+				assert.False(t, check.Allowed)
+				assert.Greater(t, check.RetryAfter, 59*time.Second)
+			}
+			assert.Equal(t, uint64(5), caches[1].Hits(), "the block found by the first instance is refused locally by the second")
+			assert.Zero(t, caches[1].Misses())
+
+			require.NoError(t, caches[0].Delete(context.Background(), ip))
+			waitForBlockEvent(t, broadcasters[1].received, true)
+			allowed, err := services[1].CheckRateLimit(ip, false, 1)
+			require.NoError(t, err)
+			assert.True(t, allowed, "the lift reaches the other instance")
+		})
+	}
+}
+
+// blockingBroadcaster never completes a publish until released
+type blockingBroadcaster struct {
+	*storage.MemoryStorage
+
+	release chan struct{}
+}
+
+func (b *blockingBroadcaster) PublishBlock(ctx context.Context, event ratelimiter.BlockEvent) error {
+	<-b.release
+	return b.MemoryStorage.PublishBlock(ctx, event)
+}
+
+func TestLocalCacheStorageShareBlocksDoesNotWait(t *testing.T) {
+	broadcaster := &blockingBroadcaster{MemoryStorage: storage.NewMemoryStorage(), release: make(chan struct{})}
+	defer close(broadcaster.release)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache := storage.NewLocalCacheStorage(broadcaster.MemoryStorage, 0, time.Minute, 100)
+	require.NoError(t, cache.ShareBlocks(ctx, broadcaster))
+	service := NewService(storage.Config{IPRateLimit: 1, IPBlockTime: 60}, cache)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 300; i++ {
+			service.CheckRateLimit("192.168.1."+strconv.Itoa(i), false, 1)
+			service.CheckRateLimit("192.168.1."+strconv.Itoa(i), false, 1)
+			cache.Delete(context.Background(), "192.168.1."+strconv.Itoa(i))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("refusals and deletes wait on a stuck broadcaster")
+	}
+}
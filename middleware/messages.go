@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"rate-limiter/storage"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message IDs of the error bodies that can be translated
+const (
+	MessageRateLimited   = storage.MessageRateLimited
+	MessageDenied        = storage.MessageDenied
+	MessageInvalidAPIKey = storage.MessageInvalidAPIKey
+	MessageQuotaExceeded = storage.MessageQuotaExceeded
+	MessageTokenRequired = storage.MessageTokenRequired
+)
+
+var defaultMessages = map[string]string{
+	MessageRateLimited:   "you have reached the maximum number of requests or actions allowed within a certain time frame",
+	MessageDenied:        "access denied",
+	MessageInvalidAPIKey: "invalid API key",
+	MessageQuotaExceeded: "you have used up your request quota for this period",
+	MessageTokenRequired: "an API key is required",
+}
+
+// Messages holds operator-provided translations of the error bodies, keyed by language
+// tag and message ID. Templates may use {retry_after} for the seconds until the client
+// can retry.
+type Messages struct {
+	translations map[string]map[string]string
+}
+
+// LoadMessages reads a JSON translations file such as
+// {"pt-BR": {"rate_limited": "limite atingido, tente em {retry_after}s"}}
+func LoadMessages(path string) (*Messages, error) {
+	translations, err := storage.LoadMessageTranslations(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Messages{translations: translations}, nil
+}
+
+// Format returns the message in the best language accepted by the request, falling
+// back to English
+func (m *Messages) Format(r *http.Request, id string, retryAfter time.Duration) string {
+	return m.FormatLanguage(r.Header.Get("Accept-Language"), id, retryAfter)
+}
+
+// FormatLanguage is Format for an Accept-Language value received outside of HTTP
+func (m *Messages) FormatLanguage(acceptLanguage, id string, retryAfter time.Duration) string {
+	template := defaultMessages[id]
+	if m != nil {
+		if translated, ok := m.lookup(acceptLanguage, id); ok {
+			template = translated
+		}
+	}
+
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	return strings.ReplaceAll(template, "{retry_after}", strconv.Itoa(seconds))
+}
+
+func (m *Messages) lookup(acceptLanguage, id string) (string, bool) {
+	for _, language := range parseAcceptLanguage(acceptLanguage) {
+		if message, ok := m.translations[language][id]; ok {
+			return message, true
+		}
+		if base, _, found := strings.Cut(language, "-"); found {
+			if message, ok := m.translations[base][id]; ok {
+				return message, true
+			}
+		}
+	}
+	return "", false
+}
+
+// parseAcceptLanguage returns the lowercased language tags by descending quality,
+// dropping the wildcard and tags with q=0
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag     string
+		quality float64
+	}
+
+	var languages []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		quality := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				quality = parsed
+			}
+		}
+		if quality > 0 {
+			languages = append(languages, weighted{tag: tag, quality: quality})
+		}
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+
+	tags := make([]string, len(languages))
+	for i, language := range languages {
+		tags[i] = language.tag
+	}
+	return tags
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeMessagesFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "messages.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	assert.Equal(t, []string{"pt-br", "en", "fr"}, parseAcceptLanguage("fr;q=0.5, pt-BR, en;q=0.8, *;q=0.1"))
+	assert.Equal(t, []string{"de"}, parseAcceptLanguage("es;q=0, de"))
+	assert.Empty(t, parseAcceptLanguage(""))
+}
+
+func TestMessagesFormat(t *testing.T) {
+	messages, err := LoadMessages(writeMessagesFile(t, `{
+		"pt": {"rate_limited": "limite atingido, tente novamente em {retry_after} segundos"},
+		"es-MX": {"denied": "acceso denegado"}
+	}`))
+	require.NoError(t, err)
+
+	request := func(acceptLanguage string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", acceptLanguage)
+		return req
+	}
+
+	assert.Equal(t, "limite atingido, tente novamente em 3 segundos",
+		messages.Format(request("pt-BR,en;q=0.5"), MessageRateLimited, 2500*time.Millisecond))
+	assert.Equal(t, "acceso denegado", messages.Format(request("es-MX"), MessageDenied, 0))
+	assert.Equal(t, "access denied", messages.Format(request("es-ES"), MessageDenied, 0), "no match for the region")
+	assert.Equal(t, defaultMessages[MessageInvalidAPIKey], messages.Format(request("pt"), MessageInvalidAPIKey, 0))
+
+	var missing *Messages
+	assert.Equal(t, defaultMessages[MessageRateLimited], missing.Format(request("pt"), MessageRateLimited, time.Second))
+}
+
+func TestLoadMessagesErrors(t *testing.T) {
+	_, err := LoadMessages(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+
+	_, err = LoadMessages(writeMessagesFile(t, `not json`))
+	assert.Error(t, err)
+
+	_, err = LoadMessages(writeMessagesFile(t, `{"pt": {"rate_limted": "typo"}}`))
+	assert.Error(t, err)
+}
+
+func TestRateLimiterLocalizedError(t *testing.T) {
+	config := storage.Config{
+		IPRateLimit:  1,
+		IPBlockTime:  60,
+		MessagesFile: writeMessagesFile(t, `{"pt": {"rate_limited": "tente em {retry_after}s"}}`),
+	}
+	service := NewService(config, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:1234"
+		req.Header.Set("Accept-Language", "pt-BR")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, send().Code)
+	w := send()
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	var response ErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "tente em 60s", response.Error)
+}
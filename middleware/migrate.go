@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"sort"
+)
+
+// MigrationReport lists what happened to each env-configured token during a migration
+type MigrationReport struct {
+	Imported  []string
+	Skipped   []string
+	Defaulted []string
+}
+
+// MigrateEnvTokens imports the TOKEN_* env configuration into the dynamic token store.
+// Tokens already in the store are skipped unless overwrite is set; tokens missing a
+// limit or block time and without a policy get the IP defaults and are reported as
+// defaulted.
+func (s *Service) MigrateEnvTokens(ctx context.Context, overwrite bool) (*MigrationReport, error) {
+	existing, err := s.storage.ListTokenConfigs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := make(map[string]struct{}, len(existing))
+	for _, tokenConfig := range existing {
+		stored[tokenConfig.Name] = struct{}{}
+	}
+
+	config := s.Config()
+
+	names := make(map[string]struct{})
+	for name := range config.TokenLimits {
+		names[name] = struct{}{}
+	}
+	for name := range config.TokenBlockTimes {
+		names[name] = struct{}{}
+	}
+	for name := range config.TokenPolicies {
+		names[name] = struct{}{}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	report := &MigrationReport{}
+	for _, name := range sorted {
+		if _, exists := stored[s.tokenName(name)]; exists && !overwrite {
+			report.Skipped = append(report.Skipped, name)
+			continue
+		}
+
+		limit, hasLimit := config.TokenLimits[name]
+		if !hasLimit {
+			limit = config.IPRateLimit
+		}
+		blockTime, hasBlockTime := config.TokenBlockTimes[name]
+		if !hasBlockTime {
+			blockTime = config.IPBlockTime
+		}
+
+		tokenConfig := &ratelimiter.TokenConfig{
+			Name:       name,
+			Limit:      limit,
+			BlockTime:  blockTime,
+			Algorithm:  config.TokenAlgorithms[name],
+			BucketSize: config.TokenBucketSizes[name],
+			Window:     config.TokenWindows[name],
+			Policy:     config.TokenPolicies[name],
+		}
+		if err := s.storage.SetTokenConfig(ctx, tokenConfig); err != nil {
+			return report, err
+		}
+
+		report.Imported = append(report.Imported, name)
+		if (!hasLimit || !hasBlockTime) && tokenConfig.Policy == "" {
+			report.Defaulted = append(report.Defaulted, name)
+		}
+	}
+
+	return report, s.SyncTokenConfigs(ctx)
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceMigrateEnvTokens(t *testing.T) {
+	testStorage := createTestStorage(t)
+	defer testStorage.Close()
+
+	ctx := context.Background()
+	service := NewService(storage.Config{
+		IPRateLimit:     10,
+		IPBlockTime:     300,
+		TokenLimits:     map[string]int{"MIGRATE_A": 100, "MIGRATE_B": 50},
+		TokenBlockTimes: map[string]int{"MIGRATE_A": 60},
+	}, testStorage)
+
+	existing := &ratelimiter.TokenConfig{Name: "MIGRATE_B", Limit: 75, BlockTime: 30}
+	require.NoError(t, testStorage.SetTokenConfig(ctx, existing))
+	defer func() {
+		testStorage.DeleteTokenConfig(ctx, "MIGRATE_A")
+		testStorage.DeleteTokenConfig(ctx, "MIGRATE_B")
+	}()
+
+	t.Run("skips_existing", func(t *testing.T) {
+		report, err := service.MigrateEnvTokens(ctx, false)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"MIGRATE_A"}, report.Imported)
+		assert.Equal(t, []string{"MIGRATE_B"}, report.Skipped)
+		assert.Empty(t, report.Defaulted)
+		assert.Equal(t, 75, service.getLimit("token:MIGRATE_B", true))
+		assert.Equal(t, 100, service.getLimit("token:MIGRATE_A", true))
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		report, err := service.MigrateEnvTokens(ctx, true)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"MIGRATE_A", "MIGRATE_B"}, report.Imported)
+		assert.Equal(t, []string{"MIGRATE_B"}, report.Defaulted)
+		assert.Equal(t, 50, service.getLimit("token:MIGRATE_B", true))
+		assert.Equal(t, 300, service.getBlockTime("token:MIGRATE_B", true))
+	})
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageMulti(t *testing.T) {
+	backends := map[string]func(t *testing.T) ratelimiter.Storage{
+		"memory": func(t *testing.T) ratelimiter.Storage { return storage.NewMemoryStorage() },
+		"redis":  func(t *testing.T) ratelimiter.Storage { return createTestStorage(t) },
+		"namespaced": func(t *testing.T) ratelimiter.Storage {
+			return storage.NewNamespacedStorage(storage.NewMemoryStorage(), "app")
+		},
+		"hashed": func(t *testing.T) ratelimiter.Storage {
+			return storage.NewHashedStorage(storage.NewMemoryStorage(), "secret")
+		},
+		"write_behind": func(t *testing.T) ratelimiter.Storage {
+			return storage.NewWriteBehindStorage(storage.NewMemoryStorage(), time.Hour, 0)
+		},
+		"local_cache": func(t *testing.T) ratelimiter.Storage {
+			return storage.NewLocalCacheStorage(storage.NewMemoryStorage(), time.Second, time.Second, 100)
+		},
+	}
+
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := backend(t)
+			defer s.Close()
+
+			prefix := "test:multi:" + time.Now().Format(time.RFC3339Nano) + ":"
+			keys := []string{prefix + "second", prefix + "missing", prefix + "day"}
+			defer func() {
+				for _, key := range keys {
+					s.Delete(ctx, key)
+				}
+			}()
+
+			now := time.Now().Truncate(time.Millisecond)
+			require.NoError(t, s.SetMulti(ctx, []ratelimiter.RateLimitEntry{
+				{Key: keys[0], RateLimit: &ratelimiter.RateLimit{Count: 3, LastReset: now}, Expiration: time.Minute},
+				{Key: keys[2], RateLimit: &ratelimiter.RateLimit{Count: 40, LastReset: now}, Expiration: time.Hour},
+			}))
+
+			rateLimits, err := s.GetMulti(ctx, keys)
+			require.NoError(t, err)
+			require.Len(t, rateLimits, 3)
+			assert.Equal(t, 3, rateLimits[0].Count)
+			assert.Nil(t, rateLimits[1], "a missing key reads as nil, in place")
+			assert.Equal(t, 40, rateLimits[2].Count)
+
+			single, err := s.Get(ctx, keys[2])
+			require.NoError(t, err)
+			assert.Equal(t, 40, single.Count, "SetMulti writes what Get reads")
+		})
+	}
+}
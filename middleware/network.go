@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"sort"
+	"time"
+)
+
+// networkKeyPrefix counts the requests of a whole network apart from its clients:
+// network:<cidr>
+const networkKeyPrefix = "network:"
+
+// NetworkLimiter resolves the NETWORK_LIMITS network of a client IP, the longest prefix
+// containing it, such as a partner network whose clients share a NAT
+type NetworkLimiter struct {
+	networks  []networkLimit
+	blockTime time.Duration
+}
+
+type networkLimit struct {
+	network *net.IPNet
+	limit   int
+}
+
+// NewNetworkLimiter returns nil when no network is limited
+func NewNetworkLimiter(config storage.Config) *NetworkLimiter {
+	if len(config.NetworkLimits) == 0 {
+		return nil
+	}
+
+	n := &NetworkLimiter{blockTime: time.Duration(config.NetworkBlockTime) * time.Second}
+	for cidr, limit := range config.NetworkLimits {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			n.networks = append(n.networks, networkLimit{network: network, limit: limit})
+		}
+	}
+	sort.Slice(n.networks, func(i, j int) bool {
+		a, _ := n.networks[i].network.Mask.Size()
+		b, _ := n.networks[j].network.Mask.Size()
+		return a > b
+	})
+	return n
+}
+
+// Match returns the most specific limited network containing the IP
+func (n *NetworkLimiter) Match(clientIP string) (*net.IPNet, int, bool) {
+	if n == nil {
+		return nil, 0, false
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return nil, 0, false
+	}
+	for _, network := range n.networks {
+		if network.network.Contains(ip) {
+			return network.network, network.limit, true
+		}
+	}
+	return nil, 0, false
+}
+
+// checkNetwork counts a request allowed by the limits of its client toward the window
+// of the client's network, refusing it with the result of that window when the
+// network is over its limit
+func (s *Service) checkNetwork(ctx context.Context, clientIP string, cost int, check *rateLimitCheck) error {
+	network, limit, found := s.networks.Match(clientIP)
+	if !found {
+		return nil
+	}
+
+	ctx, cancel := s.storageContext(ctx)
+	defer cancel()
+	limits := ratelimiter.Limits{Limit: limit, BlockTime: s.networks.blockTime}
+	result, err := s.rateLimiter(ratelimiter.AlgorithmFixedWindow).AllowLimitsN(ctx, networkKeyPrefix+network.String(), limits, max(cost, 1))
+	if err != nil {
+		return err
+	}
+	if !result.Allowed {
+		check.Result = result
+		check.NetworkLimited = true
+	}
+	return nil
+}
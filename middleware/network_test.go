@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadNetworkLimits(t *testing.T) {
+	unsetEnv(t, "NETWORK_BLOCK_TIME", "APPS", "HOST_TEMPLATES")
+	t.Setenv("IP_BLOCK_TIME", "30")
+	t.Setenv("NETWORK_LIMITS", "10.0.0.0/8=1000, 10.1.2.3/16=50")
+
+	appConfig, err := storage.LoadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"10.0.0.0/8": 1000, "10.1.0.0/16": 50}, appConfig.RateLimit.NetworkLimits)
+	assert.Equal(t, 30, appConfig.RateLimit.NetworkBlockTime, "networks are blocked like IPs by default")
+
+	t.Setenv("NETWORK_LIMITS", "10.0.0.0=1000")
+	_, err = storage.LoadConfig()
+	assert.ErrorContains(t, err, "NETWORK_LIMITS")
+}
+
+func TestRateLimiterNetworkLimits(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:      10,
+		IPBlockTime:      60,
+		NetworkLimits:    map[string]int{"10.0.0.0/8": 3, "10.1.0.0/16": 1},
+		NetworkBlockTime: 60,
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(remoteAddr string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr + ":12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("10.0.0.1"))
+	assert.Equal(t, http.StatusOK, send("10.0.0.2"))
+	assert.Equal(t, http.StatusOK, send("10.1.0.1"), "the /16 is counted apart from the /8")
+	assert.Equal(t, http.StatusTooManyRequests, send("10.1.0.2"), "the longest prefix wins")
+	assert.Equal(t, http.StatusOK, send("10.0.0.3"))
+	assert.Equal(t, http.StatusTooManyRequests, send("10.0.0.4"), "the clients of the network share its limit")
+	assert.Equal(t, http.StatusOK, send("192.168.1.1"), "other clients keep their own limit only")
+
+	verdict := service.Evaluate("10.0.0.5", "", "GET", "/", 1)
+	assert.False(t, verdict.Allowed)
+	assert.Equal(t, "network_limit", verdict.Reason)
+}
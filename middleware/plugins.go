@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"fmt"
+	"rate-limiter/storage"
+	"sort"
+	"sync"
+)
+
+// KeyExtractorFactory builds a key extractor kept outside this module from the config
+type KeyExtractorFactory func(config storage.Config) KeyExtractor
+
+// Hook observes every decision of the services. It runs on the request path, after the
+// decision is made, so it should hand slow work off to a goroutine of its own.
+type Hook interface {
+	OnDecision(decision Decision)
+}
+
+// HookFunc adapts a function to Hook
+type HookFunc func(decision Decision)
+
+func (f HookFunc) OnDecision(decision Decision) {
+	f(decision)
+}
+
+var (
+	pluginsMu           sync.RWMutex
+	keyExtractorPlugins = make(map[string]KeyExtractorFactory)
+	hookPlugins         = make(map[string]Hook)
+)
+
+// RegisterKeyExtractor makes an extractor available to API_KEY_EXTRACTORS under name. It
+// is meant to be called from the init function of the package implementing it, and
+// panics when the name is taken.
+func RegisterKeyExtractor(name string, factory KeyExtractorFactory) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	if factory == nil {
+		panic("middleware: RegisterKeyExtractor factory is nil")
+	}
+	if _, exists := keyExtractorPlugins[name]; exists {
+		panic(fmt.Sprintf("middleware: RegisterKeyExtractor called twice for %q", name))
+	}
+	keyExtractorPlugins[name] = factory
+}
+
+// RegisterHook adds a hook to every service created afterwards. Compiling the package
+// that registers it in is what turns it on. It panics when the name is taken.
+func RegisterHook(name string, hook Hook) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	if hook == nil {
+		panic("middleware: RegisterHook hook is nil")
+	}
+	if _, exists := hookPlugins[name]; exists {
+		panic(fmt.Sprintf("middleware: RegisterHook called twice for %q", name))
+	}
+	hookPlugins[name] = hook
+}
+
+// UnregisterKeyExtractor removes a registered extractor, so a test can register it again
+func UnregisterKeyExtractor(name string) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	delete(keyExtractorPlugins, name)
+}
+
+// UnregisterHook removes a registered hook from the services created afterwards; the
+// services that have it keep it
+func UnregisterHook(name string) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	delete(hookPlugins, name)
+}
+
+// KeyExtractors returns the names of the registered key extractors, sorted
+func KeyExtractors() []string {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+
+	names := make([]string, 0, len(keyExtractorPlugins))
+	for name := range keyExtractorPlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Hooks returns the names of the registered hooks, sorted
+func Hooks() []string {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+
+	names := make([]string, 0, len(hookPlugins))
+	for name := range hookPlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupKeyExtractor(name string) (KeyExtractorFactory, bool) {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+
+	factory, exists := keyExtractorPlugins[name]
+	return factory, exists
+}
+
+// registeredHooks returns the hooks in the order of their names
+func registeredHooks() []Hook {
+	names := Hooks()
+
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+
+	hooks := make([]Hook, 0, len(names))
+	for _, name := range names {
+		if hook, exists := hookPlugins[name]; exists {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
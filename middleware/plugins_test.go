@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// alternateStrategy allows every other request, counting them in the storage
+var alternateStrategy = ratelimiter.StrategyFunc(func(ctx context.Context, rateLimitStorage ratelimiter.Storage, key string, limits ratelimiter.Limits, window time.Duration, cost int, now time.Time) (ratelimiter.Result, error) {
+	state, err := rateLimitStorage.Get(ctx, key)
+	if err != nil {
+		return ratelimiter.Result{}, err
+	}
+	if state == nil {
+		state = &ratelimiter.RateLimit{LastReset: now}
+	}
+	state.Count += cost
+	if err := rateLimitStorage.Set(ctx, key, state, window); err != nil {
+		return ratelimiter.Result{}, err
+	}
+	return ratelimiter.Result{Allowed: state.Count%2 == 1, Limit: limits.Limit}, nil
+})
+
+// registerAlternateStrategy registers alternateStrategy as test_alternate until the
+// test ends
+func registerAlternateStrategy(t *testing.T) {
+	ratelimiter.RegisterStrategy("test_alternate", alternateStrategy)
+	t.Cleanup(func() { ratelimiter.UnregisterStrategy("test_alternate") })
+}
+
+func TestRegisteredStrategy(t *testing.T) {
+	registerAlternateStrategy(t)
+	assert.Contains(t, ratelimiter.Algorithms(), "test_alternate")
+	assert.True(t, ratelimiter.IsAlgorithm("test_alternate"))
+	assert.False(t, ratelimiter.IsAlgorithm("sliding_log"))
+
+	limiter, err := ratelimiter.NewLimiter(ratelimiter.WithStorage(storage.NewMemoryStorage()), ratelimiter.WithAlgorithm("test_alternate"))
+	require.NoError(t, err)
+	for i, expected := range []bool{true, false, true} {
+		result, err := limiter.Allow(context.Background(), "user:42")
+		require.NoError(t, err)
+		assert.Equal(t, expected, result.Allowed, "request %d", i)
+	}
+
+	_, err = ratelimiter.NewLimiter(ratelimiter.WithStorage(storage.NewMemoryStorage()), ratelimiter.WithAlgorithm("sliding_log"))
+	assert.Error(t, err)
+
+	config := storage.Config{IPRateLimit: 10, TokenAlgorithms: map[string]string{"gold": "test_alternate"}}
+	assert.NoError(t, config.Validate())
+	config.TokenAlgorithms["gold"] = "sliding_log"
+	assert.ErrorContains(t, config.Validate(), "test_alternate")
+
+	assert.Panics(t, func() { ratelimiter.RegisterStrategy("test_alternate", ratelimiter.StrategyFunc(nil)) })
+	assert.Panics(t, func() {
+		ratelimiter.RegisterStrategy(ratelimiter.AlgorithmTokenBucket, ratelimiter.StrategyFunc(func(context.Context, ratelimiter.Storage, string, ratelimiter.Limits, time.Duration, int, time.Time) (ratelimiter.Result, error) {
+			return ratelimiter.Result{}, nil
+		}))
+	}, "the built-in algorithms can't be replaced")
+}
+
+func TestRegisteredBackend(t *testing.T) {
+	storage.RegisterBackend("test_memory", func(config ratelimiter.StorageConfig) (ratelimiter.Storage, error) {
+		return storage.NewMemoryStorage(), nil
+	})
+	t.Cleanup(func() { storage.UnregisterBackend("test_memory") })
+
+	assert.Equal(t, []string{"redis", "etcd", "disk", "test_memory"}, storage.Backends())
+
+	rateLimitStorage, err := storage.NewStorage(ratelimiter.StorageConfig{Backend: "test_memory"})
+	require.NoError(t, err)
+	assert.IsType(t, &storage.MemoryStorage{}, rateLimitStorage)
+
+	_, err = storage.NewStorage(ratelimiter.StorageConfig{Backend: "consul"})
+	assert.ErrorContains(t, err, "test_memory")
+	assert.Panics(t, func() { storage.RegisterBackend(storage.BackendRedis, storage.NewStorage) })
+}
+
+func TestRegisteredExtractorAndHook(t *testing.T) {
+	registerAlternateStrategy(t)
+	RegisterKeyExtractor("test_tenant", func(config storage.Config) KeyExtractor {
+		return HeaderExtractor("X-Tenant")
+	})
+	t.Cleanup(func() { UnregisterKeyExtractor("test_tenant") })
+
+	// the reasons of the decisions about the tenant token
+	var mu sync.Mutex
+	var reasons []string
+	RegisterHook("test_recorder", HookFunc(func(decision Decision) {
+		if decision.Key != "token:plugin-tenant" {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		reasons = append(reasons, decision.Reason)
+	}))
+	t.Cleanup(func() { UnregisterHook("test_recorder") })
+
+	assert.Contains(t, KeyExtractors(), "test_tenant")
+	assert.Contains(t, Hooks(), "test_recorder")
+
+	service := NewService(storage.Config{
+		IPRateLimit:      10,
+		IPBlockTime:      60,
+		TokenLimits:      map[string]int{"plugin-tenant": 5},
+		TokenAlgorithms:  map[string]string{"plugin-tenant": "test_alternate"},
+		APIKeyHeaders:    []string{"API_KEY"},
+		APIKeyExtractors: []string{"missing", "test_tenant"},
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var codes []int
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		req.Header.Set("X-Tenant", "plugin-tenant")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		codes = append(codes, rec.Code)
+	}
+	assert.Equal(t, []int{http.StatusOK, http.StatusTooManyRequests}, codes, "the tenant token is limited by the registered strategy")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"within_limit", "rate_limit"}, reasons)
+	assert.Panics(t, func() { RegisterHook("test_recorder", HookFunc(func(Decision) {})) })
+}
+
+func TestUnregisterPlugins(t *testing.T) {
+	registerAlternateStrategy(t)
+	ratelimiter.UnregisterStrategy("test_alternate")
+	assert.False(t, ratelimiter.IsAlgorithm("test_alternate"))
+
+	RegisterHook("test_unregistered", HookFunc(func(Decision) {}))
+	UnregisterHook("test_unregistered")
+	assert.NotContains(t, Hooks(), "test_unregistered")
+	assert.NotPanics(t, func() { RegisterHook("test_unregistered", HookFunc(func(Decision) {})) }, "the name is free again")
+	UnregisterHook("test_unregistered")
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"net/http"
+	"path"
+	"rate-limiter/storage"
+	"slices"
+	"strings"
+)
+
+// policyKeyPrefix counts the requests of a route policy apart from the other requests
+// of the client: policy:<name>:<key>. Routes assigned the same policy share the counter.
+const policyKeyPrefix = "policy:"
+
+// policyKey scopes the key to the policy of the first POLICY_RULES rule the request
+// matches, or else of its ROUTE_POLICIES route, if any
+func (s *Service) policyKey(key, method, requestPath, keyType string) string {
+	if name, found := matchPolicyRule(s.Config().PolicyRules, method, requestPath, keyType); found {
+		return policyKeyPrefix + name + ":" + key
+	}
+	if name, found := s.routePolicies.match(method, requestPath); found {
+		return policyKeyPrefix + name + ":" + key
+	}
+	return key
+}
+
+// matchPolicyRule returns the policy of the first rule matching the request
+func matchPolicyRule(rules []storage.PolicyRule, method, requestPath, keyType string) (string, bool) {
+	for _, rule := range rules {
+		if rule.KeyType != "" && rule.KeyType != keyType {
+			continue
+		}
+		if len(rule.Methods) > 0 && !slices.Contains(rule.Methods, method) {
+			continue
+		}
+		if matched, _ := path.Match(rule.Path, requestPath); matched {
+			return rule.Policy, true
+		}
+	}
+	return "", false
+}
+
+// keyTypeOf returns the POLICY_RULES key type of a client
+func keyTypeOf(isToken, identified bool) string {
+	switch {
+	case identified:
+		return storage.KeyTypeIdentity
+	case isToken:
+		return storage.KeyTypeToken
+	default:
+		return storage.KeyTypeIP
+	}
+}
+
+// cutPolicyKey splits a route policy key into the policy name and the key of the client
+func cutPolicyKey(key string) (name, rest string, found bool) {
+	scoped, found := strings.CutPrefix(key, policyKeyPrefix)
+	if !found {
+		return "", key, false
+	}
+	return strings.Cut(scoped, ":")
+}
+
+// acquireConcurrency takes a concurrency slot for the request when its policy or
+// CONCURRENCY_LIMIT caps the requests in flight, returning whether it got one. The
+// release function is nil when the request is not capped.
+func (s *Service) acquireConcurrency(r *http.Request, key string, isToken bool) (func(), bool) {
+	if s.concurrency == nil {
+		return nil, true
+	}
+	if limit := s.policy(key, isToken).Concurrency; limit > 0 {
+		return s.concurrency.AcquireLimit(key, limit)
+	}
+	if s.concurrency.Applies(r) {
+		return s.concurrency.Acquire(key)
+	}
+	return nil, true
+}
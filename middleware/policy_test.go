@@ -0,0 +1,303 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadPolicies(t *testing.T) {
+	unsetEnv(t, "IP_RATE_LIMIT", "IP_BLOCK_TIME", "APPS", "HOST_TEMPLATES")
+	t.Setenv("POLICIES", "strict,premium")
+	t.Setenv("POLICY_STRICT_LIMIT", "2")
+	t.Setenv("POLICY_STRICT_BLOCK_TIME", "900")
+	t.Setenv("POLICY_PREMIUM_LIMIT", "1000")
+	t.Setenv("POLICY_PREMIUM_ALGORITHM", "leaky_bucket")
+	t.Setenv("POLICY_PREMIUM_BURST", "50")
+	t.Setenv("POLICY_PREMIUM_CONCURRENCY", "8")
+	t.Setenv("POLICY_PREMIUM_BANDWIDTH", "1048576")
+	t.Setenv("IP_POLICY", "strict")
+	t.Setenv("TOKEN_gold_POLICY", "premium")
+	t.Setenv("ROUTE_POLICIES", "POST /login=strict,/export=premium")
+
+	appConfig, err := storage.LoadConfig()
+	require.NoError(t, err)
+	config := appConfig.RateLimit
+
+	assert.Equal(t, storage.Policy{Name: "strict", Limit: 2, BlockTime: 900, Algorithm: "fixed_window"}, config.Policies["strict"])
+	assert.Equal(t, storage.Policy{
+		Name: "premium", Limit: 1000, BlockTime: 300, Algorithm: "leaky_bucket",
+		Burst: 50, Concurrency: 8, Bandwidth: 1048576,
+	}, config.Policies["premium"], "unset settings take the IP block time")
+	assert.Equal(t, "strict", config.DefaultPolicy().Name)
+	assert.Equal(t, "premium", config.TokenPolicy("gold").Name)
+	assert.Equal(t, map[string]string{"POST /login": "strict", "/export": "premium"}, config.RoutePolicies)
+
+	t.Setenv("TOKEN_gold_POLICY", "missing")
+	_, err = storage.LoadConfig()
+	assert.ErrorContains(t, err, "TOKEN_gold_POLICY")
+}
+
+func TestLoadTiers(t *testing.T) {
+	unsetEnv(t, "IP_RATE_LIMIT", "IP_BLOCK_TIME", "APPS", "HOST_TEMPLATES", "POLICIES")
+	t.Setenv("IP_DAILY_QUOTA", "100")
+	t.Setenv("TIER_FREE_LIMIT", "5")
+	t.Setenv("TIER_PRO_LIMIT", "100")
+	t.Setenv("TIER_PRO_WINDOW", "60")
+	t.Setenv("TIER_PRO_BLOCK_TIME", "30")
+	t.Setenv("TIER_PRO_MONTHLY_QUOTA", "5000")
+	t.Setenv("TOKEN_ABC123_TIER", "PRO")
+	t.Setenv("TOKEN_DEF456_TIER", "free")
+	t.Setenv("TOKEN_DEF456_DAILY_QUOTA", "50")
+	t.Setenv("TOKEN_GHI789_TIER", "pro")
+	t.Setenv("TOKEN_GHI789_POLICY", "free")
+
+	appConfig, err := storage.LoadConfig()
+	require.NoError(t, err)
+	config := appConfig.RateLimit
+
+	assert.Equal(t, storage.Policy{
+		Name: "pro", Limit: 100, BlockTime: 30, Window: 60, Algorithm: "fixed_window",
+		DailyQuota: 100, MonthlyQuota: 5000,
+	}, config.Policies["pro"], "unset settings take the IP limits and quotas")
+	assert.Equal(t, "pro", config.TokenPolicy("ABC123").Name)
+	assert.Equal(t, 5, config.TokenPolicy("DEF456").Limit)
+	assert.Equal(t, 50, config.TokenPolicy("DEF456").DailyQuota, "the token quota overrides its tier")
+	assert.Equal(t, "free", config.TokenPolicy("GHI789").Name, "the policy wins over the tier")
+
+	t.Setenv("TOKEN_ABC123_TIER", "gold")
+	_, err = storage.LoadConfig()
+	assert.ErrorContains(t, err, "TOKEN_ABC123_POLICY or _TIER")
+}
+
+func TestLoadTokenWindow(t *testing.T) {
+	unsetEnv(t, "IP_RATE_LIMIT", "IP_BLOCK_TIME", "APPS", "HOST_TEMPLATES", "POLICIES")
+	t.Setenv("TIER_PRO_LIMIT", "100")
+	t.Setenv("TIER_PRO_WINDOW", "60")
+	t.Setenv("TOKEN_ABC123_TIER", "pro")
+	t.Setenv("TOKEN_ABC123_WINDOW", "3600")
+	t.Setenv("TOKEN_ABC123_BURST", "20")
+
+	appConfig, err := storage.LoadConfig()
+	require.NoError(t, err)
+	policy := appConfig.RateLimit.TokenPolicy("ABC123")
+	assert.Equal(t, 100, policy.Limit, "the tier still sets the limit")
+	assert.Equal(t, 3600, policy.Window, "the token window overrides its tier")
+	assert.Equal(t, 20, policy.Burst)
+
+	service := NewService(appConfig.RateLimit, storage.NewMemoryStorage())
+	assert.Equal(t, time.Hour, service.getWindow("token:ABC123", true))
+
+	ctx := context.Background()
+	require.NoError(t, service.storage.SetTokenConfig(ctx, &ratelimiter.TokenConfig{Name: "ABC123", Limit: 10, Window: 86400}))
+	require.NoError(t, service.SyncTokenConfigs(ctx))
+	assert.Equal(t, 24*time.Hour, service.getWindow("token:ABC123", true), "the runtime token config wins")
+
+	t.Setenv("TOKEN_ABC123_WINDOW", "-1")
+	_, err = storage.LoadConfig()
+	assert.ErrorContains(t, err, "TOKEN_ABC123_WINDOW")
+}
+
+func TestServiceTier(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:   10,
+		IPBlockTime:   60,
+		Policies:      map[string]storage.Policy{"pro": {Name: "pro", Limit: 2, BlockTime: 60, Window: 60, DailyQuota: 3}},
+		TokenPolicies: map[string]string{"ABC123": "pro"},
+	}, storage.NewMemoryStorage())
+
+	assert.Equal(t, 2, service.getLimit("token:ABC123", true))
+	assert.Equal(t, time.Minute, service.getWindow("token:ABC123", true))
+	assert.Equal(t, time.Duration(0), service.getWindow("10.0.0.1", false))
+
+	quotas := service.quotas("token:ABC123", true, time.Now())
+	require.Len(t, quotas, 1)
+	assert.Equal(t, 3, quotas[0].limit, "the quota comes from the tier")
+	assert.Empty(t, service.quotas("10.0.0.1", false, time.Now()))
+
+	check, err := service.checkRateLimit(context.Background(), "token:ABC123", true, 1)
+	require.NoError(t, err)
+	assert.Greater(t, time.Until(check.Result.ResetAt), 50*time.Second, "the window of the tier is a minute")
+}
+
+func TestServicePolicy(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit: 10,
+		IPBlockTime: 60,
+		Policies: map[string]storage.Policy{
+			"premium": {Name: "premium", Limit: 1000, BlockTime: 5, Algorithm: ratelimiter.AlgorithmLeakyBucket, Burst: 20},
+			"strict":  {Name: "strict", Limit: 2, BlockTime: 900, Algorithm: ratelimiter.AlgorithmFixedWindow},
+		},
+		TokenPolicies: map[string]string{"gold": "premium", "silver": "premium"},
+		TokenLimits:   map[string]int{"silver": 500},
+	}, storage.NewMemoryStorage())
+
+	assert.Equal(t, 10, service.getLimit("10.0.0.1", false), "IPs get the default policy")
+	assert.Equal(t, 1000, service.getLimit("token:gold", true))
+	algorithm, bucketSize := service.getAlgorithm("token:gold", true)
+	assert.Equal(t, ratelimiter.AlgorithmLeakyBucket, algorithm)
+	assert.Equal(t, 20, bucketSize)
+
+	assert.Equal(t, 500, service.getLimit("token:silver", true), "the token limit overrides its policy")
+	assert.Equal(t, 5, service.getBlockTime("token:silver", true))
+
+	assert.Equal(t, 2, service.getLimit("policy:strict:token:gold", true), "the route policy wins over the token policy")
+	assert.Equal(t, 900, service.getBlockTime("policy:strict:10.0.0.1", false))
+
+	ctx := context.Background()
+	require.NoError(t, service.storage.SetTokenConfig(ctx, &ratelimiter.TokenConfig{Name: "bronze", Limit: 1, Policy: "strict"}))
+	require.NoError(t, service.SyncTokenConfigs(ctx))
+	assert.Equal(t, 2, service.getLimit("token:bronze", true), "a runtime token config can name a policy")
+}
+
+func TestRateLimiterRoutePolicy(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:   100,
+		IPBlockTime:   60,
+		Policies:      map[string]storage.Policy{"strict": {Name: "strict", Limit: 2, BlockTime: 60}},
+		RoutePolicies: map[string]string{"POST /login": "strict", "/signup": "strict"},
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("POST", "/login"))
+	assert.Equal(t, http.StatusOK, send("GET", "/signup/confirm"))
+	assert.Equal(t, http.StatusTooManyRequests, send("POST", "/login"), "routes of a policy share its counter")
+	assert.Equal(t, http.StatusOK, send("GET", "/login"), "the policy only covers POST /login")
+	assert.Equal(t, http.StatusOK, send("GET", "/users"), "other requests of the client keep their own limit")
+	assert.Equal(t, "192.168.1.1", quotaKey("policy:strict:192.168.1.1"))
+}
+
+func TestLoadPolicyRules(t *testing.T) {
+	unsetEnv(t, "IP_POLICY", "APPS", "HOST_TEMPLATES")
+	t.Setenv("POLICIES", "uploads,anonymous")
+	t.Setenv("POLICY_RULES", "post|PUT /api/*/upload Token=uploads,/api/* ip=anonymous")
+
+	appConfig, err := storage.LoadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []storage.PolicyRule{
+		{Path: "/api/*/upload", Methods: []string{"POST", "PUT"}, KeyType: "token", Policy: "uploads"},
+		{Path: "/api/*", KeyType: "ip", Policy: "anonymous"},
+	}, appConfig.RateLimit.PolicyRules, "the rules keep their order")
+	assert.Equal(t, "POST|PUT /api/*/upload token=uploads", appConfig.RateLimit.PolicyRules[0].String())
+
+	for _, invalid := range []string{"/api/* robot=uploads", "/api/*=missing", "GET=uploads", "/api/[=uploads", "GET /a ip extra=uploads"} {
+		t.Setenv("POLICY_RULES", invalid)
+		_, err = storage.LoadConfig()
+		assert.ErrorContains(t, err, "POLICY_RULES", invalid)
+	}
+}
+
+func TestServicePolicyRules(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit: 100,
+		IPBlockTime: 60,
+		TokenLimits: map[string]int{"gold": 100},
+		Policies: map[string]storage.Policy{
+			"uploads":   {Name: "uploads", Limit: 1, BlockTime: 60, Algorithm: ratelimiter.AlgorithmFixedWindow},
+			"anonymous": {Name: "anonymous", Limit: 5, BlockTime: 60, Algorithm: ratelimiter.AlgorithmLeakyBucket, Burst: 2},
+			"strict":    {Name: "strict", Limit: 2, BlockTime: 60},
+		},
+		PolicyRules: []storage.PolicyRule{
+			{Path: "/api/*/upload", Methods: []string{"POST", "PUT"}, KeyType: storage.KeyTypeToken, Policy: "uploads"},
+			{Path: "/api/*", KeyType: storage.KeyTypeIP, Policy: "anonymous"},
+		},
+		RoutePolicies: map[string]string{"/api": "strict"},
+	}, storage.NewMemoryStorage())
+
+	assert.Equal(t, "policy:uploads:token:gold", service.Evaluate("10.0.0.1", "gold", "POST", "/api/v1/upload", 1).Key)
+	assert.False(t, service.Evaluate("10.0.0.1", "gold", "PUT", "/api/v2/upload", 1).Allowed, "the uploads of a token share the policy counter")
+	assert.Equal(t, "policy:strict:token:gold", service.Evaluate("10.0.0.1", "gold", "GET", "/api/v1/upload", 1).Key, "no rule matches, the route policy applies")
+	assert.Equal(t, "policy:anonymous:10.0.0.1", service.Evaluate("10.0.0.1", "", "POST", "/api/v1", 1).Key, "the first matching rule wins")
+	assert.Equal(t, "policy:strict:10.0.0.1", service.Evaluate("10.0.0.1", "", "POST", "/api/v1/upload", 1).Key, "globs don't match across slashes")
+
+	algorithm, burst := service.getAlgorithm("policy:anonymous:10.0.0.1", false)
+	assert.Equal(t, ratelimiter.AlgorithmLeakyBucket, algorithm)
+	assert.Equal(t, 2, burst)
+}
+
+func TestRateLimiterPolicyConcurrency(t *testing.T) {
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	service := NewService(storage.Config{
+		IPRateLimit:   100,
+		IPBlockTime:   60,
+		Policies:      map[string]storage.Policy{"reports": {Name: "reports", Limit: 100, BlockTime: 60, Concurrency: 1}},
+		RoutePolicies: map[string]string{"/reports": "reports"},
+	}, storage.NewMemoryStorage())
+	require.NotNil(t, service.concurrency, "a policy with a concurrency cap enables the limiter")
+
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/reports") {
+			started <- struct{}{}
+			<-finish
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, http.StatusOK, send("/reports/1"))
+	}()
+	<-started
+
+	assert.Equal(t, http.StatusTooManyRequests, send("/reports/2"), "the policy allows one report at a time")
+	assert.Equal(t, http.StatusOK, send("/users"), "requests outside the policy are not capped")
+
+	close(finish)
+	wg.Wait()
+	assert.Equal(t, 0, service.concurrency.InFlight("policy:reports:192.168.1.1"))
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	assert.Nil(t, NewBandwidthLimiter(storage.Config{}))
+
+	limiter := NewBandwidthLimiter(storage.Config{Policies: map[string]storage.Policy{"slow": {Bandwidth: 1000}}})
+	require.NotNil(t, limiter)
+
+	w := httptest.NewRecorder()
+	paced, release := limiter.Wrap(w, httptest.NewRequest("GET", "/", nil), "10.0.0.1", 1000)
+	start := time.Now()
+	n, err := paced.Write(make([]byte, 1500))
+	release()
+	require.NoError(t, err)
+	assert.Equal(t, 1500, n)
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond, "the first second of bytes is a burst, the rest waits")
+	assert.Equal(t, 1500, w.Body.Len())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	paced, release = limiter.Wrap(httptest.NewRecorder(), req, "10.0.0.1", 1000)
+	defer release()
+	cancel()
+	n, err = paced.Write(make([]byte, 1000))
+	assert.ErrorIs(t, err, context.Canceled, "the bucket of the key is still empty")
+	assert.Equal(t, 0, n)
+}
@@ -0,0 +1,229 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	ratelimiter "rate-limiter"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quota periods, counted on the calendar of QUOTA_TIMEZONE
+const (
+	QuotaPeriodDay   = "day"
+	QuotaPeriodMonth = "month"
+)
+
+// quotaKeyPrefix keeps the quota counters apart from the window counters in the storage
+const quotaKeyPrefix = "quota:"
+
+// QuotaStatus is the state of a daily or monthly quota after a check
+type QuotaStatus struct {
+	Period    string
+	Limit     int
+	Remaining int
+	ResetAt   time.Time
+}
+
+// quota is a long-horizon limit applied to a key, with the bounds of its current period
+// and what was used of it so far
+type quota struct {
+	period string
+	limit  int
+	start  time.Time
+	end    time.Time
+	used   int
+}
+
+func (q *quota) storageKey(key string) string {
+	layout := "2006-01-02"
+	if q.period == QuotaPeriodMonth {
+		layout = "2006-01"
+	}
+	return quotaKeyPrefix + q.period + ":" + q.start.Format(layout) + ":" + key
+}
+
+func (q *quota) status() QuotaStatus {
+	return QuotaStatus{Period: q.period, Limit: q.limit, Remaining: max(q.limit-q.used, 0), ResetAt: q.end}
+}
+
+// quotas returns the daily and monthly quotas of the key for the periods containing now,
+// those of the policy of its client: the IP quotas unless a policy, a tier or the token
+// sets its own, like the window limits. The health check pool has none. A quota of 0 is
+// not enforced.
+func (s *Service) quotas(key string, isToken bool, now time.Time) []*quota {
+	if strings.HasPrefix(key, healthCheckKeyPrefix) {
+		return nil
+	}
+
+	policy := s.policy(quotaKey(key), isToken)
+	daily, monthly := policy.DailyQuota, policy.MonthlyQuota
+
+	location := s.quotaLocation
+	if location == nil {
+		location = time.UTC
+	}
+	local := now.In(location)
+
+	var quotas []*quota
+	if daily > 0 {
+		start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+		quotas = append(quotas, &quota{period: QuotaPeriodDay, limit: daily, start: start, end: start.AddDate(0, 0, 1)})
+	}
+	if monthly > 0 {
+		start := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, location)
+		quotas = append(quotas, &quota{period: QuotaPeriodMonth, limit: monthly, start: start, end: start.AddDate(0, 1, 0)})
+	}
+	return quotas
+}
+
+// quotaKey is the key the quotas are counted under: WebSocket upgrades and the requests
+// of route policies share the quotas of their client, and every IP of a token keyed by
+// IP those of the token
+func quotaKey(key string) string {
+	return tokenKey(clientKey(key))
+}
+
+// clientKey is the key of the client a request is counted for, without the WebSocket
+// and route policy prefixes
+func clientKey(key string) string {
+	_, key, _ = cutPolicyKey(strings.TrimPrefix(key, webSocketKeyPrefix))
+	return key
+}
+
+// readQuotas loads what was used of each quota in one call, reporting whether the cost
+// still fits in all of them
+func (s *Service) readQuotas(ctx context.Context, key string, quotas []*quota, cost int) (bool, error) {
+	keys := make([]string, len(quotas))
+	for i, q := range quotas {
+		keys[i] = q.storageKey(key)
+	}
+	counters, err := s.storage.GetMulti(ctx, keys)
+	if err != nil {
+		return false, err
+	}
+
+	fits := true
+	for i, q := range quotas {
+		if counters[i] != nil {
+			q.used = counters[i].Count
+		}
+		if q.used+cost > q.limit {
+			fits = false
+		}
+	}
+	return fits, nil
+}
+
+// consumeQuotas adds the cost to every quota. The counters expire when their period ends.
+// On an atomic storage the cost is added in place, so concurrent requests never
+// overwrite each other's consumption.
+func (s *Service) consumeQuotas(ctx context.Context, key string, quotas []*quota, cost int, now time.Time) error {
+	atomic, isAtomic := s.storage.(ratelimiter.AtomicStorage)
+	var entries []ratelimiter.RateLimitEntry
+	for _, q := range quotas {
+		if isAtomic {
+			used, err := atomic.Consume(ctx, q.storageKey(key), cost, q.start, q.end.Sub(now))
+			if err == nil {
+				q.used = used
+				continue
+			}
+			if !errors.Is(err, ratelimiter.ErrNotAtomic) {
+				return err
+			}
+		}
+
+		q.used += cost
+		entries = append(entries, ratelimiter.RateLimitEntry{
+			Key:        q.storageKey(key),
+			RateLimit:  &ratelimiter.RateLimit{Count: q.used, LastReset: q.start},
+			Expiration: q.end.Sub(now),
+		})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return s.storage.SetMulti(ctx, entries)
+}
+
+// refundQuotas takes the cost back from every quota, in place on an atomic storage
+func (s *Service) refundQuotas(ctx context.Context, key string, quotas []*quota, cost int, at, now time.Time) error {
+	atomic, isAtomic := s.storage.(ratelimiter.AtomicStorage)
+	var pending []*quota
+	for _, q := range quotas {
+		if isAtomic {
+			err := atomic.Refund(ctx, q.storageKey(key), cost, at)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, ratelimiter.ErrNotAtomic) {
+				return err
+			}
+		}
+		pending = append(pending, q)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	keys := make([]string, len(pending))
+	for i, q := range pending {
+		keys[i] = q.storageKey(key)
+	}
+	counters, err := s.storage.GetMulti(ctx, keys)
+	if err != nil {
+		return err
+	}
+	var entries []ratelimiter.RateLimitEntry
+	for i, q := range pending {
+		if counters[i] == nil {
+			continue
+		}
+		counters[i].Count = max(counters[i].Count-cost, 0)
+		entries = append(entries, ratelimiter.RateLimitEntry{Key: keys[i], RateLimit: counters[i], Expiration: q.end.Sub(now)})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return s.storage.SetMulti(ctx, entries)
+}
+
+// quotaRetryAfter is how long until every exhausted quota has reset
+func quotaRetryAfter(quotas []*quota, cost int, now time.Time) time.Duration {
+	var retryAfter time.Duration
+	for _, q := range quotas {
+		if q.used+cost > q.limit {
+			retryAfter = max(retryAfter, q.end.Sub(now))
+		}
+	}
+	return retryAfter
+}
+
+func quotaStatuses(quotas []*quota) []QuotaStatus {
+	if len(quotas) == 0 {
+		return nil
+	}
+	statuses := make([]QuotaStatus, 0, len(quotas))
+	for _, q := range quotas {
+		statuses = append(statuses, q.status())
+	}
+	return statuses
+}
+
+var quotaHeaderNames = map[string]string{
+	QuotaPeriodDay:   "Daily",
+	QuotaPeriodMonth: "Monthly",
+}
+
+// setQuotaHeaders exposes each quota as X-Quota-<Daily|Monthly>-Limit, -Remaining and
+// -Reset, the Unix time when the period rolls over
+func setQuotaHeaders(w http.ResponseWriter, quotas []QuotaStatus) {
+	for _, q := range quotas {
+		prefix := "X-Quota-" + quotaHeaderNames[q.Period] + "-"
+		w.Header().Set(prefix+"Limit", strconv.Itoa(q.Limit))
+		w.Header().Set(prefix+"Remaining", strconv.Itoa(q.Remaining))
+		w.Header().Set(prefix+"Reset", strconv.FormatInt(q.ResetAt.Unix(), 10))
+	}
+}
@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterDailyQuota(t *testing.T) {
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	service := NewService(storage.Config{
+		IPRateLimit:        100,
+		IPBlockTime:        60,
+		IPDailyQuota:       1000,
+		TokenLimits:        map[string]int{"gold": 100},
+		TokenDailyQuotas:   map[string]int{"gold": 2},
+		TokenMonthlyQuotas: map[string]int{"gold": 50},
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(testHandler)
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		req.Header.Set("API_KEY", "gold")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("X-Quota-Daily-Limit"))
+	assert.Equal(t, "1", w.Header().Get("X-Quota-Daily-Remaining"))
+	assert.Equal(t, "49", w.Header().Get("X-Quota-Monthly-Remaining"))
+
+	tomorrow := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	assert.Equal(t, strconv.FormatInt(tomorrow.Unix(), 10), w.Header().Get("X-Quota-Daily-Reset"))
+
+	assert.Equal(t, http.StatusOK, send().Code)
+
+	w = send()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "the window still has room but the day is used up")
+	assert.Equal(t, "0", w.Header().Get("X-Quota-Daily-Remaining"))
+	assert.Equal(t, "48", w.Header().Get("X-Quota-Monthly-Remaining"), "refused requests consume no quota")
+	assert.Contains(t, w.Body.String(), defaultMessages[MessageQuotaExceeded])
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.2:12345"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "999", w.Header().Get("X-Quota-Daily-Remaining"), "IPs get the IP quota")
+	assert.Empty(t, w.Header().Get("X-Quota-Monthly-Limit"))
+}
+
+func TestQuotaTimezone(t *testing.T) {
+	service := NewService(storage.Config{IPDailyQuota: 10, IPMonthlyQuota: 100, QuotaTimezone: "America/Sao_Paulo"}, storage.NewMemoryStorage())
+
+	// 01:30 UTC on March 1st is still February 28th in São Paulo (UTC-3)
+	now := time.Date(2026, 3, 1, 1, 30, 0, 0, time.UTC)
+	quotas := service.quotas("10.0.0.1", false, now)
+	require.Len(t, quotas, 2)
+
+	assert.Equal(t, "quota:day:2026-02-28:10.0.0.1", quotas[0].storageKey("10.0.0.1"))
+	assert.Equal(t, time.Date(2026, 3, 1, 3, 0, 0, 0, time.UTC), quotas[0].end.UTC())
+	assert.Equal(t, "quota:month:2026-02:10.0.0.1", quotas[1].storageKey("10.0.0.1"))
+	assert.Equal(t, time.Date(2026, 3, 1, 3, 0, 0, 0, time.UTC), quotas[1].end.UTC())
+
+	assert.Nil(t, service.quotas(healthCheckKeyPrefix+"/health", false, now))
+}
+
+func TestQuotaValidation(t *testing.T) {
+	assert.Error(t, storage.Config{IPDailyQuota: -1}.Validate())
+	assert.Error(t, storage.Config{TokenMonthlyQuotas: map[string]int{"gold": -5}}.Validate())
+	assert.Error(t, storage.Config{QuotaTimezone: "Mars/Olympus"}.Validate())
+	assert.NoError(t, storage.Config{IPDailyQuota: 10, QuotaTimezone: "Europe/Lisbon"}.Validate())
+}
+
+func TestTransferQuota(t *testing.T) {
+	ctx := context.Background()
+	service := NewService(storage.Config{
+		IPRateLimit:      100,
+		IPBlockTime:      60,
+		TokenDailyQuotas: map[string]int{"staging": 5, "prod": 2, "other": 5},
+	}, storage.NewMemoryStorage())
+	for _, token := range []*ratelimiter.TokenConfig{
+		{Name: "staging", Limit: 100, Owner: "acme"},
+		{Name: "prod", Limit: 100, Owner: "acme"},
+		{Name: "other", Limit: 100, Owner: "globex"},
+	} {
+		require.NoError(t, service.CreateToken(ctx, token))
+	}
+	check := func(token string) bool {
+		result, err := service.checkRateLimit(context.Background(), "token:"+token, true, 1)
+		require.NoError(t, err)
+		return result.Allowed
+	}
+
+	assert.True(t, check("staging"))
+	from, to, err := service.TransferQuota(ctx, QuotaTransfer{From: "staging", To: "prod", Period: QuotaPeriodDay, Amount: 3, Reason: "launch"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, from.Remaining)
+	assert.Equal(t, 5, to.Remaining, "the target may exceed its own limit")
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, check("prod"))
+	}
+	assert.False(t, check("prod"))
+	assert.True(t, check("staging"))
+	assert.False(t, check("staging"), "the source gave away what it transferred")
+
+	_, _, err = service.TransferQuota(ctx, QuotaTransfer{From: "staging", To: "prod", Period: QuotaPeriodDay, Amount: 1})
+	assert.ErrorIs(t, err, ErrInvalidQuotaTransfer, "only unused quota moves")
+	_, _, err = service.TransferQuota(ctx, QuotaTransfer{From: "other", To: "prod", Period: QuotaPeriodDay, Amount: 1})
+	assert.ErrorIs(t, err, ErrInvalidQuotaTransfer, "tokens of another owner are out of reach")
+	_, _, err = service.TransferQuota(ctx, QuotaTransfer{From: "staging", To: "prod", Period: QuotaPeriodMonth, Amount: 1})
+	assert.ErrorIs(t, err, ErrInvalidQuotaTransfer, "both tokens need a quota of the period")
+}
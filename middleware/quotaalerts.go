@@ -0,0 +1,209 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/smtp"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// quotaAlertKeyPrefix marks the thresholds already notified in the current period
+const quotaAlertKeyPrefix = "quota-alert:"
+
+// QuotaAlert tells the owner of a token that its usage crossed a threshold of a quota
+type QuotaAlert struct {
+	Token     string    `json:"token"`
+	Period    string    `json:"period"`
+	Threshold int       `json:"threshold"`
+	Limit     int       `json:"limit"`
+	Used      int       `json:"used"`
+	ResetAt   time.Time `json:"reset_at"`
+
+	contact string
+}
+
+// QuotaAlerter delivers quota alerts in the background: a contact starting with http://
+// or https:// gets the alert POSTed as JSON, an email address gets a mail through
+// SMTP_ADDR. Delivery is best effort; alerts queued while the queue is full are dropped.
+type QuotaAlerter struct {
+	client *http.Client
+	smtp   storage.Config
+	queue  chan QuotaAlert
+}
+
+// NewQuotaAlerter returns nil when no quota alert threshold is configured
+func NewQuotaAlerter(config storage.Config) *QuotaAlerter {
+	if len(config.QuotaAlertThresholds) == 0 && len(config.TokenQuotaAlertThresholds) == 0 {
+		return nil
+	}
+	return &QuotaAlerter{
+		client: &http.Client{Timeout: 5 * time.Second},
+		smtp:   config,
+		queue:  make(chan QuotaAlert, 256),
+	}
+}
+
+// Enqueue schedules the alert for delivery without waiting on it
+func (a *QuotaAlerter) Enqueue(alert QuotaAlert) {
+	select {
+	case a.queue <- alert:
+	default:
+		slog.Warn("Dropped quota alert, the queue is full", "token", storage.RedactAPIKey(alert.Token))
+	}
+}
+
+// Run delivers queued alerts until the context is done
+func (a *QuotaAlerter) Run(ctx context.Context) {
+	if a == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case alert := <-a.queue:
+			if err := a.Deliver(ctx, alert); err != nil {
+				slog.Error("Failed to deliver quota alert", "token", storage.RedactAPIKey(alert.Token), "error", err)
+			}
+		}
+	}
+}
+
+// Deliver sends the alert to its contact
+func (a *QuotaAlerter) Deliver(ctx context.Context, alert QuotaAlert) error {
+	switch {
+	case strings.HasPrefix(alert.contact, "http://"), strings.HasPrefix(alert.contact, "https://"):
+		return a.post(ctx, alert)
+	case strings.Contains(alert.contact, "@"):
+		return a.mail(alert)
+	default:
+		return fmt.Errorf("contact %q is neither a webhook URL nor an email address", alert.contact)
+	}
+}
+
+func (a *QuotaAlerter) post(ctx context.Context, alert QuotaAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, alert.contact, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (a *QuotaAlerter) mail(alert QuotaAlert) error {
+	if a.smtp.SMTPAddr == "" || a.smtp.SMTPFrom == "" {
+		return errors.New("SMTP_ADDR and SMTP_FROM are required to send quota alerts by email")
+	}
+
+	var auth smtp.Auth
+	if a.smtp.SMTPUsername != "" {
+		host, _, _ := strings.Cut(a.smtp.SMTPAddr, ":")
+		auth = smtp.PlainAuth("", a.smtp.SMTPUsername, a.smtp.SMTPPassword, host)
+	}
+
+	subject := fmt.Sprintf("Token %s used %d%% of its %s quota", alert.Token, alert.Threshold, quotaPeriodName(alert.Period))
+	body := fmt.Sprintf("Token %s used %d of its %d requests for the %s.\r\nThe quota resets at %s.\r\n",
+		alert.Token, alert.Used, alert.Limit, alert.Period, alert.ResetAt.Format(time.RFC1123))
+	message := "From: " + a.smtp.SMTPFrom + "\r\n" +
+		"To: " + alert.contact + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"\r\n" + body
+
+	return smtp.SendMail(a.smtp.SMTPAddr, auth, a.smtp.SMTPFrom, []string{alert.contact}, []byte(message))
+}
+
+func quotaPeriodName(period string) string {
+	if period == QuotaPeriodMonth {
+		return "monthly"
+	}
+	return "daily"
+}
+
+// RunQuotaAlerts delivers the quota alerts of the service until the context is done
+func (s *Service) RunQuotaAlerts(ctx context.Context) {
+	s.quotaAlerts.Run(ctx)
+}
+
+// alertQuotas queues an alert for every threshold the cost just pushed the token past.
+// Only the request crossing a threshold looks at the storage, where a marker expiring
+// with the period keeps other instances from sending the same alert again. No alert is
+// sent in read-only mode, where the marker cannot be written.
+func (s *Service) alertQuotas(ctx context.Context, key string, isToken bool, quotas []*quota, cost int) {
+	tokenName, found := tokenOf(quotaKey(key))
+	if s.quotaAlerts == nil || !isToken || !found || s.IsReadOnly() {
+		return
+	}
+
+	config := s.Config()
+	thresholds, exists := config.TokenQuotaAlertThresholds[tokenName]
+	if !exists {
+		thresholds = config.QuotaAlertThresholds
+	}
+
+	now := s.now()
+	for _, q := range quotas {
+		for _, threshold := range thresholds {
+			mark := (q.limit*threshold + 99) / 100
+			if q.used < mark || q.used-cost >= mark {
+				continue
+			}
+
+			marker := quotaAlertKeyPrefix + strconv.Itoa(threshold) + ":" + strings.TrimPrefix(q.storageKey(quotaKey(key)), quotaKeyPrefix)
+			if sent, err := s.storage.Get(ctx, marker); err != nil || sent != nil {
+				continue
+			}
+			if err := s.storage.Set(ctx, marker, &ratelimiter.RateLimit{Count: 1, LastReset: now}, q.end.Sub(now)); err != nil {
+				slog.Error("Failed to record quota alert", "token", storage.RedactAPIKey(tokenName), "error", err)
+				continue
+			}
+
+			contact := s.tokenContact(tokenName)
+			if contact == "" {
+				continue
+			}
+			s.quotaAlerts.Enqueue(QuotaAlert{
+				Token:     tokenName,
+				Period:    q.period,
+				Threshold: threshold,
+				Limit:     q.limit,
+				Used:      q.used,
+				ResetAt:   q.end,
+				contact:   contact,
+			})
+		}
+	}
+}
+
+// tokenContact returns the contact of the token owner, from the token config managed at
+// runtime first and TOKEN_<name>_CONTACT otherwise
+func (s *Service) tokenContact(tokenName string) string {
+	if tokenConfig, exists := s.getTokenConfig(tokenName); exists && tokenConfig.Contact != "" {
+		return tokenConfig.Contact
+	}
+	return s.Config().TokenContacts[tokenName]
+}
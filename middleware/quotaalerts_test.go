@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaAlerts(t *testing.T) {
+	alerts := make(chan QuotaAlert, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert QuotaAlert
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&alert))
+		alerts <- alert
+	}))
+	defer webhook.Close()
+
+	assert.Nil(t, NewQuotaAlerter(storage.Config{}))
+
+	rateLimitStorage := storage.NewMemoryStorage()
+	service := NewService(storage.Config{
+		IPRateLimit:          100,
+		IPBlockTime:          60,
+		TokenLimits:          map[string]int{"gold": 100, "silver": 100},
+		TokenDailyQuotas:     map[string]int{"gold": 10, "silver": 10},
+		QuotaAlertThresholds: []int{80, 95},
+		TokenContacts:        map[string]string{"gold": "http://unused.invalid/hook"},
+	}, rateLimitStorage)
+
+	require.NoError(t, rateLimitStorage.SetTokenConfig(context.Background(), &ratelimiter.TokenConfig{Name: "gold", Limit: 100, Contact: webhook.URL}))
+	require.NoError(t, service.SyncTokenConfigs(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go service.RunQuotaAlerts(ctx)
+
+	for i := 0; i < 10; i++ {
+		allowed, err := service.CheckRateLimit("token:gold", true, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+
+		allowed, err = service.CheckRateLimit("token:silver", true, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+	}
+
+	for _, threshold := range []int{80, 95} {
+		select {
+		case alert := <-alerts:
+			assert.Equal(t, "gold", alert.Token, "silver has no contact")
+			assert.Equal(t, QuotaPeriodDay, alert.Period)
+			assert.Equal(t, threshold, alert.Threshold)
+			assert.Equal(t, 10, alert.Limit)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no alert for the %d%% threshold", threshold)
+		}
+	}
+
+	quotas := service.quotas("token:gold", true, time.Now())
+	quotas[0].used = 8
+	service.alertQuotas(context.Background(), "token:gold", true, quotas, 1)
+	select {
+	case alert := <-alerts:
+		t.Fatalf("the %d%% threshold was notified twice in the same day", alert.Threshold)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestQuotaAlerterUnknownContact(t *testing.T) {
+	alerter := NewQuotaAlerter(storage.Config{QuotaAlertThresholds: []int{80}})
+	err := alerter.Deliver(context.Background(), QuotaAlert{Token: "gold", contact: "ops"})
+	assert.Error(t, err)
+
+	err = alerter.Deliver(context.Background(), QuotaAlert{Token: "gold", contact: "ops@example.com"})
+	assert.ErrorContains(t, err, "SMTP_ADDR")
+}
+
+func TestLoadConfigQuotaAlerts(t *testing.T) {
+	t.Setenv("QUOTA_ALERT_THRESHOLDS", "95,80%")
+	t.Setenv("TOKEN_GOLD_QUOTA_ALERTS", "50")
+	t.Setenv("TOKEN_GOLD_CONTACT", "ops@example.com")
+	t.Setenv("TOKEN_SILVER_QUOTA_ALERTS", "150")
+
+	config, err := storage.LoadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []int{80, 95}, config.RateLimit.QuotaAlertThresholds)
+	assert.Equal(t, []int{50}, config.RateLimit.TokenQuotaAlertThresholds["GOLD"])
+	assert.Equal(t, "ops@example.com", config.RateLimit.TokenContacts["GOLD"])
+	assert.NotContains(t, config.RateLimit.TokenQuotaAlertThresholds, "SILVER", "thresholds above 100% are skipped")
+
+	t.Setenv("QUOTA_ALERT_THRESHOLDS", "0")
+	_, err = storage.LoadConfig()
+	assert.Error(t, err)
+}
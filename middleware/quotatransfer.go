@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"time"
+)
+
+// ErrInvalidQuotaTransfer is returned for a transfer the tokens or their quotas don't allow
+var ErrInvalidQuotaTransfer = errors.New("invalid quota transfer")
+
+// QuotaTransfer moves Amount requests of the current daily or monthly quota of the token
+// From to the token To. Reason is kept in the audit log.
+type QuotaTransfer struct {
+	From   string
+	To     string
+	Period string
+	Amount int
+	Reason string
+}
+
+// TransferQuota moves unused quota between two registry tokens of the same owner, for
+// the current period only: the amount is charged to the quota of the source as if it
+// had been used and credited to the target, whose remaining quota may then exceed its
+// limit. The source can only give what it has left, checked against the charged counter
+// so concurrent requests can't push it over. Every transfer is logged for audit.
+// It returns the quotas of both tokens afterwards.
+func (s *Service) TransferQuota(ctx context.Context, transfer QuotaTransfer) (QuotaStatus, QuotaStatus, error) {
+	if transfer.Amount <= 0 {
+		return QuotaStatus{}, QuotaStatus{}, fmt.Errorf("%w: the amount must be positive", ErrInvalidQuotaTransfer)
+	}
+	if transfer.Period != QuotaPeriodDay && transfer.Period != QuotaPeriodMonth {
+		return QuotaStatus{}, QuotaStatus{}, fmt.Errorf("%w: the period must be day or month", ErrInvalidQuotaTransfer)
+	}
+	if transfer.From == transfer.To {
+		return QuotaStatus{}, QuotaStatus{}, fmt.Errorf("%w: the tokens must differ", ErrInvalidQuotaTransfer)
+	}
+
+	from, fromExists := s.getTokenConfig(transfer.From)
+	to, toExists := s.getTokenConfig(transfer.To)
+	if !fromExists || !toExists {
+		return QuotaStatus{}, QuotaStatus{}, fmt.Errorf("%w: both tokens must be in the registry", ErrInvalidQuotaTransfer)
+	}
+	if from.Owner == "" || from.Owner != to.Owner {
+		return QuotaStatus{}, QuotaStatus{}, fmt.Errorf("%w: the tokens must have the same owner", ErrInvalidQuotaTransfer)
+	}
+
+	now := s.now()
+	fromKey, toKey := "token:"+transfer.From, "token:"+transfer.To
+	fromQuota, toQuota := s.periodQuota(fromKey, transfer.Period, now), s.periodQuota(toKey, transfer.Period, now)
+	if fromQuota == nil || toQuota == nil {
+		return QuotaStatus{}, QuotaStatus{}, fmt.Errorf("%w: both tokens must have a %s quota", ErrInvalidQuotaTransfer, transfer.Period)
+	}
+
+	s.transferMu.Lock()
+	defer s.transferMu.Unlock()
+
+	used, err := s.chargeQuota(ctx, fromKey, fromQuota, transfer.Amount, now)
+	if err != nil {
+		return QuotaStatus{}, QuotaStatus{}, err
+	}
+	if used > fromQuota.limit {
+		if _, err := s.chargeQuota(ctx, fromKey, fromQuota, -transfer.Amount, now); err != nil {
+			return QuotaStatus{}, QuotaStatus{}, err
+		}
+		return QuotaStatus{}, QuotaStatus{}, fmt.Errorf("%w: token %s has only %d requests left", ErrInvalidQuotaTransfer, transfer.From, max(fromQuota.limit-used+transfer.Amount, 0))
+	}
+	if _, err := s.chargeQuota(ctx, toKey, toQuota, -transfer.Amount, now); err != nil {
+		return QuotaStatus{}, QuotaStatus{}, err
+	}
+
+	slog.Info("Quota transfer", "amount", transfer.Amount, "period", transfer.Period,
+		"from", storage.RedactAPIKey(transfer.From), "to", storage.RedactAPIKey(transfer.To), "owner", from.Owner, "reason", transfer.Reason)
+	return fromQuota.status(), toQuota.status(), nil
+}
+
+// periodQuota returns the quota of the period of the key, nil when it has none
+func (s *Service) periodQuota(key, period string, now time.Time) *quota {
+	for _, q := range s.quotas(key, true, now) {
+		if q.period == period {
+			return q
+		}
+	}
+	return nil
+}
+
+// chargeQuota adds the amount, negative to credit it, to the quota counter of the key
+// and returns what was used of it afterwards
+func (s *Service) chargeQuota(ctx context.Context, key string, q *quota, amount int, now time.Time) (int, error) {
+	if atomic, isAtomic := s.storage.(ratelimiter.AtomicStorage); isAtomic {
+		used, err := atomic.Consume(ctx, q.storageKey(key), amount, q.start, q.end.Sub(now))
+		if err == nil {
+			q.used = used
+			return used, nil
+		}
+		if !errors.Is(err, ratelimiter.ErrNotAtomic) {
+			return 0, err
+		}
+	}
+
+	counter, err := s.storage.Get(ctx, q.storageKey(key))
+	if err != nil {
+		return 0, err
+	}
+	if counter != nil {
+		q.used = counter.Count
+	}
+	q.used += amount
+	if err := s.storage.Set(ctx, q.storageKey(key), &ratelimiter.RateLimit{Count: q.used, LastReset: q.start}, q.end.Sub(now)); err != nil {
+		return 0, err
+	}
+	return q.used, nil
+}
@@ -1,67 +1,353 @@
 package middleware
 
 import (
-	"encoding/json"
 	"net"
 	"net/http"
+	ratelimiter "rate-limiter"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
-func RateLimiter(service *Service) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			clientIP := getClientIP(r)
-			apiKey := getAPIKey(r)
-			key, isToken := determineRateLimitKey(clientIP, apiKey)
+// Option customizes the rate limiter middleware
+type Option func(*options)
 
-			allowed, err := service.CheckRateLimit(key, isToken)
-			if err != nil {
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
+type options struct {
+	keyExtractor    KeyExtractor
+	onAllow         func(r *http.Request, event LimitEvent)
+	onLimitExceeded func(r *http.Request, event LimitEvent)
+	onStorageError  func(r *http.Request, key string, err error)
+}
 
-			if !allowed {
-				sendRateLimitError(w)
-				return
-			}
+// LimitEvent describes the outcome of a rate limit check to the callbacks of the
+// middleware. Result is zero for refusals that did not reach the limiter, such as the
+// concurrency limit or the error budget.
+type LimitEvent struct {
+	Key      string
+	ClientIP string
+	Reason   string
+	Result   ratelimiter.Result
+}
+
+// WithKeyExtractor overrides how the API key is read from requests
+func WithKeyExtractor(extractor KeyExtractor) Option {
+	return func(o *options) {
+		o.keyExtractor = extractor
+	}
+}
+
+// WithOnAllow calls fn for every request let through by the rate limit check, before
+// it reaches the next handler. Callbacks run on the request path, like hooks.
+func WithOnAllow(fn func(r *http.Request, event LimitEvent)) Option {
+	return func(o *options) {
+		o.onAllow = fn
+	}
+}
 
-			next.ServeHTTP(w, r)
+// WithOnLimitExceeded calls fn for every request refused with 429, before the response
+// is written
+func WithOnLimitExceeded(fn func(r *http.Request, event LimitEvent)) Option {
+	return func(o *options) {
+		o.onLimitExceeded = fn
+	}
+}
+
+// WithOnStorageError calls fn when the storage fails a check; the request is then
+// allowed or refused by ON_STORAGE_ERROR, which fires the matching callback as well
+func WithOnStorageError(fn func(r *http.Request, key string, err error)) Option {
+	return func(o *options) {
+		o.onStorageError = fn
+	}
+}
+
+func (o *options) allowed(r *http.Request, event LimitEvent) {
+	if o.onAllow != nil {
+		o.onAllow(r, event)
+	}
+}
+
+func (o *options) limitExceeded(r *http.Request, event LimitEvent) {
+	if o.onLimitExceeded != nil {
+		o.onLimitExceeded(r, event)
+	}
+}
+
+func (o *options) storageError(r *http.Request, key string, err error) {
+	if o.onStorageError != nil {
+		o.onStorageError(r, key, err)
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func RateLimiter(service *Service, opts ...Option) func(http.Handler) http.Handler {
+	o := newOptions(opts)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveRateLimited(service, o, next, w, r)
 		})
 	}
 }
 
-func getClientIP(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			clientIP := strings.TrimSpace(ips[0])
-			if isValidIP(clientIP) {
-				return clientIP
+func serveRateLimited(service *Service, o *options, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if service.IsExempt(r.URL.Path) {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	extractor := o.keyExtractor
+	if extractor == nil {
+		extractor = service.keyExtractor()
+	}
+
+	clientIP := service.clientIP.ClientIP(r)
+	key, identified := identityKey(r)
+	isToken := false
+	var tier string
+	if !identified {
+		credentials, signed, err := service.jwt.Authenticate(r)
+		if err != nil {
+			service.publishDecision(r, clientIP, clientIP, false, "invalid_jwt")
+			sendError(w, service.format, http.StatusUnauthorized, service.messages.Format(r, MessageInvalidAPIKey, 0))
+			return
+		}
+		apiKey, found := credentials.subject, signed
+		if !signed {
+			apiKey, found = extractor(r)
+		}
+		if found && !signed && service.validator != nil {
+			if err := service.validator.Validate(apiKey); err != nil {
+				service.publishDecision(r, clientIP, clientIP, false, "invalid_api_key")
+				sendError(w, service.format, http.StatusUnauthorized, service.messages.Format(r, MessageInvalidAPIKey, 0))
+				return
 			}
 		}
+		key, isToken = determineRateLimitKey(service.ipKey(clientIP), apiKey)
+		if service.tokenDisabled(key, isToken) {
+			service.publishDecision(r, clientIP, key, false, "token_disabled")
+			sendError(w, service.format, http.StatusUnauthorized, service.messages.Format(r, MessageInvalidAPIKey, 0))
+			return
+		}
+		// a JWT naming a configured tier vouches for its subject
+		var rejected bool
+		if tier = service.jwtTier(credentials); tier == "" {
+			key, isToken, rejected = service.unknownToken(key, isToken, clientIP)
+		}
+		if rejected {
+			service.publishDecision(r, clientIP, key, false, "unknown_token")
+			sendError(w, service.format, http.StatusUnauthorized, service.messages.Format(r, MessageInvalidAPIKey, 0))
+			return
+		}
+		if !isToken && !service.Config().IPRateLimitDisabled {
+			key = service.fingerprints.Key(r, key)
+		}
+	}
+
+	if service.IsDenied(clientIP, key) {
+		service.snapshots.Record(r, clientIP, key, "denylist")
+		service.publishDecision(r, clientIP, key, false, "denylist")
+		sendDeniedError(w, r, service, service.Config().DenylistStatusCode)
+		return
+	}
+	location := service.geoIP.Locate(clientIP)
+	if service.geoIP.Blocked(location) {
+		service.snapshots.Record(r, clientIP, key, "geo_blocked")
+		service.publishDecision(r, clientIP, key, false, "geo_blocked")
+		sendDeniedError(w, r, service, service.Config().DenylistStatusCode)
+		return
+	}
+	if tier == "" && !isToken && !identified {
+		tier = service.geoIP.Policy(location)
+	}
+	key = tierKey(service.tokenIPKey(key, isToken, clientIP), tier)
+
+	if exempt, pooled := service.healthChecks.Classify(r, clientIP); exempt {
+		service.publishDecision(r, clientIP, key, true, "health_check")
+		next.ServeHTTP(w, r)
+		return
+	} else if pooled {
+		key, isToken = healthCheckKeyPrefix+r.URL.Path, false
+	} else if !isToken && !identified && service.Config().IPRateLimitDisabled {
+		serveTokenless(service, next, w, r, clientIP)
+		return
+	} else {
+		key = service.policyKey(key, r.Method, r.URL.Path, keyTypeOf(isToken, identified))
 	}
 
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		if isValidIP(xri) {
-			return xri
+	if service.Config().WebSocketRateLimit > 0 && isWebSocketUpgrade(r) {
+		key = webSocketKeyPrefix + key
+	}
+
+	var cacheKey string
+	if service.responseCache.Cacheable(r) {
+		cacheKey = responseCacheKey(key, r)
+		if service.responseCache.Serve(w, cacheKey) {
+			service.publishDecision(r, clientIP, key, true, "cached")
+			return
 		}
 	}
 
-	if cfIP := r.Header.Get("CF-Connecting-IP"); cfIP != "" {
-		if isValidIP(cfIP) {
-			return cfIP
+	release, acquired := service.acquireConcurrency(r, key, isToken)
+	if !acquired {
+		service.snapshots.Record(r, clientIP, key, "concurrency_limit")
+		service.publishDecision(r, clientIP, key, false, "concurrency_limit")
+		o.limitExceeded(r, LimitEvent{Key: key, ClientIP: clientIP, Reason: "concurrency_limit"})
+		sendError(w, service.format, http.StatusTooManyRequests, service.messages.Format(r, MessageRateLimited, 0))
+		return
+	}
+	if release != nil {
+		defer release()
+	}
+
+	if retryAfter := service.checkErrorBudget(key); retryAfter > 0 {
+		service.snapshots.Record(r, clientIP, key, "error_budget")
+		service.publishDecision(r, clientIP, key, false, "error_budget")
+		o.limitExceeded(r, LimitEvent{Key: key, ClientIP: clientIP, Reason: "error_budget", Result: ratelimiter.Result{RetryAfter: retryAfter}})
+		setRetryAfter(w, retryAfter)
+		sendError(w, service.format, http.StatusTooManyRequests, service.messages.Format(r, MessageRateLimited, retryAfter))
+		return
+	}
+
+	guarded := service.failures.Applies(r.URL.Path)
+	if guarded {
+		if retryAfter := service.checkFailures(r.Context(), key); retryAfter > 0 {
+			service.snapshots.Record(r, clientIP, key, "failure_limit")
+			service.publishDecision(r, clientIP, key, false, "failure_limit")
+			o.limitExceeded(r, LimitEvent{Key: key, ClientIP: clientIP, Reason: "failure_limit", Result: ratelimiter.Result{RetryAfter: retryAfter}})
+			setRetryAfter(w, retryAfter)
+			sendError(w, service.format, http.StatusTooManyRequests, service.messages.Format(r, MessageRateLimited, retryAfter))
+			return
 		}
 	}
 
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	cost := service.costs.Cost(r)
+	var check rateLimitCheck
+	var err error
+	if service.throttle.Applies(r, key, isToken) {
+		check, err = service.throttleRateLimit(r.Context(), key, isToken, cost, service.throttle.maxWait)
+	} else {
+		check, err = service.checkRateLimit(r.Context(), key, isToken, cost)
+	}
+	if err == nil && check.Allowed {
+		err = service.checkNetwork(r.Context(), clientIP, cost, &check)
+	}
+	if err == nil && check.Allowed {
+		err = service.checkOrigin(r, key, cost, &check)
+	}
+	if err != nil && r.Context().Err() != nil {
+		// The client went away during the check, nobody is left to answer
+		return
+	}
+	allowed, reason := check.Allowed, check.reason()
 	if err != nil {
-		return r.RemoteAddr
+		o.storageError(r, key, err)
+		allowed = service.handleStorageError(key, err)
+		reason = "storage_error"
+	}
+	event := LimitEvent{Key: key, ClientIP: clientIP, Reason: reason, Result: check.Result}
+	setQuotaHeaders(w, check.Quotas)
+
+	if !allowed {
+		service.snapshots.Record(r, clientIP, key, reason)
+		service.publishDecision(r, clientIP, key, false, reason)
+		o.limitExceeded(r, event)
+		message := MessageRateLimited
+		if check.QuotaExceeded {
+			message = MessageQuotaExceeded
+		}
+		setRetryAfter(w, check.RetryAfter)
+		sendError(w, service.format, http.StatusTooManyRequests, service.messages.Format(r, message, check.RetryAfter))
+		return
+	}
+
+	service.publishDecision(r, clientIP, key, true, reason)
+	o.allowed(r, event)
+
+	if bandwidth := service.policy(key, isToken).Bandwidth; bandwidth > 0 && service.bandwidth != nil {
+		paced, release := service.bandwidth.Wrap(w, r, key, bandwidth)
+		defer release()
+		w = paced
+	}
+
+	// one recorder serves the error budget, the failure limit and refunds
+	refund := len(service.Config().RefundStatuses) > 0 && !check.CheckedAt.IsZero()
+	if service.errorBudget != nil || guarded || refund {
+		recorder := newStatusWriter(w)
+		defer func() {
+			if refund {
+				service.refund(key, isToken, cost, check.CheckedAt, recorder.statusCode)
+			}
+			if guarded {
+				service.recordFailure(key, recorder.statusCode)
+			}
+			if service.errorBudget != nil {
+				service.recordErrorBudget(key, recorder.statusCode)
+			}
+		}()
+		w = recorder
+	}
+
+	if cacheKey != "" {
+		recorder := service.responseCache.recorder(w)
+		next.ServeHTTP(recorder, r)
+		service.responseCache.Store(cacheKey, recorder)
+		return
+	}
+
+	next.ServeHTTP(w, r)
+}
+
+// serveTokenless handles a request without a token when IP limiting is off: it is
+// refused with 401, or with TOKENLESS_POLICY=allow let through without being counted,
+// published or keyed at all
+func serveTokenless(service *Service, next http.Handler, w http.ResponseWriter, r *http.Request, clientIP string) {
+	if service.Config().TokenlessPolicy == TokenlessAllow {
+		next.ServeHTTP(w, r)
+		return
+	}
+	service.publishDecision(r, clientIP, clientIP, false, "missing_token")
+	sendError(w, service.format, http.StatusUnauthorized, service.messages.Format(r, MessageTokenRequired, 0))
+}
+
+// limitReason labels the outcome of a successful check, telling an explicit limit of 0
+// or an unlimited key apart from the regular window
+func limitReason(result ratelimiter.Result) string {
+	switch {
+	case result.Limit < 0:
+		return "unlimited"
+	case result.Limit == 0:
+		return "limit_zero"
+	case result.Allowed:
+		return "within_limit"
+	default:
+		return "rate_limit"
 	}
-	return ip
+}
+
+// webSocketKeyPrefix separates the bucket of WebSocket upgrades from plain HTTP requests
+const webSocketKeyPrefix = "ws:"
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+
+	for _, value := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(value), "upgrade") {
+			return true
+		}
+	}
+	return false
 }
 
 func getAPIKey(r *http.Request) string {
@@ -76,15 +362,27 @@ func determineRateLimitKey(clientIP, apiKey string) (string, bool) {
 }
 
 func sendRateLimitError(w http.ResponseWriter) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusTooManyRequests)
+	sendError(w, nil, http.StatusTooManyRequests, defaultMessages[MessageRateLimited])
+}
 
-	response := ErrorResponse{
-		Error: "you have reached the maximum number of requests or actions allowed within a certain time frame",
+// sendDeniedError answers a denylisted client, either as rate limited or as forbidden
+func sendDeniedError(w http.ResponseWriter, r *http.Request, service *Service, statusCode int) {
+	if statusCode != http.StatusForbidden {
+		sendError(w, service.format, http.StatusTooManyRequests, service.messages.Format(r, MessageRateLimited, 0))
+		return
 	}
+	sendError(w, service.format, http.StatusForbidden, service.messages.Format(r, MessageDenied, 0))
+}
 
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		return
+func sendError(w http.ResponseWriter, format *ResponseFormat, statusCode int, message string) {
+	format.WriteError(w, statusCode, message)
+}
+
+// setRetryAfter tells a refused client how many seconds to wait, rounded up so a retry
+// right on time is not refused again
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
 	}
 }
 
@@ -1,7 +1,9 @@
 package middleware
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	ratelimiter "rate-limiter"
@@ -15,6 +17,9 @@ import (
 )
 
 func TestGetClientIP(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8", "172.16.0.0/12"}, nil)
+	require.NoError(t, err)
+
 	tests := []struct {
 		name       string
 		headers    map[string]string
@@ -94,7 +99,7 @@ func TestGetClientIP(t *testing.T) {
 				req.Header.Set(key, value)
 			}
 
-			result := getClientIP(req)
+			result := resolver.ClientIP(req)
 			assert.Equal(t, tt.expectedIP, result)
 		})
 	}
@@ -355,6 +360,7 @@ func TestRateLimiterMiddleware(t *testing.T) {
 		testStorage := createTestStorage(t)
 		defer testStorage.Close()
 
+		clock := ratelimiter.NewManualClock(time.Now())
 		service := &Service{
 			config: storage.Config{
 				IPRateLimit:     2,
@@ -363,6 +369,7 @@ func TestRateLimiterMiddleware(t *testing.T) {
 				TokenBlockTimes: map[string]int{"ABC123": 1},
 			},
 			storage: testStorage,
+			clock:   clock,
 		}
 
 		middleware := RateLimiter(service)
@@ -382,7 +389,7 @@ func TestRateLimiterMiddleware(t *testing.T) {
 		handler.ServeHTTP(w, req)
 		assert.Equal(t, http.StatusTooManyRequests, w.Code)
 
-		time.Sleep(1100 * time.Millisecond)
+		clock.Advance(1100 * time.Millisecond)
 
 		req2 := httptest.NewRequest("GET", "/", nil)
 		req2.RemoteAddr = "192.168.1.6:12345"
@@ -427,6 +434,186 @@ func TestRateLimiterIntegrationWithChi(t *testing.T) {
 	assert.Equal(t, http.StatusTooManyRequests, w2.Code)
 }
 
+func TestIsWebSocketUpgrade(t *testing.T) {
+	tests := []struct {
+		name       string
+		upgrade    string
+		connection string
+		expected   bool
+	}{
+		{"websocket", "websocket", "Upgrade", true},
+		{"keep_alive_upgrade", "WebSocket", "keep-alive, Upgrade", true},
+		{"missing_connection", "websocket", "", false},
+		{"other_protocol", "h2c", "Upgrade", false},
+		{"plain_request", "", "keep-alive", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ws", nil)
+			req.Header.Set("Upgrade", tt.upgrade)
+			req.Header.Set("Connection", tt.connection)
+			assert.Equal(t, tt.expected, isWebSocketUpgrade(req))
+		})
+	}
+}
+
+func TestRateLimiterWebSocketBucket(t *testing.T) {
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	service := &Service{
+		config: storage.Config{
+			IPRateLimit:        1,
+			IPBlockTime:        60,
+			WebSocketRateLimit: 2,
+			WebSocketBlockTime: 30,
+		},
+		storage: storage.NewMemoryStorage(),
+	}
+	handler := RateLimiter(service)(testHandler)
+
+	send := func(webSocket bool) int {
+		req := httptest.NewRequest("GET", "/ws", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		if webSocket {
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Connection", "Upgrade")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send(false))
+	assert.Equal(t, http.StatusTooManyRequests, send(false))
+
+	assert.Equal(t, http.StatusOK, send(true))
+	assert.Equal(t, http.StatusOK, send(true))
+	assert.Equal(t, http.StatusTooManyRequests, send(true))
+
+	assert.Equal(t, 30, service.getBlockTime("ws:192.168.1.1", false))
+}
+
+// failingStorage is a storage whose reads always fail
+type failingStorage struct {
+	ratelimiter.Storage
+}
+
+func (f *failingStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLimit, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestRateLimiterStorageErrorPolicy(t *testing.T) {
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name         string
+		policy       string
+		expectedCode int
+	}{
+		{"fail_open", storage.OnStorageErrorAllow, http.StatusOK},
+		{"fail_closed", storage.OnStorageErrorDeny, http.StatusTooManyRequests},
+		{"default_open", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := NewService(storage.Config{IPRateLimit: 10, OnStorageError: tt.policy}, &failingStorage{})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "192.168.1.1:12345"
+			w := httptest.NewRecorder()
+
+			RateLimiter(service)(testHandler).ServeHTTP(w, req)
+			assert.Equal(t, tt.expectedCode, w.Code)
+			assert.Equal(t, uint64(1), service.StorageErrors())
+		})
+	}
+}
+
+func TestRateLimiterCallbacks(t *testing.T) {
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	var allowed, exceeded []LimitEvent
+	var storageErrors []error
+	opts := []Option{
+		WithOnAllow(func(r *http.Request, event LimitEvent) { allowed = append(allowed, event) }),
+		WithOnLimitExceeded(func(r *http.Request, event LimitEvent) { exceeded = append(exceeded, event) }),
+		WithOnStorageError(func(r *http.Request, key string, err error) { storageErrors = append(storageErrors, err) }),
+	}
+
+	service := NewService(storage.Config{IPRateLimit: 1, IPBlockTime: 60}, storage.NewMemoryStorage())
+	handler := RateLimiter(service, opts...)(testHandler)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	require.Len(t, allowed, 1)
+	assert.Equal(t, "192.168.1.1", allowed[0].Key)
+	assert.Equal(t, "within_limit", allowed[0].Reason)
+	assert.Equal(t, 1, allowed[0].Result.Limit)
+	require.Len(t, exceeded, 1)
+	assert.Equal(t, "192.168.1.1", exceeded[0].ClientIP)
+	assert.False(t, exceeded[0].Result.Allowed)
+	assert.Positive(t, exceeded[0].Result.RetryAfter)
+	assert.Empty(t, storageErrors)
+
+	allowed = nil
+	service = NewService(storage.Config{IPRateLimit: 10}, &failingStorage{})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.1:12345"
+	RateLimiter(service, opts...)(testHandler).ServeHTTP(httptest.NewRecorder(), req)
+
+	require.Len(t, storageErrors, 1)
+	require.Len(t, allowed, 1, "ON_STORAGE_ERROR=allow lets the request through")
+	assert.Equal(t, "storage_error", allowed[0].Reason)
+}
+
+func TestRateLimiterZeroAndUnlimited(t *testing.T) {
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	service := NewService(storage.Config{
+		IPRateLimit: 0,
+		IPBlockTime: 60,
+		TokenLimits: map[string]int{"internal": -1},
+	}, storage.NewMemoryStorage())
+	decisions, cancel := service.Decisions().Subscribe(10)
+	defer cancel()
+	handler := RateLimiter(service)(testHandler)
+
+	send := func(apiKey string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		if apiKey != "" {
+			req.Header.Set("API_KEY", apiKey)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusTooManyRequests, send(""))
+	assert.Equal(t, "limit_zero", (<-decisions).Reason)
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, http.StatusOK, send("internal"))
+	}
+	assert.Equal(t, "unlimited", (<-decisions).Reason)
+
+	assert.Equal(t, uint64(1), service.ZeroLimitBlocks())
+	assert.Equal(t, uint64(100), service.UnlimitedChecks())
+}
+
 func BenchmarkRateLimiterMiddleware(b *testing.B) {
 	config := ratelimiter.StorageConfig{
 		Host:     "localhost",
@@ -472,8 +659,80 @@ func BenchmarkGetClientIP(b *testing.B) {
 	req.RemoteAddr = "192.168.1.1:12345"
 	req.Header.Set("X-Forwarded-For", "203.0.113.1, 192.168.1.1")
 
+	resolver, err := NewClientIPResolver([]string{"192.168.1.1"}, nil)
+	require.NoError(b, err)
+
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		getClientIP(req)
+		resolver.ClientIP(req)
 	}
 }
+
+func TestRateLimiterGlobalLimit(t *testing.T) {
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	service := NewService(storage.Config{
+		IPRateLimit:     10,
+		IPBlockTime:     60,
+		GlobalRateLimit: 3,
+	}, storage.NewMemoryStorage())
+	decisions, cancel := service.Decisions().Subscribe(10)
+	defer cancel()
+	handler := RateLimiter(service)(testHandler)
+
+	send := func(ip string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("10.0.0.1"))
+	assert.Equal(t, http.StatusOK, send("10.0.0.2"))
+	assert.Equal(t, http.StatusOK, send("10.0.0.3"))
+	assert.Equal(t, http.StatusTooManyRequests, send("10.0.0.4"), "no client is over its own limit")
+
+	for i := 0; i < 3; i++ {
+		<-decisions
+	}
+	assert.Equal(t, "global_limit", (<-decisions).Reason)
+	assert.Equal(t, uint64(1), service.GlobalLimitBlocks())
+
+	state, err := service.GetLimitState(context.Background(), "10.0.0.4")
+	require.NoError(t, err)
+	assert.Nil(t, state, "a globally limited request consumes nothing of the client's limit")
+}
+
+func TestRateLimiterRetryAfterHeader(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit: 1,
+		IPBlockTime: 30,
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.7:12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Retry-After"))
+
+	w = send()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+
+	// the wait left on the block, rounded up
+	w = send()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+}
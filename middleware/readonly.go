@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"errors"
+	"rate-limiter/storage"
+)
+
+// ErrReadOnlyNotSupported is returned when the service storage has no read-only switch
+var ErrReadOnlyNotSupported = errors.New("read-only mode is not supported")
+
+// SetReadOnlySwitch gives the service the read-only switch of its storage. Apps share
+// the storage of the main service, so they share its switch too.
+func (s *Service) SetReadOnlySwitch(readOnly *storage.ReadOnlyStorage) {
+	s.readOnly = readOnly
+}
+
+// IsReadOnly reports whether checks currently decide without writing counters
+func (s *Service) IsReadOnly() bool {
+	return s.readOnly != nil && s.readOnly.IsReadOnly()
+}
+
+// SetReadOnly switches the read-only mode of the storage on or off
+func (s *Service) SetReadOnly(enabled bool) error {
+	if s.readOnly == nil {
+		return ErrReadOnlyNotSupported
+	}
+	s.readOnly.SetReadOnly(enabled)
+	return nil
+}
+
+// ReadOnlyChecks returns how many rate limit checks were decided in read-only mode,
+// without counting the request
+func (s *Service) ReadOnlyChecks() uint64 {
+	return s.readOnlyChecks.Load()
+}
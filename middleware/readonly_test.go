@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"context"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnlyMode(t *testing.T) {
+	ctx := context.Background()
+	memory := storage.NewMemoryStorage()
+	readOnly := storage.NewReadOnlyStorage(memory, false)
+
+	service := NewService(storage.Config{IPRateLimit: 2, IPBlockTime: 60, IPDailyQuota: 100}, readOnly)
+	assert.ErrorIs(t, service.SetReadOnly(true), ErrReadOnlyNotSupported)
+	service.SetReadOnlySwitch(readOnly)
+
+	allowed := func(key string) bool {
+		check, err := service.checkRateLimit(context.Background(), key, false, 1)
+		require.NoError(t, err)
+		return check.Allowed
+	}
+
+	assert.True(t, allowed("10.0.0.1"))
+	assert.True(t, allowed("10.0.0.2"))
+	assert.True(t, allowed("10.0.0.2"))
+	assert.False(t, allowed("10.0.0.2"))
+
+	require.NoError(t, service.SetReadOnly(true))
+	assert.True(t, service.IsReadOnly())
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, allowed("10.0.0.1"), "the stored count never grows")
+	}
+	assert.False(t, allowed("10.0.0.2"), "a stored block is still enforced")
+
+	state, err := memory.Get(ctx, "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, state.Count)
+
+	assert.ErrorIs(t, service.ResetLimit(ctx, "10.0.0.2"), storage.ErrReadOnly)
+	_, err = service.AddBan(ctx, "10.0.0.3", "abuse")
+	assert.ErrorIs(t, err, storage.ErrReadOnly)
+
+	acquired, err := readOnly.AcquireLease(ctx, "jobs", "me", 0)
+	require.NoError(t, err)
+	assert.False(t, acquired, "no instance leads while read-only")
+
+	stats := service.Stats()
+	assert.True(t, stats.ReadOnly)
+	assert.Equal(t, uint64(6), stats.ReadOnlyChecks)
+
+	require.NoError(t, service.SetReadOnly(false))
+	assert.True(t, allowed("10.0.0.1"))
+	assert.False(t, allowed("10.0.0.1"), "counting resumes once writes are back")
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusMatches reports whether the status is one of the codes, such as 404, or classes,
+// such as 5xx, of a status list
+func statusMatches(statuses []string, statusCode int) bool {
+	code := strconv.Itoa(statusCode)
+	for _, status := range statuses {
+		if status == code || (strings.HasSuffix(status, "xx") && strings.HasPrefix(code, status[:1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// refund gives back the cost a check of the key consumed at, in the windows of the key
+// and in its quotas, when the response has one of the REFUND_STATUSES. The global,
+// network and origin windows keep it. A storage error only loses the refund.
+func (s *Service) refund(key string, isToken bool, cost int, at time.Time, statusCode int) {
+	if !statusMatches(s.Config().RefundStatuses, statusCode) {
+		return
+	}
+	ctx, cancel := s.storageContext(context.Background())
+	defer cancel()
+	cost = max(cost, 1)
+
+	algorithm, bucketSize := s.getAlgorithm(key, isToken)
+	limits := ratelimiter.Limits{
+		Limit:      s.getLimit(key, isToken),
+		BlockTime:  time.Duration(s.getBlockTime(key, isToken)) * time.Second,
+		BucketSize: bucketSize,
+		Window:     s.getWindow(key, isToken),
+		Escalation: s.escalation(),
+	}
+	err := s.rateLimiter(algorithm).RefundWindowsN(ctx, key, limits, s.getWindows(key, isToken), cost, at)
+	if err == nil && limits.Limit != 0 {
+		err = s.refundQuotas(ctx, quotaKey(key), s.quotas(key, isToken, at), cost, at, s.now())
+	}
+	if err != nil {
+		slog.Error("Refund failed", "key", storage.RedactKey(key), "status", statusCode, "error", err)
+		return
+	}
+	s.refunds.Add(1)
+}
+
+// Refunds returns how many requests were refunded for the status of their response
+func (s *Service) Refunds() uint64 {
+	return s.refunds.Load()
+}
@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusMatches(t *testing.T) {
+	statuses := []string{"5xx", "404"}
+	assert.True(t, statusMatches(statuses, http.StatusInternalServerError))
+	assert.True(t, statusMatches(statuses, http.StatusServiceUnavailable))
+	assert.True(t, statusMatches(statuses, http.StatusNotFound))
+	assert.False(t, statusMatches(statuses, http.StatusForbidden))
+	assert.False(t, statusMatches(statuses, 0), "a response not written yet has no status")
+}
+
+func TestLoadRefundStatuses(t *testing.T) {
+	unsetEnv(t, "APPS", "HOST_TEMPLATES")
+	t.Setenv("REFUND_STATUSES", "5XX,404")
+
+	appConfig, err := storage.LoadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"5xx", "404"}, appConfig.RateLimit.RefundStatuses)
+
+	for _, invalid := range []string{"6xx", "40", "4x", "600", "x"} {
+		t.Setenv("REFUND_STATUSES", invalid)
+		_, err = storage.LoadConfig()
+		assert.ErrorContains(t, err, "REFUND_STATUSES", invalid)
+	}
+}
+
+func TestRateLimiterRefund(t *testing.T) {
+	for name, backend := range map[string]ratelimiter.Storage{
+		"atomic":  storage.NewMemoryStorage(),
+		"get_set": plainStorage{storage.NewMemoryStorage()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			service := NewService(storage.Config{
+				IPRateLimit:    2,
+				IPBlockTime:    60,
+				IPDailyQuota:   3,
+				RefundStatuses: []string{"5xx", "404"},
+			}, backend)
+			handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/fail":
+					w.WriteHeader(http.StatusBadGateway)
+				case "/missing":
+					w.WriteHeader(http.StatusNotFound)
+				case "/forbidden":
+					w.WriteHeader(http.StatusForbidden)
+				default:
+					w.Write([]byte("ok"))
+				}
+			}))
+			send := func(path string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("GET", path, nil)
+				req.RemoteAddr = "192.168.1.1:1234"
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				return w
+			}
+
+			for i := 0; i < 3; i++ {
+				assert.Equal(t, http.StatusBadGateway, send("/fail").Code, "failures are refunded")
+				assert.Equal(t, http.StatusNotFound, send("/missing").Code)
+			}
+			assert.Equal(t, "2", send("/").Header().Get("X-Quota-Daily-Remaining"), "the refunds gave the quota back")
+			assert.Equal(t, http.StatusForbidden, send("/forbidden").Code)
+			assert.Equal(t, http.StatusTooManyRequests, send("/").Code, "other statuses keep their cost")
+			assert.Equal(t, uint64(6), service.Stats().Refunds)
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	ratelimiter "rate-limiter"
+	"strings"
+	"time"
+)
+
+// ErrNeverPermitted is returned by Reserve and Wait for a key whose limit blocks every
+// request, or whose quota will not allow it before the context ends
+var ErrNeverPermitted = errors.New("rate limit never permits the key")
+
+// Reserve mirrors rate.Limiter.Reserve for callers scheduling their own work, like
+// background jobs. When the request fits it is counted and Reserve returns 0; otherwise
+// nothing is consumed and it returns how long until the request would be permitted.
+// Keys are built as in the HTTP middleware: an IP, or "token:<name>" for a token.
+func (s *Service) Reserve(ctx context.Context, key string) (time.Duration, error) {
+	check, err := s.reserve(ctx, key, strings.HasPrefix(key, "token:"), 1)
+	if err != nil {
+		return 0, err
+	}
+	if check.Allowed {
+		return 0, nil
+	}
+	if check.RetryAfter <= 0 {
+		return 0, ErrNeverPermitted
+	}
+	return check.RetryAfter, nil
+}
+
+// Wait mirrors rate.Limiter.Wait: it blocks until the request for the key is permitted
+// and counted, or returns an error when the context ends first. Like the rate package,
+// it fails right away when the delay would go past the context deadline.
+func (s *Service) Wait(ctx context.Context, key string) error {
+	for {
+		delay, err := s.Reserve(ctx, key)
+		if err != nil || delay == 0 {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return ErrNeverPermitted
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve checks the key like checkRateLimit, except that a request over the limit
+// blocks the key for a single second, the window, instead of its block time, and never
+// escalates: a caller that waits for its turn should get it as soon as the next window
+// opens.
+func (s *Service) reserve(ctx context.Context, key string, isToken bool, cost int) (rateLimitCheck, error) {
+	return s.checkRateLimitWithBlock(ctx, key, isToken, cost, time.Second, ratelimiter.Escalation{})
+}
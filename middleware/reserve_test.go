@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"context"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceReserve(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit: 1,
+		IPBlockTime: 60,
+		TokenLimits: map[string]int{"blocked": 0},
+	}, storage.NewMemoryStorage())
+	ctx := context.Background()
+
+	delay, err := service.Reserve(ctx, "10.0.0.1")
+	require.NoError(t, err)
+	assert.Zero(t, delay)
+
+	delay, err = service.Reserve(ctx, "10.0.0.1")
+	require.NoError(t, err)
+	assert.Greater(t, delay, time.Duration(0))
+	assert.LessOrEqual(t, delay, time.Second, "only the next window is waited for, not the block time")
+
+	_, err = service.Reserve(ctx, "token:blocked")
+	assert.ErrorIs(t, err, ErrNeverPermitted)
+}
+
+func TestServiceWait(t *testing.T) {
+	service := NewService(storage.Config{IPRateLimit: 1, IPBlockTime: 60}, storage.NewMemoryStorage())
+	ctx := context.Background()
+
+	require.NoError(t, service.Wait(ctx, "10.0.0.1"))
+	start := time.Now()
+	require.NoError(t, service.Wait(ctx, "10.0.0.1"))
+	assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+
+	shortCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, service.Wait(shortCtx, "10.0.0.1"), ErrNeverPermitted, "the delay goes past the deadline")
+}
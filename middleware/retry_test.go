@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"rate-limiter/ratelimitertest"
+	"rate-limiter/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryStorage(t *testing.T) {
+	fake := ratelimitertest.NewFakeStorage()
+	service := NewService(storage.Config{IPRateLimit: 5}, storage.NewRetryStorage(fake, 2, time.Millisecond))
+
+	fake.FailOn("AllowWindows", fmt.Errorf("dial tcp 127.0.0.1:6379: %w", syscall.ECONNREFUSED))
+	_, err := service.checkRateLimit(context.Background(), "10.0.0.1", false, 1)
+	assert.Error(t, err)
+	assert.Equal(t, 3, fake.Calls("AllowWindows"), "a refused connection is tried again twice")
+
+	fake.FailOn("AllowWindows", errors.New("i/o timeout"))
+	_, err = service.checkRateLimit(context.Background(), "10.0.0.2", false, 1)
+	assert.Error(t, err)
+	assert.Equal(t, 4, fake.Calls("AllowWindows"), "a timed out command may have run, it is not retried")
+
+	fake.FailOn("AllowWindows", nil)
+	check, err := service.checkRateLimit(context.Background(), "10.0.0.3", false, 1)
+	assert.NoError(t, err)
+	assert.True(t, check.Allowed)
+}
+
+func TestStorageTimeout(t *testing.T) {
+	fake := ratelimitertest.NewFakeStorage()
+	fake.SetLatency(time.Second)
+	service := NewService(storage.Config{IPRateLimit: 5, StorageTimeout: 20, OnStorageError: storage.OnStorageErrorDeny}, fake)
+
+	start := time.Now()
+	verdict := service.Evaluate("10.0.0.1", "", "GET", "/", 1)
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "STORAGE_TIMEOUT_MS bounds the check")
+	assert.False(t, verdict.Allowed)
+	assert.Equal(t, "storage_error", verdict.Reason)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	service = NewService(storage.Config{IPRateLimit: 5}, fake)
+	_, err := service.checkRateLimit(ctx, "10.0.0.1", false, 1)
+	assert.ErrorIs(t, err, context.Canceled, "the check stops with the request")
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"sort"
+	"strings"
+)
+
+// routeTable matches requests against "[METHOD ]/path/prefix" routes, trying the longest
+// prefix first and, for the same prefix, a route of the method before one of any method
+type routeTable[T any] []routeEntry[T]
+
+type routeEntry[T any] struct {
+	method string
+	prefix string
+	value  T
+}
+
+func newRouteTable[T any](routes map[string]T) routeTable[T] {
+	table := make(routeTable[T], 0, len(routes))
+	for route, value := range routes {
+		method, prefix, found := strings.Cut(route, " ")
+		if !found {
+			method, prefix = "", route
+		}
+		table = append(table, routeEntry[T]{method: strings.ToUpper(method), prefix: prefix, value: value})
+	}
+	sort.Slice(table, func(i, j int) bool {
+		if len(table[i].prefix) != len(table[j].prefix) {
+			return len(table[i].prefix) > len(table[j].prefix)
+		}
+		return table[i].method > table[j].method
+	})
+	return table
+}
+
+// match returns the value of the first route matching the method and path
+func (t routeTable[T]) match(method, path string) (T, bool) {
+	for _, route := range t {
+		if (route.method == "" || route.method == method) && strings.HasPrefix(path, route.prefix) {
+			return route.value, true
+		}
+	}
+	var zero T
+	return zero, false
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFakeVault(t *testing.T, password *string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/secret/data/redis":
+			w.Write([]byte(`{"data":{"data":{"password":"` + *password + `"}}}`))
+		case "/v1/kv/admin":
+			w.Write([]byte(`{"data":{"value":"admin-secret"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSecretsFromVault(t *testing.T) {
+	password := "first"
+	vault := newFakeVault(t, &password)
+
+	t.Setenv("SECRETS_PROVIDER", "vault")
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "vault-token")
+	t.Setenv("REDIS_PASSWORD_FROM_SECRET", "secret/data/redis#password")
+	t.Setenv("ADMIN_TOKEN_FROM_SECRET", "kv/admin")
+	t.Setenv("REDIS_PASSWORD", "")
+	t.Setenv("ADMIN_TOKEN", "")
+
+	secrets, err := storage.LoadSecrets(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, secrets)
+
+	assert.True(t, secrets.Has("REDIS_PASSWORD"))
+	assert.Equal(t, "first", os.Getenv("REDIS_PASSWORD"))
+	assert.Equal(t, "admin-secret", os.Getenv("ADMIN_TOKEN"))
+
+	appConfig, err := storage.LoadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "first", appConfig.Storage.Password)
+	assert.Equal(t, "admin-secret", appConfig.RateLimit.AdminToken)
+
+	t.Run("rotation", func(t *testing.T) {
+		password = "second"
+
+		changed, err := secrets.Refresh(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"REDIS_PASSWORD"}, changed)
+		assert.Equal(t, "second", secrets.Get("REDIS_PASSWORD"))
+	})
+
+	t.Run("missing field", func(t *testing.T) {
+		t.Setenv("REDIS_PASSWORD_FROM_SECRET", "secret/data/redis#user")
+
+		_, err := storage.LoadSecrets(context.Background())
+		assert.Error(t, err)
+	})
+}
+
+func TestNewSecretsProvider(t *testing.T) {
+	t.Setenv("SECRETS_PROVIDER", "")
+	provider, err := storage.NewSecretsProvider()
+	assert.NoError(t, err)
+	assert.Nil(t, provider)
+
+	t.Setenv("SECRETS_PROVIDER", "vault")
+	t.Setenv("VAULT_ADDR", "")
+	_, err = storage.NewSecretsProvider()
+	assert.Error(t, err)
+
+	t.Setenv("SECRETS_PROVIDER", "aws")
+	t.Setenv("AWS_REGION", "us-east-1")
+	provider, err = storage.NewSecretsProvider()
+	assert.NoError(t, err)
+	assert.IsType(t, &storage.AWSSecretsManagerProvider{}, provider)
+
+	t.Setenv("SECRETS_PROVIDER", "keychain")
+	_, err = storage.NewSecretsProvider()
+	assert.Error(t, err)
+}
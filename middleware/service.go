@@ -2,104 +2,770 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"log/slog"
+	"net/http"
 	ratelimiter "rate-limiter"
 	"rate-limiter/storage"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrReloadNotSupported is returned when the service has no way to re-read its configuration
+var ErrReloadNotSupported = errors.New("config reload is not supported")
+
 type Service struct {
-	config  storage.Config
-	storage ratelimiter.Storage
+	configMu sync.RWMutex
+	config   storage.Config
+	reloader func(ctx context.Context) error
+
+	storage   ratelimiter.Storage
+	keyHasher *storage.HashedStorage
+	denylist  *Denylist
+	extractor KeyExtractor
+	validator *APIKeyValidator
+	clientIP  *ClientIPResolver
+	jwt       *JWTVerifier
+	geoIP     *GeoIP
+
+	healthChecks  *HealthCheckDetector
+	fingerprints  *Fingerprinter
+	networks      *NetworkLimiter
+	costs         *CostResolver
+	quotaLocation *time.Location
+	concurrency   *ConcurrencyLimiter
+	bandwidth     *BandwidthLimiter
+	routePolicies routeTable[string]
+	throttle      *Throttle
+	quotaAlerts   *QuotaAlerter
+	errorBudget   *ErrorBudget
+	failures      *FailureLimiter
+	format        *ResponseFormat
+	hooks         []Hook
+
+	mu           sync.RWMutex
+	tokenConfigs map[string]*ratelimiter.TokenConfig
+	transferMu   sync.Mutex
+
+	allowedRequests   atomic.Uint64
+	deniedRequests    atomic.Uint64
+	storageErrors     atomic.Uint64
+	zeroLimitBlocks   atomic.Uint64
+	unlimitedChecks   atomic.Uint64
+	clearedBlocks     atomic.Uint64
+	globalLimitBlocks atomic.Uint64
+	readOnlyChecks    atomic.Uint64
+	clientErrors      atomic.Uint64
+	errorBudgetBlocks atomic.Uint64
+	refunds           atomic.Uint64
+	failureBlocks     atomic.Uint64
+	readOnly          *storage.ReadOnlyStorage
+	snapshots         *SnapshotRecorder
+	decisions         *DecisionBroadcaster
+	analyzer          *TrafficAnalyzer
+	usage             *UsageRecorder
+	rejections        *RejectionCounter
+	responseCache     *ResponseCache
+	messages          *Messages
+	elector           *Elector
+	canary            *Canary
+	archive           storage.ObjectStore
+	clock             ratelimiter.Clock
+
+	limiterOnce sync.Once
+	limiters    map[string]*ratelimiter.Limiter
 }
 
 func NewService(config storage.Config, rateLimitStorage ratelimiter.Storage) *Service {
-	return &Service{
-		config:  config,
-		storage: rateLimitStorage,
+	var keyHasher *storage.HashedStorage
+	storedKeys := rateLimitStorage
+	if config.KeyHashingEnabled {
+		keyHasher = storage.NewHashedStorage(rateLimitStorage, config.KeyHashSecret)
+		rateLimitStorage, storedKeys = keyHasher, keyHasher.StoredKeys()
 	}
-}
 
-func (s *Service) CheckRateLimit(key string, isToken bool) (bool, error) {
-	ctx := context.Background()
+	service := &Service{
+		config:    config,
+		storage:   rateLimitStorage,
+		keyHasher: keyHasher,
+		extractor: NewKeyExtractor(config),
+		decisions: NewDecisionBroadcaster(),
+		analyzer:  NewTrafficAnalyzer(),
+
+		healthChecks:  NewHealthCheckDetector(config),
+		fingerprints:  NewFingerprinter(config),
+		networks:      NewNetworkLimiter(config),
+		costs:         NewCostResolver(config),
+		concurrency:   NewConcurrencyLimiter(config),
+		bandwidth:     NewBandwidthLimiter(config),
+		routePolicies: newRouteTable(config.RoutePolicies),
+		throttle:      NewThrottle(config),
+		quotaAlerts:   NewQuotaAlerter(config),
+		errorBudget:   NewErrorBudget(config, rateLimitStorage),
+		failures:      NewFailureLimiter(config),
+		format:        NewResponseFormat(config),
+		responseCache: NewResponseCache(config),
+		canary:        NewCanary(config, rateLimitStorage),
+		rejections:    NewRejectionCounter(storedKeys, time.Duration(config.KeyStatsRetention)*24*time.Hour),
+		hooks:         registeredHooks(),
+	}
+
+	entries := make([]string, len(config.Denylist))
+	for i, entry := range config.Denylist {
+		entries[i] = service.banValue(entry)
+	}
+	service.denylist = NewDenylist(entries)
+
+	if config.MessagesFile != "" {
+		messages, err := LoadMessages(config.MessagesFile)
+		if err != nil {
+			slog.Warn("Using the default error messages", "error", err)
+		}
+		service.messages = messages
+	}
 
-	rateLimit, err := s.storage.Get(ctx, key)
+	if config.QuotaTimezone != "" {
+		location, err := time.LoadLocation(config.QuotaTimezone)
+		if err != nil {
+			slog.Warn("Quotas roll over in UTC", "error", err)
+		}
+		service.quotaLocation = location
+	}
+
+	if config.UsageEnabled {
+		service.usage = NewUsageRecorder(rateLimitStorage, time.Duration(config.UsageRawRetention)*time.Second)
+	}
+
+	clientIP, err := NewClientIPResolver(config.TrustedProxies, config.ClientIPHeaders)
 	if err != nil {
-		return false, err
+		slog.Warn("Forwarded headers will not be trusted", "error", err)
+		clientIP = &ClientIPResolver{}
 	}
+	service.clientIP = clientIP
 
-	if rateLimit == nil {
-		rateLimit = &ratelimiter.RateLimit{
-			Count:     0,
-			LastReset: time.Now(),
-			BlockedAt: time.Time{},
+	jwt, err := NewJWTVerifier(config)
+	if err != nil {
+		slog.Warn("JWTs will be rejected", "error", err)
+		jwt = &JWTVerifier{}
+	}
+	service.jwt = jwt
+
+	geoIP, err := NewGeoIP(config)
+	if err != nil {
+		slog.Warn("Clients will not be located", "error", err)
+	}
+	service.geoIP = geoIP
+
+	if config.APIKeyStrict {
+		validator, err := NewAPIKeyValidator(config)
+		if err != nil {
+			slog.Warn("Using the default API key pattern", "error", err)
+			config.APIKeyPattern = ""
+			validator, _ = NewAPIKeyValidator(config)
 		}
+		service.validator = validator
+	}
+
+	return service
+}
+
+func (s *Service) Config() storage.Config {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+
+	return s.config
+}
+
+// storageKey returns the key the storage keeps for the key of a client, its hash with
+// KEY_HASHING_ENABLED
+func (s *Service) storageKey(key string) string {
+	if s.keyHasher == nil {
+		return key
 	}
+	return s.keyHasher.HashKey(key)
+}
 
-	limit := s.getLimit(key, isToken)
-	blockTime := s.getBlockTime(key, isToken)
+// adminKey is storageKey for a key entered by an admin, which may be a listed one
+// already hashed
+func (s *Service) adminKey(key string) string {
+	if s.keyHasher == nil {
+		return key
+	}
+	return s.keyHasher.StoredKey(key)
+}
 
-	if s.shouldResetWindow(rateLimit) {
-		rateLimit.Count = 0
-		rateLimit.LastReset = time.Now()
-		rateLimit.BlockedAt = time.Time{}
+// adminStorage is the storage of the admin API, which takes keys through adminKey
+func (s *Service) adminStorage() ratelimiter.Storage {
+	if s.keyHasher == nil {
+		return s.storage
 	}
+	return s.keyHasher.StoredKeys()
+}
 
-	if s.isBlocked(rateLimit, blockTime) {
-		return false, nil
+// banValue returns the value the storage keeps for a denylist entry: with
+// KEY_HASHING_ENABLED the token of a token ban is hashed like its key
+func (s *Service) banValue(entry string) string {
+	if !strings.HasPrefix(entry, "token:") {
+		return entry
 	}
+	return s.adminKey(entry)
+}
 
-	if rateLimit.Count >= limit {
-		rateLimit.BlockedAt = time.Now()
-		expiration := time.Duration(blockTime) * time.Second
-		if err := s.storage.Set(ctx, key, rateLimit, expiration); err != nil {
-			return false, err
+// tokenName returns the name the registry keeps for the token of a client, hashed like
+// the token part of its key with KEY_HASHING_ENABLED
+func (s *Service) tokenName(name string) string {
+	return strings.TrimPrefix(s.storageKey("token:"+name), "token:")
+}
+
+// adminTokenName is tokenName for a name entered by an admin, which may be a listed one
+func (s *Service) adminTokenName(name string) string {
+	return strings.TrimPrefix(s.adminKey("token:"+name), "token:")
+}
+
+// Reload swaps in a new config and reconciles the config-sourced denylist entries,
+// unless the storage is read-only. Key extraction, API key validation, trusted proxies,
+// health check detection, the quota timezone, the concurrency limit, throttling, quota
+// alert delivery, the response format, the response cache, the storage canary, the
+// error budget, the route policies, the limited networks, the GeoIP databases with their
+// policies and blocks, and whether concurrency and bandwidth are capped at all keep the
+// settings they were built with at startup.
+func (s *Service) Reload(ctx context.Context, config storage.Config) error {
+	s.configMu.Lock()
+	s.config = config
+	s.configMu.Unlock()
+
+	if s.IsReadOnly() {
+		return nil
+	}
+
+	configured := make(map[string]struct{}, len(config.Denylist))
+	for _, entry := range config.Denylist {
+		configured[s.banValue(entry)] = struct{}{}
+	}
+
+	bans, err := s.storage.ListBans(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ban := range bans {
+		if _, exists := configured[ban.Value]; ban.Reason == "config" && !exists {
+			if err := s.storage.RemoveBan(ctx, ban.Value); err != nil {
+				return err
+			}
 		}
-		return false, nil
 	}
 
-	rateLimit.Count++
-	expiration := time.Duration(blockTime) * time.Second
-	if err := s.storage.Set(ctx, key, rateLimit, expiration); err != nil {
-		return false, err
+	return s.SeedDenylist(ctx)
+}
+
+// SetReloader sets the function that re-reads the configuration from its sources,
+// used by SIGHUP and POST /admin/reload
+func (s *Service) SetReloader(reloader func(ctx context.Context) error) {
+	s.reloader = reloader
+}
+
+// ReloadConfig re-reads the configuration through the reloader
+func (s *Service) ReloadConfig(ctx context.Context) error {
+	if s.reloader == nil {
+		return ErrReloadNotSupported
 	}
+	return s.reloader(ctx)
+}
+
+func (s *Service) keyExtractor() KeyExtractor {
+	if s.extractor == nil {
+		return func(r *http.Request) (string, bool) {
+			apiKey := getAPIKey(r)
+			return apiKey, apiKey != ""
+		}
+	}
+	return s.extractor
+}
+
+// ResponseFormat returns the serialization profile of the JSON responses
+func (s *Service) ResponseFormat() *ResponseFormat {
+	return s.format
+}
+
+// Messages returns the translated error messages, nil when only English is configured
+func (s *Service) Messages() *Messages {
+	return s.messages
+}
+
+// ClientIP returns the client IP of a request, trusting forwarded headers as the
+// middleware does
+func (s *Service) ClientIP(r *http.Request) string {
+	return s.clientIP.ClientIP(r)
+}
+
+// ClientIPHeaders returns the headers ClientIP reads the client IP from behind a
+// trusted proxy, for adapters building the request it is given
+func (s *Service) ClientIPHeaders() []string {
+	return s.clientIP.Headers()
+}
+
+// SetClock sets the clock the windows, blocks and quotas of the service are measured
+// with. The storage keeps its own clock for expirations, see MemoryStorage.SetClock.
+func (s *Service) SetClock(clock ratelimiter.Clock) {
+	s.clock = clock
+}
+
+// now reads the clock of the service, the system clock unless SetClock was called
+func (s *Service) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock.Now()
+}
+
+// SetSnapshotRecorder enables sampling of blocked requests
+func (s *Service) SetSnapshotRecorder(recorder *SnapshotRecorder) {
+	s.snapshots = recorder
+}
+
+// StorageErrors returns how many rate limit checks failed because of the storage backend
+func (s *Service) StorageErrors() uint64 {
+	return s.storageErrors.Load()
+}
+
+// ZeroLimitBlocks returns how many requests were blocked because their limit is 0
+func (s *Service) ZeroLimitBlocks() uint64 {
+	return s.zeroLimitBlocks.Load()
+}
+
+// UnlimitedChecks returns how many requests skipped the limit because it is negative
+func (s *Service) UnlimitedChecks() uint64 {
+	return s.unlimitedChecks.Load()
+}
 
-	return true, nil
+// GlobalLimitBlocks returns how many requests were refused by GLOBAL_RATE_LIMIT
+func (s *Service) GlobalLimitBlocks() uint64 {
+	return s.globalLimitBlocks.Load()
 }
 
-func (s *Service) isBlocked(rateLimit *ratelimiter.RateLimit, blockTime int) bool {
-	if rateLimit.BlockedAt.IsZero() {
+// Stats are the counters of a service, exposed per app by the admin API
+type Stats struct {
+	Allowed           uint64 `json:"allowed"`
+	Denied            uint64 `json:"denied"`
+	StorageErrors     uint64 `json:"storage_errors"`
+	ZeroLimitBlocks   uint64 `json:"zero_limit_blocks"`
+	UnlimitedChecks   uint64 `json:"unlimited_checks"`
+	GlobalLimitBlocks uint64 `json:"global_limit_blocks"`
+	ClearedBlocks     uint64 `json:"cleared_blocks"`
+	ReadOnly          bool   `json:"read_only"`
+	ReadOnlyChecks    uint64 `json:"read_only_checks"`
+	ClientErrors      uint64 `json:"client_errors"`
+	ErrorBudgetBlocks uint64 `json:"error_budget_blocks"`
+	Refunds           uint64 `json:"refunds"`
+	FailureBlocks     uint64 `json:"failure_blocks"`
+
+	Canary *CanaryStatus `json:"canary,omitempty"`
+}
+
+func (s *Service) Stats() Stats {
+	return Stats{
+		Allowed:           s.allowedRequests.Load(),
+		Denied:            s.deniedRequests.Load(),
+		StorageErrors:     s.StorageErrors(),
+		ZeroLimitBlocks:   s.ZeroLimitBlocks(),
+		UnlimitedChecks:   s.UnlimitedChecks(),
+		GlobalLimitBlocks: s.GlobalLimitBlocks(),
+		ClearedBlocks:     s.ClearedBlocks(),
+		ReadOnly:          s.IsReadOnly(),
+		ReadOnlyChecks:    s.ReadOnlyChecks(),
+		ClientErrors:      s.ClientErrors(),
+		ErrorBudgetBlocks: s.ErrorBudgetBlocks(),
+		Refunds:           s.Refunds(),
+		FailureBlocks:     s.FailureBlocks(),
+		Canary:            s.CanaryStatus(),
+	}
+}
+
+// handleStorageError records a failed check and applies the ON_STORAGE_ERROR policy,
+// returning whether the request is allowed through
+func (s *Service) handleStorageError(key string, err error) bool {
+	s.storageErrors.Add(1)
+
+	allowed := s.Config().OnStorageError != storage.OnStorageErrorDeny
+	slog.Error("Rate limit check failed", "key", storage.RedactKey(key), "allowed", allowed, "error", err)
+
+	return allowed
+}
+
+func (s *Service) IsDenied(clientIP, key string) bool {
+	if s.denylist == nil {
 		return false
 	}
-	return time.Since(rateLimit.BlockedAt).Seconds() < float64(blockTime)
+	return s.denylist.IsDenied(clientIP, s.storageKey(key))
 }
 
-func (s *Service) shouldResetWindow(rateLimit *ratelimiter.RateLimit) bool {
-	return time.Since(rateLimit.LastReset).Seconds() >= 1.0
+// SeedDenylist persists the configured denylist entries that are not stored yet
+func (s *Service) SeedDenylist(ctx context.Context) error {
+	bans, err := s.storage.ListBans(ctx)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]struct{}, len(bans))
+	for _, ban := range bans {
+		existing[ban.Value] = struct{}{}
+	}
+
+	for _, entry := range s.Config().Denylist {
+		if _, exists := existing[s.banValue(entry)]; exists {
+			continue
+		}
+		if err := ValidateDenylistEntry(entry); err != nil {
+			slog.Warn("Skipping denylist entry", "error", err)
+			continue
+		}
+		ban := &ratelimiter.Ban{Value: entry, Reason: "config", CreatedAt: s.now()}
+		if err := s.storage.AddBan(ctx, ban); err != nil {
+			return err
+		}
+	}
+
+	return s.SyncDenylist(ctx)
 }
 
-func (s *Service) getLimit(key string, isToken bool) int {
-	if isToken {
-		tokenParts := strings.Split(key, ":")
-		if len(tokenParts) == 2 {
-			tokenName := tokenParts[1]
-			if limit, exists := s.config.TokenLimits[tokenName]; exists {
-				return limit
+// SyncDenylist reloads the in-memory denylist from storage
+func (s *Service) SyncDenylist(ctx context.Context) error {
+	bans, err := s.storage.ListBans(ctx)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]string, 0, len(bans))
+	for _, ban := range bans {
+		entries = append(entries, ban.Value)
+	}
+	s.denylist.Replace(entries)
+
+	return nil
+}
+
+// SyncTokenConfigs reloads the dynamic token configs from storage
+func (s *Service) SyncTokenConfigs(ctx context.Context) error {
+	list, err := s.storage.ListTokenConfigs(ctx)
+	if err != nil {
+		return err
+	}
+
+	tokenConfigs := make(map[string]*ratelimiter.TokenConfig, len(list))
+	for _, tokenConfig := range list {
+		tokenConfigs[tokenConfig.Name] = tokenConfig
+	}
+
+	s.mu.Lock()
+	s.tokenConfigs = tokenConfigs
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *Service) getTokenConfig(tokenName string) (*ratelimiter.TokenConfig, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokenConfig, exists := s.tokenConfigs[s.tokenName(tokenName)]
+	return tokenConfig, exists
+}
+
+// Sync reloads every piece of storage-backed configuration
+func (s *Service) Sync(ctx context.Context) error {
+	if err := s.SyncDenylist(ctx); err != nil {
+		return err
+	}
+	return s.SyncTokenConfigs(ctx)
+}
+
+// RunSync periodically syncs storage-backed configuration so changes made on other instances apply here
+func (s *Service) RunSync(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Sync(ctx); err != nil {
+				slog.Error("Failed to sync configuration", "error", err)
 			}
 		}
 	}
-	return s.config.IPRateLimit
 }
 
+func (s *Service) AddBan(ctx context.Context, value, reason string) (*ratelimiter.Ban, error) {
+	if err := ValidateDenylistEntry(value); err != nil {
+		return nil, err
+	}
+
+	ban := &ratelimiter.Ban{Value: value, Reason: reason, CreatedAt: s.now()}
+	if err := s.storage.AddBan(ctx, ban); err != nil {
+		return nil, err
+	}
+
+	return ban, s.SyncDenylist(ctx)
+}
+
+func (s *Service) RemoveBan(ctx context.Context, value string) error {
+	if err := s.storage.RemoveBan(ctx, value); err != nil {
+		return err
+	}
+	return s.SyncDenylist(ctx)
+}
+
+func (s *Service) ListBans(ctx context.Context) ([]*ratelimiter.Ban, error) {
+	return s.storage.ListBans(ctx)
+}
+
+// CheckRateLimit consumes cost units of the key's quota, reporting whether they fit
+func (s *Service) CheckRateLimit(key string, isToken bool, cost int) (bool, error) {
+	result, err := s.checkRateLimit(context.Background(), key, isToken, cost)
+	if err != nil {
+		return false, err
+	}
+	return result.Allowed, nil
+}
+
+// globalKey counts the requests of every client together for GLOBAL_RATE_LIMIT
+const globalKey = "global"
+
+// rateLimitCheck is the outcome of checkRateLimit: the window result and the state of
+// the daily and monthly quotas of the key
+type rateLimitCheck struct {
+	ratelimiter.Result
+	Quotas        []QuotaStatus
+	QuotaExceeded bool
+	GlobalLimited bool
+	OriginLimited bool
+	// NetworkLimited is set when NETWORK_LIMITS refused the network of the client
+	NetworkLimited bool
+	// CheckedAt is when an allowed check consumed its cost, for refunds
+	CheckedAt time.Time
+}
+
+func (c rateLimitCheck) reason() string {
+	if c.GlobalLimited {
+		return "global_limit"
+	}
+	if c.QuotaExceeded {
+		return "quota_exceeded"
+	}
+	if c.OriginLimited {
+		return "origin_limit"
+	}
+	if c.NetworkLimited {
+		return "network_limit"
+	}
+	return limitReason(c.Result)
+}
+
+// checkRateLimit checks the global limit first, then the quotas before the window so a
+// request refused by either consumes neither; the quotas are charged only once the
+// window allowed it
+func (s *Service) checkRateLimit(ctx context.Context, key string, isToken bool, cost int) (rateLimitCheck, error) {
+	return s.checkRateLimitWithBlock(ctx, key, isToken, cost, time.Duration(s.getBlockTime(key, isToken))*time.Second, s.escalation())
+}
+
+// checkRateLimitWithBlock is checkRateLimit with the block time and escalation of the
+// key overridden
+func (s *Service) checkRateLimitWithBlock(ctx context.Context, key string, isToken bool, cost int, blockTime time.Duration, escalation ratelimiter.Escalation) (rateLimitCheck, error) {
+	ctx, cancel := s.storageContext(ctx)
+	defer cancel()
+	cost = max(cost, 1)
+	if s.IsReadOnly() {
+		s.readOnlyChecks.Add(1)
+	}
+	algorithm, bucketSize := s.getAlgorithm(key, isToken)
+	limits := ratelimiter.Limits{
+		Limit:      s.getLimit(key, isToken),
+		BlockTime:  blockTime,
+		BucketSize: bucketSize,
+		Window:     s.getWindow(key, isToken),
+		Escalation: escalation,
+	}
+
+	if globalLimit := s.Config().GlobalRateLimit; globalLimit > 0 {
+		global := ratelimiter.Limits{Limit: globalLimit, BlockTime: time.Second}
+		result, err := s.rateLimiter(ratelimiter.AlgorithmFixedWindow).AllowLimitsN(ctx, globalKey, global, cost)
+		if err != nil {
+			return rateLimitCheck{}, err
+		}
+		if !result.Allowed {
+			s.globalLimitBlocks.Add(1)
+			return rateLimitCheck{Result: result, GlobalLimited: true}, nil
+		}
+	}
+
+	now := s.now()
+	var quotas []*quota
+	if limits.Limit != 0 {
+		quotas = s.quotas(key, isToken, now)
+	}
+	if len(quotas) > 0 {
+		fits, err := s.readQuotas(ctx, quotaKey(key), quotas, cost)
+		if err != nil {
+			return rateLimitCheck{}, err
+		}
+		if !fits {
+			return rateLimitCheck{
+				Result:        ratelimiter.Result{Limit: limits.Limit, RetryAfter: quotaRetryAfter(quotas, cost, now)},
+				Quotas:        quotaStatuses(quotas),
+				QuotaExceeded: true,
+			}, nil
+		}
+	}
+
+	result, err := s.rateLimiter(algorithm).AllowWindowsN(ctx, key, limits, s.getWindows(key, isToken), cost)
+	if err != nil {
+		return rateLimitCheck{}, err
+	}
+
+	switch {
+	case limits.Limit == 0:
+		s.zeroLimitBlocks.Add(1)
+	case limits.Limit < 0:
+		s.unlimitedChecks.Add(1)
+	}
+
+	if result.Allowed {
+		if err := s.consumeQuotas(ctx, quotaKey(key), quotas, cost, now); err != nil {
+			return rateLimitCheck{}, err
+		}
+		s.alertQuotas(ctx, key, isToken, quotas, cost)
+		s.recordUsage(key, cost)
+		// the limiter read its own clock, a window it started is not after this one
+		return rateLimitCheck{Result: result, Quotas: quotaStatuses(quotas), CheckedAt: s.now()}, nil
+	}
+	return rateLimitCheck{Result: result, Quotas: quotaStatuses(quotas)}, nil
+}
+
+// storageContext bounds the storage calls of a check by STORAGE_TIMEOUT_MS, on top of
+// the deadline and cancellation of the caller
+func (s *Service) storageContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := s.Config().StorageTimeout; timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+	}
+	return ctx, func() {}
+}
+
+// rateLimiter returns the limiter of the algorithm over the service storage, the limits
+// are resolved per request by CheckRateLimit
+func (s *Service) rateLimiter(algorithm string) *ratelimiter.Limiter {
+	s.limiterOnce.Do(func() {
+		algorithms := ratelimiter.Algorithms()
+		s.limiters = make(map[string]*ratelimiter.Limiter, len(algorithms))
+		for _, algorithm := range algorithms {
+			s.limiters[algorithm], _ = ratelimiter.NewLimiter(ratelimiter.WithStorage(s.storage), ratelimiter.WithAlgorithm(algorithm), ratelimiter.WithClock(s.now))
+		}
+	})
+	if limiter, exists := s.limiters[algorithm]; exists {
+		return limiter
+	}
+	return s.limiters[ratelimiter.AlgorithmFixedWindow]
+}
+
+func (s *Service) getLimit(key string, isToken bool) int {
+	return s.policy(key, isToken).Limit
+}
+
+// escalation returns the block escalation of BLOCK_ESCALATION_FACTOR, capped at BLOCK_MAX
+// and never past MAX_BLOCK_TIME, whose sweep would lift longer blocks anyway
+func (s *Service) escalation() ratelimiter.Escalation {
+	config := s.Config()
+	if config.BlockEscalationFactor <= 1 {
+		return ratelimiter.Escalation{}
+	}
+
+	maxBlock := config.BlockMax
+	if config.MaxBlockTime > 0 && (maxBlock <= 0 || maxBlock > config.MaxBlockTime) {
+		maxBlock = config.MaxBlockTime
+	}
+	return ratelimiter.Escalation{
+		Factor:       config.BlockEscalationFactor,
+		MaxBlockTime: time.Duration(maxBlock) * time.Second,
+		Decay:        time.Duration(config.BlockEscalationDecay) * time.Second,
+	}
+}
+
+// getAlgorithm returns the algorithm and bucket size of the key
+func (s *Service) getAlgorithm(key string, isToken bool) (string, int) {
+	policy := s.policy(key, isToken)
+	if policy.Algorithm == "" {
+		return ratelimiter.AlgorithmFixedWindow, policy.Burst
+	}
+	return policy.Algorithm, policy.Burst
+}
+
+// getWindow returns the window of the key, 0 for the one second window of the limiters
+func (s *Service) getWindow(key string, isToken bool) time.Duration {
+	return time.Duration(s.policy(key, isToken).Window) * time.Second
+}
+
+// getWindows returns the windows stacked on the window of the key, counted under
+// ratelimiter.WindowKey
+func (s *Service) getWindows(key string, isToken bool) []ratelimiter.Window {
+	return s.policy(key, isToken).Windows
+}
+
+// getBlockTime returns the block time of the key, capped at MAX_BLOCK_TIME
 func (s *Service) getBlockTime(key string, isToken bool) int {
-	if isToken {
-		tokenParts := strings.Split(key, ":")
-		if len(tokenParts) == 2 {
-			tokenName := tokenParts[1]
-			if blockTime, exists := s.config.TokenBlockTimes[tokenName]; exists {
-				return blockTime
-			}
+	blockTime := s.policy(key, isToken).BlockTime
+	if maxBlockTime := s.Config().MaxBlockTime; maxBlockTime > 0 && blockTime > maxBlockTime {
+		return maxBlockTime
+	}
+	return blockTime
+}
+
+// policy resolves the policy of the key. The WebSocket and health check pools keep
+// their own limits and a route policy key gets its policy; an mTLS identity gets its
+// MTLS_IDENTITY_* limits, a token gets the token config managed at runtime first, over
+// TOKEN_<name>_* otherwise, and everything else the default policy.
+func (s *Service) policy(key string, isToken bool) storage.Policy {
+	config := s.Config()
+
+	if strings.HasPrefix(key, webSocketKeyPrefix) {
+		return storage.Policy{Limit: config.WebSocketRateLimit, BlockTime: config.WebSocketBlockTime}
+	}
+	if strings.HasPrefix(key, healthCheckKeyPrefix) {
+		return storage.Policy{Limit: config.HealthCheckPoolLimit, BlockTime: config.HealthCheckPoolBlockTime}
+	}
+	if name, _, found := cutPolicyKey(key); found {
+		if policy, exists := config.Policies[name]; exists {
+			return policy
+		}
+	}
+
+	if tier, _, found := cutTierKey(key); found {
+		if policy, exists := config.Policies[tier]; exists {
+			return policy
+		}
+	}
+	if identity, found := strings.CutPrefix(key, identityKeyPrefix); found {
+		return config.IdentityPolicy(identity)
+	}
+
+	tokenName, found := tokenOf(key)
+	if !isToken || !found || strings.Contains(tokenName, ":") {
+		return config.DefaultPolicy()
+	}
+
+	policy := config.TokenPolicy(tokenName)
+	if tokenConfig, exists := s.getTokenConfig(tokenName); exists {
+		if named, exists := config.Policies[tokenConfig.Policy]; exists {
+			return named
+		}
+		policy.Limit, policy.BlockTime = tokenConfig.Limit, tokenConfig.BlockTime
+		if tokenConfig.Algorithm != "" {
+			policy.Algorithm, policy.Burst = tokenConfig.Algorithm, tokenConfig.BucketSize
+		}
+		if tokenConfig.Window > 0 {
+			policy.Window = tokenConfig.Window
 		}
 	}
-	return s.config.IPBlockTime
+	return policy
 }
@@ -1,8 +1,10 @@
 package middleware
 
 import (
+	"context"
 	"os"
 	ratelimiter "rate-limiter"
+	"rate-limiter/ratelimitertest"
 	"rate-limiter/storage"
 	"testing"
 	"time"
@@ -44,6 +46,7 @@ func TestLoadConfig(t *testing.T) {
 		assert.Equal(t, 10, config.RateLimit.IPRateLimit)
 		assert.Equal(t, 300, config.RateLimit.IPBlockTime)
 		assert.Equal(t, "8080", config.RateLimit.ServerPort)
+		assert.Equal(t, 30, config.RateLimit.ShutdownTimeout)
 		assert.NotNil(t, config.RateLimit.TokenLimits)
 		assert.NotNil(t, config.RateLimit.TokenBlockTimes)
 	})
@@ -98,6 +101,53 @@ func TestGetDefaultConfig(t *testing.T) {
 	assert.Equal(t, 0, len(config.RateLimit.TokenBlockTimes))
 }
 
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, storage.Config{IPRateLimit: 0, IPBlockTime: -1}.Validate(), "block time is unused without a positive limit")
+	assert.NoError(t, storage.Config{IPRateLimit: -1, IPBlockTime: 300}.Validate())
+	assert.Error(t, storage.Config{IPRateLimit: 10, IPBlockTime: -1}.Validate())
+	assert.Error(t, storage.Config{
+		IPRateLimit:     10,
+		TokenLimits:     map[string]int{"gold": 5},
+		TokenBlockTimes: map[string]int{"gold": -5},
+	}.Validate())
+	assert.NoError(t, storage.Config{TokenAlgorithms: map[string]string{"gold": "leaky_bucket"}}.Validate())
+	assert.Error(t, storage.Config{TokenAlgorithms: map[string]string{"gold": "sliding_log"}}.Validate())
+	assert.Error(t, storage.Config{TokenBucketSizes: map[string]int{"gold": -1}}.Validate())
+	assert.NoError(t, storage.Config{BlockEscalationFactor: 5}.Validate())
+	assert.Error(t, storage.Config{BlockEscalationFactor: 0.5}.Validate())
+	assert.NoError(t, storage.Config{
+		Policies:      map[string]storage.Policy{"strict": {Algorithm: "fixed_window", Concurrency: 2}},
+		IPPolicy:      "strict",
+		RoutePolicies: map[string]string{"/login": "strict"},
+	}.Validate())
+	assert.Error(t, storage.Config{Policies: map[string]storage.Policy{"strict": {Algorithm: "sliding_log"}}}.Validate())
+	assert.Error(t, storage.Config{Policies: map[string]storage.Policy{"strict": {Algorithm: "fixed_window", Bandwidth: -1}}}.Validate())
+	assert.Error(t, storage.Config{RoutePolicies: map[string]string{"/login": "missing"}}.Validate())
+
+	err := storage.AppConfig{Apps: []storage.AppNamespace{
+		{Name: "billing", RateLimit: storage.Config{IPRateLimit: 1, IPBlockTime: -1}},
+	}}.Validate()
+	assert.ErrorContains(t, err, "app billing")
+}
+
+func TestConfigWarnings(t *testing.T) {
+	assert.Empty(t, storage.Config{IPRateLimit: 10, TokenLimits: map[string]int{"gold": -1}}.Warnings())
+
+	warnings := storage.Config{IPRateLimit: 0, TokenLimits: map[string]int{"gold": 0, "silver": 0}}.Warnings()
+	assert.Equal(t, []string{
+		"IP_RATE_LIMIT is 0, every request without an API key is blocked",
+		"TOKEN_gold_LIMIT is 0, every request with this token is blocked",
+		"TOKEN_silver_LIMIT is 0, every request with this token is blocked",
+		"IP and token limits are all 0, the rate limiter blocks every request",
+	}, warnings)
+
+	appConfig := storage.AppConfig{
+		RateLimit: storage.Config{IPRateLimit: 10},
+		Apps:      []storage.AppNamespace{{Name: "billing", RateLimit: storage.Config{IPRateLimit: 0}}},
+	}
+	assert.Equal(t, []string{"app billing: IP_RATE_LIMIT is 0, every request without an API key is blocked"}, appConfig.Warnings())
+}
+
 func TestNewService(t *testing.T) {
 	testStorage := createTestStorage(t)
 	defer testStorage.Close()
@@ -111,19 +161,46 @@ func TestNewService(t *testing.T) {
 
 // createTestStorage creates a Redis storage for testing
 func createTestStorage(t *testing.T) ratelimiter.Storage {
-	config := ratelimiter.StorageConfig{
-		Host:     "localhost",
-		Port:     "6379",
-		Password: "",
-		DB:       1, // Use DB 1 for tests
-	}
+	return ratelimitertest.RedisStorage(t)
+}
 
-	redisStorage, err := storage.NewRedisStorage(config)
-	if err != nil {
-		t.Skipf("Redis not available for testing: %v", err)
-	}
+func TestNewRedisStorageModes(t *testing.T) {
+	t.Run("sentinel_requires_master", func(t *testing.T) {
+		_, err := storage.NewRedisStorage(ratelimiter.StorageConfig{
+			Mode:      ratelimiter.RedisModeSentinel,
+			Addresses: []string{"localhost:26379"},
+		})
+		assert.ErrorContains(t, err, "master name")
+	})
 
-	return redisStorage
+	t.Run("tls_missing_ca", func(t *testing.T) {
+		_, err := storage.NewRedisStorage(ratelimiter.StorageConfig{
+			Host:       "localhost",
+			Port:       "6379",
+			TLSEnabled: true,
+			TLSCACert:  "/nonexistent/ca.pem",
+		})
+		assert.ErrorContains(t, err, "CA certificate")
+	})
+
+	t.Run("tls_invalid_client_cert", func(t *testing.T) {
+		_, err := storage.NewRedisStorage(ratelimiter.StorageConfig{
+			Host:       "localhost",
+			Port:       "6379",
+			TLSEnabled: true,
+			TLSCert:    "/nonexistent/client.pem",
+			TLSKey:     "/nonexistent/client.key",
+		})
+		assert.ErrorContains(t, err, "client certificate")
+	})
+
+	t.Run("cluster_unreachable", func(t *testing.T) {
+		_, err := storage.NewRedisStorage(ratelimiter.StorageConfig{
+			Mode:      ratelimiter.RedisModeCluster,
+			Addresses: []string{"127.0.0.1:1"},
+		})
+		assert.Error(t, err)
+	})
 }
 
 func TestServiceGetLimit(t *testing.T) {
@@ -222,65 +299,75 @@ func TestServiceGetBlockTime(t *testing.T) {
 	}
 }
 
-func TestServiceShouldResetWindow(t *testing.T) {
-	service := &Service{}
+func TestApplyWindowsResetsWindow(t *testing.T) {
+	now := time.Now()
+	check := []ratelimiter.WindowCheck{{Limits: ratelimiter.Limits{Limit: 10, BlockTime: 300 * time.Second}, Window: time.Second}}
 
 	t.Run("after_second", func(t *testing.T) {
 		rateLimit := &ratelimiter.RateLimit{
-			LastReset: time.Now().Add(-2 * time.Second),
+			Count:     5,
+			LastReset: now.Add(-2 * time.Second),
 		}
 
-		shouldReset := service.shouldResetWindow(rateLimit)
-		assert.True(t, shouldReset)
+		ratelimiter.ApplyWindows([]*ratelimiter.RateLimit{rateLimit}, check, 1, now)
+		assert.Equal(t, 1, rateLimit.Count)
+		assert.Equal(t, now, rateLimit.LastReset)
 	})
 
 	t.Run("before_second", func(t *testing.T) {
 		rateLimit := &ratelimiter.RateLimit{
-			LastReset: time.Now().Add(-500 * time.Millisecond),
+			Count:     5,
+			LastReset: now.Add(-500 * time.Millisecond),
 		}
 
-		shouldReset := service.shouldResetWindow(rateLimit)
-		assert.False(t, shouldReset)
+		ratelimiter.ApplyWindows([]*ratelimiter.RateLimit{rateLimit}, check, 1, now)
+		assert.Equal(t, 6, rateLimit.Count)
 	})
 
 	t.Run("exactly_second", func(t *testing.T) {
 		rateLimit := &ratelimiter.RateLimit{
-			LastReset: time.Now().Add(-1 * time.Second),
+			Count:     5,
+			LastReset: now.Add(-1 * time.Second),
 		}
 
-		shouldReset := service.shouldResetWindow(rateLimit)
-		assert.True(t, shouldReset)
+		ratelimiter.ApplyWindows([]*ratelimiter.RateLimit{rateLimit}, check, 1, now)
+		assert.Equal(t, 1, rateLimit.Count)
 	})
 }
 
-func TestServiceIsBlocked(t *testing.T) {
-	service := &Service{}
+func TestApplyWindowsBlocked(t *testing.T) {
+	now := time.Now()
+	check := []ratelimiter.WindowCheck{{Limits: ratelimiter.Limits{Limit: 10, BlockTime: 300 * time.Second}, Window: time.Second}}
 
 	t.Run("not_blocked_zero", func(t *testing.T) {
 		rateLimit := &ratelimiter.RateLimit{
+			LastReset: now,
 			BlockedAt: time.Time{},
 		}
 
-		isBlocked := service.isBlocked(rateLimit, 300)
-		assert.False(t, isBlocked)
+		result := ratelimiter.ApplyWindows([]*ratelimiter.RateLimit{rateLimit}, check, 1, now)
+		assert.True(t, result.Allowed)
 	})
 
 	t.Run("blocked_within_time", func(t *testing.T) {
 		rateLimit := &ratelimiter.RateLimit{
-			BlockedAt: time.Now().Add(-100 * time.Second),
+			LastReset: now,
+			BlockedAt: now.Add(-100 * time.Second),
 		}
 
-		isBlocked := service.isBlocked(rateLimit, 300)
-		assert.True(t, isBlocked)
+		result := ratelimiter.ApplyWindows([]*ratelimiter.RateLimit{rateLimit}, check, 1, now)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, 200*time.Second, result.RetryAfter)
 	})
 
 	t.Run("not_blocked_time_passed", func(t *testing.T) {
 		rateLimit := &ratelimiter.RateLimit{
-			BlockedAt: time.Now().Add(-400 * time.Second),
+			LastReset: now,
+			BlockedAt: now.Add(-400 * time.Second),
 		}
 
-		isBlocked := service.isBlocked(rateLimit, 300)
-		assert.False(t, isBlocked)
+		result := ratelimiter.ApplyWindows([]*ratelimiter.RateLimit{rateLimit}, check, 1, now)
+		assert.True(t, result.Allowed)
 	})
 }
 
@@ -297,7 +384,7 @@ func TestServiceCheckRateLimit(t *testing.T) {
 			storage: testStorage,
 		}
 
-		allowed, err := service.CheckRateLimit("192.168.1.1", false)
+		allowed, err := service.CheckRateLimit("192.168.1.1", false, 1)
 		require.NoError(t, err)
 		assert.True(t, allowed)
 	})
@@ -315,12 +402,12 @@ func TestServiceCheckRateLimit(t *testing.T) {
 		}
 
 		for i := 0; i < 2; i++ {
-			allowed, err := service.CheckRateLimit("192.168.1.2", false)
+			allowed, err := service.CheckRateLimit("192.168.1.2", false, 1)
 			require.NoError(t, err)
 			assert.True(t, allowed)
 		}
 
-		allowed, err := service.CheckRateLimit("192.168.1.2", false)
+		allowed, err := service.CheckRateLimit("192.168.1.2", false, 1)
 		require.NoError(t, err)
 		assert.False(t, allowed)
 	})
@@ -339,7 +426,7 @@ func TestServiceCheckRateLimit(t *testing.T) {
 		}
 
 		for i := 0; i < 4; i++ {
-			allowed, err := service.CheckRateLimit("token:ABC123", true)
+			allowed, err := service.CheckRateLimit("token:ABC123", true, 1)
 			require.NoError(t, err)
 			assert.True(t, allowed)
 		}
@@ -349,26 +436,27 @@ func TestServiceCheckRateLimit(t *testing.T) {
 		testStorage := createTestStorage(t)
 		defer testStorage.Close()
 
+		clock := ratelimiter.NewManualClock(time.Now())
 		service := &Service{
 			config: storage.Config{
 				IPRateLimit: 1,
 				IPBlockTime: 1,
 			},
 			storage: testStorage,
+			clock:   clock,
 		}
 
-		allowed, err := service.CheckRateLimit("192.168.1.3", false)
+		allowed, err := service.CheckRateLimit("192.168.1.3", false, 1)
 		require.NoError(t, err)
 		assert.True(t, allowed)
 
-		allowed, err = service.CheckRateLimit("192.168.1.3", false)
+		allowed, err = service.CheckRateLimit("192.168.1.3", false, 1)
 		require.NoError(t, err)
 		assert.False(t, allowed)
 
-		// Wait for window reset
-		time.Sleep(1100 * time.Millisecond)
+		clock.Advance(1100 * time.Millisecond)
 
-		allowed, err = service.CheckRateLimit("192.168.1.3", false)
+		allowed, err = service.CheckRateLimit("192.168.1.3", false, 1)
 		require.NoError(t, err)
 		assert.True(t, allowed)
 	})
@@ -389,7 +477,7 @@ func TestServiceCheckRateLimit(t *testing.T) {
 		for i := 0; i < 10; i++ {
 			go func(id int) {
 				for j := 0; j < 10; j++ {
-					service.CheckRateLimit("concurrent-test", false)
+					service.CheckRateLimit("concurrent-test", false, 1)
 				}
 				done <- true
 			}(i)
@@ -401,6 +489,45 @@ func TestServiceCheckRateLimit(t *testing.T) {
 	})
 }
 
+func TestServiceReload(t *testing.T) {
+	ctx := context.Background()
+
+	config := storage.GetDefaultConfig().RateLimit
+	config.Denylist = []string{"10.0.0.1", "10.0.0.2"}
+	service := NewService(config, storage.NewMemoryStorage())
+	require.NoError(t, service.SeedDenylist(ctx))
+
+	_, err := service.AddBan(ctx, "10.0.0.3", "manual")
+	require.NoError(t, err)
+
+	reloaded := config.Clone()
+	reloaded.IPRateLimit = 3
+	reloaded.TokenLimits["gold"] = 500
+	reloaded.Denylist = []string{"10.0.0.2", "10.0.0.4"}
+	require.NoError(t, service.Reload(ctx, reloaded))
+
+	assert.Equal(t, 3, service.getLimit("192.168.1.1", false))
+	assert.Equal(t, 500, service.getLimit("token:gold", true))
+
+	assert.False(t, service.IsDenied("10.0.0.1", "10.0.0.1"), "config entry removed on reload")
+	assert.True(t, service.IsDenied("10.0.0.2", "10.0.0.2"))
+	assert.True(t, service.IsDenied("10.0.0.3", "10.0.0.3"), "manual bans survive reload")
+	assert.True(t, service.IsDenied("10.0.0.4", "10.0.0.4"))
+}
+
+func TestServiceReloadConfig(t *testing.T) {
+	service := NewService(storage.GetDefaultConfig().RateLimit, storage.NewMemoryStorage())
+	assert.ErrorIs(t, service.ReloadConfig(context.Background()), ErrReloadNotSupported)
+
+	calls := 0
+	service.SetReloader(func(ctx context.Context) error {
+		calls++
+		return nil
+	})
+	assert.NoError(t, service.ReloadConfig(context.Background()))
+	assert.Equal(t, 1, calls)
+}
+
 func BenchmarkServiceCheckRateLimit(b *testing.B) {
 	config := ratelimiter.StorageConfig{
 		Host:     "localhost",
@@ -426,7 +553,7 @@ func BenchmarkServiceCheckRateLimit(b *testing.B) {
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			service.CheckRateLimit("bench-test", false)
+			service.CheckRateLimit("bench-test", false, 1)
 		}
 	})
 }
@@ -447,3 +574,42 @@ func BenchmarkServiceGetLimit(b *testing.B) {
 		service.getLimit("token:ABC123", true)
 	}
 }
+
+func TestServiceBlockEscalation(t *testing.T) {
+	ctx := context.Background()
+	clock := ratelimiter.NewManualClock(time.Now())
+	memoryStorage := storage.NewMemoryStorage()
+	memoryStorage.SetClock(clock)
+	service := NewService(storage.Config{
+		IPRateLimit:           1,
+		IPBlockTime:           60,
+		MaxBlockTime:          600,
+		BlockEscalationFactor: 5,
+		BlockMax:              3600,
+		BlockEscalationDecay:  3600,
+	}, memoryStorage)
+	service.SetClock(clock)
+
+	escalation := service.escalation()
+	assert.Equal(t, 10*time.Minute, escalation.MaxBlockTime, "BLOCK_MAX never goes past MAX_BLOCK_TIME")
+	assert.Equal(t, time.Hour, escalation.Decay)
+
+	check, err := service.checkRateLimit(context.Background(), "10.0.0.9", false, 1)
+	require.NoError(t, err)
+	require.True(t, check.Allowed)
+	check, err = service.checkRateLimit(context.Background(), "10.0.0.9", false, 1)
+	require.NoError(t, err)
+	assert.False(t, check.Allowed)
+	assert.Equal(t, time.Minute, check.RetryAfter)
+
+	clock.Advance(1100 * time.Millisecond)
+	check, err = service.checkRateLimit(context.Background(), "10.0.0.9", false, 1)
+	require.NoError(t, err)
+	assert.False(t, check.Allowed, "the block outlives the one second window")
+
+	state, err := service.GetLimitState(ctx, "10.0.0.9")
+	require.NoError(t, err)
+	assert.True(t, state.Blocked)
+	assert.Equal(t, 1, state.Violations)
+	assert.WithinDuration(t, state.BlockedAt.Add(time.Minute), state.BlockedUntil, time.Millisecond)
+}
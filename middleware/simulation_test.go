@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the simulation tests")
+
+// simulationEpoch is the time the timelines count from
+var simulationEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// simulationStep is one request of a timeline: at an offset from the epoch, the key
+// spends cost
+type simulationStep struct {
+	at   time.Duration
+	key  string
+	cost int
+}
+
+// simulation is a timeline read from testdata/simulation/<name>.txt: settings lines
+// (limit, window, block, bucket) followed by "<offset> <key> <cost>" lines
+type simulation struct {
+	limits ratelimiter.Limits
+	window time.Duration
+	steps  []simulationStep
+}
+
+func loadSimulation(t *testing.T, path string) simulation {
+	t.Helper()
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	sim := simulation{window: time.Second}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 && len(fields) != 3 {
+			t.Fatalf("%s:%d: expected a setting or an <offset> <key> <cost> step", path, line)
+		}
+
+		var err error
+		switch fields[0] {
+		case "limit":
+			sim.limits.Limit, err = strconv.Atoi(fields[1])
+		case "bucket":
+			sim.limits.BucketSize, err = strconv.Atoi(fields[1])
+		case "window":
+			sim.window, err = time.ParseDuration(fields[1])
+		case "block":
+			sim.limits.BlockTime, err = time.ParseDuration(fields[1])
+		default:
+			var step simulationStep
+			step.at, err = time.ParseDuration(fields[0])
+			require.NoError(t, err, "%s:%d", path, line)
+			step.key = fields[1]
+			step.cost, err = strconv.Atoi(fields[2])
+			sim.steps = append(sim.steps, step)
+		}
+		require.NoError(t, err, "%s:%d", path, line)
+	}
+	require.NoError(t, scanner.Err())
+	return sim
+}
+
+// run feeds the timeline through a limiter of the algorithm on a clock set to each
+// step, returning one decision per line
+func (sim simulation) run(t *testing.T, algorithm string, rateLimitStorage ratelimiter.Storage) string {
+	t.Helper()
+	var now time.Time
+	limiter, err := ratelimiter.NewLimiter(
+		ratelimiter.WithStorage(rateLimitStorage),
+		ratelimiter.WithAlgorithm(algorithm),
+		ratelimiter.WithLimit(sim.limits.Limit, sim.window),
+		ratelimiter.WithClock(func() time.Time { return now }),
+	)
+	require.NoError(t, err)
+
+	var out strings.Builder
+	for _, step := range sim.steps {
+		now = simulationEpoch.Add(step.at)
+		result, err := limiter.AllowLimitsN(context.Background(), step.key, sim.limits, step.cost)
+		require.NoError(t, err)
+
+		resetAt := "-"
+		if !result.ResetAt.IsZero() {
+			resetAt = result.ResetAt.Sub(simulationEpoch).String()
+		}
+		fmt.Fprintf(&out, "%s %s %d allowed=%t remaining=%d retry_after=%s reset_at=%s\n",
+			step.at, step.key, step.cost, result.Allowed, result.Remaining, result.RetryAfter, resetAt)
+	}
+	return out.String()
+}
+
+// TestSimulationGolden replays every timeline of testdata/simulation through each
+// algorithm on a deterministic clock and compares the decisions with the golden files,
+// on the atomic and the Get and Set paths of the storage alike. Run with -update to
+// rewrite the golden files after an intended change of behavior.
+func TestSimulationGolden(t *testing.T) {
+	timelines, err := filepath.Glob(filepath.Join("testdata", "simulation", "*.txt"))
+	require.NoError(t, err)
+	require.NotEmpty(t, timelines)
+
+	for _, timeline := range timelines {
+		sim := loadSimulation(t, timeline)
+		name := strings.TrimSuffix(timeline, ".txt")
+
+		for _, algorithm := range []string{ratelimiter.AlgorithmFixedWindow, ratelimiter.AlgorithmTokenBucket, ratelimiter.AlgorithmLeakyBucket} {
+			t.Run(filepath.Base(name)+"/"+algorithm, func(t *testing.T) {
+				got := sim.run(t, algorithm, storage.NewMemoryStorage())
+				golden := name + "." + algorithm + ".golden"
+				if *updateGolden {
+					require.NoError(t, os.WriteFile(golden, []byte(got), 0o644))
+				}
+
+				want, err := os.ReadFile(golden)
+				require.NoError(t, err, "run with -update to create the golden file")
+				assert.Equal(t, string(want), got)
+				assert.Equal(t, got, sim.run(t, algorithm, plainStorage{storage.NewMemoryStorage()}), "the Get and Set path decides the same")
+			})
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const redactedValue = "[REDACTED]"
+
+// Snapshot is a sanitized copy of a blocked request kept for forensic analysis
+type Snapshot struct {
+	Time          time.Time           `json:"time"`
+	Reason        string              `json:"reason"`
+	Key           string              `json:"key"`
+	ClientIP      string              `json:"client_ip"`
+	Method        string              `json:"method"`
+	Host          string              `json:"host"`
+	Path          string              `json:"path"`
+	Headers       map[string][]string `json:"headers"`
+	Body          string              `json:"body,omitempty"`
+	BodyTruncated bool                `json:"body_truncated,omitempty"`
+}
+
+// SnapshotSink persists encoded snapshots
+type SnapshotSink interface {
+	Write(ctx context.Context, data []byte) error
+}
+
+// SnapshotRecorder samples blocked requests into a sink. Sampling is bounded both by
+// a rate and by a hard cap of snapshots per second.
+type SnapshotRecorder struct {
+	sink         SnapshotSink
+	sampleRate   float64
+	maxPerSecond int
+	maxBodyBytes int64
+	redact       map[string]struct{}
+
+	mu          sync.Mutex
+	second      int64
+	secondCount int
+}
+
+func NewSnapshotRecorder(sink SnapshotSink, sampleRate float64, maxPerSecond int, maxBodyBytes int64, redactHeaders []string) *SnapshotRecorder {
+	redact := make(map[string]struct{}, len(redactHeaders))
+	for _, header := range redactHeaders {
+		redact[http.CanonicalHeaderKey(header)] = struct{}{}
+	}
+
+	return &SnapshotRecorder{
+		sink:         sink,
+		sampleRate:   sampleRate,
+		maxPerSecond: maxPerSecond,
+		maxBodyBytes: maxBodyBytes,
+		redact:       redact,
+	}
+}
+
+// Close closes the sink when it holds resources
+func (s *SnapshotRecorder) Close() error {
+	if closer, ok := s.sink.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (s *SnapshotRecorder) shouldSample() bool {
+	if s.sampleRate <= 0 || rand.Float64() >= s.sampleRate {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().Unix()
+	if now != s.second {
+		s.second = now
+		s.secondCount = 0
+	}
+	if s.maxPerSecond > 0 && s.secondCount >= s.maxPerSecond {
+		return false
+	}
+	s.secondCount++
+
+	return true
+}
+
+// Record samples a blocked request; failures are logged and never affect the response
+func (s *SnapshotRecorder) Record(r *http.Request, clientIP, key, reason string) {
+	if s == nil || !s.shouldSample() {
+		return
+	}
+
+	snapshot := s.capture(r, clientIP, key, reason)
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	if err := s.sink.Write(ctx, data); err != nil {
+		slog.Error("Failed to record request snapshot", "error", err)
+	}
+}
+
+func (s *SnapshotRecorder) capture(r *http.Request, clientIP, key, reason string) *Snapshot {
+	snapshot := &Snapshot{
+		Time:     time.Now(),
+		Reason:   reason,
+		Key:      s.redactKey(key),
+		ClientIP: clientIP,
+		Method:   r.Method,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		Headers:  make(map[string][]string, len(r.Header)),
+	}
+
+	for name, values := range r.Header {
+		if _, secret := s.redact[http.CanonicalHeaderKey(name)]; secret {
+			snapshot.Headers[name] = []string{redactedValue}
+			continue
+		}
+		snapshot.Headers[name] = values
+	}
+
+	if r.Body != nil && s.maxBodyBytes > 0 {
+		body, _ := io.ReadAll(io.LimitReader(r.Body, s.maxBodyBytes+1))
+		if int64(len(body)) > s.maxBodyBytes {
+			body = body[:s.maxBodyBytes]
+			snapshot.BodyTruncated = true
+		}
+		snapshot.Body = string(body)
+	}
+
+	return snapshot
+}
+
+// redactKey hides the token of token keys, keeping IP keys readable
+func (s *SnapshotRecorder) redactKey(key string) string {
+	if len(key) > len("token:") && key[:len("token:")] == "token:" {
+		return "token:" + redactedValue
+	}
+	return key
+}
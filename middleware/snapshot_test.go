@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memorySink struct {
+	mu      sync.Mutex
+	entries [][]byte
+}
+
+func (m *memorySink) Write(ctx context.Context, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, data)
+	return nil
+}
+
+func TestSnapshotRecorderRecord(t *testing.T) {
+	sink := &memorySink{}
+	recorder := NewSnapshotRecorder(sink, 1, 0, 8, []string{"Authorization", "API_KEY"})
+
+	req := httptest.NewRequest("POST", "/login", strings.NewReader("username=admin&password=secret"))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("API_KEY", "ABC123")
+	req.Header.Set("User-Agent", "curl/8.0")
+
+	recorder.Record(req, "192.168.1.1", "token:ABC123", "rate_limit")
+	require.Len(t, sink.entries, 1)
+
+	var snapshot Snapshot
+	require.NoError(t, json.Unmarshal(sink.entries[0], &snapshot))
+
+	assert.Equal(t, "rate_limit", snapshot.Reason)
+	assert.Equal(t, "token:[REDACTED]", snapshot.Key)
+	assert.Equal(t, "/login", snapshot.Path)
+	assert.Equal(t, []string{"[REDACTED]"}, snapshot.Headers["Authorization"])
+	assert.Equal(t, []string{"[REDACTED]"}, snapshot.Headers["Api_key"])
+	assert.Equal(t, []string{"curl/8.0"}, snapshot.Headers["User-Agent"])
+	assert.Equal(t, "username", snapshot.Body)
+	assert.True(t, snapshot.BodyTruncated)
+}
+
+func TestSnapshotRecorderSampling(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		sink := &memorySink{}
+		recorder := NewSnapshotRecorder(sink, 0, 0, 0, nil)
+
+		for i := 0; i < 10; i++ {
+			recorder.Record(httptest.NewRequest("GET", "/", nil), "192.168.1.1", "192.168.1.1", "rate_limit")
+		}
+		assert.Empty(t, sink.entries)
+	})
+
+	t.Run("per_second_cap", func(t *testing.T) {
+		sink := &memorySink{}
+		recorder := NewSnapshotRecorder(sink, 1, 3, 0, nil)
+
+		for i := 0; i < 10; i++ {
+			recorder.Record(httptest.NewRequest("GET", "/", nil), "192.168.1.1", "192.168.1.1", "rate_limit")
+		}
+		assert.LessOrEqual(t, len(sink.entries), 6)
+		assert.GreaterOrEqual(t, len(sink.entries), 3)
+	})
+
+	t.Run("nil_recorder", func(t *testing.T) {
+		var recorder *SnapshotRecorder
+		recorder.Record(httptest.NewRequest("GET", "/", nil), "192.168.1.1", "192.168.1.1", "rate_limit")
+	})
+}
+
+func TestRateLimiterRecordsDeniedSnapshot(t *testing.T) {
+	sink := &memorySink{}
+	service := NewService(storage.Config{Denylist: []string{"192.168.1.1"}}, nil)
+	service.SetSnapshotRecorder(NewSnapshotRecorder(sink, 1, 0, 0, nil))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.1:12345"
+	w := httptest.NewRecorder()
+
+	RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Len(t, sink.entries, 1)
+	assert.Contains(t, string(sink.entries[0]), `"reason":"denylist"`)
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"rate-limiter/storage"
+	"strings"
+	"time"
+)
+
+// Throttle selects the requests that wait for a free slot instead of getting an
+// immediate 429, like rate.Limiter.Wait: those under THROTTLE_PATHS and those of the
+// tokens in THROTTLE_TOKENS. A request is answered with 429 only when no slot frees
+// within THROTTLE_MAX_WAIT_MS.
+type Throttle struct {
+	maxWait time.Duration
+	paths   []string
+	tokens  map[string]struct{}
+}
+
+// NewThrottle returns nil when no path or token is throttled
+func NewThrottle(config storage.Config) *Throttle {
+	if config.ThrottleMaxWait <= 0 || (len(config.ThrottlePaths) == 0 && len(config.ThrottleTokens) == 0) {
+		return nil
+	}
+
+	t := &Throttle{
+		maxWait: time.Duration(config.ThrottleMaxWait) * time.Millisecond,
+		paths:   config.ThrottlePaths,
+		tokens:  make(map[string]struct{}, len(config.ThrottleTokens)),
+	}
+	for _, token := range config.ThrottleTokens {
+		t.tokens[token] = struct{}{}
+	}
+	return t
+}
+
+// Applies reports whether the request waits instead of being rejected
+func (t *Throttle) Applies(r *http.Request, key string, isToken bool) bool {
+	if t == nil {
+		return false
+	}
+
+	if tokenName, found := tokenOf(quotaKey(key)); isToken && found {
+		if _, exists := t.tokens[tokenName]; exists {
+			return true
+		}
+	}
+	for _, prefix := range t.paths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// throttleRateLimit retries the check until it passes, the wait would go past maxWait
+// or the context is done. Its attempts go through reserve, so a slot is found as soon
+// as one frees instead of after the block time.
+func (s *Service) throttleRateLimit(ctx context.Context, key string, isToken bool, cost int, maxWait time.Duration) (rateLimitCheck, error) {
+	deadline := time.Now().Add(maxWait)
+
+	for {
+		check, err := s.reserve(ctx, key, isToken, cost)
+		if err != nil || check.Allowed {
+			return check, err
+		}
+
+		wait := check.RetryAfter
+		if wait <= 0 || time.Now().Add(wait).After(deadline) {
+			return check, nil
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return check, nil
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottle(t *testing.T) {
+	var disabled *Throttle
+	assert.False(t, disabled.Applies(httptest.NewRequest("GET", "/", nil), "10.0.0.1", false))
+	assert.Nil(t, NewThrottle(storage.Config{ThrottleMaxWait: 1000}))
+
+	throttle := NewThrottle(storage.Config{
+		ThrottleMaxWait: 1000,
+		ThrottlePaths:   []string{"/batch"},
+		ThrottleTokens:  []string{"etl"},
+	})
+	assert.True(t, throttle.Applies(httptest.NewRequest("GET", "/batch/1", nil), "10.0.0.1", false))
+	assert.False(t, throttle.Applies(httptest.NewRequest("GET", "/users", nil), "10.0.0.1", false))
+	assert.True(t, throttle.Applies(httptest.NewRequest("GET", "/users", nil), "token:etl", true))
+	assert.False(t, throttle.Applies(httptest.NewRequest("GET", "/users", nil), "token:web", true))
+}
+
+func TestRateLimiterThrottle(t *testing.T) {
+	okHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	newHandler := func(maxWait int) http.Handler {
+		service := NewService(storage.Config{
+			IPRateLimit:     1,
+			IPBlockTime:     60,
+			ThrottleMaxWait: maxWait,
+			ThrottlePaths:   []string{"/batch"},
+		}, storage.NewMemoryStorage())
+		return RateLimiter(service)(okHandler)
+	}
+	send := func(handler http.Handler, path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	handler := newHandler(2000)
+	assert.Equal(t, http.StatusOK, send(handler, "/batch"))
+	start := time.Now()
+	assert.Equal(t, http.StatusOK, send(handler, "/batch"), "the request waits for the next window")
+	assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+
+	handler = newHandler(100)
+	assert.Equal(t, http.StatusOK, send(handler, "/batch"))
+	assert.Equal(t, http.StatusTooManyRequests, send(handler, "/batch"), "no slot frees within the max wait")
+
+	handler = newHandler(2000)
+	assert.Equal(t, http.StatusOK, send(handler, "/users"))
+	start = time.Now()
+	assert.Equal(t, http.StatusTooManyRequests, send(handler, "/users"), "other routes are rejected right away")
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
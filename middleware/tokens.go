@@ -0,0 +1,215 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"sort"
+	"strings"
+)
+
+// Policies of UNKNOWN_TOKEN_POLICY for API keys matching no configured token
+const (
+	UnknownTokenDefaultLimit = "default_token_limit"
+	UnknownTokenFallbackToIP = "fallback_to_ip_key"
+	UnknownTokenReject       = "reject"
+)
+
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrTokenExists   = errors.New("token already exists")
+	ErrInvalidToken  = errors.New("invalid token")
+)
+
+// ListTokens returns the tokens of the registry, sorted by name
+func (s *Service) ListTokens(ctx context.Context) ([]*ratelimiter.TokenConfig, error) {
+	tokens, err := s.storage.ListTokenConfigs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	return tokens, nil
+}
+
+// GetToken returns the token of the registry, ErrTokenNotFound when it isn't registered
+func (s *Service) GetToken(ctx context.Context, name string) (*ratelimiter.TokenConfig, error) {
+	tokens, err := s.storage.ListTokenConfigs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name = s.adminTokenName(name)
+	for _, token := range tokens {
+		if token.Name == name {
+			return token, nil
+		}
+	}
+	return nil, ErrTokenNotFound
+}
+
+// CreateToken registers a new token, ErrTokenExists when the name is taken
+func (s *Service) CreateToken(ctx context.Context, token *ratelimiter.TokenConfig) error {
+	if _, err := s.GetToken(ctx, token.Name); err == nil {
+		return ErrTokenExists
+	} else if !errors.Is(err, ErrTokenNotFound) {
+		return err
+	}
+	return s.saveToken(ctx, token)
+}
+
+// UpdateToken replaces a registered token, ErrTokenNotFound when it isn't registered
+func (s *Service) UpdateToken(ctx context.Context, token *ratelimiter.TokenConfig) error {
+	if _, err := s.GetToken(ctx, token.Name); err != nil {
+		return err
+	}
+	return s.saveToken(ctx, token)
+}
+
+// DeleteToken removes the token from the registry. Its requests fall back to the
+// TOKEN_<name>_* env configuration, if any, and the default policy otherwise.
+func (s *Service) DeleteToken(ctx context.Context, name string) error {
+	if _, err := s.GetToken(ctx, name); err != nil {
+		return err
+	}
+	if err := s.storage.DeleteTokenConfig(ctx, name); err != nil {
+		return err
+	}
+	return s.SyncTokenConfigs(ctx)
+}
+
+// saveToken validates and stores the token, applying it on this instance right away;
+// other instances pick it up on their next sync
+func (s *Service) saveToken(ctx context.Context, token *ratelimiter.TokenConfig) error {
+	if err := s.validateToken(token); err != nil {
+		return err
+	}
+	if err := s.storage.SetTokenConfig(ctx, token); err != nil {
+		return err
+	}
+	return s.SyncTokenConfigs(ctx)
+}
+
+func (s *Service) validateToken(token *ratelimiter.TokenConfig) error {
+	if token.Name == "" || strings.ContainsAny(token.Name, ": ") {
+		return fmt.Errorf("%w: the name must not be empty or contain colons or spaces", ErrInvalidToken)
+	}
+	if token.Limit > 0 && token.BlockTime < 0 {
+		return fmt.Errorf("%w: the block time must not be negative", ErrInvalidToken)
+	}
+	if _, exists := s.Config().Policies[token.Policy]; token.Policy != "" && !exists {
+		return fmt.Errorf("%w: tier %q is not a configured policy", ErrInvalidToken, token.Policy)
+	}
+	if token.Algorithm != "" && !ratelimiter.IsAlgorithm(token.Algorithm) {
+		return fmt.Errorf("%w: the algorithm must be one of %s", ErrInvalidToken, strings.Join(ratelimiter.Algorithms(), ", "))
+	}
+	if token.BucketSize < 0 {
+		return fmt.Errorf("%w: the bucket size must not be negative", ErrInvalidToken)
+	}
+	if token.Window < 0 {
+		return fmt.Errorf("%w: the window must not be negative", ErrInvalidToken)
+	}
+	return nil
+}
+
+// SeedTokens registers the TOKEN_* env tokens missing from the registry, so the env
+// configuration seeds the registry on first start and the registry wins afterwards
+func (s *Service) SeedTokens(ctx context.Context) error {
+	report, err := s.MigrateEnvTokens(ctx, false)
+	if err != nil {
+		return err
+	}
+	if len(report.Imported) > 0 {
+		slog.Info("Seeded the token registry with env tokens", "tokens", len(report.Imported))
+	}
+	return nil
+}
+
+// TOKENLESS_POLICY values, how requests without a token are handled when
+// IP_RATE_LIMIT_ENABLED=false
+const (
+	TokenlessReject = "reject"
+	TokenlessAllow  = "allow"
+)
+
+// tokenIPSeparator joins the token and the client IP in the keys of TOKEN_KEY_BY_IP
+const tokenIPSeparator = ":ip:"
+
+// tokenOf returns the name of the token of the key, for plain token keys and for those
+// of a token and a client IP or of a JWT tier alike
+func tokenOf(key string) (string, bool) {
+	_, key, _ = cutTierKey(key)
+	tokenName, found := strings.CutPrefix(key, "token:")
+	if !found {
+		return "", false
+	}
+	tokenName, _, _ = strings.Cut(tokenName, tokenIPSeparator)
+	return tokenName, true
+}
+
+// tokenIPKey adds the client IP to a token key when TOKEN_KEY_BY_IP is set, so each IP
+// of the token is limited on its own. The denylist is checked against the plain key
+// before, and without a client IP the token key is kept.
+func (s *Service) tokenIPKey(key string, isToken bool, clientIP string) string {
+	if !isToken || clientIP == "" || !s.Config().TokenKeyByIP {
+		return key
+	}
+	return key + tokenIPSeparator + s.ipKey(clientIP)
+}
+
+// tokenKey strips the client IP off the key of a token and an IP
+func tokenKey(key string) string {
+	if _, found := tokenOf(key); found {
+		key, _, _ = strings.Cut(key, tokenIPSeparator)
+	}
+	return key
+}
+
+// tokenDisabled reports whether the registry has the token switched off
+func (s *Service) tokenDisabled(key string, isToken bool) bool {
+	tokenName, found := tokenOf(key)
+	if !isToken || !found {
+		return false
+	}
+	tokenConfig, exists := s.getTokenConfig(tokenName)
+	return exists && tokenConfig.Disabled
+}
+
+// tokenKnown reports whether the token is in the registry or has any TOKEN_<name>_*
+// setting
+func (s *Service) tokenKnown(config storage.Config, tokenName string) bool {
+	if _, exists := s.getTokenConfig(tokenName); exists {
+		return true
+	}
+	for _, settings := range []map[string]int{config.TokenLimits, config.TokenBlockTimes, config.TokenWindows, config.TokenDailyQuotas, config.TokenMonthlyQuotas} {
+		if _, exists := settings[tokenName]; exists {
+			return true
+		}
+	}
+	_, hasPolicy := config.TokenPolicies[tokenName]
+	_, hasAlgorithm := config.TokenAlgorithms[tokenName]
+	return hasPolicy || hasAlgorithm
+}
+
+// unknownToken applies UNKNOWN_TOKEN_POLICY to the key: a token nobody configured is
+// refused, moved to the key of its client IP or kept with the default token limit.
+// Without a client IP, as for Envoy descriptors, the token key is kept.
+func (s *Service) unknownToken(key string, isToken bool, clientIP string) (string, bool, bool) {
+	tokenName, found := tokenOf(key)
+	if !isToken || !found {
+		return key, isToken, false
+	}
+
+	config := s.Config()
+	if config.UnknownTokenPolicy == "" || config.UnknownTokenPolicy == UnknownTokenDefaultLimit || s.tokenKnown(config, tokenName) {
+		return key, isToken, false
+	}
+	if config.UnknownTokenPolicy == UnknownTokenReject {
+		return key, isToken, true
+	}
+	if clientIP == "" {
+		return key, isToken, false
+	}
+	return s.ipKey(clientIP), false, false
+}
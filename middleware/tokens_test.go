@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenRegistry(t *testing.T) {
+	ctx := context.Background()
+	service := NewService(storage.Config{
+		IPRateLimit:     10,
+		IPBlockTime:     60,
+		TokenLimits:     map[string]int{"gold": 100, "silver": 50},
+		TokenBlockTimes: map[string]int{},
+		Policies:        map[string]storage.Policy{"premium": {Name: "premium", Limit: 1000}},
+	}, storage.NewMemoryStorage())
+
+	require.NoError(t, service.SeedTokens(ctx))
+	tokens, err := service.ListTokens(ctx)
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	assert.Equal(t, "gold", tokens[0].Name)
+
+	require.NoError(t, service.UpdateToken(ctx, &ratelimiter.TokenConfig{Name: "gold", Limit: 200, BlockTime: 30}))
+	assert.Equal(t, 200, service.getLimit("token:gold", true), "updates apply right away")
+
+	require.NoError(t, service.SeedTokens(ctx))
+	assert.Equal(t, 200, service.getLimit("token:gold", true), "seeding never overwrites the registry")
+
+	assert.ErrorIs(t, service.CreateToken(ctx, &ratelimiter.TokenConfig{Name: "gold"}), ErrTokenExists)
+	assert.ErrorIs(t, service.UpdateToken(ctx, &ratelimiter.TokenConfig{Name: "bronze"}), ErrTokenNotFound)
+	assert.ErrorIs(t, service.CreateToken(ctx, &ratelimiter.TokenConfig{Name: "a:b"}), ErrInvalidToken)
+	assert.ErrorIs(t, service.CreateToken(ctx, &ratelimiter.TokenConfig{Name: "bronze", Policy: "missing"}), ErrInvalidToken)
+
+	require.NoError(t, service.CreateToken(ctx, &ratelimiter.TokenConfig{Name: "bronze", Policy: "premium"}))
+	assert.Equal(t, 1000, service.getLimit("token:bronze", true))
+
+	require.NoError(t, service.DeleteToken(ctx, "silver"))
+	assert.Equal(t, 50, service.getLimit("token:silver", true), "a deleted token falls back to its env limit")
+	assert.ErrorIs(t, service.DeleteToken(ctx, "silver"), ErrTokenNotFound)
+}
+
+func TestRateLimiterDisabledToken(t *testing.T) {
+	ctx := context.Background()
+	service := NewService(storage.Config{IPRateLimit: 10, IPBlockTime: 60}, storage.NewMemoryStorage())
+	require.NoError(t, service.CreateToken(ctx, &ratelimiter.TokenConfig{Name: "gold", Limit: 100, Disabled: true}))
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.1:12345"
+	req.Header.Set("API_KEY", "gold")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	assert.Equal(t, "token_disabled", service.Evaluate("192.168.1.1", "gold", "GRPC", "/svc/Method", 1).Reason)
+}
+
+func TestUnknownTokenPolicy(t *testing.T) {
+	newService := func(policy string) *Service {
+		return NewService(storage.Config{
+			IPRateLimit:        2,
+			IPBlockTime:        60,
+			TokenLimits:        map[string]int{"gold": 100},
+			UnknownTokenPolicy: policy,
+			DefaultTokenLimit:  5,
+		}, storage.NewMemoryStorage())
+	}
+	send := func(handler http.Handler, apiKey string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		req.Header.Set("API_KEY", apiKey)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	service := newService(UnknownTokenDefaultLimit)
+	assert.Equal(t, 5, service.getLimit("token:fresh", true), "unknown tokens get the default token limit")
+	assert.Equal(t, 100, service.getLimit("token:gold", true))
+
+	service = newService(UnknownTokenFallbackToIP)
+	handler := RateLimiter(service)(ok)
+	assert.Equal(t, http.StatusOK, send(handler, "fresh-1"))
+	assert.Equal(t, http.StatusOK, send(handler, "fresh-2"))
+	assert.Equal(t, http.StatusTooManyRequests, send(handler, "fresh-3"), "fresh tokens share the counter of their IP")
+	assert.Equal(t, http.StatusOK, send(handler, "gold"), "configured tokens keep their own counter")
+	assert.Equal(t, "192.168.1.1", service.Evaluate("192.168.1.1", "fresh-4", "GRPC", "/svc/Method", 1).Key)
+
+	service = newService(UnknownTokenReject)
+	handler = RateLimiter(service)(ok)
+	assert.Equal(t, http.StatusUnauthorized, send(handler, "fresh"))
+	assert.Equal(t, http.StatusOK, send(handler, "gold"))
+	require.NoError(t, service.CreateToken(context.Background(), &ratelimiter.TokenConfig{Name: "silver", Limit: 10}))
+	assert.Equal(t, http.StatusOK, send(handler, "silver"), "registry tokens are known")
+	assert.Equal(t, "unknown_token", service.EvaluateKey("token:fresh", "RLS", "", 1).Reason)
+}
+
+func TestTokenKeyByIP(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit:      10,
+		IPBlockTime:      60,
+		TokenLimits:      map[string]int{"gold": 2},
+		TokenBlockTimes:  map[string]int{"gold": 60},
+		TokenDailyQuotas: map[string]int{"gold": 5},
+		TokenKeyByIP:     true,
+		Denylist:         []string{"token:leaked"},
+	}, storage.NewMemoryStorage())
+	handler := RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(clientIP, apiKey string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = clientIP + ":12345"
+		req.Header.Set("API_KEY", apiKey)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("10.0.0.1", "gold"))
+	assert.Equal(t, http.StatusOK, send("10.0.0.1", "gold"))
+	assert.Equal(t, http.StatusTooManyRequests, send("10.0.0.1", "gold"))
+	assert.Equal(t, http.StatusOK, send("10.0.0.2", "gold"), "every IP of the token has a window of its own")
+	assert.Equal(t, http.StatusOK, send("10.0.0.3", "gold"))
+	assert.Equal(t, http.StatusOK, send("10.0.0.4", "gold"))
+	assert.Equal(t, http.StatusTooManyRequests, send("10.0.0.5", "gold"), "the daily quota is shared by the IPs of the token")
+
+	assert.Equal(t, 2, service.getLimit("token:gold:ip:10.0.0.1", true), "the token limits apply to each of its IPs")
+	assert.NotEqual(t, http.StatusOK, send("10.0.0.6", "leaked"), "the denylist matches the token itself")
+	assert.Equal(t, "token:gold:ip:10.0.0.7", service.Evaluate("10.0.0.7", "gold", "GRPC", "/svc/Method", 1).Key)
+}
+
+func TestTokenOnlyMode(t *testing.T) {
+	newHandler := func(policy string) (*Service, http.Handler) {
+		service := NewService(storage.Config{
+			IPRateLimit:         1,
+			IPBlockTime:         60,
+			TokenLimits:         map[string]int{"gold": 100},
+			IPRateLimitDisabled: true,
+			TokenlessPolicy:     policy,
+		}, storage.NewMemoryStorage())
+		return service, RateLimiter(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	send := func(handler http.Handler, apiKey string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		if apiKey != "" {
+			req.Header.Set("API_KEY", apiKey)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	service, handler := newHandler(TokenlessReject)
+	assert.Equal(t, http.StatusUnauthorized, send(handler, ""))
+	assert.Equal(t, http.StatusOK, send(handler, "gold"))
+	assert.Equal(t, "missing_token", service.Evaluate("192.168.1.1", "", "GRPC", "/svc/Method", 1).Reason)
+
+	service, handler = newHandler(TokenlessAllow)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, send(handler, ""), "tokenless requests are not limited by IP")
+	}
+	assert.Equal(t, uint64(0), service.Stats().Allowed, "nor counted")
+	assert.True(t, service.Evaluate("192.168.1.1", "", "GRPC", "/svc/Method", 1).Allowed)
+}
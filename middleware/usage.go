@@ -0,0 +1,226 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	ratelimiter "rate-limiter"
+	"sort"
+	"sync"
+	"time"
+)
+
+// usageRollupDelay keeps the rollup away from seconds that may still be flushing
+const usageRollupDelay = 5 * time.Second
+
+// UsageRecorder buffers allowed requests per second and key, so storage sees one
+// write per second instead of one per request
+type UsageRecorder struct {
+	storage   ratelimiter.Storage
+	retention time.Duration
+
+	mu      sync.Mutex
+	pending map[int64]map[string]int64
+}
+
+func NewUsageRecorder(storage ratelimiter.Storage, retention time.Duration) *UsageRecorder {
+	return &UsageRecorder{
+		storage:   storage,
+		retention: retention,
+		pending:   make(map[int64]map[string]int64),
+	}
+}
+
+func (u *UsageRecorder) Record(key string, at time.Time) {
+	u.RecordN(key, at, 1)
+}
+
+// RecordN counts a request that consumed count units of quota
+func (u *UsageRecorder) RecordN(key string, at time.Time, count int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	second := at.Unix()
+	counts, exists := u.pending[second]
+	if !exists {
+		counts = make(map[string]int64)
+		u.pending[second] = counts
+	}
+	counts[key] += count
+}
+
+// Flush writes the buffered seconds to storage; seconds that fail stay buffered
+func (u *UsageRecorder) Flush(ctx context.Context) error {
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = make(map[int64]map[string]int64)
+	u.mu.Unlock()
+
+	var firstErr error
+	for second, counts := range pending {
+		err := u.storage.AddUsage(ctx, ratelimiter.UsagePeriodSecond, time.Unix(second, 0), counts, u.retention)
+		if err == nil {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+
+		u.mu.Lock()
+		if u.pending[second] == nil {
+			u.pending[second] = make(map[string]int64)
+		}
+		for key, count := range counts {
+			u.pending[second][key] += count
+		}
+		u.mu.Unlock()
+	}
+
+	return firstErr
+}
+
+// RunUsageFlush flushes the buffered usage every interval
+func (s *Service) RunUsageFlush(ctx context.Context, interval time.Duration) {
+	if s.usage == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.usage.Flush(ctx); err != nil {
+				slog.Error("Failed to flush usage", "error", err)
+			}
+		}
+	}
+}
+
+// FlushUsage writes the buffered usage, used on shutdown
+func (s *Service) FlushUsage(ctx context.Context) error {
+	if s.usage == nil {
+		return nil
+	}
+	return s.usage.Flush(ctx)
+}
+
+func (s *Service) recordUsage(key string, cost int) {
+	if s.usage != nil {
+		s.usage.RecordN(key, s.now(), int64(cost))
+	}
+}
+
+// RollupUsage compacts the per-second usage older than before into hourly and daily
+// records. Seconds are put back when the records can't be written.
+func (s *Service) RollupUsage(ctx context.Context, before time.Time) error {
+	seconds, err := s.storage.TakeUsage(ctx, ratelimiter.UsagePeriodSecond, before)
+	if err != nil {
+		return err
+	}
+	if len(seconds) == 0 {
+		return nil
+	}
+
+	config := s.Config()
+	hourlyRetention := time.Duration(config.UsageHourlyRetention) * 24 * time.Hour
+	dailyRetention := time.Duration(config.UsageDailyRetention) * 24 * time.Hour
+
+	hours := make(map[time.Time]map[string]int64)
+	days := make(map[time.Time]map[string]int64)
+	for _, record := range seconds {
+		start := record.Start.UTC()
+		addUsageCount(hours, start.Truncate(time.Hour), record.Key, record.Count)
+		addUsageCount(days, time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC), record.Key, record.Count)
+	}
+
+	for start, counts := range hours {
+		if err := s.storage.AddUsage(ctx, ratelimiter.UsagePeriodHour, start, counts, hourlyRetention); err != nil {
+			s.restoreUsage(ctx, seconds)
+			return err
+		}
+	}
+	for start, counts := range days {
+		if err := s.storage.AddUsage(ctx, ratelimiter.UsagePeriodDay, start, counts, dailyRetention); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) restoreUsage(ctx context.Context, seconds []*ratelimiter.UsageRecord) {
+	retention := time.Duration(s.Config().UsageRawRetention) * time.Second
+
+	buckets := make(map[time.Time]map[string]int64)
+	for _, record := range seconds {
+		addUsageCount(buckets, record.Start, record.Key, record.Count)
+	}
+	for start, counts := range buckets {
+		if err := s.storage.AddUsage(ctx, ratelimiter.UsagePeriodSecond, start, counts, retention); err != nil {
+			slog.Error("Failed to restore usage", "start", start.Format(time.RFC3339), "error", err)
+		}
+	}
+}
+
+func addUsageCount(buckets map[time.Time]map[string]int64, start time.Time, key string, count int64) {
+	counts, exists := buckets[start]
+	if !exists {
+		counts = make(map[string]int64)
+		buckets[start] = counts
+	}
+	counts[key] += count
+}
+
+// RunUsageRollup periodically compacts per-second usage. Buckets are shared by every
+// app namespace, so it only needs to run on one service, and only the leader rolls up.
+func (s *Service) RunUsageRollup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !s.elector.IsLeader() {
+				continue
+			}
+			if err := s.RollupUsage(ctx, now.Add(-usageRollupDelay)); err != nil {
+				slog.Error("Failed to roll up usage", "error", err)
+			}
+		}
+	}
+}
+
+// ListUsage returns the usage records of a period between from and to, optionally
+// for a single key, oldest first
+func (s *Service) ListUsage(ctx context.Context, period string, from, to time.Time, key string) ([]*ratelimiter.UsageRecord, error) {
+	records, err := s.storage.ListUsage(ctx, period, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// records of hashed keys are found by the hash of the key asked for
+	if key != "" {
+		key = s.adminKey(key)
+	}
+
+	filtered := make([]*ratelimiter.UsageRecord, 0, len(records))
+	for _, record := range records {
+		if key == "" || record.Key == key {
+			filtered = append(filtered, record)
+		}
+	}
+
+	sort.Slice(filtered, func(i, j int) bool {
+		if !filtered[i].Start.Equal(filtered[j].Start) {
+			return filtered[i].Start.Before(filtered[j].Start)
+		}
+		return filtered[i].Key < filtered[j].Key
+	})
+
+	return filtered, nil
+}
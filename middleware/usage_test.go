@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newUsageService(t *testing.T, rateLimitStorage ratelimiter.Storage) *Service {
+	config := storage.GetDefaultConfig().RateLimit
+	config.UsageEnabled = true
+	config.IPRateLimit = 100
+	return NewService(config, rateLimitStorage)
+}
+
+func TestUsageRollup(t *testing.T) {
+	ctx := context.Background()
+	memory := storage.NewMemoryStorage()
+	service := newUsageService(t, memory)
+
+	for i := 0; i < 3; i++ {
+		allowed, err := service.CheckRateLimit("192.168.1.1", false, 1)
+		require.NoError(t, err)
+		require.True(t, allowed)
+	}
+	_, err := service.CheckRateLimit("token:gold", true, 1)
+	require.NoError(t, err)
+
+	require.NoError(t, service.FlushUsage(ctx))
+
+	now := time.Now()
+	seconds, err := service.ListUsage(ctx, ratelimiter.UsagePeriodSecond, now.Add(-time.Minute), now, "")
+	require.NoError(t, err)
+	require.NotEmpty(t, seconds)
+
+	require.NoError(t, service.RollupUsage(ctx, now.Add(time.Second)))
+
+	seconds, err = service.ListUsage(ctx, ratelimiter.UsagePeriodSecond, now.Add(-time.Minute), now, "")
+	require.NoError(t, err)
+	assert.Empty(t, seconds, "rolled up seconds are compacted away")
+
+	hours, err := service.ListUsage(ctx, ratelimiter.UsagePeriodHour, now.Add(-2*time.Hour), now, "192.168.1.1")
+	require.NoError(t, err)
+	require.Len(t, hours, 1)
+	assert.Equal(t, int64(3), hours[0].Count)
+	assert.Equal(t, now.UTC().Truncate(time.Hour), hours[0].Start)
+
+	days, err := service.ListUsage(ctx, ratelimiter.UsagePeriodDay, now.Add(-48*time.Hour), now, "")
+	require.NoError(t, err)
+	require.Len(t, days, 2)
+	assert.Equal(t, "192.168.1.1", days[0].Key)
+	assert.Equal(t, "token:gold", days[1].Key)
+	assert.Equal(t, int64(1), days[1].Count)
+}
+
+func TestUsageRollupAcrossNamespaces(t *testing.T) {
+	ctx := context.Background()
+	memory := storage.NewMemoryStorage()
+	base := newUsageService(t, memory)
+	app := newUsageService(t, storage.NewNamespacedStorage(memory, "billing"))
+
+	_, err := base.CheckRateLimit("10.0.0.1", false, 1)
+	require.NoError(t, err)
+	_, err = app.CheckRateLimit("10.0.0.1", false, 1)
+	require.NoError(t, err)
+	require.NoError(t, base.FlushUsage(ctx))
+	require.NoError(t, app.FlushUsage(ctx))
+
+	now := time.Now()
+	require.NoError(t, base.RollupUsage(ctx, now.Add(time.Second)))
+
+	records, err := app.ListUsage(ctx, ratelimiter.UsagePeriodHour, now.Add(-2*time.Hour), now, "")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "10.0.0.1", records[0].Key)
+
+	records, err = base.ListUsage(ctx, ratelimiter.UsagePeriodHour, now.Add(-2*time.Hour), now, "")
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+}
+
+func TestUsageDisabled(t *testing.T) {
+	ctx := context.Background()
+	memory := storage.NewMemoryStorage()
+	service := NewService(storage.GetDefaultConfig().RateLimit, memory)
+
+	_, err := service.CheckRateLimit("10.0.0.1", false, 1)
+	require.NoError(t, err)
+	require.NoError(t, service.FlushUsage(ctx))
+
+	records, err := memory.ListUsage(ctx, ratelimiter.UsagePeriodSecond, time.Now().Add(-time.Minute), time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, records)
+}
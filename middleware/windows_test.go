@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterStackedWindows(t *testing.T) {
+	backends := map[string]func() ratelimiter.Storage{
+		"atomic": func() ratelimiter.Storage { return storage.NewMemoryStorage() },
+		"multi":  func() ratelimiter.Storage { return plainStorage{storage.NewMemoryStorage()} },
+	}
+
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := backend()
+			now := time.Now()
+			limiter, err := ratelimiter.NewLimiter(ratelimiter.WithStorage(s), ratelimiter.WithClock(func() time.Time { return now }))
+			require.NoError(t, err)
+
+			limits := ratelimiter.Limits{Limit: 5, BlockTime: 10 * time.Second}
+			windows := []ratelimiter.Window{{Limit: 3, Length: time.Minute}}
+			for i := 0; i < 2; i++ {
+				result, err := limiter.AllowWindowsN(ctx, "user:1", limits, windows, 1)
+				require.NoError(t, err)
+				assert.True(t, result.Allowed)
+				assert.Equal(t, 3, result.Limit, "the minute window is the most constraining")
+				assert.Equal(t, 2-i, result.Remaining)
+			}
+
+			result, err := limiter.AllowWindowsN(ctx, "user:1", limits, windows, 2)
+			require.NoError(t, err)
+			assert.False(t, result.Allowed, "the cost fits in the second but not in the minute")
+			assert.Equal(t, 3, result.Limit)
+			assert.Equal(t, 10*time.Second, result.RetryAfter)
+
+			stacked, err := s.Get(ctx, ratelimiter.WindowKey("user:1", time.Minute))
+			require.NoError(t, err)
+			require.NotNil(t, stacked)
+			assert.Equal(t, 2, stacked.Count)
+
+			now = now.Add(11 * time.Second)
+			result, err = limiter.AllowWindowsN(ctx, "user:1", limits, windows, 1)
+			require.NoError(t, err)
+			assert.True(t, result.Allowed, "a new second and the last request of the minute")
+			assert.Equal(t, 0, result.Remaining)
+
+			result, err = limiter.AllowWindowsN(ctx, "user:1", limits, windows, 1)
+			require.NoError(t, err)
+			assert.False(t, result.Allowed)
+		})
+	}
+}
+
+func TestWindowKey(t *testing.T) {
+	key := ratelimiter.WindowKey("token:gold", time.Hour)
+	assert.Equal(t, "token:gold:w3600", key)
+
+	base, length, found := ratelimiter.CutWindowKey(key)
+	assert.True(t, found)
+	assert.Equal(t, "token:gold", base)
+	assert.Equal(t, time.Hour, length)
+
+	_, _, found = ratelimiter.CutWindowKey("token:gold")
+	assert.False(t, found)
+	_, _, found = ratelimiter.CutWindowKey("token:wide")
+	assert.False(t, found)
+}
+
+func TestLoadPolicyWindows(t *testing.T) {
+	unsetEnv(t, "IP_RATE_LIMIT", "IP_BLOCK_TIME", "APPS", "HOST_TEMPLATES")
+	t.Setenv("POLICIES", "api")
+	t.Setenv("POLICY_API_LIMIT", "10")
+	t.Setenv("POLICY_API_WINDOWS", "300/60, 5000/3600")
+	t.Setenv("IP_POLICY", "api")
+
+	appConfig, err := storage.LoadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []ratelimiter.Window{{Limit: 300, Length: time.Minute}, {Limit: 5000, Length: time.Hour}}, appConfig.RateLimit.Policies["api"].Windows)
+
+	t.Setenv("POLICY_API_WINDOWS", "300/60,400/60")
+	_, err = storage.LoadConfig()
+	assert.ErrorContains(t, err, "POLICY_API_WINDOWS")
+
+	t.Setenv("POLICY_API_WINDOWS", "300/60")
+	t.Setenv("POLICY_API_ALGORITHM", "token_bucket")
+	_, err = storage.LoadConfig()
+	assert.ErrorContains(t, err, "fixed_window")
+}
+
+func TestServiceStackedWindows(t *testing.T) {
+	service := NewService(storage.Config{
+		IPRateLimit: 10,
+		IPBlockTime: 60,
+		IPPolicy:    "api",
+		Policies: map[string]storage.Policy{"api": {
+			Name: "api", Limit: 10, BlockTime: 60, Algorithm: ratelimiter.AlgorithmFixedWindow,
+			Windows: []ratelimiter.Window{{Limit: 2, Length: time.Hour}},
+		}},
+	}, storage.NewMemoryStorage())
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		check, err := service.checkRateLimit(ctx, "10.0.0.1", false, 1)
+		require.NoError(t, err)
+		assert.True(t, check.Allowed)
+		assert.Equal(t, 2, check.Limit)
+	}
+	check, err := service.checkRateLimit(ctx, "10.0.0.1", false, 1)
+	require.NoError(t, err)
+	assert.False(t, check.Allowed, "the hour window is used up")
+
+	state, err := service.GetLimitState(ctx, ratelimiter.WindowKey("10.0.0.1", time.Hour))
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, 2, state.Limit, "the state of a stacked window reports its own limit")
+	assert.True(t, state.Blocked)
+
+	require.NoError(t, service.ResetLimit(ctx, "10.0.0.1"))
+	check, err = service.checkRateLimit(ctx, "10.0.0.1", false, 1)
+	require.NoError(t, err)
+	assert.True(t, check.Allowed, "a reset clears the stacked windows too")
+}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStorage keeps rate limits in a map and counts the writes it receives
+type countingStorage struct {
+	ratelimiter.Storage
+
+	mu     sync.Mutex
+	data   map[string]ratelimiter.RateLimit
+	writes int
+}
+
+func newCountingStorage() *countingStorage {
+	return &countingStorage{data: make(map[string]ratelimiter.RateLimit)}
+}
+
+func (c *countingStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLimit, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rateLimit, exists := c.data[key]
+	if !exists {
+		return nil, nil
+	}
+	return &rateLimit, nil
+}
+
+func (c *countingStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.data[key] = *rateLimit
+	c.writes++
+	return nil
+}
+
+func (c *countingStorage) Close() error {
+	return nil
+}
+
+func (c *countingStorage) Writes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes
+}
+
+func TestWriteBehindStorage(t *testing.T) {
+	t.Run("buffers_and_flushes", func(t *testing.T) {
+		inner := newCountingStorage()
+		writeBehind := storage.NewWriteBehindStorage(inner, time.Hour, 0)
+
+		service := &Service{
+			config:  storage.Config{IPRateLimit: 100, IPBlockTime: 60},
+			storage: writeBehind,
+		}
+
+		for i := 0; i < 5; i++ {
+			allowed, err := service.CheckRateLimit("192.168.1.1", false, 1)
+			require.NoError(t, err)
+			assert.True(t, allowed)
+		}
+
+		assert.Equal(t, 0, inner.Writes())
+
+		rateLimit, err := writeBehind.Get(context.Background(), "192.168.1.1")
+		require.NoError(t, err)
+		assert.Equal(t, 5, rateLimit.Count)
+
+		require.NoError(t, writeBehind.Close())
+		assert.Equal(t, 1, inner.Writes())
+		assert.Equal(t, 5, inner.data["192.168.1.1"].Count)
+	})
+
+	t.Run("flushes_when_full", func(t *testing.T) {
+		inner := newCountingStorage()
+		writeBehind := storage.NewWriteBehindStorage(inner, time.Hour, 3)
+		defer writeBehind.Close()
+
+		ctx := context.Background()
+		for i := 0; i < 3; i++ {
+			require.NoError(t, writeBehind.Set(ctx, "192.168.1.1", &ratelimiter.RateLimit{Count: i + 1}, time.Minute))
+		}
+
+		assert.Eventually(t, func() bool {
+			return inner.Writes() == 1
+		}, time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,40 @@
+// Package example shows how an extension compiled into the server registers itself.
+// It is linked in by cmd/plugins_example.go, built with -tags example_plugins.
+package example
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"rate-limiter/middleware"
+	"rate-limiter/storage"
+)
+
+func init() {
+	middleware.RegisterKeyExtractor("subdomain", SubdomainExtractor)
+	middleware.RegisterHook("log_denied", middleware.HookFunc(logDenied))
+}
+
+// SubdomainExtractor uses the tenant subdomain of the host as the API key, acme for
+// acme.api.example.com. Hosts of two labels or fewer carry no tenant.
+func SubdomainExtractor(config storage.Config) middleware.KeyExtractor {
+	return func(r *http.Request) (string, bool) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) != nil || strings.Count(host, ".") < 2 {
+			return "", false
+		}
+		tenant, _, _ := strings.Cut(host, ".")
+		return tenant, tenant != ""
+	}
+}
+
+func logDenied(decision middleware.Decision) {
+	if !decision.Allowed {
+		slog.Info("Denied", "method", decision.Method, "path", decision.Path, "key", storage.RedactKey(decision.Key), "reason", decision.Reason)
+	}
+}
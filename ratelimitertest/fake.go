@@ -0,0 +1,292 @@
+package ratelimitertest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+)
+
+// FakeStorage is an in-memory Storage for unit tests of applications embedding the
+// limiter. It behaves like the memory storage, atomic checks included, until the test
+// makes an operation fail, slows every call down or seeds counters directly.
+//
+// Operations are named after the methods of ratelimiter.Storage and
+// ratelimiter.AtomicStorage: "Get", "Set", "AllowWindows", "Consume", and so on,
+// plus "AllowWindowsBatch" of ratelimiter.BatchStorage.
+type FakeStorage struct {
+	memory *storage.MemoryStorage
+
+	mu        sync.Mutex
+	opErrors  map[string]error
+	keyErrors map[string]error
+	latency   time.Duration
+	calls     map[string]int
+}
+
+func NewFakeStorage() *FakeStorage {
+	return &FakeStorage{
+		memory:    storage.NewMemoryStorage(),
+		opErrors:  make(map[string]error),
+		keyErrors: make(map[string]error),
+		calls:     make(map[string]int),
+	}
+}
+
+// SetClock sets the clock the expirations are measured with
+func (f *FakeStorage) SetClock(clock ratelimiter.Clock) {
+	f.memory.SetClock(clock)
+}
+
+// FailOn makes every call of the operation return err; a nil err makes it succeed again
+func (f *FakeStorage) FailOn(op string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.opErrors, op)
+		return
+	}
+	f.opErrors[op] = err
+}
+
+// FailKey makes every counter operation on the key return err; a nil err makes them
+// succeed again. An atomic check fails when any of its windows does.
+func (f *FakeStorage) FailKey(key string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.keyErrors, key)
+		return
+	}
+	f.keyErrors[key] = err
+}
+
+// SetLatency delays every call by d, or until its context is done
+func (f *FakeStorage) SetLatency(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency = d
+}
+
+// Calls returns how many times the operation was called, failed calls included
+func (f *FakeStorage) Calls(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// Seed stores a counter without expiration, bypassing failures and latency
+func (f *FakeStorage) Seed(key string, rateLimit ratelimiter.RateLimit) {
+	f.memory.Set(context.Background(), key, &rateLimit, 0)
+}
+
+// Counter returns the stored counter of the key, bypassing failures and latency
+func (f *FakeStorage) Counter(key string) (ratelimiter.RateLimit, bool) {
+	rateLimit, _ := f.memory.Get(context.Background(), key)
+	if rateLimit == nil {
+		return ratelimiter.RateLimit{}, false
+	}
+	return *rateLimit, true
+}
+
+// call records a call of the operation, waits for the latency and returns the failure
+// set for the operation or for one of the keys
+func (f *FakeStorage) call(ctx context.Context, op string, keys ...string) error {
+	f.mu.Lock()
+	f.calls[op]++
+	latency := f.latency
+	err := f.opErrors[op]
+	for _, key := range keys {
+		if err == nil {
+			err = f.keyErrors[key]
+		}
+	}
+	f.mu.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return err
+}
+
+func (f *FakeStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLimit, error) {
+	if err := f.call(ctx, "Get", key); err != nil {
+		return nil, err
+	}
+	return f.memory.Get(ctx, key)
+}
+
+func (f *FakeStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
+	if err := f.call(ctx, "Set", key); err != nil {
+		return err
+	}
+	return f.memory.Set(ctx, key, rateLimit, expiration)
+}
+
+func (f *FakeStorage) AllowWindows(ctx context.Context, checks []ratelimiter.WindowCheck, cost int, now time.Time) (ratelimiter.Result, error) {
+	keys := make([]string, len(checks))
+	for i, check := range checks {
+		keys[i] = check.Key
+	}
+	if err := f.call(ctx, "AllowWindows", keys...); err != nil {
+		return ratelimiter.Result{}, err
+	}
+	return f.memory.AllowWindows(ctx, checks, cost, now)
+}
+
+func (f *FakeStorage) GetMulti(ctx context.Context, keys []string) ([]*ratelimiter.RateLimit, error) {
+	if err := f.call(ctx, "GetMulti", keys...); err != nil {
+		return nil, err
+	}
+	return f.memory.GetMulti(ctx, keys)
+}
+
+func (f *FakeStorage) SetMulti(ctx context.Context, entries []ratelimiter.RateLimitEntry) error {
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+	if err := f.call(ctx, "SetMulti", keys...); err != nil {
+		return err
+	}
+	return f.memory.SetMulti(ctx, entries)
+}
+
+// AllowWindowsBatch is one "AllowWindowsBatch" operation, with a single latency, whose
+// error fails every call of the batch
+func (f *FakeStorage) AllowWindowsBatch(ctx context.Context, calls []*ratelimiter.WindowCall) {
+	var keys []string
+	for _, call := range calls {
+		for _, check := range call.Checks {
+			keys = append(keys, check.Key)
+		}
+	}
+	if err := f.call(ctx, "AllowWindowsBatch", keys...); err != nil {
+		for _, call := range calls {
+			call.Err = err
+		}
+		return
+	}
+	f.memory.AllowWindowsBatch(ctx, calls)
+}
+
+func (f *FakeStorage) Consume(ctx context.Context, key string, cost int, start time.Time, expiration time.Duration) (int, error) {
+	if err := f.call(ctx, "Consume", key); err != nil {
+		return 0, err
+	}
+	return f.memory.Consume(ctx, key, cost, start, expiration)
+}
+
+func (f *FakeStorage) Refund(ctx context.Context, key string, cost int, at time.Time) error {
+	if err := f.call(ctx, "Refund", key); err != nil {
+		return err
+	}
+	return f.memory.Refund(ctx, key, cost, at)
+}
+
+func (f *FakeStorage) Delete(ctx context.Context, key string) error {
+	if err := f.call(ctx, "Delete", key); err != nil {
+		return err
+	}
+	return f.memory.Delete(ctx, key)
+}
+
+func (f *FakeStorage) List(ctx context.Context) ([]string, error) {
+	if err := f.call(ctx, "List"); err != nil {
+		return nil, err
+	}
+	return f.memory.List(ctx)
+}
+
+func (f *FakeStorage) AddBan(ctx context.Context, ban *ratelimiter.Ban) error {
+	if err := f.call(ctx, "AddBan"); err != nil {
+		return err
+	}
+	return f.memory.AddBan(ctx, ban)
+}
+
+func (f *FakeStorage) RemoveBan(ctx context.Context, value string) error {
+	if err := f.call(ctx, "RemoveBan"); err != nil {
+		return err
+	}
+	return f.memory.RemoveBan(ctx, value)
+}
+
+func (f *FakeStorage) ListBans(ctx context.Context) ([]*ratelimiter.Ban, error) {
+	if err := f.call(ctx, "ListBans"); err != nil {
+		return nil, err
+	}
+	return f.memory.ListBans(ctx)
+}
+
+func (f *FakeStorage) SetTokenConfig(ctx context.Context, tokenConfig *ratelimiter.TokenConfig) error {
+	if err := f.call(ctx, "SetTokenConfig"); err != nil {
+		return err
+	}
+	return f.memory.SetTokenConfig(ctx, tokenConfig)
+}
+
+func (f *FakeStorage) DeleteTokenConfig(ctx context.Context, name string) error {
+	if err := f.call(ctx, "DeleteTokenConfig"); err != nil {
+		return err
+	}
+	return f.memory.DeleteTokenConfig(ctx, name)
+}
+
+func (f *FakeStorage) ListTokenConfigs(ctx context.Context) ([]*ratelimiter.TokenConfig, error) {
+	if err := f.call(ctx, "ListTokenConfigs"); err != nil {
+		return nil, err
+	}
+	return f.memory.ListTokenConfigs(ctx)
+}
+
+func (f *FakeStorage) AddUsage(ctx context.Context, period string, start time.Time, counts map[string]int64, retention time.Duration) error {
+	if err := f.call(ctx, "AddUsage"); err != nil {
+		return err
+	}
+	return f.memory.AddUsage(ctx, period, start, counts, retention)
+}
+
+func (f *FakeStorage) TakeUsage(ctx context.Context, period string, before time.Time) ([]*ratelimiter.UsageRecord, error) {
+	if err := f.call(ctx, "TakeUsage"); err != nil {
+		return nil, err
+	}
+	return f.memory.TakeUsage(ctx, period, before)
+}
+
+func (f *FakeStorage) ListUsage(ctx context.Context, period string, from, to time.Time) ([]*ratelimiter.UsageRecord, error) {
+	if err := f.call(ctx, "ListUsage"); err != nil {
+		return nil, err
+	}
+	return f.memory.ListUsage(ctx, period, from, to)
+}
+
+func (f *FakeStorage) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	if err := f.call(ctx, "AcquireLease"); err != nil {
+		return false, err
+	}
+	return f.memory.AcquireLease(ctx, name, holder, ttl)
+}
+
+func (f *FakeStorage) ReleaseLease(ctx context.Context, name, holder string) error {
+	if err := f.call(ctx, "ReleaseLease"); err != nil {
+		return err
+	}
+	return f.memory.ReleaseLease(ctx, name, holder)
+}
+
+func (f *FakeStorage) Ping(ctx context.Context) error {
+	return f.call(ctx, "Ping")
+}
+
+func (f *FakeStorage) Close() error {
+	return f.memory.Close()
+}
@@ -0,0 +1,49 @@
+// Package ratelimitertest provides the storages the tests of the rate limiter run
+// against.
+package ratelimitertest
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	ratelimiter "rate-limiter"
+	"rate-limiter/storage"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// RedisStorage returns a Redis storage on an in-process miniredis started for the test.
+// With REDIS_ADDR set, e.g. localhost:6379, the tests run against DB 1 of that Redis
+// instead, and fail when it can't be reached. The storage is closed when the test ends.
+func RedisStorage(t testing.TB) ratelimiter.Storage {
+	t.Helper()
+	return RedisStorages(t, 1)[0]
+}
+
+// RedisStorages returns n Redis storages on the same Redis, like the storages of n
+// instances sharing it, picked as RedisStorage does
+func RedisStorages(t testing.TB, n int) []ratelimiter.Storage {
+	t.Helper()
+
+	addr, db := os.Getenv("REDIS_ADDR"), 1
+	if addr == "" {
+		addr, db = miniredis.RunT(t).Addr(), 0
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("invalid Redis address %q: %v", addr, err)
+	}
+
+	storages := make([]ratelimiter.Storage, n)
+	for i := range storages {
+		redisStorage, err := storage.NewRedisStorage(ratelimiter.StorageConfig{Host: host, Port: port, DB: db})
+		if err != nil {
+			t.Fatalf("failed to connect to Redis at %s: %v", addr, err)
+		}
+		t.Cleanup(func() { redisStorage.Close() })
+		storages[i] = redisStorage
+	}
+	return storages
+}
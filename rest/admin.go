@@ -0,0 +1,438 @@
+package rest
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	ratelimiter "rate-limiter"
+	"rate-limiter/middleware"
+	"rate-limiter/storage"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type banRequest struct {
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// SetupAdminRoutes mounts the admin API; it is disabled when no admin token is configured.
+// Each app is scoped under /admin/apps/{name} and also accepts its own admin token.
+// Every path is served versioned under /admin/v1 and /admin/v2 too, see mountVersioned.
+func SetupAdminRoutes(r chi.Router, rateLimiterService *middleware.Service, apps ...*middleware.App) {
+	globalToken := func() []string {
+		return []string{rateLimiterService.Config().AdminToken}
+	}
+
+	if rateLimiterService.Config().AdminToken != "" {
+		mountVersioned(r, rateLimiterService, "", adminAuth(rateLimiterService, globalToken), func(r chi.Router) {
+			r.Post("/reload", reloadHandler(rateLimiterService))
+			r.Get("/read-only", readOnlyHandler(rateLimiterService))
+			r.Put("/read-only", setReadOnlyHandler(rateLimiterService))
+			mountAdminRoutes(r, rateLimiterService)
+		})
+	}
+
+	for _, app := range apps {
+		service := app.Service
+		appTokens := func() []string {
+			return append(globalToken(), service.Config().AdminToken)
+		}
+		mountVersioned(r, rateLimiterService, "/apps/"+app.Name, adminAuth(service, appTokens), func(r chi.Router) {
+			mountAdminRoutes(r, service)
+		})
+	}
+}
+
+func mountAdminRoutes(r chi.Router, rateLimiterService *middleware.Service) {
+	r.Get("/limits", listLimitsHandler(rateLimiterService))
+	r.Delete("/limits", resetLimitsHandler(rateLimiterService))
+	r.Get("/limits/{key}", getLimitHandler(rateLimiterService))
+	r.Delete("/limits/{key}", resetLimitHandler(rateLimiterService))
+	r.Get("/blocked", listBlockedHandler(rateLimiterService))
+	r.Get("/decisions", streamDecisionsHandler(rateLimiterService))
+	r.Get("/stats", statsHandler(rateLimiterService))
+	r.Get("/stats/top", topRejectedHandler(rateLimiterService))
+	r.Get("/stats/{key}", keyStatsHandler(rateLimiterService))
+	r.Get("/usage", listUsageHandler(rateLimiterService))
+
+	r.Get("/denylist", listBansHandler(rateLimiterService))
+	r.Post("/denylist", addBanHandler(rateLimiterService))
+	r.Delete("/denylist/*", removeBanHandler(rateLimiterService))
+
+	r.Get("/tokens", listTokensHandler(rateLimiterService))
+	r.Post("/tokens", createTokenHandler(rateLimiterService))
+	r.Get("/tokens/{name}", getTokenHandler(rateLimiterService))
+	r.Put("/tokens/{name}", updateTokenHandler(rateLimiterService))
+	r.Delete("/tokens/{name}", deleteTokenHandler(rateLimiterService))
+	r.Post("/quota-transfers", transferQuotaHandler(rateLimiterService))
+
+	r.Get("/suggestions", suggestionsHandler(rateLimiterService))
+	r.Post("/suggestions", startAnalysisHandler(rateLimiterService))
+	r.Delete("/suggestions", stopAnalysisHandler(rateLimiterService))
+}
+
+// adminAuth checks the bearer token against the current admin tokens, so tokens
+// changed by a config reload apply immediately
+func adminAuth(service *middleware.Service, adminTokens func() []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			for _, adminToken := range adminTokens() {
+				if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			writeError(w, service, http.StatusUnauthorized, "unauthorized")
+		})
+	}
+}
+
+func reloadHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := service.ReloadConfig(r.Context())
+		if errors.Is(err, middleware.ErrReloadNotSupported) {
+			writeError(w, service, http.StatusNotImplemented, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, service, http.StatusInternalServerError, fmt.Sprintf("failed to reload config: %v", err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type readOnlyRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+type readOnlyResponse struct {
+	ReadOnly bool `json:"read_only"`
+}
+
+func readOnlyHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, service, http.StatusOK, readOnlyResponse{ReadOnly: service.IsReadOnly()})
+	}
+}
+
+// setReadOnlyHandler switches the read-only mode of the shared storage, for every app
+func setReadOnlyHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req readOnlyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, service, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		if err := service.SetReadOnly(req.Enabled); err != nil {
+			writeError(w, service, http.StatusNotImplemented, err.Error())
+			return
+		}
+		slog.Info("Read-only mode set through the admin API", "enabled", req.Enabled)
+		writeJSON(w, service, http.StatusOK, readOnlyResponse{ReadOnly: service.IsReadOnly()})
+	}
+}
+
+// writeStatus is the status of a failed admin write: 503 while the storage is read-only
+func writeStatus(err error) int {
+	if errors.Is(err, storage.ErrReadOnly) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func getLimitHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state, err := service.GetLimitState(r.Context(), chi.URLParam(r, "key"))
+		if err != nil {
+			writeError(w, service, http.StatusInternalServerError, "failed to get limit")
+			return
+		}
+		if state == nil {
+			writeError(w, service, http.StatusNotFound, "key not found")
+			return
+		}
+		writeJSON(w, service, http.StatusOK, state)
+	}
+}
+
+func resetLimitHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := service.ResetLimit(r.Context(), chi.URLParam(r, "key")); err != nil {
+			writeError(w, service, writeStatus(err), "failed to reset limit")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// listLimitsHandler lists the state of the keys starting with the prefix query
+// parameter, every key without it
+func listLimitsHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		states, err := service.ListLimits(r.Context(), r.URL.Query().Get("prefix"))
+		if err != nil {
+			writeError(w, service, http.StatusInternalServerError, "failed to list limits")
+			return
+		}
+		writeJSON(w, service, http.StatusOK, states)
+	}
+}
+
+// resetLimitsHandler resets the keys starting with the prefix query parameter, which is
+// required so a bare DELETE never wipes every counter
+func resetLimitsHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+		if prefix == "" {
+			writeError(w, service, http.StatusBadRequest, "prefix is required")
+			return
+		}
+		reset, err := service.ResetLimits(r.Context(), prefix)
+		if err != nil {
+			writeError(w, service, writeStatus(err), "failed to reset limits")
+			return
+		}
+		writeJSON(w, service, http.StatusOK, map[string]int{"reset": reset})
+	}
+}
+
+func listBlockedHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		blocked, err := service.ListBlocked(r.Context())
+		if err != nil {
+			writeError(w, service, http.StatusInternalServerError, "failed to list blocked keys")
+			return
+		}
+		writeJSON(w, service, http.StatusOK, blocked)
+	}
+}
+
+// streamDecisionsHandler streams live decisions as server-sent events, filtered by the
+// key, client_ip, host, reason and allowed query parameters. From v2 on each event is
+// named "decision" and numbered within the stream, so EventSource clients can listen
+// for decisions alone.
+func streamDecisionsHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, service, http.StatusInternalServerError, "streaming not supported")
+			return
+		}
+
+		filters := r.URL.Query()
+		matches := func(decision middleware.Decision) bool {
+			if key := filters.Get("key"); key != "" && key != decision.Key {
+				return false
+			}
+			if clientIP := filters.Get("client_ip"); clientIP != "" && clientIP != decision.ClientIP {
+				return false
+			}
+			if host := filters.Get("host"); host != "" && !strings.EqualFold(host, decision.Host) {
+				return false
+			}
+			if reason := filters.Get("reason"); reason != "" && reason != decision.Reason {
+				return false
+			}
+			if allowed := filters.Get("allowed"); allowed != "" && allowed != strconv.FormatBool(decision.Allowed) {
+				return false
+			}
+			return true
+		}
+
+		// The stream outlives SERVER_WRITE_TIMEOUT; it lasts until the client leaves
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+		decisions, unsubscribe := service.Decisions().Subscribe(256)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(15 * time.Second)
+		defer keepAlive.Stop()
+
+		typed := apiVersionOf(r) >= apiV2
+		var sequence uint64
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			case decision := <-decisions:
+				if !matches(decision) {
+					continue
+				}
+				data, err := service.ResponseFormat().Marshal(decision)
+				if err != nil {
+					continue
+				}
+				if typed {
+					sequence++
+					fmt.Fprintf(w, "event: decision\nid: %d\n", sequence)
+				}
+				fmt.Fprintf(w, "data: %s\n\n", data)
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// statsHandler returns the counters of the service; under /admin/apps/{name} they are
+// scoped to the app or host
+func statsHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, service, http.StatusOK, service.Stats())
+	}
+}
+
+// maxTopRejected caps the n of GET /admin/stats/top, each key costing a few reads
+const maxTopRejected = 1000
+
+func keyStatsHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := service.GetKeyStats(r.Context(), chi.URLParam(r, "key"))
+		if err != nil {
+			writeError(w, service, http.StatusInternalServerError, "failed to get key stats")
+			return
+		}
+		if stats == nil {
+			writeError(w, service, http.StatusNotFound, "key not found")
+			return
+		}
+		writeJSON(w, service, http.StatusOK, stats)
+	}
+}
+
+// topRejectedHandler lists the most refused keys; n defaults to 20
+func topRejectedHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := 20
+		if raw := r.URL.Query().Get("n"); raw != "" {
+			parsed, err := strconv.Atoi(raw)
+			if err != nil || parsed <= 0 || parsed > maxTopRejected {
+				writeError(w, service, http.StatusBadRequest, fmt.Sprintf("n must be between 1 and %d", maxTopRejected))
+				return
+			}
+			n = parsed
+		}
+
+		top, err := service.TopRejected(r.Context(), n)
+		if err != nil {
+			writeError(w, service, http.StatusInternalServerError, "failed to list the most refused keys")
+			return
+		}
+		writeJSON(w, service, http.StatusOK, top)
+	}
+}
+
+// listUsageHandler returns rolled up usage for billing exports and dashboards. Query
+// parameters: period (hour, day or second; default hour), from and to (RFC 3339;
+// default the last 24 hours) and key.
+func listUsageHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		period := query.Get("period")
+		switch period {
+		case "":
+			period = ratelimiter.UsagePeriodHour
+		case ratelimiter.UsagePeriodHour, ratelimiter.UsagePeriodDay, ratelimiter.UsagePeriodSecond:
+		default:
+			writeError(w, service, http.StatusBadRequest, "invalid period")
+			return
+		}
+
+		to := time.Now()
+		from := to.Add(-24 * time.Hour)
+		for name, value := range map[string]*time.Time{"from": &from, "to": &to} {
+			if raw := query.Get(name); raw != "" {
+				parsed, err := time.Parse(time.RFC3339, raw)
+				if err != nil {
+					writeError(w, service, http.StatusBadRequest, "invalid "+name)
+					return
+				}
+				*value = parsed
+			}
+		}
+
+		records, err := service.ListUsage(r.Context(), period, from, to, query.Get("key"))
+		if err != nil {
+			writeError(w, service, http.StatusInternalServerError, "failed to list usage")
+			return
+		}
+		writeJSON(w, service, http.StatusOK, records)
+	}
+}
+
+func listBansHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bans, err := service.ListBans(r.Context())
+		if err != nil {
+			writeError(w, service, http.StatusInternalServerError, "failed to list bans")
+			return
+		}
+		writeJSON(w, service, http.StatusOK, bans)
+	}
+}
+
+func addBanHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req banRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, service, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		ban, err := service.AddBan(r.Context(), strings.TrimSpace(req.Value), req.Reason)
+		if errors.Is(err, middleware.ErrInvalidDenylistEntry) {
+			writeError(w, service, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, service, writeStatus(err), "failed to add ban")
+			return
+		}
+		writeJSON(w, service, http.StatusCreated, ban)
+	}
+}
+
+func removeBanHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		value := chi.URLParam(r, "*")
+		if value == "" {
+			writeError(w, service, http.StatusBadRequest, "missing denylist entry")
+			return
+		}
+
+		if err := service.RemoveBan(r.Context(), value); err != nil {
+			writeError(w, service, writeStatus(err), "failed to remove ban")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// writeJSON answers in the serialization profile of the service
+func writeJSON(w http.ResponseWriter, service *middleware.Service, statusCode int, v interface{}) {
+	service.ResponseFormat().WriteJSON(w, statusCode, v)
+}
+
+func writeError(w http.ResponseWriter, service *middleware.Service, statusCode int, message string) {
+	service.ResponseFormat().WriteError(w, statusCode, message)
+}
@@ -0,0 +1,128 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"rate-limiter/middleware"
+	"rate-limiter/storage"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResetLimitsByPrefix(t *testing.T) {
+	service := middleware.NewService(storage.Config{
+		IPRateLimit: 10,
+		IPBlockTime: 60,
+		AdminToken:  "secret",
+	}, storage.NewMemoryStorage())
+	router := chi.NewRouter()
+	SetupAdminRoutes(router, service)
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "192.168.1.1"} {
+		_, err := service.CheckRateLimit(ip, false, 1)
+		require.NoError(t, err)
+	}
+
+	send := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodDelete, "/admin/limits").Code)
+
+	rr := send(http.MethodDelete, "/admin/limits?prefix=10.")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"reset": 2}`, rr.Body.String())
+
+	rr = send(http.MethodGet, "/admin/limits?prefix=10.")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `[]`, rr.Body.String())
+}
+
+func TestKeyStats(t *testing.T) {
+	service := middleware.NewService(storage.Config{
+		IPRateLimit:       1,
+		IPBlockTime:       60,
+		AdminToken:        "secret",
+		KeyStatsRetention: 30,
+	}, storage.NewMemoryStorage())
+	router := SetupRouter(service)
+
+	for ip, requests := range map[string]int{"10.0.0.1": 4, "10.0.0.2": 2} {
+		for i := 0; i < requests; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/api/test", nil)
+			req.RemoteAddr = ip + ":1234"
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	}
+	require.NoError(t, service.FlushRejections(context.Background()))
+
+	send := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send("/admin/stats/10.0.0.1")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var stats middleware.KeyStats
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &stats))
+	assert.Equal(t, 1, stats.Count)
+	assert.Equal(t, 1, stats.Limit)
+	assert.Equal(t, 3, stats.Rejections)
+	assert.False(t, stats.WindowStart.IsZero())
+	assert.WithinDuration(t, time.Now().Add(time.Minute), stats.BlockedUntil, 5*time.Second)
+
+	rr = send("/admin/stats/top?n=1")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var top []middleware.KeyStats
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &top))
+	require.Len(t, top, 1)
+	assert.Equal(t, "10.0.0.1", top[0].Key)
+
+	assert.Equal(t, http.StatusNotFound, send("/admin/stats/10.0.0.9").Code)
+	assert.Equal(t, http.StatusBadRequest, send("/admin/stats/top?n=0").Code)
+}
+
+func TestAddBanStatus(t *testing.T) {
+	readOnly := storage.NewReadOnlyStorage(storage.NewMemoryStorage(), false)
+	service := middleware.NewService(storage.Config{
+		IPRateLimit: 10,
+		IPBlockTime: 60,
+		AdminToken:  "secret",
+	}, readOnly)
+	router := chi.NewRouter()
+	SetupAdminRoutes(router, service)
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/denylist", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send(`{"value": "not-an-ip"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "invalid denylist entry")
+
+	assert.Equal(t, http.StatusCreated, send(`{"value": "10.0.0.1"}`).Code)
+
+	readOnly.SetReadOnly(true)
+	rr = send(`{"value": "10.0.0.2"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code, "a storage error is not the fault of the request")
+	assert.Contains(t, rr.Body.String(), "failed to add ban")
+}
@@ -0,0 +1,20 @@
+//go:build autocert
+
+package rest
+
+import (
+	"crypto/tls"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// autocertTLSConfig gets the certificates of domains from Let's Encrypt through the
+// TLS-ALPN-01 challenge, so the listener needs to be reachable on port 443
+func autocertTLSConfig(domains []string, cacheDir string) (*tls.Config, error) {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+	}
+	return manager.TLSConfig(), nil
+}
@@ -0,0 +1,81 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"rate-limiter/middleware"
+	"strconv"
+)
+
+type checkHeadersKey struct{}
+
+// Headers naming the original request, as sent by nginx auth_request (X-Original-*) and
+// Traefik ForwardAuth or HAProxy (X-Forwarded-*)
+var (
+	originalMethodHeaders = []string{"X-Original-Method", "X-Forwarded-Method"}
+	originalURIHeaders    = []string{"X-Original-URI", "X-Forwarded-Uri"}
+)
+
+// checkHandler makes the rate limit decision for the request described by the headers
+// of a fronting proxy, without serving it: 204 when it is allowed, else the refusal of
+// the middleware. The client IP, API key and host come from the forwarded headers, so
+// the proxy must be one of the TRUSTED_PROXIES.
+func checkHandler(router *middleware.AppRouter) http.HandlerFunc {
+	allowed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	limiter := middleware.AppRateLimiter(router,
+		middleware.WithOnAllow(setCheckHeaders),
+		middleware.WithOnLimitExceeded(setCheckHeaders),
+	)(allowed)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		limiter.ServeHTTP(w, originalRequest(r, w.Header()))
+	}
+}
+
+// originalRequest rewrites the method, URL and host of r to those of the request being
+// checked, so route policies and apps apply to it
+func originalRequest(r *http.Request, header http.Header) *http.Request {
+	original := r.Clone(context.WithValue(r.Context(), checkHeadersKey{}, header))
+	original.Method = http.MethodGet
+	original.URL = &url.URL{Path: "/"}
+
+	if method := firstHeader(r, originalMethodHeaders); method != "" {
+		original.Method = method
+	}
+	if uri := firstHeader(r, originalURIHeaders); uri != "" {
+		if parsed, err := url.ParseRequestURI(uri); err == nil {
+			original.URL = parsed
+		}
+	}
+	original.RequestURI = original.URL.RequestURI()
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+		original.Host = host
+	}
+	return original
+}
+
+func firstHeader(r *http.Request, names []string) string {
+	for _, name := range names {
+		if value := r.Header.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// setCheckHeaders exposes the window of the checked key as X-RateLimit-Limit, -Remaining
+// and -Reset, the Unix time when it resets, for the proxy to pass on to the client
+func setCheckHeaders(r *http.Request, event middleware.LimitEvent) {
+	header, ok := r.Context().Value(checkHeadersKey{}).(http.Header)
+	if !ok || event.Result.Limit <= 0 {
+		return
+	}
+	header.Set("X-RateLimit-Limit", strconv.Itoa(event.Result.Limit))
+	header.Set("X-RateLimit-Remaining", strconv.Itoa(event.Result.Remaining))
+	if !event.Result.ResetAt.IsZero() {
+		header.Set("X-RateLimit-Reset", strconv.FormatInt(event.Result.ResetAt.Unix(), 10))
+	}
+}
@@ -0,0 +1,45 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"rate-limiter/middleware"
+	"rate-limiter/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	service := middleware.NewService(storage.Config{
+		IPRateLimit:    1,
+		IPBlockTime:    30,
+		TrustedProxies: []string{"10.0.0.0/8"},
+	}, storage.NewMemoryStorage())
+	router := SetupRouter(service)
+
+	check := func(clientIP string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/check", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Original-Method", http.MethodPost)
+		req.Header.Set("X-Original-URI", "/orders?page=2")
+		req.Header.Set("X-Forwarded-For", clientIP)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := check("203.0.113.7")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "0", rr.Header().Get("X-RateLimit-Remaining"))
+	assert.NotEmpty(t, rr.Header().Get("X-RateLimit-Reset"))
+
+	rr = check("203.0.113.7")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "30", rr.Header().Get("Retry-After"))
+	assert.Equal(t, "1", rr.Header().Get("X-RateLimit-Limit"))
+
+	assert.Equal(t, http.StatusNoContent, check("203.0.113.8").Code, "every client forwarded by the proxy has a window of its own")
+}
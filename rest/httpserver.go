@@ -0,0 +1,39 @@
+package rest
+
+import (
+	"net/http"
+	"time"
+
+	"rate-limiter/storage"
+)
+
+// NewServer builds the main HTTP server of handler on the configured port, with the
+// read, write and idle timeouts and header limit of the config and TLS when set up
+func NewServer(config storage.Config, handler http.Handler) (*http.Server, error) {
+	tlsConfig, err := ServerTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Server{
+		Addr:              ":" + GetServerPort(config),
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadTimeout:       seconds(config.ServerReadTimeout),
+		ReadHeaderTimeout: seconds(config.ServerReadHeaderTimeout),
+		WriteTimeout:      seconds(config.ServerWriteTimeout),
+		IdleTimeout:       seconds(config.ServerIdleTimeout),
+		MaxHeaderBytes:    config.ServerMaxHeaderBytes,
+	}, nil
+}
+
+// ListenAndServe serves server over TLS when it has a TLS configuration
+func ListenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
@@ -0,0 +1,14 @@
+//go:build !autocert
+
+package rest
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// autocertTLSConfig refuses TLS_AUTOCERT_DOMAINS: autocert is only linked in with
+// -tags autocert
+func autocertTLSConfig(domains []string, cacheDir string) (*tls.Config, error) {
+	return nil, errors.New("TLS_AUTOCERT_DOMAINS needs a build with -tags autocert")
+}
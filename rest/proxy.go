@@ -0,0 +1,109 @@
+package rest
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"rate-limiter/middleware"
+	"rate-limiter/storage"
+	"strings"
+)
+
+// ProxyOption customizes the reverse proxy
+type ProxyOption func(*proxyOptions)
+
+type proxyOptions struct {
+	stripAPIKey bool
+	config      storage.Config
+	format      *middleware.ResponseFormat
+}
+
+// WithStrippedAPIKey removes the API key from every place the config reads it from
+// (headers, bearer Authorization, query parameter and cookie) before forwarding, so
+// rate limit keys never reach the upstream
+func WithStrippedAPIKey(config storage.Config) ProxyOption {
+	return func(o *proxyOptions) {
+		o.stripAPIKey = true
+		o.config = config
+	}
+}
+
+// WithResponseFormat writes the proxy errors in the serialization profile of the service
+func WithResponseFormat(format *middleware.ResponseFormat) ProxyOption {
+	return func(o *proxyOptions) {
+		o.format = format
+	}
+}
+
+// NewProxy forwards every request to the upstream, so the binary can rate limit an
+// existing service without code changes. Hop-by-hop headers are dropped, the client
+// IP is appended to X-Forwarded-For and X-Forwarded-Host/Proto carry the original
+// host and scheme.
+func NewProxy(upstream string, opts ...ProxyOption) (http.Handler, error) {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UPSTREAM_URL: %w", err)
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("invalid UPSTREAM_URL %q: expected http(s)://host[:port]", upstream)
+	}
+
+	o := &proxyOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			// Rewrite starts without the incoming X-Forwarded-For; restore it so the
+			// client IP is appended to the chain rather than replacing it
+			r.Out.Header["X-Forwarded-For"] = r.In.Header["X-Forwarded-For"]
+			r.SetXForwarded()
+			if o.stripAPIKey {
+				stripAPIKey(r.Out, o.config)
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			proxyErrorHandler(w, r, o.format, err)
+		},
+	}
+	return proxy, nil
+}
+
+func stripAPIKey(r *http.Request, config storage.Config) {
+	for _, name := range config.APIKeyHeaders {
+		r.Header.Del(name)
+	}
+
+	if config.APIKeyBearer {
+		if scheme, _, found := strings.Cut(r.Header.Get("Authorization"), " "); found && strings.EqualFold(scheme, "Bearer") {
+			r.Header.Del("Authorization")
+		}
+	}
+
+	if config.APIKeyQueryParam != "" {
+		query := r.URL.Query()
+		if query.Has(config.APIKeyQueryParam) {
+			query.Del(config.APIKeyQueryParam)
+			r.URL.RawQuery = query.Encode()
+		}
+	}
+
+	if config.APIKeyCookie != "" {
+		cookies := r.Cookies()
+		r.Header.Del("Cookie")
+		for _, cookie := range cookies {
+			if cookie.Name != config.APIKeyCookie {
+				r.AddCookie(cookie)
+			}
+		}
+	}
+}
+
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, format *middleware.ResponseFormat, err error) {
+	slog.Error("Proxy error", "method", r.Method, "path", r.URL.Path, "error", err)
+	format.WriteError(w, http.StatusBadGateway, "Upstream unavailable")
+}
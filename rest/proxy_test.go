@@ -0,0 +1,169 @@
+package rest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"rate-limiter/middleware"
+	"rate-limiter/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyRouter(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, "upstream "+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewProxy(upstream.URL)
+	require.NoError(t, err)
+
+	service := middleware.NewService(storage.Config{IPRateLimit: 2, IPBlockTime: 30}, storage.NewMemoryStorage())
+	router := SetupProxyRouter(service, proxy)
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/orders/42", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "upstream /orders/42", rr.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/orders/42", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, int32(2), hits.Load(), "rejected requests never reach the upstream")
+}
+
+func TestProxyRouterCheck(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream "+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewProxy(upstream.URL)
+	require.NoError(t, err)
+
+	service := middleware.NewService(storage.Config{IPRateLimit: 10, IPBlockTime: 30, AdminToken: "secret"}, storage.NewMemoryStorage())
+	router := SetupProxyRouter(service, proxy)
+
+	send := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send("/check")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "upstream /check", rr.Body.String(), "the upstream keeps its /check")
+
+	assert.Equal(t, http.StatusNoContent, send("/admin/check").Code, "the check endpoint takes no admin token")
+}
+
+func TestProxyUpstreamDown(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	proxy, err := NewProxy(upstream.URL)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.JSONEq(t, `{"error": "Upstream unavailable"}`, rr.Body.String())
+}
+
+func TestProxyUpstreamDownNestedError(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	format := middleware.NewResponseFormat(storage.Config{ResponseErrorEnvelope: middleware.ErrorEnvelopeNested})
+	proxy, err := NewProxy(upstream.URL, WithResponseFormat(format))
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.JSONEq(t, `{"error": {"message": "Upstream unavailable", "status": 502}}`, rr.Body.String())
+}
+
+func TestNewProxyInvalidURL(t *testing.T) {
+	for _, upstream := range []string{"localhost:3000", "ftp://files", "http://", "://bad"} {
+		_, err := NewProxy(upstream)
+		assert.Error(t, err, upstream)
+	}
+}
+
+func TestProxyForwardedHeaders(t *testing.T) {
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewProxy(upstream.URL)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://api.example.com/orders", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("Connection", "X-Internal")
+	req.Header.Set("X-Internal", "secret")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("API_KEY", "gold")
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.NotNil(t, received)
+	assert.Equal(t, "203.0.113.7, 10.0.0.1", received.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "api.example.com", received.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "http", received.Header.Get("X-Forwarded-Proto"))
+	assert.Empty(t, received.Header.Get("X-Internal"), "headers named by Connection are hop-by-hop")
+	assert.Empty(t, received.Header.Get("Keep-Alive"))
+	assert.Equal(t, "gold", received.Header.Get("API_KEY"), "the API key is kept unless stripping is enabled")
+}
+
+func TestProxyStripsAPIKey(t *testing.T) {
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewProxy(upstream.URL, WithStrippedAPIKey(storage.Config{
+		APIKeyHeaders:    []string{"API_KEY", "X-Api-Key"},
+		APIKeyBearer:     true,
+		APIKeyQueryParam: "api_key",
+		APIKeyCookie:     "key",
+	}))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/orders?api_key=gold&page=2", nil)
+	req.Header.Set("API_KEY", "gold")
+	req.Header.Set("X-Api-Key", "gold")
+	req.Header.Set("Authorization", "Bearer gold")
+	req.Header.Set("Cookie", "key=gold; session=abc")
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.NotNil(t, received)
+	assert.Empty(t, received.Header.Get("API_KEY"))
+	assert.Empty(t, received.Header.Get("X-Api-Key"))
+	assert.Empty(t, received.Header.Get("Authorization"))
+	assert.Equal(t, "page=2", received.URL.RawQuery)
+	assert.Equal(t, "session=abc", received.Header.Get("Cookie"))
+}
@@ -0,0 +1,61 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"rate-limiter/middleware"
+	"rate-limiter/storage"
+)
+
+// quotaTransferRequest moves amount requests of the current day or month quota between
+// two tokens of the same owner
+type quotaTransferRequest struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Period string `json:"period"`
+	Amount int    `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+type quotaResponse struct {
+	Period    string    `json:"period"`
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	ResetAt   time.Time `json:"reset_at"`
+}
+
+type quotaTransferResponse struct {
+	From quotaResponse `json:"from"`
+	To   quotaResponse `json:"to"`
+}
+
+func newQuotaResponse(status middleware.QuotaStatus) quotaResponse {
+	return quotaResponse{Period: status.Period, Limit: status.Limit, Remaining: status.Remaining, ResetAt: status.ResetAt}
+}
+
+func transferQuotaHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req quotaTransferRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, service, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		from, to, err := service.TransferQuota(r.Context(), middleware.QuotaTransfer(req))
+		switch {
+		case errors.Is(err, middleware.ErrInvalidQuotaTransfer):
+			writeError(w, service, http.StatusBadRequest, err.Error())
+			return
+		case errors.Is(err, storage.ErrReadOnly):
+			writeError(w, service, http.StatusServiceUnavailable, err.Error())
+			return
+		case err != nil:
+			writeError(w, service, http.StatusInternalServerError, "failed to transfer quota")
+			return
+		}
+		writeJSON(w, service, http.StatusOK, quotaTransferResponse{From: newQuotaResponse(from), To: newQuotaResponse(to)})
+	}
+}
@@ -1,7 +1,9 @@
 package rest
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"rate-limiter/middleware"
 	"rate-limiter/storage"
@@ -10,17 +12,39 @@ import (
 	"github.com/go-chi/chi/v5"
 )
 
-func SetupRouter(rateLimiterService *middleware.Service) *chi.Mux {
+func SetupRouter(rateLimiterService *middleware.Service, apps ...*middleware.App) *chi.Mux {
+	r := setupRouter(rateLimiterService, apps, "/check", SetupRoutes)
+	r.Get("/health", healthHandler(rateLimiterService))
+	return r
+}
+
+// SetupProxyRouter rate limits every path outside /admin and forwards allowed requests
+// to the proxy. The check endpoint is served at /admin/check, so it does not shadow a
+// /check of the upstream; it takes no admin token.
+func SetupProxyRouter(rateLimiterService *middleware.Service, proxy http.Handler, apps ...*middleware.App) *chi.Mux {
+	return setupRouter(rateLimiterService, apps, "/admin/check", func(r chi.Router) {
+		r.Handle("/*", proxy)
+	})
+}
+
+func setupRouter(rateLimiterService *middleware.Service, apps []*middleware.App, checkPath string, routes func(chi.Router)) *chi.Mux {
 	r := chi.NewRouter()
-	r.Use(middleware.RateLimiter(rateLimiterService))
-	r.Use(logRequest)
-	SetupRoutes(r)
+	appRouter := middleware.NewAppRouter(rateLimiterService, apps...)
+	r.Get("/readyz", readyHandler(rateLimiterService))
+	r.Get("/live", liveHandler)
+	r.Get("/ready", storageReadyHandler(rateLimiterService))
+	r.With(logRequest).Get(checkPath, checkHandler(appRouter))
+	SetupAdminRoutes(r, rateLimiterService, apps...)
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.AppRateLimiter(appRouter))
+		r.Use(logRequest)
+		routes(r)
+	})
 	return r
 }
 
-func SetupRoutes(r *chi.Mux) {
+func SetupRoutes(r chi.Router) {
 	r.Get("/", homeHandler)
-	r.Get("/health", healthHandler)
 	r.Get("/api/test", apiTestHandler)
 	r.Get("/api/load-test", loadTestHandler)
 }
@@ -31,10 +55,74 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, `{"message": "Rate limiter is working", "path": "/", "timestamp": "`+time.Now().Format(time.RFC3339)+`"}`)
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
+// healthCheckTimeout bounds the storage ping of the health endpoints
+const healthCheckTimeout = 2 * time.Second
+
+type healthResponse struct {
+	middleware.Health
+	Service   string `json:"service"`
+	Timestamp string `json:"timestamp"`
+}
+
+// healthHandler pings the storage and reports the instance healthy, degraded or, with
+// 503, unhealthy. It is served outside the rate limiter.
+func healthHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		defer cancel()
+
+		response := healthResponse{
+			Health:    service.Health(ctx),
+			Service:   "rate-limiter",
+			Timestamp: time.Now().Format(time.RFC3339),
+		}
+		status := http.StatusOK
+		if response.Status == middleware.HealthUnhealthy {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, service, status, response)
+	}
+}
+
+// liveHandler answers as long as the process serves HTTP, for liveness probes
+func liveHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, `{"status": "healthy", "service": "rate-limiter", "timestamp": "`+time.Now().Format(time.RFC3339)+`"}`)
+	fmt.Fprint(w, `{"status": "alive"}`)
+}
+
+// storageReadyHandler answers 503 while the storage is unreachable or the canary
+// reports it unhealthy, for readiness probes. A degraded instance still serves.
+func storageReadyHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		defer cancel()
+
+		health := service.Health(ctx)
+		status := http.StatusOK
+		if health.Status == middleware.HealthUnhealthy || !service.Ready() {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, service, status, health)
+	}
+}
+
+type readyResponse struct {
+	Ready  bool                     `json:"ready"`
+	Canary *middleware.CanaryStatus `json:"canary,omitempty"`
+}
+
+// readyHandler answers 503 while the storage canary reports the storage unhealthy. It
+// is served outside the rate limiter, so probes are never refused.
+func readyHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := readyResponse{Ready: service.Ready(), Canary: service.CanaryStatus()}
+		status := http.StatusOK
+		if !response.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, service, status, response)
+	}
 }
 
 func apiTestHandler(w http.ResponseWriter, r *http.Request) {
@@ -62,16 +150,28 @@ func GetServerPort(config storage.Config) string {
 	return "8080"
 }
 
+// logRequest logs every request once it is served. The API key is only
+// logged redacted, so the logs never hold a usable key.
 func logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		fmt.Printf("[%s] %s %s from %s", start.Format("15:04:05"), r.Method, r.URL.Path, r.RemoteAddr)
+		next.ServeHTTP(w, r)
 
+		if !slog.Default().Enabled(r.Context(), slog.LevelInfo) {
+			return
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if app, ok := middleware.AppFromContext(r.Context()); ok {
+			attrs = append(attrs, slog.String("app", app))
+		}
 		if apiKey := r.Header.Get("API_KEY"); apiKey != "" {
-			fmt.Printf(" (API_KEY: %s)", apiKey)
+			attrs = append(attrs, slog.String("api_key", storage.RedactAPIKey(apiKey)))
 		}
-
-		next.ServeHTTP(w, r)
-		fmt.Printf(" - %v\n", time.Since(start))
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "Request", attrs...)
 	})
 }
@@ -0,0 +1,131 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rate-limiter/middleware"
+	"rate-limiter/ratelimitertest"
+	"rate-limiter/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadyz(t *testing.T) {
+	service := middleware.NewService(storage.Config{IPRateLimit: 0, CanaryInterval: 10}, storage.NewMemoryStorage())
+	router := SetupRouter(service)
+
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "probes are not rate limited, even with a limit of 0")
+	assert.JSONEq(t, `{"ready": true, "canary": {"ready": true, "checked_at": "0001-01-01T00:00:00Z", "latency_ms": 0, "consecutive_failures": 0, "runs": 0, "failures": 0}}`, rr.Body.String())
+}
+
+func TestLogRequestRedactsAPIKey(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(storage.NewLogger(&logs, storage.LogConfig{Level: "info", Format: storage.LogFormatJSON}))
+
+	service := middleware.NewService(storage.Config{
+		IPRateLimit: 10,
+		TokenLimits: map[string]int{"ABC123": 10},
+	}, storage.NewMemoryStorage())
+	router := SetupRouter(service)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/test", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("API_KEY", "ABC123")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.NotContains(t, logs.String(), "ABC123")
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(logs.Bytes(), &entry))
+	assert.Equal(t, "Request", entry["msg"])
+	assert.Equal(t, "/api/test", entry["path"])
+	assert.Equal(t, storage.RedactAPIKey("ABC123"), entry["api_key"])
+
+	assert.Equal(t, "10.0.0.1", storage.RedactKey("10.0.0.1"))
+	assert.Equal(t, "tier:gold:token:"+storage.RedactAPIKey("ABC123"), storage.RedactKey("tier:gold:token:ABC123"))
+}
+
+func TestHealth(t *testing.T) {
+	fake := ratelimitertest.NewFakeStorage()
+	get := func(router http.Handler, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	router := SetupRouter(middleware.NewService(storage.Config{IPRateLimit: 10}, fake))
+
+	rr := get(router, "/health")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var health map[string]interface{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &health))
+	assert.Equal(t, middleware.HealthHealthy, health["status"])
+	assert.Equal(t, "up", health["checks"].(map[string]interface{})["storage"].(map[string]interface{})["status"])
+	assert.Equal(t, http.StatusOK, get(router, "/ready").Code)
+
+	fake.FailOn("Ping", errors.New("connection refused"))
+	rr = get(router, "/health")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"unhealthy"`)
+	assert.Contains(t, rr.Body.String(), "connection refused")
+	assert.Equal(t, http.StatusServiceUnavailable, get(router, "/ready").Code)
+	assert.Equal(t, http.StatusOK, get(router, "/live").Code)
+
+	fallback := storage.NewFallbackStorage(fake, 100*time.Millisecond, time.Second)
+	router = SetupRouter(middleware.NewService(storage.Config{IPRateLimit: 10}, fallback))
+	rr = get(router, "/health")
+	assert.Equal(t, http.StatusOK, rr.Code, "counters are still limited in memory")
+	assert.Contains(t, rr.Body.String(), `"degraded"`)
+	assert.Equal(t, http.StatusOK, get(router, "/ready").Code)
+}
+
+func TestNewServer(t *testing.T) {
+	config := storage.GetDefaultConfig().RateLimit
+	config.ServerPort = "9090"
+	config.ServerReadHeaderTimeout = 1
+	config.ServerMaxHeaderBytes = 4096
+	service := middleware.NewService(storage.Config{IPRateLimit: 10}, storage.NewMemoryStorage())
+	server, err := NewServer(config, SetupRouter(service))
+	require.NoError(t, err)
+	assert.Equal(t, ":9090", server.Addr)
+	assert.Equal(t, 10*time.Second, server.ReadTimeout)
+	assert.Equal(t, time.Second, server.ReadHeaderTimeout)
+	assert.Equal(t, 30*time.Second, server.WriteTimeout)
+	assert.Equal(t, 120*time.Second, server.IdleTimeout)
+	assert.Equal(t, 4096, server.MaxHeaderBytes)
+	assert.Nil(t, server.TLSConfig)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /live HTTP/1.1\r\nHost: localhost\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err, "a client that never finishes its headers is disconnected")
+
+	config.TLSAutocertDomains = []string{"api.example.com"}
+	_, err = NewServer(config, SetupRouter(service))
+	assert.Error(t, err, "autocert is not linked in without -tags autocert")
+}
@@ -0,0 +1,62 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"rate-limiter/middleware"
+)
+
+// analysisRequest starts an analysis of the traffic for Duration seconds. Headroom
+// multiplies the observed p99 rates into the suggested limits, 1.5 when left out.
+type analysisRequest struct {
+	Duration int     `json:"duration"`
+	Headroom float64 `json:"headroom"`
+}
+
+// suggestionsHandler returns the suggested limits of the running or last analysis
+func suggestionsHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := service.AnalysisReport()
+		if report == nil {
+			writeError(w, service, http.StatusNotFound, "no analysis has run yet")
+			return
+		}
+		writeJSON(w, service, http.StatusOK, report)
+	}
+}
+
+func startAnalysisHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req analysisRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, service, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.Duration <= 0 || req.Headroom < 0 {
+			writeError(w, service, http.StatusBadRequest, "duration must be positive and headroom not negative")
+			return
+		}
+
+		err := service.StartAnalysis(time.Duration(req.Duration)*time.Second, req.Headroom)
+		if errors.Is(err, middleware.ErrAnalysisRunning) {
+			writeError(w, service, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, service, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, service, http.StatusAccepted, service.AnalysisReport())
+	}
+}
+
+// stopAnalysisHandler ends the running analysis early; its suggestions stay available
+func stopAnalysisHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		service.StopAnalysis()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
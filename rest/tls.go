@@ -0,0 +1,51 @@
+package rest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"rate-limiter/storage"
+)
+
+// ServerTLSConfig builds the TLS configuration of the listener, or nil when neither
+// TLS_CERT nor TLS_AUTOCERT_DOMAINS is set. With TLS_CLIENT_CA it verifies client
+// certificates, requiring one unless TLS_CLIENT_AUTH is optional.
+func ServerTLSConfig(config storage.Config) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	switch {
+	case len(config.TLSAutocertDomains) > 0:
+		var err error
+		if tlsConfig, err = autocertTLSConfig(config.TLSAutocertDomains, config.TLSAutocertCacheDir); err != nil {
+			return nil, err
+		}
+	case config.TLSCert != "":
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load server certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	default:
+		return nil, nil
+	}
+	tlsConfig.MinVersion = tls.VersionTLS12
+
+	if config.TLSClientCA != "" {
+		caCert, err := os.ReadFile(config.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA certificate: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("failed to parse client CA certificate")
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if config.TLSClientAuth == "optional" {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return tlsConfig, nil
+}
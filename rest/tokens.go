@@ -0,0 +1,185 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	ratelimiter "rate-limiter"
+	"rate-limiter/middleware"
+	"rate-limiter/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// tokenRequest creates or updates a token of the registry. Fields left out keep their
+// current value on update and take the IP limits on create; a new token is enabled.
+// The tier is the name of a configured policy.
+type tokenRequest struct {
+	Name       string  `json:"name"`
+	Limit      *int    `json:"limit"`
+	BlockTime  *int    `json:"block_time"`
+	Tier       *string `json:"tier"`
+	Enabled    *bool   `json:"enabled"`
+	Contact    *string `json:"contact"`
+	Algorithm  *string `json:"algorithm"`
+	BucketSize *int    `json:"bucket_size"`
+	Window     *int    `json:"window"`
+	Owner      *string `json:"owner"`
+}
+
+type tokenResponse struct {
+	Name       string `json:"name"`
+	Limit      int    `json:"limit"`
+	BlockTime  int    `json:"block_time"`
+	Tier       string `json:"tier,omitempty"`
+	Enabled    bool   `json:"enabled"`
+	Contact    string `json:"contact,omitempty"`
+	Algorithm  string `json:"algorithm,omitempty"`
+	BucketSize int    `json:"bucket_size,omitempty"`
+	Window     int    `json:"window,omitempty"`
+	Owner      string `json:"owner,omitempty"`
+}
+
+func newTokenResponse(token *ratelimiter.TokenConfig) tokenResponse {
+	return tokenResponse{
+		Name:       token.Name,
+		Limit:      token.Limit,
+		BlockTime:  token.BlockTime,
+		Tier:       token.Policy,
+		Enabled:    !token.Disabled,
+		Contact:    token.Contact,
+		Algorithm:  token.Algorithm,
+		BucketSize: token.BucketSize,
+		Window:     token.Window,
+		Owner:      token.Owner,
+	}
+}
+
+// apply copies the fields set in the request onto the token
+func (req tokenRequest) apply(token *ratelimiter.TokenConfig) {
+	if req.Limit != nil {
+		token.Limit = *req.Limit
+	}
+	if req.BlockTime != nil {
+		token.BlockTime = *req.BlockTime
+	}
+	if req.Tier != nil {
+		token.Policy = *req.Tier
+	}
+	if req.Enabled != nil {
+		token.Disabled = !*req.Enabled
+	}
+	if req.Contact != nil {
+		token.Contact = *req.Contact
+	}
+	if req.Algorithm != nil {
+		token.Algorithm = *req.Algorithm
+	}
+	if req.BucketSize != nil {
+		token.BucketSize = *req.BucketSize
+	}
+	if req.Window != nil {
+		token.Window = *req.Window
+	}
+	if req.Owner != nil {
+		token.Owner = *req.Owner
+	}
+}
+
+// tokenStatus is the status of a failed token registry call
+func tokenStatus(err error) int {
+	switch {
+	case errors.Is(err, middleware.ErrTokenNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, middleware.ErrTokenExists):
+		return http.StatusConflict
+	case errors.Is(err, middleware.ErrInvalidToken):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrReadOnly):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func listTokensHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokens, err := service.ListTokens(r.Context())
+		if err != nil {
+			writeError(w, service, http.StatusInternalServerError, "failed to list tokens")
+			return
+		}
+
+		response := make([]tokenResponse, 0, len(tokens))
+		for _, token := range tokens {
+			response = append(response, newTokenResponse(token))
+		}
+		writeJSON(w, service, http.StatusOK, response)
+	}
+}
+
+func getTokenHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := service.GetToken(r.Context(), chi.URLParam(r, "name"))
+		if err != nil {
+			writeError(w, service, tokenStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, service, http.StatusOK, newTokenResponse(token))
+	}
+}
+
+func createTokenHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req tokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, service, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		config := service.Config()
+		token := &ratelimiter.TokenConfig{Name: req.Name, Limit: config.IPRateLimit, BlockTime: config.IPBlockTime}
+		req.apply(token)
+
+		if err := service.CreateToken(r.Context(), token); err != nil {
+			writeError(w, service, tokenStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, service, http.StatusCreated, newTokenResponse(token))
+	}
+}
+
+// updateTokenHandler changes the fields set in the body of the token named in the path
+func updateTokenHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req tokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, service, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		token, err := service.GetToken(r.Context(), chi.URLParam(r, "name"))
+		if err != nil {
+			writeError(w, service, tokenStatus(err), err.Error())
+			return
+		}
+		updated := *token
+		req.apply(&updated)
+
+		if err := service.UpdateToken(r.Context(), &updated); err != nil {
+			writeError(w, service, tokenStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, service, http.StatusOK, newTokenResponse(&updated))
+	}
+}
+
+func deleteTokenHandler(service *middleware.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := service.DeleteToken(r.Context(), chi.URLParam(r, "name")); err != nil {
+			writeError(w, service, tokenStatus(err), err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,50 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"rate-limiter/middleware"
+	"rate-limiter/storage"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenAdminAPI(t *testing.T) {
+	service := middleware.NewService(storage.Config{
+		IPRateLimit: 10,
+		IPBlockTime: 60,
+		AdminToken:  "secret",
+		Policies:    map[string]storage.Policy{"premium": {Name: "premium", Limit: 1000}},
+	}, storage.NewMemoryStorage())
+	router := chi.NewRouter()
+	SetupAdminRoutes(router, service)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send(http.MethodPost, "/admin/tokens", `{"name": "gold", "limit": 100}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.JSONEq(t, `{"name": "gold", "limit": 100, "block_time": 60, "enabled": true}`, rr.Body.String())
+	assert.Equal(t, http.StatusConflict, send(http.MethodPost, "/admin/tokens", `{"name": "gold"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/admin/tokens", `{"name": "silver", "tier": "missing"}`).Code)
+
+	rr = send(http.MethodPut, "/admin/tokens/gold", `{"tier": "premium", "enabled": false}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"name": "gold", "limit": 100, "block_time": 60, "tier": "premium", "enabled": false}`, rr.Body.String())
+
+	rr = send(http.MethodGet, "/admin/tokens", "")
+	assert.JSONEq(t, `[{"name": "gold", "limit": 100, "block_time": 60, "tier": "premium", "enabled": false}]`, rr.Body.String())
+
+	assert.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/admin/tokens/gold", "").Code)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodGet, "/admin/tokens/gold", "").Code)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodPut, "/admin/tokens/gold", `{}`).Code)
+}
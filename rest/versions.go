@@ -0,0 +1,107 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"rate-limiter/middleware"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Versions of the admin API. v2 frames the decision stream as typed server-sent events
+// with ids; everything else is served the same by both.
+const (
+	apiV1 = 1
+	apiV2 = 2
+
+	latestAPIVersion = apiV2
+)
+
+// legacyAPIVersion names the unversioned /admin paths in API_SUNSET
+const legacyAPIVersion = "legacy"
+
+type apiVersionContextKey struct{}
+
+// apiVersionOf returns the admin API version the request is served with
+func apiVersionOf(r *http.Request) int {
+	if version, ok := r.Context().Value(apiVersionContextKey{}).(int); ok {
+		return version
+	}
+	return apiV1
+}
+
+// mountVersioned serves the routes of the scope under /admin/v1<scope> and
+// /admin/v2<scope> and, for the callers that predate versioning, under /admin<scope>.
+// The unversioned paths serve the version asked for in the API-Version header, v1 by
+// default, and are deprecated in favour of the versioned ones.
+func mountVersioned(r chi.Router, service *middleware.Service, scope string, auth func(http.Handler) http.Handler, routes func(chi.Router)) {
+	for version := apiV1; version <= latestAPIVersion; version++ {
+		prefix := fmt.Sprintf("/admin/v%d%s", version, scope)
+		r.Route(prefix, func(r chi.Router) {
+			r.Use(auth, withAPIVersion(service, prefix, scope, version))
+			routes(r)
+		})
+	}
+	prefix := "/admin" + scope
+	r.Route(prefix, func(r chi.Router) {
+		r.Use(auth, negotiateAPIVersion(service, prefix, scope))
+		routes(r)
+	})
+}
+
+// successorPath is the path of the latest version for a path under the prefix of the
+// scope
+func successorPath(prefix, scope, path string) string {
+	return fmt.Sprintf("/admin/v%d%s%s", latestAPIVersion, scope, strings.TrimPrefix(path, prefix))
+}
+
+// withAPIVersion serves the request with the version, announcing its deprecation when
+// API_SUNSET lists it
+func withAPIVersion(service *middleware.Service, prefix, scope string, version int) func(http.Handler) http.Handler {
+	name := fmt.Sprintf("v%d", version)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("API-Version", strconv.Itoa(version))
+			if sunset, deprecated := service.Config().APISunsets[name]; deprecated {
+				setDeprecation(w, sunset, successorPath(prefix, scope, r.URL.Path))
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionContextKey{}, version)))
+		})
+	}
+}
+
+// negotiateAPIVersion serves an unversioned request with the version of its API-Version
+// header, always marking it deprecated
+func negotiateAPIVersion(service *middleware.Service, prefix, scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			version := apiV1
+			if requested := strings.TrimPrefix(strings.ToLower(r.Header.Get("API-Version")), "v"); requested != "" {
+				parsed, err := strconv.Atoi(requested)
+				if err != nil || parsed < apiV1 || parsed > latestAPIVersion {
+					writeError(w, service, http.StatusBadRequest, fmt.Sprintf("unsupported API version %q", r.Header.Get("API-Version")))
+					return
+				}
+				version = parsed
+			}
+
+			w.Header().Set("API-Version", strconv.Itoa(version))
+			setDeprecation(w, service.Config().APISunsets[legacyAPIVersion], successorPath(prefix, scope, r.URL.Path))
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionContextKey{}, version)))
+		})
+	}
+}
+
+// setDeprecation sets the Deprecation header, the Sunset header (RFC 8594) when a date is
+// announced and a Link to the path that replaces the deprecated one
+func setDeprecation(w http.ResponseWriter, sunset time.Time, successor string) {
+	w.Header().Set("Deprecation", "true")
+	if !sunset.IsZero() {
+		w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+}
@@ -0,0 +1,100 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"rate-limiter/middleware"
+	"rate-limiter/storage"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminAPIVersions(t *testing.T) {
+	service := middleware.NewService(storage.Config{
+		IPRateLimit: 10,
+		IPBlockTime: 60,
+		AdminToken:  "secret",
+		APISunsets: map[string]time.Time{
+			"legacy": time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+			"v1":     time.Date(2027, 6, 30, 0, 0, 0, 0, time.UTC),
+		},
+	}, storage.NewMemoryStorage())
+	app := &middleware.App{Name: "billing", Service: middleware.NewService(storage.Config{IPRateLimit: 5}, storage.NewMemoryStorage())}
+	router := chi.NewRouter()
+	SetupAdminRoutes(router, service, app)
+
+	send := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send("/admin/v2/stats", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("API-Version"))
+	assert.Empty(t, rr.Header().Get("Deprecation"), "the latest version is not deprecated")
+
+	rr = send("/admin/v1/stats", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "true", rr.Header().Get("Deprecation"))
+	assert.Equal(t, "Wed, 30 Jun 2027 00:00:00 GMT", rr.Header().Get("Sunset"))
+	assert.Equal(t, `</admin/v2/stats>; rel="successor-version"`, rr.Header().Get("Link"))
+
+	rr = send("/admin/stats", nil)
+	assert.Equal(t, http.StatusOK, rr.Code, "the unversioned paths keep working")
+	assert.Equal(t, "1", rr.Header().Get("API-Version"))
+	assert.Equal(t, "true", rr.Header().Get("Deprecation"))
+	assert.Equal(t, "Fri, 01 Jan 2027 00:00:00 GMT", rr.Header().Get("Sunset"))
+
+	rr = send("/admin/apps/billing/stats", http.Header{"Api-Version": {"2"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("API-Version"), "the header negotiates the version")
+	assert.Equal(t, `</admin/v2/apps/billing/stats>; rel="successor-version"`, rr.Header().Get("Link"))
+	assert.Equal(t, http.StatusOK, send("/admin/v2/apps/billing/stats", nil).Code)
+
+	assert.Equal(t, http.StatusBadRequest, send("/admin/stats", http.Header{"Api-Version": {"3"}}).Code)
+	assert.Equal(t, http.StatusUnauthorized, send("/admin/v2/apps/billing/stats", http.Header{"Authorization": {"Bearer wrong"}}).Code)
+}
+
+func TestDecisionStreamVersions(t *testing.T) {
+	service := middleware.NewService(storage.Config{IPRateLimit: 10, AdminToken: "secret"}, storage.NewMemoryStorage())
+	router := chi.NewRouter()
+	SetupAdminRoutes(router, service)
+
+	stream := func(path string) string {
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			router.ServeHTTP(rr, req)
+		}()
+		// publish until the handler has subscribed and caught one
+		for i := 0; i < 50; i++ {
+			service.Decisions().Publish(middleware.Decision{Key: "10.0.0.1", Allowed: true, Reason: "allowed"})
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		<-done
+		return rr.Body.String()
+	}
+
+	v1 := stream("/admin/v1/decisions")
+	assert.True(t, strings.HasPrefix(v1, "data: "), v1)
+	v2 := stream("/admin/v2/decisions")
+	assert.True(t, strings.HasPrefix(v2, "event: decision\nid: 1\ndata: "), v2)
+}
@@ -0,0 +1,115 @@
+// Package rls implements the Envoy RateLimitService gRPC API on top of the Service, so
+// Envoy and Istio sidecars can use the rate limiter as their global rate limit service.
+package rls
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"rate-limiter/middleware"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Descriptor entry keys mapped to the client IP and API key of the service
+const (
+	RemoteAddressKey = "remote_address"
+	APIKeyKey        = "api_key"
+)
+
+// Server answers ShouldRateLimit with the limits, denylist and storage of the service
+type Server struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+	service *middleware.Service
+}
+
+func NewServer(service *middleware.Service) *Server {
+	return &Server{service: service}
+}
+
+// Register adds the RateLimitService to a gRPC server
+func (s *Server) Register(server *grpc.Server) {
+	rlsv3.RegisterRateLimitServiceServer(server, s)
+}
+
+// ShouldRateLimit evaluates every descriptor of the request. A descriptor with a
+// remote_address or api_key entry is limited like an HTTP request from that client;
+// any other descriptor is limited on its own entries with the IP limits. The request
+// is over the limit when any descriptor is.
+func (s *Server) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	response := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+
+	for _, descriptor := range req.GetDescriptors() {
+		verdict := s.evaluate(ctx, req.GetDomain(), descriptor, int(req.GetHitsAddend()))
+
+		if !verdict.Allowed {
+			response.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+		}
+		response.Statuses = append(response.Statuses, descriptorStatus(verdict))
+	}
+
+	return response, nil
+}
+
+// evaluate consumes hits units of quota; Envoy sends 0 to mean 1
+func (s *Server) evaluate(ctx context.Context, domain string, descriptor *ratelimitv3.RateLimitDescriptor, hits int) middleware.Verdict {
+	var clientIP, apiKey string
+	for _, entry := range descriptor.GetEntries() {
+		switch entry.GetKey() {
+		case RemoteAddressKey:
+			clientIP = entry.GetValue()
+		case APIKeyKey:
+			apiKey = entry.GetValue()
+		}
+	}
+
+	if clientIP != "" || apiKey != "" {
+		return s.service.EvaluateContext(ctx, clientIP, apiKey, "RLS", domain, hits)
+	}
+	return s.service.EvaluateKeyContext(ctx, descriptorKey(domain, descriptor), "RLS", domain, hits)
+}
+
+// descriptorKey builds rls:<domain>:<key>=<value>,... with the entries sorted, so the
+// same descriptor always maps to the same counter
+func descriptorKey(domain string, descriptor *ratelimitv3.RateLimitDescriptor) string {
+	entries := make([]string, 0, len(descriptor.GetEntries()))
+	for _, entry := range descriptor.GetEntries() {
+		entries = append(entries, entry.GetKey()+"="+entry.GetValue())
+	}
+	sort.Strings(entries)
+
+	return "rls:" + domain + ":" + strings.Join(entries, ",")
+}
+
+func descriptorStatus(verdict middleware.Verdict) *rlsv3.RateLimitResponse_DescriptorStatus {
+	result := verdict.Result
+	descriptorStatus := &rlsv3.RateLimitResponse_DescriptorStatus{
+		Code:           rlsv3.RateLimitResponse_OK,
+		LimitRemaining: uint32(max(result.Remaining, 0)),
+	}
+	if !verdict.Allowed {
+		descriptorStatus.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+	}
+
+	if result.Limit > 0 {
+		descriptorStatus.CurrentLimit = &rlsv3.RateLimitResponse_RateLimit{
+			RequestsPerUnit: uint32(result.Limit),
+			Unit:            rlsv3.RateLimitResponse_RateLimit_SECOND,
+		}
+	}
+
+	untilReset := result.RetryAfter
+	if untilReset <= 0 && !result.ResetAt.IsZero() {
+		untilReset = time.Until(result.ResetAt)
+	}
+	if untilReset > 0 {
+		descriptorStatus.DurationUntilReset = durationpb.New(untilReset)
+	}
+
+	return descriptorStatus
+}
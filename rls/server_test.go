@@ -0,0 +1,109 @@
+package rls
+
+import (
+	"context"
+	"testing"
+
+	"rate-limiter/middleware"
+	"rate-limiter/storage"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(config storage.Config) *Server {
+	return NewServer(middleware.NewService(config, storage.NewMemoryStorage()))
+}
+
+func request(domain string, descriptors ...map[string]string) *rlsv3.RateLimitRequest {
+	req := &rlsv3.RateLimitRequest{Domain: domain}
+	for _, entries := range descriptors {
+		descriptor := &ratelimitv3.RateLimitDescriptor{}
+		for key, value := range entries {
+			descriptor.Entries = append(descriptor.Entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: key, Value: value})
+		}
+		req.Descriptors = append(req.Descriptors, descriptor)
+	}
+	return req
+}
+
+func TestShouldRateLimitRemoteAddress(t *testing.T) {
+	server := newTestServer(storage.Config{IPRateLimit: 1, IPBlockTime: 30})
+	req := request("edge", map[string]string{RemoteAddressKey: "10.0.0.1"})
+
+	resp, err := server.ShouldRateLimit(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, rlsv3.RateLimitResponse_OK, resp.OverallCode)
+	require.Len(t, resp.Statuses, 1)
+	assert.Equal(t, uint32(1), resp.Statuses[0].CurrentLimit.RequestsPerUnit)
+	assert.Equal(t, rlsv3.RateLimitResponse_RateLimit_SECOND, resp.Statuses[0].CurrentLimit.Unit)
+	assert.Equal(t, uint32(0), resp.Statuses[0].LimitRemaining)
+
+	resp, err = server.ShouldRateLimit(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, rlsv3.RateLimitResponse_OVER_LIMIT, resp.OverallCode)
+	assert.Equal(t, rlsv3.RateLimitResponse_OVER_LIMIT, resp.Statuses[0].Code)
+	assert.Equal(t, int64(30), resp.Statuses[0].DurationUntilReset.Seconds)
+}
+
+func TestShouldRateLimitAPIKey(t *testing.T) {
+	server := newTestServer(storage.Config{
+		IPRateLimit: 1,
+		IPBlockTime: 30,
+		TokenLimits: map[string]int{"gold": 3},
+	})
+
+	for i := 0; i < 3; i++ {
+		resp, err := server.ShouldRateLimit(context.Background(), request("edge", map[string]string{RemoteAddressKey: "10.0.0.1", APIKeyKey: "gold"}))
+		require.NoError(t, err)
+		assert.Equal(t, rlsv3.RateLimitResponse_OK, resp.OverallCode, "request %d", i+1)
+		assert.Equal(t, uint32(3), resp.Statuses[0].CurrentLimit.RequestsPerUnit)
+	}
+}
+
+func TestShouldRateLimitGenericDescriptors(t *testing.T) {
+	server := newTestServer(storage.Config{IPRateLimit: 1, IPBlockTime: 30})
+
+	resp, err := server.ShouldRateLimit(context.Background(), request("edge",
+		map[string]string{"path": "/a"},
+		map[string]string{"path": "/b"},
+	))
+	require.NoError(t, err)
+	assert.Equal(t, rlsv3.RateLimitResponse_OK, resp.OverallCode)
+	require.Len(t, resp.Statuses, 2)
+
+	resp, err = server.ShouldRateLimit(context.Background(), request("edge",
+		map[string]string{"path": "/a"},
+		map[string]string{"path": "/c"},
+	))
+	require.NoError(t, err)
+	assert.Equal(t, rlsv3.RateLimitResponse_OVER_LIMIT, resp.OverallCode, "any descriptor over the limit fails the request")
+	assert.Equal(t, rlsv3.RateLimitResponse_OVER_LIMIT, resp.Statuses[0].Code)
+	assert.Equal(t, rlsv3.RateLimitResponse_OK, resp.Statuses[1].Code)
+
+	resp, err = server.ShouldRateLimit(context.Background(), request("other", map[string]string{"path": "/a"}))
+	require.NoError(t, err)
+	assert.Equal(t, rlsv3.RateLimitResponse_OK, resp.OverallCode, "domains are counted separately")
+}
+
+func TestDescriptorKey(t *testing.T) {
+	req := request("edge", map[string]string{"b": "2", "a": "1"})
+	assert.Equal(t, "rls:edge:a=1,b=2", descriptorKey("edge", req.Descriptors[0]))
+}
+
+func TestShouldRateLimitHitsAddend(t *testing.T) {
+	server := newTestServer(storage.Config{IPRateLimit: 10, IPBlockTime: 30})
+
+	req := request("edge", map[string]string{RemoteAddressKey: "10.0.0.1"})
+	req.HitsAddend = 8
+	resp, err := server.ShouldRateLimit(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, rlsv3.RateLimitResponse_OK, resp.OverallCode)
+	assert.Equal(t, uint32(2), resp.Statuses[0].LimitRemaining)
+
+	resp, err = server.ShouldRateLimit(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, rlsv3.RateLimitResponse_OVER_LIMIT, resp.OverallCode)
+}
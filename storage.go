@@ -2,27 +2,240 @@ package ratelimiter
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
-// RateLimit stores rate limiting information for a specific key
+// RateLimit stores rate limiting information for a specific key. Violations and
+// ViolatedAt keep the recent blocks of the key when blocks escalate.
 type RateLimit struct {
-	Count     int
-	LastReset time.Time
-	BlockedAt time.Time
+	Count      int
+	LastReset  time.Time
+	BlockedAt  time.Time
+	Violations int `json:",omitempty"`
+	ViolatedAt time.Time
+}
+
+// Ban stores a denylist entry: an IP, a CIDR or a token key ("token:<name>")
+type Ban struct {
+	Value     string
+	Reason    string
+	CreatedAt time.Time
+}
+
+// TokenConfig stores the limits of a token managed at runtime instead of through env vars.
+// Contact is where the token owner is notified, a webhook URL or an email address.
+// Algorithm and BucketSize select the limiter of the token like TOKEN_<name>_ALGORITHM
+// and TOKEN_<name>_BUCKET_SIZE. Policy names a configured policy the token gets instead
+// of all of these. Window is the length of its window in seconds, the one of the policy
+// when 0. A disabled token is refused like an invalid API key.
+type TokenConfig struct {
+	Name       string
+	Limit      int
+	BlockTime  int
+	Contact    string `json:",omitempty"`
+	Algorithm  string `json:",omitempty"`
+	BucketSize int    `json:",omitempty"`
+	Window     int    `json:",omitempty"`
+	Policy     string `json:",omitempty"`
+	Disabled   bool   `json:",omitempty"`
+	// Owner groups the tokens of one customer, which may move quota between each other
+	Owner string `json:",omitempty"`
+}
+
+// Usage periods. Second buckets are raw data compacted by the rollup into hours and days.
+const (
+	UsagePeriodSecond = "second"
+	UsagePeriodHour   = "hour"
+	UsagePeriodDay    = "day"
+)
+
+// UsageRecord counts the allowed requests of a key during the period starting at Start
+type UsageRecord struct {
+	Key    string    `json:"key"`
+	Period string    `json:"period"`
+	Start  time.Time `json:"start"`
+	Count  int64     `json:"count"`
 }
 
 // Storage defines the interface for rate limit storage backends
 type Storage interface {
 	Get(ctx context.Context, key string) (*RateLimit, error)
 	Set(ctx context.Context, key string, rateLimit *RateLimit, expiration time.Duration) error
+	// GetMulti returns the counters of the keys in order, nil for a missing one, and
+	// SetMulti writes several counters, each in a single round trip
+	GetMulti(ctx context.Context, keys []string) ([]*RateLimit, error)
+	SetMulti(ctx context.Context, entries []RateLimitEntry) error
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context) ([]string, error)
+	AddBan(ctx context.Context, ban *Ban) error
+	RemoveBan(ctx context.Context, value string) error
+	ListBans(ctx context.Context) ([]*Ban, error)
+	SetTokenConfig(ctx context.Context, tokenConfig *TokenConfig) error
+	DeleteTokenConfig(ctx context.Context, name string) error
+	ListTokenConfigs(ctx context.Context) ([]*TokenConfig, error)
+	AddUsage(ctx context.Context, period string, start time.Time, counts map[string]int64, retention time.Duration) error
+	TakeUsage(ctx context.Context, period string, before time.Time) ([]*UsageRecord, error)
+	ListUsage(ctx context.Context, period string, from, to time.Time) ([]*UsageRecord, error)
+	AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+	ReleaseLease(ctx context.Context, name, holder string) error
+	// Ping checks that the backend is reachable
+	Ping(ctx context.Context) error
 	Close() error
 }
 
+// RateLimitEntry is a counter written by SetMulti
+type RateLimitEntry struct {
+	Key        string
+	RateLimit  *RateLimit
+	Expiration time.Duration
+}
+
+// ErrNotAtomic is returned by an AtomicStorage wrapper whose underlying storage cannot
+// run the operation atomically; the caller falls back to Get and Set
+var ErrNotAtomic = errors.New("ratelimiter: storage does not support atomic operations")
+
+// WindowCheck is a fixed window a request has to fit in
+type WindowCheck struct {
+	Key    string
+	Limits Limits
+	Window time.Duration
+}
+
+// AtomicStorage is implemented by storages that run a whole check in one step, with no
+// other check of the same keys interleaved, instead of a Get followed by a Set
+type AtomicStorage interface {
+	// AllowWindows consumes cost in every window when it fits in all of them, with the
+	// semantics of ApplyWindows
+	AllowWindows(ctx context.Context, checks []WindowCheck, cost int, now time.Time) (Result, error)
+	// Consume adds cost to the counter of the key, created with start as LastReset, and
+	// returns the new count
+	Consume(ctx context.Context, key string, cost int, start time.Time, expiration time.Duration) (int, error)
+	// Refund takes cost back from the counter of the key, never below zero and keeping
+	// its expiration. A missing counter, or one whose LastReset is after at, which started
+	// over since the cost was consumed, is left alone.
+	Refund(ctx context.Context, key string, cost int, at time.Time) error
+}
+
+// WindowCall is one AllowWindows call of a batch, whose Result and Err are filled in
+// by AllowWindowsBatch
+type WindowCall struct {
+	Checks []WindowCheck
+	Cost   int
+	Now    time.Time
+
+	Result Result
+	Err    error
+}
+
+// BatchStorage is implemented by atomic storages that run several AllowWindows calls in
+// one round trip. Each call stays atomic and they run in order, so a batch allows
+// exactly what the calls would have one after the other.
+type BatchStorage interface {
+	AllowWindowsBatch(ctx context.Context, calls []*WindowCall)
+}
+
+// BlockEvent is a refusal one instance got for the keys of a check, blocked together
+// until BlockedUntil, or with a zero BlockedUntil the lift of the blocks of its only key
+type BlockEvent struct {
+	Keys         []string  `json:"keys"`
+	BlockedUntil time.Time `json:"blocked_until,omitempty"`
+	Result       Result    `json:"result"`
+}
+
+// BlockBroadcaster is implemented by shared storages that relay block events between
+// the instances using them. SubscribeBlocks returns once the subscription is set up and
+// calls handler with every event published, by this instance too, until ctx is done.
+type BlockBroadcaster interface {
+	PublishBlock(ctx context.Context, event BlockEvent) error
+	SubscribeBlocks(ctx context.Context, handler func(BlockEvent)) error
+}
+
+// Redis deployment modes supported by StorageConfig.Mode
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeCluster    = "cluster"
+	RedisModeSentinel   = "sentinel"
+)
+
 // StorageConfig holds configuration for storage backends
 type StorageConfig struct {
 	Host     string
 	Port     string
 	Password string
 	DB       int
+
+	// PasswordProvider, when set, is consulted on every new connection so a
+	// rotated password applies without a restart. Sentinel mode ignores it.
+	PasswordProvider func() string
+
+	// Backend selects the storage: redis (the default) or etcd, reached at
+	// EtcdEndpoints through the JSON gateway of its v3 API, with every key under
+	// EtcdPrefix. EtcdUsername authenticates when etcd has auth enabled.
+	Backend       string
+	EtcdEndpoints []string
+	EtcdPrefix    string
+	EtcdUsername  string
+	EtcdPassword  string
+	EtcdTLSCACert string
+	EtcdTLSCert   string
+	EtcdTLSKey    string
+
+	// DiskPath is the file the disk backend keeps everything in, saved every
+	// DiskSyncInterval milliseconds when the counters changed
+	DiskPath         string
+	DiskSyncInterval int
+
+	// KeyPrefix is prepended to every Redis key, so several services or environments
+	// can share one Redis, e.g. "rl:prod:"
+	KeyPrefix string
+
+	// CounterEncoding is how Redis and etcd store counters: CounterEncodingJSON (the
+	// default) or CounterEncodingBinary. Both are read whatever it is.
+	CounterEncoding string
+
+	// Mode selects standalone, cluster or sentinel. Cluster and sentinel use
+	// Addresses (cluster nodes or sentinels); sentinel also needs MasterName.
+	Mode             string
+	Addresses        []string
+	MasterName       string
+	SentinelPassword string
+
+	TLSEnabled            bool
+	TLSCACert             string
+	TLSCert               string
+	TLSKey                string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
+
+	WriteBehindEnabled       bool
+	WriteBehindFlushInterval int
+	WriteBehindMaxPending    int
+
+	FallbackEnabled       bool
+	FallbackTimeout       int
+	FallbackProbeInterval int
+
+	// RetryAttempts retries counter operations failing with a transient error, such as
+	// a refused connection or a loading Redis, after a jittered backoff starting at
+	// RetryBackoff milliseconds and doubling each attempt
+	RetryAttempts int
+	RetryBackoff  int
+
+	// CoalesceEnabled batches the checks of a key that arrive while one of its checks is
+	// in flight into a single round trip
+	CoalesceEnabled bool
+
+	// LocalCache keeps blocked keys and hot counters in process, LocalCacheCounterTTL
+	// and LocalCacheBlockTTL in milliseconds. LocalCacheShareBlocks relays the blocks
+	// between the instances over Redis pub/sub.
+	LocalCacheEnabled     bool
+	LocalCacheCounterTTL  int
+	LocalCacheBlockTTL    int
+	LocalCacheSize        int
+	LocalCacheShareBlocks bool
+
+	// ReadOnly starts the limiter in read-only mode, deciding from the stored counters
+	// without writing them
+	ReadOnly bool
 }
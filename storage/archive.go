@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ObjectStore keeps archived objects outside of the rate limit storage
+type ObjectStore interface {
+	PutObject(ctx context.Context, key string, body []byte) error
+}
+
+// NewObjectStore opens the cold tier described by ARCHIVE_URL: s3://bucket/prefix,
+// gs://bucket/prefix (through the S3-compatible XML API and HMAC keys) or
+// file:///directory. It returns nil when no archive is configured.
+func NewObjectStore(config Config) (ObjectStore, error) {
+	if config.ArchiveURL == "" {
+		return nil, nil
+	}
+
+	target, err := url.Parse(config.ArchiveURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ARCHIVE_URL: %w", err)
+	}
+	prefix := strings.Trim(target.Path, "/")
+
+	switch target.Scheme {
+	case "file":
+		if target.Path == "" {
+			return nil, fmt.Errorf("invalid ARCHIVE_URL %q: missing directory", config.ArchiveURL)
+		}
+		return &DirectoryObjectStore{dir: target.Path}, nil
+	case "s3", "gs":
+		if target.Host == "" {
+			return nil, fmt.Errorf("invalid ARCHIVE_URL %q: missing bucket", config.ArchiveURL)
+		}
+
+		endpoint, region := config.ArchiveEndpoint, config.ArchiveRegion
+		if target.Scheme == "gs" {
+			endpoint = getDefault(endpoint, "https://storage.googleapis.com")
+			region = getDefault(region, "auto")
+		} else {
+			region = getDefault(region, "us-east-1")
+			endpoint = getDefault(endpoint, "https://s3."+region+".amazonaws.com")
+		}
+
+		return &S3ObjectStore{
+			endpoint: strings.TrimSuffix(endpoint, "/"),
+			bucket:   target.Host,
+			prefix:   prefix,
+			region:   region,
+			credentials: awsCredentials{
+				accessKey:    config.ArchiveAccessKeyID,
+				secretKey:    config.ArchiveSecretAccessKey,
+				sessionToken: config.ArchiveSessionToken,
+			},
+			client: &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid ARCHIVE_URL %q: unsupported scheme %q", config.ArchiveURL, target.Scheme)
+	}
+}
+
+// S3ObjectStore uploads objects with path-style, SigV4 signed PUT requests, which
+// AWS S3, Google Cloud Storage interoperability and MinIO all accept
+type S3ObjectStore struct {
+	endpoint    string
+	bucket      string
+	prefix      string
+	region      string
+	credentials awsCredentials
+	client      *http.Client
+}
+
+func (s *S3ObjectStore) PutObject(ctx context.Context, key string, body []byte) error {
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.endpoint+"/"+s.bucket+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	signAWSRequest(req, s.credentials, s.region, "s3", body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach object storage: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("object storage returned %s for %s: %s", resp.Status, key, message)
+	}
+	return nil
+}
+
+// DirectoryObjectStore writes objects as files below a directory, for development or
+// a mounted volume
+type DirectoryObjectStore struct {
+	dir string
+}
+
+func (d *DirectoryObjectStore) PutObject(ctx context.Context, key string, body []byte) error {
+	path := filepath.Join(d.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, body, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func getDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
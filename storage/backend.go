@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"fmt"
+	ratelimiter "rate-limiter"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage backends selected by StorageConfig.Backend
+const (
+	BackendRedis = "redis"
+	BackendEtcd  = "etcd"
+	BackendDisk  = "disk"
+)
+
+// BackendFactory connects to a storage backend kept outside this module. Settings that
+// StorageConfig has no field for are read by the factory itself, from its own
+// environment variables.
+type BackendFactory func(config ratelimiter.StorageConfig) (ratelimiter.Storage, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a backend available to STORAGE_BACKEND under name. It is meant
+// to be called from the init function of the package implementing it, and panics when
+// the name is taken.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if factory == nil {
+		panic("storage: RegisterBackend factory is nil")
+	}
+	_, exists := backends[name]
+	if exists || name == "" || name == BackendRedis || name == BackendEtcd || name == BackendDisk {
+		panic(fmt.Sprintf("storage: RegisterBackend called twice for %q", name))
+	}
+	backends[name] = factory
+}
+
+// UnregisterBackend removes a registered backend, so a test can register it again
+func UnregisterBackend(name string) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	delete(backends, name)
+}
+
+// Backends returns the built-in backends followed by the registered ones, sorted by name
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	registered := make([]string, 0, len(backends))
+	for name := range backends {
+		registered = append(registered, name)
+	}
+	sort.Strings(registered)
+	return append([]string{BackendRedis, BackendEtcd, BackendDisk}, registered...)
+}
+
+// NewStorage connects to the backend selected by StorageConfig.Backend
+func NewStorage(config ratelimiter.StorageConfig) (ratelimiter.Storage, error) {
+	switch config.Backend {
+	case "", BackendRedis:
+		return NewRedisStorage(config)
+	case BackendEtcd:
+		return NewEtcdStorage(config)
+	case BackendDisk:
+		return NewDiskStorage(config.DiskPath, time.Duration(max(config.DiskSyncInterval, 1))*time.Millisecond)
+	}
+
+	backendsMu.RLock()
+	factory, exists := backends[config.Backend]
+	backendsMu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("unknown storage backend %q, expected one of %s", config.Backend, strings.Join(Backends(), ", "))
+	}
+	return factory(config)
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CoalescingStorage merges concurrent checks of a hot key into fewer round trips. The
+// first check of a key goes straight to the wrapped storage; checks of the same windows
+// arriving while it is in flight queue up and run together as one AllowWindowsBatch
+// once it returns, and so on while the key stays busy. A lone check waits for nothing.
+//
+// Batches keep every call atomic and in order, so exactly the requests that would have
+// been allowed one by one are allowed. Storages without BatchStorage are not coalesced.
+type CoalescingStorage struct {
+	ratelimiter.Storage
+
+	mu     sync.Mutex
+	queues map[string]*windowQueue
+}
+
+// windowQueue tracks the in-flight check of a key and the calls waiting behind it
+type windowQueue struct {
+	checks []ratelimiter.WindowCheck
+	next   *windowBatch
+}
+
+type windowBatch struct {
+	ctx   context.Context
+	calls []*ratelimiter.WindowCall
+	done  chan struct{}
+}
+
+func NewCoalescingStorage(storage ratelimiter.Storage) *CoalescingStorage {
+	return &CoalescingStorage{
+		Storage: storage,
+		queues:  make(map[string]*windowQueue),
+	}
+}
+
+// AllowWindows runs the check right away when no check of its windows is in flight,
+// else it joins the batch that runs when the current one returns
+func (c *CoalescingStorage) AllowWindows(ctx context.Context, checks []ratelimiter.WindowCheck, cost int, now time.Time) (ratelimiter.Result, error) {
+	atomic, ok := c.Storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return ratelimiter.Result{}, ratelimiter.ErrNotAtomic
+	}
+	batcher, ok := c.Storage.(ratelimiter.BatchStorage)
+	if !ok {
+		return atomic.AllowWindows(ctx, checks, cost, now)
+	}
+
+	key := windowsKey(checks)
+	c.mu.Lock()
+	queue, busy := c.queues[key]
+	if !busy {
+		c.queues[key] = &windowQueue{checks: checks}
+		c.mu.Unlock()
+
+		result, err := atomic.AllowWindows(ctx, checks, cost, now)
+		c.finish(key, batcher)
+		return result, err
+	}
+	if !slices.Equal(queue.checks, checks) {
+		// Same keys with other limits, such as during a reload; not worth a queue
+		c.mu.Unlock()
+		return atomic.AllowWindows(ctx, checks, cost, now)
+	}
+
+	call := &ratelimiter.WindowCall{Checks: checks, Cost: cost, Now: now}
+	if queue.next == nil {
+		queue.next = &windowBatch{ctx: ctx, done: make(chan struct{})}
+	}
+	batch := queue.next
+	batch.calls = append(batch.calls, call)
+	c.mu.Unlock()
+
+	select {
+	case <-batch.done:
+		return call.Result, call.Err
+	case <-ctx.Done():
+		return ratelimiter.Result{}, ctx.Err()
+	}
+}
+
+// Consume forwards to the wrapped storage, adds are not coalesced
+func (c *CoalescingStorage) Consume(ctx context.Context, key string, cost int, start time.Time, expiration time.Duration) (int, error) {
+	atomic, ok := c.Storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return 0, ratelimiter.ErrNotAtomic
+	}
+	return atomic.Consume(ctx, key, cost, start, expiration)
+}
+
+// Refund forwards to the wrapped storage, refunds are not coalesced
+func (c *CoalescingStorage) Refund(ctx context.Context, key string, cost int, at time.Time) error {
+	atomic, ok := c.Storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return ratelimiter.ErrNotAtomic
+	}
+	return atomic.Refund(ctx, key, cost, at)
+}
+
+// finish hands the key over to the batch waiting behind the check that just returned,
+// or releases it when there is none
+func (c *CoalescingStorage) finish(key string, batcher ratelimiter.BatchStorage) {
+	c.mu.Lock()
+	queue := c.queues[key]
+	batch := queue.next
+	queue.next = nil
+	if batch == nil {
+		delete(c.queues, key)
+	}
+	c.mu.Unlock()
+
+	if batch != nil {
+		go c.run(key, batch, batcher)
+	}
+}
+
+// run sends a batch with the deadline of its first call, but not its cancellation: the
+// other calls still wait for their results
+func (c *CoalescingStorage) run(key string, batch *windowBatch, batcher ratelimiter.BatchStorage) {
+	ctx := context.WithoutCancel(batch.ctx)
+	if deadline, ok := batch.ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	batcher.AllowWindowsBatch(ctx, batch.calls)
+	close(batch.done)
+	c.finish(key, batcher)
+}
+
+func windowsKey(checks []ratelimiter.WindowCheck) string {
+	if len(checks) == 1 {
+		return checks[0].Key
+	}
+	keys := make([]string, len(checks))
+	for i, check := range checks {
+		keys[i] = check.Key
+	}
+	return strings.Join(keys, "\x00")
+}
@@ -1,25 +1,319 @@
 package storage
 
 import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"path"
 	ratelimiter "rate-limiter"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
+const (
+	OnStorageErrorAllow = "allow"
+	OnStorageErrorDeny  = "deny"
+)
+
 type Config struct {
-	IPRateLimit     int
-	IPBlockTime     int
+	IPRateLimit int
+	IPBlockTime int
+	// IPv6Prefix keys IPv6 clients by their network of that length rather than their
+	// address, since anyone holds a whole /64; 0 or 128 keys every address apart
+	IPv6Prefix      int
 	TokenLimits     map[string]int
 	TokenBlockTimes map[string]int
+	// UnknownTokenPolicy handles API keys matching no configured token:
+	// default_token_limit keys them by token with DefaultTokenLimit (the IP limit when
+	// 0), fallback_to_ip_key limits them as their IP and reject refuses them
+	UnknownTokenPolicy string
+	DefaultTokenLimit  int
+	// TokenKeyByIP keys tokens by token and client IP, token:<name>:ip:<ip>, so every
+	// IP using a token gets a window of its own; the quotas stay shared by the token
+	TokenKeyByIP bool
+
+	// JWTSecret, JWTPublicKeyFile and JWTJWKSURL verify JWT bearer tokens (HMAC, RSA
+	// or the RSA keys of a JWKS), keying their clients by the first set of JWTKeyClaims
+	// and taking the policy or tier named in JWTTierClaim
+	JWTSecret        string
+	JWTPublicKeyFile string
+	JWTJWKSURL       string
+	JWTKeyClaims     []string
+	JWTTierClaim     string
+	JWTIssuer        string
+	JWTAudience      string
+
+	// IPRateLimitDisabled turns the limiter token-only: requests without a token or mTLS
+	// identity are never keyed by IP but refused or let through by TokenlessPolicy
+	IPRateLimitDisabled bool
+	TokenlessPolicy     string
+
+	GlobalRateLimit int
+
+	// NetworkLimits cap the requests of every client of a network together, keyed by
+	// CIDR, on top of their own limits; a client in several of them counts toward the
+	// longest prefix only. A network over its limit is blocked for NetworkBlockTime.
+	NetworkLimits    map[string]int
+	NetworkBlockTime int
+
+	// GeoIPDatabases are MaxMind databases (GeoLite2 Country, City or ASN) giving the
+	// country and ASN of client IPs. IP-keyed clients take the policy of their ASN in
+	// ASNPolicies, else of their country in CountryPolicies, and clients of
+	// BlockedCountries or BlockedASNs are refused like denylisted ones.
+	GeoIPDatabases   []string
+	CountryPolicies  map[string]string
+	ASNPolicies      map[string]string
+	BlockedCountries []string
+	BlockedASNs      []string
+
 	ServerPort      string
+	RLSPort         string
+	GRPCPort        string
+	ShutdownTimeout int
+
+	// ServerReadTimeout, ServerReadHeaderTimeout, ServerWriteTimeout and ServerIdleTimeout
+	// (seconds, 0 disables one) and ServerMaxHeaderBytes bound what a client can hold of
+	// the main server, so slow clients can't exhaust its connections
+	ServerReadTimeout       int
+	ServerReadHeaderTimeout int
+	ServerWriteTimeout      int
+	ServerIdleTimeout       int
+	ServerMaxHeaderBytes    int
+
+	// StorageTimeout bounds the storage calls of a single check, in milliseconds; 0 leaves
+	// them bound only by the incoming request
+	StorageTimeout int
+
+	// TLSCert and TLSKey serve the listener over TLS. With TLSClientCA clients must
+	// present a certificate it signed (TLSClientAuth "optional" also accepts clients
+	// without one), and the identity of the certificate becomes their rate limit key,
+	// limited by IdentityLimits or IdentityPolicies like tokens are
+	TLSCert          string
+	TLSKey           string
+	TLSClientCA      string
+	TLSClientAuth    string
+	IdentityLimits   map[string]int
+	IdentityPolicies map[string]string
+
+	// TLSAutocertDomains obtains the certificate from Let's Encrypt instead of TLSCert,
+	// caching it in TLSAutocertCacheDir; needs a build with -tags autocert
+	TLSAutocertDomains  []string
+	TLSAutocertCacheDir string
+
+	// TokenAlgorithms picks the algorithm of a token tier, fixed_window by default;
+	// TokenBucketSizes sizes the bucket of the leaky_bucket tiers (TOKEN_<token>_BURST
+	// or _BUCKET_SIZE) and TokenWindows sets the window of a token in seconds
+	TokenAlgorithms  map[string]string
+	TokenBucketSizes map[string]int
+	TokenWindows     map[string]int
+
+	// Policies are the named policies of POLICIES and the tiers of TIER_<NAME>_*;
+	// IPPolicy, TokenPolicies (TOKEN_<token>_POLICY or _TIER) and RoutePolicies assign
+	// them to the IPs, to tokens and to "[METHOD ]/prefix" routes. PolicyRules bind the
+	// requests they match to a policy ahead of RoutePolicies, the first match winning.
+	Policies      map[string]Policy
+	IPPolicy      string
+	TokenPolicies map[string]string
+	RoutePolicies map[string]string
+	PolicyRules   []PolicyRule
+
+	MaxBlockTime       int
+	BlockSweepInterval int
+
+	// BlockEscalationFactor multiplies the block time of a key for every recent block,
+	// up to BlockMax seconds; a violation is forgotten every BlockEscalationDecay seconds
+	BlockEscalationFactor float64
+	BlockMax              int
+	BlockEscalationDecay  int
+
+	UpstreamURL      string
+	ProxyStripAPIKey bool
+
+	AdminToken string
+	// APISunsets deprecates the admin API versions it lists ("legacy" for the
+	// unversioned paths, "v1", ...) and announces when they go away
+	APISunsets         map[string]time.Time
+	Denylist           []string
+	DenylistStatusCode int
+	SyncInterval       int
+
+	APIKeyHeaders    []string
+	APIKeyBearer     bool
+	APIKeyQueryParam string
+	APIKeyCookie     string
+	// APIKeyExtractors names extractors registered by plugins, tried after the others
+	APIKeyExtractors []string
+	APIKeyStrict     bool
+	APIKeyMinLength  int
+	APIKeyMaxLength  int
+	APIKeyPrefix     string
+	APIKeyPattern    string
+
+	OnStorageError string
+
+	MessagesFile string
+
+	TrustedProxies []string
+	// ClientIPHeaders carry the client IP, by precedence; X-Forwarded-For, Forwarded,
+	// X-Real-IP and CF-Connecting-IP when empty
+	ClientIPHeaders []string
+
+	// CDNCacheHeader names the header a CDN in front reports its cache status in, such
+	// as X-Cache or CF-Cache-Status. Every request counts toward the regular limits;
+	// those the CDN did not serve from cache (a value other than CDNCacheHitValues)
+	// also count toward OriginRateLimit, a window of their own protecting the origin.
+	CDNCacheHeader    string
+	CDNCacheHitValues []string
+	OriginRateLimit   int
+	OriginBlockTime   int
+
+	// ErrorBudgetWindow counts the responses of each client and how many were client
+	// errors (4xx other than 429) over windows of that many seconds. A client whose share
+	// of errors goes over ErrorBudgetRatio, after ErrorBudgetMinRequests requests in the
+	// window, is blocked for ErrorBudgetBlockTime; with no ratio they are only counted.
+	ErrorBudgetWindow      int
+	ErrorBudgetRatio       float64
+	ErrorBudgetMinRequests int
+	ErrorBudgetBlockTime   int
+
+	// RefundStatuses give back to the client the cost of a request whose response has one
+	// of these statuses, codes such as 404 or classes such as 5xx, so that it is not
+	// charged for the failures of the upstream
+	RefundStatuses []string
+
+	// FailurePaths are glob patterns, matched with path.Match, of the paths whose requests
+	// only count when their response has one of the FailureStatuses, such as the 401s of
+	// a login. A client with more than FailureRateLimit of them in FailureWindow seconds
+	// is refused on those paths for FailureBlockTime.
+	FailurePaths     []string
+	FailureStatuses  []string
+	FailureRateLimit int
+	FailureWindow    int
+	FailureBlockTime int
+
+	ResponseFieldCase     string
+	ResponseEnvelope      string
+	ResponseErrorEnvelope string
+
+	ThrottleMaxWait int
+	ThrottlePaths   []string
+	ThrottleTokens  []string
+
+	IPDailyQuota       int
+	IPMonthlyQuota     int
+	TokenDailyQuotas   map[string]int
+	TokenMonthlyQuotas map[string]int
+	QuotaTimezone      string
+
+	QuotaAlertThresholds      []int
+	TokenQuotaAlertThresholds map[string][]int
+	TokenContacts             map[string]string
+	SMTPAddr                  string
+	SMTPFrom                  string
+	SMTPUsername              string
+	SMTPPassword              string
+
+	ConcurrencyLimit int
+	ConcurrencyPaths []string
+
+	RouteCosts         map[string]int
+	CostHeader         string
+	CostTrustedCallers []string
+
+	FingerprintEnabled   bool
+	FingerprintSecret    string
+	FingerprintCIDRs     []string
+	FingerprintJA3Header string
+	// FingerprintHeaders feed the fingerprint, User-Agent and Accept-Language when empty
+	FingerprintHeaders []string
+
+	// KeyHashing stores counters and usage under the HMAC-SHA256 of client IPs and
+	// API keys, keyed by KeyHashSecret, instead of the raw values
+	KeyHashingEnabled bool
+	KeyHashSecret     string
+
+	// ExemptPaths are glob patterns, matched with path.Match, of the paths never rate
+	// limited, such as the probes and metrics of the infrastructure
+	ExemptPaths []string
+
+	HealthCheckMode          string
+	HealthCheckUserAgents    []string
+	HealthCheckPaths         []string
+	HealthCheckMinSources    int
+	HealthCheckWindow        int
+	HealthCheckPoolLimit     int
+	HealthCheckPoolBlockTime int
+
+	WebSocketRateLimit int
+	WebSocketBlockTime int
+
+	ResponseCachePaths        []string
+	ResponseCacheTTL          int
+	ResponseCacheMaxBodyBytes int64
+	ResponseCacheMaxEntries   int
+
+	LeaderLeaseTTL int
+
+	UsageEnabled         bool
+	UsageRollupInterval  int
+	UsageRawRetention    int
+	UsageHourlyRetention int
+	UsageDailyRetention  int
+
+	// KeyStatsRetention is how many days the refusals of a key are counted after its
+	// last one, 0 to not count them
+	KeyStatsRetention int
+
+	ArchiveURL             string
+	ArchiveEndpoint        string
+	ArchiveRegion          string
+	ArchiveAccessKeyID     string
+	ArchiveSecretAccessKey string
+	ArchiveSessionToken    string
+	ArchiveAfterHours      int
+	ArchiveInterval        int
+
+	BlockEventsSocket string
+
+	CanaryInterval         int
+	CanaryMaxLatency       int
+	CanaryFailureThreshold int
+	CanaryAlertWebhook     string
+
+	SnapshotSampleRate    float64
+	SnapshotMaxPerSecond  int
+	SnapshotMaxBodyBytes  int64
+	SnapshotSink          string
+	SnapshotStream        string
+	SnapshotMaxEntries    int64
+	SnapshotFile          string
+	SnapshotFileMaxBytes  int64
+	SnapshotRedactHeaders []string
+}
+
+// AppNamespace is a separately configured application served by the same deployment,
+// selected by Host header or path prefix
+type AppNamespace struct {
+	Name       string
+	Hosts      []string
+	PathPrefix string
+	Template   string
+	RateLimit  Config
 }
 
 type AppConfig struct {
 	RateLimit Config
 	Storage   ratelimiter.StorageConfig
+	Apps      []AppNamespace
+	Log       LogConfig
 }
 
 func LoadConfig() (AppConfig, error) {
@@ -31,6 +325,19 @@ func LoadConfig() (AppConfig, error) {
 		RateLimit: Config{
 			TokenLimits:     make(map[string]int),
 			TokenBlockTimes: make(map[string]int),
+
+			TokenAlgorithms:  make(map[string]string),
+			TokenBucketSizes: make(map[string]int),
+			TokenWindows:     make(map[string]int),
+
+			Policies:      make(map[string]Policy),
+			TokenPolicies: make(map[string]string),
+
+			TokenDailyQuotas:   make(map[string]int),
+			TokenMonthlyQuotas: make(map[string]int),
+
+			TokenQuotaAlertThresholds: make(map[string][]int),
+			TokenContacts:             make(map[string]string),
 		},
 		Storage: ratelimiter.StorageConfig{},
 	}
@@ -55,11 +362,292 @@ func LoadConfig() (AppConfig, error) {
 		appConfig.RateLimit.IPBlockTime = 300
 	}
 
+	appConfig.RateLimit.GlobalRateLimit = getEnvInt("GLOBAL_RATE_LIMIT", 0)
+	networkLimits, err := parseNetworkLimits(getEnvList("NETWORK_LIMITS"))
+	if err != nil {
+		return appConfig, err
+	}
+	appConfig.RateLimit.NetworkLimits = networkLimits
+	appConfig.RateLimit.NetworkBlockTime = getEnvInt("NETWORK_BLOCK_TIME", appConfig.RateLimit.IPBlockTime)
+
+	appConfig.RateLimit.GeoIPDatabases = getEnvList("GEOIP_DATABASES")
+	appConfig.RateLimit.CountryPolicies = make(map[string]string)
+	for country, name := range parseIdentityPolicies(getEnvList("COUNTRY_POLICIES")) {
+		appConfig.RateLimit.CountryPolicies[strings.ToUpper(country)] = name
+	}
+	appConfig.RateLimit.ASNPolicies = make(map[string]string)
+	for asn, name := range parseIdentityPolicies(getEnvList("ASN_POLICIES")) {
+		appConfig.RateLimit.ASNPolicies[normalizeASN(asn)] = name
+	}
+	for _, country := range getEnvList("BLOCKED_COUNTRIES") {
+		appConfig.RateLimit.BlockedCountries = append(appConfig.RateLimit.BlockedCountries, strings.ToUpper(country))
+	}
+	for _, asn := range getEnvList("BLOCKED_ASNS") {
+		appConfig.RateLimit.BlockedASNs = append(appConfig.RateLimit.BlockedASNs, normalizeASN(asn))
+	}
+
+	appConfig.RateLimit.MaxBlockTime = getEnvInt("MAX_BLOCK_TIME", 86400)
+	appConfig.RateLimit.BlockSweepInterval = getEnvInt("BLOCK_SWEEP_INTERVAL", 300)
+	appConfig.RateLimit.BlockEscalationFactor = getEnvFloat("BLOCK_ESCALATION_FACTOR", 0)
+	appConfig.RateLimit.BlockMax = getEnvInt("BLOCK_MAX", 0)
+	appConfig.RateLimit.BlockEscalationDecay = getEnvInt("BLOCK_ESCALATION_DECAY", 3600)
+
 	appConfig.RateLimit.ServerPort = os.Getenv("SERVER_PORT")
 	if appConfig.RateLimit.ServerPort == "" {
 		appConfig.RateLimit.ServerPort = "8080"
 	}
 
+	appConfig.RateLimit.UpstreamURL = os.Getenv("UPSTREAM_URL")
+	appConfig.RateLimit.ProxyStripAPIKey = os.Getenv("PROXY_STRIP_API_KEY") == "true"
+
+	appConfig.RateLimit.ShutdownTimeout = getEnvInt("SHUTDOWN_TIMEOUT", 30)
+	appConfig.RateLimit.ServerReadTimeout = getEnvInt("SERVER_READ_TIMEOUT", 10)
+	appConfig.RateLimit.ServerReadHeaderTimeout = getEnvInt("SERVER_READ_HEADER_TIMEOUT", 5)
+	appConfig.RateLimit.ServerWriteTimeout = getEnvInt("SERVER_WRITE_TIMEOUT", 30)
+	appConfig.RateLimit.ServerIdleTimeout = getEnvInt("SERVER_IDLE_TIMEOUT", 120)
+	appConfig.RateLimit.ServerMaxHeaderBytes = getEnvInt("SERVER_MAX_HEADER_BYTES", 1<<20)
+	appConfig.RateLimit.StorageTimeout = getEnvInt("STORAGE_TIMEOUT_MS", 500)
+
+	appConfig.RateLimit.IPRateLimitDisabled = os.Getenv("IP_RATE_LIMIT_ENABLED") == "false"
+	appConfig.RateLimit.IPv6Prefix = getEnvInt("IPV6_PREFIX", 64)
+	appConfig.RateLimit.TokenlessPolicy = getEnvOrDefault("TOKENLESS_POLICY", "reject")
+
+	appConfig.RateLimit.UnknownTokenPolicy = getEnvOrDefault("UNKNOWN_TOKEN_POLICY", "default_token_limit")
+	appConfig.RateLimit.DefaultTokenLimit = getEnvInt("DEFAULT_TOKEN_LIMIT", 0)
+	appConfig.RateLimit.TokenKeyByIP = os.Getenv("TOKEN_KEY_BY_IP") == "true"
+
+	appConfig.RateLimit.JWTSecret = os.Getenv("JWT_SECRET")
+	appConfig.RateLimit.JWTPublicKeyFile = os.Getenv("JWT_PUBLIC_KEY_FILE")
+	appConfig.RateLimit.JWTJWKSURL = os.Getenv("JWT_JWKS_URL")
+	appConfig.RateLimit.JWTKeyClaims = getEnvList("JWT_KEY_CLAIMS")
+	appConfig.RateLimit.JWTTierClaim = getEnvOrDefault("JWT_TIER_CLAIM", "tier")
+	appConfig.RateLimit.JWTIssuer = os.Getenv("JWT_ISSUER")
+	appConfig.RateLimit.JWTAudience = os.Getenv("JWT_AUDIENCE")
+
+	appConfig.RateLimit.TLSCert = os.Getenv("TLS_CERT")
+	appConfig.RateLimit.TLSKey = os.Getenv("TLS_KEY")
+	appConfig.RateLimit.TLSClientCA = os.Getenv("TLS_CLIENT_CA")
+	appConfig.RateLimit.TLSClientAuth = getEnvOrDefault("TLS_CLIENT_AUTH", "require")
+	appConfig.RateLimit.TLSAutocertDomains = getEnvList("TLS_AUTOCERT_DOMAINS")
+	appConfig.RateLimit.TLSAutocertCacheDir = getEnvOrDefault("TLS_AUTOCERT_CACHE_DIR", "autocert-cache")
+	identityLimits, err := parseIdentityLimits(getEnvList("MTLS_IDENTITY_LIMITS"))
+	if err != nil {
+		return appConfig, err
+	}
+	appConfig.RateLimit.IdentityLimits = identityLimits
+	appConfig.RateLimit.IdentityPolicies = parseIdentityPolicies(getEnvList("MTLS_IDENTITY_POLICIES"))
+
+	appConfig.RateLimit.AdminToken = os.Getenv("ADMIN_TOKEN")
+	apiSunsets, err := parseAPISunsets(getEnvList("API_SUNSET"))
+	if err != nil {
+		return appConfig, err
+	}
+	appConfig.RateLimit.APISunsets = apiSunsets
+
+	appConfig.RateLimit.Denylist = getEnvList("DENYLIST")
+	if path := os.Getenv("DENYLIST_FILE"); path != "" {
+		entries, err := loadListFile(path)
+		if err != nil {
+			return appConfig, fmt.Errorf("failed to load DENYLIST_FILE: %w", err)
+		}
+		appConfig.RateLimit.Denylist = append(appConfig.RateLimit.Denylist, entries...)
+	}
+
+	appConfig.RateLimit.DenylistStatusCode = http.StatusTooManyRequests
+	if val := os.Getenv("DENYLIST_STATUS_CODE"); val != "" {
+		if code, err := strconv.Atoi(val); err == nil && (code == http.StatusForbidden || code == http.StatusTooManyRequests) {
+			appConfig.RateLimit.DenylistStatusCode = code
+		}
+	}
+
+	appConfig.RateLimit.SyncInterval = 10
+	if val := os.Getenv("SYNC_INTERVAL"); val != "" {
+		if interval, err := strconv.Atoi(val); err == nil && interval > 0 {
+			appConfig.RateLimit.SyncInterval = interval
+		}
+	}
+
+	appConfig.RateLimit.APIKeyHeaders = getEnvList("API_KEY_HEADERS")
+	if len(appConfig.RateLimit.APIKeyHeaders) == 0 {
+		appConfig.RateLimit.APIKeyHeaders = []string{"API_KEY"}
+	}
+	appConfig.RateLimit.APIKeyBearer = getEnvOrDefault("API_KEY_BEARER", "true") == "true"
+	appConfig.RateLimit.APIKeyQueryParam = os.Getenv("API_KEY_QUERY_PARAM")
+	appConfig.RateLimit.APIKeyCookie = os.Getenv("API_KEY_COOKIE")
+	appConfig.RateLimit.APIKeyExtractors = getEnvList("API_KEY_EXTRACTORS")
+	appConfig.RateLimit.APIKeyStrict = os.Getenv("API_KEY_STRICT") == "true"
+	appConfig.RateLimit.APIKeyMinLength = getEnvInt("API_KEY_MIN_LENGTH", 1)
+	appConfig.RateLimit.APIKeyMaxLength = getEnvInt("API_KEY_MAX_LENGTH", 128)
+	appConfig.RateLimit.APIKeyPrefix = os.Getenv("API_KEY_PREFIX")
+	appConfig.RateLimit.APIKeyPattern = os.Getenv("API_KEY_PATTERN")
+
+	appConfig.RateLimit.WebSocketRateLimit = getEnvInt("WEBSOCKET_RATE_LIMIT", 0)
+	appConfig.RateLimit.WebSocketBlockTime = getEnvInt("WEBSOCKET_BLOCK_TIME", appConfig.RateLimit.IPBlockTime)
+
+	appConfig.RateLimit.TrustedProxies = getEnvList("TRUSTED_PROXIES")
+	appConfig.RateLimit.ClientIPHeaders = getEnvList("CLIENT_IP_HEADERS")
+
+	appConfig.RateLimit.CDNCacheHeader = os.Getenv("CDN_CACHE_HEADER")
+	appConfig.RateLimit.CDNCacheHitValues = getEnvList("CDN_CACHE_HIT_VALUES")
+	if len(appConfig.RateLimit.CDNCacheHitValues) == 0 {
+		appConfig.RateLimit.CDNCacheHitValues = []string{"HIT", "STALE"}
+	}
+	appConfig.RateLimit.OriginRateLimit = getEnvInt("ORIGIN_RATE_LIMIT", 0)
+	appConfig.RateLimit.OriginBlockTime = getEnvInt("ORIGIN_BLOCK_TIME", appConfig.RateLimit.IPBlockTime)
+
+	appConfig.RateLimit.ErrorBudgetWindow = getEnvInt("ERROR_BUDGET_WINDOW", 0)
+	appConfig.RateLimit.ErrorBudgetRatio = getEnvFloat("ERROR_BUDGET_RATIO", 0)
+	appConfig.RateLimit.ErrorBudgetMinRequests = getEnvInt("ERROR_BUDGET_MIN_REQUESTS", 20)
+	appConfig.RateLimit.ErrorBudgetBlockTime = getEnvInt("ERROR_BUDGET_BLOCK_TIME", appConfig.RateLimit.IPBlockTime)
+
+	refundStatuses, err := parseStatuses(getEnvList("REFUND_STATUSES"))
+	if err != nil {
+		return appConfig, fmt.Errorf("invalid REFUND_STATUSES: %w", err)
+	}
+	appConfig.RateLimit.RefundStatuses = refundStatuses
+
+	appConfig.RateLimit.FailurePaths = getEnvList("FAILURE_PATHS")
+	failureStatuses, err := parseStatuses(getEnvList("FAILURE_STATUSES"))
+	if err != nil {
+		return appConfig, fmt.Errorf("invalid FAILURE_STATUSES: %w", err)
+	}
+	if len(failureStatuses) == 0 {
+		failureStatuses = []string{"401", "403"}
+	}
+	appConfig.RateLimit.FailureStatuses = failureStatuses
+	appConfig.RateLimit.FailureRateLimit = getEnvInt("FAILURE_RATE_LIMIT", 0)
+	appConfig.RateLimit.FailureWindow = getEnvInt("FAILURE_WINDOW", 60)
+	appConfig.RateLimit.FailureBlockTime = getEnvInt("FAILURE_BLOCK_TIME", appConfig.RateLimit.IPBlockTime)
+
+	appConfig.RateLimit.ResponseFieldCase = os.Getenv("RESPONSE_FIELD_CASE")
+	appConfig.RateLimit.ResponseEnvelope = os.Getenv("RESPONSE_ENVELOPE")
+	appConfig.RateLimit.ResponseErrorEnvelope = getEnvOrDefault("RESPONSE_ERROR_ENVELOPE", "flat")
+
+	appConfig.RateLimit.ConcurrencyLimit = getEnvInt("CONCURRENCY_LIMIT", 0)
+	appConfig.RateLimit.ConcurrencyPaths = getEnvList("CONCURRENCY_PATHS")
+
+	appConfig.RateLimit.ThrottleMaxWait = getEnvInt("THROTTLE_MAX_WAIT_MS", 1000)
+	appConfig.RateLimit.ThrottlePaths = getEnvList("THROTTLE_PATHS")
+	appConfig.RateLimit.ThrottleTokens = getEnvList("THROTTLE_TOKENS")
+
+	appConfig.RateLimit.IPDailyQuota = getEnvInt("IP_DAILY_QUOTA", 0)
+	appConfig.RateLimit.IPMonthlyQuota = getEnvInt("IP_MONTHLY_QUOTA", 0)
+	appConfig.RateLimit.QuotaTimezone = getEnvOrDefault("QUOTA_TIMEZONE", "UTC")
+
+	thresholds, err := parseThresholds(getEnvList("QUOTA_ALERT_THRESHOLDS"))
+	if err != nil {
+		return appConfig, fmt.Errorf("invalid QUOTA_ALERT_THRESHOLDS: %w", err)
+	}
+	appConfig.RateLimit.QuotaAlertThresholds = thresholds
+	appConfig.RateLimit.SMTPAddr = os.Getenv("SMTP_ADDR")
+	appConfig.RateLimit.SMTPFrom = os.Getenv("SMTP_FROM")
+	appConfig.RateLimit.SMTPUsername = os.Getenv("SMTP_USERNAME")
+	appConfig.RateLimit.SMTPPassword = os.Getenv("SMTP_PASSWORD")
+
+	routeCosts, err := parseRouteCosts(getEnvList("ROUTE_COSTS"))
+	if err != nil {
+		return appConfig, err
+	}
+	appConfig.RateLimit.RouteCosts = routeCosts
+	appConfig.RateLimit.CostHeader = getEnvOrDefault("COST_HEADER", "X-RateLimit-Cost")
+	appConfig.RateLimit.CostTrustedCallers = getEnvList("COST_TRUSTED_CALLERS")
+
+	routePolicies, err := parseRoutePolicies(getEnvList("ROUTE_POLICIES"))
+	if err != nil {
+		return appConfig, err
+	}
+	appConfig.RateLimit.RoutePolicies = routePolicies
+
+	policyRules, err := parsePolicyRules(getEnvList("POLICY_RULES"))
+	if err != nil {
+		return appConfig, err
+	}
+	appConfig.RateLimit.PolicyRules = policyRules
+
+	appConfig.RateLimit.FingerprintEnabled = os.Getenv("FINGERPRINT_ENABLED") == "true"
+	appConfig.RateLimit.FingerprintSecret = os.Getenv("FINGERPRINT_SECRET")
+	appConfig.RateLimit.FingerprintCIDRs = getEnvList("FINGERPRINT_CIDRS")
+	appConfig.RateLimit.FingerprintJA3Header = os.Getenv("FINGERPRINT_JA3_HEADER")
+	appConfig.RateLimit.FingerprintHeaders = getEnvList("FINGERPRINT_HEADERS")
+
+	appConfig.RateLimit.KeyHashingEnabled = os.Getenv("KEY_HASHING_ENABLED") == "true"
+	appConfig.RateLimit.KeyHashSecret = os.Getenv("KEY_HASH_SECRET")
+
+	appConfig.RateLimit.MessagesFile = os.Getenv("MESSAGES_FILE")
+
+	appConfig.RateLimit.ResponseCachePaths = getEnvList("RESPONSE_CACHE_PATHS")
+	appConfig.RateLimit.ResponseCacheTTL = getEnvInt("RESPONSE_CACHE_TTL_MS", 1000)
+	appConfig.RateLimit.ResponseCacheMaxBodyBytes = int64(getEnvInt("RESPONSE_CACHE_MAX_BODY_BYTES", 1024*1024))
+	appConfig.RateLimit.ResponseCacheMaxEntries = getEnvInt("RESPONSE_CACHE_MAX_ENTRIES", 10000)
+
+	appConfig.RateLimit.RLSPort = os.Getenv("RLS_PORT")
+	appConfig.RateLimit.GRPCPort = os.Getenv("GRPC_PORT")
+
+	appConfig.RateLimit.BlockEventsSocket = os.Getenv("BLOCK_EVENTS_SOCKET")
+
+	appConfig.RateLimit.LeaderLeaseTTL = getEnvInt("LEADER_LEASE_TTL", 15)
+
+	appConfig.RateLimit.CanaryInterval = getEnvInt("CANARY_INTERVAL", 0)
+	appConfig.RateLimit.CanaryMaxLatency = getEnvInt("CANARY_MAX_LATENCY_MS", 250)
+	appConfig.RateLimit.CanaryFailureThreshold = getEnvInt("CANARY_FAILURE_THRESHOLD", 3)
+	appConfig.RateLimit.CanaryAlertWebhook = os.Getenv("CANARY_ALERT_WEBHOOK")
+
+	appConfig.RateLimit.UsageEnabled = os.Getenv("USAGE_ENABLED") == "true"
+	appConfig.RateLimit.UsageRollupInterval = getEnvInt("USAGE_ROLLUP_INTERVAL", 60)
+	appConfig.RateLimit.UsageRawRetention = getEnvInt("USAGE_RAW_RETENTION", 7200)
+	appConfig.RateLimit.UsageHourlyRetention = getEnvInt("USAGE_HOURLY_RETENTION_DAYS", 90)
+	appConfig.RateLimit.UsageDailyRetention = getEnvInt("USAGE_DAILY_RETENTION_DAYS", 400)
+
+	appConfig.RateLimit.KeyStatsRetention = getEnvInt("KEY_STATS_RETENTION_DAYS", 30)
+
+	appConfig.RateLimit.ArchiveURL = os.Getenv("ARCHIVE_URL")
+	appConfig.RateLimit.ArchiveEndpoint = os.Getenv("ARCHIVE_ENDPOINT")
+	appConfig.RateLimit.ArchiveRegion = getEnvOrDefault("ARCHIVE_REGION", os.Getenv("AWS_REGION"))
+	appConfig.RateLimit.ArchiveAccessKeyID = getEnvOrDefault("ARCHIVE_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID"))
+	appConfig.RateLimit.ArchiveSecretAccessKey = getEnvOrDefault("ARCHIVE_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	appConfig.RateLimit.ArchiveSessionToken = getEnvOrDefault("ARCHIVE_SESSION_TOKEN", os.Getenv("AWS_SESSION_TOKEN"))
+	appConfig.RateLimit.ArchiveAfterHours = getEnvInt("ARCHIVE_AFTER_HOURS", 48)
+	appConfig.RateLimit.ArchiveInterval = getEnvInt("ARCHIVE_INTERVAL", 3600)
+
+	appConfig.RateLimit.ExemptPaths = []string{"/health", "/healthz", "/metrics"}
+	if value, exists := os.LookupEnv("EXEMPT_PATHS"); exists {
+		appConfig.RateLimit.ExemptPaths = splitList(value)
+	}
+
+	appConfig.RateLimit.HealthCheckMode = getEnvOrDefault("HEALTHCHECK_MODE", "pool")
+	appConfig.RateLimit.HealthCheckUserAgents = getEnvList("HEALTHCHECK_USER_AGENTS")
+	if len(appConfig.RateLimit.HealthCheckUserAgents) == 0 {
+		appConfig.RateLimit.HealthCheckUserAgents = []string{"kube-probe", "ELB-HealthChecker", "GoogleHC", "Consul Health Check", "Envoy/HC"}
+	}
+	appConfig.RateLimit.HealthCheckPaths = getEnvList("HEALTHCHECK_PATHS")
+	if len(appConfig.RateLimit.HealthCheckPaths) == 0 {
+		appConfig.RateLimit.HealthCheckPaths = []string{"/health", "/healthz", "/ready", "/readyz", "/live", "/livez"}
+	}
+	appConfig.RateLimit.HealthCheckMinSources = getEnvInt("HEALTHCHECK_MIN_SOURCES", 3)
+	appConfig.RateLimit.HealthCheckWindow = getEnvInt("HEALTHCHECK_WINDOW", 10)
+	appConfig.RateLimit.HealthCheckPoolLimit = getEnvInt("HEALTHCHECK_POOL_LIMIT", 1000)
+	appConfig.RateLimit.HealthCheckPoolBlockTime = getEnvInt("HEALTHCHECK_POOL_BLOCK_TIME", 1)
+
+	appConfig.RateLimit.OnStorageError = OnStorageErrorAllow
+	if strings.EqualFold(os.Getenv("ON_STORAGE_ERROR"), OnStorageErrorDeny) {
+		appConfig.RateLimit.OnStorageError = OnStorageErrorDeny
+	}
+
+	if val := os.Getenv("SNAPSHOT_SAMPLE_RATE"); val != "" {
+		if rate, err := strconv.ParseFloat(val, 64); err == nil && rate >= 0 && rate <= 1 {
+			appConfig.RateLimit.SnapshotSampleRate = rate
+		}
+	}
+	appConfig.RateLimit.SnapshotMaxPerSecond = getEnvInt("SNAPSHOT_MAX_PER_SECOND", 10)
+	appConfig.RateLimit.SnapshotMaxBodyBytes = int64(getEnvInt("SNAPSHOT_MAX_BODY_BYTES", 1024))
+	appConfig.RateLimit.SnapshotSink = getEnvOrDefault("SNAPSHOT_SINK", "redis")
+	appConfig.RateLimit.SnapshotStream = getEnvOrDefault("SNAPSHOT_STREAM", "snapshots")
+	appConfig.RateLimit.SnapshotMaxEntries = int64(getEnvInt("SNAPSHOT_MAX_ENTRIES", 1000))
+	appConfig.RateLimit.SnapshotFile = getEnvOrDefault("SNAPSHOT_FILE", "snapshots.jsonl")
+	appConfig.RateLimit.SnapshotFileMaxBytes = int64(getEnvInt("SNAPSHOT_FILE_MAX_BYTES", 10*1024*1024))
+	appConfig.RateLimit.SnapshotRedactHeaders = append([]string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}, appConfig.RateLimit.APIKeyHeaders...)
+	appConfig.RateLimit.SnapshotRedactHeaders = append(appConfig.RateLimit.SnapshotRedactHeaders, getEnvList("SNAPSHOT_REDACT_HEADERS")...)
+
 	appConfig.Storage = ratelimiter.StorageConfig{
 		Host:     getEnvOrDefault("REDIS_HOST", "localhost"),
 		Port:     getEnvOrDefault("REDIS_PORT", "6379"),
@@ -73,34 +661,307 @@ func LoadConfig() (AppConfig, error) {
 		}
 	}
 
-	for _, env := range os.Environ() {
-		pair := strings.SplitN(env, "=", 2)
-		if len(pair) != 2 {
+	appConfig.Storage.Backend = getEnvOrDefault("STORAGE_BACKEND", BackendRedis)
+	appConfig.Storage.EtcdEndpoints = getEnvList("ETCD_ENDPOINTS")
+	appConfig.Storage.EtcdPrefix = getEnvOrDefault("ETCD_PREFIX", "ratelimiter/")
+	appConfig.Storage.EtcdUsername = os.Getenv("ETCD_USERNAME")
+	appConfig.Storage.EtcdPassword = os.Getenv("ETCD_PASSWORD")
+	appConfig.Storage.EtcdTLSCACert = os.Getenv("ETCD_TLS_CA_CERT")
+	appConfig.Storage.EtcdTLSCert = os.Getenv("ETCD_TLS_CERT")
+	appConfig.Storage.EtcdTLSKey = os.Getenv("ETCD_TLS_KEY")
+	appConfig.Storage.DiskPath = getEnvOrDefault("DISK_STORAGE_PATH", "ratelimiter-data.json")
+	appConfig.Storage.DiskSyncInterval = getEnvInt("DISK_SYNC_INTERVAL_MS", 1000)
+	appConfig.Storage.CounterEncoding = getEnvOrDefault("COUNTER_ENCODING", ratelimiter.CounterEncodingJSON)
+
+	appConfig.Storage.Mode = getEnvOrDefault("REDIS_MODE", ratelimiter.RedisModeStandalone)
+	appConfig.Storage.KeyPrefix = os.Getenv("REDIS_KEY_PREFIX")
+	appConfig.Storage.Addresses = getEnvList("REDIS_ADDRS")
+	appConfig.Storage.MasterName = os.Getenv("REDIS_MASTER_NAME")
+	appConfig.Storage.SentinelPassword = os.Getenv("REDIS_SENTINEL_PASSWORD")
+
+	appConfig.Storage.TLSEnabled = os.Getenv("REDIS_TLS_ENABLED") == "true"
+	appConfig.Storage.TLSCACert = os.Getenv("REDIS_TLS_CA_CERT")
+	appConfig.Storage.TLSCert = os.Getenv("REDIS_TLS_CERT")
+	appConfig.Storage.TLSKey = os.Getenv("REDIS_TLS_KEY")
+	appConfig.Storage.TLSServerName = os.Getenv("REDIS_TLS_SERVER_NAME")
+	appConfig.Storage.TLSInsecureSkipVerify = os.Getenv("REDIS_TLS_INSECURE_SKIP_VERIFY") == "true"
+
+	appConfig.Storage.WriteBehindEnabled = os.Getenv("WRITE_BEHIND_ENABLED") == "true"
+	appConfig.Storage.WriteBehindFlushInterval = getEnvInt("WRITE_BEHIND_FLUSH_INTERVAL_MS", 100)
+	appConfig.Storage.WriteBehindMaxPending = getEnvInt("WRITE_BEHIND_MAX_PENDING", 1000)
+
+	appConfig.Storage.FallbackEnabled = os.Getenv("FALLBACK_ENABLED") == "true"
+	appConfig.Storage.FallbackTimeout = getEnvInt("FALLBACK_TIMEOUT_MS", 100)
+	appConfig.Storage.FallbackProbeInterval = getEnvInt("FALLBACK_PROBE_INTERVAL", 5)
+
+	appConfig.Storage.RetryAttempts = getEnvInt("STORAGE_RETRY_ATTEMPTS", 2)
+	appConfig.Storage.RetryBackoff = getEnvInt("STORAGE_RETRY_BACKOFF_MS", 10)
+	appConfig.Storage.CoalesceEnabled = os.Getenv("COALESCE_ENABLED") == "true"
+
+	appConfig.Storage.LocalCacheEnabled = os.Getenv("LOCAL_CACHE_ENABLED") == "true"
+	appConfig.Storage.LocalCacheCounterTTL = getEnvInt("LOCAL_CACHE_COUNTER_TTL_MS", 100)
+	appConfig.Storage.LocalCacheBlockTTL = getEnvInt("LOCAL_CACHE_BLOCK_TTL_MS", 5000)
+	appConfig.Storage.LocalCacheSize = getEnvInt("LOCAL_CACHE_SIZE", 10000)
+	appConfig.Storage.LocalCacheShareBlocks = os.Getenv("LOCAL_CACHE_SHARE_BLOCKS") == "true"
+
+	appConfig.Storage.ReadOnly = os.Getenv("READ_ONLY") == "true"
+
+	appConfig.Log.Level = getEnvOrDefault("LOG_LEVEL", "info")
+	appConfig.Log.Format = getEnvOrDefault("LOG_FORMAT", LogFormatText)
+
+	scanTokenEnv("TOKEN_", appConfig.RateLimit.TokenLimits, appConfig.RateLimit.TokenBlockTimes)
+	scanTokenAlgorithmEnv("TOKEN_", appConfig.RateLimit.TokenAlgorithms, appConfig.RateLimit.TokenBucketSizes)
+	scanTokenWindowEnv("TOKEN_", appConfig.RateLimit.TokenWindows)
+	scanTokenPolicyEnv("TOKEN_", appConfig.RateLimit.TokenPolicies)
+	scanTokenQuotaEnv("TOKEN_", appConfig.RateLimit.TokenDailyQuotas, appConfig.RateLimit.TokenMonthlyQuotas)
+	scanTokenAlertEnv("TOKEN_", appConfig.RateLimit.TokenQuotaAlertThresholds, appConfig.RateLimit.TokenContacts)
+
+	loadTiers("", &appConfig.RateLimit)
+	loadPolicies("", &appConfig.RateLimit)
+
+	appConfig.Apps = loadApps(appConfig.RateLimit)
+
+	if err := appConfig.Validate(); err != nil {
+		return appConfig, err
+	}
+
+	return appConfig, nil
+}
+
+// Validate rejects block times that can't be applied. Limits are always valid: 0
+// blocks every request and a negative limit disables limiting for the key.
+func (c AppConfig) Validate() error {
+	if err := c.RateLimit.Validate(); err != nil {
+		return err
+	}
+	if err := c.Log.Validate(); err != nil {
+		return err
+	}
+	switch c.Storage.CounterEncoding {
+	case "", ratelimiter.CounterEncodingJSON, ratelimiter.CounterEncodingBinary:
+	default:
+		return fmt.Errorf("COUNTER_ENCODING must be json or binary, got %q", c.Storage.CounterEncoding)
+	}
+	for _, app := range c.Apps {
+		if err := app.RateLimit.Validate(); err != nil {
+			return fmt.Errorf("app %s: %w", app.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c Config) Validate() error {
+	for _, pattern := range c.ExemptPaths {
+		if _, err := path.Match(pattern, "/"); err != nil {
+			return fmt.Errorf("invalid EXEMPT_PATHS pattern %q: %w", pattern, err)
+		}
+	}
+	if c.IPRateLimit > 0 && c.IPBlockTime < 0 {
+		return fmt.Errorf("IP_BLOCK_TIME must not be negative, got %d", c.IPBlockTime)
+	}
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		return fmt.Errorf("IPV6_PREFIX must be between 0 and 128, got %d", c.IPv6Prefix)
+	}
+	for _, proxy := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return fmt.Errorf("invalid TRUSTED_PROXIES entry %q: expected an IP or a CIDR", proxy)
+		}
+	}
+	if c.APIKeyPattern != "" {
+		if _, err := regexp.Compile(c.APIKeyPattern); err != nil {
+			return fmt.Errorf("invalid API_KEY_PATTERN: %w", err)
+		}
+	}
+	if c.JWTPublicKeyFile != "" {
+		if _, err := LoadRSAPublicKey(c.JWTPublicKeyFile); err != nil {
+			return fmt.Errorf("invalid JWT_PUBLIC_KEY_FILE: %w", err)
+		}
+	}
+	if c.MessagesFile != "" {
+		if _, err := LoadMessageTranslations(c.MessagesFile); err != nil {
+			return fmt.Errorf("invalid MESSAGES_FILE: %w", err)
+		}
+	}
+	if err := c.validateGeoIP(); err != nil {
+		return err
+	}
+	if len(c.NetworkLimits) > 0 && c.NetworkBlockTime < 0 {
+		return fmt.Errorf("NETWORK_BLOCK_TIME must not be negative, got %d", c.NetworkBlockTime)
+	}
+	if c.OriginRateLimit > 0 && c.OriginBlockTime < 0 {
+		return fmt.Errorf("ORIGIN_BLOCK_TIME must not be negative, got %d", c.OriginBlockTime)
+	}
+	if c.ErrorBudgetWindow < 0 {
+		return fmt.Errorf("ERROR_BUDGET_WINDOW must not be negative, got %d", c.ErrorBudgetWindow)
+	}
+	if c.ErrorBudgetRatio < 0 || c.ErrorBudgetRatio >= 1 {
+		return fmt.Errorf("ERROR_BUDGET_RATIO must be between 0 and 1, got %g", c.ErrorBudgetRatio)
+	}
+	if c.ErrorBudgetRatio > 0 && c.ErrorBudgetBlockTime < 0 {
+		return fmt.Errorf("ERROR_BUDGET_BLOCK_TIME must not be negative, got %d", c.ErrorBudgetBlockTime)
+	}
+	for _, pattern := range c.FailurePaths {
+		if _, err := path.Match(pattern, "/"); err != nil {
+			return fmt.Errorf("invalid FAILURE_PATHS pattern %q: %w", pattern, err)
+		}
+	}
+	if c.FailureRateLimit > 0 && c.FailureWindow <= 0 {
+		return fmt.Errorf("FAILURE_WINDOW must be positive, got %d", c.FailureWindow)
+	}
+	if c.FailureRateLimit > 0 && c.FailureBlockTime < 0 {
+		return fmt.Errorf("FAILURE_BLOCK_TIME must not be negative, got %d", c.FailureBlockTime)
+	}
+	for token, blockTime := range c.TokenBlockTimes {
+		if limit, exists := c.TokenLimits[token]; exists && limit <= 0 {
 			continue
 		}
+		if blockTime < 0 {
+			return fmt.Errorf("TOKEN_%s_BLOCK_TIME must not be negative, got %d", token, blockTime)
+		}
+	}
+	for token, algorithm := range c.TokenAlgorithms {
+		if !ratelimiter.IsAlgorithm(algorithm) {
+			return fmt.Errorf("TOKEN_%s_ALGORITHM must be one of %s, got %q", token, strings.Join(ratelimiter.Algorithms(), ", "), algorithm)
+		}
+	}
+	for token, size := range c.TokenBucketSizes {
+		if size < 0 {
+			return fmt.Errorf("TOKEN_%s_BUCKET_SIZE must not be negative, got %d", token, size)
+		}
+	}
+	for token, window := range c.TokenWindows {
+		if window < 0 {
+			return fmt.Errorf("TOKEN_%s_WINDOW must not be negative, got %d", token, window)
+		}
+	}
+	if err := c.validatePolicies(); err != nil {
+		return err
+	}
+	if c.BlockEscalationFactor != 0 && c.BlockEscalationFactor < 1 {
+		return fmt.Errorf("BLOCK_ESCALATION_FACTOR must be at least 1, got %g", c.BlockEscalationFactor)
+	}
+	if c.BlockMax < 0 || c.BlockEscalationDecay < 0 {
+		return fmt.Errorf("BLOCK_MAX and BLOCK_ESCALATION_DECAY must not be negative")
+	}
+	if c.IPDailyQuota < 0 || c.IPMonthlyQuota < 0 {
+		return fmt.Errorf("IP_DAILY_QUOTA and IP_MONTHLY_QUOTA must not be negative")
+	}
+	for token, quota := range c.TokenDailyQuotas {
+		if quota < 0 {
+			return fmt.Errorf("TOKEN_%s_DAILY_QUOTA must not be negative, got %d", token, quota)
+		}
+	}
+	for token, quota := range c.TokenMonthlyQuotas {
+		if quota < 0 {
+			return fmt.Errorf("TOKEN_%s_MONTHLY_QUOTA must not be negative, got %d", token, quota)
+		}
+	}
+	switch c.ResponseFieldCase {
+	case "", "snake", "camel":
+	default:
+		return fmt.Errorf("RESPONSE_FIELD_CASE must be snake or camel, got %q", c.ResponseFieldCase)
+	}
+	switch c.ResponseErrorEnvelope {
+	case "", "flat", "nested", "problem":
+	default:
+		return fmt.Errorf("RESPONSE_ERROR_ENVELOPE must be flat, nested or problem, got %q", c.ResponseErrorEnvelope)
+	}
+	switch c.UnknownTokenPolicy {
+	case "", "default_token_limit", "fallback_to_ip_key", "reject":
+	default:
+		return fmt.Errorf("UNKNOWN_TOKEN_POLICY must be default_token_limit, fallback_to_ip_key or reject, got %q", c.UnknownTokenPolicy)
+	}
+	if c.IPRateLimitDisabled {
+		switch c.TokenlessPolicy {
+		case "", "reject", "allow":
+		default:
+			return fmt.Errorf("TOKENLESS_POLICY must be reject or allow, got %q", c.TokenlessPolicy)
+		}
+		if c.UnknownTokenPolicy == "fallback_to_ip_key" {
+			return fmt.Errorf("UNKNOWN_TOKEN_POLICY fallback_to_ip_key needs IP rate limiting, which IP_RATE_LIMIT_ENABLED=false turns off")
+		}
+	}
+	if c.KeyHashingEnabled && c.KeyHashSecret == "" {
+		return fmt.Errorf("KEY_HASH_SECRET is required when KEY_HASHING_ENABLED=true")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("TLS_CERT and TLS_KEY must be set together")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		return fmt.Errorf("TLS_CLIENT_CA requires TLS_CERT and TLS_KEY")
+	}
+	switch c.TLSClientAuth {
+	case "", "require", "optional":
+	default:
+		return fmt.Errorf("TLS_CLIENT_AUTH must be require or optional, got %q", c.TLSClientAuth)
+	}
+	if c.QuotaTimezone != "" {
+		if _, err := time.LoadLocation(c.QuotaTimezone); err != nil {
+			return fmt.Errorf("invalid QUOTA_TIMEZONE: %w", err)
+		}
+	}
+	return nil
+}
 
-		key, value := pair[0], pair[1]
+// Warnings lists the limits of 0, which block every matching request, and the block
+// times over MAX_BLOCK_TIME, so a misconfiguration shows up at startup instead of as
+// unexplained 429s
+func (c AppConfig) Warnings() []string {
+	warnings := c.RateLimit.Warnings()
+	for _, app := range c.Apps {
+		for _, warning := range app.RateLimit.Warnings() {
+			warnings = append(warnings, "app "+app.Name+": "+warning)
+		}
+	}
+	return warnings
+}
 
-		if strings.HasPrefix(key, "TOKEN_") && strings.HasSuffix(key, "_LIMIT") {
-			tokenName := strings.TrimPrefix(key, "TOKEN_")
-			tokenName = strings.TrimSuffix(tokenName, "_LIMIT")
+func (c Config) Warnings() []string {
+	var warnings []string
 
-			if limit, err := strconv.Atoi(value); err == nil {
-				appConfig.RateLimit.TokenLimits[tokenName] = limit
-			}
+	if c.IPRateLimit == 0 && !c.IPRateLimitDisabled {
+		warnings = append(warnings, "IP_RATE_LIMIT is 0, every request without an API key is blocked")
+	}
+
+	tokens := make([]string, 0, len(c.TokenLimits))
+	for token := range c.TokenLimits {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+
+	allTokensBlocked := len(tokens) > 0
+	for _, token := range tokens {
+		if c.TokenLimits[token] == 0 {
+			warnings = append(warnings, fmt.Sprintf("TOKEN_%s_LIMIT is 0, every request with this token is blocked", token))
+		} else {
+			allTokensBlocked = false
 		}
+	}
 
-		if strings.HasPrefix(key, "TOKEN_") && strings.HasSuffix(key, "_BLOCK_TIME") {
-			tokenName := strings.TrimPrefix(key, "TOKEN_")
-			tokenName = strings.TrimSuffix(tokenName, "_BLOCK_TIME")
+	tokenlessBlocked := c.IPRateLimit == 0
+	if c.IPRateLimitDisabled {
+		tokenlessBlocked = c.TokenlessPolicy != "allow"
+	}
+	if tokenlessBlocked && allTokensBlocked {
+		warnings = append(warnings, "IP and token limits are all 0, the rate limiter blocks every request")
+	}
 
-			if blockTime, err := strconv.Atoi(value); err == nil {
-				appConfig.RateLimit.TokenBlockTimes[tokenName] = blockTime
+	if c.MaxBlockTime > 0 {
+		if c.IPBlockTime > c.MaxBlockTime {
+			warnings = append(warnings, fmt.Sprintf("IP_BLOCK_TIME %ds is capped at MAX_BLOCK_TIME %ds", c.IPBlockTime, c.MaxBlockTime))
+		}
+		blockTokens := make([]string, 0, len(c.TokenBlockTimes))
+		for token := range c.TokenBlockTimes {
+			blockTokens = append(blockTokens, token)
+		}
+		sort.Strings(blockTokens)
+		for _, token := range blockTokens {
+			if blockTime := c.TokenBlockTimes[token]; blockTime > c.MaxBlockTime {
+				warnings = append(warnings, fmt.Sprintf("TOKEN_%s_BLOCK_TIME %ds is capped at MAX_BLOCK_TIME %ds", token, blockTime, c.MaxBlockTime))
 			}
 		}
 	}
-
-	return appConfig, nil
+	return warnings
 }
 
 func GetDefaultConfig() AppConfig {
@@ -111,13 +972,95 @@ func GetDefaultConfig() AppConfig {
 			TokenLimits:     make(map[string]int),
 			TokenBlockTimes: make(map[string]int),
 			ServerPort:      "8080",
+			ShutdownTimeout: 30,
+
+			ServerReadTimeout:       10,
+			ServerReadHeaderTimeout: 5,
+			ServerWriteTimeout:      30,
+			ServerIdleTimeout:       120,
+			ServerMaxHeaderBytes:    1 << 20,
+			StorageTimeout:          500,
+			TLSAutocertCacheDir:     "autocert-cache",
+
+			DenylistStatusCode: http.StatusTooManyRequests,
+			SyncInterval:       10,
+
+			APIKeyHeaders:   []string{"API_KEY"},
+			APIKeyBearer:    true,
+			APIKeyMinLength: 1,
+			APIKeyMaxLength: 128,
+
+			OnStorageError: OnStorageErrorAllow,
+
+			LeaderLeaseTTL: 15,
+
+			CanaryMaxLatency:       250,
+			CanaryFailureThreshold: 3,
+
+			UsageRollupInterval:  60,
+			UsageRawRetention:    7200,
+			UsageHourlyRetention: 90,
+			UsageDailyRetention:  400,
+
+			KeyStatsRetention: 30,
+
+			ArchiveAfterHours: 48,
+			ArchiveInterval:   3600,
 		},
 		Storage: ratelimiter.StorageConfig{
 			Host:     "localhost",
 			Port:     "6379",
 			Password: "",
 			DB:       0,
+			Mode:     ratelimiter.RedisModeStandalone,
+
+			Backend:    BackendRedis,
+			EtcdPrefix: "ratelimiter/",
+
+			DiskPath:         "ratelimiter-data.json",
+			DiskSyncInterval: 1000,
+
+			CounterEncoding: ratelimiter.CounterEncodingJSON,
+
+			WriteBehindFlushInterval: 100,
+			WriteBehindMaxPending:    1000,
+
+			FallbackTimeout:       100,
+			FallbackProbeInterval: 5,
+
+			RetryAttempts: 2,
+			RetryBackoff:  10,
+
+			LocalCacheCounterTTL: 100,
+			LocalCacheBlockTTL:   5000,
+			LocalCacheSize:       10000,
 		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: LogFormatText,
+		},
+	}
+}
+
+// EnvSnapshot is the process environment as it was before .env, config files and
+// secrets were applied, so a reload can re-apply them from scratch
+type EnvSnapshot map[string]string
+
+func SnapshotEnv() EnvSnapshot {
+	env := make(EnvSnapshot)
+	for _, pair := range os.Environ() {
+		if key, value, found := strings.Cut(pair, "="); found {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// Restore replaces the process environment with the snapshot
+func (e EnvSnapshot) Restore() {
+	os.Clearenv()
+	for key, value := range e {
+		os.Setenv(key, value)
 	}
 }
 
@@ -127,3 +1070,516 @@ func getEnvOrDefault(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+// parseAPISunsets reads "version=YYYY-MM-DD" entries
+func parseAPISunsets(entries []string) (map[string]time.Time, error) {
+	sunsets := make(map[string]time.Time, len(entries))
+	for _, entry := range entries {
+		version, date, _ := strings.Cut(entry, "=")
+		sunset, err := time.Parse(time.DateOnly, strings.TrimSpace(date))
+		if err != nil || strings.TrimSpace(version) == "" {
+			return nil, fmt.Errorf("invalid API_SUNSET entry %q: expected version=YYYY-MM-DD", entry)
+		}
+		sunsets[strings.ToLower(strings.TrimSpace(version))] = sunset
+	}
+	return sunsets, nil
+}
+
+// parseIdentityLimits reads "identity=limit" entries. Identities are split at the last
+// "=", so URI identities may contain one.
+func parseIdentityLimits(entries []string) (map[string]int, error) {
+	limits := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		separator := strings.LastIndex(entry, "=")
+		limit, err := strconv.Atoi(strings.TrimSpace(entry[separator+1:]))
+		if separator <= 0 || err != nil {
+			return nil, fmt.Errorf("invalid MTLS_IDENTITY_LIMITS entry %q: expected identity=limit", entry)
+		}
+		limits[strings.TrimSpace(entry[:separator])] = limit
+	}
+	return limits, nil
+}
+
+// parseNetworkLimits reads "cidr=limit" entries, keyed by the canonical form of the CIDR
+func parseNetworkLimits(entries []string) (map[string]int, error) {
+	limits := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		cidr, value, found := strings.Cut(entry, "=")
+		_, network, cidrErr := net.ParseCIDR(strings.TrimSpace(cidr))
+		limit, limitErr := strconv.Atoi(strings.TrimSpace(value))
+		if !found || cidrErr != nil || limitErr != nil {
+			return nil, fmt.Errorf("invalid NETWORK_LIMITS entry %q: expected cidr=limit", entry)
+		}
+		limits[network.String()] = limit
+	}
+	return limits, nil
+}
+
+// normalizeASN drops the AS prefix of an autonomous system number, AS13335 being 13335
+func normalizeASN(asn string) string {
+	if number, found := strings.CutPrefix(strings.ToUpper(asn), "AS"); found {
+		return number
+	}
+	return asn
+}
+
+// validateGeoIP checks that GeoIP settings have a database to look clients up in and
+// name valid countries and ASNs, and that the databases open: without them the blocked
+// countries and ASNs would let every client through
+func (c Config) validateGeoIP() error {
+	countries := make([]string, 0, len(c.CountryPolicies)+len(c.BlockedCountries))
+	for country := range c.CountryPolicies {
+		countries = append(countries, country)
+	}
+	countries = append(countries, c.BlockedCountries...)
+	asns := make([]string, 0, len(c.ASNPolicies)+len(c.BlockedASNs))
+	for asn := range c.ASNPolicies {
+		asns = append(asns, asn)
+	}
+	asns = append(asns, c.BlockedASNs...)
+
+	if len(countries)+len(asns) > 0 && len(c.GeoIPDatabases) == 0 {
+		return fmt.Errorf("COUNTRY_POLICIES, ASN_POLICIES, BLOCKED_COUNTRIES and BLOCKED_ASNS need GEOIP_DATABASES")
+	}
+	for _, country := range countries {
+		if len(country) != 2 {
+			return fmt.Errorf("invalid country %q: expected an ISO 3166-1 alpha-2 code such as BR", country)
+		}
+	}
+	for _, asn := range asns {
+		if _, err := strconv.ParseUint(asn, 10, 32); err != nil {
+			return fmt.Errorf("invalid ASN %q: expected a number such as 13335 or AS13335", asn)
+		}
+	}
+	for _, path := range c.GeoIPDatabases {
+		if _, err := OpenMMDB(path); err != nil {
+			return fmt.Errorf("failed to open GEOIP_DATABASES: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseIdentityPolicies reads "identity=policy" entries, split like parseIdentityLimits
+func parseIdentityPolicies(entries []string) map[string]string {
+	policies := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		if separator := strings.LastIndex(entry, "="); separator > 0 {
+			policies[strings.TrimSpace(entry[:separator])] = strings.TrimSpace(entry[separator+1:])
+		}
+	}
+	return policies
+}
+
+// parseRouteCosts reads "[METHOD ]/path/prefix=cost" entries
+func parseRouteCosts(entries []string) (map[string]int, error) {
+	costs := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		route, value, found := strings.Cut(entry, "=")
+		cost, err := strconv.Atoi(strings.TrimSpace(value))
+		if !found || err != nil || cost < 1 {
+			return nil, fmt.Errorf("invalid ROUTE_COSTS entry %q: expected [METHOD ]/path=cost with a positive cost", entry)
+		}
+		costs[strings.Join(strings.Fields(route), " ")] = cost
+	}
+	return costs, nil
+}
+
+func getEnvList(key string) []string {
+	return splitList(os.Getenv(key))
+}
+
+// splitList splits a comma separated list, dropping blank entries
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// loadListFile reads one entry per line, skipping blank lines and # comments
+func loadListFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+
+	return entries, scanner.Err()
+}
+
+// scanTokenEnv reads <prefix><token>_LIMIT and <prefix><token>_BLOCK_TIME variables
+func scanTokenEnv(prefix string, limits, blockTimes map[string]int) {
+	for _, env := range os.Environ() {
+		pair := strings.SplitN(env, "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+
+		key, value := pair[0], pair[1]
+
+		if strings.HasPrefix(key, prefix) && strings.HasSuffix(key, "_LIMIT") {
+			tokenName := strings.TrimPrefix(key, prefix)
+			tokenName = strings.TrimSuffix(tokenName, "_LIMIT")
+
+			if limit, err := strconv.Atoi(value); err == nil {
+				limits[tokenName] = limit
+			}
+		}
+
+		if strings.HasPrefix(key, prefix) && strings.HasSuffix(key, "_BLOCK_TIME") {
+			tokenName := strings.TrimPrefix(key, prefix)
+			tokenName = strings.TrimSuffix(tokenName, "_BLOCK_TIME")
+
+			if blockTime, err := strconv.Atoi(value); err == nil {
+				blockTimes[tokenName] = blockTime
+			}
+		}
+	}
+}
+
+// scanTokenAlgorithmEnv reads <prefix><token>_ALGORITHM and <prefix><token>_BUCKET_SIZE
+// variables, or _BURST for the bucket size
+func scanTokenAlgorithmEnv(prefix string, algorithms map[string]string, bucketSizes map[string]int) {
+	for _, env := range os.Environ() {
+		pair := strings.SplitN(env, "=", 2)
+		if len(pair) != 2 || !strings.HasPrefix(pair[0], prefix) {
+			continue
+		}
+
+		key, value := strings.TrimPrefix(pair[0], prefix), pair[1]
+		switch {
+		case strings.HasSuffix(key, "_ALGORITHM"):
+			algorithms[strings.TrimSuffix(key, "_ALGORITHM")] = strings.ToLower(strings.TrimSpace(value))
+		case strings.HasSuffix(key, "_BUCKET_SIZE"):
+			if size, err := strconv.Atoi(value); err == nil {
+				bucketSizes[strings.TrimSuffix(key, "_BUCKET_SIZE")] = size
+			}
+		case strings.HasSuffix(key, "_BURST"):
+			if size, err := strconv.Atoi(value); err == nil {
+				bucketSizes[strings.TrimSuffix(key, "_BURST")] = size
+			}
+		}
+	}
+}
+
+// scanTokenWindowEnv reads <prefix><token>_WINDOW variables
+func scanTokenWindowEnv(prefix string, windows map[string]int) {
+	values := make(map[string]string)
+	scanTokenSuffixEnv(prefix, "_WINDOW", values)
+	for token, value := range values {
+		if window, err := strconv.Atoi(value); err == nil {
+			windows[token] = window
+		}
+	}
+}
+
+// scanTokenQuotaEnv reads <prefix><token>_DAILY_QUOTA and <prefix><token>_MONTHLY_QUOTA variables
+func scanTokenQuotaEnv(prefix string, daily, monthly map[string]int) {
+	for _, env := range os.Environ() {
+		pair := strings.SplitN(env, "=", 2)
+		if len(pair) != 2 || !strings.HasPrefix(pair[0], prefix) {
+			continue
+		}
+
+		key, value := strings.TrimPrefix(pair[0], prefix), pair[1]
+		quota, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case strings.HasSuffix(key, "_DAILY_QUOTA"):
+			daily[strings.TrimSuffix(key, "_DAILY_QUOTA")] = quota
+		case strings.HasSuffix(key, "_MONTHLY_QUOTA"):
+			monthly[strings.TrimSuffix(key, "_MONTHLY_QUOTA")] = quota
+		}
+	}
+}
+
+// scanTokenAlertEnv reads <prefix><token>_QUOTA_ALERTS and <prefix><token>_CONTACT
+// variables. Invalid threshold lists are skipped with a warning.
+func scanTokenAlertEnv(prefix string, thresholds map[string][]int, contacts map[string]string) {
+	for _, env := range os.Environ() {
+		pair := strings.SplitN(env, "=", 2)
+		if len(pair) != 2 || !strings.HasPrefix(pair[0], prefix) {
+			continue
+		}
+
+		key, value := strings.TrimPrefix(pair[0], prefix), pair[1]
+		switch {
+		case strings.HasSuffix(key, "_QUOTA_ALERTS"):
+			parsed, err := parseThresholds(splitList(value))
+			if err != nil {
+				slog.Warn("Skipping invalid variable", "variable", pair[0], "error", err)
+				continue
+			}
+			thresholds[strings.TrimSuffix(key, "_QUOTA_ALERTS")] = parsed
+		case strings.HasSuffix(key, "_CONTACT"):
+			contacts[strings.TrimSuffix(key, "_CONTACT")] = strings.TrimSpace(value)
+		}
+	}
+}
+
+// parseStatuses reads HTTP status codes, such as 404, and classes, such as 5xx
+func parseStatuses(entries []string) ([]string, error) {
+	statuses := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		status := strings.ToLower(entry)
+		code, err := strconv.Atoi(strings.TrimSuffix(status, "xx"))
+		valid := err == nil && (code >= 100 && code <= 599 && len(status) == 3 || code >= 1 && code <= 5 && status == strconv.Itoa(code)+"xx")
+		if !valid {
+			return nil, fmt.Errorf("status %q must be a code between 100 and 599 or a class such as 5xx", entry)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// parseThresholds parses quota alert thresholds, percentages between 1 and 100
+func parseThresholds(entries []string) ([]int, error) {
+	thresholds := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		threshold, err := strconv.Atoi(strings.TrimSuffix(entry, "%"))
+		if err != nil || threshold < 1 || threshold > 100 {
+			return nil, fmt.Errorf("threshold %q must be a percentage between 1 and 100", entry)
+		}
+		thresholds = append(thresholds, threshold)
+	}
+	sort.Ints(thresholds)
+	return thresholds, nil
+}
+
+// loadApps reads the APPS list; each app inherits the base config and can override it
+// with APP_<NAME>_* variables. Hosts bound to a limit template by HOST_TEMPLATES are
+// served as apps too, one per host.
+func loadApps(base Config) []AppNamespace {
+	var apps []AppNamespace
+
+	for _, name := range getEnvList("APPS") {
+		prefix := "APP_" + strings.ToUpper(name) + "_"
+
+		app := AppNamespace{
+			Name:       name,
+			Hosts:      getEnvList(prefix + "HOSTS"),
+			PathPrefix: os.Getenv(prefix + "PATH_PREFIX"),
+			RateLimit:  base.Clone(),
+		}
+
+		applyLimitOverrides(prefix, &app.RateLimit)
+		app.RateLimit.AdminToken = os.Getenv(prefix + "ADMIN_TOKEN")
+		app.RateLimit.Denylist = append(app.RateLimit.Denylist, getEnvList(prefix+"DENYLIST")...)
+
+		apps = append(apps, app)
+	}
+
+	return append(apps, loadHostTemplates(base)...)
+}
+
+// loadHostTemplates reads HOST_TEMPLATES, a list of host=template pairs. A template is
+// a set of TEMPLATE_<NAME>_* overrides of the base config, shared by every host bound
+// to it; each host still gets its own counters, namespace and admin routes.
+func loadHostTemplates(base Config) []AppNamespace {
+	var apps []AppNamespace
+
+	for _, entry := range getEnvList("HOST_TEMPLATES") {
+		host, template, found := strings.Cut(entry, "=")
+		if !found || host == "" || template == "" {
+			slog.Warn("Skipping invalid HOST_TEMPLATES entry, expected host=template", "entry", entry)
+			continue
+		}
+		prefix := "TEMPLATE_" + strings.ToUpper(template) + "_"
+
+		app := AppNamespace{
+			Name:      strings.ToLower(host),
+			Hosts:     []string{host},
+			Template:  template,
+			RateLimit: base.Clone(),
+		}
+
+		applyLimitOverrides(prefix, &app.RateLimit)
+		app.RateLimit.AdminToken = os.Getenv(prefix + "ADMIN_TOKEN")
+		app.RateLimit.Denylist = append(app.RateLimit.Denylist, getEnvList(prefix+"DENYLIST")...)
+
+		apps = append(apps, app)
+	}
+
+	return apps
+}
+
+// applyLimitOverrides reads the IP limits, token limits, policies and quotas under the prefix
+func applyLimitOverrides(prefix string, config *Config) {
+	if val := os.Getenv(prefix + "IP_RATE_LIMIT"); val != "" {
+		if limit, err := strconv.Atoi(val); err == nil {
+			config.IPRateLimit = limit
+		}
+	}
+
+	if val := os.Getenv(prefix + "IP_BLOCK_TIME"); val != "" {
+		if blockTime, err := strconv.Atoi(val); err == nil {
+			config.IPBlockTime = blockTime
+		}
+	}
+
+	config.IPDailyQuota = getEnvInt(prefix+"IP_DAILY_QUOTA", config.IPDailyQuota)
+	config.IPMonthlyQuota = getEnvInt(prefix+"IP_MONTHLY_QUOTA", config.IPMonthlyQuota)
+
+	scanTokenEnv(prefix+"TOKEN_", config.TokenLimits, config.TokenBlockTimes)
+	scanTokenAlgorithmEnv(prefix+"TOKEN_", config.TokenAlgorithms, config.TokenBucketSizes)
+	scanTokenWindowEnv(prefix+"TOKEN_", config.TokenWindows)
+	scanTokenPolicyEnv(prefix+"TOKEN_", config.TokenPolicies)
+	loadTiers(prefix, config)
+	loadPolicies(prefix, config)
+	scanTokenQuotaEnv(prefix+"TOKEN_", config.TokenDailyQuotas, config.TokenMonthlyQuotas)
+	scanTokenAlertEnv(prefix+"TOKEN_", config.TokenQuotaAlertThresholds, config.TokenContacts)
+}
+
+// Clone returns a copy of the config that shares no maps or slices with the original
+func (c Config) Clone() Config {
+	clone := c
+
+	clone.TokenLimits = make(map[string]int, len(c.TokenLimits))
+	for token, limit := range c.TokenLimits {
+		clone.TokenLimits[token] = limit
+	}
+
+	clone.TokenBlockTimes = make(map[string]int, len(c.TokenBlockTimes))
+	for token, blockTime := range c.TokenBlockTimes {
+		clone.TokenBlockTimes[token] = blockTime
+	}
+
+	clone.TokenAlgorithms = make(map[string]string, len(c.TokenAlgorithms))
+	for token, algorithm := range c.TokenAlgorithms {
+		clone.TokenAlgorithms[token] = algorithm
+	}
+
+	clone.TokenBucketSizes = make(map[string]int, len(c.TokenBucketSizes))
+	for token, size := range c.TokenBucketSizes {
+		clone.TokenBucketSizes[token] = size
+	}
+
+	clone.TokenWindows = make(map[string]int, len(c.TokenWindows))
+	for token, window := range c.TokenWindows {
+		clone.TokenWindows[token] = window
+	}
+
+	clone.GeoIPDatabases = append([]string(nil), c.GeoIPDatabases...)
+	clone.BlockedCountries = append([]string(nil), c.BlockedCountries...)
+	clone.BlockedASNs = append([]string(nil), c.BlockedASNs...)
+	clone.CountryPolicies = make(map[string]string, len(c.CountryPolicies))
+	for country, name := range c.CountryPolicies {
+		clone.CountryPolicies[country] = name
+	}
+	clone.ASNPolicies = make(map[string]string, len(c.ASNPolicies))
+	for asn, name := range c.ASNPolicies {
+		clone.ASNPolicies[asn] = name
+	}
+
+	clone.NetworkLimits = make(map[string]int, len(c.NetworkLimits))
+	for network, limit := range c.NetworkLimits {
+		clone.NetworkLimits[network] = limit
+	}
+
+	clone.IdentityLimits = make(map[string]int, len(c.IdentityLimits))
+	for identity, limit := range c.IdentityLimits {
+		clone.IdentityLimits[identity] = limit
+	}
+
+	clone.IdentityPolicies = make(map[string]string, len(c.IdentityPolicies))
+	for identity, name := range c.IdentityPolicies {
+		clone.IdentityPolicies[identity] = name
+	}
+
+	clone.APISunsets = make(map[string]time.Time, len(c.APISunsets))
+	for version, sunset := range c.APISunsets {
+		clone.APISunsets[version] = sunset
+	}
+
+	clone.Policies = make(map[string]Policy, len(c.Policies))
+	for name, policy := range c.Policies {
+		policy.Windows = append([]ratelimiter.Window(nil), policy.Windows...)
+		clone.Policies[name] = policy
+	}
+
+	clone.TokenPolicies = make(map[string]string, len(c.TokenPolicies))
+	for token, name := range c.TokenPolicies {
+		clone.TokenPolicies[token] = name
+	}
+
+	clone.RoutePolicies = make(map[string]string, len(c.RoutePolicies))
+	for route, name := range c.RoutePolicies {
+		clone.RoutePolicies[route] = name
+	}
+
+	clone.PolicyRules = make([]PolicyRule, len(c.PolicyRules))
+	for i, rule := range c.PolicyRules {
+		rule.Methods = append([]string(nil), rule.Methods...)
+		clone.PolicyRules[i] = rule
+	}
+
+	clone.Denylist = append([]string(nil), c.Denylist...)
+	clone.APIKeyHeaders = append([]string(nil), c.APIKeyHeaders...)
+	clone.FingerprintHeaders = append([]string(nil), c.FingerprintHeaders...)
+	clone.ClientIPHeaders = append([]string(nil), c.ClientIPHeaders...)
+	clone.RefundStatuses = append([]string(nil), c.RefundStatuses...)
+	clone.FailurePaths = append([]string(nil), c.FailurePaths...)
+	clone.FailureStatuses = append([]string(nil), c.FailureStatuses...)
+
+	clone.TokenDailyQuotas = make(map[string]int, len(c.TokenDailyQuotas))
+	for token, quota := range c.TokenDailyQuotas {
+		clone.TokenDailyQuotas[token] = quota
+	}
+
+	clone.TokenMonthlyQuotas = make(map[string]int, len(c.TokenMonthlyQuotas))
+	for token, quota := range c.TokenMonthlyQuotas {
+		clone.TokenMonthlyQuotas[token] = quota
+	}
+
+	clone.QuotaAlertThresholds = append([]int(nil), c.QuotaAlertThresholds...)
+	clone.TokenQuotaAlertThresholds = make(map[string][]int, len(c.TokenQuotaAlertThresholds))
+	for token, thresholds := range c.TokenQuotaAlertThresholds {
+		clone.TokenQuotaAlertThresholds[token] = append([]int(nil), thresholds...)
+	}
+
+	clone.TokenContacts = make(map[string]string, len(c.TokenContacts))
+	for token, contact := range c.TokenContacts {
+		clone.TokenContacts[token] = contact
+	}
+
+	clone.RouteCosts = make(map[string]int, len(c.RouteCosts))
+	for route, cost := range c.RouteCosts {
+		clone.RouteCosts[route] = cost
+	}
+
+	return clone
+}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	ratelimiter "rate-limiter"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Drift kinds reported by Diff
+const (
+	DriftBan         = "ban"
+	DriftTokenConfig = "token_config"
+	DriftKey         = "key"
+)
+
+// Drift is an entry that differs between two storages. Source and Target describe the
+// entry on each side, empty where it is missing.
+type Drift struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// DiffOptions tunes what Diff compares. Counters move with every request, so by default
+// only their presence and block state are compared; CountTolerance > 0 also reports
+// counts further apart than it. SkipKeys compares the configuration alone.
+type DiffOptions struct {
+	CountTolerance int
+	SkipKeys       bool
+}
+
+// Diff compares the denylist, the token registry and the active counters of two
+// storages, such as the two sides of a blue/green migration or a DR replica, returning
+// the entries that differ sorted by kind and name
+func Diff(ctx context.Context, source, target ratelimiter.Storage, options DiffOptions) ([]Drift, error) {
+	var drifts []Drift
+
+	sourceBans, err := banDescriptions(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("source: %w", err)
+	}
+	targetBans, err := banDescriptions(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("target: %w", err)
+	}
+	drifts = appendDrifts(drifts, DriftBan, sourceBans, targetBans)
+
+	sourceTokens, err := tokenConfigDescriptions(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("source: %w", err)
+	}
+	targetTokens, err := tokenConfigDescriptions(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("target: %w", err)
+	}
+	drifts = appendDrifts(drifts, DriftTokenConfig, sourceTokens, targetTokens)
+
+	if !options.SkipKeys {
+		sourceKeys, err := keyStates(ctx, source)
+		if err != nil {
+			return nil, fmt.Errorf("source: %w", err)
+		}
+		targetKeys, err := keyStates(ctx, target)
+		if err != nil {
+			return nil, fmt.Errorf("target: %w", err)
+		}
+		drifts = appendKeyDrifts(drifts, sourceKeys, targetKeys, options.CountTolerance)
+	}
+
+	sort.Slice(drifts, func(i, j int) bool {
+		if drifts[i].Kind != drifts[j].Kind {
+			return drifts[i].Kind < drifts[j].Kind
+		}
+		return drifts[i].Name < drifts[j].Name
+	})
+	return drifts, nil
+}
+
+func banDescriptions(ctx context.Context, storage ratelimiter.Storage) (map[string]string, error) {
+	bans, err := storage.ListBans(ctx)
+	if err != nil {
+		return nil, err
+	}
+	descriptions := make(map[string]string, len(bans))
+	for _, ban := range bans {
+		descriptions[ban.Value] = "reason=" + ban.Reason
+	}
+	return descriptions, nil
+}
+
+func tokenConfigDescriptions(ctx context.Context, storage ratelimiter.Storage) (map[string]string, error) {
+	tokenConfigs, err := storage.ListTokenConfigs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	descriptions := make(map[string]string, len(tokenConfigs))
+	for _, tokenConfig := range tokenConfigs {
+		data, err := json.Marshal(tokenConfig)
+		if err != nil {
+			return nil, err
+		}
+		descriptions[tokenConfig.Name] = string(data)
+	}
+	return descriptions, nil
+}
+
+func keyStates(ctx context.Context, storage ratelimiter.Storage) (map[string]*ratelimiter.RateLimit, error) {
+	keys, err := storage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]*ratelimiter.RateLimit, len(keys))
+	for _, key := range keys {
+		state, err := storage.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		// a key may expire between List and Get
+		if state != nil {
+			states[key] = state
+		}
+	}
+	return states, nil
+}
+
+// appendDrifts reports the entries missing on either side or described differently
+func appendDrifts(drifts []Drift, kind string, source, target map[string]string) []Drift {
+	for name, description := range source {
+		if target[name] != description {
+			drifts = append(drifts, Drift{Kind: kind, Name: name, Source: description, Target: target[name]})
+		}
+	}
+	for name, description := range target {
+		if _, exists := source[name]; !exists {
+			drifts = append(drifts, Drift{Kind: kind, Name: name, Target: description})
+		}
+	}
+	return drifts
+}
+
+func appendKeyDrifts(drifts []Drift, source, target map[string]*ratelimiter.RateLimit, countTolerance int) []Drift {
+	for key, state := range source {
+		other, exists := target[key]
+		switch {
+		case !exists:
+			drifts = append(drifts, Drift{Kind: DriftKey, Name: key, Source: describeKey(state)})
+		case state.BlockedAt.IsZero() != other.BlockedAt.IsZero() || state.Violations != other.Violations,
+			countTolerance > 0 && abs(state.Count-other.Count) > countTolerance:
+			drifts = append(drifts, Drift{Kind: DriftKey, Name: key, Source: describeKey(state), Target: describeKey(other)})
+		}
+	}
+	for key, state := range target {
+		if _, exists := source[key]; !exists {
+			drifts = append(drifts, Drift{Kind: DriftKey, Name: key, Target: describeKey(state)})
+		}
+	}
+	return drifts
+}
+
+func describeKey(state *ratelimiter.RateLimit) string {
+	description := "count=" + strconv.Itoa(state.Count)
+	if !state.BlockedAt.IsZero() {
+		description += " blocked_at=" + state.BlockedAt.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	if state.Violations > 0 {
+		description += " violations=" + strconv.Itoa(state.Violations)
+	}
+	return description
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// ParseURL reads the storage config of a storage URL:
+//
+//	redis://[:password@]host[:port][/db]   (rediss:// for TLS)
+//	etcd://host[:port][,host[:port]...][/prefix]   (etcds:// for TLS, prefix ratelimiter/ by default)
+//	disk:///path/to/file
+func ParseURL(raw string) (ratelimiter.StorageConfig, error) {
+	scheme, rest, found := strings.Cut(raw, "://")
+	if !found {
+		return ratelimiter.StorageConfig{}, fmt.Errorf("invalid storage URL %q: missing scheme", raw)
+	}
+
+	switch scheme {
+	case "redis", "rediss":
+		parsed, err := url.Parse(raw)
+		if err != nil {
+			return ratelimiter.StorageConfig{}, fmt.Errorf("invalid storage URL %q: %w", raw, err)
+		}
+		config := ratelimiter.StorageConfig{
+			Backend:    BackendRedis,
+			Mode:       ratelimiter.RedisModeStandalone,
+			Host:       parsed.Hostname(),
+			Port:       parsed.Port(),
+			TLSEnabled: scheme == "rediss",
+		}
+		if config.Port == "" {
+			config.Port = "6379"
+		}
+		if password, set := parsed.User.Password(); set {
+			config.Password = password
+		}
+		if db := strings.Trim(parsed.Path, "/"); db != "" {
+			if config.DB, err = strconv.Atoi(db); err != nil {
+				return ratelimiter.StorageConfig{}, fmt.Errorf("invalid storage URL %q: the path must be the database number", raw)
+			}
+		}
+		return config, nil
+	case "etcd", "etcds":
+		hosts, prefix, _ := strings.Cut(rest, "/")
+		config := ratelimiter.StorageConfig{Backend: BackendEtcd, EtcdPrefix: prefix}
+		protocol := "http://"
+		if scheme == "etcds" {
+			protocol = "https://"
+		}
+		for _, host := range strings.Split(hosts, ",") {
+			if !strings.Contains(host, ":") {
+				host += ":2379"
+			}
+			config.EtcdEndpoints = append(config.EtcdEndpoints, protocol+host)
+		}
+		switch {
+		case prefix == "":
+			config.EtcdPrefix = "ratelimiter/"
+		case !strings.HasSuffix(prefix, "/"):
+			config.EtcdPrefix += "/"
+		}
+		return config, nil
+	case "disk":
+		if rest == "" {
+			return ratelimiter.StorageConfig{}, fmt.Errorf("invalid storage URL %q: missing path", raw)
+		}
+		return ratelimiter.StorageConfig{Backend: BackendDisk, DiskPath: rest, DiskSyncInterval: 1000}, nil
+	}
+	return ratelimiter.StorageConfig{}, fmt.Errorf("invalid storage URL %q: unknown scheme %s", raw, scheme)
+}
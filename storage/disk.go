@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	ratelimiter "rate-limiter"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// diskStateVersion is the format of the DiskStorage file
+const diskStateVersion = 1
+
+// DiskStorage is a MemoryStorage persisted to a local file, for single-node deployments
+// that keep their counters, bans and token registry across restarts without running
+// Redis. Counters are saved every syncInterval when they changed, so a crash loses at
+// most that much of them; bans and token configs are saved as soon as they change. The
+// file is replaced atomically, so a crash mid-save leaves the previous one intact. It
+// belongs to a single process: instances sharing it would overwrite each other.
+type DiskStorage struct {
+	*MemoryStorage
+
+	path  string
+	dirty atomic.Bool
+
+	saveMu  sync.Mutex
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type diskState struct {
+	Version int       `json:"version"`
+	SavedAt time.Time `json:"saved_at"`
+	memoryState
+}
+
+// NewDiskStorage loads the file at path, if any, and saves to it every syncInterval
+func NewDiskStorage(path string, syncInterval time.Duration) (*DiskStorage, error) {
+	d := &DiskStorage{
+		MemoryStorage: NewMemoryStorage(),
+		path:          path,
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
+	go d.run(syncInterval)
+
+	return d, nil
+}
+
+func (d *DiskStorage) load() error {
+	data, err := os.ReadFile(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read storage file: %w", err)
+	}
+
+	var state diskState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse storage file %s: %w", d.path, err)
+	}
+	if state.Version != diskStateVersion {
+		return fmt.Errorf("storage file %s has version %d, expected %d", d.path, state.Version, diskStateVersion)
+	}
+	d.MemoryStorage.restore(state.memoryState)
+	return nil
+}
+
+func (d *DiskStorage) run(syncInterval time.Duration) {
+	defer close(d.stopped)
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			if d.dirty.Load() {
+				if err := d.Save(); err != nil {
+					slog.Error("Failed to save the disk storage", "error", err)
+				}
+			}
+		}
+	}
+}
+
+// Save writes the storage to its file through a temporary file renamed over it
+func (d *DiskStorage) Save() error {
+	d.saveMu.Lock()
+	defer d.saveMu.Unlock()
+
+	d.dirty.Store(false)
+	data, err := json.Marshal(diskState{Version: diskStateVersion, SavedAt: time.Now().UTC(), memoryState: d.MemoryStorage.state()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal storage: %w", err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save storage: %w", err)
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to save storage: %w", err)
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to save storage: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to save storage: %w", err)
+	}
+	if err := os.Rename(temp.Name(), d.path); err != nil {
+		return fmt.Errorf("failed to save storage: %w", err)
+	}
+	return nil
+}
+
+// changed marks the counters for the next save
+func (d *DiskStorage) changed(err error) error {
+	if err == nil {
+		d.dirty.Store(true)
+	}
+	return err
+}
+
+// saved writes a change of the bans or the token registry through to the file
+func (d *DiskStorage) saved(err error) error {
+	if err != nil {
+		return err
+	}
+	return d.Save()
+}
+
+func (d *DiskStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
+	return d.changed(d.MemoryStorage.Set(ctx, key, rateLimit, expiration))
+}
+
+func (d *DiskStorage) SetMulti(ctx context.Context, entries []ratelimiter.RateLimitEntry) error {
+	return d.changed(d.MemoryStorage.SetMulti(ctx, entries))
+}
+
+func (d *DiskStorage) Delete(ctx context.Context, key string) error {
+	return d.changed(d.MemoryStorage.Delete(ctx, key))
+}
+
+func (d *DiskStorage) AllowWindows(ctx context.Context, checks []ratelimiter.WindowCheck, cost int, now time.Time) (ratelimiter.Result, error) {
+	result, err := d.MemoryStorage.AllowWindows(ctx, checks, cost, now)
+	return result, d.changed(err)
+}
+
+func (d *DiskStorage) Consume(ctx context.Context, key string, cost int, start time.Time, expiration time.Duration) (int, error) {
+	count, err := d.MemoryStorage.Consume(ctx, key, cost, start, expiration)
+	return count, d.changed(err)
+}
+
+func (d *DiskStorage) Refund(ctx context.Context, key string, cost int, at time.Time) error {
+	return d.changed(d.MemoryStorage.Refund(ctx, key, cost, at))
+}
+
+func (d *DiskStorage) AddUsage(ctx context.Context, period string, start time.Time, counts map[string]int64, retention time.Duration) error {
+	return d.changed(d.MemoryStorage.AddUsage(ctx, period, start, counts, retention))
+}
+
+func (d *DiskStorage) TakeUsage(ctx context.Context, period string, before time.Time) ([]*ratelimiter.UsageRecord, error) {
+	records, err := d.MemoryStorage.TakeUsage(ctx, period, before)
+	return records, d.changed(err)
+}
+
+func (d *DiskStorage) AddBan(ctx context.Context, ban *ratelimiter.Ban) error {
+	return d.saved(d.MemoryStorage.AddBan(ctx, ban))
+}
+
+func (d *DiskStorage) RemoveBan(ctx context.Context, value string) error {
+	return d.saved(d.MemoryStorage.RemoveBan(ctx, value))
+}
+
+func (d *DiskStorage) SetTokenConfig(ctx context.Context, tokenConfig *ratelimiter.TokenConfig) error {
+	return d.saved(d.MemoryStorage.SetTokenConfig(ctx, tokenConfig))
+}
+
+func (d *DiskStorage) DeleteTokenConfig(ctx context.Context, name string) error {
+	return d.saved(d.MemoryStorage.DeleteTokenConfig(ctx, name))
+}
+
+// Close stops the periodic saves and saves what changed since the last one
+func (d *DiskStorage) Close() error {
+	close(d.done)
+	<-d.stopped
+
+	if !d.dirty.Load() {
+		return nil
+	}
+	return d.Save()
+}
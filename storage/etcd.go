@@ -0,0 +1,766 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	ratelimiter "rate-limiter"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// etcdMaxAttempts bounds how often a read-modify-write is retried when another writer
+// changed the keys in between
+const etcdMaxAttempts = 16
+
+var errEtcdUnauthorized = errors.New("etcd: unauthorized")
+
+// EtcdStorage keeps the counters, the denylist, the token registry, usage and leases in
+// etcd, talking to it through the JSON gateway of its v3 API, for environments that
+// already operate etcd and want its strong consistency for the counters. Counters
+// expire through etcd leases, shared by the keys expiring within the same second, so
+// expirations are rounded up to the second. Checks and consumption read the keys and
+// write them back in a transaction conditioned on their revisions, retried when
+// another instance got there first.
+type EtcdStorage struct {
+	endpoints []string
+	prefix    string
+	username  string
+	password  string
+	encoding  string
+	client    *http.Client
+
+	mu       sync.Mutex
+	endpoint int
+	token    string
+	leases   map[int64]int64
+}
+
+// NewEtcdStorage connects to the first reachable of EtcdEndpoints
+func NewEtcdStorage(config ratelimiter.StorageConfig) (ratelimiter.Storage, error) {
+	endpoints := make([]string, 0, len(config.EtcdEndpoints))
+	for _, endpoint := range config.EtcdEndpoints {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+		endpoints = append(endpoints, strings.TrimSuffix(endpoint, "/"))
+	}
+	if len(endpoints) == 0 {
+		endpoints = []string{"http://localhost:2379"}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.EtcdTLSCACert != "" || config.EtcdTLSCert != "" || config.EtcdTLSKey != "" {
+		tlsConfig, err := newTLSConfig(ratelimiter.StorageConfig{
+			TLSEnabled: true,
+			TLSCACert:  config.EtcdTLSCACert,
+			TLSCert:    config.EtcdTLSCert,
+			TLSKey:     config.EtcdTLSKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	e := &EtcdStorage{
+		endpoints: endpoints,
+		prefix:    config.EtcdPrefix,
+		username:  config.EtcdUsername,
+		password:  config.EtcdPassword,
+		encoding:  config.CounterEncoding,
+		client:    &http.Client{Transport: transport, Timeout: 5 * time.Second},
+		leases:    make(map[int64]int64),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if e.username != "" {
+		if err := e.authenticate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.call(ctx, "/v3/maintenance/status", struct{}{}, nil); err != nil {
+		return nil, fmt.Errorf("failed to connect to etcd: %w", err)
+	}
+
+	return e, nil
+}
+
+// etcdKeyValue is a key of a range or delete response. Keys and values are base64 in the
+// JSON gateway, like []byte in encoding/json, and 64 bit integers are strings.
+type etcdKeyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+	KeysOnly bool   `json:"keys_only,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+type etcdPutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease int64  `json:"lease,omitempty,string"`
+	// IgnoreLease keeps the lease the key already has
+	IgnoreLease bool `json:"ignore_lease,omitempty"`
+}
+
+type etcdDeleteRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+	PrevKv   bool   `json:"prev_kv,omitempty"`
+}
+
+type etcdDeleteResponse struct {
+	PrevKvs []etcdKeyValue `json:"prev_kvs"`
+}
+
+// etcdCompare is a condition of a transaction: the mod revision (0 for a missing key)
+// or the value of the key equals the given one
+type etcdCompare struct {
+	Target      string `json:"target"`
+	Key         []byte `json:"key"`
+	Result      string `json:"result"`
+	ModRevision string `json:"mod_revision,omitempty"`
+	Value       []byte `json:"value,omitempty"`
+}
+
+type etcdOp struct {
+	RequestRange       *etcdRangeRequest  `json:"request_range,omitempty"`
+	RequestPut         *etcdPutRequest    `json:"request_put,omitempty"`
+	RequestDeleteRange *etcdDeleteRequest `json:"request_delete_range,omitempty"`
+}
+
+type etcdTxnRequest struct {
+	Compare []etcdCompare `json:"compare,omitempty"`
+	Success []etcdOp      `json:"success,omitempty"`
+	Failure []etcdOp      `json:"failure,omitempty"`
+}
+
+type etcdTxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+	Responses []struct {
+		ResponseRange *etcdRangeResponse `json:"response_range"`
+	} `json:"responses"`
+}
+
+func modRevisionIs(key []byte, revision int64) etcdCompare {
+	return etcdCompare{Target: "MOD", Key: key, Result: "EQUAL", ModRevision: strconv.FormatInt(revision, 10)}
+}
+
+func valueIs(key []byte, value string) etcdCompare {
+	return etcdCompare{Target: "VALUE", Key: key, Result: "EQUAL", Value: []byte(value)}
+}
+
+// prefixEnd is the end of the range of the keys starting with prefix
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+// call posts the request to the gateway, trying the endpoints in turn from the last one
+// that answered, and authenticating again once when the token expired
+func (e *EtcdStorage) call(ctx context.Context, path string, request, response any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	err = e.post(ctx, path, body, response)
+	if errors.Is(err, errEtcdUnauthorized) && e.username != "" {
+		if err = e.authenticate(ctx); err == nil {
+			err = e.post(ctx, path, body, response)
+		}
+	}
+	return err
+}
+
+func (e *EtcdStorage) post(ctx context.Context, path string, body []byte, response any) error {
+	e.mu.Lock()
+	first, token := e.endpoint, e.token
+	e.mu.Unlock()
+
+	var err error
+	for i := range e.endpoints {
+		current := (first + i) % len(e.endpoints)
+		var resp *http.Response
+		if resp, err = e.send(ctx, e.endpoints[current]+path, token, body); err != nil {
+			continue
+		}
+
+		e.mu.Lock()
+		e.endpoint = current
+		e.mu.Unlock()
+		return decodeEtcdResponse(resp, response)
+	}
+	return err
+}
+
+func (e *EtcdStorage) send(ctx context.Context, url, token string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return e.client.Do(req)
+}
+
+func decodeEtcdResponse(resp *http.Response, response any) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Message string `json:"message"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		json.Unmarshal(data, &failure)
+		if resp.StatusCode == http.StatusUnauthorized || strings.Contains(failure.Message, "invalid auth token") {
+			return errEtcdUnauthorized
+		}
+		return fmt.Errorf("etcd returned status %d: %s", resp.StatusCode, failure.Message)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// authenticate trades EtcdUsername and EtcdPassword for a token sent with every request
+func (e *EtcdStorage) authenticate(ctx context.Context) error {
+	body, err := json.Marshal(map[string]string{"name": e.username, "password": e.password})
+	if err != nil {
+		return err
+	}
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err := e.post(ctx, "/v3/auth/authenticate", body, &auth); err != nil {
+		return fmt.Errorf("failed to authenticate to etcd: %w", err)
+	}
+
+	e.mu.Lock()
+	e.token = auth.Token
+	e.mu.Unlock()
+	return nil
+}
+
+// lease returns a lease expiring once expiration has passed, 0 for none. The keys
+// expiring within the same second share one, so a check grants at most one per second.
+func (e *EtcdStorage) lease(ctx context.Context, expiration time.Duration) (int64, error) {
+	if expiration <= 0 {
+		return 0, nil
+	}
+	now := time.Now()
+	second := now.Add(expiration).Unix() + 1
+
+	e.mu.Lock()
+	id, exists := e.leases[second]
+	e.mu.Unlock()
+	if exists {
+		return id, nil
+	}
+
+	var grant struct {
+		ID int64 `json:"ID,string"`
+	}
+	if err := e.call(ctx, "/v3/lease/grant", map[string]string{"TTL": strconv.FormatInt(second-now.Unix(), 10)}, &grant); err != nil {
+		return 0, fmt.Errorf("failed to grant etcd lease: %w", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for expiry := range e.leases {
+		// leave a second of margin so a lease is never handed out as it expires
+		if expiry <= now.Unix()+1 {
+			delete(e.leases, expiry)
+		}
+	}
+	e.leases[second] = grant.ID
+	return grant.ID, nil
+}
+
+func (e *EtcdStorage) limitKey(key string) []byte {
+	return []byte(e.prefix + "limits/" + key)
+}
+
+func (e *EtcdStorage) rangeKeys(ctx context.Context, key, rangeEnd []byte) ([]etcdKeyValue, error) {
+	var response etcdRangeResponse
+	if err := e.call(ctx, "/v3/kv/range", etcdRangeRequest{Key: key, RangeEnd: rangeEnd}, &response); err != nil {
+		return nil, err
+	}
+	return response.Kvs, nil
+}
+
+func (e *EtcdStorage) put(ctx context.Context, key []byte, value any, expiration time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return e.putData(ctx, key, data, expiration)
+}
+
+func (e *EtcdStorage) putData(ctx context.Context, key, data []byte, expiration time.Duration) error {
+	lease, err := e.lease(ctx, expiration)
+	if err != nil {
+		return err
+	}
+	return e.call(ctx, "/v3/kv/put", etcdPutRequest{Key: key, Value: data, Lease: lease}, nil)
+}
+
+func (e *EtcdStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLimit, error) {
+	kvs, err := e.rangeKeys(ctx, e.limitKey(key), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get from etcd: %w", err)
+	}
+	if len(kvs) == 0 {
+		return nil, nil
+	}
+
+	rateLimit, err := ratelimiter.DecodeRateLimit(kvs[0].Value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rate limit: %w", err)
+	}
+	return rateLimit, nil
+}
+
+func (e *EtcdStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
+	data, err := ratelimiter.EncodeRateLimit(rateLimit, e.encoding)
+	if err != nil {
+		return fmt.Errorf("failed to marshal rate limit: %w", err)
+	}
+	if err := e.putData(ctx, e.limitKey(key), data, expiration); err != nil {
+		return fmt.Errorf("failed to set in etcd: %w", err)
+	}
+	return nil
+}
+
+// GetMulti reads the counters in one transaction
+func (e *EtcdStorage) GetMulti(ctx context.Context, keys []string) ([]*ratelimiter.RateLimit, error) {
+	reads := make([]etcdOp, len(keys))
+	for i, key := range keys {
+		reads[i] = etcdOp{RequestRange: &etcdRangeRequest{Key: e.limitKey(key)}}
+	}
+
+	var read etcdTxnResponse
+	if err := e.call(ctx, "/v3/kv/txn", etcdTxnRequest{Success: reads}, &read); err != nil {
+		return nil, fmt.Errorf("failed to get from etcd: %w", err)
+	}
+	if len(read.Responses) != len(keys) {
+		return nil, fmt.Errorf("unexpected etcd transaction reply with %d responses", len(read.Responses))
+	}
+
+	rateLimits := make([]*ratelimiter.RateLimit, len(keys))
+	for i, response := range read.Responses {
+		if response.ResponseRange == nil || len(response.ResponseRange.Kvs) == 0 {
+			continue
+		}
+		rateLimit, err := ratelimiter.DecodeRateLimit(response.ResponseRange.Kvs[0].Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal rate limit: %w", err)
+		}
+		rateLimits[i] = rateLimit
+	}
+	return rateLimits, nil
+}
+
+// SetMulti writes the counters in one transaction
+func (e *EtcdStorage) SetMulti(ctx context.Context, entries []ratelimiter.RateLimitEntry) error {
+	writes := make([]etcdOp, len(entries))
+	for i, entry := range entries {
+		data, err := ratelimiter.EncodeRateLimit(entry.RateLimit, e.encoding)
+		if err != nil {
+			return fmt.Errorf("failed to marshal rate limit: %w", err)
+		}
+		lease, err := e.lease(ctx, entry.Expiration)
+		if err != nil {
+			return fmt.Errorf("failed to set in etcd: %w", err)
+		}
+		writes[i] = etcdOp{RequestPut: &etcdPutRequest{Key: e.limitKey(entry.Key), Value: data, Lease: lease}}
+	}
+
+	if err := e.call(ctx, "/v3/kv/txn", etcdTxnRequest{Success: writes}, nil); err != nil {
+		return fmt.Errorf("failed to set in etcd: %w", err)
+	}
+	return nil
+}
+
+// AllowWindows reads every window in one transaction, applies the check and writes the
+// windows it changed in a transaction conditioned on none of them having changed since
+func (e *EtcdStorage) AllowWindows(ctx context.Context, checks []ratelimiter.WindowCheck, cost int, now time.Time) (ratelimiter.Result, error) {
+	reads := make([]etcdOp, len(checks))
+	for i, check := range checks {
+		reads[i] = etcdOp{RequestRange: &etcdRangeRequest{Key: e.limitKey(check.Key)}}
+	}
+
+	for attempt := 0; attempt < etcdMaxAttempts; attempt++ {
+		var read etcdTxnResponse
+		if err := e.call(ctx, "/v3/kv/txn", etcdTxnRequest{Success: reads}, &read); err != nil {
+			return ratelimiter.Result{}, fmt.Errorf("failed to check rate limit in etcd: %w", err)
+		}
+		if len(read.Responses) != len(checks) {
+			return ratelimiter.Result{}, fmt.Errorf("unexpected etcd transaction reply with %d responses", len(read.Responses))
+		}
+
+		states := make([]*ratelimiter.RateLimit, len(checks))
+		compares := make([]etcdCompare, len(checks))
+		for i, check := range checks {
+			states[i] = &ratelimiter.RateLimit{LastReset: now}
+			var revision int64
+			if response := read.Responses[i].ResponseRange; response != nil && len(response.Kvs) > 0 {
+				state, err := ratelimiter.DecodeRateLimit(response.Kvs[0].Value)
+				if err != nil {
+					return ratelimiter.Result{}, fmt.Errorf("failed to unmarshal rate limit: %w", err)
+				}
+				states[i] = state
+				revision = response.Kvs[0].ModRevision
+			}
+			compares[i] = modRevisionIs(e.limitKey(check.Key), revision)
+		}
+
+		result := ratelimiter.ApplyWindows(states, checks, cost, now)
+		var writes []etcdOp
+		for i, check := range checks {
+			if !ratelimiter.WindowChanged(result, states[i], now) {
+				continue
+			}
+			data, err := ratelimiter.EncodeRateLimit(states[i], e.encoding)
+			if err != nil {
+				return ratelimiter.Result{}, err
+			}
+			lease, err := e.lease(ctx, check.Expiration(states[i], now))
+			if err != nil {
+				return ratelimiter.Result{}, err
+			}
+			writes = append(writes, etcdOp{RequestPut: &etcdPutRequest{Key: e.limitKey(check.Key), Value: data, Lease: lease}})
+		}
+		if len(writes) == 0 {
+			return result, nil
+		}
+
+		var write etcdTxnResponse
+		if err := e.call(ctx, "/v3/kv/txn", etcdTxnRequest{Compare: compares, Success: writes}, &write); err != nil {
+			return ratelimiter.Result{}, fmt.Errorf("failed to check rate limit in etcd: %w", err)
+		}
+		if write.Succeeded {
+			return result, nil
+		}
+	}
+	return ratelimiter.Result{}, fmt.Errorf("failed to check rate limit in etcd: the keys kept changing")
+}
+
+// Consume adds cost to the counter of the key with a write conditioned on its revision
+func (e *EtcdStorage) Consume(ctx context.Context, key string, cost int, start time.Time, expiration time.Duration) (int, error) {
+	etcdKey := e.limitKey(key)
+	for attempt := 0; attempt < etcdMaxAttempts; attempt++ {
+		kvs, err := e.rangeKeys(ctx, etcdKey, nil)
+		if err != nil {
+			return 0, fmt.Errorf("failed to consume in etcd: %w", err)
+		}
+
+		state := &ratelimiter.RateLimit{LastReset: start}
+		var revision int64
+		if len(kvs) > 0 {
+			if state, err = ratelimiter.DecodeRateLimit(kvs[0].Value); err != nil {
+				return 0, fmt.Errorf("failed to unmarshal rate limit: %w", err)
+			}
+			revision = kvs[0].ModRevision
+		}
+		state.Count += cost
+
+		data, err := ratelimiter.EncodeRateLimit(state, e.encoding)
+		if err != nil {
+			return 0, err
+		}
+		lease, err := e.lease(ctx, expiration)
+		if err != nil {
+			return 0, err
+		}
+		var txn etcdTxnResponse
+		err = e.call(ctx, "/v3/kv/txn", etcdTxnRequest{
+			Compare: []etcdCompare{modRevisionIs(etcdKey, revision)},
+			Success: []etcdOp{{RequestPut: &etcdPutRequest{Key: etcdKey, Value: data, Lease: lease}}},
+		}, &txn)
+		if err != nil {
+			return 0, fmt.Errorf("failed to consume in etcd: %w", err)
+		}
+		if txn.Succeeded {
+			return state.Count, nil
+		}
+	}
+	return 0, fmt.Errorf("failed to consume in etcd: the key kept changing")
+}
+
+// Refund takes cost back from the counter of the key with a write conditioned on its
+// revision, keeping its lease
+func (e *EtcdStorage) Refund(ctx context.Context, key string, cost int, at time.Time) error {
+	etcdKey := e.limitKey(key)
+	for attempt := 0; attempt < etcdMaxAttempts; attempt++ {
+		kvs, err := e.rangeKeys(ctx, etcdKey, nil)
+		if err != nil {
+			return fmt.Errorf("failed to refund in etcd: %w", err)
+		}
+		if len(kvs) == 0 {
+			return nil
+		}
+		state, err := ratelimiter.DecodeRateLimit(kvs[0].Value)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal rate limit: %w", err)
+		}
+		if state.LastReset.After(at) {
+			return nil
+		}
+		state.Count = max(state.Count-cost, 0)
+
+		data, err := ratelimiter.EncodeRateLimit(state, e.encoding)
+		if err != nil {
+			return err
+		}
+		var txn etcdTxnResponse
+		err = e.call(ctx, "/v3/kv/txn", etcdTxnRequest{
+			Compare: []etcdCompare{modRevisionIs(etcdKey, kvs[0].ModRevision)},
+			Success: []etcdOp{{RequestPut: &etcdPutRequest{Key: etcdKey, Value: data, IgnoreLease: true}}},
+		}, &txn)
+		if err != nil {
+			return fmt.Errorf("failed to refund in etcd: %w", err)
+		}
+		if txn.Succeeded {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to refund in etcd: the key kept changing")
+}
+
+func (e *EtcdStorage) Delete(ctx context.Context, key string) error {
+	if err := e.call(ctx, "/v3/kv/deleterange", etcdDeleteRequest{Key: e.limitKey(key)}, nil); err != nil {
+		return fmt.Errorf("failed to delete from etcd: %w", err)
+	}
+	return nil
+}
+
+// List returns every rate limit key
+func (e *EtcdStorage) List(ctx context.Context) ([]string, error) {
+	prefix := e.limitKey("")
+	var response etcdRangeResponse
+	if err := e.call(ctx, "/v3/kv/range", etcdRangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix), KeysOnly: true}, &response); err != nil {
+		return nil, fmt.Errorf("failed to list keys from etcd: %w", err)
+	}
+
+	keys := make([]string, 0, len(response.Kvs))
+	for _, kv := range response.Kvs {
+		keys = append(keys, strings.TrimPrefix(string(kv.Key), string(prefix)))
+	}
+	return keys, nil
+}
+
+// listValues decodes every value under the prefix with decode
+func (e *EtcdStorage) listValues(ctx context.Context, prefix string, decode func([]byte) error) error {
+	kvs, err := e.rangeKeys(ctx, []byte(prefix), prefixEnd([]byte(prefix)))
+	if err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		if err := decode(kv.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *EtcdStorage) AddBan(ctx context.Context, ban *ratelimiter.Ban) error {
+	if err := e.put(ctx, []byte(e.prefix+"denylist/"+ban.Value), ban, 0); err != nil {
+		return fmt.Errorf("failed to add ban in etcd: %w", err)
+	}
+	return nil
+}
+
+func (e *EtcdStorage) RemoveBan(ctx context.Context, value string) error {
+	if err := e.call(ctx, "/v3/kv/deleterange", etcdDeleteRequest{Key: []byte(e.prefix + "denylist/" + value)}, nil); err != nil {
+		return fmt.Errorf("failed to remove ban from etcd: %w", err)
+	}
+	return nil
+}
+
+func (e *EtcdStorage) ListBans(ctx context.Context) ([]*ratelimiter.Ban, error) {
+	bans := make([]*ratelimiter.Ban, 0)
+	err := e.listValues(ctx, e.prefix+"denylist/", func(data []byte) error {
+		var ban ratelimiter.Ban
+		if err := json.Unmarshal(data, &ban); err != nil {
+			return fmt.Errorf("failed to unmarshal ban: %w", err)
+		}
+		bans = append(bans, &ban)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bans from etcd: %w", err)
+	}
+	return bans, nil
+}
+
+func (e *EtcdStorage) SetTokenConfig(ctx context.Context, tokenConfig *ratelimiter.TokenConfig) error {
+	if err := e.put(ctx, []byte(e.prefix+"token_configs/"+tokenConfig.Name), tokenConfig, 0); err != nil {
+		return fmt.Errorf("failed to set token config in etcd: %w", err)
+	}
+	return nil
+}
+
+func (e *EtcdStorage) DeleteTokenConfig(ctx context.Context, name string) error {
+	if err := e.call(ctx, "/v3/kv/deleterange", etcdDeleteRequest{Key: []byte(e.prefix + "token_configs/" + name)}, nil); err != nil {
+		return fmt.Errorf("failed to delete token config from etcd: %w", err)
+	}
+	return nil
+}
+
+func (e *EtcdStorage) ListTokenConfigs(ctx context.Context) ([]*ratelimiter.TokenConfig, error) {
+	tokenConfigs := make([]*ratelimiter.TokenConfig, 0)
+	err := e.listValues(ctx, e.prefix+"token_configs/", func(data []byte) error {
+		var tokenConfig ratelimiter.TokenConfig
+		if err := json.Unmarshal(data, &tokenConfig); err != nil {
+			return fmt.Errorf("failed to unmarshal token config: %w", err)
+		}
+		tokenConfigs = append(tokenConfigs, &tokenConfig)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list token configs from etcd: %w", err)
+	}
+	return tokenConfigs, nil
+}
+
+// usageKey orders the usage buckets of a period by start time, zero padded so the key
+// order is the time order
+func (e *EtcdStorage) usageKey(period string, start int64) string {
+	return fmt.Sprintf("%susage/%s/%020d/", e.prefix, period, start)
+}
+
+// AddUsage writes the counts as a new entry of the bucket rather than incrementing
+// shared counters, so instances never contend on them; reads sum the entries
+func (e *EtcdStorage) AddUsage(ctx context.Context, period string, start time.Time, counts map[string]int64, retention time.Duration) error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	if err := e.put(ctx, []byte(e.usageKey(period, start.Unix())+hex.EncodeToString(id)), counts, retention); err != nil {
+		return fmt.Errorf("failed to add usage in etcd: %w", err)
+	}
+	return nil
+}
+
+// TakeUsage deletes the buckets and returns what they held in a single request, so
+// concurrent rollups on several instances never count a bucket twice
+func (e *EtcdStorage) TakeUsage(ctx context.Context, period string, before time.Time) ([]*ratelimiter.UsageRecord, error) {
+	var response etcdDeleteResponse
+	request := etcdDeleteRequest{Key: []byte(e.usageKey(period, 0)), RangeEnd: []byte(e.usageKey(period, before.Unix())), PrevKv: true}
+	if err := e.call(ctx, "/v3/kv/deleterange", request, &response); err != nil {
+		return nil, fmt.Errorf("failed to take usage buckets from etcd: %w", err)
+	}
+	return e.usageRecords(period, response.PrevKvs), nil
+}
+
+func (e *EtcdStorage) ListUsage(ctx context.Context, period string, from, to time.Time) ([]*ratelimiter.UsageRecord, error) {
+	kvs, err := e.rangeKeys(ctx, []byte(e.usageKey(period, from.Unix())), []byte(e.usageKey(period, to.Unix()+1)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list usage buckets from etcd: %w", err)
+	}
+	return e.usageRecords(period, kvs), nil
+}
+
+// usageRecords sums the entries of each bucket by key
+func (e *EtcdStorage) usageRecords(period string, kvs []etcdKeyValue) []*ratelimiter.UsageRecord {
+	type bucketKey struct {
+		start int64
+		key   string
+	}
+	totals := make(map[bucketKey]int64)
+	prefix := e.prefix + "usage/" + period + "/"
+	for _, kv := range kvs {
+		start, err := strconv.ParseInt(strings.SplitN(strings.TrimPrefix(string(kv.Key), prefix), "/", 2)[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		var counts map[string]int64
+		if err := json.Unmarshal(kv.Value, &counts); err != nil {
+			continue
+		}
+		for key, count := range counts {
+			totals[bucketKey{start, key}] += count
+		}
+	}
+
+	records := make([]*ratelimiter.UsageRecord, 0, len(totals))
+	for bucket, count := range totals {
+		records = append(records, &ratelimiter.UsageRecord{
+			Key:    bucket.key,
+			Period: period,
+			Start:  time.Unix(bucket.start, 0).UTC(),
+			Count:  count,
+		})
+	}
+	return records
+}
+
+// AcquireLease takes the lease when nobody holds it, or renews it for its holder, the
+// key expiring with an etcd lease of the TTL
+func (e *EtcdStorage) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	key := []byte(e.prefix + "lease/" + name)
+	lease, err := e.lease(ctx, ttl)
+	if err != nil {
+		return false, err
+	}
+	put := []etcdOp{{RequestPut: &etcdPutRequest{Key: key, Value: []byte(holder), Lease: lease}}}
+
+	for _, condition := range []etcdCompare{modRevisionIs(key, 0), valueIs(key, holder)} {
+		var txn etcdTxnResponse
+		if err := e.call(ctx, "/v3/kv/txn", etcdTxnRequest{Compare: []etcdCompare{condition}, Success: put}, &txn); err != nil {
+			return false, fmt.Errorf("failed to acquire lease in etcd: %w", err)
+		}
+		if txn.Succeeded {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (e *EtcdStorage) ReleaseLease(ctx context.Context, name, holder string) error {
+	key := []byte(e.prefix + "lease/" + name)
+	err := e.call(ctx, "/v3/kv/txn", etcdTxnRequest{
+		Compare: []etcdCompare{valueIs(key, holder)},
+		Success: []etcdOp{{RequestDeleteRange: &etcdDeleteRequest{Key: key}}},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to release lease in etcd: %w", err)
+	}
+	return nil
+}
+
+func (e *EtcdStorage) Ping(ctx context.Context) error {
+	return e.call(ctx, "/v3/maintenance/status", struct{}{}, nil)
+}
+
+func (e *EtcdStorage) Close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
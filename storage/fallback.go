@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	ratelimiter "rate-limiter"
+	"sync"
+	"time"
+)
+
+// ErrFallbackActive wraps the error of a failed Ping of the primary storage, whose
+// counters are served from the in-memory fallback meanwhile
+var ErrFallbackActive = errors.New("primary storage unavailable, counters served from the in-memory fallback")
+
+// FallbackStorage serves counters from an in-process store while the primary storage
+// is failing. A circuit breaker opens on the first failed or timed out call and lets a
+// single probe through to the primary every probeInterval; a successful probe closes it.
+//
+// Only counter operations fall back: bans and token configs keep going to the primary
+// so a blip never replaces them with empty in-memory data.
+type FallbackStorage struct {
+	ratelimiter.Storage
+
+	fallback      *MemoryStorage
+	timeout       time.Duration
+	probeInterval time.Duration
+
+	mu        sync.Mutex
+	open      bool
+	nextProbe time.Time
+}
+
+func NewFallbackStorage(primary ratelimiter.Storage, timeout, probeInterval time.Duration) *FallbackStorage {
+	return &FallbackStorage{
+		Storage:       primary,
+		fallback:      NewMemoryStorage(),
+		timeout:       timeout,
+		probeInterval: probeInterval,
+	}
+}
+
+// usePrimary reports whether the call should go to the primary, letting one probe
+// through when the breaker is open and the probe interval has elapsed
+func (f *FallbackStorage) usePrimary() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.open {
+		return true
+	}
+	if time.Now().Before(f.nextProbe) {
+		return false
+	}
+
+	f.nextProbe = time.Now().Add(f.probeInterval)
+	return true
+}
+
+// record opens the breaker on a failed call and closes it on a successful one. A call
+// cancelled by its caller, such as a client that went away, says nothing of the primary.
+func (f *FallbackStorage) record(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err == nil {
+		if f.open {
+			slog.Info("Primary storage recovered, leaving in-memory fallback")
+		}
+		f.open = false
+		return
+	}
+
+	if !f.open {
+		slog.Warn("Primary storage failed, using in-memory fallback", "error", err)
+	}
+	f.open = true
+	f.nextProbe = time.Now().Add(f.probeInterval)
+}
+
+// Ping checks the primary storage. While it fails, counters are served from memory, so
+// the error wraps ErrFallbackActive.
+func (f *FallbackStorage) Ping(ctx context.Context) error {
+	if err := f.Storage.Ping(ctx); err != nil {
+		return fmt.Errorf("%w: %v", ErrFallbackActive, err)
+	}
+	return nil
+}
+
+// IsFallbackActive reports whether counters are currently served from memory
+func (f *FallbackStorage) IsFallbackActive() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.open
+}
+
+func (f *FallbackStorage) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if f.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, f.timeout)
+}
+
+func (f *FallbackStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLimit, error) {
+	if f.usePrimary() {
+		primaryCtx, cancel := f.withTimeout(ctx)
+		rateLimit, err := f.Storage.Get(primaryCtx, key)
+		cancel()
+
+		f.record(err)
+		if err == nil {
+			return rateLimit, nil
+		}
+	}
+
+	return f.fallback.Get(ctx, key)
+}
+
+func (f *FallbackStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
+	if f.usePrimary() {
+		primaryCtx, cancel := f.withTimeout(ctx)
+		err := f.Storage.Set(primaryCtx, key, rateLimit, expiration)
+		cancel()
+
+		f.record(err)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return f.fallback.Set(ctx, key, rateLimit, expiration)
+}
+
+func (f *FallbackStorage) GetMulti(ctx context.Context, keys []string) ([]*ratelimiter.RateLimit, error) {
+	if f.usePrimary() {
+		primaryCtx, cancel := f.withTimeout(ctx)
+		rateLimits, err := f.Storage.GetMulti(primaryCtx, keys)
+		cancel()
+
+		f.record(err)
+		if err == nil {
+			return rateLimits, nil
+		}
+	}
+
+	return f.fallback.GetMulti(ctx, keys)
+}
+
+func (f *FallbackStorage) SetMulti(ctx context.Context, entries []ratelimiter.RateLimitEntry) error {
+	if f.usePrimary() {
+		primaryCtx, cancel := f.withTimeout(ctx)
+		err := f.Storage.SetMulti(primaryCtx, entries)
+		cancel()
+
+		f.record(err)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return f.fallback.SetMulti(ctx, entries)
+}
+
+// AllowWindows runs the atomic check on the primary, or in memory while it is failing
+func (f *FallbackStorage) AllowWindows(ctx context.Context, checks []ratelimiter.WindowCheck, cost int, now time.Time) (ratelimiter.Result, error) {
+	atomic, ok := f.Storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return ratelimiter.Result{}, ratelimiter.ErrNotAtomic
+	}
+
+	if f.usePrimary() {
+		primaryCtx, cancel := f.withTimeout(ctx)
+		result, err := atomic.AllowWindows(primaryCtx, checks, cost, now)
+		cancel()
+
+		if errors.Is(err, ratelimiter.ErrNotAtomic) {
+			return result, err
+		}
+		f.record(err)
+		if err == nil {
+			return result, nil
+		}
+	}
+
+	return f.fallback.AllowWindows(ctx, checks, cost, now)
+}
+
+// Consume adds the cost on the primary, or in memory while it is failing
+func (f *FallbackStorage) Consume(ctx context.Context, key string, cost int, start time.Time, expiration time.Duration) (int, error) {
+	atomic, ok := f.Storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return 0, ratelimiter.ErrNotAtomic
+	}
+
+	if f.usePrimary() {
+		primaryCtx, cancel := f.withTimeout(ctx)
+		count, err := atomic.Consume(primaryCtx, key, cost, start, expiration)
+		cancel()
+
+		if errors.Is(err, ratelimiter.ErrNotAtomic) {
+			return count, err
+		}
+		f.record(err)
+		if err == nil {
+			return count, nil
+		}
+	}
+
+	return f.fallback.Consume(ctx, key, cost, start, expiration)
+}
+
+// Refund takes the cost back on the primary, or in memory while it is failing
+func (f *FallbackStorage) Refund(ctx context.Context, key string, cost int, at time.Time) error {
+	atomic, ok := f.Storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return ratelimiter.ErrNotAtomic
+	}
+
+	if f.usePrimary() {
+		primaryCtx, cancel := f.withTimeout(ctx)
+		err := atomic.Refund(primaryCtx, key, cost, at)
+		cancel()
+
+		if errors.Is(err, ratelimiter.ErrNotAtomic) {
+			return err
+		}
+		f.record(err)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return f.fallback.Refund(ctx, key, cost, at)
+}
+
+func (f *FallbackStorage) Delete(ctx context.Context, key string) error {
+	if err := f.fallback.Delete(ctx, key); err != nil {
+		return err
+	}
+	return f.Storage.Delete(ctx, key)
+}
+
+func (f *FallbackStorage) List(ctx context.Context) ([]string, error) {
+	if f.IsFallbackActive() {
+		return f.fallback.List(ctx)
+	}
+	return f.Storage.List(ctx)
+}
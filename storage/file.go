@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// LimitConfig is a limit and block time pair in the config file, with optional daily
+// and monthly quotas, or the name of a policy. Tokens also take a window in seconds, an
+// algorithm and a burst, bucket_size being its older name.
+type LimitConfig struct {
+	Limit        *int   `yaml:"limit" json:"limit"`
+	BlockTime    *int   `yaml:"block_time" json:"block_time"`
+	Window       *int   `yaml:"window" json:"window"`
+	DailyQuota   *int   `yaml:"daily_quota" json:"daily_quota"`
+	MonthlyQuota *int   `yaml:"monthly_quota" json:"monthly_quota"`
+	Algorithm    string `yaml:"algorithm" json:"algorithm"`
+	BucketSize   *int   `yaml:"bucket_size" json:"bucket_size"`
+	Burst        *int   `yaml:"burst" json:"burst"`
+	Policy       string `yaml:"policy" json:"policy"`
+}
+
+// PolicyConfig is a named policy in the config file, see Policy
+type PolicyConfig struct {
+	Limit        *int           `yaml:"limit" json:"limit"`
+	BlockTime    *int           `yaml:"block_time" json:"block_time"`
+	Window       *int           `yaml:"window" json:"window"`
+	Windows      []WindowConfig `yaml:"windows" json:"windows"`
+	Algorithm    string         `yaml:"algorithm" json:"algorithm"`
+	Burst        *int           `yaml:"burst" json:"burst"`
+	Concurrency  *int           `yaml:"concurrency" json:"concurrency"`
+	Bandwidth    *int           `yaml:"bandwidth" json:"bandwidth"`
+	DailyQuota   *int           `yaml:"daily_quota" json:"daily_quota"`
+	MonthlyQuota *int           `yaml:"monthly_quota" json:"monthly_quota"`
+}
+
+// WindowConfig is a window stacked on a policy: Limit requests per Window seconds
+type WindowConfig struct {
+	Limit  int `yaml:"limit" json:"limit"`
+	Window int `yaml:"window" json:"window"`
+}
+
+// PolicyRuleConfig binds requests to a policy in the config file, see PolicyRule
+type PolicyRuleConfig struct {
+	Path    string   `yaml:"path" json:"path"`
+	Methods []string `yaml:"methods" json:"methods"`
+	KeyType string   `yaml:"key_type" json:"key_type"`
+	Policy  string   `yaml:"policy" json:"policy"`
+}
+
+// RouteConfig scopes limits to a path prefix or host, served as an app namespace
+type RouteConfig struct {
+	Name       string                 `yaml:"name" json:"name"`
+	PathPrefix string                 `yaml:"path_prefix" json:"path_prefix"`
+	Hosts      []string               `yaml:"hosts" json:"hosts"`
+	AdminToken string                 `yaml:"admin_token" json:"admin_token"`
+	IP         LimitConfig            `yaml:"ip" json:"ip"`
+	Tokens     map[string]LimitConfig `yaml:"tokens" json:"tokens"`
+}
+
+// FileStorageConfig is the storage section of the config file
+type FileStorageConfig struct {
+	Host             string   `yaml:"host" json:"host"`
+	Port             string   `yaml:"port" json:"port"`
+	Password         string   `yaml:"password" json:"password"`
+	DB               *int     `yaml:"db" json:"db"`
+	Mode             string   `yaml:"mode" json:"mode"`
+	Addresses        []string `yaml:"addresses" json:"addresses"`
+	MasterName       string   `yaml:"master_name" json:"master_name"`
+	SentinelPassword string   `yaml:"sentinel_password" json:"sentinel_password"`
+	Backend          string   `yaml:"backend" json:"backend"`
+	EtcdEndpoints    []string `yaml:"etcd_endpoints" json:"etcd_endpoints"`
+	EtcdPrefix       string   `yaml:"etcd_prefix" json:"etcd_prefix"`
+	DiskPath         string   `yaml:"disk_path" json:"disk_path"`
+}
+
+// FileResponseConfig is the response section of the config file, the serialization
+// profile of the JSON responses
+type FileResponseConfig struct {
+	FieldCase     string `yaml:"field_case" json:"field_case"`
+	Envelope      string `yaml:"envelope" json:"envelope"`
+	ErrorEnvelope string `yaml:"error_envelope" json:"error_envelope"`
+}
+
+// FileGeoIPConfig is the geoip section of the config file: the MaxMind databases, the
+// policies of countries and ASNs and the blocked ones
+type FileGeoIPConfig struct {
+	Databases        []string          `yaml:"databases" json:"databases"`
+	Countries        map[string]string `yaml:"countries" json:"countries"`
+	ASNs             map[string]string `yaml:"asns" json:"asns"`
+	BlockedCountries []string          `yaml:"blocked_countries" json:"blocked_countries"`
+	BlockedASNs      []string          `yaml:"blocked_asns" json:"blocked_asns"`
+}
+
+// FileConfig is the structure of the YAML/JSON config file. Settings without a
+// dedicated section go in env, keyed by their environment variable name.
+type FileConfig struct {
+	IP       LimitConfig            `yaml:"ip" json:"ip"`
+	Tokens   map[string]LimitConfig `yaml:"tokens" json:"tokens"`
+	Routes   []RouteConfig          `yaml:"routes" json:"routes"`
+	Storage  FileStorageConfig      `yaml:"storage" json:"storage"`
+	Response FileResponseConfig     `yaml:"response" json:"response"`
+	GeoIP    FileGeoIPConfig        `yaml:"geoip" json:"geoip"`
+	Env      map[string]string      `yaml:"env" json:"env"`
+
+	// Policies are keyed by name; RoutePolicies assigns them to "[METHOD ]/prefix" routes
+	// and PolicyRules to the requests they match, in order
+	Policies      map[string]PolicyConfig `yaml:"policies" json:"policies"`
+	RoutePolicies map[string]string       `yaml:"route_policies" json:"route_policies"`
+	PolicyRules   []PolicyRuleConfig      `yaml:"policy_rules" json:"policy_rules"`
+}
+
+// LoadConfigFromFile loads a YAML or JSON config file (picked by extension) and then
+// the environment. Environment variables, including .env, override file values.
+func LoadConfigFromFile(path string) (AppConfig, error) {
+	fileConfig, err := readConfigFile(path)
+	if err != nil {
+		return AppConfig{}, err
+	}
+
+	godotenv.Load()
+
+	for key, value := range fileConfig.envDefaults() {
+		if _, exists := os.LookupEnv(key); exists {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return AppConfig{}, err
+		}
+	}
+
+	return LoadConfig()
+}
+
+func readConfigFile(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	fileConfig := &FileConfig{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, fileConfig)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, fileConfig)
+	default:
+		return nil, fmt.Errorf("unsupported config file extension: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	for _, route := range fileConfig.Routes {
+		if route.Name == "" {
+			return nil, fmt.Errorf("config file route is missing a name")
+		}
+		if route.PathPrefix == "" && len(route.Hosts) == 0 {
+			return nil, fmt.Errorf("config file route %s needs a path_prefix or hosts", route.Name)
+		}
+	}
+
+	return fileConfig, nil
+}
+
+// envDefaults maps the file onto the environment variables LoadConfig reads
+func (f *FileConfig) envDefaults() map[string]string {
+	env := make(map[string]string)
+	for key, value := range f.Env {
+		env[key] = value
+	}
+
+	f.IP.setEnv(env, "IP_RATE_LIMIT", "IP_BLOCK_TIME")
+	f.IP.setQuotaEnv(env, "IP_DAILY_QUOTA", "IP_MONTHLY_QUOTA")
+	setIfNotEmpty(env, "IP_POLICY", f.IP.Policy)
+	for token, limits := range f.Tokens {
+		limits.setEnv(env, "TOKEN_"+token+"_LIMIT", "TOKEN_"+token+"_BLOCK_TIME")
+		limits.setQuotaEnv(env, "TOKEN_"+token+"_DAILY_QUOTA", "TOKEN_"+token+"_MONTHLY_QUOTA")
+		limits.setAlgorithmEnv(env, "TOKEN_"+token+"_ALGORITHM", "TOKEN_"+token+"_BUCKET_SIZE")
+		limits.setWindowEnv(env, "TOKEN_"+token+"_WINDOW")
+		setIfNotEmpty(env, "TOKEN_"+token+"_POLICY", limits.Policy)
+	}
+
+	policies := make([]string, 0, len(f.Policies))
+	for name, policy := range f.Policies {
+		policies = append(policies, name)
+		policy.setEnv(env, "POLICY_"+strings.ToUpper(name)+"_")
+	}
+	sort.Strings(policies)
+	setIfNotEmpty(env, "POLICIES", strings.Join(policies, ","))
+
+	routes := make([]string, 0, len(f.RoutePolicies))
+	for route, name := range f.RoutePolicies {
+		routes = append(routes, route+"="+name)
+	}
+	sort.Strings(routes)
+	setIfNotEmpty(env, "ROUTE_POLICIES", strings.Join(routes, ","))
+
+	rules := make([]string, 0, len(f.PolicyRules))
+	for _, rule := range f.PolicyRules {
+		rules = append(rules, PolicyRule(rule).String())
+	}
+	setIfNotEmpty(env, "POLICY_RULES", strings.Join(rules, ","))
+
+	setIfNotEmpty(env, "GEOIP_DATABASES", strings.Join(f.GeoIP.Databases, ","))
+	setIfNotEmpty(env, "COUNTRY_POLICIES", joinAssignments(f.GeoIP.Countries))
+	setIfNotEmpty(env, "ASN_POLICIES", joinAssignments(f.GeoIP.ASNs))
+	setIfNotEmpty(env, "BLOCKED_COUNTRIES", strings.Join(f.GeoIP.BlockedCountries, ","))
+	setIfNotEmpty(env, "BLOCKED_ASNS", strings.Join(f.GeoIP.BlockedASNs, ","))
+
+	var names []string
+	for _, route := range f.Routes {
+		names = append(names, route.Name)
+		prefix := "APP_" + strings.ToUpper(route.Name) + "_"
+
+		setIfNotEmpty(env, prefix+"PATH_PREFIX", route.PathPrefix)
+		setIfNotEmpty(env, prefix+"HOSTS", strings.Join(route.Hosts, ","))
+		setIfNotEmpty(env, prefix+"ADMIN_TOKEN", route.AdminToken)
+		route.IP.setEnv(env, prefix+"IP_RATE_LIMIT", prefix+"IP_BLOCK_TIME")
+		route.IP.setQuotaEnv(env, prefix+"IP_DAILY_QUOTA", prefix+"IP_MONTHLY_QUOTA")
+		setIfNotEmpty(env, prefix+"IP_POLICY", route.IP.Policy)
+		for token, limits := range route.Tokens {
+			limits.setEnv(env, prefix+"TOKEN_"+token+"_LIMIT", prefix+"TOKEN_"+token+"_BLOCK_TIME")
+			limits.setQuotaEnv(env, prefix+"TOKEN_"+token+"_DAILY_QUOTA", prefix+"TOKEN_"+token+"_MONTHLY_QUOTA")
+			limits.setAlgorithmEnv(env, prefix+"TOKEN_"+token+"_ALGORITHM", prefix+"TOKEN_"+token+"_BUCKET_SIZE")
+			limits.setWindowEnv(env, prefix+"TOKEN_"+token+"_WINDOW")
+			setIfNotEmpty(env, prefix+"TOKEN_"+token+"_POLICY", limits.Policy)
+		}
+	}
+	setIfNotEmpty(env, "APPS", strings.Join(names, ","))
+
+	setIfNotEmpty(env, "REDIS_HOST", f.Storage.Host)
+	setIfNotEmpty(env, "REDIS_PORT", f.Storage.Port)
+	setIfNotEmpty(env, "REDIS_PASSWORD", f.Storage.Password)
+	if f.Storage.DB != nil {
+		env["REDIS_DB"] = strconv.Itoa(*f.Storage.DB)
+	}
+	setIfNotEmpty(env, "REDIS_MODE", f.Storage.Mode)
+	setIfNotEmpty(env, "REDIS_ADDRS", strings.Join(f.Storage.Addresses, ","))
+	setIfNotEmpty(env, "REDIS_MASTER_NAME", f.Storage.MasterName)
+	setIfNotEmpty(env, "REDIS_SENTINEL_PASSWORD", f.Storage.SentinelPassword)
+	setIfNotEmpty(env, "STORAGE_BACKEND", f.Storage.Backend)
+	setIfNotEmpty(env, "ETCD_ENDPOINTS", strings.Join(f.Storage.EtcdEndpoints, ","))
+	setIfNotEmpty(env, "ETCD_PREFIX", f.Storage.EtcdPrefix)
+	setIfNotEmpty(env, "DISK_STORAGE_PATH", f.Storage.DiskPath)
+
+	setIfNotEmpty(env, "RESPONSE_FIELD_CASE", f.Response.FieldCase)
+	setIfNotEmpty(env, "RESPONSE_ENVELOPE", f.Response.Envelope)
+	setIfNotEmpty(env, "RESPONSE_ERROR_ENVELOPE", f.Response.ErrorEnvelope)
+
+	return env
+}
+
+func (l LimitConfig) setEnv(env map[string]string, limitKey, blockTimeKey string) {
+	if l.Limit != nil {
+		env[limitKey] = strconv.Itoa(*l.Limit)
+	}
+	if l.BlockTime != nil {
+		env[blockTimeKey] = strconv.Itoa(*l.BlockTime)
+	}
+}
+
+func (l LimitConfig) setQuotaEnv(env map[string]string, dailyKey, monthlyKey string) {
+	if l.DailyQuota != nil {
+		env[dailyKey] = strconv.Itoa(*l.DailyQuota)
+	}
+	if l.MonthlyQuota != nil {
+		env[monthlyKey] = strconv.Itoa(*l.MonthlyQuota)
+	}
+}
+
+func (l LimitConfig) setAlgorithmEnv(env map[string]string, algorithmKey, bucketSizeKey string) {
+	setIfNotEmpty(env, algorithmKey, l.Algorithm)
+	if l.BucketSize != nil {
+		env[bucketSizeKey] = strconv.Itoa(*l.BucketSize)
+	}
+	if l.Burst != nil {
+		env[bucketSizeKey] = strconv.Itoa(*l.Burst)
+	}
+}
+
+func (l LimitConfig) setWindowEnv(env map[string]string, windowKey string) {
+	if l.Window != nil {
+		env[windowKey] = strconv.Itoa(*l.Window)
+	}
+}
+
+func (p PolicyConfig) setEnv(env map[string]string, prefix string) {
+	for suffix, value := range map[string]*int{
+		"LIMIT":         p.Limit,
+		"BLOCK_TIME":    p.BlockTime,
+		"WINDOW":        p.Window,
+		"BURST":         p.Burst,
+		"CONCURRENCY":   p.Concurrency,
+		"BANDWIDTH":     p.Bandwidth,
+		"DAILY_QUOTA":   p.DailyQuota,
+		"MONTHLY_QUOTA": p.MonthlyQuota,
+	} {
+		if value != nil {
+			env[prefix+suffix] = strconv.Itoa(*value)
+		}
+	}
+	setIfNotEmpty(env, prefix+"ALGORITHM", p.Algorithm)
+
+	windows := make([]string, 0, len(p.Windows))
+	for _, window := range p.Windows {
+		windows = append(windows, strconv.Itoa(window.Limit)+"/"+strconv.Itoa(window.Window))
+	}
+	setIfNotEmpty(env, prefix+"WINDOWS", strings.Join(windows, ","))
+}
+
+// joinAssignments lists the entries as sorted key=value pairs
+func joinAssignments(entries map[string]string) string {
+	pairs := make([]string, 0, len(entries))
+	for key, value := range entries {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func setIfNotEmpty(env map[string]string, key, value string) {
+	if value != "" {
+		env[key] = value
+	}
+}
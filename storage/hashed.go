@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	ratelimiter "rate-limiter"
+	"strings"
+	"time"
+)
+
+// hashedKeyMarker starts the hash of a key, after the "token:" prefix of token keys
+const hashedKeyMarker = "#"
+
+// HashedStorage replaces every counter and usage key of an underlying storage with its
+// HMAC-SHA256, so raw client IPs and API keys never reach the backend. Token keys keep
+// their "token:" prefix to stay apart from IP keys; any other key is hashed whole. The
+// names of the token registry and the token bans ("token:<name>") are hashed the same
+// way; IP and CIDR bans and leases are stored as given.
+//
+// Every key is hashed, even one that looks hashed, since clients choose their API keys.
+// StoredKeys gives the admin API a view that also takes the hashed keys the storage
+// lists.
+type HashedStorage struct {
+	storage ratelimiter.Storage
+	secret  []byte
+
+	// stored keeps keys that are already hashed as they are, see StoredKeys
+	stored bool
+}
+
+func NewHashedStorage(storage ratelimiter.Storage, secret string) *HashedStorage {
+	return &HashedStorage{
+		storage: storage,
+		secret:  []byte(secret),
+	}
+}
+
+// HashKey returns the key the storage keeps for key
+func (h *HashedStorage) HashKey(key string) string {
+	prefix := ""
+	if rest, found := strings.CutPrefix(key, "token:"); found {
+		prefix, key = "token:", rest
+	}
+
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write([]byte(key))
+	return prefix + hashedKeyMarker + hex.EncodeToString(mac.Sum(nil))
+}
+
+// StoredKey is HashKey for a key entered by an admin, which may be one the storage
+// listed and keep it as it is, or built by the caller from HashKey after a "prefix:" of
+// its own. It must never be given the key of a client.
+func (h *HashedStorage) StoredKey(key string) string {
+	if isHashedKey(key) {
+		return key
+	}
+	return h.HashKey(key)
+}
+
+// StoredKeys returns a view of the storage taking its keys through StoredKey
+func (h *HashedStorage) StoredKeys() *HashedStorage {
+	return &HashedStorage{storage: h.storage, secret: h.secret, stored: true}
+}
+
+// key returns the key the storage keeps for key, as HashKey or StoredKey does
+func (h *HashedStorage) key(key string) string {
+	if h.stored {
+		return h.StoredKey(key)
+	}
+	return h.HashKey(key)
+}
+
+// banValue hashes the token of a token ban; entered by admins, it may be listed already
+func (h *HashedStorage) banValue(value string) string {
+	if !strings.HasPrefix(value, "token:") {
+		return value
+	}
+	return h.StoredKey(value)
+}
+
+// tokenName hashes the name of a registry token like the token part of its key;
+// entered by admins, it may be listed already
+func (h *HashedStorage) tokenName(name string) string {
+	return h.StoredKey(name)
+}
+
+func isHashedKey(key string) bool {
+	i := strings.LastIndex(key, hashedKeyMarker)
+	if i < 0 || (i > 0 && key[i-1] != ':') {
+		return false
+	}
+	digest := key[i+len(hashedKeyMarker):]
+	if len(digest) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil
+}
+
+func (h *HashedStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLimit, error) {
+	return h.storage.Get(ctx, h.key(key))
+}
+
+func (h *HashedStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
+	return h.storage.Set(ctx, h.key(key), rateLimit, expiration)
+}
+
+func (h *HashedStorage) GetMulti(ctx context.Context, keys []string) ([]*ratelimiter.RateLimit, error) {
+	hashed := make([]string, len(keys))
+	for i, key := range keys {
+		hashed[i] = h.key(key)
+	}
+	return h.storage.GetMulti(ctx, hashed)
+}
+
+func (h *HashedStorage) SetMulti(ctx context.Context, entries []ratelimiter.RateLimitEntry) error {
+	hashed := make([]ratelimiter.RateLimitEntry, len(entries))
+	for i, entry := range entries {
+		hashed[i] = entry
+		hashed[i].Key = h.key(entry.Key)
+	}
+	return h.storage.SetMulti(ctx, hashed)
+}
+
+// AllowWindows forwards to the underlying storage when it is atomic
+func (h *HashedStorage) AllowWindows(ctx context.Context, checks []ratelimiter.WindowCheck, cost int, now time.Time) (ratelimiter.Result, error) {
+	atomic, ok := h.storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return ratelimiter.Result{}, ratelimiter.ErrNotAtomic
+	}
+
+	hashed := make([]ratelimiter.WindowCheck, len(checks))
+	for i, check := range checks {
+		hashed[i] = check
+		hashed[i].Key = h.key(check.Key)
+	}
+	return atomic.AllowWindows(ctx, hashed, cost, now)
+}
+
+// Consume forwards to the underlying storage when it is atomic
+func (h *HashedStorage) Consume(ctx context.Context, key string, cost int, start time.Time, expiration time.Duration) (int, error) {
+	atomic, ok := h.storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return 0, ratelimiter.ErrNotAtomic
+	}
+	return atomic.Consume(ctx, h.key(key), cost, start, expiration)
+}
+
+// Refund forwards to the underlying storage when it is atomic
+func (h *HashedStorage) Refund(ctx context.Context, key string, cost int, at time.Time) error {
+	atomic, ok := h.storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return ratelimiter.ErrNotAtomic
+	}
+	return atomic.Refund(ctx, h.key(key), cost, at)
+}
+
+func (h *HashedStorage) Delete(ctx context.Context, key string) error {
+	return h.storage.Delete(ctx, h.key(key))
+}
+
+func (h *HashedStorage) List(ctx context.Context) ([]string, error) {
+	return h.storage.List(ctx)
+}
+
+func (h *HashedStorage) AddBan(ctx context.Context, ban *ratelimiter.Ban) error {
+	hashed := *ban
+	hashed.Value = h.banValue(ban.Value)
+	return h.storage.AddBan(ctx, &hashed)
+}
+
+func (h *HashedStorage) RemoveBan(ctx context.Context, value string) error {
+	return h.storage.RemoveBan(ctx, h.banValue(value))
+}
+
+func (h *HashedStorage) ListBans(ctx context.Context) ([]*ratelimiter.Ban, error) {
+	return h.storage.ListBans(ctx)
+}
+
+func (h *HashedStorage) SetTokenConfig(ctx context.Context, tokenConfig *ratelimiter.TokenConfig) error {
+	hashed := *tokenConfig
+	hashed.Name = h.tokenName(tokenConfig.Name)
+	return h.storage.SetTokenConfig(ctx, &hashed)
+}
+
+func (h *HashedStorage) DeleteTokenConfig(ctx context.Context, name string) error {
+	return h.storage.DeleteTokenConfig(ctx, h.tokenName(name))
+}
+
+func (h *HashedStorage) ListTokenConfigs(ctx context.Context) ([]*ratelimiter.TokenConfig, error) {
+	return h.storage.ListTokenConfigs(ctx)
+}
+
+func (h *HashedStorage) AddUsage(ctx context.Context, period string, start time.Time, counts map[string]int64, retention time.Duration) error {
+	hashed := make(map[string]int64, len(counts))
+	for key, count := range counts {
+		hashed[h.key(key)] += count
+	}
+	return h.storage.AddUsage(ctx, period, start, hashed, retention)
+}
+
+func (h *HashedStorage) TakeUsage(ctx context.Context, period string, before time.Time) ([]*ratelimiter.UsageRecord, error) {
+	return h.storage.TakeUsage(ctx, period, before)
+}
+
+func (h *HashedStorage) ListUsage(ctx context.Context, period string, from, to time.Time) ([]*ratelimiter.UsageRecord, error) {
+	return h.storage.ListUsage(ctx, period, from, to)
+}
+
+func (h *HashedStorage) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	return h.storage.AcquireLease(ctx, name, holder, ttl)
+}
+
+func (h *HashedStorage) ReleaseLease(ctx context.Context, name, holder string) error {
+	return h.storage.ReleaseLease(ctx, name, holder)
+}
+
+func (h *HashedStorage) Ping(ctx context.Context) error {
+	return h.storage.Ping(ctx)
+}
+
+func (h *HashedStorage) Close() error {
+	return h.storage.Close()
+}
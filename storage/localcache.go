@@ -0,0 +1,364 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log/slog"
+	ratelimiter "rate-limiter"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// localCacheEntry is either a counter read or written through the cache, or the
+// refusal of the keys of a check that were blocked
+type localCacheEntry struct {
+	key       string
+	expiresAt time.Time
+
+	rateLimit *ratelimiter.RateLimit
+
+	keys         []string
+	blockedUntil time.Time
+	result       ratelimiter.Result
+}
+
+// LocalCacheStorage keeps the counters it reads and writes through, and the refusals of
+// blocked keys, in an in-process LRU in front of a shared storage. A request of a key
+// the cache knows is blocked is refused without reaching the storage, until the block
+// ends or blockTTL passes, whichever is first; counters are served for counterTTL. The
+// cache only sees the writes of this instance, so a block lifted or a counter moved by
+// another instance shows up here once the entry expires, unless the instances share
+// their blocks and lifts through ShareBlocks.
+type LocalCacheStorage struct {
+	ratelimiter.Storage
+
+	counterTTL time.Duration
+	blockTTL   time.Duration
+	maxEntries int
+
+	// published queues the events shared through ShareBlocks
+	published chan ratelimiter.BlockEvent
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func NewLocalCacheStorage(storage ratelimiter.Storage, counterTTL, blockTTL time.Duration, maxEntries int) *LocalCacheStorage {
+	return &LocalCacheStorage{
+		Storage:    storage,
+		counterTTL: counterTTL,
+		blockTTL:   blockTTL,
+		maxEntries: max(maxEntries, 1),
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Hits returns how many reads and checks were answered by the cache
+func (c *LocalCacheStorage) Hits() uint64 {
+	return c.hits.Load()
+}
+
+// Misses returns how many reads and checks went to the storage
+func (c *LocalCacheStorage) Misses() uint64 {
+	return c.misses.Load()
+}
+
+// ShareBlocks publishes the blocks this instance finds, and the blocks it lifts, to the
+// other instances through the broadcaster, and caches theirs as if found here, so a key
+// blocked by one instance is refused by all of them without a round trip. It is called
+// once, before the cache serves any check, and shares until ctx is done. The events are
+// published in the background, so a slow broadcaster never holds a request up.
+func (c *LocalCacheStorage) ShareBlocks(ctx context.Context, broadcaster ratelimiter.BlockBroadcaster) error {
+	if err := broadcaster.SubscribeBlocks(ctx, c.receiveBlock); err != nil {
+		return err
+	}
+	c.published = make(chan ratelimiter.BlockEvent, 256)
+	go c.runPublish(ctx, broadcaster)
+	return nil
+}
+
+// publishBlock queues a block or a lift to share. Failing to share it, or dropping it
+// while the queue is full, only leaves the other instances to find out from the storage.
+func (c *LocalCacheStorage) publishBlock(event ratelimiter.BlockEvent) {
+	if c.published == nil {
+		return
+	}
+	select {
+	case c.published <- event:
+	default:
+		slog.Warn("Dropped a block shared with the other instances, the queue is full")
+	}
+}
+
+// runPublish publishes the queued events until ctx is done
+func (c *LocalCacheStorage) runPublish(ctx context.Context, broadcaster ratelimiter.BlockBroadcaster) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-c.published:
+			if err := broadcaster.PublishBlock(ctx, event); err != nil {
+				slog.Warn("Failed to share a block with the other instances", "error", err)
+			}
+		}
+	}
+}
+
+// receiveBlock caches a block found by an instance, or forgets the blocks of a key it
+// lifted. Its own events come back too and change nothing.
+func (c *LocalCacheStorage) receiveBlock(event ratelimiter.BlockEvent) {
+	if event.BlockedUntil.IsZero() {
+		for _, key := range event.Keys {
+			c.evict(key)
+		}
+		return
+	}
+	c.cacheBlock(event.Keys, event.BlockedUntil, event.Result, time.Now())
+}
+
+// cacheBlock remembers the refusal of the keys of a check until the block ends or the
+// block TTL passes
+func (c *LocalCacheStorage) cacheBlock(keys []string, blockedUntil time.Time, result ratelimiter.Result, now time.Time) {
+	if c.blockTTL <= 0 || !now.Before(blockedUntil) {
+		return
+	}
+	c.store(&localCacheEntry{
+		key:          blockEntryKey(keys),
+		expiresAt:    now.Add(min(c.blockTTL, blockedUntil.Sub(now))),
+		keys:         keys,
+		blockedUntil: blockedUntil,
+		result:       result,
+	})
+}
+
+// blockEntryKey names the refusal of a check, whose keys are blocked together
+func blockEntryKey(keys []string) string {
+	return "block\x00" + strings.Join(keys, "\x00")
+}
+
+func (c *LocalCacheStorage) lookup(key string, now time.Time) *localCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[key]
+	if !exists {
+		return nil
+	}
+	entry := element.Value.(*localCacheEntry)
+	if !now.Before(entry.expiresAt) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return entry
+}
+
+func (c *LocalCacheStorage) store(entry *localCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, exists := c.entries[entry.key]; exists {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*localCacheEntry).key)
+	}
+}
+
+// evict drops the counter of the key and every refusal involving it
+func (c *LocalCacheStorage) evict(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*localCacheEntry)
+		if entry.key == key || slices.Contains(entry.keys, key) {
+			c.lru.Remove(element)
+			delete(c.entries, entry.key)
+		}
+		element = next
+	}
+}
+
+// evictCounters drops the counters of the keys, leaving the refusals alone
+func (c *LocalCacheStorage) evictCounters(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if element, exists := c.entries[key]; exists {
+			c.lru.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *LocalCacheStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLimit, error) {
+	if entry := c.lookup(key, time.Now()); entry != nil && entry.rateLimit != nil {
+		c.hits.Add(1)
+		rateLimit := *entry.rateLimit
+		return &rateLimit, nil
+	}
+	c.misses.Add(1)
+
+	rateLimit, err := c.Storage.Get(ctx, key)
+	if err != nil || rateLimit == nil {
+		return rateLimit, err
+	}
+	c.cacheCounter(key, rateLimit, c.counterTTL)
+	return rateLimit, nil
+}
+
+func (c *LocalCacheStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
+	if err := c.Storage.Set(ctx, key, rateLimit, expiration); err != nil {
+		c.evictCounters(key)
+		return err
+	}
+	c.cacheCounter(key, rateLimit, min(c.counterTTL, expiration))
+	return nil
+}
+
+// GetMulti serves the cached counters and reads the other keys in one call
+func (c *LocalCacheStorage) GetMulti(ctx context.Context, keys []string) ([]*ratelimiter.RateLimit, error) {
+	rateLimits := make([]*ratelimiter.RateLimit, len(keys))
+	var missing []string
+	var positions []int
+
+	now := time.Now()
+	for i, key := range keys {
+		if entry := c.lookup(key, now); entry != nil && entry.rateLimit != nil {
+			c.hits.Add(1)
+			rateLimit := *entry.rateLimit
+			rateLimits[i] = &rateLimit
+			continue
+		}
+		c.misses.Add(1)
+		missing = append(missing, key)
+		positions = append(positions, i)
+	}
+
+	if len(missing) == 0 {
+		return rateLimits, nil
+	}
+	stored, err := c.Storage.GetMulti(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	for i, rateLimit := range stored {
+		rateLimits[positions[i]] = rateLimit
+		if rateLimit != nil {
+			c.cacheCounter(missing[i], rateLimit, c.counterTTL)
+		}
+	}
+	return rateLimits, nil
+}
+
+func (c *LocalCacheStorage) SetMulti(ctx context.Context, entries []ratelimiter.RateLimitEntry) error {
+	if err := c.Storage.SetMulti(ctx, entries); err != nil {
+		keys := make([]string, len(entries))
+		for i, entry := range entries {
+			keys[i] = entry.Key
+		}
+		c.evictCounters(keys...)
+		return err
+	}
+	for _, entry := range entries {
+		c.cacheCounter(entry.Key, entry.RateLimit, min(c.counterTTL, entry.Expiration))
+	}
+	return nil
+}
+
+func (c *LocalCacheStorage) cacheCounter(key string, rateLimit *ratelimiter.RateLimit, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	cached := *rateLimit
+	c.store(&localCacheEntry{key: key, expiresAt: time.Now().Add(ttl), rateLimit: &cached})
+}
+
+func (c *LocalCacheStorage) Delete(ctx context.Context, key string) error {
+	c.evict(key)
+	if err := c.Storage.Delete(ctx, key); err != nil {
+		return err
+	}
+	c.publishBlock(ratelimiter.BlockEvent{Keys: []string{key}})
+	return nil
+}
+
+// AllowWindows refuses a check the cache knows is blocked without reaching the storage,
+// and remembers the refusals of the storage that come with a block
+func (c *LocalCacheStorage) AllowWindows(ctx context.Context, checks []ratelimiter.WindowCheck, cost int, now time.Time) (ratelimiter.Result, error) {
+	atomicStorage, ok := c.Storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return ratelimiter.Result{}, ratelimiter.ErrNotAtomic
+	}
+
+	keys := make([]string, len(checks))
+	for i, check := range checks {
+		keys[i] = check.Key
+	}
+	entryKey := blockEntryKey(keys)
+
+	if entry := c.lookup(entryKey, now); entry != nil && now.Before(entry.blockedUntil) {
+		c.hits.Add(1)
+		result := entry.result
+		result.RetryAfter = entry.blockedUntil.Sub(now)
+		return result, nil
+	}
+	c.misses.Add(1)
+
+	result, err := atomicStorage.AllowWindows(ctx, checks, cost, now)
+	if err != nil {
+		return result, err
+	}
+	c.evictCounters(keys...)
+
+	// while any window is blocked the check is refused and nothing changes, so the
+	// refusal holds until the longest block ends
+	if !result.Allowed && result.RetryAfter > 0 && c.blockTTL > 0 {
+		blockedUntil := now.Add(result.RetryAfter)
+		c.cacheBlock(keys, blockedUntil, result, now)
+		c.publishBlock(ratelimiter.BlockEvent{Keys: keys, BlockedUntil: blockedUntil, Result: result})
+	}
+	return result, nil
+}
+
+func (c *LocalCacheStorage) Consume(ctx context.Context, key string, cost int, start time.Time, expiration time.Duration) (int, error) {
+	atomicStorage, ok := c.Storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return 0, ratelimiter.ErrNotAtomic
+	}
+	count, err := atomicStorage.Consume(ctx, key, cost, start, expiration)
+	if !errors.Is(err, ratelimiter.ErrNotAtomic) {
+		c.evictCounters(key)
+	}
+	return count, err
+}
+
+func (c *LocalCacheStorage) Refund(ctx context.Context, key string, cost int, at time.Time) error {
+	atomicStorage, ok := c.Storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return ratelimiter.ErrNotAtomic
+	}
+	err := atomicStorage.Refund(ctx, key, cost, at)
+	if !errors.Is(err, ratelimiter.ErrNotAtomic) {
+		c.evictCounters(key)
+	}
+	return err
+}
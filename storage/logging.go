@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Log formats of LOG_FORMAT
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogConfig selects the level ("debug", "info", "warn" or "error") and the format of
+// the process logs
+type LogConfig struct {
+	Level  string
+	Format string
+}
+
+// Validate checks the level and the format
+func (c LogConfig) Validate() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); c.Level != "" && err != nil {
+		return fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", c.Level)
+	}
+	switch c.Format {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		return fmt.Errorf("LOG_FORMAT must be text or json, got %q", c.Format)
+	}
+	return nil
+}
+
+// NewLogger returns a logger writing to w at the level and in the format of the config,
+// info and text when they are not set
+func NewLogger(w io.Writer, config LogConfig) *slog.Logger {
+	level := slog.LevelInfo
+	if config.Level != "" {
+		level.UnmarshalText([]byte(config.Level))
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	if config.Format == LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
+
+// RedactAPIKey returns the truncated SHA-256 of an API key, enough to tell keys apart
+// in the logs without revealing them
+func RedactAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// RedactKey returns a rate limit key fit for the logs: the API key after "token:" is
+// redacted, wherever it is in the key, and IP keys stay readable
+func RedactKey(key string) string {
+	i := strings.Index(key, "token:")
+	if i < 0 || i+len("token:") == len(key) {
+		return key
+	}
+	return key[:i] + "token:" + RedactAPIKey(key[i+len("token:"):])
+}
@@ -0,0 +1,13 @@
+-- acquire_lease renews the lease of KEYS[1] when ARGV[1] holds it, or takes it when free
+--
+-- ARGV: holder, ttl (ms)
+-- Returns: 1 when the holder owns the lease
+
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0
@@ -0,0 +1,12 @@
+-- consume adds a cost to the counter of KEYS[1], creating it when missing
+--
+-- ARGV: cost, start of the counter (Unix ms), expiration (ms), counter encoding (json or
+-- binary)
+-- Returns: the new count
+
+local cost = tonumber(ARGV[1])
+local state = load(KEYS[1]) or { count = 0, last_reset = tonumber(ARGV[2]), violations = 0 }
+
+state.count = state.count + cost
+store(KEYS[1], state, tonumber(ARGV[3]), ARGV[4])
+return state.count
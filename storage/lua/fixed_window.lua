@@ -0,0 +1,132 @@
+-- fixed_window checks a request against the fixed windows of KEYS and consumes its cost
+-- in all of them only when it fits in every one, with the steps of
+-- ratelimiter.ApplyWindows. In cluster mode KEYS must share a hash slot.
+--
+-- ARGV: cost, now (Unix ms), counter encoding (json or binary), then limit, window (ms),
+-- block time (ms), escalation factor, max block time (ms) and escalation decay (ms) for
+-- each key
+-- Returns: allowed (0 or 1), limit, remaining, reset at (Unix ms), retry after (ms)
+
+local cost = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+local encoding = ARGV[3]
+
+local windows = {}
+for i, key in ipairs(KEYS) do
+	local base = 3 + (i - 1) * 6
+	local w = {
+		key = key,
+		limit = tonumber(ARGV[base + 1]),
+		window = tonumber(ARGV[base + 2]),
+		block = tonumber(ARGV[base + 3]),
+		factor = tonumber(ARGV[base + 4]),
+		max_block = tonumber(ARGV[base + 5]),
+		decay = tonumber(ARGV[base + 6]),
+		count = 0,
+		last_reset = now,
+		blocked_at = nil,
+		violations = 0,
+		violated_at = nil,
+	}
+
+	local state = load(key)
+	if state then
+		w.count = state.count
+		w.last_reset = state.last_reset or 0
+		w.blocked_at = state.blocked_at
+		w.violations = state.violations
+		w.violated_at = state.violated_at
+	end
+	windows[i] = w
+end
+
+-- block_for mirrors ratelimiter.Limits.BlockFor
+local function block_for(w, violations)
+	if w.factor <= 1 or violations <= 1 then
+		return w.block
+	end
+	local block = w.block * w.factor ^ (violations - 1)
+	if w.max_block > 0 and block > w.max_block then
+		return math.max(w.max_block, w.block)
+	end
+	return math.floor(block)
+end
+
+-- blocked_until mirrors ratelimiter.Limits.BlockedUntil, nil when not blocked
+local function blocked_until(w)
+	if not w.blocked_at then
+		return nil
+	end
+	local until_ms = w.blocked_at + block_for(w, w.violations)
+	if now < until_ms then
+		return until_ms
+	end
+	return nil
+end
+
+-- save mirrors ratelimiter.WindowCheck.Expiration: the counter is kept until its window
+-- ends, its block ends and its violations are forgotten, whichever comes last
+local function save(w)
+	local until_ms = w.last_reset + w.window
+	local blocked = blocked_until(w)
+	if blocked and blocked > until_ms then
+		until_ms = blocked
+	end
+	if w.violations > 0 and w.factor > 1 and w.violated_at then
+		until_ms = math.max(until_ms, w.violated_at + w.decay * w.violations)
+	end
+	store(w.key, w, math.max(until_ms - now, 1), encoding)
+end
+
+for _, w in ipairs(windows) do
+	if now - w.last_reset >= w.window then
+		w.count = 0
+		w.last_reset = now
+		if not blocked_until(w) then
+			w.blocked_at = nil
+		end
+	end
+end
+
+local refused = nil
+local retry_after = 0
+for _, w in ipairs(windows) do
+	local until_ms = blocked_until(w)
+	if until_ms then
+		refused = refused or w
+		retry_after = math.max(retry_after, until_ms - now)
+	end
+end
+if refused then
+	return { 0, refused.limit, 0, refused.last_reset + refused.window, retry_after }
+end
+
+for _, w in ipairs(windows) do
+	if w.count + cost > w.limit then
+		w.blocked_at = now
+		if w.factor > 1 then
+			local violations = w.violations
+			if w.decay > 0 and violations > 0 and w.violated_at then
+				violations = violations - math.floor((now - w.violated_at) / w.decay)
+			end
+			w.violations = math.max(violations, 0) + 1
+			w.violated_at = now
+		end
+		save(w)
+		refused = refused or w
+		retry_after = math.max(retry_after, block_for(w, w.violations))
+	end
+end
+if refused then
+	return { 0, refused.limit, 0, refused.last_reset + refused.window, retry_after }
+end
+
+local tightest = nil
+for _, w in ipairs(windows) do
+	w.count = w.count + cost
+	save(w)
+	if not tightest or w.limit - w.count < tightest.limit - tightest.count then
+		tightest = w
+	end
+end
+return { 1, tightest.limit, tightest.limit - tightest.count, tightest.last_reset + tightest.window, 0 }
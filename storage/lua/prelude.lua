@@ -0,0 +1,147 @@
+-- rate-limiter script bundle, prepended to every script of storage/lua.
+-- Counters are stored as the JSON or the binary encoding of ratelimiter.RateLimit, so
+-- the scripts convert their RFC 3339 times or Unix microseconds to and from Unix
+-- milliseconds.
+
+local ZERO_TIME = "0001-01-01T00:00:00Z"
+
+-- the layout of RateLimit.MarshalBinary: a version byte and five big endian int64
+local BINARY_VERSION = 1
+local BINARY_FORMAT = ">Bi8i8i8i8i8"
+
+local function days_from_civil(y, m, d)
+	if m <= 2 then
+		y = y - 1
+	end
+	local era = math.floor(y / 400)
+	local yoe = y - era * 400
+	local doy = math.floor((153 * ((m + 9) % 12) + 2) / 5) + d - 1
+	local doe = yoe * 365 + math.floor(yoe / 4) - math.floor(yoe / 100) + doy
+	return era * 146097 + doe - 719468
+end
+
+local function civil_from_days(z)
+	z = z + 719468
+	local era = math.floor(z / 146097)
+	local doe = z - era * 146097
+	local yoe = math.floor((doe - math.floor(doe / 1460) + math.floor(doe / 36524) - math.floor(doe / 146096)) / 365)
+	local doy = doe - (365 * yoe + math.floor(yoe / 4) - math.floor(yoe / 100))
+	local mp = math.floor((5 * doy + 2) / 153)
+	local d = doy - math.floor((153 * mp + 2) / 5) + 1
+	local m = mp < 10 and mp + 3 or mp - 9
+	local y = yoe + era * 400
+	if m <= 2 then
+		y = y + 1
+	end
+	return y, m, d
+end
+
+-- parse_time returns the Unix milliseconds of an RFC 3339 time, nil for the zero time
+local function parse_time(value)
+	if type(value) ~= "string" then
+		return nil
+	end
+	local y, mo, d, h, mi, s, frac, zone = string.match(value, "^(%d+)%-(%d+)%-(%d+)T(%d+):(%d+):(%d+)(%.?%d*)(.*)$")
+	if not y or tonumber(y) <= 1 then
+		return nil
+	end
+
+	local ms = (days_from_civil(tonumber(y), tonumber(mo), tonumber(d)) * 86400 + tonumber(h) * 3600 + tonumber(mi) * 60 + tonumber(s)) * 1000
+	if #frac > 1 then
+		ms = ms + math.floor(tonumber("0" .. frac) * 1000)
+	end
+
+	local sign, zh, zm = string.match(zone, "^([+-])(%d+):(%d+)$")
+	if sign then
+		local offset = (tonumber(zh) * 60 + tonumber(zm)) * 60000
+		if sign == "+" then
+			ms = ms - offset
+		else
+			ms = ms + offset
+		end
+	end
+	return ms
+end
+
+-- format_time returns the RFC 3339 UTC time of Unix milliseconds, the zero time for nil
+local function format_time(ms)
+	if not ms then
+		return ZERO_TIME
+	end
+	local days = math.floor(ms / 86400000)
+	local rest = ms - days * 86400000
+	local y, m, d = civil_from_days(days)
+	return string.format("%04d-%02d-%02dT%02d:%02d:%02d.%03dZ", y, m, d,
+		math.floor(rest / 3600000), math.floor(rest / 60000) % 60, math.floor(rest / 1000) % 60, rest % 1000)
+end
+
+-- from_micros returns the Unix milliseconds of Unix microseconds, nil for 0
+local function from_micros(us)
+	if us == 0 then
+		return nil
+	end
+	return math.floor(us / 1000)
+end
+
+-- to_micros returns the Unix microseconds of Unix milliseconds, 0 for nil
+local function to_micros(ms)
+	if not ms then
+		return 0
+	end
+	return ms * 1000
+end
+
+-- load reads the counter of key in either encoding, with its times in Unix milliseconds
+-- (nil for the zero time), or returns nil when the key is missing
+local function load(key)
+	local data = redis.call("GET", key)
+	if not data then
+		return nil
+	end
+
+	if string.sub(data, 1, 1) == "{" then
+		local state = cjson.decode(data)
+		return {
+			count = tonumber(state.Count) or 0,
+			last_reset = parse_time(state.LastReset),
+			blocked_at = parse_time(state.BlockedAt),
+			violations = tonumber(state.Violations) or 0,
+			violated_at = parse_time(state.ViolatedAt),
+		}
+	end
+
+	local version, count, last_reset, blocked_at, violations, violated_at = struct.unpack(BINARY_FORMAT, data)
+	if version ~= BINARY_VERSION then
+		error("unknown counter encoding version " .. tostring(version))
+	end
+	return {
+		count = count,
+		last_reset = from_micros(last_reset),
+		blocked_at = from_micros(blocked_at),
+		violations = violations,
+		violated_at = from_micros(violated_at),
+	}
+end
+
+-- store writes a counter loaded by load in the encoding, expiring after ttl
+-- milliseconds when ttl is positive
+local function store(key, state, ttl, encoding)
+	local data
+	if encoding == "binary" then
+		data = struct.pack(BINARY_FORMAT, BINARY_VERSION, state.count, to_micros(state.last_reset),
+			to_micros(state.blocked_at), state.violations, to_micros(state.violated_at))
+	else
+		data = cjson.encode({
+			Count = state.count,
+			LastReset = format_time(state.last_reset),
+			BlockedAt = format_time(state.blocked_at),
+			Violations = state.violations,
+			ViolatedAt = format_time(state.violated_at),
+		})
+	end
+	if ttl > 0 then
+		redis.call("SET", key, data, "PX", ttl)
+	else
+		redis.call("SET", key, data)
+	end
+end
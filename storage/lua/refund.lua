@@ -0,0 +1,21 @@
+-- refund takes a cost back from the counter of KEYS[1], never below zero and keeping its
+-- expiration. A missing counter, or one reset after the time the cost was consumed, is
+-- left alone.
+--
+-- ARGV: cost, time the cost was consumed (Unix ms), counter encoding (json or binary)
+-- Returns: 1 when the counter was refunded, 0 otherwise
+
+local state = load(KEYS[1])
+if not state or (state.last_reset or 0) > tonumber(ARGV[2]) then
+	return 0
+end
+
+-- PTTL is -1 for a counter that never expires, which store keeps that way
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl == 0 then
+	return 0
+end
+
+state.count = math.max(state.count - tonumber(ARGV[1]), 0)
+store(KEYS[1], state, ttl, ARGV[3])
+return 1
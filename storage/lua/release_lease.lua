@@ -0,0 +1,8 @@
+-- release_lease deletes the lease of KEYS[1] when ARGV[1] holds it
+--
+-- ARGV: holder
+
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
@@ -0,0 +1,517 @@
+package storage
+
+import (
+	"context"
+	"maps"
+	ratelimiter "rate-limiter"
+	"sort"
+	"sync"
+	"time"
+)
+
+const memoryCleanupEvery = 1000
+
+type memoryEntry struct {
+	rateLimit ratelimiter.RateLimit
+	expiresAt time.Time
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+// MemoryStorage keeps everything in process memory. Data is lost on restart and
+// not shared between instances.
+type MemoryStorage struct {
+	mu           sync.Mutex
+	entries      map[string]memoryEntry
+	bans         map[string]ratelimiter.Ban
+	tokenConfigs map[string]ratelimiter.TokenConfig
+	usage        map[string]map[int64]*memoryUsageBucket
+	leases       map[string]memoryLease
+	writes       int
+	clock        ratelimiter.Clock
+
+	blockHandlers map[int]func(ratelimiter.BlockEvent)
+	nextHandler   int
+}
+
+type memoryLease struct {
+	holder    string
+	expiresAt time.Time
+}
+
+type memoryUsageBucket struct {
+	counts    map[string]int64
+	expiresAt time.Time
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		entries:      make(map[string]memoryEntry),
+		bans:         make(map[string]ratelimiter.Ban),
+		tokenConfigs: make(map[string]ratelimiter.TokenConfig),
+		usage:        make(map[string]map[int64]*memoryUsageBucket),
+		leases:       make(map[string]memoryLease),
+		clock:        ratelimiter.SystemClock,
+
+		blockHandlers: make(map[int]func(ratelimiter.BlockEvent)),
+	}
+}
+
+// SetClock sets the clock the expirations are measured with
+func (m *MemoryStorage) SetClock(clock ratelimiter.Clock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clock = clock
+}
+
+func (m *MemoryStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLimit, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.get(key, m.clock.Now()), nil
+}
+
+// get returns a copy of the counter, the lock must be held
+func (m *MemoryStorage) get(key string, now time.Time) *ratelimiter.RateLimit {
+	entry, exists := m.entries[key]
+	if !exists {
+		return nil
+	}
+	if entry.expired(now) {
+		delete(m.entries, key)
+		return nil
+	}
+
+	rateLimit := entry.rateLimit
+	return &rateLimit
+}
+
+func (m *MemoryStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.set(key, rateLimit, expiration)
+	return nil
+}
+
+// GetMulti reads the counters under a single hold of the lock
+func (m *MemoryStorage) GetMulti(ctx context.Context, keys []string) ([]*ratelimiter.RateLimit, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.clock.Now()
+	rateLimits := make([]*ratelimiter.RateLimit, len(keys))
+	for i, key := range keys {
+		rateLimits[i] = m.get(key, now)
+	}
+	return rateLimits, nil
+}
+
+// SetMulti writes the counters under a single hold of the lock
+func (m *MemoryStorage) SetMulti(ctx context.Context, entries []ratelimiter.RateLimitEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, entry := range entries {
+		m.set(entry.Key, entry.RateLimit, entry.Expiration)
+	}
+	return nil
+}
+
+// set stores the counter, the lock must be held
+func (m *MemoryStorage) set(key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) {
+	entry := memoryEntry{rateLimit: *rateLimit}
+	if expiration > 0 {
+		entry.expiresAt = m.clock.Now().Add(expiration)
+	}
+	m.entries[key] = entry
+
+	m.writes++
+	if m.writes%memoryCleanupEvery == 0 {
+		m.cleanupExpired()
+	}
+}
+
+// AllowWindows runs the whole check under the storage lock
+func (m *MemoryStorage) AllowWindows(ctx context.Context, checks []ratelimiter.WindowCheck, cost int, now time.Time) (ratelimiter.Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.allowWindows(checks, cost, now), nil
+}
+
+// AllowWindowsBatch runs the calls in order under a single hold of the storage lock
+func (m *MemoryStorage) AllowWindowsBatch(ctx context.Context, calls []*ratelimiter.WindowCall) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, call := range calls {
+		call.Result = m.allowWindows(call.Checks, call.Cost, call.Now)
+	}
+}
+
+func (m *MemoryStorage) allowWindows(checks []ratelimiter.WindowCheck, cost int, now time.Time) ratelimiter.Result {
+	// a request rarely has more than a few windows, keep their state on the stack
+	var buffer [4]ratelimiter.RateLimit
+	var pointers [4]*ratelimiter.RateLimit
+	values, states := buffer[:0], pointers[:0]
+	for _, check := range checks {
+		value := ratelimiter.RateLimit{LastReset: now}
+		if entry, exists := m.entries[check.Key]; exists && !entry.expired(now) {
+			value = entry.rateLimit
+		}
+		values = append(values, value)
+	}
+	for i := range values {
+		states = append(states, &values[i])
+	}
+
+	result := ratelimiter.ApplyWindows(states, checks, cost, now)
+	for i, check := range checks {
+		if ratelimiter.WindowChanged(result, states[i], now) {
+			m.set(check.Key, states[i], check.Expiration(states[i], now))
+		}
+	}
+	return result
+}
+
+// Consume adds cost to the counter of the key under the storage lock
+func (m *MemoryStorage) Consume(ctx context.Context, key string, cost int, start time.Time, expiration time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rateLimit := &ratelimiter.RateLimit{LastReset: start}
+	if entry, exists := m.entries[key]; exists && !entry.expired(m.clock.Now()) {
+		rateLimit = &entry.rateLimit
+	}
+	rateLimit.Count += cost
+	m.set(key, rateLimit, expiration)
+
+	return rateLimit.Count, nil
+}
+
+// Refund takes cost back from the counter of the key under the storage lock
+func (m *MemoryStorage) Refund(ctx context.Context, key string, cost int, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, exists := m.entries[key]
+	if !exists || entry.expired(m.clock.Now()) || entry.rateLimit.LastReset.After(at) {
+		return nil
+	}
+	entry.rateLimit.Count = max(entry.rateLimit.Count-cost, 0)
+	m.entries[key] = entry
+	return nil
+}
+
+func (m *MemoryStorage) cleanupExpired() {
+	now := m.clock.Now()
+	for key, entry := range m.entries {
+		if entry.expired(now) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+func (m *MemoryStorage) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *MemoryStorage) List(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.clock.Now()
+	keys := make([]string, 0, len(m.entries))
+	for key, entry := range m.entries {
+		if !entry.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (m *MemoryStorage) AddBan(ctx context.Context, ban *ratelimiter.Ban) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.bans[ban.Value] = *ban
+	return nil
+}
+
+func (m *MemoryStorage) RemoveBan(ctx context.Context, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.bans, value)
+	return nil
+}
+
+func (m *MemoryStorage) ListBans(ctx context.Context) ([]*ratelimiter.Ban, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bans := make([]*ratelimiter.Ban, 0, len(m.bans))
+	for _, ban := range m.bans {
+		ban := ban
+		bans = append(bans, &ban)
+	}
+
+	return bans, nil
+}
+
+func (m *MemoryStorage) SetTokenConfig(ctx context.Context, tokenConfig *ratelimiter.TokenConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tokenConfigs[tokenConfig.Name] = *tokenConfig
+	return nil
+}
+
+func (m *MemoryStorage) DeleteTokenConfig(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.tokenConfigs, name)
+	return nil
+}
+
+func (m *MemoryStorage) ListTokenConfigs(ctx context.Context) ([]*ratelimiter.TokenConfig, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tokenConfigs := make([]*ratelimiter.TokenConfig, 0, len(m.tokenConfigs))
+	for _, tokenConfig := range m.tokenConfigs {
+		tokenConfig := tokenConfig
+		tokenConfigs = append(tokenConfigs, &tokenConfig)
+	}
+
+	return tokenConfigs, nil
+}
+
+func (m *MemoryStorage) AddUsage(ctx context.Context, period string, start time.Time, counts map[string]int64, retention time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buckets, exists := m.usage[period]
+	if !exists {
+		buckets = make(map[int64]*memoryUsageBucket)
+		m.usage[period] = buckets
+	}
+
+	bucket, exists := buckets[start.Unix()]
+	if !exists {
+		bucket = &memoryUsageBucket{counts: make(map[string]int64)}
+		buckets[start.Unix()] = bucket
+	}
+	for key, count := range counts {
+		bucket.counts[key] += count
+	}
+	bucket.expiresAt = m.clock.Now().Add(retention)
+
+	return nil
+}
+
+func (m *MemoryStorage) TakeUsage(ctx context.Context, period string, before time.Time) ([]*ratelimiter.UsageRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	records := m.usageRecords(period, func(start int64) bool { return start < before.Unix() })
+	for _, record := range records {
+		delete(m.usage[period], record.Start.Unix())
+	}
+
+	return records, nil
+}
+
+func (m *MemoryStorage) ListUsage(ctx context.Context, period string, from, to time.Time) ([]*ratelimiter.UsageRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.usageRecords(period, func(start int64) bool {
+		return start >= from.Unix() && start <= to.Unix()
+	}), nil
+}
+
+// usageRecords returns the unexpired records of the buckets whose start matches, oldest first
+func (m *MemoryStorage) usageRecords(period string, match func(start int64) bool) []*ratelimiter.UsageRecord {
+	now := m.clock.Now()
+	records := make([]*ratelimiter.UsageRecord, 0)
+
+	for start, bucket := range m.usage[period] {
+		if now.After(bucket.expiresAt) {
+			delete(m.usage[period], start)
+			continue
+		}
+		if !match(start) {
+			continue
+		}
+		for key, count := range bucket.counts {
+			records = append(records, &ratelimiter.UsageRecord{
+				Key:    key,
+				Period: period,
+				Start:  time.Unix(start, 0).UTC(),
+				Count:  count,
+			})
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].Start.Equal(records[j].Start) {
+			return records[i].Start.Before(records[j].Start)
+		}
+		return records[i].Key < records[j].Key
+	})
+
+	return records
+}
+
+func (m *MemoryStorage) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.clock.Now()
+	if lease, exists := m.leases[name]; exists && lease.holder != holder && now.Before(lease.expiresAt) {
+		return false, nil
+	}
+
+	m.leases[name] = memoryLease{holder: holder, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *MemoryStorage) ReleaseLease(ctx context.Context, name, holder string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if lease, exists := m.leases[name]; exists && lease.holder == holder {
+		delete(m.leases, name)
+	}
+	return nil
+}
+
+// PublishBlock hands the event to the subscribers of this process before returning
+func (m *MemoryStorage) PublishBlock(ctx context.Context, event ratelimiter.BlockEvent) error {
+	m.mu.Lock()
+	handlers := make([]func(ratelimiter.BlockEvent), 0, len(m.blockHandlers))
+	for _, handler := range m.blockHandlers {
+		handlers = append(handlers, handler)
+	}
+	m.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+	return nil
+}
+
+func (m *MemoryStorage) SubscribeBlocks(ctx context.Context, handler func(ratelimiter.BlockEvent)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := m.nextHandler
+	m.nextHandler++
+	m.blockHandlers[id] = handler
+	context.AfterFunc(ctx, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.blockHandlers, id)
+	})
+	return nil
+}
+
+func (m *MemoryStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryStorage) Close() error {
+	return nil
+}
+
+// memoryState is what MemoryStorage holds that outlives a restart, saved by DiskStorage.
+// Leases are left out: their holders are gone after a restart.
+type memoryState struct {
+	Entries      map[string]memoryStateEntry            `json:"entries"`
+	Bans         []ratelimiter.Ban                      `json:"bans"`
+	TokenConfigs []ratelimiter.TokenConfig              `json:"token_configs"`
+	Usage        map[string]map[int64]memoryStateBucket `json:"usage"`
+}
+
+type memoryStateEntry struct {
+	RateLimit ratelimiter.RateLimit `json:"rate_limit"`
+	ExpiresAt time.Time             `json:"expires_at,omitempty"`
+}
+
+type memoryStateBucket struct {
+	Counts    map[string]int64 `json:"counts"`
+	ExpiresAt time.Time        `json:"expires_at"`
+}
+
+// state copies the unexpired data of the storage
+func (m *MemoryStorage) state() memoryState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.clock.Now()
+	state := memoryState{
+		Entries: make(map[string]memoryStateEntry, len(m.entries)),
+		Usage:   make(map[string]map[int64]memoryStateBucket, len(m.usage)),
+	}
+	for key, entry := range m.entries {
+		if !entry.expired(now) {
+			state.Entries[key] = memoryStateEntry{RateLimit: entry.rateLimit, ExpiresAt: entry.expiresAt}
+		}
+	}
+	for _, ban := range m.bans {
+		state.Bans = append(state.Bans, ban)
+	}
+	for _, tokenConfig := range m.tokenConfigs {
+		state.TokenConfigs = append(state.TokenConfigs, tokenConfig)
+	}
+	for period, buckets := range m.usage {
+		state.Usage[period] = make(map[int64]memoryStateBucket, len(buckets))
+		for start, bucket := range buckets {
+			if now.Before(bucket.expiresAt) {
+				state.Usage[period][start] = memoryStateBucket{Counts: maps.Clone(bucket.counts), ExpiresAt: bucket.expiresAt}
+			}
+		}
+	}
+	return state
+}
+
+// restore loads a saved state, skipping what expired in the meantime
+func (m *MemoryStorage) restore(state memoryState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.clock.Now()
+	for key, saved := range state.Entries {
+		if entry := (memoryEntry{rateLimit: saved.RateLimit, expiresAt: saved.ExpiresAt}); !entry.expired(now) {
+			m.entries[key] = entry
+		}
+	}
+	for _, ban := range state.Bans {
+		m.bans[ban.Value] = ban
+	}
+	for _, tokenConfig := range state.TokenConfigs {
+		m.tokenConfigs[tokenConfig.Name] = tokenConfig
+	}
+	for period, buckets := range state.Usage {
+		for start, saved := range buckets {
+			if !now.Before(saved.ExpiresAt) {
+				continue
+			}
+			if m.usage[period] == nil {
+				m.usage[period] = make(map[int64]*memoryUsageBucket)
+			}
+			m.usage[period][start] = &memoryUsageBucket{counts: saved.Counts, expiresAt: saved.ExpiresAt}
+		}
+	}
+}
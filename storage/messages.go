@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Message IDs of the error bodies that can be translated
+const (
+	MessageRateLimited   = "rate_limited"
+	MessageDenied        = "denied"
+	MessageInvalidAPIKey = "invalid_api_key"
+	MessageQuotaExceeded = "quota_exceeded"
+	MessageTokenRequired = "token_required"
+)
+
+var messageIDs = map[string]bool{
+	MessageRateLimited:   true,
+	MessageDenied:        true,
+	MessageInvalidAPIKey: true,
+	MessageQuotaExceeded: true,
+	MessageTokenRequired: true,
+}
+
+// LoadMessageTranslations reads a JSON translations file such as
+// {"pt-BR": {"rate_limited": "limite atingido, tente em {retry_after}s"}}, keyed by
+// lowercase language tag and message ID
+func LoadMessageTranslations(path string) (map[string]map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read messages file: %w", err)
+	}
+
+	var raw map[string]map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse messages file: %w", err)
+	}
+
+	translations := make(map[string]map[string]string, len(raw))
+	for language, messages := range raw {
+		for id := range messages {
+			if !messageIDs[id] {
+				return nil, fmt.Errorf("unknown message %q for language %s", id, language)
+			}
+		}
+		translations[strings.ToLower(language)] = messages
+	}
+	return translations, nil
+}
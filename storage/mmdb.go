@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker starts the metadata section at the end of a MaxMind DB file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errInvalidMMDB = errors.New("invalid MaxMind database")
+
+// MMDBReader looks IPs up in a MaxMind DB file, the format of the GeoLite2 databases,
+// held in memory. Records decode to map[string]any, []any, string, uint64, int64,
+// float64, bool and []byte values.
+type MMDBReader struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+}
+
+// OpenMMDB reads the database at path into memory
+func OpenMMDB(path string) (*MMDBReader, error) {
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newMMDBReader(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return reader, nil
+}
+
+func newMMDBReader(buffer []byte) (*MMDBReader, error) {
+	start := bytes.LastIndex(buffer, mmdbMetadataMarker)
+	if start < 0 {
+		return nil, fmt.Errorf("%w: no metadata", errInvalidMMDB)
+	}
+	metadata := mmdbDecoder{data: buffer[start+len(mmdbMetadataMarker):]}
+	value, _, err := metadata.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", errInvalidMMDB)
+	}
+
+	nodeCount, _ := fields["node_count"].(uint64)
+	recordSize, _ := fields["record_size"].(uint64)
+	ipVersion, _ := fields["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("%w: unsupported record size %d", errInvalidMMDB, recordSize)
+	}
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("%w: unsupported IP version %d", errInvalidMMDB, ipVersion)
+	}
+
+	treeSize := nodeCount * recordSize / 4
+	if treeSize+16 > uint64(start) {
+		return nil, fmt.Errorf("%w: search tree overflows the file", errInvalidMMDB)
+	}
+	return &MMDBReader{
+		tree:       buffer[:treeSize],
+		data:       buffer[treeSize+16 : start],
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+	}, nil
+}
+
+// Lookup returns the record of the network containing the IP, or nil when the database
+// has none
+func (r *MMDBReader) Lookup(ip net.IP) (any, error) {
+	address := ip.To4()
+	if address == nil {
+		if r.ipVersion == 4 {
+			return nil, nil
+		}
+		address = ip.To16()
+	} else if r.ipVersion == 6 {
+		// IPv4 addresses live under ::/96 of an IPv6 tree
+		address = append(make(net.IP, 12), address...)
+	}
+
+	node := uint(0)
+	for i := 0; i < len(address)*8 && node < r.nodeCount; i++ {
+		bit := uint(address[i/8]>>(7-i%8)) & 1
+		node = r.record(node, bit)
+	}
+	if node <= r.nodeCount {
+		return nil, nil
+	}
+
+	decoder := mmdbDecoder{data: r.data}
+	value, _, err := decoder.decode(node - r.nodeCount - 16)
+	return value, err
+}
+
+// record reads the left (0) or right (1) record of a node of the search tree
+func (r *MMDBReader) record(node, bit uint) uint {
+	b := r.tree[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// mmdbDecoder decodes the values of the data section of a MaxMind DB
+type mmdbDecoder struct {
+	data []byte
+}
+
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBoolean
+	mmdbFloat
+)
+
+// decode returns the value at the offset and the offset following it
+func (d mmdbDecoder) decode(offset uint) (any, uint, error) {
+	kind, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if kind == mmdbPointer {
+		// the value pointed to never is another pointer
+		value, _, err := d.decode(size)
+		return value, offset, err
+	}
+	if kind == mmdbBoolean {
+		return size != 0, offset, nil
+	}
+	if kind == mmdbMap {
+		value := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			var key, field any
+			if key, offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			if field, offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: map key is not a string", errInvalidMMDB)
+			}
+			value[name] = field
+		}
+		return value, offset, nil
+	}
+	if kind == mmdbArray {
+		value := make([]any, size)
+		for i := range value {
+			if value[i], offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+		}
+		return value, offset, nil
+	}
+
+	if uint(len(d.data)) < offset+size {
+		return nil, 0, fmt.Errorf("%w: value overflows the data section", errInvalidMMDB)
+	}
+	payload := d.data[offset : offset+size]
+	offset += size
+	switch kind {
+	case mmdbString:
+		return string(payload), offset, nil
+	case mmdbBytes, mmdbUint128:
+		return payload, offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w: double of %d bytes", errInvalidMMDB, size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w: float of %d bytes", errInvalidMMDB, size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(payload))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("%w: integer of %d bytes", errInvalidMMDB, size)
+		}
+		var value uint64
+		for _, b := range payload {
+			value = value<<8 | uint64(b)
+		}
+		return value, offset, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("%w: integer of %d bytes", errInvalidMMDB, size)
+		}
+		var value uint32
+		for _, b := range payload {
+			value = value<<8 | uint32(b)
+		}
+		return int64(int32(value)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("%w: unknown type %d", errInvalidMMDB, kind)
+}
+
+// control reads the control byte of a value and its extensions, returning its type, its
+// size (the target offset for pointers) and the offset of its payload
+func (d mmdbDecoder) control(offset uint) (kind, size, next uint, err error) {
+	read := func(n uint) ([]byte, error) {
+		if uint(len(d.data)) < offset+n {
+			return nil, fmt.Errorf("%w: value overflows the data section", errInvalidMMDB)
+		}
+		b := d.data[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+
+	b, err := read(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	ctrl := b[0]
+	kind = uint(ctrl >> 5)
+
+	if kind == mmdbPointer {
+		length := uint(ctrl>>3)&0x3 + 1
+		if b, err = read(length); err != nil {
+			return 0, 0, 0, err
+		}
+		var pointer uint
+		if length < 4 {
+			pointer = uint(ctrl & 0x7)
+		}
+		for _, v := range b {
+			pointer = pointer<<8 | uint(v)
+		}
+		switch length {
+		case 2:
+			pointer += 2048
+		case 3:
+			pointer += 526336
+		}
+		return kind, pointer, offset, nil
+	}
+
+	if kind == mmdbExtended {
+		if b, err = read(1); err != nil {
+			return 0, 0, 0, err
+		}
+		kind = 7 + uint(b[0])
+	}
+
+	size = uint(ctrl & 0x1f)
+	if size >= 29 {
+		length := size - 28
+		if b, err = read(length); err != nil {
+			return 0, 0, 0, err
+		}
+		var extra uint
+		for _, v := range b {
+			extra = extra<<8 | uint(v)
+		}
+		switch length {
+		case 1:
+			size = 29 + extra
+		case 2:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+	return kind, size, offset, nil
+}
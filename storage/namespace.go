@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"context"
+	ratelimiter "rate-limiter"
+	"strings"
+	"time"
+)
+
+// appKeyPrefix starts every key, ban, token config and usage key of an app namespace:
+// app:<namespace>:<key>
+const appKeyPrefix = "app:"
+
+// NamespacedStorage prefixes every key and ban of an underlying storage so several
+// applications can share one backend without collisions
+type NamespacedStorage struct {
+	storage ratelimiter.Storage
+	prefix  string
+}
+
+func NewNamespacedStorage(storage ratelimiter.Storage, namespace string) ratelimiter.Storage {
+	return &NamespacedStorage{
+		storage: storage,
+		prefix:  appKeyPrefix + namespace + ":",
+	}
+}
+
+func (n *NamespacedStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLimit, error) {
+	return n.storage.Get(ctx, n.prefix+key)
+}
+
+func (n *NamespacedStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
+	return n.storage.Set(ctx, n.prefix+key, rateLimit, expiration)
+}
+
+func (n *NamespacedStorage) GetMulti(ctx context.Context, keys []string) ([]*ratelimiter.RateLimit, error) {
+	namespaced := make([]string, len(keys))
+	for i, key := range keys {
+		namespaced[i] = n.prefix + key
+	}
+	return n.storage.GetMulti(ctx, namespaced)
+}
+
+func (n *NamespacedStorage) SetMulti(ctx context.Context, entries []ratelimiter.RateLimitEntry) error {
+	namespaced := make([]ratelimiter.RateLimitEntry, len(entries))
+	for i, entry := range entries {
+		namespaced[i] = entry
+		namespaced[i].Key = n.prefix + entry.Key
+	}
+	return n.storage.SetMulti(ctx, namespaced)
+}
+
+// AllowWindows forwards to the underlying storage when it is atomic
+func (n *NamespacedStorage) AllowWindows(ctx context.Context, checks []ratelimiter.WindowCheck, cost int, now time.Time) (ratelimiter.Result, error) {
+	atomic, ok := n.storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return ratelimiter.Result{}, ratelimiter.ErrNotAtomic
+	}
+
+	namespaced := make([]ratelimiter.WindowCheck, len(checks))
+	for i, check := range checks {
+		namespaced[i] = check
+		namespaced[i].Key = n.prefix + check.Key
+	}
+	return atomic.AllowWindows(ctx, namespaced, cost, now)
+}
+
+// Consume forwards to the underlying storage when it is atomic
+func (n *NamespacedStorage) Consume(ctx context.Context, key string, cost int, start time.Time, expiration time.Duration) (int, error) {
+	atomic, ok := n.storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return 0, ratelimiter.ErrNotAtomic
+	}
+	return atomic.Consume(ctx, n.prefix+key, cost, start, expiration)
+}
+
+// Refund forwards to the underlying storage when it is atomic
+func (n *NamespacedStorage) Refund(ctx context.Context, key string, cost int, at time.Time) error {
+	atomic, ok := n.storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return ratelimiter.ErrNotAtomic
+	}
+	return atomic.Refund(ctx, n.prefix+key, cost, at)
+}
+
+func (n *NamespacedStorage) Delete(ctx context.Context, key string) error {
+	return n.storage.Delete(ctx, n.prefix+key)
+}
+
+func (n *NamespacedStorage) List(ctx context.Context) ([]string, error) {
+	keys, err := n.storage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var namespaced []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, n.prefix) {
+			namespaced = append(namespaced, strings.TrimPrefix(key, n.prefix))
+		}
+	}
+
+	return namespaced, nil
+}
+
+func (n *NamespacedStorage) AddBan(ctx context.Context, ban *ratelimiter.Ban) error {
+	namespaced := *ban
+	namespaced.Value = n.prefix + ban.Value
+	return n.storage.AddBan(ctx, &namespaced)
+}
+
+func (n *NamespacedStorage) RemoveBan(ctx context.Context, value string) error {
+	return n.storage.RemoveBan(ctx, n.prefix+value)
+}
+
+func (n *NamespacedStorage) ListBans(ctx context.Context) ([]*ratelimiter.Ban, error) {
+	bans, err := n.storage.ListBans(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var namespaced []*ratelimiter.Ban
+	for _, ban := range bans {
+		if strings.HasPrefix(ban.Value, n.prefix) {
+			ban.Value = strings.TrimPrefix(ban.Value, n.prefix)
+			namespaced = append(namespaced, ban)
+		}
+	}
+
+	return namespaced, nil
+}
+
+func (n *NamespacedStorage) SetTokenConfig(ctx context.Context, tokenConfig *ratelimiter.TokenConfig) error {
+	namespaced := *tokenConfig
+	namespaced.Name = n.prefix + tokenConfig.Name
+	return n.storage.SetTokenConfig(ctx, &namespaced)
+}
+
+func (n *NamespacedStorage) DeleteTokenConfig(ctx context.Context, name string) error {
+	return n.storage.DeleteTokenConfig(ctx, n.prefix+name)
+}
+
+func (n *NamespacedStorage) ListTokenConfigs(ctx context.Context) ([]*ratelimiter.TokenConfig, error) {
+	tokenConfigs, err := n.storage.ListTokenConfigs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var namespaced []*ratelimiter.TokenConfig
+	for _, tokenConfig := range tokenConfigs {
+		if strings.HasPrefix(tokenConfig.Name, n.prefix) {
+			tokenConfig.Name = strings.TrimPrefix(tokenConfig.Name, n.prefix)
+			namespaced = append(namespaced, tokenConfig)
+		}
+	}
+
+	return namespaced, nil
+}
+
+func (n *NamespacedStorage) Close() error {
+	return n.storage.Close()
+}
+
+func (n *NamespacedStorage) AddUsage(ctx context.Context, period string, start time.Time, counts map[string]int64, retention time.Duration) error {
+	namespaced := make(map[string]int64, len(counts))
+	for key, count := range counts {
+		namespaced[n.prefix+key] = count
+	}
+	return n.storage.AddUsage(ctx, period, start, namespaced, retention)
+}
+
+// TakeUsage is not scoped: buckets are shared by every namespace, so the rollup runs
+// against the underlying storage and returns prefixed keys
+func (n *NamespacedStorage) TakeUsage(ctx context.Context, period string, before time.Time) ([]*ratelimiter.UsageRecord, error) {
+	return n.storage.TakeUsage(ctx, period, before)
+}
+
+func (n *NamespacedStorage) ListUsage(ctx context.Context, period string, from, to time.Time) ([]*ratelimiter.UsageRecord, error) {
+	records, err := n.storage.ListUsage(ctx, period, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaced := make([]*ratelimiter.UsageRecord, 0)
+	for _, record := range records {
+		if strings.HasPrefix(record.Key, n.prefix) {
+			scoped := *record
+			scoped.Key = strings.TrimPrefix(record.Key, n.prefix)
+			namespaced = append(namespaced, &scoped)
+		}
+	}
+
+	return namespaced, nil
+}
+
+func (n *NamespacedStorage) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	return n.storage.AcquireLease(ctx, n.prefix+name, holder, ttl)
+}
+
+func (n *NamespacedStorage) ReleaseLease(ctx context.Context, name, holder string) error {
+	return n.storage.ReleaseLease(ctx, n.prefix+name, holder)
+}
+
+func (n *NamespacedStorage) Ping(ctx context.Context) error {
+	return n.storage.Ping(ctx)
+}
+
+// DefaultScopeStorage is the storage of the default scope when apps share its backend.
+// Its keys are not prefixed, so it leaves out the keys, bans, token configs and usage of
+// the app namespaces from its lists: the admin routes of the default scope don't show
+// the data of the apps, and a reload of its denylist leaves their bans alone.
+type DefaultScopeStorage struct {
+	ratelimiter.Storage
+}
+
+func NewDefaultScopeStorage(storage ratelimiter.Storage) *DefaultScopeStorage {
+	return &DefaultScopeStorage{Storage: storage}
+}
+
+func (d *DefaultScopeStorage) List(ctx context.Context) ([]string, error) {
+	keys, err := d.Storage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var scoped []string
+	for _, key := range keys {
+		if !strings.HasPrefix(key, appKeyPrefix) {
+			scoped = append(scoped, key)
+		}
+	}
+
+	return scoped, nil
+}
+
+func (d *DefaultScopeStorage) ListBans(ctx context.Context) ([]*ratelimiter.Ban, error) {
+	bans, err := d.Storage.ListBans(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var scoped []*ratelimiter.Ban
+	for _, ban := range bans {
+		if !strings.HasPrefix(ban.Value, appKeyPrefix) {
+			scoped = append(scoped, ban)
+		}
+	}
+
+	return scoped, nil
+}
+
+func (d *DefaultScopeStorage) ListTokenConfigs(ctx context.Context) ([]*ratelimiter.TokenConfig, error) {
+	tokenConfigs, err := d.Storage.ListTokenConfigs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var scoped []*ratelimiter.TokenConfig
+	for _, tokenConfig := range tokenConfigs {
+		if !strings.HasPrefix(tokenConfig.Name, appKeyPrefix) {
+			scoped = append(scoped, tokenConfig)
+		}
+	}
+
+	return scoped, nil
+}
+
+// ListUsage leaves out the usage of the apps. TakeUsage does not: the rollup of the
+// default scope compacts the buckets of every namespace.
+func (d *DefaultScopeStorage) ListUsage(ctx context.Context, period string, from, to time.Time) ([]*ratelimiter.UsageRecord, error) {
+	records, err := d.Storage.ListUsage(ctx, period, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	scoped := make([]*ratelimiter.UsageRecord, 0)
+	for _, record := range records {
+		if !strings.HasPrefix(record.Key, appKeyPrefix) {
+			scoped = append(scoped, record)
+		}
+	}
+
+	return scoped, nil
+}
+
+// AllowWindows forwards to the underlying storage when it is atomic
+func (d *DefaultScopeStorage) AllowWindows(ctx context.Context, checks []ratelimiter.WindowCheck, cost int, now time.Time) (ratelimiter.Result, error) {
+	atomic, ok := d.Storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return ratelimiter.Result{}, ratelimiter.ErrNotAtomic
+	}
+	return atomic.AllowWindows(ctx, checks, cost, now)
+}
+
+// Consume forwards to the underlying storage when it is atomic
+func (d *DefaultScopeStorage) Consume(ctx context.Context, key string, cost int, start time.Time, expiration time.Duration) (int, error) {
+	atomic, ok := d.Storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return 0, ratelimiter.ErrNotAtomic
+	}
+	return atomic.Consume(ctx, key, cost, start, expiration)
+}
+
+// Refund forwards to the underlying storage when it is atomic
+func (d *DefaultScopeStorage) Refund(ctx context.Context, key string, cost int, at time.Time) error {
+	atomic, ok := d.Storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return ratelimiter.ErrNotAtomic
+	}
+	return atomic.Refund(ctx, key, cost, at)
+}
@@ -0,0 +1,394 @@
+package storage
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	ratelimiter "rate-limiter"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy is a named set of limits assigned as a whole to the IPs, to tokens or to
+// routes, so a tier is one POLICY_<NAME>_* block instead of an entry in every map.
+// Window is the length of the window in seconds, 1 when unset. Burst is the bucket
+// size of leaky_bucket, Concurrency caps the requests of a key in flight at once and
+// Bandwidth caps the response bytes per second of a key; 0 leaves either uncapped.
+// DailyQuota and MonthlyQuota apply to the clients the policy is assigned to, not to
+// route policies, which share the quotas of their client. Windows stack more fixed
+// windows on the one of Limit and Window, a request passing only when it fits in all
+// of them, such as 300 per minute and 5000 per hour on top of 10 per second.
+type Policy struct {
+	Name         string
+	Limit        int
+	BlockTime    int
+	Window       int
+	Windows      []ratelimiter.Window
+	Algorithm    string
+	Burst        int
+	Concurrency  int
+	Bandwidth    int
+	DailyQuota   int
+	MonthlyQuota int
+}
+
+// tierSettings are the TIER_<NAME>_* settings of a tier, the same as a policy's
+var tierSettings = []string{"LIMIT", "BLOCK_TIME", "WINDOWS", "WINDOW", "ALGORITHM", "BURST", "CONCURRENCY", "BANDWIDTH", "DAILY_QUOTA", "MONTHLY_QUOTA"}
+
+// DefaultPolicy is the policy of the IPs and of the tokens without limits of their own:
+// IP_POLICY when set, else IP_RATE_LIMIT and IP_BLOCK_TIME over the fixed window
+func (c Config) DefaultPolicy() Policy {
+	if policy, exists := c.Policies[c.IPPolicy]; exists {
+		return policy
+	}
+	return Policy{
+		Limit:        c.IPRateLimit,
+		BlockTime:    c.IPBlockTime,
+		Algorithm:    ratelimiter.AlgorithmFixedWindow,
+		DailyQuota:   c.IPDailyQuota,
+		MonthlyQuota: c.IPMonthlyQuota,
+	}
+}
+
+// TokenPolicy returns the policy of the token: the one named by TOKEN_<name>_POLICY or
+// TOKEN_<name>_TIER, or the default policy with the DEFAULT_TOKEN_LIMIT, with any
+// TOKEN_<name>_LIMIT, _BLOCK_TIME, _WINDOW, _ALGORITHM, _BURST (or _BUCKET_SIZE),
+// _DAILY_QUOTA and _MONTHLY_QUOTA of the token on top
+func (c Config) TokenPolicy(token string) Policy {
+	policy := c.DefaultPolicy()
+	if c.DefaultTokenLimit > 0 {
+		policy.Limit = c.DefaultTokenLimit
+	}
+	if named, exists := c.Policies[c.TokenPolicies[token]]; exists {
+		policy = named
+	}
+
+	if limit, exists := c.TokenLimits[token]; exists {
+		policy.Limit = limit
+	}
+	if blockTime, exists := c.TokenBlockTimes[token]; exists {
+		policy.BlockTime = blockTime
+	}
+	if window, exists := c.TokenWindows[token]; exists {
+		policy.Window = window
+	}
+	if algorithm := c.TokenAlgorithms[token]; algorithm != "" {
+		policy.Algorithm = algorithm
+	}
+	if size, exists := c.TokenBucketSizes[token]; exists {
+		policy.Burst = size
+	}
+	if quota, exists := c.TokenDailyQuotas[token]; exists {
+		policy.DailyQuota = quota
+	}
+	if quota, exists := c.TokenMonthlyQuotas[token]; exists {
+		policy.MonthlyQuota = quota
+	}
+	return policy
+}
+
+// IdentityPolicy returns the policy of an mTLS identity: the one named by
+// MTLS_IDENTITY_POLICIES, or the default policy, with its MTLS_IDENTITY_LIMITS limit
+// on top
+func (c Config) IdentityPolicy(identity string) Policy {
+	policy := c.DefaultPolicy()
+	if named, exists := c.Policies[c.IdentityPolicies[identity]]; exists {
+		policy = named
+	}
+	if limit, exists := c.IdentityLimits[identity]; exists {
+		policy.Limit = limit
+	}
+	return policy
+}
+
+// loadPolicies reads the policies listed in <prefix>POLICIES from their
+// <prefix>POLICY_<NAME>_* variables over the existing ones
+func loadPolicies(prefix string, config *Config) {
+	for _, name := range getEnvList(prefix + "POLICIES") {
+		loadPolicy(name, prefix+"POLICY_"+strings.ToUpper(name)+"_", config)
+	}
+
+	if name := os.Getenv(prefix + "IP_POLICY"); name != "" {
+		config.IPPolicy = name
+	}
+}
+
+// loadTiers reads the tiers defined by <prefix>TIER_<NAME>_* variables as policies named
+// after the tier in lower case, and the <prefix>TOKEN_<token>_TIER assignments. A token
+// with both a tier and a TOKEN_<token>_POLICY gets the policy.
+func loadTiers(prefix string, config *Config) {
+	tiers := make(map[string]bool)
+	for _, env := range os.Environ() {
+		key, _, _ := strings.Cut(env, "=")
+		rest, found := strings.CutPrefix(key, prefix+"TIER_")
+		if !found {
+			continue
+		}
+		for _, setting := range tierSettings {
+			if name, found := strings.CutSuffix(rest, "_"+setting); found && name != "" {
+				tiers[name] = true
+				break
+			}
+		}
+	}
+	for name := range tiers {
+		loadPolicy(strings.ToLower(name), prefix+"TIER_"+name+"_", config)
+	}
+
+	tokenTiers := make(map[string]string)
+	scanTokenSuffixEnv(prefix+"TOKEN_", "_TIER", tokenTiers)
+	for token, tier := range tokenTiers {
+		if _, exists := config.TokenPolicies[token]; !exists {
+			config.TokenPolicies[token] = strings.ToLower(tier)
+		}
+	}
+}
+
+// loadPolicy reads the <envPrefix>* settings of the policy over its existing ones. A
+// setting left out takes the IP limits and quotas, the fixed window of one second and
+// no concurrency or bandwidth cap.
+func loadPolicy(name, envPrefix string, config *Config) {
+	policy, exists := config.Policies[name]
+	if !exists {
+		policy = Policy{
+			Name:         name,
+			Limit:        config.IPRateLimit,
+			BlockTime:    config.IPBlockTime,
+			Algorithm:    ratelimiter.AlgorithmFixedWindow,
+			DailyQuota:   config.IPDailyQuota,
+			MonthlyQuota: config.IPMonthlyQuota,
+		}
+	}
+
+	policy.Limit = getEnvInt(envPrefix+"LIMIT", policy.Limit)
+	policy.BlockTime = getEnvInt(envPrefix+"BLOCK_TIME", policy.BlockTime)
+	policy.Window = getEnvInt(envPrefix+"WINDOW", policy.Window)
+	if value := os.Getenv(envPrefix + "WINDOWS"); value != "" {
+		windows, err := parseWindows(splitList(value))
+		if err != nil {
+			slog.Warn("Skipping invalid variable", "variable", envPrefix+"WINDOWS", "error", err)
+		} else {
+			policy.Windows = windows
+		}
+	}
+	if algorithm := os.Getenv(envPrefix + "ALGORITHM"); algorithm != "" {
+		policy.Algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+	}
+	policy.Burst = getEnvInt(envPrefix+"BURST", policy.Burst)
+	policy.Concurrency = getEnvInt(envPrefix+"CONCURRENCY", policy.Concurrency)
+	policy.Bandwidth = getEnvInt(envPrefix+"BANDWIDTH", policy.Bandwidth)
+	policy.DailyQuota = getEnvInt(envPrefix+"DAILY_QUOTA", policy.DailyQuota)
+	policy.MonthlyQuota = getEnvInt(envPrefix+"MONTHLY_QUOTA", policy.MonthlyQuota)
+
+	config.Policies[name] = policy
+}
+
+// parseWindows reads "limit/seconds" entries, such as 300/60 for 300 requests a minute
+func parseWindows(entries []string) ([]ratelimiter.Window, error) {
+	windows := make([]ratelimiter.Window, 0, len(entries))
+	for _, entry := range entries {
+		limitValue, lengthValue, found := strings.Cut(entry, "/")
+		limit, limitErr := strconv.Atoi(strings.TrimSpace(limitValue))
+		length, lengthErr := strconv.Atoi(strings.TrimSpace(lengthValue))
+		if !found || limitErr != nil || lengthErr != nil {
+			return nil, fmt.Errorf("invalid window %q: expected limit/seconds", entry)
+		}
+		windows = append(windows, ratelimiter.Window{Limit: limit, Length: time.Duration(length) * time.Second})
+	}
+	return windows, nil
+}
+
+// scanTokenPolicyEnv reads <prefix><token>_POLICY variables
+func scanTokenPolicyEnv(prefix string, policies map[string]string) {
+	scanTokenSuffixEnv(prefix, "_POLICY", policies)
+}
+
+// scanTokenSuffixEnv reads the <prefix><token><suffix> variables into values
+func scanTokenSuffixEnv(prefix, suffix string, values map[string]string) {
+	for _, env := range os.Environ() {
+		pair := strings.SplitN(env, "=", 2)
+		if len(pair) != 2 || !strings.HasPrefix(pair[0], prefix) || !strings.HasSuffix(pair[0], suffix) {
+			continue
+		}
+		token := strings.TrimSuffix(strings.TrimPrefix(pair[0], prefix), suffix)
+		values[token] = strings.TrimSpace(pair[1])
+	}
+}
+
+// parseRoutePolicies reads "[METHOD ]/path/prefix=policy" entries
+func parseRoutePolicies(entries []string) (map[string]string, error) {
+	policies := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		route, name, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" || strings.TrimSpace(route) == "" {
+			return nil, fmt.Errorf("invalid ROUTE_POLICIES entry %q: expected [METHOD ]/path=policy", entry)
+		}
+		policies[strings.Join(strings.Fields(route), " ")] = name
+	}
+	return policies, nil
+}
+
+// Key types a PolicyRule matches: the clients keyed by IP, by API key or JWT, or by
+// mTLS identity. An empty key type matches them all.
+const (
+	KeyTypeIP       = "ip"
+	KeyTypeToken    = "token"
+	KeyTypeIdentity = "identity"
+)
+
+// PolicyRule binds the requests matching the glob pattern Path, matched with path.Match,
+// one of Methods (any method when empty) and KeyType to the policy named Policy
+type PolicyRule struct {
+	Path    string
+	Methods []string
+	KeyType string
+	Policy  string
+}
+
+// String returns the rule as a POLICY_RULES entry: "[METHOD|METHOD ]/glob[ keytype]=policy"
+func (r PolicyRule) String() string {
+	fields := make([]string, 0, 3)
+	if len(r.Methods) > 0 {
+		fields = append(fields, strings.Join(r.Methods, "|"))
+	}
+	fields = append(fields, r.Path)
+	if r.KeyType != "" {
+		fields = append(fields, r.KeyType)
+	}
+	return strings.Join(fields, " ") + "=" + r.Policy
+}
+
+// parsePolicyRules reads "[METHOD|METHOD ]/glob[ keytype]=policy" entries, in order
+func parsePolicyRules(entries []string) ([]PolicyRule, error) {
+	rules := make([]PolicyRule, 0, len(entries))
+	for _, entry := range entries {
+		separator := strings.LastIndex(entry, "=")
+		fields := strings.Fields(entry[:max(separator, 0)])
+		rule := PolicyRule{Policy: strings.TrimSpace(entry[separator+1:])}
+		if len(fields) > 0 && !strings.HasPrefix(fields[0], "/") {
+			rule.Methods = strings.Split(strings.ToUpper(fields[0]), "|")
+			fields = fields[1:]
+		}
+		if len(fields) > 0 {
+			rule.Path = fields[0]
+		}
+		if len(fields) > 1 {
+			rule.KeyType = strings.ToLower(fields[1])
+		}
+		if separator <= 0 || rule.Policy == "" || !strings.HasPrefix(rule.Path, "/") || len(fields) > 2 {
+			return nil, fmt.Errorf("invalid POLICY_RULES entry %q: expected [METHOD|METHOD ]/glob[ keytype]=policy", entry)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// validatePolicies rejects invalid policy settings and assignments of policies that
+// don't exist
+func (c Config) validatePolicies() error {
+	for name, policy := range c.Policies {
+		if name == "" || strings.ContainsAny(name, ": ") {
+			return fmt.Errorf("policy name %q must not be empty or contain colons or spaces", name)
+		}
+		if !ratelimiter.IsAlgorithm(policy.Algorithm) {
+			return fmt.Errorf("POLICY_%s_ALGORITHM must be one of %s, got %q", strings.ToUpper(name), strings.Join(ratelimiter.Algorithms(), ", "), policy.Algorithm)
+		}
+		if policy.BlockTime < 0 || policy.Window < 0 || policy.Burst < 0 || policy.Concurrency < 0 || policy.Bandwidth < 0 {
+			return fmt.Errorf("POLICY_%s_BLOCK_TIME, _WINDOW, _BURST, _CONCURRENCY and _BANDWIDTH must not be negative", strings.ToUpper(name))
+		}
+		if policy.DailyQuota < 0 || policy.MonthlyQuota < 0 {
+			return fmt.Errorf("POLICY_%s_DAILY_QUOTA and _MONTHLY_QUOTA must not be negative", strings.ToUpper(name))
+		}
+		if err := validateWindows(name, policy); err != nil {
+			return err
+		}
+	}
+
+	if _, exists := c.Policies[c.IPPolicy]; c.IPPolicy != "" && !exists {
+		return fmt.Errorf("IP_POLICY %q is not listed in POLICIES", c.IPPolicy)
+	}
+	for token, name := range c.TokenPolicies {
+		if _, exists := c.Policies[name]; !exists {
+			return fmt.Errorf("TOKEN_%s_POLICY or _TIER %q is not a configured policy or tier", token, name)
+		}
+	}
+	for identity, name := range c.IdentityPolicies {
+		if _, exists := c.Policies[name]; !exists {
+			return fmt.Errorf("MTLS_IDENTITY_POLICIES entry %s=%s names a policy not listed in POLICIES", identity, name)
+		}
+	}
+	for country, name := range c.CountryPolicies {
+		if _, exists := c.Policies[name]; !exists {
+			return fmt.Errorf("COUNTRY_POLICIES entry %s=%s names a policy not listed in POLICIES", country, name)
+		}
+	}
+	for asn, name := range c.ASNPolicies {
+		if _, exists := c.Policies[name]; !exists {
+			return fmt.Errorf("ASN_POLICIES entry %s=%s names a policy not listed in POLICIES", asn, name)
+		}
+	}
+	for route, name := range c.RoutePolicies {
+		if _, exists := c.Policies[name]; !exists {
+			return fmt.Errorf("ROUTE_POLICIES entry %s=%s names a policy not listed in POLICIES", route, name)
+		}
+	}
+	for _, rule := range c.PolicyRules {
+		if _, exists := c.Policies[rule.Policy]; !exists {
+			return fmt.Errorf("POLICY_RULES entry %s names a policy not listed in POLICIES", rule)
+		}
+		if _, err := path.Match(rule.Path, "/"); err != nil {
+			return fmt.Errorf("invalid POLICY_RULES pattern %q: %w", rule.Path, err)
+		}
+		switch rule.KeyType {
+		case "", KeyTypeIP, KeyTypeToken, KeyTypeIdentity:
+		default:
+			return fmt.Errorf("POLICY_RULES entry %s must match the %s, %s or %s key type, got %q", rule, KeyTypeIP, KeyTypeToken, KeyTypeIdentity, rule.KeyType)
+		}
+	}
+	return nil
+}
+
+// validateWindows rejects stacked windows that are empty, too short, repeated or on an
+// algorithm other than the fixed window
+func validateWindows(name string, policy Policy) error {
+	if len(policy.Windows) == 0 {
+		return nil
+	}
+	if policy.Algorithm != ratelimiter.AlgorithmFixedWindow {
+		return fmt.Errorf("POLICY_%s_WINDOWS needs the %s algorithm, got %q", strings.ToUpper(name), ratelimiter.AlgorithmFixedWindow, policy.Algorithm)
+	}
+	lengths := make(map[time.Duration]bool, len(policy.Windows))
+	for _, window := range policy.Windows {
+		if window.Limit < 1 || window.Length < time.Second {
+			return fmt.Errorf("POLICY_%s_WINDOWS entries need a positive limit and a window of at least one second", strings.ToUpper(name))
+		}
+		if lengths[window.Length] {
+			return fmt.Errorf("POLICY_%s_WINDOWS has more than one window of %s", strings.ToUpper(name), window.Length)
+		}
+		lengths[window.Length] = true
+	}
+	return nil
+}
+
+// HasConcurrencyPolicy reports whether any policy caps the requests in flight
+func (c Config) HasConcurrencyPolicy() bool {
+	for _, policy := range c.Policies {
+		if policy.Concurrency > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// HasBandwidthPolicy reports whether any policy caps the response bandwidth
+func (c Config) HasBandwidthPolicy() bool {
+	for _, policy := range c.Policies {
+		if policy.Bandwidth > 0 {
+			return true
+		}
+	}
+	return false
+}
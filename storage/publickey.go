@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+)
+
+// LoadRSAPublicKey reads an RSA public key from a PEM certificate, PKIX or PKCS#1 key
+// file
+func LoadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var key any
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		key = cert.PublicKey
+	} else if parsed, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		key = parsed
+	} else if parsed, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		key = parsed
+	}
+	if rsaKey, ok := key.(*rsa.PublicKey); ok {
+		return rsaKey, nil
+	}
+	return nil, errors.New("not an RSA public key")
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	ratelimiter "rate-limiter"
+	"sync/atomic"
+	"time"
+)
+
+// ErrReadOnly is returned for writes the read-only mode cannot drop silently, like
+// admin changes to bans, token configs and counters
+var ErrReadOnly = errors.New("storage is in read-only mode")
+
+// ReadOnlyStorage is the disaster recovery switch for a primary that refuses writes.
+// While read-only, checks keep deciding from the counters already stored but never
+// write them back: counter writes and usage records are dropped, admin writes fail with
+// ErrReadOnly and no instance acquires a lease, so the background jobs pause.
+//
+// A key under its limit stays under it, since its count never grows, and a blocked key
+// stays blocked until its stored block ends. Limits are only as accurate as the
+// counters were when the mode was switched on.
+type ReadOnlyStorage struct {
+	ratelimiter.Storage
+
+	enabled atomic.Bool
+}
+
+func NewReadOnlyStorage(primary ratelimiter.Storage, enabled bool) *ReadOnlyStorage {
+	r := &ReadOnlyStorage{Storage: primary}
+	r.enabled.Store(enabled)
+	return r
+}
+
+// SetReadOnly switches the read-only mode on or off
+func (r *ReadOnlyStorage) SetReadOnly(enabled bool) {
+	r.enabled.Store(enabled)
+}
+
+// IsReadOnly reports whether writes are currently refused
+func (r *ReadOnlyStorage) IsReadOnly() bool {
+	return r.enabled.Load()
+}
+
+func (r *ReadOnlyStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
+	if r.IsReadOnly() {
+		return nil
+	}
+	return r.Storage.Set(ctx, key, rateLimit, expiration)
+}
+
+func (r *ReadOnlyStorage) SetMulti(ctx context.Context, entries []ratelimiter.RateLimitEntry) error {
+	if r.IsReadOnly() {
+		return nil
+	}
+	return r.Storage.SetMulti(ctx, entries)
+}
+
+// AllowWindows falls back to Get and Set while read-only, so the check decides from the
+// stored counters and its write is dropped
+func (r *ReadOnlyStorage) AllowWindows(ctx context.Context, checks []ratelimiter.WindowCheck, cost int, now time.Time) (ratelimiter.Result, error) {
+	atomicStorage, ok := r.Storage.(ratelimiter.AtomicStorage)
+	if !ok || r.IsReadOnly() {
+		return ratelimiter.Result{}, ratelimiter.ErrNotAtomic
+	}
+	return atomicStorage.AllowWindows(ctx, checks, cost, now)
+}
+
+func (r *ReadOnlyStorage) Consume(ctx context.Context, key string, cost int, start time.Time, expiration time.Duration) (int, error) {
+	atomicStorage, ok := r.Storage.(ratelimiter.AtomicStorage)
+	if !ok || r.IsReadOnly() {
+		return 0, ratelimiter.ErrNotAtomic
+	}
+	return atomicStorage.Consume(ctx, key, cost, start, expiration)
+}
+
+func (r *ReadOnlyStorage) Refund(ctx context.Context, key string, cost int, at time.Time) error {
+	atomicStorage, ok := r.Storage.(ratelimiter.AtomicStorage)
+	if !ok || r.IsReadOnly() {
+		return ratelimiter.ErrNotAtomic
+	}
+	return atomicStorage.Refund(ctx, key, cost, at)
+}
+
+func (r *ReadOnlyStorage) Delete(ctx context.Context, key string) error {
+	if r.IsReadOnly() {
+		return ErrReadOnly
+	}
+	return r.Storage.Delete(ctx, key)
+}
+
+func (r *ReadOnlyStorage) AddBan(ctx context.Context, ban *ratelimiter.Ban) error {
+	if r.IsReadOnly() {
+		return ErrReadOnly
+	}
+	return r.Storage.AddBan(ctx, ban)
+}
+
+func (r *ReadOnlyStorage) RemoveBan(ctx context.Context, value string) error {
+	if r.IsReadOnly() {
+		return ErrReadOnly
+	}
+	return r.Storage.RemoveBan(ctx, value)
+}
+
+func (r *ReadOnlyStorage) SetTokenConfig(ctx context.Context, tokenConfig *ratelimiter.TokenConfig) error {
+	if r.IsReadOnly() {
+		return ErrReadOnly
+	}
+	return r.Storage.SetTokenConfig(ctx, tokenConfig)
+}
+
+func (r *ReadOnlyStorage) DeleteTokenConfig(ctx context.Context, name string) error {
+	if r.IsReadOnly() {
+		return ErrReadOnly
+	}
+	return r.Storage.DeleteTokenConfig(ctx, name)
+}
+
+// AddUsage drops the usage of requests served while read-only
+func (r *ReadOnlyStorage) AddUsage(ctx context.Context, period string, start time.Time, counts map[string]int64, retention time.Duration) error {
+	if r.IsReadOnly() {
+		return nil
+	}
+	return r.Storage.AddUsage(ctx, period, start, counts, retention)
+}
+
+// TakeUsage takes nothing while read-only, since taking deletes the records
+func (r *ReadOnlyStorage) TakeUsage(ctx context.Context, period string, before time.Time) ([]*ratelimiter.UsageRecord, error) {
+	if r.IsReadOnly() {
+		return nil, nil
+	}
+	return r.Storage.TakeUsage(ctx, period, before)
+}
+
+// AcquireLease never grants a lease while read-only, so no instance leads
+func (r *ReadOnlyStorage) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	if r.IsReadOnly() {
+		return false, nil
+	}
+	return r.Storage.AcquireLease(ctx, name, holder, ttl)
+}
+
+func (r *ReadOnlyStorage) ReleaseLease(ctx context.Context, name, holder string) error {
+	if r.IsReadOnly() {
+		return nil
+	}
+	return r.Storage.ReleaseLease(ctx, name, holder)
+}
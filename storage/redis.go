@@ -2,40 +2,164 @@ package storage
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"os"
 	ratelimiter "rate-limiter"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+const (
+	denylistKey     = "denylist"
+	tokenConfigsKey = "token_configs"
+	usageKeyPrefix  = "usage:"
+	leaseKeyPrefix  = "lease:"
+	// blocksChannel is the pub/sub channel the block events are relayed on
+	blocksChannel = "blocks"
+)
+
 type RedisStorage struct {
-	client *redis.Client
+	client   redis.UniversalClient
+	encoding string
+	// prefix is prepended to every Redis key, internal ones included
+	prefix string
 }
 
 func NewRedisStorage(config ratelimiter.StorageConfig) (ratelimiter.Storage, error) {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%s", config.Host, config.Port),
-		Password: config.Password,
-		DB:       config.DB,
-	})
+	rdb, err := newRedisClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := loadScripts(ctx, rdb); err != nil {
+		slog.Warn("Lua scripts will be sent on first use", "error", err)
+	}
+
+	return &RedisStorage{
+		client:   rdb,
+		encoding: config.CounterEncoding,
+		prefix:   config.KeyPrefix,
+	}, nil
+}
+
+func redisCredentials(username string, password func() string) func() (string, string) {
+	return func() (string, string) {
+		return username, password()
+	}
+}
+
+// newRedisClient creates a Redis client for the configured mode and checks the connection
+func newRedisClient(config ratelimiter.StorageConfig) (redis.UniversalClient, error) {
+	addresses := config.Addresses
+	if len(addresses) == 0 {
+		addresses = []string{fmt.Sprintf("%s:%s", config.Host, config.Port)}
+	}
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var rdb redis.UniversalClient
+	switch config.Mode {
+	case ratelimiter.RedisModeCluster:
+		clusterOptions := &redis.ClusterOptions{
+			Addrs:     addresses,
+			Password:  config.Password,
+			TLSConfig: tlsConfig,
+		}
+		if config.PasswordProvider != nil {
+			clusterOptions.NewClient = func(opt *redis.Options) *redis.Client {
+				opt.CredentialsProvider = redisCredentials(opt.Username, config.PasswordProvider)
+				return redis.NewClient(opt)
+			}
+		}
+		rdb = redis.NewClusterClient(clusterOptions)
+	case ratelimiter.RedisModeSentinel:
+		if config.MasterName == "" {
+			return nil, fmt.Errorf("sentinel mode requires a master name")
+		}
+		rdb = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       config.MasterName,
+			SentinelAddrs:    addresses,
+			SentinelPassword: config.SentinelPassword,
+			Password:         config.Password,
+			DB:               config.DB,
+			TLSConfig:        tlsConfig,
+		})
+	default:
+		options := &redis.Options{
+			Addr:      addresses[0],
+			Password:  config.Password,
+			DB:        config.DB,
+			TLSConfig: tlsConfig,
+		}
+		if config.PasswordProvider != nil {
+			options.CredentialsProvider = redisCredentials("", config.PasswordProvider)
+		}
+		rdb = redis.NewClient(options)
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err := rdb.Ping(ctx).Result()
+	_, err = rdb.Ping(ctx).Result()
 	if err != nil {
+		rdb.Close()
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	return &RedisStorage{
-		client: rdb,
-	}, nil
+	return rdb, nil
+}
+
+// newTLSConfig builds the TLS configuration for Redis, or nil when TLS is disabled
+func newTLSConfig(config ratelimiter.StorageConfig) (*tls.Config, error) {
+	if !config.TLSEnabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         config.TLSServerName,
+		InsecureSkipVerify: config.TLSInsecureSkipVerify,
+	}
+
+	if config.TLSCACert != "" {
+		caCert, err := os.ReadFile(config.TLSCACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Redis CA certificate: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("failed to parse Redis CA certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.TLSCert != "" || config.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Redis client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
 }
 
 func (r *RedisStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLimit, error) {
-	data, err := r.client.Get(ctx, key).Result()
+	data, err := r.client.Get(ctx, r.prefix+key).Result()
 	if err != nil {
 		if err == redis.Nil {
 			return nil, nil
@@ -43,21 +167,21 @@ func (r *RedisStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLi
 		return nil, fmt.Errorf("failed to get from Redis: %w", err)
 	}
 
-	var rateLimit ratelimiter.RateLimit
-	if err := json.Unmarshal([]byte(data), &rateLimit); err != nil {
+	rateLimit, err := ratelimiter.DecodeRateLimit([]byte(data))
+	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal rate limit: %w", err)
 	}
 
-	return &rateLimit, nil
+	return rateLimit, nil
 }
 
 func (r *RedisStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
-	data, err := json.Marshal(rateLimit)
+	data, err := ratelimiter.EncodeRateLimit(rateLimit, r.encoding)
 	if err != nil {
 		return fmt.Errorf("failed to marshal rate limit: %w", err)
 	}
 
-	err = r.client.Set(ctx, key, data, expiration).Err()
+	err = r.client.Set(ctx, r.prefix+key, data, expiration).Err()
 	if err != nil {
 		return fmt.Errorf("failed to set in Redis: %w", err)
 	}
@@ -65,6 +189,505 @@ func (r *RedisStorage) Set(ctx context.Context, key string, rateLimit *ratelimit
 	return nil
 }
 
+// counterEncoding returns the encoding the scripts write counters in
+func (r *RedisStorage) counterEncoding() string {
+	if r.encoding == ratelimiter.CounterEncodingBinary {
+		return ratelimiter.CounterEncodingBinary
+	}
+	return ratelimiter.CounterEncodingJSON
+}
+
+// GetMulti reads the counters with one pipeline of GETs, which unlike MGET works across
+// the slots of a cluster
+func (r *RedisStorage) GetMulti(ctx context.Context, keys []string) ([]*ratelimiter.RateLimit, error) {
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Get(ctx, r.prefix+key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get from Redis: %w", err)
+	}
+
+	rateLimits := make([]*ratelimiter.RateLimit, len(keys))
+	for i, cmd := range cmds {
+		data, err := cmd.Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get from Redis: %w", err)
+		}
+		if rateLimits[i], err = ratelimiter.DecodeRateLimit(data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal rate limit: %w", err)
+		}
+	}
+	return rateLimits, nil
+}
+
+// SetMulti writes the counters with one pipeline of SETs
+func (r *RedisStorage) SetMulti(ctx context.Context, entries []ratelimiter.RateLimitEntry) error {
+	values := make([][]byte, len(entries))
+	for i, entry := range entries {
+		data, err := ratelimiter.EncodeRateLimit(entry.RateLimit, r.encoding)
+		if err != nil {
+			return fmt.Errorf("failed to marshal rate limit: %w", err)
+		}
+		values[i] = data
+	}
+
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, entry := range entries {
+			pipe.Set(ctx, r.prefix+entry.Key, values[i], entry.Expiration)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set in Redis: %w", err)
+	}
+	return nil
+}
+
+// AllowWindows runs the fixed window check in a single script call
+func (r *RedisStorage) AllowWindows(ctx context.Context, checks []ratelimiter.WindowCheck, cost int, now time.Time) (ratelimiter.Result, error) {
+	if r.spansSlots(checks) {
+		return ratelimiter.Result{}, ratelimiter.ErrNotAtomic
+	}
+	keys, args := r.windowArgs(checks, cost, now)
+	return windowResult(scripts.fixedWindow.Run(ctx, r.client, keys, args...).Int64Slice())
+}
+
+// AllowWindowsBatch runs the script of every call in one pipeline. Redis runs each
+// script atomically in pipeline order; calls refused with NOSCRIPT did not run and are
+// sent again with the script body.
+func (r *RedisStorage) AllowWindowsBatch(ctx context.Context, calls []*ratelimiter.WindowCall) {
+	if len(calls) > 0 && r.spansSlots(calls[0].Checks) {
+		for _, call := range calls {
+			call.Err = ratelimiter.ErrNotAtomic
+		}
+		return
+	}
+	cmds := make([]*redis.Cmd, len(calls))
+	_, _ = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, call := range calls {
+			keys, args := r.windowArgs(call.Checks, call.Cost, call.Now)
+			cmds[i] = scripts.fixedWindow.EvalSha(ctx, pipe, keys, args...)
+		}
+		return nil
+	})
+
+	var reload []int
+	for i, cmd := range cmds {
+		if cmd.Err() != nil && redis.HasErrorPrefix(cmd.Err(), "NOSCRIPT") {
+			reload = append(reload, i)
+		}
+	}
+	if len(reload) > 0 {
+		_, _ = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, i := range reload {
+				keys, args := r.windowArgs(calls[i].Checks, calls[i].Cost, calls[i].Now)
+				cmds[i] = scripts.fixedWindow.Eval(ctx, pipe, keys, args...)
+			}
+			return nil
+		})
+	}
+
+	for i, call := range calls {
+		call.Result, call.Err = windowResult(cmds[i].Int64Slice())
+	}
+}
+
+// spansSlots reports whether the checks may be on several slots of a cluster, which a
+// script can't reach at once; the caller then falls back to GetMulti and SetMulti
+func (r *RedisStorage) spansSlots(checks []ratelimiter.WindowCheck) bool {
+	_, cluster := r.client.(*redis.ClusterClient)
+	return cluster && len(checks) > 1
+}
+
+// windowArgs builds the keys and arguments of the fixed window script
+func (r *RedisStorage) windowArgs(checks []ratelimiter.WindowCheck, cost int, now time.Time) ([]string, []interface{}) {
+	keys := make([]string, len(checks))
+	args := make([]interface{}, 0, 3+6*len(checks))
+	args = append(args, cost, now.UnixMilli(), r.counterEncoding())
+	for i, check := range checks {
+		keys[i] = r.prefix + check.Key
+		escalation := check.Limits.Escalation
+		args = append(args, check.Limits.Limit, check.Window.Milliseconds(), check.Limits.BlockTime.Milliseconds(),
+			escalation.Factor, escalation.MaxBlockTime.Milliseconds(), escalation.Decay.Milliseconds())
+	}
+	return keys, args
+}
+
+// windowResult decodes the reply of the fixed window script
+func windowResult(values []int64, err error) (ratelimiter.Result, error) {
+	if err != nil {
+		return ratelimiter.Result{}, fmt.Errorf("failed to check rate limit in Redis: %w", err)
+	}
+	if len(values) != 5 {
+		return ratelimiter.Result{}, fmt.Errorf("unexpected rate limit script reply: %v", values)
+	}
+
+	return ratelimiter.Result{
+		Allowed:    values[0] == 1,
+		Limit:      int(values[1]),
+		Remaining:  int(values[2]),
+		ResetAt:    time.UnixMilli(values[3]),
+		RetryAfter: time.Duration(values[4]) * time.Millisecond,
+	}, nil
+}
+
+// Consume adds cost to the counter of the key in a single script call
+func (r *RedisStorage) Consume(ctx context.Context, key string, cost int, start time.Time, expiration time.Duration) (int, error) {
+	count, err := scripts.consume.Run(ctx, r.client, []string{r.prefix + key}, cost, start.UnixMilli(), expiration.Milliseconds(), r.counterEncoding()).Int()
+	if err != nil {
+		return 0, fmt.Errorf("failed to consume in Redis: %w", err)
+	}
+
+	return count, nil
+}
+
+// Refund takes cost back from the counter of the key in a single script call
+func (r *RedisStorage) Refund(ctx context.Context, key string, cost int, at time.Time) error {
+	err := scripts.refund.Run(ctx, r.client, []string{r.prefix + key}, cost, at.UnixMilli(), r.counterEncoding()).Err()
+	if err != nil {
+		return fmt.Errorf("failed to refund in Redis: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RedisStorage) Delete(ctx context.Context, key string) error {
+	err := r.client.Del(ctx, r.prefix+key).Err()
+	if err != nil {
+		return fmt.Errorf("failed to delete from Redis: %w", err)
+	}
+
+	return nil
+}
+
+// List returns every rate limit key under the prefix, skipping the keys reserved for
+// internal data. In cluster mode every master is scanned.
+func (r *RedisStorage) List(ctx context.Context) ([]string, error) {
+	cluster, ok := r.client.(*redis.ClusterClient)
+	if !ok {
+		return r.scanKeys(ctx, r.client)
+	}
+
+	var mu sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+		nodeKeys, err := r.scanKeys(ctx, client)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		keys = append(keys, nodeKeys...)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// escapeGlob escapes the characters SCAN MATCH patterns give a meaning to
+func escapeGlob(value string) string {
+	var escaped strings.Builder
+	for _, c := range value {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+func isInternalKey(key string) bool {
+	return strings.HasPrefix(key, usageKeyPrefix) || strings.HasPrefix(key, leaseKeyPrefix)
+}
+
+func (r *RedisStorage) scanKeys(ctx context.Context, client redis.Cmdable) ([]string, error) {
+	var keys []string
+
+	iter := client.Scan(ctx, 0, escapeGlob(r.prefix)+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		if key := strings.TrimPrefix(iter.Val(), r.prefix); key != denylistKey && key != tokenConfigsKey && !isInternalKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan Redis: %w", err)
+	}
+
+	return keys, nil
+}
+
+func (r *RedisStorage) AddBan(ctx context.Context, ban *ratelimiter.Ban) error {
+	data, err := json.Marshal(ban)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ban: %w", err)
+	}
+
+	err = r.client.HSet(ctx, r.prefix+denylistKey, ban.Value, data).Err()
+	if err != nil {
+		return fmt.Errorf("failed to add ban in Redis: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RedisStorage) RemoveBan(ctx context.Context, value string) error {
+	err := r.client.HDel(ctx, r.prefix+denylistKey, value).Err()
+	if err != nil {
+		return fmt.Errorf("failed to remove ban from Redis: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RedisStorage) ListBans(ctx context.Context) ([]*ratelimiter.Ban, error) {
+	entries, err := r.client.HGetAll(ctx, r.prefix+denylistKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bans from Redis: %w", err)
+	}
+
+	bans := make([]*ratelimiter.Ban, 0, len(entries))
+	for _, data := range entries {
+		var ban ratelimiter.Ban
+		if err := json.Unmarshal([]byte(data), &ban); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal ban: %w", err)
+		}
+		bans = append(bans, &ban)
+	}
+
+	return bans, nil
+}
+
+func (r *RedisStorage) SetTokenConfig(ctx context.Context, tokenConfig *ratelimiter.TokenConfig) error {
+	data, err := json.Marshal(tokenConfig)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token config: %w", err)
+	}
+
+	err = r.client.HSet(ctx, r.prefix+tokenConfigsKey, tokenConfig.Name, data).Err()
+	if err != nil {
+		return fmt.Errorf("failed to set token config in Redis: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RedisStorage) DeleteTokenConfig(ctx context.Context, name string) error {
+	err := r.client.HDel(ctx, r.prefix+tokenConfigsKey, name).Err()
+	if err != nil {
+		return fmt.Errorf("failed to delete token config from Redis: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RedisStorage) ListTokenConfigs(ctx context.Context) ([]*ratelimiter.TokenConfig, error) {
+	entries, err := r.client.HGetAll(ctx, r.prefix+tokenConfigsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list token configs from Redis: %w", err)
+	}
+
+	tokenConfigs := make([]*ratelimiter.TokenConfig, 0, len(entries))
+	for _, data := range entries {
+		var tokenConfig ratelimiter.TokenConfig
+		if err := json.Unmarshal([]byte(data), &tokenConfig); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal token config: %w", err)
+		}
+		tokenConfigs = append(tokenConfigs, &tokenConfig)
+	}
+
+	return tokenConfigs, nil
+}
+
+// usageIndexKey is a sorted set of the bucket start times of a period, scored by unix time
+func usageIndexKey(period string) string {
+	return usageKeyPrefix + period
+}
+
+func usageBucketKey(period string, start int64) string {
+	return usageKeyPrefix + period + ":" + strconv.FormatInt(start, 10)
+}
+
+func (r *RedisStorage) AddUsage(ctx context.Context, period string, start time.Time, counts map[string]int64, retention time.Duration) error {
+	bucketKey := r.prefix + usageBucketKey(period, start.Unix())
+	indexKey := r.prefix + usageIndexKey(period)
+
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for key, count := range counts {
+			pipe.HIncrBy(ctx, bucketKey, key, count)
+		}
+		pipe.Expire(ctx, bucketKey, retention)
+		pipe.ZAdd(ctx, indexKey, redis.Z{Score: float64(start.Unix()), Member: start.Unix()})
+		pipe.ZRemRangeByScore(ctx, indexKey, "-inf", "("+strconv.FormatInt(start.Add(-retention).Unix(), 10))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add usage in Redis: %w", err)
+	}
+
+	return nil
+}
+
+// TakeUsage reads and deletes each bucket in a transaction, so concurrent rollups
+// on several instances never count a bucket twice
+func (r *RedisStorage) TakeUsage(ctx context.Context, period string, before time.Time) ([]*ratelimiter.UsageRecord, error) {
+	indexKey := r.prefix + usageIndexKey(period)
+
+	starts, err := r.client.ZRangeByScore(ctx, indexKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatInt(before.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list usage buckets from Redis: %w", err)
+	}
+
+	var records []*ratelimiter.UsageRecord
+	for _, member := range starts {
+		start, err := strconv.ParseInt(member, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		bucketKey := r.prefix + usageBucketKey(period, start)
+		var entries *redis.MapStringStringCmd
+		_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			entries = pipe.HGetAll(ctx, bucketKey)
+			pipe.Del(ctx, bucketKey)
+			return nil
+		})
+		if err != nil {
+			return records, fmt.Errorf("failed to take usage bucket from Redis: %w", err)
+		}
+		if err := r.client.ZRem(ctx, indexKey, member).Err(); err != nil {
+			return records, fmt.Errorf("failed to remove usage bucket from Redis: %w", err)
+		}
+
+		records = append(records, usageRecords(period, start, entries.Val())...)
+	}
+
+	return records, nil
+}
+
+func (r *RedisStorage) ListUsage(ctx context.Context, period string, from, to time.Time) ([]*ratelimiter.UsageRecord, error) {
+	starts, err := r.client.ZRangeByScore(ctx, r.prefix+usageIndexKey(period), &redis.ZRangeBy{
+		Min: strconv.FormatInt(from.Unix(), 10),
+		Max: strconv.FormatInt(to.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list usage buckets from Redis: %w", err)
+	}
+
+	records := make([]*ratelimiter.UsageRecord, 0)
+	for _, member := range starts {
+		start, err := strconv.ParseInt(member, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		entries, err := r.client.HGetAll(ctx, r.prefix+usageBucketKey(period, start)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get usage bucket from Redis: %w", err)
+		}
+		records = append(records, usageRecords(period, start, entries)...)
+	}
+
+	return records, nil
+}
+
+func usageRecords(period string, start int64, entries map[string]string) []*ratelimiter.UsageRecord {
+	records := make([]*ratelimiter.UsageRecord, 0, len(entries))
+	for key, value := range entries {
+		count, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		records = append(records, &ratelimiter.UsageRecord{
+			Key:    key,
+			Period: period,
+			Start:  time.Unix(start, 0).UTC(),
+			Count:  count,
+		})
+	}
+	return records
+}
+
+func (r *RedisStorage) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	acquired, err := scripts.acquireLease.Run(ctx, r.client, []string{r.prefix + leaseKeyPrefix + name}, holder, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire lease in Redis: %w", err)
+	}
+
+	return acquired == 1, nil
+}
+
+func (r *RedisStorage) ReleaseLease(ctx context.Context, name, holder string) error {
+	err := scripts.releaseLease.Run(ctx, r.client, []string{r.prefix + leaseKeyPrefix + name}, holder).Err()
+	if err != nil {
+		return fmt.Errorf("failed to release lease in Redis: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RedisStorage) PublishBlock(ctx context.Context, event ratelimiter.BlockEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode block event: %w", err)
+	}
+	if err := r.client.Publish(ctx, r.prefix+blocksChannel, payload).Err(); err != nil {
+		return fmt.Errorf("failed to publish block event to Redis: %w", err)
+	}
+
+	return nil
+}
+
+// SubscribeBlocks listens on the blocks channel of the prefix. The client resubscribes
+// on its own after a lost connection; the events published meanwhile are missed.
+func (r *RedisStorage) SubscribeBlocks(ctx context.Context, handler func(ratelimiter.BlockEvent)) error {
+	pubsub := r.client.Subscribe(ctx, r.prefix+blocksChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return fmt.Errorf("failed to subscribe to Redis block events: %w", err)
+	}
+
+	go func() {
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				var event ratelimiter.BlockEvent
+				if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+					slog.Warn("Ignoring malformed block event", "error", err)
+					continue
+				}
+				handler(event)
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *RedisStorage) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
 func (r *RedisStorage) Close() error {
 	return r.client.Close()
 }
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	ratelimiter "rate-limiter"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// transientReplies are the Redis error replies of a command that was refused without
+// being run, so running it again can't count a request twice
+var transientReplies = []string{"LOADING ", "TRYAGAIN ", "CLUSTERDOWN ", "MASTERDOWN ", "BUSY "}
+
+// IsTransient reports whether err is a failure worth retrying: the connection could
+// not be made, or Redis refused the command while loading, failing over or busy.
+// Timeouts are not, since the command may have run.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		for _, prefix := range transientReplies {
+			if strings.HasPrefix(redisErr.Error(), prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RetryStorage retries the counter operations of the wrapped storage on transient
+// errors, up to attempts more times, sleeping a jittered backoff that doubles each
+// attempt. It gives up as soon as the context of the call is done.
+type RetryStorage struct {
+	ratelimiter.Storage
+
+	attempts int
+	backoff  time.Duration
+}
+
+func NewRetryStorage(storage ratelimiter.Storage, attempts int, backoff time.Duration) *RetryStorage {
+	return &RetryStorage{Storage: storage, attempts: attempts, backoff: backoff}
+}
+
+// retry runs op until it succeeds, fails with a non-transient error or runs out of
+// attempts
+func (r *RetryStorage) retry(ctx context.Context, op func() error) error {
+	err := op()
+	backoff := r.backoff
+	for attempt := 0; attempt < r.attempts && IsTransient(err); attempt++ {
+		// Full jitter keeps instances that failed together from retrying together
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff) + 1)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+		err = op()
+	}
+	return err
+}
+
+func (r *RetryStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLimit, error) {
+	var rateLimit *ratelimiter.RateLimit
+	err := r.retry(ctx, func() (err error) {
+		rateLimit, err = r.Storage.Get(ctx, key)
+		return err
+	})
+	return rateLimit, err
+}
+
+func (r *RetryStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
+	return r.retry(ctx, func() error {
+		return r.Storage.Set(ctx, key, rateLimit, expiration)
+	})
+}
+
+func (r *RetryStorage) GetMulti(ctx context.Context, keys []string) ([]*ratelimiter.RateLimit, error) {
+	var rateLimits []*ratelimiter.RateLimit
+	err := r.retry(ctx, func() (err error) {
+		rateLimits, err = r.Storage.GetMulti(ctx, keys)
+		return err
+	})
+	return rateLimits, err
+}
+
+func (r *RetryStorage) SetMulti(ctx context.Context, entries []ratelimiter.RateLimitEntry) error {
+	return r.retry(ctx, func() error {
+		return r.Storage.SetMulti(ctx, entries)
+	})
+}
+
+func (r *RetryStorage) Delete(ctx context.Context, key string) error {
+	return r.retry(ctx, func() error {
+		return r.Storage.Delete(ctx, key)
+	})
+}
+
+// AllowWindows retries the atomic check of the wrapped storage
+func (r *RetryStorage) AllowWindows(ctx context.Context, checks []ratelimiter.WindowCheck, cost int, now time.Time) (ratelimiter.Result, error) {
+	atomic, ok := r.Storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return ratelimiter.Result{}, ratelimiter.ErrNotAtomic
+	}
+
+	var result ratelimiter.Result
+	err := r.retry(ctx, func() (err error) {
+		result, err = atomic.AllowWindows(ctx, checks, cost, now)
+		return err
+	})
+	return result, err
+}
+
+// Consume retries the atomic add of the wrapped storage
+func (r *RetryStorage) Consume(ctx context.Context, key string, cost int, start time.Time, expiration time.Duration) (int, error) {
+	atomic, ok := r.Storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return 0, ratelimiter.ErrNotAtomic
+	}
+
+	var count int
+	err := r.retry(ctx, func() (err error) {
+		count, err = atomic.Consume(ctx, key, cost, start, expiration)
+		return err
+	})
+	return count, err
+}
+
+// Refund retries the atomic refund of the wrapped storage
+func (r *RetryStorage) Refund(ctx context.Context, key string, cost int, at time.Time) error {
+	atomic, ok := r.Storage.(ratelimiter.AtomicStorage)
+	if !ok {
+		return ratelimiter.ErrNotAtomic
+	}
+	return r.retry(ctx, func() error {
+		return atomic.Refund(ctx, key, cost, at)
+	})
+}
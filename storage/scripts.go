@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"embed"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ScriptBundleVersion is the version of the Lua scripts in storage/lua. Bump it when a
+// script changes what it stores, so a rolling deploy never mixes incompatible scripts
+// under the same SHA.
+const ScriptBundleVersion = 3
+
+//go:embed lua/*.lua
+var luaFiles embed.FS
+
+// scriptBundle holds every script the Redis storage runs. Each one is the prelude, with
+// the shared time and storage helpers, followed by the script itself.
+type scriptBundle struct {
+	fixedWindow  *redis.Script
+	consume      *redis.Script
+	refund       *redis.Script
+	acquireLease *redis.Script
+	releaseLease *redis.Script
+}
+
+var scripts = newScriptBundle()
+
+func newScriptBundle() scriptBundle {
+	prelude := fmt.Sprintf("-- bundle v%d\n%s\n", ScriptBundleVersion, readLuaFile("prelude"))
+	script := func(name string) *redis.Script {
+		return redis.NewScript(prelude + readLuaFile(name))
+	}
+
+	return scriptBundle{
+		fixedWindow:  script("fixed_window"),
+		consume:      script("consume"),
+		refund:       script("refund"),
+		acquireLease: script("acquire_lease"),
+		releaseLease: script("release_lease"),
+	}
+}
+
+func readLuaFile(name string) string {
+	data, err := luaFiles.ReadFile("lua/" + name + ".lua")
+	if err != nil {
+		panic(fmt.Sprintf("missing embedded script %s: %v", name, err))
+	}
+	return string(data)
+}
+
+func (b scriptBundle) all() []*redis.Script {
+	return []*redis.Script{b.fixedWindow, b.consume, b.refund, b.acquireLease, b.releaseLease}
+}
+
+// loadScripts runs SCRIPT LOAD for the whole bundle, on every master in cluster mode, so
+// checks run with EVALSHA from the first request. A node that later loses its scripts
+// (restart, failover, SCRIPT FLUSH) gets them back through the EVAL fallback of
+// redis.Script.Run on NOSCRIPT.
+func loadScripts(ctx context.Context, client redis.UniversalClient) error {
+	load := func(ctx context.Context, client redis.Scripter) error {
+		for _, script := range scripts.all() {
+			if err := script.Load(ctx, client).Err(); err != nil {
+				return fmt.Errorf("failed to load Redis scripts: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return load(ctx, client)
+		})
+	}
+	return load(ctx, client)
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+const secretEnvSuffix = "_FROM_SECRET"
+
+// SecretsProvider fetches secret values. A reference is "<name>" or "<name>#<field>",
+// where field selects a key of a structured secret.
+type SecretsProvider interface {
+	GetSecret(ctx context.Context, ref string) (string, error)
+}
+
+// NewSecretsProvider returns the provider selected by SECRETS_PROVIDER (vault or aws),
+// or nil when no provider is configured
+func NewSecretsProvider() (SecretsProvider, error) {
+	switch provider := os.Getenv("SECRETS_PROVIDER"); provider {
+	case "":
+		return nil, nil
+	case "vault":
+		addr := os.Getenv("VAULT_ADDR")
+		if addr == "" {
+			return nil, fmt.Errorf("VAULT_ADDR is required for the vault secrets provider")
+		}
+		return &VaultProvider{
+			addr:      strings.TrimSuffix(addr, "/"),
+			token:     os.Getenv("VAULT_TOKEN"),
+			namespace: os.Getenv("VAULT_NAMESPACE"),
+			client:    &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	case "aws":
+		region := getEnvOrDefault("AWS_REGION", os.Getenv("AWS_DEFAULT_REGION"))
+		if region == "" {
+			return nil, fmt.Errorf("AWS_REGION is required for the aws secrets provider")
+		}
+		return &AWSSecretsManagerProvider{
+			region: region,
+			credentials: awsCredentials{
+				accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+				secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			},
+			client: &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown secrets provider: %s", provider)
+	}
+}
+
+// LoadSecrets resolves the secret-backed env variables before LoadConfig reads them.
+// It returns nil when no secrets provider is configured.
+func LoadSecrets(ctx context.Context) (*Secrets, error) {
+	godotenv.Load()
+
+	provider, err := NewSecretsProvider()
+	if err != nil || provider == nil {
+		return nil, err
+	}
+
+	secrets := NewSecrets(provider)
+	if _, err := secrets.Refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+// SecretsRefreshInterval returns how often secrets are re-fetched to pick up rotations
+func SecretsRefreshInterval() time.Duration {
+	return time.Duration(getEnvInt("SECRETS_REFRESH_INTERVAL", 300)) * time.Second
+}
+
+// Secrets resolves every <VAR>_FROM_SECRET env variable into <VAR>, so any setting
+// (Redis password, admin token, HMAC secrets...) can come from the provider
+type Secrets struct {
+	provider SecretsProvider
+
+	mu     sync.RWMutex
+	refs   map[string]string
+	values map[string]string
+}
+
+func NewSecrets(provider SecretsProvider) *Secrets {
+	refs := make(map[string]string)
+	for _, env := range os.Environ() {
+		key, value, found := strings.Cut(env, "=")
+		if found && strings.HasSuffix(key, secretEnvSuffix) && value != "" {
+			refs[strings.TrimSuffix(key, secretEnvSuffix)] = value
+		}
+	}
+
+	return &Secrets{
+		provider: provider,
+		refs:     refs,
+		values:   make(map[string]string),
+	}
+}
+
+// Get returns the current value of a secret-backed variable
+func (s *Secrets) Get(name string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.values[name]
+}
+
+// Has reports whether a variable is backed by the secrets provider
+func (s *Secrets) Has(name string) bool {
+	_, exists := s.refs[name]
+	return exists
+}
+
+// Refresh fetches every referenced secret, exports it to the environment so
+// LoadConfig picks it up, and returns the names whose value changed
+func (s *Secrets) Refresh(ctx context.Context) ([]string, error) {
+	names := make([]string, 0, len(s.refs))
+	for name := range s.refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var changed []string
+	for _, name := range names {
+		value, err := s.provider.GetSecret(ctx, s.refs[name])
+		if err != nil {
+			return changed, fmt.Errorf("failed to fetch secret for %s: %w", name, err)
+		}
+
+		s.mu.Lock()
+		if s.values[name] != value {
+			s.values[name] = value
+			changed = append(changed, name)
+		}
+		s.mu.Unlock()
+
+		os.Setenv(name, value)
+	}
+
+	return changed, nil
+}
+
+// Watch refreshes the secrets every interval and calls onRotate with the changed names
+func (s *Secrets) Watch(ctx context.Context, interval time.Duration, onRotate func(changed []string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := s.Refresh(ctx)
+			if err != nil {
+				slog.Error("Failed to refresh secrets", "error", err)
+			}
+			if len(changed) > 0 {
+				onRotate(changed)
+			}
+		}
+	}
+}
+
+func splitSecretRef(ref string) (name, field string) {
+	name, field, _ = strings.Cut(ref, "#")
+	return name, field
+}
+
+// selectField returns the field of a structured secret, or the raw value when no field is set
+func selectField(data map[string]interface{}, raw, field string) (string, error) {
+	if field == "" {
+		return raw, nil
+	}
+
+	value, exists := data[field]
+	if !exists {
+		return "", fmt.Errorf("field %q not found in secret", field)
+	}
+	return fmt.Sprint(value), nil
+}
+
+// VaultProvider reads secrets from HashiCorp Vault KV engines (v1 or v2)
+type VaultProvider struct {
+	addr      string
+	token     string
+	namespace string
+	client    *http.Client
+}
+
+func (v *VaultProvider) GetSecret(ctx context.Context, ref string) (string, error) {
+	path, field := splitSecretRef(ref)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach Vault: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s", resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode Vault response: %w", err)
+	}
+
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	if field == "" {
+		field = "value"
+	}
+
+	return selectField(data, "", field)
+}
+
+// AWSSecretsManagerProvider reads secrets from AWS Secrets Manager using static
+// credentials and a SigV4 signed GetSecretValue call
+type AWSSecretsManagerProvider struct {
+	region      string
+	credentials awsCredentials
+	client      *http.Client
+}
+
+func (a *AWSSecretsManagerProvider) GetSecret(ctx context.Context, ref string) (string, error) {
+	secretID, field := splitSecretRef(ref)
+
+	payload, err := json.Marshal(map[string]string{"SecretId": secretID})
+	if err != nil {
+		return "", err
+	}
+
+	host := fmt.Sprintf("secretsmanager.%s.amazonaws.com", a.region)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+host+"/", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequest(req, a.credentials, a.region, "secretsmanager", payload, time.Now().UTC())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach AWS Secrets Manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("AWS Secrets Manager returned %s: %s", resp.Status, message)
+	}
+
+	var body struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode AWS Secrets Manager response: %w", err)
+	}
+
+	var data map[string]interface{}
+	if field != "" {
+		if err := json.Unmarshal([]byte(body.SecretString), &data); err != nil {
+			return "", fmt.Errorf("secret is not a JSON object: %w", err)
+		}
+	}
+
+	return selectField(data, body.SecretString, field)
+}
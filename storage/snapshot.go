@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	ratelimiter "rate-limiter"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStreamSink appends snapshots to a Redis stream capped at maxEntries
+type RedisStreamSink struct {
+	client     redis.UniversalClient
+	stream     string
+	maxEntries int64
+}
+
+func NewRedisStreamSink(config ratelimiter.StorageConfig, stream string, maxEntries int64) (*RedisStreamSink, error) {
+	rdb, err := newRedisClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisStreamSink{
+		client:     rdb,
+		stream:     config.KeyPrefix + stream,
+		maxEntries: maxEntries,
+	}, nil
+}
+
+func (s *RedisStreamSink) Write(ctx context.Context, data []byte) error {
+	err := s.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.stream,
+		MaxLen: s.maxEntries,
+		Approx: true,
+		Values: map[string]interface{}{"snapshot": data},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to add snapshot to Redis stream: %w", err)
+	}
+
+	return nil
+}
+
+func (s *RedisStreamSink) Close() error {
+	return s.client.Close()
+}
+
+// FileSink appends snapshots as JSON lines, rotating the file to <path>.1 once it
+// grows past maxBytes so at most two files are retained
+type FileSink struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+}
+
+func NewFileSink(path string, maxBytes int64) (*FileSink, error) {
+	sink := &FileSink{
+		path:     path,
+		maxBytes: maxBytes,
+	}
+
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+
+	return sink, nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat snapshot file: %w", err)
+	}
+
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileSink) Write(ctx context.Context, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxBytes > 0 && s.size+int64(len(data))+1 > s.maxBytes {
+		s.file.Close()
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return fmt.Errorf("failed to rotate snapshot file: %w", err)
+		}
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(append(data, '\n'))
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
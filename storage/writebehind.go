@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	ratelimiter "rate-limiter"
+	"sync"
+	"time"
+)
+
+type pendingWrite struct {
+	rateLimit  ratelimiter.RateLimit
+	expiration time.Duration
+	setAt      time.Time
+}
+
+// WriteBehindStorage buffers counter writes in memory and flushes them to the
+// underlying storage every flushInterval or once maxPending writes are buffered.
+//
+// Reads of buffered keys are served from the buffer, so this instance always sees
+// its own increments. Increments from other instances become visible after their
+// next flush. If the process crashes, at most flushInterval worth of writes (and
+// never more than maxPending writes) are lost.
+type WriteBehindStorage struct {
+	ratelimiter.Storage
+
+	flushInterval time.Duration
+	maxPending    int
+
+	mu      sync.Mutex
+	pending map[string]pendingWrite
+	writes  int
+
+	flushCh chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func NewWriteBehindStorage(storage ratelimiter.Storage, flushInterval time.Duration, maxPending int) *WriteBehindStorage {
+	w := &WriteBehindStorage{
+		Storage:       storage,
+		flushInterval: flushInterval,
+		maxPending:    maxPending,
+		pending:       make(map[string]pendingWrite),
+		flushCh:       make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w
+}
+
+func (w *WriteBehindStorage) run() {
+	defer close(w.stopped)
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			w.Flush(context.Background())
+			return
+		case <-ticker.C:
+			w.Flush(context.Background())
+		case <-w.flushCh:
+			w.Flush(context.Background())
+		}
+	}
+}
+
+func (w *WriteBehindStorage) Get(ctx context.Context, key string) (*ratelimiter.RateLimit, error) {
+	w.mu.Lock()
+	write, exists := w.pending[key]
+	w.mu.Unlock()
+
+	if exists {
+		rateLimit := write.rateLimit
+		return &rateLimit, nil
+	}
+
+	return w.Storage.Get(ctx, key)
+}
+
+func (w *WriteBehindStorage) Set(ctx context.Context, key string, rateLimit *ratelimiter.RateLimit, expiration time.Duration) error {
+	w.mu.Lock()
+	w.pending[key] = pendingWrite{
+		rateLimit:  *rateLimit,
+		expiration: expiration,
+		setAt:      time.Now(),
+	}
+	w.writes++
+	full := w.maxPending > 0 && w.writes >= w.maxPending
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.flushCh <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// GetMulti serves the pending writes and reads the other keys from the underlying storage
+func (w *WriteBehindStorage) GetMulti(ctx context.Context, keys []string) ([]*ratelimiter.RateLimit, error) {
+	rateLimits := make([]*ratelimiter.RateLimit, len(keys))
+	var missing []string
+	var positions []int
+
+	w.mu.Lock()
+	for i, key := range keys {
+		if write, exists := w.pending[key]; exists {
+			rateLimit := write.rateLimit
+			rateLimits[i] = &rateLimit
+			continue
+		}
+		missing = append(missing, key)
+		positions = append(positions, i)
+	}
+	w.mu.Unlock()
+
+	if len(missing) == 0 {
+		return rateLimits, nil
+	}
+	stored, err := w.Storage.GetMulti(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	for i, rateLimit := range stored {
+		rateLimits[positions[i]] = rateLimit
+	}
+	return rateLimits, nil
+}
+
+// SetMulti buffers every counter like Set
+func (w *WriteBehindStorage) SetMulti(ctx context.Context, entries []ratelimiter.RateLimitEntry) error {
+	for _, entry := range entries {
+		if err := w.Set(ctx, entry.Key, entry.RateLimit, entry.Expiration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *WriteBehindStorage) Delete(ctx context.Context, key string) error {
+	w.mu.Lock()
+	delete(w.pending, key)
+	w.mu.Unlock()
+
+	return w.Storage.Delete(ctx, key)
+}
+
+func (w *WriteBehindStorage) List(ctx context.Context) ([]string, error) {
+	keys, err := w.Storage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		seen[key] = struct{}{}
+	}
+
+	w.mu.Lock()
+	for key := range w.pending {
+		if _, exists := seen[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	w.mu.Unlock()
+
+	return keys, nil
+}
+
+// Flush writes every buffered counter to the underlying storage
+func (w *WriteBehindStorage) Flush(ctx context.Context) {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = make(map[string]pendingWrite, len(pending))
+	w.writes = 0
+	w.mu.Unlock()
+
+	for key, write := range pending {
+		expiration := write.expiration - time.Since(write.setAt)
+		if expiration <= 0 {
+			continue
+		}
+
+		rateLimit := write.rateLimit
+		if err := w.Storage.Set(ctx, key, &rateLimit, expiration); err != nil {
+			slog.Error("Failed to flush counter", "key", RedactKey(key), "error", err)
+		}
+	}
+}
+
+// Close flushes the pending writes and closes the underlying storage
+func (w *WriteBehindStorage) Close() error {
+	close(w.done)
+	<-w.stopped
+
+	return w.Storage.Close()
+}
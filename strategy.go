@@ -0,0 +1,89 @@
+package ratelimiter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Strategy is a rate limiting algorithm kept outside this module. Registered under a
+// name, it is selected like the built-in algorithms: WithAlgorithm, TOKEN_<name>_ALGORITHM
+// or POLICY_<name>_ALGORITHM. Limits of 0 and below are handled by the Limiter before the
+// strategy is called, and cost is at least 1.
+type Strategy interface {
+	Allow(ctx context.Context, storage Storage, key string, limits Limits, window time.Duration, cost int, now time.Time) (Result, error)
+}
+
+// StrategyFunc adapts a function to Strategy
+type StrategyFunc func(ctx context.Context, storage Storage, key string, limits Limits, window time.Duration, cost int, now time.Time) (Result, error)
+
+func (f StrategyFunc) Allow(ctx context.Context, storage Storage, key string, limits Limits, window time.Duration, cost int, now time.Time) (Result, error) {
+	return f(ctx, storage, key, limits, window, cost, now)
+}
+
+var (
+	strategiesMu sync.RWMutex
+	strategies   = make(map[string]Strategy)
+)
+
+// RegisterStrategy makes a strategy available under name. It is meant to be called from
+// the init function of the package implementing it, and panics when the name is taken,
+// by a built-in algorithm or another strategy.
+func RegisterStrategy(name string, strategy Strategy) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+
+	if strategy == nil {
+		panic("ratelimiter: RegisterStrategy strategy is nil")
+	}
+	if _, exists := strategies[name]; exists || isBuiltinAlgorithm(name) {
+		panic(fmt.Sprintf("ratelimiter: RegisterStrategy called twice for %q", name))
+	}
+	strategies[name] = strategy
+}
+
+// UnregisterStrategy removes a registered strategy, so a test can register it again
+func UnregisterStrategy(name string) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+
+	delete(strategies, name)
+}
+
+// Algorithms returns the built-in algorithms followed by the registered strategies,
+// sorted by name
+func Algorithms() []string {
+	strategiesMu.RLock()
+	defer strategiesMu.RUnlock()
+
+	registered := make([]string, 0, len(strategies))
+	for name := range strategies {
+		registered = append(registered, name)
+	}
+	sort.Strings(registered)
+	return append([]string{AlgorithmFixedWindow, AlgorithmTokenBucket, AlgorithmLeakyBucket}, registered...)
+}
+
+// IsAlgorithm reports whether name is a built-in algorithm or a registered strategy
+func IsAlgorithm(name string) bool {
+	_, registered := lookupStrategy(name)
+	return isBuiltinAlgorithm(name) || registered
+}
+
+func isBuiltinAlgorithm(name string) bool {
+	switch name {
+	case AlgorithmFixedWindow, AlgorithmTokenBucket, AlgorithmLeakyBucket:
+		return true
+	}
+	return false
+}
+
+func lookupStrategy(name string) (Strategy, bool) {
+	strategiesMu.RLock()
+	defer strategiesMu.RUnlock()
+
+	strategy, exists := strategies[name]
+	return strategy, exists
+}